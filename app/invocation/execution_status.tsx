@@ -1,4 +1,5 @@
-import { ExtendedBuildBuddyService, ServerStreamHandler, ServerStream } from "../service/rpc_service";
+import Long from "long";
+import { Cancelable, ExtendedBuildBuddyService, ServerStreamHandler, ServerStream } from "../service/rpc_service";
 import { execution_stats } from "../../proto/execution_stats_ts_proto";
 import { build } from "../../proto/remote_execution_ts_proto";
 import { streamWithRetry } from "../util/rpc";
@@ -37,6 +38,68 @@ export function waitExecution(
   );
 }
 
+/** Output of a running execution, as read so far. */
+export type ExecutionOutput = {
+  stdout: string;
+  stderr: string;
+};
+
+/**
+ * Live-streams the output of a running execution using the
+ * ReadExecutionOutput API. The handler is called with all of the output that
+ * has been read so far whenever new output is read.
+ */
+export function readExecutionOutput(
+  rpcService: ExtendedBuildBuddyService,
+  executionId: string,
+  handler: ServerStreamHandler<ExecutionOutput>
+): Cancelable {
+  const stdout = new OutputBuffer();
+  const stderr = new OutputBuffer();
+  return streamWithRetry(
+    rpcService.readExecutionOutput,
+    // If the stream is retried, resume from where we left off.
+    () =>
+      new execution_stats.ReadExecutionOutputRequest({
+        executionId,
+        stdoutOffset: Long.fromNumber(stdout.offset),
+        stderrOffset: Long.fromNumber(stderr.offset),
+      }),
+    {
+      next: (response) => {
+        if (!response.output) return;
+        stdout.append(Number(response.output.stdoutOffset), response.output.stdout);
+        stderr.append(Number(response.output.stderrOffset), response.output.stderr);
+        handler.next({ stdout: stdout.text, stderr: stderr.text });
+      },
+      error: (e) => handler.error(e),
+      complete: () => handler.complete(),
+    }
+  );
+}
+
+/** Accumulates the output read from a single output stream. */
+class OutputBuffer {
+  /** Offset of the end of the output that has been read so far. */
+  offset = 0;
+  text = "";
+  private decoder = new TextDecoder();
+
+  append(offset: number, data: Uint8Array) {
+    if (offset < this.offset) {
+      // The command was restarted, so its output starts over.
+      this.text = "";
+      this.decoder = new TextDecoder();
+    } else if (offset > this.offset) {
+      // Some output is no longer available.
+      this.text += this.decoder.decode() + (this.text ? "\n" : "") + "[... output truncated ...]\n";
+      this.decoder = new TextDecoder();
+    }
+    this.text += this.decoder.decode(data, { stream: true });
+    this.offset = offset + data.length;
+  }
+}
+
 export function executionStatusLabel(op: ExecuteOperation) {
   if (op.done) {
     return "Completed";
@@ -32,6 +32,7 @@ import InvocationTabsComponent, { getActiveTab } from "./invocation_tabs";
 import TimingCardComponent from "./invocation_timing_card";
 import FileCardComponent from "./invocation_file_card";
 import SpawnCardComponent from "./invocation_spawn_card";
+import SpawnRecordsCardComponent from "./invocation_spawn_records_card";
 import InvocationExecLogCardComponent from "./invocation_exec_log_card";
 import InvocationActionCardComponent from "./invocation_action_card";
 import TargetsComponent from "./invocation_targets";
@@ -664,6 +665,13 @@ export default class InvocationComponent extends React.Component<Props, State> {
             />
           )}
 
+          {activeTab === "spawns" && capabilities.config.spawnRecordsEnabled && (
+            <SpawnRecordsCardComponent
+              model={this.state.model}
+              filter={this.props.search.get("spawnFilter") ?? ""}
+            />
+          )}
+
           {activeTab === "spawns" && (
             <SpawnCardComponent
               model={this.state.model}
@@ -26,7 +26,13 @@ import Dialog, {
 } from "../components/dialog/dialog";
 import Button, { OutlinedButton } from "../components/button/button";
 import Modal from "../components/modal/modal";
-import { ExecuteOperation, executionStatusLabel, waitExecution } from "./execution_status";
+import {
+  ExecuteOperation,
+  ExecutionOutput,
+  executionStatusLabel,
+  readExecutionOutput,
+  waitExecution,
+} from "./execution_status";
 import capabilities from "../capabilities/capabilities";
 import { getErrorReason } from "../util/rpc";
 import rpc_service from "../service/rpc_service";
@@ -69,6 +75,7 @@ interface State {
   stdout?: string;
   serverLogs?: ServerLog[];
   lastOperation?: ExecuteOperation;
+  liveOutput?: ExecutionOutput;
   profileLoading: boolean;
   profile?: Profile;
 }
@@ -135,12 +142,19 @@ export default class InvocationActionCardComponent extends React.Component<Props
   }
 
   private operationStream?: Cancelable;
+  private outputStream?: Cancelable;
+
+  componentWillUnmount() {
+    this.outputStream?.cancel();
+  }
 
   streamExecution() {
     if (!capabilities.config.streamingHttpEnabled) return;
 
     this.operationStream?.cancel();
-    this.setState({ lastOperation: undefined });
+    this.outputStream?.cancel();
+    this.outputStream = undefined;
+    this.setState({ lastOperation: undefined, liveOutput: undefined });
     const executionId = this.props.search.get("executionId");
     if (!executionId) return;
 
@@ -157,6 +171,15 @@ export default class InvocationActionCardComponent extends React.Component<Props
         }
 
         this.setState({ lastOperation: operation });
+        // If the executor is streaming the command's output, show it until
+        // the execution completes.
+        if (operation.metadata?.stdoutStreamName && !operation.done && !this.outputStream) {
+          this.outputStream = readExecutionOutput(service, executionId, {
+            next: (liveOutput) => this.setState({ liveOutput }),
+            error: (error) => console.log(error),
+            complete: () => {},
+          });
+        }
         if (operation.response && !this.state.executeResponse) {
           this.setState({ executeResponse: operation.response });
           console.log(operation.response);
@@ -1027,6 +1050,36 @@ export default class InvocationActionCardComponent extends React.Component<Props
                             : "Unknown"}
                       </div>
                     </div>
+                    {!this.state.executeResponse && this.state.liveOutput && (
+                      <>
+                        <div className="action-section">
+                          <div className="action-property-title">Stderr</div>
+                          <div>
+                            {this.state.liveOutput.stderr ? (
+                              <TerminalComponent
+                                value={this.state.liveOutput.stderr}
+                                lightTheme={this.props.preferences.lightTerminalEnabled}
+                              />
+                            ) : (
+                              <div>None</div>
+                            )}
+                          </div>
+                        </div>
+                        <div className="action-section">
+                          <div className="action-property-title">Stdout</div>
+                          <div>
+                            {this.state.liveOutput.stdout ? (
+                              <TerminalComponent
+                                value={this.state.liveOutput.stdout}
+                                lightTheme={this.props.preferences.lightTerminalEnabled}
+                              />
+                            ) : (
+                              <div>None</div>
+                            )}
+                          </div>
+                        </div>
+                      </>
+                    )}
                     {this.state.executeResponse && (
                       <>
                         <div className="action-section">
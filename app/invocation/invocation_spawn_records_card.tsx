@@ -0,0 +1,193 @@
+import React from "react";
+import { XCircle } from "lucide-react";
+import InvocationModel from "./invocation_model";
+import rpcService from "../service/rpc_service";
+import errorService from "../errors/error_service";
+import format from "../format/format";
+import { spawn_record } from "../../proto/spawn_record_ts_proto";
+import { FilledButton, OutlinedButton } from "../components/button/button";
+import TextInput from "../components/input/input";
+
+interface Props {
+  model: InvocationModel;
+  filter: string;
+}
+
+interface State {
+  loading: boolean;
+  spawns: spawn_record.GetSpawnsResponse.Spawn[];
+  nextPageToken: string;
+  // The baseline invocation ID being typed into the input.
+  baselineInput: string;
+  // The baseline invocation ID that the current spawns were compared with.
+  baselineInvocationId: string;
+}
+
+// How many input and env var differences to show per spawn.
+const MAX_DIFFS_SHOWN = 10;
+
+/**
+ * Lists the spawns of the invocation that missed the cache, using the spawn
+ * records stored when the invocation's compact execution log was ingested.
+ * If a baseline invocation is entered, each cache miss is explained by
+ * comparing the spawn with the spawn that produced the same output in the
+ * baseline invocation.
+ */
+export default class SpawnRecordsCardComponent extends React.Component<Props, State> {
+  state: State = {
+    loading: true,
+    spawns: [],
+    nextPageToken: "",
+    baselineInput: "",
+    baselineInvocationId: "",
+  };
+
+  componentDidMount() {
+    this.fetchSpawns("");
+  }
+
+  componentDidUpdate(prevProps: Props) {
+    if (this.props.model !== prevProps.model) {
+      this.fetchSpawns(this.state.baselineInvocationId);
+    }
+  }
+
+  fetchSpawns(baselineInvocationId: string, pageToken = "") {
+    this.setState({ loading: true });
+    rpcService.service
+      .getSpawns(
+        new spawn_record.GetSpawnsRequest({
+          invocationId: this.props.model.getInvocationId(),
+          filter: new spawn_record.GetSpawnsRequest.Filter({ cacheMissOnly: true }),
+          baselineInvocationId,
+          pageToken,
+        })
+      )
+      .then((response) => {
+        this.setState({
+          spawns: pageToken ? [...this.state.spawns, ...response.spawns] : response.spawns,
+          nextPageToken: response.nextPageToken,
+          baselineInvocationId,
+        });
+      })
+      .catch((e) => errorService.handleError(e))
+      .finally(() => this.setState({ loading: false }));
+  }
+
+  handleBaselineInputChange(e: React.ChangeEvent<HTMLInputElement>) {
+    this.setState({ baselineInput: e.target.value });
+  }
+
+  handleCompareClicked(e: React.FormEvent) {
+    e.preventDefault();
+    this.fetchSpawns(this.state.baselineInput.trim());
+  }
+
+  handleMoreClicked() {
+    this.fetchSpawns(this.state.baselineInvocationId, this.state.nextPageToken);
+  }
+
+  renderExplanation(explanation: spawn_record.CacheMissExplanation) {
+    if (!explanation.baselineFound) {
+      return <div className="spawn-record-explanation">No spawn with this output ran in the baseline invocation.</div>;
+    }
+    if (explanation.sameDigest) {
+      return (
+        <div className="spawn-record-explanation">
+          The spawn did not change since the baseline invocation. Its result may not have been written to the cache,
+          or it may have been evicted.
+        </div>
+      );
+    }
+    return (
+      <div className="spawn-record-explanation">
+        {explanation.inputDiffs.length > 0 && (
+          <div>
+            <div>
+              {format.formatWithCommas(explanation.inputDiffs.length)} changed input
+              {explanation.inputDiffs.length === 1 ? "" : "s"}
+              {explanation.inputsTruncated && " (may be incomplete)"}:
+            </div>
+            {explanation.inputDiffs.slice(0, MAX_DIFFS_SHOWN).map((diff) => (
+              <div key={diff.path} className="spawn-record-diff">
+                {diff.path}: {diff.oldDigest || "(added)"} → {diff.newDigest || "(removed)"}
+              </div>
+            ))}
+          </div>
+        )}
+        {explanation.envDiffs.length > 0 && (
+          <div>
+            <div>Changed environment variables:</div>
+            {explanation.envDiffs.slice(0, MAX_DIFFS_SHOWN).map((diff) => (
+              <div key={diff.name} className="spawn-record-diff">
+                {diff.name}: "{diff.oldValue}" → "{diff.newValue}"
+              </div>
+            ))}
+          </div>
+        )}
+        {explanation.newArgs.length > 0 && <div>The command line arguments changed.</div>}
+      </div>
+    );
+  }
+
+  render() {
+    const filter = this.props.filter.toLowerCase();
+    const spawns = this.state.spawns.filter(
+      (s) =>
+        !filter ||
+        s.record?.targetLabel.toLowerCase().includes(filter) ||
+        s.record?.mnemonic.toLowerCase().includes(filter) ||
+        s.record?.primaryOutput.toLowerCase().includes(filter)
+    );
+
+    return (
+      <div className="card expanded">
+        <XCircle className="icon red" />
+        <div className="content">
+          <div className="invocation-content-header">
+            <div className="title">Cache misses</div>
+            <form className="invocation-sort-controls" onSubmit={this.handleCompareClicked.bind(this)}>
+              <TextInput
+                placeholder="Baseline invocation ID"
+                value={this.state.baselineInput}
+                onChange={this.handleBaselineInputChange.bind(this)}
+              />
+              <FilledButton type="submit" disabled={this.state.loading}>
+                Explain misses
+              </FilledButton>
+            </form>
+          </div>
+          {!this.state.loading && !spawns.length && (
+            <div className="invocation-execution-empty-state">No cache misses were recorded for this invocation.</div>
+          )}
+          <div className="invocation-execution-table">
+            {spawns.map((spawn) => (
+              <div key={spawn.record?.primaryOutput} className="invocation-execution-row">
+                <div>
+                  <div className="invocation-execution-row-header">
+                    <span className="invocation-execution-row-header-status">{spawn.record?.targetLabel}</span>
+                    <span>{spawn.record?.primaryOutput}</span>
+                  </div>
+                  <div className="invocation-execution-row-stats">
+                    {spawn.record?.duration && <div>Duration: {format.durationProto(spawn.record.duration)}</div>}
+                    <div>Mnemonic: {spawn.record?.mnemonic}</div>
+                    <div>Runner: {spawn.record?.runner}</div>
+                    <div>Cacheable: {spawn.record?.cacheable ? "true" : "false"}</div>
+                    <div>Remote cacheable: {spawn.record?.remoteCacheable ? "true" : "false"}</div>
+                  </div>
+                  {spawn.cacheMissExplanation && this.renderExplanation(spawn.cacheMissExplanation)}
+                </div>
+              </div>
+            ))}
+          </div>
+          {this.state.loading && <div className="loading" />}
+          {!this.state.loading && this.state.nextPageToken && (
+            <div className="more-buttons">
+              <OutlinedButton onClick={this.handleMoreClicked.bind(this)}>See more cache misses</OutlinedButton>
+            </div>
+          )}
+        </div>
+      </div>
+    );
+  }
+}
@@ -4,16 +4,23 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"maps"
 	"net/http"
 	"net/url"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/prom"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/hostedrunner"
 	"github.com/buildbuddy-io/buildbuddy/proto/workflow"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_compare"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_format"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_report"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_subscription"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/spawn_records"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/eventlog"
 	"github.com/buildbuddy-io/buildbuddy/server/http/protolet"
@@ -21,28 +28,42 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/target"
 	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/paging"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/durationpb"
 
 	api_common "github.com/buildbuddy-io/buildbuddy/server/api/common"
+	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
 	requestcontext "github.com/buildbuddy-io/buildbuddy/server/util/request_context"
 
 	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	cmpb "github.com/buildbuddy-io/buildbuddy/proto/api/v1/common"
 	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	cappb "github.com/buildbuddy-io/buildbuddy/proto/capability"
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
 	elpb "github.com/buildbuddy-io/buildbuddy/proto/eventlog"
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	gitpb "github.com/buildbuddy-io/buildbuddy/proto/git"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	inspb "github.com/buildbuddy-io/buildbuddy/proto/invocation_status"
+	pgpb "github.com/buildbuddy-io/buildbuddy/proto/pagination"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
 	rnpb "github.com/buildbuddy-io/buildbuddy/proto/runner"
+	sprpb "github.com/buildbuddy-io/buildbuddy/proto/spawn_record"
+	sfpb "github.com/buildbuddy-io/buildbuddy/proto/stat_filter"
+	trpb "github.com/buildbuddy-io/buildbuddy/proto/target"
 )
 
 var (
@@ -52,6 +73,11 @@ var (
 	enableMetricsAPI     = flag.Bool("api.enable_metrics_api", false, "If true, enable access to metrics API.")
 )
 
+const (
+	// The max number of targets returned in each GetTargetStats page.
+	targetStatsPageSize = 100
+)
+
 type APIServer struct {
 	env environment.Env
 }
@@ -180,6 +206,77 @@ func (s *APIServer) GetInvocation(ctx context.Context, req *apipb.GetInvocationR
 	}, nil
 }
 
+func (s *APIServer) SearchInvocation(ctx context.Context, req *apipb.SearchInvocationRequest) (*apipb.SearchInvocationResponse, error) {
+	user, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	searcher := s.env.GetInvocationSearchService()
+	if searcher == nil {
+		return nil, status.UnimplementedError("Invocation search is not configured")
+	}
+	query := req.GetQuery()
+	statuses := make([]inspb.OverallStatus, 0, len(query.GetStatus()))
+	for _, st := range query.GetStatus() {
+		statuses = append(statuses, inspb.OverallStatus(st))
+	}
+	repoURL, err := normalizeRepoURL(query.GetRepoUrl())
+	if err != nil {
+		return nil, err
+	}
+	searchRsp, err := searcher.QueryInvocations(ctx, &inpb.SearchInvocationRequest{
+		Query: &inpb.InvocationQuery{
+			// Always search the group that the API key belongs to.
+			GroupId:       user.GetGroupID(),
+			RepoUrl:       repoURL,
+			BranchName:    query.GetBranchName(),
+			CommitSha:     query.GetCommitSha(),
+			User:          query.GetUser(),
+			Host:          query.GetHost(),
+			Command:       query.GetCommand(),
+			Pattern:       query.GetPattern(),
+			Role:          query.GetRole(),
+			Tags:          query.GetTag(),
+			Status:        statuses,
+			UpdatedAfter:  query.GetUpdatedAfter(),
+			UpdatedBefore: query.GetUpdatedBefore(),
+		},
+		Count:     req.GetPageSize(),
+		PageToken: req.GetPageToken(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &apipb.SearchInvocationResponse{
+		Invocation:    make([]*apipb.Invocation, 0, len(searchRsp.GetInvocation())),
+		NextPageToken: searchRsp.GetNextPageToken(),
+	}
+	for _, in := range searchRsp.GetInvocation() {
+		rsp.Invocation = append(rsp.Invocation, &apipb.Invocation{
+			Id: &apipb.Invocation_Id{
+				InvocationId: in.GetInvocationId(),
+			},
+			Success:          in.GetSuccess(),
+			User:             in.GetUser(),
+			DurationUsec:     in.GetDurationUsec(),
+			Host:             in.GetHost(),
+			Command:          in.GetCommand(),
+			Pattern:          invocation_format.ShortFormatPatterns(in.GetPattern()),
+			ActionCount:      in.GetActionCount(),
+			CreatedAtUsec:    in.GetCreatedAtUsec(),
+			UpdatedAtUsec:    in.GetUpdatedAtUsec(),
+			RepoUrl:          in.GetRepoUrl(),
+			BranchName:       in.GetBranchName(),
+			CommitSha:        in.GetCommitSha(),
+			Role:             in.GetRole(),
+			BazelExitCode:    in.GetBazelExitCode(),
+			InvocationStatus: apipb.InvocationStatus(in.GetInvocationStatus()),
+		})
+	}
+	return rsp, nil
+}
+
 func (s *APIServer) CacheEnabled() bool {
 	return *enableCache
 }
@@ -255,6 +352,150 @@ func (s *APIServer) GetTarget(ctx context.Context, req *apipb.GetTargetRequest)
 	}, nil
 }
 
+// normalizeRepoURL normalizes the repo URL in an API request so that it
+// matches the repo URLs stored for invocations.
+func normalizeRepoURL(repoURL string) (string, error) {
+	if repoURL == "" {
+		return "", nil
+	}
+	u, err := gitutil.NormalizeRepoURL(repoURL)
+	if err != nil {
+		return "", status.InvalidArgumentErrorf("invalid repo_url %q: %s", repoURL, err)
+	}
+	return u.String(), nil
+}
+
+func (s *APIServer) GetTargetHistory(ctx context.Context, req *apipb.GetTargetHistoryRequest) (*apipb.GetTargetHistoryResponse, error) {
+	userInfo, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetRepoUrl() == "" {
+		return nil, status.InvalidArgumentError("GetTargetHistoryRequest must contain a valid repo_url")
+	}
+	repoURL, err := normalizeRepoURL(req.GetRepoUrl())
+	if err != nil {
+		return nil, err
+	}
+	historyRsp, err := target.GetTargetHistory(ctx, s.env, &trpb.GetTargetHistoryRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: userInfo.GetGroupID()},
+		Query: &trpb.TargetQuery{
+			RepoUrl:    repoURL,
+			BranchName: req.GetBranchName(),
+			Label:      req.GetLabel(),
+		},
+		ServerSidePagination: true,
+		PageToken:            req.GetPageToken(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &apipb.GetTargetHistoryResponse{
+		TargetHistory: make([]*apipb.TargetHistory, 0),
+		NextPageToken: historyRsp.GetNextPageToken(),
+	}
+	for _, h := range historyRsp.GetInvocationTargets() {
+		history := &apipb.TargetHistory{
+			Label:      h.GetTarget().GetLabel(),
+			RuleType:   h.GetTarget().GetRuleType(),
+			TargetType: h.GetTarget().GetTargetType(),
+			TestSize:   h.GetTarget().GetTestSize(),
+		}
+		for _, ts := range h.GetTargetStatus() {
+			history.Run = append(history.Run, &apipb.TargetRun{
+				InvocationId:            ts.GetInvocationId(),
+				CommitSha:               ts.GetCommitSha(),
+				Status:                  ts.GetStatus(),
+				Timing:                  ts.GetTiming(),
+				InvocationCreatedAtUsec: ts.GetInvocationCreatedAtUsec(),
+			})
+		}
+		rsp.TargetHistory = append(rsp.TargetHistory, history)
+	}
+	return rsp, nil
+}
+
+func (s *APIServer) GetTargetStats(ctx context.Context, req *apipb.GetTargetStatsRequest) (*apipb.GetTargetStatsResponse, error) {
+	repoURL, err := normalizeRepoURL(req.GetRepoUrl())
+	if err != nil {
+		return nil, err
+	}
+	pageToken := req.GetPageToken()
+	if pageToken == "" {
+		if pageToken, err = paging.EncodeOffsetLimit(&pgpb.OffsetLimit{Limit: targetStatsPageSize}); err != nil {
+			return nil, err
+		}
+	}
+	statsRsp, err := target.GetTargetStats(ctx, s.env, &trpb.GetTargetStatsRequest{
+		Labels:        req.GetLabel(),
+		Repo:          repoURL,
+		BranchName:    req.GetBranchName(),
+		StartedAfter:  req.GetStartedAfter(),
+		StartedBefore: req.GetStartedBefore(),
+		PageToken:     pageToken,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &apipb.GetTargetStatsResponse{
+		TargetStats:   make([]*apipb.TargetStats, 0, len(statsRsp.GetStats())),
+		NextPageToken: statsRsp.GetNextPageToken(),
+	}
+	for _, st := range statsRsp.GetStats() {
+		rsp.TargetStats = append(rsp.TargetStats, &apipb.TargetStats{
+			Label:              st.GetLabel(),
+			TotalRuns:          st.GetData().GetTotalRuns(),
+			SuccessfulRuns:     st.GetData().GetSuccessfulRuns(),
+			FlakyRuns:          st.GetData().GetFlakyRuns(),
+			LikelyFlakyRuns:    st.GetData().GetLikelyFlakyRuns(),
+			FailedRuns:         st.GetData().GetFailedRuns(),
+			TotalFlakeDuration: durationpb.New(time.Duration(st.GetData().GetTotalFlakeRuntimeUsec()) * time.Microsecond),
+		})
+	}
+	return rsp, nil
+}
+
+func (s *APIServer) GetTargetFlakeSamples(ctx context.Context, req *apipb.GetTargetFlakeSamplesRequest) (*apipb.GetTargetFlakeSamplesResponse, error) {
+	if req.GetLabel() == "" {
+		return nil, status.InvalidArgumentError("GetTargetFlakeSamplesRequest must contain a valid label")
+	}
+	repoURL, err := normalizeRepoURL(req.GetRepoUrl())
+	if err != nil {
+		return nil, err
+	}
+	samplesRsp, err := target.GetTargetFlakeSamples(ctx, s.env, &trpb.GetTargetFlakeSamplesRequest{
+		Label:         req.GetLabel(),
+		Repo:          repoURL,
+		BranchName:    req.GetBranchName(),
+		StartedAfter:  req.GetStartedAfter(),
+		StartedBefore: req.GetStartedBefore(),
+		PageToken:     req.GetPageToken(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &apipb.GetTargetFlakeSamplesResponse{
+		FlakeSample:   make([]*apipb.FlakeSample, 0, len(samplesRsp.GetSamples())),
+		NextPageToken: samplesRsp.GetNextPageToken(),
+	}
+	for _, sample := range samplesRsp.GetSamples() {
+		testResultID := sample.GetEvent().GetId().GetTestResult()
+		rsp.FlakeSample = append(rsp.FlakeSample, &apipb.FlakeSample{
+			InvocationId:            sample.GetInvocationId(),
+			InvocationStartTimeUsec: sample.GetInvocationStartTimeUsec(),
+			Status:                  sample.GetStatus(),
+			Run:                     testResultID.GetRun(),
+			Shard:                   testResultID.GetShard(),
+			Attempt:                 testResultID.GetAttempt(),
+			File:                    api_common.FilesFromOutput(sample.GetEvent().GetTestResult().GetTestActionOutput()),
+		})
+	}
+	return rsp, nil
+}
+
 func (s *APIServer) redisCachedActions(ctx context.Context, userInfo interfaces.UserInfo, iid, targetLabel string) ([]*apipb.Action, error) {
 	if !s.CacheEnabled() || s.env.GetMetricsCollector() == nil {
 		return nil, nil
@@ -336,6 +577,103 @@ func (s *APIServer) GetAction(ctx context.Context, req *apipb.GetActionRequest)
 	return rsp, nil
 }
 
+func (s *APIServer) SearchExecution(ctx context.Context, req *apipb.SearchExecutionRequest) (*apipb.SearchExecutionResponse, error) {
+	searcher := s.env.GetExecutionSearchService()
+	if searcher == nil {
+		return nil, status.UnimplementedError("Execution search is not configured")
+	}
+	query := req.GetQuery()
+	var dimensionFilters []*sfpb.DimensionFilter
+	addDimensionFilter := func(dimension sfpb.ExecutionDimensionType, value string) {
+		if value == "" {
+			return
+		}
+		dimensionFilters = append(dimensionFilters, &sfpb.DimensionFilter{
+			Dimension: &sfpb.Dimension{Execution: dimension.Enum()},
+			Value:     value,
+		})
+	}
+	addDimensionFilter(sfpb.ExecutionDimensionType_TARGET_LABEL_EXECUTION_DIMENSION, query.GetTargetLabel())
+	addDimensionFilter(sfpb.ExecutionDimensionType_ACTION_MNEMONIC_EXECUTION_DIMENSION, query.GetActionMnemonic())
+	addDimensionFilter(sfpb.ExecutionDimensionType_WORKER_EXECUTION_DIMENSION, query.GetWorker())
+	statuses := make([]espb.ExecutionStatus, 0, len(query.GetStatus()))
+	for _, st := range query.GetStatus() {
+		statuses = append(statuses, espb.ExecutionStatus(st))
+	}
+	repoURL, err := normalizeRepoURL(query.GetRepoUrl())
+	if err != nil {
+		return nil, err
+	}
+	searchRsp, err := searcher.SearchExecutions(ctx, &espb.SearchExecutionRequest{
+		Query: &espb.ExecutionQuery{
+			InvocationId:    query.GetInvocationId(),
+			ExecutionStatus: statuses,
+			DimensionFilter: dimensionFilters,
+			RepoUrl:         repoURL,
+			BranchName:      query.GetBranchName(),
+			CommitSha:       query.GetCommitSha(),
+			InvocationUser:  query.GetUser(),
+			Command:         query.GetCommand(),
+			UpdatedAfter:    query.GetUpdatedAfter(),
+			UpdatedBefore:   query.GetUpdatedBefore(),
+		},
+		Count:     req.GetPageSize(),
+		PageToken: req.GetPageToken(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &apipb.SearchExecutionResponse{
+		Execution:     make([]*apipb.Execution, 0, len(searchRsp.GetExecution())),
+		NextPageToken: searchRsp.GetNextPageToken(),
+	}
+	for _, e := range searchRsp.GetExecution() {
+		rsp.Execution = append(rsp.Execution, executionProtoToAPI(e))
+	}
+	return rsp, nil
+}
+
+// executionProtoToAPI converts an execution search result to the API
+// Execution proto.
+func executionProtoToAPI(in *espb.ExecutionWithInvocationMetadata) *apipb.Execution {
+	ex := in.GetExecution()
+	md := ex.GetExecutedActionMetadata()
+	out := &apipb.Execution{
+		Id: &apipb.Execution_Id{
+			InvocationId: in.GetInvocationMetadata().GetId(),
+			ExecutionId:  ex.GetExecutionId(),
+		},
+		TargetLabel:           ex.GetTargetLabel(),
+		ActionMnemonic:        ex.GetActionMnemonic(),
+		ActionDigestHash:      ex.GetActionDigest().GetHash(),
+		ActionDigestSizeBytes: ex.GetActionDigest().GetSizeBytes(),
+		ExitCode:              ex.GetExitCode(),
+		Worker:                md.GetWorker(),
+		QueuedTime:            md.GetQueuedTimestamp(),
+		WorkerTiming: &cmpb.Timing{
+			StartTime: md.GetWorkerStartTimestamp(),
+			Duration:  durationpb.New(md.GetWorkerCompletedTimestamp().AsTime().Sub(md.GetWorkerStartTimestamp().AsTime())),
+		},
+		CommandSnippet: ex.GetCommandSnippet(),
+		RepoUrl:        in.GetInvocationMetadata().GetRepoUrl(),
+		BranchName:     in.GetInvocationMetadata().GetBranchName(),
+		CommitSha:      in.GetInvocationMetadata().GetCommitSha(),
+		User:           in.GetInvocationMetadata().GetUser(),
+		Command:        in.GetInvocationMetadata().GetCommand(),
+	}
+	switch {
+	case ex.GetStatus().GetCode() != 0:
+		out.Status = apipb.ExecutionStatus_ERRORED_EXECUTION_STATUS
+		out.Error = ex.GetStatus()
+	case ex.GetExitCode() != 0:
+		out.Status = apipb.ExecutionStatus_FAILED_EXECUTION_STATUS
+	default:
+		out.Status = apipb.ExecutionStatus_SUCCEEDED_EXECUTION_STATUS
+	}
+	return out
+}
+
 func (s *APIServer) GetLog(ctx context.Context, req *apipb.GetLogRequest) (*apipb.GetLogResponse, error) {
 	// Check whether the user is authenticated. No need for the returned user
 	// here, because user filters will be applied by LookupInvocation.
@@ -366,6 +704,177 @@ func (s *APIServer) GetLog(ctx context.Context, req *apipb.GetLogRequest) (*apip
 	}, nil
 }
 
+func (s *APIServer) GetInvocationReport(ctx context.Context, req *apipb.GetInvocationReportRequest) (*apipb.GetInvocationReportResponse, error) {
+	// Check whether the user is authenticated. No need for the returned user
+	// here, because user filters will be applied by LookupInvocation.
+	if _, err := s.env.GetAuthenticator().AuthenticatedUser(ctx); err != nil {
+		return nil, err
+	}
+	iid := req.GetInvocationId()
+	if iid == "" {
+		return nil, status.InvalidArgumentError("invocation_id is required")
+	}
+
+	collector := invocation_report.NewCollector()
+	_, err := build_event_handler.LookupInvocationWithCallback(ctx, s.env, iid, func(event *inpb.InvocationEvent) error {
+		collector.ProcessEvent(event.GetBuildEvent())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &apipb.GetInvocationReportResponse{}
+	switch req.GetFormat() {
+	case apipb.ReportFormat_UNKNOWN_REPORT_FORMAT, apipb.ReportFormat_JUNIT_XML_REPORT_FORMAT:
+		rsp.ContentType = invocation_report.JUnitXMLContentType
+		rsp.Contents, err = collector.JUnitXML(ctx, s.env.GetPooledByteStreamClient())
+	case apipb.ReportFormat_FAILURE_SUMMARY_REPORT_FORMAT:
+		rsp.ContentType = invocation_report.FailureSummaryContentType
+		rsp.Contents = collector.FailureSummary()
+	case apipb.ReportFormat_SARIF_REPORT_FORMAT:
+		rsp.ContentType = invocation_report.SARIFContentType
+		rsp.Contents, err = collector.SARIF(ctx, s.env.GetPooledByteStreamClient())
+	default:
+		return nil, status.InvalidArgumentErrorf("unsupported report format %s", req.GetFormat())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+func (s *APIServer) CompareInvocations(ctx context.Context, req *apipb.CompareInvocationsRequest) (*apipb.CompareInvocationsResponse, error) {
+	// Check whether the user is authenticated. No need for the returned user
+	// here, because user filters will be applied by LookupInvocation.
+	if _, err := s.env.GetAuthenticator().AuthenticatedUser(ctx); err != nil {
+		return nil, err
+	}
+	if req.GetOldInvocationId() == "" || req.GetNewInvocationId() == "" {
+		return nil, status.InvalidArgumentError("old_invocation_id and new_invocation_id are required")
+	}
+
+	oldSummary := invocation_compare.NewSummary()
+	newSummary := invocation_compare.NewSummary()
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		return s.summarizeInvocation(egCtx, req.GetOldInvocationId(), oldSummary)
+	})
+	eg.Go(func() error {
+		return s.summarizeInvocation(egCtx, req.GetNewInvocationId(), newSummary)
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	rsp := invocation_compare.Compare(oldSummary, newSummary)
+
+	if oldSummary.ExecutionLog() == nil || newSummary.ExecutionLog() == nil {
+		return rsp, nil
+	}
+	var oldLog, newLog *invocation_compare.ExecutionLog
+	eg, egCtx = errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		var err error
+		oldLog, err = invocation_compare.FetchExecutionLog(egCtx, s.env, oldSummary.ExecutionLog())
+		return err
+	})
+	eg.Go(func() error {
+		var err error
+		newLog, err = invocation_compare.FetchExecutionLog(egCtx, s.env, newSummary.ExecutionLog())
+		return err
+	})
+	if err := eg.Wait(); err != nil {
+		// The execution logs may have been evicted from the cache, in which
+		// case the rest of the comparison is still useful.
+		log.CtxWarningf(ctx, "Could not read execution logs to compare invocations %s and %s: %s", req.GetOldInvocationId(), req.GetNewInvocationId(), err)
+		return rsp, nil
+	}
+	rsp.ExecutionLogsCompared = true
+	rsp.SpawnDiff = invocation_compare.DiffExecutionLogs(oldLog, newLog)
+	return rsp, nil
+}
+
+func (s *APIServer) summarizeInvocation(ctx context.Context, iid string, summary *invocation_compare.Summary) error {
+	_, err := build_event_handler.LookupInvocationWithCallback(ctx, s.env, iid, func(event *inpb.InvocationEvent) error {
+		summary.ProcessEvent(event.GetBuildEvent())
+		return nil
+	})
+	return err
+}
+
+func (s *APIServer) GetSpawns(ctx context.Context, req *apipb.GetSpawnsRequest) (*apipb.GetSpawnsResponse, error) {
+	// Check whether the user is authenticated. No need for the returned user
+	// here, because user filters will be applied by GetSpawns.
+	if _, err := s.env.GetAuthenticator().AuthenticatedUser(ctx); err != nil {
+		return nil, err
+	}
+	spawnsRsp, err := spawn_records.GetSpawns(ctx, s.env, &sprpb.GetSpawnsRequest{
+		InvocationId: req.GetInvocationId(),
+		PageToken:    req.GetPageToken(),
+		Filter: &sprpb.GetSpawnsRequest_Filter{
+			Mnemonic:      req.GetMnemonic(),
+			TargetLabel:   req.GetTargetLabel(),
+			CacheMissOnly: req.GetCacheMissOnly(),
+		},
+		BaselineInvocationId: req.GetBaselineInvocationId(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	rsp := &apipb.GetSpawnsResponse{NextPageToken: spawnsRsp.GetNextPageToken()}
+	for _, spawn := range spawnsRsp.GetSpawns() {
+		rsp.Spawn = append(rsp.Spawn, toAPISpawn(spawn))
+	}
+	return rsp, nil
+}
+
+func toAPISpawn(spawn *sprpb.GetSpawnsResponse_Spawn) *apipb.Spawn {
+	r := spawn.GetRecord()
+	out := &apipb.Spawn{
+		PrimaryOutput: r.GetPrimaryOutput(),
+		TargetLabel:   r.GetTargetLabel(),
+		Mnemonic:      r.GetMnemonic(),
+		Runner:        r.GetRunner(),
+		CacheHit:      r.GetCacheHit(),
+		Remote:        r.GetRemote(),
+		Cacheable:     r.GetCacheable(),
+		ExitCode:      r.GetExitCode(),
+		Digest:        r.GetDigest(),
+		Duration:      r.GetDuration(),
+		InputCount:    r.GetInputCount(),
+	}
+	for _, f := range r.GetOutputs() {
+		out.Output = append(out.Output, &apipb.SpawnOutput{
+			Path:   f.GetPath(),
+			Digest: f.GetDigest(),
+		})
+	}
+	if e := spawn.GetCacheMissExplanation(); e != nil {
+		out.CacheMissExplanation = &apipb.CacheMissExplanation{
+			BaselineFound:   e.GetBaselineFound(),
+			SameDigest:      e.GetSameDigest(),
+			InputsTruncated: e.GetInputsTruncated(),
+			OldArgs:         e.GetOldArgs(),
+			NewArgs:         e.GetNewArgs(),
+		}
+		for _, d := range e.GetInputDiffs() {
+			out.CacheMissExplanation.InputDiff = append(out.CacheMissExplanation.InputDiff, &apipb.InputDiff{
+				Path:      d.GetPath(),
+				OldDigest: d.GetOldDigest(),
+				NewDigest: d.GetNewDigest(),
+			})
+		}
+		for _, d := range e.GetEnvDiffs() {
+			out.CacheMissExplanation.EnvDiff = append(out.CacheMissExplanation.EnvDiff, &apipb.KeyValueDiff{
+				Key:      d.GetName(),
+				OldValue: d.GetOldValue(),
+				NewValue: d.GetNewValue(),
+			})
+		}
+	}
+	return out
+}
+
 type getFileWriter struct {
 	s apipb.ApiService_GetFileServer
 }
@@ -463,6 +972,133 @@ func (s *APIServer) handleGetFileRequest(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+func (s *APIServer) GetInvocationReportHandler() http.Handler {
+	return http.HandlerFunc(s.handleGetInvocationReportRequest)
+}
+
+// Handle http GetInvocationReport requests by writing the report contents
+// directly to the response, so that the report can be saved to a file.
+func (s *APIServer) handleGetInvocationReportRequest(w http.ResponseWriter, r *http.Request) {
+	req := &apipb.GetInvocationReportRequest{}
+	if err := protolet.ReadRequestToProto(r, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rsp, err := s.GetInvocationReport(r.Context(), req)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+	w.Header().Set("Content-Type", rsp.GetContentType())
+	w.Write(rsp.GetContents())
+}
+
+// httpStatusForError returns the HTTP status code for an error returned by an
+// API method.
+func httpStatusForError(err error) int {
+	switch {
+	case status.IsUnauthenticatedError(err):
+		return http.StatusUnauthorized
+	case status.IsPermissionDeniedError(err):
+		return http.StatusForbidden
+	case status.IsInvalidArgumentError(err):
+		return http.StatusBadRequest
+	case status.IsNotFoundError(err):
+		return http.StatusNotFound
+	case status.IsUnimplementedError(err):
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (s *APIServer) SubscribeInvocation(req *apipb.SubscribeInvocationRequest, stream apipb.ApiService_SubscribeInvocationServer) error {
+	sub, err := s.subscribeInvocation(stream.Context(), req)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	for {
+		update, err := sub.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(update); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *APIServer) subscribeInvocation(ctx context.Context, req *apipb.SubscribeInvocationRequest) (*invocation_subscription.Subscription, error) {
+	// Check whether the user is authenticated. No need for the returned user
+	// here, because user filters will be applied by Subscribe.
+	if _, err := s.env.GetAuthenticator().AuthenticatedUser(ctx); err != nil {
+		return nil, err
+	}
+	if req.GetInvocationId() == "" {
+		return nil, status.InvalidArgumentError("invocation_id is required")
+	}
+	return invocation_subscription.Subscribe(ctx, s.env, req.GetInvocationId())
+}
+
+func (s *APIServer) SubscribeInvocationHandler() http.Handler {
+	return http.HandlerFunc(s.handleSubscribeInvocationRequest)
+}
+
+// Handle http SubscribeInvocation requests by streaming updates as
+// server-sent events. Each event is named after the type of update (e.g.
+// "build_event") and its data is the JSON-encoded SubscribeInvocationResponse.
+// The invocation ID may also be passed as the "invocation_id" query parameter,
+// since EventSource clients can't send a request body.
+func (s *APIServer) handleSubscribeInvocationRequest(w http.ResponseWriter, r *http.Request) {
+	req := &apipb.SubscribeInvocationRequest{InvocationId: r.URL.Query().Get("invocation_id")}
+	if req.GetInvocationId() == "" {
+		if err := protolet.ReadRequestToProto(r, req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	sub, err := s.subscribeInvocation(r.Context(), req)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusForError(err))
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		update, err := sub.Recv()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			if r.Context().Err() == nil {
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", strings.ReplaceAll(err.Error(), "\n", " "))
+				flusher.Flush()
+			}
+			return
+		}
+		data, err := protojson.Marshal(update)
+		if err != nil {
+			log.CtxWarningf(r.Context(), "Failed to marshal invocation update: %s", err)
+			continue
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", invocation_subscription.UpdateType(update), data)
+		flusher.Flush()
+	}
+}
+
 func (s *APIServer) GetMetricsHandler() http.Handler {
 	return http.HandlerFunc(s.handleGetMetricsRequest)
 }
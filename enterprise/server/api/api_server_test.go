@@ -4,19 +4,26 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
 	"testing"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/invocation_search_service"
 	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	"github.com/buildbuddy-io/buildbuddy/proto/failure_details"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/spawn_records"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/pubsub"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
@@ -30,8 +37,13 @@ import (
 	commonpb "github.com/buildbuddy-io/buildbuddy/proto/api/v1/common"
 	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
 	cappb "github.com/buildbuddy-io/buildbuddy/proto/capability"
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
+	inspb "github.com/buildbuddy-io/buildbuddy/proto/invocation_status"
 	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+	sprpb "github.com/buildbuddy-io/buildbuddy/proto/spawn_record"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
 )
 
 var userMap = testauth.TestUsers("user1", "group1")
@@ -66,6 +78,83 @@ func TestGetInvocationWithMetadata(t *testing.T) {
 	assert.Equal(t, 2, len(resp.Invocation[0].WorkspaceStatus))
 }
 
+func TestSearchInvocation(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "user1")
+	env.SetInvocationSearchService(invocation_search_service.NewInvocationSearchService(env, env.GetDBHandle(), nil))
+	for _, inv := range []*tables.Invocation{
+		{BranchName: "main", Success: true, InvocationStatus: int64(inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS)},
+		{BranchName: "main", Success: false, InvocationStatus: int64(inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS)},
+		{BranchName: "main", InvocationStatus: int64(inspb.InvocationStatus_PARTIAL_INVOCATION_STATUS)},
+		{BranchName: "feature", Success: true, InvocationStatus: int64(inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS)},
+	} {
+		iid, err := uuid.NewRandom()
+		require.NoError(t, err)
+		inv.InvocationID = iid.String()
+		inv.InvocationUUID = iid[:]
+		inv.GroupID = "group1"
+		inv.Perms = perms.GROUP_READ
+		inv.RepoURL = "https://github.com/buildbuddy-io/buildbuddy"
+		inv.Command = "test"
+		err = env.GetDBHandle().NewQuery(ctx, "create_invocation").Create(inv)
+		require.NoError(t, err)
+	}
+	s := NewAPIServer(env)
+
+	rsp, err := s.SearchInvocation(ctx, &apipb.SearchInvocationRequest{
+		Query: &apipb.InvocationQuery{
+			RepoUrl:    "git@github.com:buildbuddy-io/buildbuddy.git",
+			BranchName: "main",
+			Status:     []apipb.OverallStatus{apipb.OverallStatus_SUCCESS, apipb.OverallStatus_IN_PROGRESS},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetInvocation(), 2)
+	for _, inv := range rsp.GetInvocation() {
+		assert.Equal(t, "main", inv.GetBranchName())
+		assert.Equal(t, "test", inv.GetCommand())
+	}
+	assert.Empty(t, rsp.GetNextPageToken())
+
+	// Page through all invocations on main.
+	var invocationIDs []string
+	pageToken := ""
+	for {
+		rsp, err := s.SearchInvocation(ctx, &apipb.SearchInvocationRequest{
+			Query:     &apipb.InvocationQuery{BranchName: "main"},
+			PageSize:  2,
+			PageToken: pageToken,
+		})
+		require.NoError(t, err)
+		for _, inv := range rsp.GetInvocation() {
+			invocationIDs = append(invocationIDs, inv.GetId().GetInvocationId())
+		}
+		if rsp.GetNextPageToken() == "" {
+			break
+		}
+		pageToken = rsp.GetNextPageToken()
+	}
+	assert.Len(t, invocationIDs, 3)
+}
+
+func TestSearchInvocation_InvalidRepoURL(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "user1")
+	env.SetInvocationSearchService(invocation_search_service.NewInvocationSearchService(env, env.GetDBHandle(), nil))
+	s := NewAPIServer(env)
+	_, err := s.SearchInvocation(ctx, &apipb.SearchInvocationRequest{
+		Query: &apipb.InvocationQuery{RepoUrl: "https://%zz"},
+	})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
+
+func TestSearchInvocationAuth(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "")
+	env.SetInvocationSearchService(invocation_search_service.NewInvocationSearchService(env, env.GetDBHandle(), nil))
+	s := NewAPIServer(env)
+	resp, err := s.SearchInvocation(ctx, &apipb.SearchInvocationRequest{})
+	require.Error(t, err)
+	require.Nil(t, resp)
+}
+
 func TestGetInvocationNotFound(t *testing.T) {
 	env, ctx := getEnvAndCtx(t, "user1")
 	testUUID, err := uuid.NewRandom()
@@ -151,6 +240,199 @@ func TestGetTargetByTag(t *testing.T) {
 	assert.Equal(t, 2, len(resp.Target))
 }
 
+func TestGetTargetHistory(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "user1")
+	const repoURL = "https://github.com/buildbuddy-io/buildbuddy"
+	targetIDs := map[string]int64{"//:a_test": 1, "//:b_test": 2}
+	for label, targetID := range targetIDs {
+		err := env.GetDBHandle().NewQuery(ctx, "create_target").Create(&tables.Target{
+			TargetID: targetID,
+			GroupID:  "group1",
+			RepoURL:  repoURL,
+			Label:    label,
+			RuleType: "go_test",
+			Perms:    perms.GROUP_READ,
+		})
+		require.NoError(t, err)
+	}
+	for _, inv := range []struct {
+		commitSHA, branchName string
+		statuses              map[string]build_event_stream.TestStatus
+	}{
+		{
+			commitSHA:  "commit1",
+			branchName: "main",
+			statuses: map[string]build_event_stream.TestStatus{
+				"//:a_test": build_event_stream.TestStatus_FLAKY,
+				"//:b_test": build_event_stream.TestStatus_PASSED,
+			},
+		},
+		{
+			commitSHA:  "commit2",
+			branchName: "feature",
+			statuses: map[string]build_event_stream.TestStatus{
+				"//:a_test": build_event_stream.TestStatus_FAILED,
+			},
+		},
+	} {
+		iid, err := uuid.NewRandom()
+		require.NoError(t, err)
+		err = env.GetDBHandle().NewQuery(ctx, "create_invocation").Create(&tables.Invocation{
+			InvocationID:   iid.String(),
+			InvocationUUID: iid[:],
+			GroupID:        "group1",
+			Perms:          perms.GROUP_READ,
+			Role:           "CI",
+			Command:        "test",
+			RepoURL:        repoURL,
+			CommitSHA:      inv.commitSHA,
+			BranchName:     inv.branchName,
+		})
+		require.NoError(t, err)
+		for label, testStatus := range inv.statuses {
+			err := env.GetDBHandle().NewQuery(ctx, "create_target_status").Create(&tables.TargetStatus{
+				TargetID:       targetIDs[label],
+				InvocationUUID: iid[:],
+				TargetType:     int32(commonpb.TargetType_TEST),
+				Status:         int32(testStatus),
+			})
+			require.NoError(t, err)
+		}
+	}
+	s := NewAPIServer(env)
+
+	rsp, err := s.GetTargetHistory(ctx, &apipb.GetTargetHistoryRequest{
+		RepoUrl: "git@github.com:buildbuddy-io/buildbuddy.git",
+		Label:   "//:a_test",
+	})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetTargetHistory(), 1)
+	assert.Equal(t, "//:a_test", rsp.GetTargetHistory()[0].GetLabel())
+	assert.Equal(t, commonpb.TargetType_TEST, rsp.GetTargetHistory()[0].GetTargetType())
+	statuses := map[string]commonpb.Status{}
+	for _, run := range rsp.GetTargetHistory()[0].GetRun() {
+		statuses[run.GetCommitSha()] = run.GetStatus()
+	}
+	assert.Equal(t, map[string]commonpb.Status{
+		"commit1": commonpb.Status_FLAKY,
+		"commit2": commonpb.Status_FAILED,
+	}, statuses)
+
+	rsp, err = s.GetTargetHistory(ctx, &apipb.GetTargetHistoryRequest{
+		RepoUrl:    repoURL,
+		BranchName: "main",
+	})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetTargetHistory(), 2)
+	for _, h := range rsp.GetTargetHistory() {
+		require.Len(t, h.GetRun(), 1, "target %s", h.GetLabel())
+		assert.Equal(t, "commit1", h.GetRun()[0].GetCommitSha())
+	}
+
+	// Fetching the next page returns no more history.
+	rsp, err = s.GetTargetHistory(ctx, &apipb.GetTargetHistoryRequest{
+		RepoUrl:    repoURL,
+		BranchName: "main",
+		PageToken:  rsp.GetNextPageToken(),
+	})
+	require.NoError(t, err)
+	assert.Empty(t, rsp.GetTargetHistory())
+	assert.Empty(t, rsp.GetNextPageToken())
+
+	_, err = s.GetTargetHistory(ctx, &apipb.GetTargetHistoryRequest{})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
+
+func TestGetTargetHistory_LabelFilterPaginatesOverMatchingCommits(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "user1")
+	const repoURL = "https://github.com/buildbuddy-io/buildbuddy"
+	targetIDs := map[string]int64{"//:a_test": 1, "//:b_test": 2}
+	for label, targetID := range targetIDs {
+		err := env.GetDBHandle().NewQuery(ctx, "create_target").Create(&tables.Target{
+			TargetID: targetID,
+			GroupID:  "group1",
+			RepoURL:  repoURL,
+			Label:    label,
+			RuleType: "go_test",
+			Perms:    perms.GROUP_READ,
+		})
+		require.NoError(t, err)
+	}
+	// The oldest commit ran //:a_test, followed by more than a page of commits
+	// that only ran //:b_test.
+	commits := []string{"commit_a"}
+	for i := range 50 {
+		commits = append(commits, fmt.Sprintf("commit_b%02d", i))
+	}
+	for _, commitSHA := range commits {
+		label := "//:b_test"
+		if commitSHA == "commit_a" {
+			label = "//:a_test"
+		}
+		iid, err := uuid.NewRandom()
+		require.NoError(t, err)
+		err = env.GetDBHandle().NewQuery(ctx, "create_invocation").Create(&tables.Invocation{
+			InvocationID:   iid.String(),
+			InvocationUUID: iid[:],
+			GroupID:        "group1",
+			Perms:          perms.GROUP_READ,
+			Role:           "CI",
+			Command:        "test",
+			RepoURL:        repoURL,
+			CommitSHA:      commitSHA,
+		})
+		require.NoError(t, err)
+		err = env.GetDBHandle().NewQuery(ctx, "create_target_status").Create(&tables.TargetStatus{
+			TargetID:       targetIDs[label],
+			InvocationUUID: iid[:],
+			TargetType:     int32(commonpb.TargetType_TEST),
+			Status:         int32(build_event_stream.TestStatus_PASSED),
+		})
+		require.NoError(t, err)
+	}
+	s := NewAPIServer(env)
+
+	rsp, err := s.GetTargetHistory(ctx, &apipb.GetTargetHistoryRequest{
+		RepoUrl: repoURL,
+		Label:   "//:a_test",
+	})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetTargetHistory(), 1)
+	require.Len(t, rsp.GetTargetHistory()[0].GetRun(), 1)
+	assert.Equal(t, "commit_a", rsp.GetTargetHistory()[0].GetRun()[0].GetCommitSha())
+
+	rsp, err = s.GetTargetHistory(ctx, &apipb.GetTargetHistoryRequest{
+		RepoUrl:   repoURL,
+		Label:     "//:a_test",
+		PageToken: rsp.GetNextPageToken(),
+	})
+	require.NoError(t, err)
+	assert.Empty(t, rsp.GetTargetHistory())
+	assert.Empty(t, rsp.GetNextPageToken())
+}
+
+func TestGetTargetHistoryAuth(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "")
+	s := NewAPIServer(env)
+	resp, err := s.GetTargetHistory(ctx, &apipb.GetTargetHistoryRequest{RepoUrl: "https://github.com/buildbuddy-io/buildbuddy"})
+	require.Error(t, err)
+	require.Nil(t, resp)
+}
+
+func TestGetTargetStats_RequiresOLAPDB(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "user1")
+	s := NewAPIServer(env)
+	_, err := s.GetTargetStats(ctx, &apipb.GetTargetStatsRequest{})
+	assert.True(t, status.IsUnimplementedError(err), "expected Unimplemented, got %v", err)
+}
+
+func TestGetTargetFlakeSamples_RequiresLabel(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "user1")
+	s := NewAPIServer(env)
+	_, err := s.GetTargetFlakeSamples(ctx, &apipb.GetTargetFlakeSamplesRequest{})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
+
 func TestGetAction(t *testing.T) {
 	testUUID, err := uuid.NewRandom()
 	assert.NoError(t, err)
@@ -206,6 +488,52 @@ func TestGetActionWithTargetLabel(t *testing.T) {
 	assert.Equal(t, resp.Action[0].File[0].SizeBytes, int64(152092))
 }
 
+func TestSearchExecution_NotConfigured(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "user1")
+	s := NewAPIServer(env)
+	_, err := s.SearchExecution(ctx, &apipb.SearchExecutionRequest{})
+	assert.True(t, status.IsUnimplementedError(err), "expected Unimplemented, got %v", err)
+}
+
+func TestExecutionProtoToAPI(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		statusCode     int32
+		exitCode       int32
+		expectedStatus apipb.ExecutionStatus
+	}{
+		{name: "succeeded", expectedStatus: apipb.ExecutionStatus_SUCCEEDED_EXECUTION_STATUS},
+		{name: "failed", exitCode: 1, expectedStatus: apipb.ExecutionStatus_FAILED_EXECUTION_STATUS},
+		{name: "errored", statusCode: 4, expectedStatus: apipb.ExecutionStatus_ERRORED_EXECUTION_STATUS},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ex := executionProtoToAPI(&espb.ExecutionWithInvocationMetadata{
+				Execution: &espb.Execution{
+					ExecutionId:    "uploads/abc/blobs/123/10",
+					ActionDigest:   &repb.Digest{Hash: "123", SizeBytes: 10},
+					Status:         &statuspb.Status{Code: test.statusCode},
+					ExitCode:       test.exitCode,
+					TargetLabel:    "//:foo",
+					ActionMnemonic: "GoCompilePkg",
+				},
+				InvocationMetadata: &espb.InvocationMetadata{
+					Id:         "inv1",
+					BranchName: "main",
+				},
+			})
+			assert.Equal(t, test.expectedStatus, ex.GetStatus())
+			assert.Equal(t, test.statusCode != 0, ex.GetError() != nil)
+			assert.Equal(t, "inv1", ex.GetId().GetInvocationId())
+			assert.Equal(t, "uploads/abc/blobs/123/10", ex.GetId().GetExecutionId())
+			assert.Equal(t, "123", ex.GetActionDigestHash())
+			assert.Equal(t, int64(10), ex.GetActionDigestSizeBytes())
+			assert.Equal(t, "//:foo", ex.GetTargetLabel())
+			assert.Equal(t, "GoCompilePkg", ex.GetActionMnemonic())
+			assert.Equal(t, "main", ex.GetBranchName())
+		})
+	}
+}
+
 func TestGetActionAuth(t *testing.T) {
 	testUUID, err := uuid.NewRandom()
 	assert.NoError(t, err)
@@ -247,6 +575,175 @@ func TestGetLogAuth(t *testing.T) {
 	require.Nil(t, resp)
 }
 
+func TestGetInvocationReport(t *testing.T) {
+	testUUID, err := uuid.NewRandom()
+	assert.NoError(t, err)
+	testInvocationID := testUUID.String()
+
+	env, ctx := getEnvAndCtx(t, "user1")
+	streamBuild(t, env, testInvocationID)
+	s := NewAPIServer(env)
+
+	rsp, err := s.GetInvocationReport(ctx, &apipb.GetInvocationReportRequest{InvocationId: testInvocationID})
+	require.NoError(t, err)
+	assert.Equal(t, "application/xml", rsp.GetContentType())
+	assert.Contains(t, string(rsp.GetContents()), `<testsuites tests="0" failures="0" errors="0" skipped="0"></testsuites>`)
+
+	rsp, err = s.GetInvocationReport(ctx, &apipb.GetInvocationReportRequest{
+		InvocationId: testInvocationID,
+		Format:       apipb.ReportFormat_FAILURE_SUMMARY_REPORT_FORMAT,
+	})
+	require.NoError(t, err)
+	assert.Empty(t, rsp.GetContents())
+
+	rsp, err = s.GetInvocationReport(ctx, &apipb.GetInvocationReportRequest{
+		InvocationId: testInvocationID,
+		Format:       apipb.ReportFormat_SARIF_REPORT_FORMAT,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "application/sarif+json", rsp.GetContentType())
+	assert.Contains(t, string(rsp.GetContents()), `"ruleId": "bazel/actionMnemonic"`)
+	assert.Contains(t, string(rsp.GetContents()), `"fullyQualifiedName": "//failed:target"`)
+}
+
+func TestGetInvocationReportAuth(t *testing.T) {
+	testUUID, err := uuid.NewRandom()
+	assert.NoError(t, err)
+	testInvocationID := testUUID.String()
+
+	env, ctx := getEnvAndCtx(t, "")
+	streamBuild(t, env, testInvocationID)
+	s := NewAPIServer(env)
+	rsp, err := s.GetInvocationReport(ctx, &apipb.GetInvocationReportRequest{InvocationId: testInvocationID})
+	require.Error(t, err)
+	require.Nil(t, rsp)
+}
+
+func TestGetInvocationReport_RequiresInvocationID(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "user1")
+	s := NewAPIServer(env)
+	_, err := s.GetInvocationReport(ctx, &apipb.GetInvocationReportRequest{})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
+
+func TestCompareInvocations(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "user1")
+	oldIID := uuid.New().String()
+	newIID := uuid.New().String()
+	streamBuild(t, env, oldIID)
+	streamBuild(t, env, newIID)
+	s := NewAPIServer(env)
+
+	for _, iids := range [][2]string{{oldIID, newIID}, {oldIID, oldIID}} {
+		rsp, err := s.CompareInvocations(ctx, &apipb.CompareInvocationsRequest{
+			OldInvocationId: iids[0],
+			NewInvocationId: iids[1],
+		})
+		require.NoError(t, err)
+		assert.Empty(t, rsp.GetOptionDiff())
+		assert.Empty(t, rsp.GetWorkspaceStatusDiff())
+		assert.Empty(t, rsp.GetBuildMetadataDiff())
+		assert.Empty(t, rsp.GetTargetStatusDiff())
+		assert.False(t, rsp.GetExecutionLogsCompared())
+	}
+
+	_, err := s.CompareInvocations(ctx, &apipb.CompareInvocationsRequest{OldInvocationId: oldIID})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+
+	_, err = s.CompareInvocations(ctx, &apipb.CompareInvocationsRequest{
+		OldInvocationId: oldIID,
+		NewInvocationId: uuid.New().String(),
+	})
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+}
+
+func TestGetSpawns(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "user1")
+	s := NewAPIServer(env)
+	writeSpawns := func(records ...*sprpb.SpawnRecord) string {
+		iid := uuid.New().String()
+		streamBuild(t, env, iid)
+		ti, err := env.GetInvocationDB().LookupInvocation(ctx, iid)
+		require.NoError(t, err)
+		err = spawn_records.Write(ctx, env, iid, ti.Attempt, &sprpb.SpawnRecords{Spawns: records})
+		require.NoError(t, err)
+		return iid
+	}
+	baselineIID := writeSpawns(&sprpb.SpawnRecord{
+		PrimaryOutput: "bazel-out/bin/lib.o",
+		Env:           map[string]string{"PATH": "/bin"},
+	})
+	iid := writeSpawns(
+		&sprpb.SpawnRecord{
+			PrimaryOutput: "bazel-out/bin/lib.o",
+			Mnemonic:      "CppCompile",
+			Env:           map[string]string{"PATH": "/usr/bin"},
+			Outputs:       []*sprpb.File{{Path: "bazel-out/bin/lib.o", Digest: "abc/1"}},
+		},
+		&sprpb.SpawnRecord{
+			PrimaryOutput: "bazel-out/bin/lib.so",
+			Mnemonic:      "CppLink",
+			CacheHit:      true,
+		},
+	)
+
+	rsp, err := s.GetSpawns(ctx, &apipb.GetSpawnsRequest{
+		InvocationId:         iid,
+		CacheMissOnly:        true,
+		BaselineInvocationId: baselineIID,
+	})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetSpawn(), 1)
+	spawn := rsp.GetSpawn()[0]
+	assert.Equal(t, "CppCompile", spawn.GetMnemonic())
+	assert.Equal(t, "abc/1", spawn.GetOutput()[0].GetDigest())
+	assert.True(t, spawn.GetCacheMissExplanation().GetBaselineFound())
+	require.Len(t, spawn.GetCacheMissExplanation().GetEnvDiff(), 1)
+	assert.Equal(t, "/bin", spawn.GetCacheMissExplanation().GetEnvDiff()[0].GetOldValue())
+	assert.Equal(t, "/usr/bin", spawn.GetCacheMissExplanation().GetEnvDiff()[0].GetNewValue())
+
+	_, err = s.GetSpawns(ctx, &apipb.GetSpawnsRequest{InvocationId: baselineIID, BaselineInvocationId: uuid.New().String()})
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	unauthCtx := context.Background()
+	_, err = s.GetSpawns(unauthCtx, &apipb.GetSpawnsRequest{InvocationId: iid})
+	require.Error(t, err)
+}
+
+func TestSubscribeInvocationHandler(t *testing.T) {
+	flags.Set(t, "app.invocation_subscriptions.enabled", true)
+	env, ctx := getEnvAndCtx(t, "user1")
+	env.SetPubSub(pubsub.NewTestPubSub())
+	testInvocationID := uuid.New().String()
+	streamBuild(t, env, testInvocationID)
+	s := NewAPIServer(env)
+
+	// The invocation has already completed, so only the final update is
+	// sent.
+	req := httptest.NewRequest("GET", "/api/v1/SubscribeInvocation?invocation_id="+testInvocationID, nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	s.SubscribeInvocationHandler().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+	event, data, ok := strings.Cut(strings.TrimSuffix(rec.Body.String(), "\n\n"), "\n")
+	require.True(t, ok, "unexpected body %q", rec.Body.String())
+	assert.Equal(t, "event: invocation_completed", event)
+	update := &apipb.SubscribeInvocationResponse{}
+	require.NoError(t, protojson.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), update))
+	assert.True(t, update.GetInvocationCompleted().GetSuccess())
+	assert.Equal(t, apipb.InvocationStatus_COMPLETE_INVOCATION_STATUS, update.GetInvocationCompleted().GetInvocationStatus())
+
+	req = httptest.NewRequest("GET", "/api/v1/SubscribeInvocation", nil).WithContext(ctx)
+	rec = httptest.NewRecorder()
+	s.SubscribeInvocationHandler().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	req = httptest.NewRequest("GET", "/api/v1/SubscribeInvocation?invocation_id="+testInvocationID, nil)
+	rec = httptest.NewRecorder()
+	s.SubscribeInvocationHandler().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
 func TestDeleteFile_CAS(t *testing.T) {
 	flags.Set(t, "enable_cache_delete_api", true)
 	var err error
@@ -0,0 +1,300 @@
+package distributed
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/consistent_hash"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+
+	dcpb "github.com/buildbuddy-io/buildbuddy/proto/distributed_cache"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+)
+
+var (
+	enableAntiEntropy           = flag.Bool("cache.distributed_cache.enable_anti_entropy", false, "If enabled, each node periodically checks that the other replicas of its entries have a copy, and re-replicates the entries they're missing. Only used if replication_factor > 1. Requires a disk or pebble base cache. ** Enterprise only **")
+	antiEntropyInterval         = flag.Duration("cache.distributed_cache.anti_entropy_interval", 1*time.Hour, "How long to wait between anti-entropy passes over the local cache.")
+	antiEntropyEntriesPerSecond = flag.Float64("cache.distributed_cache.anti_entropy_max_entries_per_second", 1000, "The maximum number of entry replicas checked per second by the anti-entropy process.")
+	antiEntropyFindMissingBatch = flag.Int("cache.distributed_cache.anti_entropy_batch_size", 100, "The maximum number of entries checked against a replica in a single FindMissing request by the anti-entropy process.")
+)
+
+// The maximum number of missing entries copied to a replica concurrently.
+const antiEntropyRepairConcurrency = 8
+
+// replicaBatchKey identifies entries that can be checked against a replica
+// in a single FindMissing request.
+type replicaBatchKey struct {
+	peer         string
+	groupID      string
+	cacheType    rspb.CacheType
+	instanceName string
+}
+
+// antiEntropyStats summarizes an anti-entropy pass.
+type antiEntropyStats struct {
+	startTime time.Time
+	endTime   time.Time
+	checked   int64
+	missing   int64
+	repaired  int64
+	failed    int64
+	err       error
+}
+
+// antiEntropy repairs replicas that diverged, e.g. because a node lost its
+// disk or hinted handoffs were dropped.
+//
+// Each pass scans the local cache for the entries that this node owns, then
+// asks the other owners which of the entries they're missing, in batches.
+// Missing entries are copied to the replicas that don't have them.
+type antiEntropy struct {
+	c         *Cache
+	interval  time.Duration
+	limiter   *rate.Limiter
+	batchSize int
+
+	mu       sync.Mutex
+	running  *antiEntropyStats
+	lastPass *antiEntropyStats
+}
+
+func newAntiEntropy(c *Cache) *antiEntropy {
+	limit := rate.Inf
+	if c.config.AntiEntropyEntriesPerSecond > 0 {
+		limit = rate.Limit(c.config.AntiEntropyEntriesPerSecond)
+	}
+	batchSize := *antiEntropyFindMissingBatch
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	return &antiEntropy{
+		c:         c,
+		interval:  c.config.AntiEntropyInterval,
+		limiter:   rate.NewLimiter(limit, batchSize),
+		batchSize: batchSize,
+	}
+}
+
+// run runs an anti-entropy pass every interval until quit is closed.
+func (a *antiEntropy) run(quit chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-quit
+		cancel()
+	}()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(a.interval):
+		}
+		stats := a.pass(ctx)
+		if stats.err != nil && ctx.Err() == nil {
+			log.Warningf("Distributed cache %q: anti-entropy pass failed: %s", a.c.config.ListenAddr, stats.err)
+		} else if stats.missing > 0 {
+			log.Infof("Distributed cache %q: anti-entropy pass found %d missing replicas: %d repaired, %d failed", a.c.config.ListenAddr, stats.missing, stats.repaired, stats.failed)
+		}
+	}
+}
+
+// pass checks the replicas of every local entry that this node owns, and
+// repairs the replicas that are missing entries.
+func (a *antiEntropy) pass(ctx context.Context) *antiEntropyStats {
+	stats := &antiEntropyStats{startTime: time.Now()}
+	a.mu.Lock()
+	a.running = stats
+	a.mu.Unlock()
+
+	stats.err = a.scan(ctx, stats)
+
+	a.mu.Lock()
+	stats.endTime = time.Now()
+	a.running = nil
+	a.lastPass = stats
+	a.mu.Unlock()
+	return stats
+}
+
+func (a *antiEntropy) scan(ctx context.Context, stats *antiEntropyStats) error {
+	lister, ok := a.c.local.(interfaces.CacheLister)
+	if !ok {
+		return status.UnimplementedError("local cache does not support listing entries")
+	}
+	self := a.c.config.ListenAddr
+	owners := a.ownersFunc()
+	batches := make(map[replicaBatchKey][]*interfaces.CacheEntryInfo)
+	err := lister.ListEntries(ctx, nil, func(info *interfaces.CacheEntryInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		owners := owners(info.Resource.GetDigest().GetHash())
+		if !slices.Contains(owners, self) {
+			return nil
+		}
+		for _, peer := range owners {
+			// Each replica is checked by a single node: the first of the
+			// entry's other owners.
+			i := slices.IndexFunc(owners, func(owner string) bool { return owner != peer })
+			if peer == self || owners[i] != self {
+				continue
+			}
+			key := replicaBatchKey{
+				peer:         peer,
+				groupID:      info.GroupID,
+				cacheType:    info.Resource.GetCacheType(),
+				instanceName: info.Resource.GetInstanceName(),
+			}
+			batches[key] = append(batches[key], info)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The replicas are checked once the scan is done, so that the local
+	// cache isn't iterated over while waiting on the network.
+	for key, entries := range batches {
+		for batch := range slices.Chunk(entries, a.batchSize) {
+			if err := a.limiter.WaitN(ctx, len(batch)); err != nil {
+				return err
+			}
+			a.addChecked(stats, int64(len(batch)))
+			metrics.DistributedCacheAntiEntropyCheckedEntries.Add(float64(len(batch)))
+			a.checkReplica(ctx, key, batch, stats)
+		}
+	}
+	return nil
+}
+
+// ownersFunc returns a function that returns the owners of a key that hold
+// a replica of it. While a handoff is in progress, entries are still stored
+// on their previous owners, so the previous owners that are still members of
+// the cluster are used.
+func (a *antiEntropy) ownersFunc() func(key string) []string {
+	var fallback *consistent_hash.ConsistentHash
+	if a.c.rebalancer != nil {
+		fallback = a.c.rebalancer.readFallback()
+	}
+	if fallback == nil {
+		return func(key string) []string {
+			return a.c.owners(a.c.consistentHash, key)
+		}
+	}
+	members := a.c.consistentHash.GetItems()
+	return func(key string) []string {
+		return slices.DeleteFunc(a.c.owners(fallback, key), func(peer string) bool {
+			return !slices.Contains(members, peer)
+		})
+	}
+}
+
+// checkReplica copies the entries in batch that are missing from the replica
+// identified by key.
+func (a *antiEntropy) checkReplica(ctx context.Context, key replicaBatchKey, batch []*interfaces.CacheEntryInfo, stats *antiEntropyStats) {
+	ctx, err := a.c.entryContext(ctx, batch[0])
+	if err != nil {
+		log.Debugf("Anti-entropy: could not authenticate as group %q: %s", key.groupID, err)
+		return
+	}
+	byHash := make(map[string]*interfaces.CacheEntryInfo, len(batch))
+	rns := make([]*rspb.ResourceName, 0, len(batch))
+	for _, info := range batch {
+		byHash[info.Resource.GetDigest().GetHash()] = info
+		rns = append(rns, info.Resource)
+	}
+	isolation := &dcpb.Isolation{
+		CacheType:          key.cacheType,
+		RemoteInstanceName: key.instanceName,
+	}
+	missing, err := a.c.distributedProxy.RemoteFindMissing(ctx, key.peer, isolation, rns)
+	if err != nil {
+		// The replica may be down; hinted handoffs take care of writes
+		// that it missed while unavailable, and the next pass checks it
+		// again.
+		log.Debugf("Anti-entropy: could not check replica %q: %s", key.peer, err)
+		return
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	eg := &errgroup.Group{}
+	eg.SetLimit(antiEntropyRepairConcurrency)
+	for _, d := range missing {
+		info, ok := byHash[d.GetHash()]
+		if !ok {
+			continue
+		}
+		eg.Go(func() error {
+			repairStatus := "repaired"
+			if _, err := a.c.transferEntry(ctx, info, key.peer); err != nil {
+				log.Debugf("Anti-entropy: could not copy %s to replica %q: %s", info.Resource.GetDigest().GetHash(), key.peer, err)
+				repairStatus = "failed"
+			}
+			a.addRepair(stats, repairStatus == "repaired")
+			metrics.DistributedCacheAntiEntropyMissingReplicas.With(prometheus.Labels{metrics.StatusHumanReadableLabel: repairStatus}).Inc()
+			return nil
+		})
+	}
+	eg.Wait()
+}
+
+func (a *antiEntropy) addChecked(stats *antiEntropyStats, n int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats.checked += n
+}
+
+func (a *antiEntropy) addRepair(stats *antiEntropyStats, repaired bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats.missing++
+	if repaired {
+		stats.repaired++
+	} else {
+		stats.failed++
+	}
+}
+
+func (a *antiEntropy) Statusz(ctx context.Context) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	writeStats := func(name string, s *antiEntropyStats) string {
+		buf := fmt.Sprintf("%s: started %s", name, s.startTime.Format(time.RFC3339))
+		if !s.endTime.IsZero() {
+			buf += fmt.Sprintf(", took %s", s.endTime.Sub(s.startTime))
+		}
+		buf += "\n"
+		buf += fmt.Sprintf("  Replicas checked: %d\n", s.checked)
+		buf += fmt.Sprintf("  Missing replicas: %d (%d repaired, %d failed)\n", s.missing, s.repaired, s.failed)
+		if s.err != nil {
+			buf += fmt.Sprintf("  Error: %s\n", s.err)
+		}
+		return buf
+	}
+	buf := "<pre>"
+	buf += fmt.Sprintf("Interval: %s\n", a.interval)
+	if a.running != nil {
+		buf += writeStats("Current pass", a.running)
+	}
+	if a.lastPass != nil {
+		buf += writeStats("Last pass", a.lastPass)
+	}
+	if a.running == nil && a.lastPass == nil {
+		buf += "No passes have run yet.\n"
+	}
+	buf += "</pre>"
+	return buf
+}
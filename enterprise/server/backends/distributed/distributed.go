@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -30,6 +31,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
 	"github.com/buildbuddy-io/buildbuddy/server/util/peerset"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/statusz"
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc/metadata"
@@ -77,6 +79,13 @@ type CacheConfig struct {
 	EnableLocalWrites            bool
 	EnableLocalCompressionLookup bool
 	ReadThroughLocalCache        bool
+	EnableOnlineRebalancing      bool
+	RebalanceDelay               time.Duration
+	HandoffReadFallbackPeriod    time.Duration
+	HandoffOnShutdown            bool
+	EnableAntiEntropy            bool
+	AntiEntropyInterval          time.Duration
+	AntiEntropyEntriesPerSecond  float64
 }
 
 type hintedHandoffOrder struct {
@@ -104,6 +113,7 @@ type peerInfo struct {
 }
 
 type Cache struct {
+	env                  environment.Env
 	local                interfaces.Cache
 	log                  log.Logger
 	lookasideMu          *sync.Mutex
@@ -121,6 +131,8 @@ type Cache struct {
 	finishedShutdown     bool
 	config               CacheConfig
 	zone                 string
+	rebalancer           *rebalancer
+	antiEntropy          *antiEntropy
 }
 
 func Register(env *real_environment.RealEnv) error {
@@ -141,6 +153,13 @@ func Register(env *real_environment.RealEnv) error {
 		EnableLocalCompressionLookup: *enableLocalCompressionLookup,
 		LookasideCacheSizeBytes:      *lookasideCacheSizeBytes,
 		ReadThroughLocalCache:        *readThroughLocalCache,
+		EnableOnlineRebalancing:      *enableOnlineRebalancing,
+		RebalanceDelay:               *rebalanceDelay,
+		HandoffReadFallbackPeriod:    *handoffReadFallbackPeriod,
+		HandoffOnShutdown:            *handoffOnShutdown,
+		EnableAntiEntropy:            *enableAntiEntropy,
+		AntiEntropyInterval:          *antiEntropyInterval,
+		AntiEntropyEntriesPerSecond:  *antiEntropyEntriesPerSecond,
 	}
 	log.Infof("Enabling distributed cache with config: %+v", dcConfig)
 	if len(dcConfig.Nodes) == 0 {
@@ -194,6 +213,19 @@ func NewDistributedCache(env environment.Env, c interfaces.Cache, config CacheCo
 	if len(config.NewNodes) > 0 && len(config.Nodes) == 0 {
 		return nil, status.FailedPreconditionError("new nodes may only be specified when all nodes are hardcoded.")
 	}
+	if config.EnableOnlineRebalancing {
+		if len(config.Nodes) > 0 {
+			return nil, status.FailedPreconditionError("online rebalancing may only be enabled when peers are discovered over redis.")
+		}
+		if _, ok := c.(interfaces.CacheLister); !ok {
+			return nil, status.FailedPreconditionError("online rebalancing requires a base cache that can list its entries.")
+		}
+	}
+	if config.EnableAntiEntropy && config.ReplicationFactor > 1 {
+		if _, ok := c.(interfaces.CacheLister); !ok {
+			return nil, status.FailedPreconditionError("anti-entropy requires a base cache that can list its entries.")
+		}
+	}
 	hashFn, err := parseConsistentHash(*consistentHashFunction)
 	if err != nil {
 		return nil, err
@@ -209,6 +241,7 @@ func NewDistributedCache(env environment.Env, c interfaces.Cache, config CacheCo
 		config.RPCHeartbeatInterval = 1 * time.Second
 	}
 	dc := &Cache{
+		env:                 env,
 		local:               c,
 		lookasideMu:         &sync.Mutex{},
 		log:                 log.NamedSubLogger(fmt.Sprintf("Coordinator(%s)", config.ListenAddr)),
@@ -256,6 +289,10 @@ func NewDistributedCache(env environment.Env, c interfaces.Cache, config CacheCo
 	if zone := resources.GetZone(); zone != "" {
 		dc.zone = zone
 	}
+	if config.EnableAntiEntropy && config.ReplicationFactor > 1 {
+		dc.antiEntropy = newAntiEntropy(dc)
+		statusz.AddSection("distributed_cache_anti_entropy", "Distributed cache anti-entropy", dc.antiEntropy)
+	}
 	dc.distributedProxy.SetHeartbeatCallbackFunc(dc.recvHeartbeatCallback)
 	dc.distributedProxy.SetHintedHandoffCallbackFunc(dc.recvHintedHandoffCallback)
 	if len(config.Nodes) > 0 {
@@ -267,15 +304,25 @@ func NewDistributedCache(env environment.Env, c interfaces.Cache, config CacheCo
 		}
 	} else {
 		// No nodes were hardcoded, use redis for discovery.
+		if config.EnableOnlineRebalancing {
+			dc.rebalancer = newRebalancer(dc, hashFn, *consistentHashVNodes)
+			statusz.AddSection("distributed_cache_handoff", "Distributed cache membership changes", dc.rebalancer)
+		}
 		heartbeatConfig := &heartbeat.Config{
 			MyPublicAddr: config.ListenAddr,
 			GroupName:    config.GroupName,
 			UpdateFn: func(peers ...string) {
+				if dc.rebalancer != nil {
+					dc.rebalancer.peersChanged(peers)
+				}
 				if err := chash.Set(peers...); err != nil {
 					log.Errorf("Error setting peers in consistent hash: %s", err)
 				}
 			},
-			EnablePeerExpiry: false,
+			// With online rebalancing, peers that stop heartbeating are
+			// removed from the ring, and their entries are handed off to
+			// the remaining peers.
+			EnablePeerExpiry: config.EnableOnlineRebalancing,
 		}
 		dc.heartbeatChannel = heartbeat.NewHeartbeatChannel(config.PubSub, heartbeatConfig)
 	}
@@ -596,6 +643,9 @@ func (c *Cache) StartListening() {
 	}
 	c.shutDownChan = make(chan struct{})
 	go c.heartbeatPeers(c.shutDownChan)
+	if c.antiEntropy != nil {
+		go c.antiEntropy.run(c.shutDownChan)
+	}
 	go func() {
 		log.Infof("Distributed cache listening on %q", c.config.ListenAddr)
 		if c.heartbeatChannel != nil {
@@ -620,6 +670,14 @@ func (c *Cache) Shutdown(ctx context.Context) error {
 	if c.heartbeatChannel != nil {
 		c.heartbeatChannel.StopAdvertising()
 	}
+	if c.rebalancer != nil {
+		c.rebalancer.stop()
+		if c.config.HandoffOnShutdown {
+			if err := c.rebalancer.drain(ctx); err != nil {
+				log.Warningf("Distributed cache %q: error handing off entries before shutting down: %s", c.config.ListenAddr, err)
+			}
+		}
+	}
 	close(c.shutDownChan)
 	c.finishedShutdown = true
 	return c.distributedProxy.Shutdown(ctx)
@@ -702,6 +760,24 @@ func (c *Cache) readPeers(d *repb.Digest) *peerset.PeerSet {
 	sort.Slice(primaryPeers, func(i, j int) bool {
 		return sortVal(primaryPeers[i]) < sortVal(primaryPeers[j])
 	})
+
+	if c.rebalancer != nil {
+		if fallback := c.rebalancer.readFallback(); fallback != nil {
+			// The peer set changed recently, and this key may not have
+			// been handed off to its new owners yet. Try them first, then
+			// fall back to the previous owners that are still around.
+			// Keys found on a previous owner are backfilled to the new
+			// owners.
+			members := c.consistentHash.GetItems()
+			previousOwners := slices.DeleteFunc(c.owners(fallback, d.GetHash()), func(peer string) bool {
+				return !slices.Contains(members, peer)
+			})
+			secondaryPeers = slices.DeleteFunc(secondaryPeers, func(peer string) bool {
+				return slices.Contains(previousOwners, peer)
+			})
+			primaryPeers = dedupe(append(slices.Clip(primaryPeers), previousOwners...))
+		}
+	}
 	return peerset.New(primaryPeers, secondaryPeers)
 }
 
@@ -1524,3 +1600,13 @@ func (c *Cache) SupportsCompressor(compressor repb.Compressor_Value) bool {
 	}
 	return false
 }
+
+// ListEntries lists the entries stored in the local cache. Entries that are
+// only stored on other peers are listed by those peers.
+func (c *Cache) ListEntries(ctx context.Context, partitionIDs []string, fn func(info *interfaces.CacheEntryInfo) error) error {
+	lister, ok := c.local.(interfaces.CacheLister)
+	if !ok {
+		return status.UnimplementedError("local cache does not support listing entries")
+	}
+	return lister.ListEntries(ctx, partitionIDs, fn)
+}
@@ -5,20 +5,24 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"slices"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/server/backends/disk_cache"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/content_addressable_storage_server"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/pubsub"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/quarantine"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testcompression"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testmetrics"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testport"
 	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
@@ -27,6 +31,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
@@ -1215,6 +1220,15 @@ func TestDelete_NonExistentFile(t *testing.T) {
 	}
 }
 
+// uncompressedCache simulates a cache that doesn't support compression.
+type uncompressedCache struct {
+	interfaces.Cache
+}
+
+func (c *uncompressedCache) SupportsCompressor(compressor repb.Compressor_Value) bool {
+	return compressor == repb.Compressor_IDENTITY
+}
+
 func TestSupportsCompressor(t *testing.T) {
 	singleCacheSizeBytes := int64(1000000)
 	env := testenv.GetTestEnv(t)
@@ -1236,8 +1250,8 @@ func TestSupportsCompressor(t *testing.T) {
 		{
 			name:                     "does not support zstd",
 			compressionLookupEnabled: true,
-			cache1:                   newMemoryCache(t, singleCacheSizeBytes),
-			cache2:                   newMemoryCache(t, singleCacheSizeBytes),
+			cache1:                   &uncompressedCache{newMemoryCache(t, singleCacheSizeBytes)},
+			cache2:                   &uncompressedCache{newMemoryCache(t, singleCacheSizeBytes)},
 			expected:                 false,
 		},
 		{
@@ -2317,6 +2331,199 @@ func TestReadThroughLocalCache(t *testing.T) {
 
 }
 
+func newDiskCache(t *testing.T, te environment.Env, maxSizeBytes int64) *disk_cache.DiskCache {
+	dc, err := disk_cache.NewDiskCache(te, &disk_cache.Options{RootDirectory: testfs.MakeTempDir(t)}, maxSizeBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc.WaitUntilMapped()
+	return dc
+}
+
+// waitForHandoff waits until every cache has settled on a peer set of the
+// given size and finished handing off entries.
+func waitForHandoff(t *testing.T, numPeers int, caches ...*Cache) {
+	for _, c := range caches {
+		require.Eventually(t, func() bool {
+			if len(c.consistentHash.GetItems()) != numPeers {
+				return false
+			}
+			c.rebalancer.mu.Lock()
+			defer c.rebalancer.mu.Unlock()
+			return len(c.rebalancer.stablePeers) == numPeers && c.rebalancer.state != handoffStateWaiting && c.rebalancer.state != handoffStateRunning
+		}, 15*time.Second, 50*time.Millisecond, "peer %q did not finish handing off entries", c.config.ListenAddr)
+	}
+}
+
+func TestOnlineRebalancing(t *testing.T) {
+	env, authenticator, ctx := getEnvAuthAndCtx(t)
+	ctx, err := authenticator.WithAuthenticatedUser(ctx, "user1")
+	require.NoError(t, err)
+	ctx, err = prefix.AttachUserPrefixToContext(ctx, env.GetAuthenticator())
+	require.NoError(t, err)
+
+	singleCacheSizeBytes := int64(10_000_000)
+	peer1 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	peer2 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	peer3 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	baseConfig := CacheConfig{
+		PubSub:                    pubsub.NewTestPubSub(),
+		GroupName:                 "rebalancing-test",
+		ReplicationFactor:         1,
+		DisableLocalLookup:        true,
+		EnableOnlineRebalancing:   true,
+		RebalanceDelay:            200 * time.Millisecond,
+		HandoffReadFallbackPeriod: time.Hour,
+	}
+	localCaches := map[string]*disk_cache.DiskCache{
+		peer1: newDiskCache(t, env, singleCacheSizeBytes),
+		peer2: newDiskCache(t, env, singleCacheSizeBytes),
+		peer3: newDiskCache(t, env, singleCacheSizeBytes),
+	}
+
+	// Start a distributed cache with 2 nodes, R = 1, and write some data.
+	config1 := baseConfig
+	config1.ListenAddr = peer1
+	dc1 := startNewDCache(t, env, config1, localCaches[peer1])
+	config2 := baseConfig
+	config2.ListenAddr = peer2
+	dc2 := startNewDCache(t, env, config2, localCaches[peer2])
+	waitForReady(t, peer1)
+	waitForReady(t, peer2)
+	waitForHandoff(t, 2, dc1, dc2)
+
+	var written []*rspb.ResourceName
+	for i := 0; i < 100; i++ {
+		rn, buf := testdigest.RandomCASResourceBuf(t, 100)
+		require.NoError(t, dc1.Set(ctx, rn, buf))
+		written = append(written, rn)
+	}
+
+	// requireOwnersContain checks that every resource is stored in the local
+	// cache of its owner among peers, and returns the number of resources
+	// owned by each peer.
+	requireOwnersContain := func(resources []*rspb.ResourceName, peers ...string) map[string]int {
+		ring := dc1.rebalancer.newRing(peers)
+		owned := make(map[string]int)
+		for _, rn := range resources {
+			owner := dc1.owners(ring, rn.GetDigest().GetHash())[0]
+			exists, err := localCaches[owner].Contains(ctx, rn)
+			require.NoError(t, err)
+			require.True(t, exists, "%s not found on owner %q", rn.GetDigest().GetHash(), owner)
+			owned[owner]++
+		}
+		return owned
+	}
+
+	// Add a third node. The entries it now owns are handed off to it.
+	config3 := baseConfig
+	config3.ListenAddr = peer3
+	dc3 := startNewDCache(t, env, config3, localCaches[peer3])
+	waitForReady(t, peer3)
+	waitForHandoff(t, 3, dc1, dc2, dc3)
+
+	owned := requireOwnersContain(written, peer1, peer2, peer3)
+	require.Greater(t, owned[peer3], 0)
+	require.Contains(t, dc1.rebalancer.Statusz(ctx), "Entries transferred")
+	for _, rn := range written {
+		readAndCompareDigest(t, ctx, dc3, rn)
+	}
+
+	// Write some more data, some of which is only stored on the third node.
+	for i := 0; i < 50; i++ {
+		rn, buf := testdigest.RandomCASResourceBuf(t, 100)
+		require.NoError(t, dc1.Set(ctx, rn, buf))
+		written = append(written, rn)
+	}
+
+	// Shut down the third node. It hands off its entries to the remaining
+	// nodes before leaving.
+	dc3.config.HandoffOnShutdown = true
+	waitForShutdown(dc3)
+	requireOwnersContain(written, peer1, peer2)
+}
+
+func TestAntiEntropy(t *testing.T) {
+	for _, replicationFactor := range []int{2, 3} {
+		t.Run(fmt.Sprintf("R=%d", replicationFactor), func(t *testing.T) {
+			testAntiEntropy(t, replicationFactor)
+		})
+	}
+}
+
+func testAntiEntropy(t *testing.T, replicationFactor int) {
+	env, authenticator, ctx := getEnvAuthAndCtx(t)
+	ctx, err := authenticator.WithAuthenticatedUser(ctx, "user1")
+	require.NoError(t, err)
+	ctx, err = prefix.AttachUserPrefixToContext(ctx, env.GetAuthenticator())
+	require.NoError(t, err)
+	metrics.DistributedCacheAntiEntropyMissingReplicas.Reset()
+
+	singleCacheSizeBytes := int64(10_000_000)
+	peer1 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	peer2 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	peer3 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	baseConfig := CacheConfig{
+		ReplicationFactor:   replicationFactor,
+		Nodes:               []string{peer1, peer2, peer3},
+		DisableLocalLookup:  true,
+		EnableAntiEntropy:   true,
+		AntiEntropyInterval: 100 * time.Millisecond,
+	}
+	localCaches := map[string]*disk_cache.DiskCache{
+		peer1: newDiskCache(t, env, singleCacheSizeBytes),
+		peer2: newDiskCache(t, env, singleCacheSizeBytes),
+		peer3: newDiskCache(t, env, singleCacheSizeBytes),
+	}
+	var dc1 *Cache
+	for _, peer := range []string{peer1, peer2, peer3} {
+		config := baseConfig
+		config.ListenAddr = peer
+		dc := startNewDCache(t, env, config, localCaches[peer])
+		if peer == peer1 {
+			dc1 = dc
+		}
+	}
+	waitForReady(t, peer1)
+	waitForReady(t, peer2)
+	waitForReady(t, peer3)
+
+	var written []*rspb.ResourceName
+	for i := 0; i < 50; i++ {
+		rn, buf := testdigest.RandomCASResourceBuf(t, 100)
+		require.NoError(t, dc1.Set(ctx, rn, buf))
+		written = append(written, rn)
+	}
+
+	// Simulate peer3 losing its disk.
+	lost := 0
+	for _, rn := range written {
+		if slices.Contains(dc1.owners(dc1.consistentHash, rn.GetDigest().GetHash()), peer3) {
+			require.NoError(t, localCaches[peer3].Delete(ctx, rn))
+			lost++
+		}
+	}
+	require.Greater(t, lost, 0)
+
+	// The other replicas copy the lost entries back to peer3.
+	for _, rn := range written {
+		for _, owner := range dc1.owners(dc1.consistentHash, rn.GetDigest().GetHash()) {
+			require.Eventually(t, func() bool {
+				exists, err := localCaches[owner].Contains(ctx, rn)
+				return err == nil && exists
+			}, 10*time.Second, 50*time.Millisecond, "%s not found on owner %q", rn.GetDigest().GetHash(), owner)
+		}
+	}
+	// Each lost replica is repaired by a single node.
+	require.Eventually(t, func() bool {
+		repaired := testmetrics.CounterValueForLabels(t, metrics.DistributedCacheAntiEntropyMissingReplicas, prometheus.Labels{metrics.StatusHumanReadableLabel: "repaired"})
+		return int(repaired) >= lost
+	}, 10*time.Second, 50*time.Millisecond)
+	time.Sleep(3 * baseConfig.AntiEntropyInterval)
+	repaired := testmetrics.CounterValueForLabels(t, metrics.DistributedCacheAntiEntropyMissingReplicas, prometheus.Labels{metrics.StatusHumanReadableLabel: "repaired"})
+	require.Equal(t, lost, int(repaired))
+}
+
 type Op int
 
 const (
@@ -0,0 +1,414 @@
+package distributed
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/claims"
+	"github.com/buildbuddy-io/buildbuddy/server/util/consistent_hash"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	enableOnlineRebalancing   = flag.Bool("cache.distributed_cache.enable_online_rebalancing", false, "If enabled, when peers discovered over redis join or leave the cluster, entries are handed off to their new owners in the background, and reads fall back to the previous owners until the handoff completes. Requires a disk or pebble base cache. ** Enterprise only **")
+	rebalanceDelay            = flag.Duration("cache.distributed_cache.rebalance_delay", 30*time.Second, "How long the set of peers must be stable before entries are handed off to their new owners.")
+	handoffReadFallbackPeriod = flag.Duration("cache.distributed_cache.handoff_read_fallback_period", 5*time.Minute, "How long reads keep falling back to the previous owners of entries after this node's handoff completes, so that other nodes can finish their handoffs.")
+	handoffConcurrency        = flag.Int("cache.distributed_cache.handoff_concurrency", 16, "The maximum number of entries a node hands off to their new owners concurrently.")
+	handoffOnShutdown         = flag.Bool("cache.distributed_cache.handoff_on_shutdown", false, "If enabled along with online rebalancing, a node hands off the entries it owns to the remaining peers when it shuts down. Enable this when nodes are removed from the cluster, not during rolling restarts.")
+)
+
+const (
+	handoffStateIdle     = "idle"
+	handoffStateWaiting  = "waiting for peer set to stabilize"
+	handoffStateRunning  = "running"
+	handoffStateComplete = "complete"
+	handoffStateFailed   = "failed"
+)
+
+// handoffProgress tracks the entries handled by a single handoff.
+type handoffProgress struct {
+	scanned     atomic.Int64
+	transferred atomic.Int64
+	present     atomic.Int64
+	failed      atomic.Int64
+	bytes       atomic.Int64
+}
+
+// rebalancer moves entries to their new owners when peers join or leave the
+// consistent hash ring.
+//
+// Peer set changes are applied to the ring immediately, so writes go to the
+// new owners right away. Once the peer set has been stable for the rebalance
+// delay, each node scans its local cache and copies the entries whose owners
+// changed to the new owners. Until then, and for a grace period afterwards,
+// reads fall back to the owners in the last ring whose handoff completed.
+type rebalancer struct {
+	c              *Cache
+	hashFn         consistent_hash.HashFunction
+	vnodes         int
+	delay          time.Duration
+	fallbackPeriod time.Duration
+
+	mu sync.Mutex
+	// stablePeers is the last peer set whose handoff completed, or nil if
+	// this node hasn't settled on a peer set yet.
+	stablePeers  []string
+	pendingPeers []string
+	// fallback is the ring built from stablePeers. It's set while the
+	// entries may not have been handed off to their new owners yet.
+	fallback *consistent_hash.ConsistentHash
+	// generation is incremented on every peer set change, so that timers
+	// and handoffs started for an older peer set can tell they've been
+	// superseded.
+	generation int64
+	timer      *time.Timer
+	cancel     context.CancelFunc
+
+	state     string
+	fromPeers []string
+	toPeers   []string
+	startTime time.Time
+	endTime   time.Time
+	progress  *handoffProgress
+}
+
+func newRebalancer(c *Cache, hashFn consistent_hash.HashFunction, vnodes int) *rebalancer {
+	return &rebalancer{
+		c:              c,
+		hashFn:         hashFn,
+		vnodes:         vnodes,
+		delay:          c.config.RebalanceDelay,
+		fallbackPeriod: c.config.HandoffReadFallbackPeriod,
+		state:          handoffStateIdle,
+		progress:       &handoffProgress{},
+	}
+}
+
+func (r *rebalancer) newRing(peers []string) *consistent_hash.ConsistentHash {
+	ring := consistent_hash.NewConsistentHash(r.hashFn, r.vnodes)
+	if err := ring.Set(peers...); err != nil {
+		log.Errorf("Error setting peers in consistent hash: %s", err)
+	}
+	return ring
+}
+
+// peersChanged is called when the set of peers in the consistent hash ring
+// changes. It cancels any handoff in progress and schedules a handoff to the
+// new peer set once the peer set has been stable for the rebalance delay.
+func (r *rebalancer) peersChanged(peers []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.generation++
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.stablePeers != nil && r.fallback == nil {
+		r.fallback = r.newRing(r.stablePeers)
+	}
+	r.pendingPeers = peers
+	r.state = handoffStateWaiting
+	generation := r.generation
+	r.timer = time.AfterFunc(r.delay, func() {
+		r.startHandoff(generation)
+	})
+}
+
+func (r *rebalancer) startHandoff(generation int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if generation != r.generation {
+		return
+	}
+	from, to := r.stablePeers, r.pendingPeers
+	if from == nil {
+		// This node just started, so it has nothing to hand off: any
+		// entries it still has from a previous run are owned by the same
+		// nodes as before.
+		r.stablePeers = to
+		r.state = handoffStateIdle
+		return
+	}
+	if slices.Equal(from, to) {
+		r.completeLocked(generation, handoffStateComplete)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.state = handoffStateRunning
+	r.fromPeers, r.toPeers = from, to
+	r.startTime, r.endTime = time.Now(), time.Time{}
+	r.progress = &handoffProgress{}
+	progress := r.progress
+	go func() {
+		defer cancel()
+		metrics.DistributedCacheHandoffInProgress.Set(1)
+		defer metrics.DistributedCacheHandoffInProgress.Set(0)
+
+		log.Infof("Distributed cache %q: handing off entries after peer set changed from %s to %s", r.c.config.ListenAddr, from, to)
+		err := r.handOff(ctx, from, to, false /*=leaving*/, progress)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if generation != r.generation {
+			log.Infof("Distributed cache %q: handoff to %s superseded by another peer set change", r.c.config.ListenAddr, to)
+			return
+		}
+		r.cancel = nil
+		state := handoffStateComplete
+		if err != nil {
+			// Entries that weren't handed off are still found on their
+			// previous owners while reads fall back to them, and are
+			// backfilled to their new owners when they're read.
+			log.Warningf("Distributed cache %q: handoff to %s failed: %s", r.c.config.ListenAddr, to, err)
+			state = handoffStateFailed
+		} else {
+			log.Infof("Distributed cache %q: handoff to %s complete: %d entries transferred, %d already present, %d failed", r.c.config.ListenAddr, to, progress.transferred.Load(), progress.present.Load(), progress.failed.Load())
+		}
+		r.completeLocked(generation, state)
+	}()
+}
+
+// completeLocked marks the pending peer set as stable, and stops falling back
+// to the previous owners of entries after the fallback period.
+func (r *rebalancer) completeLocked(generation int64, state string) {
+	r.stablePeers = r.pendingPeers
+	r.state = state
+	r.endTime = time.Now()
+	if r.fallback == nil {
+		return
+	}
+	r.timer = time.AfterFunc(r.fallbackPeriod, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if generation == r.generation {
+			r.fallback = nil
+		}
+	})
+}
+
+// readFallback returns the ring that reads should fall back to, or nil if
+// all entries are stored on their current owners.
+func (r *rebalancer) readFallback() *consistent_hash.ConsistentHash {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fallback
+}
+
+// stop cancels any scheduled or running handoff.
+func (r *rebalancer) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.generation++
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+}
+
+// drain hands off the entries owned by this node to the nodes that will own
+// them once this node has left the cluster.
+func (r *rebalancer) drain(ctx context.Context) error {
+	from := r.c.consistentHash.GetItems()
+	to := slices.DeleteFunc(slices.Clone(from), func(peer string) bool {
+		return peer == r.c.config.ListenAddr
+	})
+	if len(to) == 0 || len(to) == len(from) {
+		return nil
+	}
+	progress := &handoffProgress{}
+	metrics.DistributedCacheHandoffInProgress.Set(1)
+	defer metrics.DistributedCacheHandoffInProgress.Set(0)
+	log.Infof("Distributed cache %q: handing off entries to %s before shutting down", r.c.config.ListenAddr, to)
+	err := r.handOff(ctx, from, to, true /*=leaving*/, progress)
+	log.Infof("Distributed cache %q: drain finished: %d entries transferred, %d already present, %d failed", r.c.config.ListenAddr, progress.transferred.Load(), progress.present.Load(), progress.failed.Load())
+	return err
+}
+
+func (r *rebalancer) Statusz(ctx context.Context) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	buf := "<pre>"
+	buf += fmt.Sprintf("State: %s\n", r.state)
+	buf += fmt.Sprintf("Stable peers: %s\n", r.stablePeers)
+	if r.state == handoffStateWaiting {
+		buf += fmt.Sprintf("Pending peers: %s\n", r.pendingPeers)
+	}
+	buf += fmt.Sprintf("Reads falling back to previous owners: %t\n", r.fallback != nil)
+	if !r.startTime.IsZero() {
+		buf += fmt.Sprintf("Last handoff: %s -> %s\n", r.fromPeers, r.toPeers)
+		buf += fmt.Sprintf("  Started: %s\n", r.startTime.Format(time.RFC3339))
+		if !r.endTime.IsZero() && r.endTime.After(r.startTime) {
+			buf += fmt.Sprintf("  Finished: %s (took %s)\n", r.endTime.Format(time.RFC3339), r.endTime.Sub(r.startTime))
+		}
+		buf += fmt.Sprintf("  Entries scanned: %d\n", r.progress.scanned.Load())
+		buf += fmt.Sprintf("  Entries transferred: %d (%d bytes)\n", r.progress.transferred.Load(), r.progress.bytes.Load())
+		buf += fmt.Sprintf("  Entries already present: %d\n", r.progress.present.Load())
+		buf += fmt.Sprintf("  Entries failed: %d\n", r.progress.failed.Load())
+	}
+	buf += "</pre>"
+	return buf
+}
+
+// owners returns the replicationFactor peers that own key in ring.
+func (c *Cache) owners(ring *consistent_hash.ConsistentHash, key string) []string {
+	peers := ring.GetAllReplicas(key)
+	if len(peers) > c.config.ReplicationFactor {
+		peers = peers[:c.config.ReplicationFactor]
+	}
+	return peers
+}
+
+// handoffTransfer is a local entry that must be copied to a new owner.
+type handoffTransfer struct {
+	info *interfaces.CacheEntryInfo
+	peer string
+}
+
+// handOff copies the local entries whose owners differ between the from and
+// to peer sets to their new owners.
+//
+// Each entry is handed off by a single node: the first of its previous
+// owners that is still a member of the cluster. If leaving is true, this node
+// is leaving the cluster and hands off every entry it previously owned.
+//
+// The entries to hand off are collected before any of them are copied, so
+// that the local cache isn't iterated over while waiting on the network.
+func (r *rebalancer) handOff(ctx context.Context, from, to []string, leaving bool, progress *handoffProgress) error {
+	c := r.c
+	lister, ok := c.local.(interfaces.CacheLister)
+	if !ok {
+		return status.UnimplementedError("local cache does not support listing entries")
+	}
+	fromRing, toRing := r.newRing(from), r.newRing(to)
+
+	var transfers []handoffTransfer
+	err := lister.ListEntries(ctx, nil, func(info *interfaces.CacheEntryInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		progress.scanned.Add(1)
+		key := info.Resource.GetDigest().GetHash()
+		oldOwners := c.owners(fromRing, key)
+		if leaving {
+			if !slices.Contains(oldOwners, c.config.ListenAddr) {
+				return nil
+			}
+		} else {
+			i := slices.IndexFunc(oldOwners, func(peer string) bool {
+				return slices.Contains(to, peer)
+			})
+			if i < 0 || oldOwners[i] != c.config.ListenAddr {
+				return nil
+			}
+		}
+		for _, peer := range c.owners(toRing, key) {
+			if peer == c.config.ListenAddr || (!leaving && slices.Contains(oldOwners, peer)) {
+				continue
+			}
+			transfers = append(transfers, handoffTransfer{info: info, peer: peer})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	eg, gCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(*handoffConcurrency)
+	for _, t := range transfers {
+		if gCtx.Err() != nil {
+			break
+		}
+		eg.Go(func() error {
+			r.handOffEntry(gCtx, t.info, t.peer, progress)
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+func (r *rebalancer) handOffEntry(ctx context.Context, info *interfaces.CacheEntryInfo, peer string, progress *handoffProgress) {
+	n, err := r.c.transferEntry(ctx, info, peer)
+	switch {
+	case err != nil:
+		if ctx.Err() != nil {
+			return
+		}
+		r.c.log.CtxDebugf(ctx, "Failed to hand off %s to peer %q: %s", info.Resource.GetDigest().GetHash(), peer, err)
+		progress.failed.Add(1)
+		metrics.DistributedCacheHandoffEntries.With(prometheus.Labels{metrics.StatusHumanReadableLabel: "failed"}).Inc()
+	case n < 0:
+		progress.present.Add(1)
+		metrics.DistributedCacheHandoffEntries.With(prometheus.Labels{metrics.StatusHumanReadableLabel: "present"}).Inc()
+	default:
+		progress.transferred.Add(1)
+		progress.bytes.Add(n)
+		metrics.DistributedCacheHandoffEntries.With(prometheus.Labels{metrics.StatusHumanReadableLabel: "transferred"}).Inc()
+		metrics.DistributedCacheHandoffBytes.Add(float64(n))
+	}
+}
+
+// entryContext returns a context that is authenticated as the group that owns
+// a local entry.
+func (c *Cache) entryContext(ctx context.Context, info *interfaces.CacheEntryInfo) (context.Context, error) {
+	if info.GroupID != "" && info.GroupID != interfaces.AuthAnonymousUser {
+		ctx = claims.AuthContextWithJWT(ctx, &claims.Claims{GroupID: info.GroupID, AllowedGroups: []string{info.GroupID}}, nil)
+	}
+	return prefix.AttachUserPrefixToContext(ctx, c.env.GetAuthenticator())
+}
+
+// transferEntry copies a local entry to peer on behalf of the group that owns
+// it, and returns the number of bytes copied, or -1 if peer already had the
+// entry.
+func (c *Cache) transferEntry(ctx context.Context, info *interfaces.CacheEntryInfo, peer string) (int64, error) {
+	ctx, err := c.entryContext(ctx, info)
+	if err != nil {
+		return 0, err
+	}
+	rn := info.Resource
+	if exists, err := c.distributedProxy.RemoteContains(ctx, peer, rn); err == nil && exists {
+		return -1, nil
+	}
+	rc, err := c.local.Reader(ctx, rn, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	wc, err := c.distributedProxy.RemoteWriter(ctx, peer, "", rn)
+	if err != nil {
+		return 0, err
+	}
+	defer wc.Close()
+	n, err := io.Copy(wc, rc)
+	if err != nil {
+		return 0, err
+	}
+	if err := wc.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
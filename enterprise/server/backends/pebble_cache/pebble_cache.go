@@ -11,6 +11,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -18,8 +19,8 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/filestore"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/raft/keys"
-	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/chunker"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/pebble"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore/gcs"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
@@ -30,6 +31,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/approxlru"
 	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/bytebufferpool"
+	"github.com/buildbuddy-io/buildbuddy/server/util/chunker"
 	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
@@ -68,7 +70,7 @@ var (
 	backgroundRepairFrequency = flag.Duration("cache.pebble.background_repair_frequency", 1*24*time.Hour, "How frequently to run period background repair tasks.")
 	backgroundRepairQPSLimit  = flag.Int("cache.pebble.background_repair_qps_limit", 100, "QPS limit for background repair modifications.")
 	scanForMissingFiles       = flag.Bool("cache.pebble.scan_for_missing_files", false, "If set, scan all keys and check if external files are missing on disk. Deletes keys with missing files.")
-	scanForOrphanedFiles      = flag.Bool("cache.pebble.scan_for_orphaned_files", false, "If true, scan for orphaned files")
+	scanForOrphanedFiles      = flag.Bool("cache.pebble.scan_for_orphaned_files", false, "If true, scan for orphaned files and external blobs")
 	orphanDeleteDryRun        = flag.Bool("cache.pebble.orphan_delete_dry_run", true, "If set, log orphaned files instead of deleting them")
 	dirDeletionDelay          = flag.Duration("cache.pebble.dir_deletion_delay", time.Hour, "How old directories must be before being eligible for deletion when empty")
 	atimeUpdateThresholdFlag  = flag.Duration("cache.pebble.atime_update_threshold", DefaultAtimeUpdateThreshold, "Don't update atime if it was updated more recently than this")
@@ -90,6 +92,8 @@ var (
 	enableTableBloomFilter    = flag.Bool("cache.pebble.enable_table_bloom_filter", true, "If true, write bloom filter data with pebble SSTables.")
 	enableAutoRatchet         = flag.Bool("cache.pebble.enable_auto_ratchet", false, "If true, automatically upgrade on-disk format to latest version.")
 	groupTrackingMinTimeUsec  = flag.Int64("cache.pebble.min_time_for_group_tracking_usec", math.MaxInt64, "If a file was created after this timestamp, we will count it when tracking cache space usage by group.")
+	groupQuotasFlag           = flag.Slice("cache.pebble.group_quotas", []GroupQuota{}, "The maximum number of bytes that a group may store in a partition. When a group exceeds its quota, its least recently used entries in the partition are evicted. Requires min_time_for_group_tracking_usec to be set.")
+	defaultGroupQuotaFraction = flag.Float64("cache.pebble.default_group_quota_fraction", 0, "If > 0, the maximum fraction of a partition's size that a group without a quota in group_quotas may store in the partition. Requires min_time_for_group_tracking_usec to be set.")
 
 	activeKeyVersion  = flag.Int64("cache.pebble.active_key_version", int64(filestore.UnspecifiedKeyVersion), "The key version new data will be written with. If negative, will write to the highest existing version in the database, or the highest known version if a new database is created.")
 	migrationQPSLimit = flag.Int("cache.pebble.migration_qps_limit", 50, "QPS limit for data version migration")
@@ -106,6 +110,11 @@ var (
 	gcsCredentials = flag.String("cache.pebble.gcs.credentials", "", "Credentials in JSON format that will be used to authenticate to GCS.", flag.Secret)
 	gcsProjectID   = flag.String("cache.pebble.gcs.project_id", "", "The Google Cloud project ID of the project owning the above credentials and GCS bucket.")
 	gcsAppName     = flag.String("cache.pebble.gcs.app_name", "", "The app name, under which blobstore data will be stored.")
+
+	// Generic blobstore Large File Support
+	blobstoreEnabled = flag.Bool("cache.pebble.blobstore.enabled", false, "If true, store files larger than min_gcs_file_size_bytes in the blobstore configured by the storage.* flags (e.g. S3, MinIO, Azure or disk).")
+	blobstoreAppName = flag.String("cache.pebble.blobstore.app_name", "", "The app name, under which blobstore data will be stored.")
+	blobstoreTTLDays = flag.Int64("cache.pebble.blobstore.ttl_days", 0, "The TTL, specified in days, of the lifecycle rule configured on the blobstore bucket (0 means disabled). Unlike GCS, blobs expire based on their creation time, and the rule must be configured on the bucket by the operator.")
 )
 
 var (
@@ -144,6 +153,10 @@ const (
 	partitionMetadataFlushPeriod = 5 * time.Second
 	metricsRefreshPeriod         = 30 * time.Second
 
+	// Externally stored blobs modified more recently than this are never
+	// considered orphaned, since their metadata may not be written yet.
+	orphanedBlobGracePeriod = time.Hour
+
 	// CompressorBufSizeBytes is the buffer size we use for each chunk when compressing data
 	// It should be relatively large to get a good compression ratio bc each chunk is compressed independently
 	CompressorBufSizeBytes = 4e6 // 4 MB
@@ -167,6 +180,14 @@ const (
 	deleteSizeOp
 )
 
+// GroupQuota limits the number of bytes that a group may store in a
+// partition.
+type GroupQuota struct {
+	GroupID      string `yaml:"group_id" json:"group_id" usage:"The Group ID to which this quota applies."`
+	PartitionID  string `yaml:"partition_id" json:"partition_id" usage:"The partition to which this quota applies. Defaults to the default partition."`
+	MaxSizeBytes int64  `yaml:"max_size_bytes" json:"max_size_bytes" usage:"The maximum number of bytes the group may store in the partition."`
+}
+
 // Options is a struct containing the pebble cache configuration options.
 // Once a cache is created, the options may not be changed.
 type Options struct {
@@ -194,6 +215,12 @@ type Options struct {
 
 	IncludeMetadataSize bool
 
+	// GroupQuotas limit the number of bytes that individual groups may
+	// store in a partition. Groups without a quota in a partition may store
+	// up to DefaultGroupQuotaFraction of the partition's size, if set.
+	GroupQuotas               []GroupQuota
+	DefaultGroupQuotaFraction float64
+
 	ActiveKeyVersion *int64
 
 	Clock clockwork.Clock
@@ -207,7 +234,14 @@ type Options struct {
 	GCSAppName          string
 	GCSTTLDays          *int64
 	MinGCSFileSizeBytes *int64
-	FileStorer          filestore.Store
+
+	// Blobstore, if set, is used instead of GCS to store files larger than
+	// MinGCSFileSizeBytes.
+	Blobstore        interfaces.Blobstore
+	BlobstoreAppName string
+	BlobstoreTTLDays *int64
+
+	FileStorer filestore.Store
 }
 
 type sizeUpdate struct {
@@ -275,7 +309,11 @@ type PebbleCache struct {
 	metricsCollector *pebble.MetricsCollector
 
 	minGCSFileSizeBytes int64
-	gcsTTLDays          int64
+	blobTTLDays         int64
+	// blobsNeverExpire is set when a generic blobstore without a lifecycle
+	// TTL is used for external blobs. (A GCS bucket TTL of 0 is handled as
+	// it always has been.)
+	blobsNeverExpire bool
 }
 
 type keyMigrator interface {
@@ -353,6 +391,8 @@ func Register(env *real_environment.RealEnv) error {
 		MinEvictionAge:              minEvictionAgeFlag,
 		AverageChunkSizeBytes:       *averageChunkSizeBytes,
 		IncludeMetadataSize:         *includeMetadataSize,
+		GroupQuotas:                 *groupQuotasFlag,
+		DefaultGroupQuotaFraction:   *defaultGroupQuotaFraction,
 		ActiveKeyVersion:            activeKeyVersion,
 		GCSBucket:                   *gcsBucket,
 		GCSCredentials:              *gcsCredentials,
@@ -362,6 +402,22 @@ func Register(env *real_environment.RealEnv) error {
 		MinGCSFileSizeBytes:         minGCSFileSizeBytesFlag,
 		EnableAutoRatchet:           *enableAutoRatchet,
 	}
+	if *blobstoreEnabled {
+		if *gcsBucket != "" {
+			return status.InvalidArgumentError("cache.pebble.gcs.bucket and cache.pebble.blobstore.enabled are mutually exclusive")
+		}
+		bs := env.GetBlobstore()
+		if bs == nil {
+			var err error
+			bs, err = blobstore.NewFromConfig(env.GetServerContext())
+			if err != nil {
+				return status.InternalErrorf("Error configuring pebble cache blobstore: %s", err)
+			}
+		}
+		opts.Blobstore = bs
+		opts.BlobstoreAppName = *blobstoreAppName
+		opts.BlobstoreTTLDays = blobstoreTTLDays
+	}
 	c, err := NewPebbleCache(env, opts)
 	if err != nil {
 		return status.InternalErrorf("Error configuring pebble cache: %s", err)
@@ -410,6 +466,24 @@ func validateOpts(opts *Options) error {
 		}
 	}
 
+	for _, q := range opts.GroupQuotas {
+		if q.GroupID == "" {
+			return status.InvalidArgumentError("Group quotas must specify a group ID")
+		}
+		if q.MaxSizeBytes <= 0 {
+			return status.InvalidArgumentErrorf("Quota for group %q must be greater than 0", q.GroupID)
+		}
+		if q.PartitionID != "" && q.PartitionID != DefaultPartitionID && !hasPartition(opts.Partitions, q.PartitionID) {
+			return status.NotFoundErrorf("Quota for group %q in unknown partition %q", q.GroupID, q.PartitionID)
+		}
+	}
+	if opts.DefaultGroupQuotaFraction < 0 || opts.DefaultGroupQuotaFraction > 1 {
+		return status.InvalidArgumentErrorf("Default group quota fraction must be between 0 and 1, got %f", opts.DefaultGroupQuotaFraction)
+	}
+	if (len(opts.GroupQuotas) > 0 || opts.DefaultGroupQuotaFraction > 0) && *groupTrackingMinTimeUsec == math.MaxInt64 {
+		return status.FailedPreconditionError("Group quotas require cache.pebble.min_time_for_group_tracking_usec to be set")
+	}
+
 	return nil
 }
 
@@ -466,6 +540,10 @@ func SetOptionDefaults(opts *Options) {
 		var ttlInDays int64 = 0
 		opts.GCSTTLDays = &ttlInDays
 	}
+	if opts.BlobstoreTTLDays == nil || *opts.BlobstoreTTLDays == 0 {
+		var ttlInDays int64 = 0
+		opts.BlobstoreTTLDays = &ttlInDays
+	}
 }
 
 func ensureDefaultPartitionExists(opts *Options) {
@@ -584,6 +662,13 @@ func NewPebbleCache(env environment.Env, opts *Options) (*PebbleCache, error) {
 		clock = clockwork.NewRealClock()
 	}
 
+	if opts.GCSBucket != "" && opts.Blobstore != nil {
+		return nil, status.InvalidArgumentError("GCSBucket and Blobstore are mutually exclusive")
+	}
+	blobTTLDays := *opts.GCSTTLDays
+	if opts.Blobstore != nil {
+		blobTTLDays = *opts.BlobstoreTTLDays
+	}
 	fileStorer := opts.FileStorer
 	if fileStorer == nil {
 		filestoreOpts := make([]filestore.Option, 0)
@@ -605,6 +690,10 @@ func NewPebbleCache(env environment.Env, opts *Options) (*PebbleCache, error) {
 			filestoreOpts = append(filestoreOpts, filestore.WithGCSBlobstore(gcsBlobstore, opts.GCSAppName))
 			log.Printf("Pebble Cache: storing files larger than %d bytes in GCS (bucket: %q)", *opts.MinGCSFileSizeBytes, opts.GCSBucket)
 			log.Printf("Pebble Cache: GCS TTL is set to %d days", *opts.GCSTTLDays)
+		} else if opts.Blobstore != nil {
+			filestoreOpts = append(filestoreOpts, filestore.WithBlobstore(opts.Blobstore, opts.BlobstoreAppName), filestore.WithClock(clock))
+			log.Printf("Pebble Cache: storing files larger than %d bytes in blobstore (app name: %q)", *opts.MinGCSFileSizeBytes, opts.BlobstoreAppName)
+			log.Printf("Pebble Cache: blobstore TTL is set to %d days", *opts.BlobstoreTTLDays)
 		}
 		fileStorer = filestore.New(filestoreOpts...)
 	}
@@ -641,7 +730,8 @@ func NewPebbleCache(env environment.Env, opts *Options) (*PebbleCache, error) {
 		metricsCollector:            mc,
 		includeMetadataSize:         opts.IncludeMetadataSize,
 		minGCSFileSizeBytes:         *opts.MinGCSFileSizeBytes,
-		gcsTTLDays:                  *opts.GCSTTLDays,
+		blobTTLDays:                 blobTTLDays,
+		blobsNeverExpire:            opts.Blobstore != nil && blobTTLDays == 0,
 		fileStorer:                  fileStorer,
 	}
 
@@ -724,7 +814,8 @@ func NewPebbleCache(env environment.Env, opts *Options) (*PebbleCache, error) {
 			if err := disk.EnsureDirectoryExists(blobDir); err != nil {
 				return err
 			}
-			pe, err := newPartitionEvictor(env.GetServerContext(), part, pc.fileStorer, blobDir, pc.leaser, pc.locker, pc, clock, *opts.MinEvictionAge, opts.Name, opts.IncludeMetadataSize, *opts.SampleBufferSize, *opts.SamplesPerBatch, *opts.SamplerIterRefreshPeriod, *opts.DeleteBufferSize, *opts.NumDeleteWorkers)
+			quotas := newGroupQuotas(part, opts.GroupQuotas, opts.DefaultGroupQuotaFraction)
+			pe, err := newPartitionEvictor(env.GetServerContext(), part, pc.fileStorer, blobDir, pc.leaser, pc.locker, pc, clock, *opts.MinEvictionAge, opts.Name, opts.IncludeMetadataSize, *opts.SampleBufferSize, *opts.SamplesPerBatch, *opts.SamplerIterRefreshPeriod, *opts.DeleteBufferSize, *opts.NumDeleteWorkers, quotas)
 			if err != nil {
 				return err
 			}
@@ -902,18 +993,23 @@ func (p *PebbleCache) updateAtime(key filestore.PebbleKey) error {
 		metrics.CacheNameLabel: p.name,
 	}
 
-	// If this is a GCS object, update the custom time and record the new
-	// custom time.
+	// If this is an externally stored blob, update the custom time and
+	// record the new custom time. Blob storage without custom times
+	// expires blobs based on their creation time, so the recorded custom
+	// time is left as is.
 	if gcsMetadata := md.GetStorageMetadata().GetGcsMetadata(); gcsMetadata != nil {
-		if p.gcsObjectIsPastTTL(gcsMetadata) {
+		if p.blobIsPastTTL(gcsMetadata) {
 			return nil
 		}
-		if err := p.fileStorer.UpdateBlobAtime(p.env.GetServerContext(), gcsMetadata, newAtime); err != nil {
+		err := p.fileStorer.UpdateBlobAtime(p.env.GetServerContext(), gcsMetadata, newAtime)
+		if err != nil && !status.IsUnimplementedError(err) {
 			metrics.PebbleCacheAtimeUpdateGCSErrorCount.With(lbls).Inc()
-			log.Errorf("Error updating GCS custom time (%q): %s", key, err)
+			log.Errorf("Error updating blob custom time (%q): %s", key, err)
 			return err
 		}
-		md.StorageMetadata.GcsMetadata.LastCustomTimeUsec = newAtime.UnixMicro()
+		if err == nil {
+			md.StorageMetadata.GcsMetadata.LastCustomTimeUsec = newAtime.UnixMicro()
+		}
 	}
 
 	md.LastAccessUsec = newAtime.UnixMicro()
@@ -1176,10 +1272,78 @@ func (p *PebbleCache) deleteOrphanedFiles(quitChan chan struct{}) error {
 		alert.UnexpectedEvent("pebble_cache_error_deleting_orphans", "err [%s]: %s", p.name, err)
 	}
 	log.Infof("Pebble Cache [%s]: deleteOrphanedFiles removed %d files", p.name, orphanCount)
+
+	blobOrphanCount, err := p.deleteOrphanedBlobs(db, quitChan)
+	if err != nil {
+		alert.UnexpectedEvent("pebble_cache_error_deleting_orphans", "err [%s]: %s", p.name, err)
+	}
+	log.Infof("Pebble Cache [%s]: deleteOrphanedFiles removed %d external blobs", p.name, blobOrphanCount)
 	close(p.orphanedFilesDone)
 	return nil
 }
 
+// deleteOrphanedBlobs deletes blobs in external blob storage that are not
+// referenced by any metadata record. Blobs modified within
+// orphanedBlobGracePeriod are skipped, since their metadata may not have
+// been written yet.
+func (p *PebbleCache) deleteOrphanedBlobs(db pebble.IPebbleDB, quitChan chan struct{}) (int, error) {
+	ctx := p.env.GetServerContext()
+	orphanCount := 0
+	listFn := func(blobName string, lastModified time.Time) error {
+		// Check if we're shutting down; exit if so.
+		select {
+		case <-quitChan:
+			return status.CanceledErrorf("cache shutting down")
+		default:
+		}
+
+		if p.clock.Since(lastModified) < orphanedBlobGracePeriod {
+			return nil
+		}
+		key, err := p.fileStorer.BlobPebbleKey(blobName)
+		if err != nil {
+			log.Warningf("[%s] Skipping orphaned blob: %q: %s", p.name, blobName, err)
+			return nil
+		}
+
+		unlockFn := p.locker.RLock(key.LockID())
+		md := sgpb.FileMetadataFromVTPool()
+		err = p.lookupFileMetadata(ctx, db, key, md)
+		// A newer write of the same key may have replaced this blob with
+		// a differently salted one.
+		referenced := err == nil && md.GetStorageMetadata().GetGcsMetadata().GetBlobName() == blobName
+		md.ReturnToVTPool()
+		unlockFn()
+
+		if err != nil && !status.IsNotFoundError(err) {
+			return err
+		}
+		if referenced {
+			return nil
+		}
+		if *orphanDeleteDryRun {
+			log.Infof("[%s] Would delete orphaned blob: %s (last modified: %s) which is not in cache", p.name, blobName, lastModified)
+		} else {
+			if err := p.fileStorer.DeleteStoredBlob(ctx, &sgpb.StorageMetadata_GCSMetadata{BlobName: blobName}); err != nil {
+				log.Warningf("[%s] Error deleting orphaned blob %q: %s", p.name, blobName, err)
+				return nil
+			}
+			log.Infof("[%s] Removed orphaned blob: %q", p.name, blobName)
+		}
+		orphanCount += 1
+		if orphanCount%1000 == 0 {
+			log.Infof("[%s] Removed %d orphaned blobs", p.name, orphanCount)
+		}
+		return nil
+	}
+	err := p.fileStorer.ListStoredBlobs(ctx, listFn)
+	if status.IsFailedPreconditionError(err) || status.IsUnimplementedError(err) {
+		// No external blob storage is configured, or it can't be listed.
+		return 0, nil
+	}
+	return orphanCount, err
+}
+
 func (p *PebbleCache) backgroundRepair(quitChan chan struct{}) error {
 	fixMissingFiles := *scanForMissingFiles
 
@@ -1307,8 +1471,7 @@ func (p *PebbleCache) backgroundRepairPartition(db pebble.IPebbleDB, evictor *pa
 		removedEntry := false
 		if opts.deleteEntriesWithMissingFiles {
 			blobDir = p.blobDir()
-			_, err := p.fileStorer.NewReader(p.env.GetServerContext(), blobDir, fileMetadata.GetStorageMetadata(), 0, 0)
-			if err != nil {
+			if err := p.checkStoredFile(p.env.GetServerContext(), blobDir, fileMetadata); err != nil {
 				_ = modLim.Wait(p.env.GetServerContext())
 
 				unlockFn := p.locker.Lock(key.LockID())
@@ -1335,6 +1498,28 @@ func (p *PebbleCache) backgroundRepairPartition(db pebble.IPebbleDB, evictor *pa
 	}
 }
 
+// checkStoredFile returns a NotFound error if the data described by
+// fileMetadata is missing.
+func (p *PebbleCache) checkStoredFile(ctx context.Context, blobDir string, fileMetadata *sgpb.FileMetadata) error {
+	md := fileMetadata.GetStorageMetadata()
+	if gcsMetadata := md.GetGcsMetadata(); gcsMetadata != nil {
+		// Avoid downloading externally stored blobs just to check that
+		// they exist.
+		if p.blobIsPastTTL(gcsMetadata) {
+			return status.NotFoundError("backing object may have expired")
+		}
+		if !p.fileStorer.FileExists(ctx, blobDir, md) {
+			return status.NotFoundErrorf("blob %q not found", gcsMetadata.GetBlobName())
+		}
+		return nil
+	}
+	rc, err := p.fileStorer.NewReader(ctx, blobDir, md, 0, 0)
+	if err != nil {
+		return err
+	}
+	return rc.Close()
+}
+
 func (p *PebbleCache) backgroundRepairIteration(quitChan chan struct{}, opts *repairOpts) error {
 	log.Infof("Pebble Cache [%s]: backgroundRepairIteration starting", p.name)
 
@@ -1545,12 +1730,12 @@ func (p *PebbleCache) handleMetadataMismatch(ctx context.Context, causeErr error
 	if !status.IsNotFoundError(causeErr) && !os.IsNotExist(causeErr) {
 		return false
 	}
-	if fileMetadata.GetStorageMetadata().GetFileMetadata() != nil {
+	if md := fileMetadata.GetStorageMetadata(); md.GetFileMetadata() != nil || md.GetGcsMetadata() != nil {
 		err := p.deleteMetadataOnly(ctx, key)
 		if err != nil && status.IsNotFoundError(err) {
 			return false
 		}
-		log.Warningf("[%s] Metadata record %q was found but file (%+v) not found on disk: %s", p.name, key.String(), fileMetadata, causeErr)
+		log.Warningf("[%s] Metadata record %q was found but file (%+v) not found: %s", p.name, key.String(), fileMetadata, causeErr)
 		if err != nil {
 			log.Warningf("[%s] Error deleting metadata: %s", p.name, err)
 			return false
@@ -1655,11 +1840,11 @@ func (p *PebbleCache) findMissing(ctx context.Context, db pebble.IPebbleDB, r *r
 		log.Infof("Ignoring zero-length file. Key: %q, md: %+v", key, md)
 		return status.NotFoundError("object not found (zero-length)")
 	}
-	// If this is a GCS object, ensure the custom time is relatively recent
-	// so that we avoid saying something exists when it's been deleted by
-	// a GCS lifecycle rule.
+	// If this is an externally stored blob, ensure the custom time is
+	// relatively recent so that we avoid saying something exists when it's
+	// been deleted by a lifecycle rule.
 	if gcsMetadata := md.GetStorageMetadata().GetGcsMetadata(); gcsMetadata != nil {
-		if p.gcsObjectIsPastTTL(gcsMetadata) {
+		if p.blobIsPastTTL(gcsMetadata) {
 			return status.NotFoundError("backing object may have expired")
 		}
 	}
@@ -1668,7 +1853,10 @@ func (p *PebbleCache) findMissing(ctx context.Context, db pebble.IPebbleDB, r *r
 	return nil
 }
 
-func (p *PebbleCache) gcsObjectIsPastTTL(gcsMetadata *sgpb.StorageMetadata_GCSMetadata) bool {
+func (p *PebbleCache) blobIsPastTTL(gcsMetadata *sgpb.StorageMetadata_GCSMetadata) bool {
+	if p.blobsNeverExpire {
+		return false
+	}
 	// The GCS TTL is set as an integer number of days. The docs are vague,
 	// but it seems plausible that if a file is *ever* marked for deletion,
 	// it will be deleted, even if it has changed since. Basically, there is
@@ -1680,7 +1868,7 @@ func (p *PebbleCache) gcsObjectIsPastTTL(gcsMetadata *sgpb.StorageMetadata_GCSMe
 	// TTL, assume it has already been marked for deletion.
 	customTimeUsec := gcsMetadata.GetLastCustomTimeUsec()
 	buffer := time.Hour
-	return p.clock.Since(time.UnixMicro(customTimeUsec))+buffer > time.Duration(p.gcsTTLDays*24)*time.Hour
+	return p.clock.Since(time.UnixMicro(customTimeUsec))+buffer > time.Duration(p.blobTTLDays*24)*time.Hour
 }
 
 func (p *PebbleCache) Get(ctx context.Context, r *rspb.ResourceName) ([]byte, error) {
@@ -2492,6 +2680,10 @@ func (p *PebbleCache) TestingWaitForGC(ctx context.Context) error {
 type evictionKey struct {
 	bytes           []byte
 	storageMetadata *sgpb.StorageMetadata
+
+	// quotaGroupID is set if the key is evicted because the group that owns
+	// it exceeded its quota.
+	quotaGroupID string
 }
 
 func (k *evictionKey) ID() string {
@@ -2523,6 +2715,10 @@ type partitionEvictor struct {
 	casCount    int64
 	acCount     int64
 
+	quotas          *groupQuotas
+	groupsOverQuota map[string]struct{}
+	quotaCandidates map[string][]*approxlru.Sample[*evictionKey]
+
 	atimeBufferSize  int
 	minEvictionAge   time.Duration
 	activeKeyVersion int64
@@ -2539,7 +2735,7 @@ type versionGetter interface {
 	minDatabaseVersion() filestore.PebbleKeyVersion
 }
 
-func newPartitionEvictor(ctx context.Context, part disk.Partition, fileStorer filestore.Store, blobDir string, dbg pebble.Leaser, locker lockmap.Locker, vg versionGetter, clock clockwork.Clock, minEvictionAge time.Duration, cacheName string, includeMetadataSize bool, sampleBufferSize int, samplesPerBatch int, samplerIterRefreshPeriod time.Duration, deleteBufferSize int, numDeleteWorkers int) (*partitionEvictor, error) {
+func newPartitionEvictor(ctx context.Context, part disk.Partition, fileStorer filestore.Store, blobDir string, dbg pebble.Leaser, locker lockmap.Locker, vg versionGetter, clock clockwork.Clock, minEvictionAge time.Duration, cacheName string, includeMetadataSize bool, sampleBufferSize int, samplesPerBatch int, samplerIterRefreshPeriod time.Duration, deleteBufferSize int, numDeleteWorkers int, quotas *groupQuotas) (*partitionEvictor, error) {
 	pe := &partitionEvictor{
 		ctx:                      ctx,
 		mu:                       &sync.Mutex{},
@@ -2560,6 +2756,9 @@ func newPartitionEvictor(ctx context.Context, part disk.Partition, fileStorer fi
 		numDeleteWorkers:         numDeleteWorkers,
 		includeMetadataSize:      includeMetadataSize,
 		sizeByGroup:              make(map[string]int64),
+		quotas:                   quotas,
+		groupsOverQuota:          make(map[string]struct{}),
+		quotaCandidates:          make(map[string][]*approxlru.Sample[*evictionKey]),
 	}
 	metricLbls := prometheus.Labels{
 		metrics.PartitionID:    part.ID,
@@ -2596,6 +2795,9 @@ func newPartitionEvictor(ctx context.Context, part disk.Partition, fileStorer fi
 	pe.casCount = casCount
 	pe.acCount = acCount
 	pe.sizeByGroup = sizeByGroup
+	for groupID := range sizeByGroup {
+		pe.updateQuotaStatusLocked(groupID)
+	}
 	pe.lru.UpdateSizeBytes(sizeBytes)
 
 	log.Infof("Pebble Cache [%s]: Initialized cache partition %q AC: %d, CAS: %d, Size: %d [bytes] in %s", pe.cacheName, part.ID, pe.acCount, pe.casCount, pe.sizeBytes, time.Since(start))
@@ -2682,7 +2884,7 @@ func (e *partitionEvictor) generateSamplesForEviction(quitChan chan struct{}) er
 		// entries to evict. We will sleep for some time to prevent from
 		// constantly generating samples in vain.
 		e.mu.Lock()
-		shouldSleep := e.sizeBytes <= int64(SamplerSleepThreshold*float64(e.part.MaxSizeBytes))
+		shouldSleep := e.sizeBytes <= int64(SamplerSleepThreshold*float64(e.part.MaxSizeBytes)) && len(e.groupsOverQuota) == 0
 		e.mu.Unlock()
 		if shouldSleep {
 			select {
@@ -2764,6 +2966,15 @@ func (e *partitionEvictor) maybeAddToSampleChan(iter pebble.Iterator, fileMetada
 		SizeBytes: sizeBytes,
 		Timestamp: atime,
 	}
+	if groupID := fileMetadata.GetFileRecord().GetIsolation().GetGroupId(); e.quotas.enabled() && fileMetadata.GetLastModifyUsec() > *groupTrackingMinTimeUsec {
+		e.mu.Lock()
+		_, overQuota := e.groupsOverQuota[groupID]
+		e.mu.Unlock()
+		if overQuota {
+			e.addQuotaEvictionCandidate(groupID, sample, quitChan)
+			return
+		}
+	}
 	timeutil.StopAndDrainClockworkTimer(timer)
 	timer.Reset(SamplerSleepDuration)
 	select {
@@ -2798,6 +3009,61 @@ func (e *partitionEvictor) updateMetrics() {
 			metrics.CacheNameLabel: e.cacheName,
 			metrics.GroupID:        g}).Set(float64(sizeBytes))
 	}
+	// The default quota applies to every other group, so only the explicitly
+	// configured quotas are reported per group.
+	for g, limit := range e.quotas.explicit() {
+		metrics.DiskCachePartitionGroupQuotaBytes.With(prometheus.Labels{
+			metrics.PartitionID:    e.part.ID,
+			metrics.CacheNameLabel: e.cacheName,
+			metrics.GroupID:        g}).Set(float64(limit))
+	}
+}
+
+// updateQuotaStatusLocked records whether groupID stores more bytes in the
+// partition than its quota allows.
+func (e *partitionEvictor) updateQuotaStatusLocked(groupID string) {
+	if limit := e.quotas.limit(groupID); limit > 0 && e.sizeByGroup[groupID] > limit {
+		e.groupsOverQuota[groupID] = struct{}{}
+	} else {
+		delete(e.groupsOverQuota, groupID)
+	}
+}
+
+// addQuotaEvictionCandidate collects samples of the entries owned by a group
+// that exceeds its quota. Once enough samples have been collected, the least
+// recently used of them are evicted, regardless of how full the partition is.
+func (e *partitionEvictor) addQuotaEvictionCandidate(groupID string, sample *approxlru.Sample[*evictionKey], quitChan chan struct{}) {
+	sample.Key.quotaGroupID = groupID
+	e.mu.Lock()
+	candidates := append(e.quotaCandidates[groupID], sample)
+	if len(candidates) < *samplesPerEviction {
+		e.quotaCandidates[groupID] = candidates
+		e.mu.Unlock()
+		return
+	}
+	delete(e.quotaCandidates, groupID)
+	_, overQuota := e.groupsOverQuota[groupID]
+	e.mu.Unlock()
+	if !overQuota {
+		return
+	}
+
+	// Candidates may have been waiting for a while, so check their age
+	// again. Entries that were used recently are never evicted, even if
+	// their group is over its quota.
+	candidates = slices.DeleteFunc(candidates, func(c *approxlru.Sample[*evictionKey]) bool {
+		return e.clock.Since(c.Timestamp) < e.minEvictionAge
+	})
+	slices.SortFunc(candidates, func(a, b *approxlru.Sample[*evictionKey]) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+	for _, c := range candidates[:min(*deletesPerEviction, len(candidates))] {
+		select {
+		case e.deletes <- c:
+		case <-quitChan:
+			return
+		}
+	}
 }
 
 func (e *partitionEvictor) updateSize(cacheType rspb.CacheType, lastModifyUsec int64, groupID string, deltaSize int64) {
@@ -2811,6 +3077,7 @@ func (e *partitionEvictor) updateSize(cacheType rspb.CacheType, lastModifyUsec i
 
 	if lastModifyUsec > *groupTrackingMinTimeUsec {
 		e.sizeByGroup[groupID] += deltaSize
+		e.updateQuotaStatusLocked(groupID)
 	}
 
 	switch cacheType {
@@ -2988,10 +3255,64 @@ func (e *partitionEvictor) Statusz(ctx context.Context) string {
 		lastEvictedStr = fmt.Sprintf("%q age: %s", string(le.Key.bytes), age)
 	}
 	buf += fmt.Sprintf("Last evicted item: %s\n", lastEvictedStr)
+	if len(e.groupsOverQuota) > 0 {
+		groupIDs := slices.Sorted(maps.Keys(e.groupsOverQuota))
+		buf += "Groups over quota:\n"
+		for _, g := range groupIDs {
+			buf += fmt.Sprintf("  %s: %s / %s\n", g, units.BytesSize(float64(e.sizeByGroup[g])), units.BytesSize(float64(e.quotas.limit(g))))
+		}
+	}
 	buf += "</pre>"
 	return buf
 }
 
+// groupQuotas holds the quotas of the groups storing data in a partition.
+type groupQuotas struct {
+	byGroup      map[string]int64
+	defaultBytes int64
+}
+
+func newGroupQuotas(part disk.Partition, quotas []GroupQuota, defaultFraction float64) *groupQuotas {
+	gq := &groupQuotas{
+		byGroup:      make(map[string]int64),
+		defaultBytes: int64(defaultFraction * float64(part.MaxSizeBytes)),
+	}
+	for _, q := range quotas {
+		partitionID := q.PartitionID
+		if partitionID == "" {
+			partitionID = DefaultPartitionID
+		}
+		if partitionID == part.ID {
+			gq.byGroup[q.GroupID] = q.MaxSizeBytes
+		}
+	}
+	return gq
+}
+
+// explicit returns the quotas configured for specific groups.
+func (q *groupQuotas) explicit() map[string]int64 {
+	if q == nil {
+		return nil
+	}
+	return q.byGroup
+}
+
+func (q *groupQuotas) enabled() bool {
+	return q != nil && (len(q.byGroup) > 0 || q.defaultBytes > 0)
+}
+
+// limit returns the maximum number of bytes that groupID may store in the
+// partition, or 0 if the group has no quota.
+func (q *groupQuotas) limit(groupID string) int64 {
+	if q == nil {
+		return 0
+	}
+	if limit, ok := q.byGroup[groupID]; ok {
+		return limit
+	}
+	return q.defaultBytes
+}
+
 var digestChars = []byte("abcdef1234567890")
 
 func (e *partitionEvictor) randomKey(buf []byte) ([]byte, error) {
@@ -3056,11 +3377,14 @@ func (e *partitionEvictor) doEvict(sample *approxlru.Sample[*evictionKey]) {
 		return
 	}
 	atime := time.UnixMicro(md.GetLastAccessUsec())
-	age := time.Since(atime)
+	age := e.clock.Since(atime)
 	if !sample.Timestamp.Equal(atime) {
 		// atime have been updated. Do not evict.
 		return
 	}
+	if age < e.minEvictionAge {
+		return
+	}
 
 	if err := e.deleteFile(key, md.GetFileRecord().GetIsolation().GetGroupId(), md.GetLastModifyUsec(), version, sample.SizeBytes, sample.Key.storageMetadata); err != nil {
 		log.Errorf("[%s] Error evicting file for key %q: %s (ignoring)", e.cacheName, sample.Key, err)
@@ -3071,6 +3395,12 @@ func (e *partitionEvictor) doEvict(sample *approxlru.Sample[*evictionKey]) {
 	metrics.DiskCacheBytesEvicted.With(lbls).Add(float64(sample.SizeBytes))
 	metrics.DiskCacheEvictionAgeMsec.With(lbls).Observe(float64(age.Milliseconds()))
 	metrics.DiskCacheLastEvictionAgeUsec.With(lbls).Set(float64(age.Microseconds()))
+	if sample.Key.quotaGroupID != "" {
+		metrics.DiskCacheGroupQuotaEvictions.With(prometheus.Labels{
+			metrics.PartitionID:    e.part.ID,
+			metrics.CacheNameLabel: e.cacheName,
+			metrics.GroupID:        sample.Key.quotaGroupID}).Inc()
+	}
 }
 
 func (e *partitionEvictor) sample(ctx context.Context, k int) ([]*approxlru.Sample[*evictionKey], error) {
@@ -3231,6 +3561,103 @@ func (p *PebbleCache) SupportsCompressor(compressor repb.Compressor_Value) bool
 	}
 }
 
+// ListEntries scans the metadata of the given partitions (or all partitions if
+// none are given) and calls fn with each complete AC and CAS entry.
+func (p *PebbleCache) ListEntries(ctx context.Context, partitionIDs []string, fn func(info *interfaces.CacheEntryInfo) error) error {
+	db, err := p.leaser.DB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	evictors := make([]*partitionEvictor, len(p.evictors))
+	p.statusMu.Lock()
+	copy(evictors, p.evictors)
+	p.statusMu.Unlock()
+
+	for _, e := range evictors {
+		if len(partitionIDs) > 0 && !slices.Contains(partitionIDs, e.part.ID) {
+			continue
+		}
+		if err := p.listPartitionEntries(ctx, db, e, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PebbleCache) listPartitionEntries(ctx context.Context, db pebble.IPebbleDB, e *partitionEvictor, fn func(info *interfaces.CacheEntryInfo) error) error {
+	lowerBound, upperBound := keys.Range([]byte(e.partitionKeyPrefix() + "/"))
+	iter, err := db.NewIter(&pebble.IterOptions{
+		LowerBound: lowerBound,
+		UpperBound: upperBound,
+	})
+	if err != nil {
+		return err
+	}
+	// We update the iter variable later on, so we need to wrap the Close call
+	// in a func to operate on the correct iterator instance.
+	defer func() {
+		iter.Close()
+	}()
+
+	count := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Create a new iterator once in a while to avoid holding on to sstables
+		// for too long.
+		if count != 0 && count%1_000_000 == 0 {
+			k := make([]byte, len(iter.Key()))
+			copy(k, iter.Key())
+			newIter, err := db.NewIter(&pebble.IterOptions{
+				LowerBound: k,
+				UpperBound: upperBound,
+			})
+			if err != nil {
+				return err
+			}
+			iter.Close()
+			iter = newIter
+			if !iter.First() {
+				break
+			}
+		}
+		count++
+
+		if bytes.HasPrefix(iter.Key(), SystemKeyPrefix) {
+			continue
+		}
+		md := &sgpb.FileMetadata{}
+		if err := proto.Unmarshal(iter.Value(), md); err != nil {
+			log.Errorf("[%s] Error unmarshaling metadata when listing entries: %s", p.name, err)
+			continue
+		}
+		// Chunks are only reachable through the entries that reference them.
+		if md.GetFileType() == sgpb.FileMetadata_CHUNK_FILE_TYPE {
+			continue
+		}
+		fr := md.GetFileRecord()
+		err := fn(&interfaces.CacheEntryInfo{
+			Resource: &rspb.ResourceName{
+				Digest:         fr.GetDigest(),
+				InstanceName:   fr.GetIsolation().GetRemoteInstanceName(),
+				Compressor:     fr.GetCompressor(),
+				CacheType:      fr.GetIsolation().GetCacheType(),
+				DigestFunction: fr.GetDigestFunction(),
+			},
+			GroupID:            fr.GetIsolation().GetGroupId(),
+			PartitionID:        fr.GetIsolation().GetPartitionId(),
+			LastAccessTimeUsec: md.GetLastAccessUsec(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // compressionReader helps manage resources associated with a compression.NewZstdCompressingReader
 type compressionReader struct {
 	io.ReadCloser
@@ -3312,11 +3739,11 @@ func (p *PebbleCache) reader(ctx context.Context, db pebble.IPebbleDB, r *rspb.R
 		log.Infof("Ignoring zero-length file. Key: %q, md: %+v", key, fileMetadata)
 		return nil, status.NotFoundError("object not found (zero-length)")
 	}
-	// If this is a GCS object, ensure the custom time is relatively recent
-	// so that we avoid saying something exists when it's been deleted by
-	// a GCS lifecycle rule.
+	// If this is an externally stored blob, ensure the custom time is
+	// relatively recent so that we avoid saying something exists when it's
+	// been deleted by a lifecycle rule.
 	if gcsMetadata := fileMetadata.GetStorageMetadata().GetGcsMetadata(); gcsMetadata != nil {
-		if p.gcsObjectIsPastTTL(gcsMetadata) {
+		if p.blobIsPastTTL(gcsMetadata) {
 			return nil, status.NotFoundError("backing object may have expired")
 		}
 	}
@@ -24,6 +24,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/crypter_service"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/filestore"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/raft/keys"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
@@ -554,6 +555,85 @@ func TestIsolateAnonUsers(t *testing.T) {
 	}
 }
 
+func TestListEntries(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	testAPIKey := "AK2222"
+	testGroup := "GR7890"
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers(testAPIKey, testGroup)))
+
+	maxSizeBytes := int64(1_000_000_000) // 1GB
+	partitionID := "FOO"
+	opts := &pebble_cache.Options{
+		RootDirectory:         testfs.MakeTempDir(t),
+		MaxSizeBytes:          maxSizeBytes,
+		AverageChunkSizeBytes: 64 * 4,
+		Partitions: []disk.Partition{
+			{ID: "default", MaxSizeBytes: maxSizeBytes},
+			{ID: partitionID, MaxSizeBytes: maxSizeBytes},
+		},
+		PartitionMappings: []disk.PartitionMapping{
+			{GroupID: testGroup, Prefix: "", PartitionID: partitionID},
+		},
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, opts)
+	require.NoError(t, err)
+	pc.Start()
+	defer pc.Stop()
+
+	anonCtx := getAnonContext(t, te)
+	groupCtx, err := prefix.AttachUserPrefixToContext(te.GetAuthenticator().AuthContextFromAPIKey(context.Background(), testAPIKey), te.GetAuthenticator())
+	require.NoError(t, err)
+
+	anonCAS, buf := testdigest.RandomCASResourceBuf(t, 100)
+	require.NoError(t, pc.Set(anonCtx, anonCAS, buf))
+	groupAC, buf := testdigest.RandomACResourceBuf(t, 100)
+	require.NoError(t, pc.Set(groupCtx, groupAC, buf))
+	// Large enough to be chunked. Only the entry itself should be listed,
+	// not its chunks.
+	groupCAS, buf := testdigest.RandomCASResourceBuf(t, 10_000)
+	require.NoError(t, pc.Set(groupCtx, groupCAS, buf))
+
+	listEntries := func(partitionIDs ...string) map[string]*interfaces.CacheEntryInfo {
+		entries := make(map[string]*interfaces.CacheEntryInfo)
+		err := pc.ListEntries(context.Background(), partitionIDs, func(info *interfaces.CacheEntryInfo) error {
+			entries[info.Resource.GetDigest().GetHash()] = info
+			return nil
+		})
+		require.NoError(t, err)
+		return entries
+	}
+
+	entries := listEntries()
+	require.Len(t, entries, 3)
+	info := entries[anonCAS.GetDigest().GetHash()]
+	require.Equal(t, interfaces.AuthAnonymousUser, info.GroupID)
+	require.Equal(t, pebble_cache.DefaultPartitionID, info.PartitionID)
+	require.Equal(t, rspb.CacheType_CAS, info.Resource.GetCacheType())
+	require.Equal(t, int64(100), info.Resource.GetDigest().GetSizeBytes())
+	require.Positive(t, info.LastAccessTimeUsec)
+	info = entries[groupAC.GetDigest().GetHash()]
+	require.Equal(t, testGroup, info.GroupID)
+	require.Equal(t, partitionID, info.PartitionID)
+	require.Equal(t, rspb.CacheType_AC, info.Resource.GetCacheType())
+	info = entries[groupCAS.GetDigest().GetHash()]
+	require.Equal(t, testGroup, info.GroupID)
+	require.Equal(t, int64(10_000), info.Resource.GetDigest().GetSizeBytes())
+
+	// The listed entries can be read back with the compressor they are
+	// stored with.
+	rbuf, err := pc.Get(groupCtx, info.Resource)
+	require.NoError(t, err)
+	if info.Resource.GetCompressor() == repb.Compressor_ZSTD {
+		rbuf, err = compression.DecompressZstd(nil, rbuf)
+		require.NoError(t, err)
+	}
+	require.Equal(t, buf, rbuf)
+
+	entries = listEntries(partitionID)
+	require.Len(t, entries, 2)
+	require.NotContains(t, entries, anonCAS.GetDigest().GetHash())
+}
+
 func TestMetadata(t *testing.T) {
 	te := testenv.GetTestEnv(t)
 	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
@@ -3296,6 +3376,131 @@ func TestCacheStaysBelowConfiguredSize(t *testing.T) {
 	}
 }
 
+func TestGroupQuotas(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	testUsers := testauth.TestUsers("AK1", "GR1", "AK2", "GR2")
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testUsers))
+	ctx1 := te.GetAuthenticator().AuthContextFromAPIKey(context.Background(), "AK1")
+	ctx2 := te.GetAuthenticator().AuthContextFromAPIKey(context.Background(), "AK2")
+
+	newOpts := func() *pebble_cache.Options {
+		return &pebble_cache.Options{
+			RootDirectory:               testfs.MakeTempDir(t),
+			MaxSizeBytes:                int64(1_000_000_000), // 1GB
+			MinEvictionAge:              pointer(time.Duration(0)),
+			AtimeUpdateThreshold:        pointer(time.Duration(0)),
+			AtimeBufferSize:             pointer(0),
+			MinBytesAutoZstdCompression: math.MaxInt64, // don't compress anything.
+			GroupQuotas: []pebble_cache.GroupQuota{
+				{GroupID: "GR1", MaxSizeBytes: 20_000},
+			},
+		}
+	}
+
+	// Quotas can't be enforced without tracking the size of each group.
+	_, err := pebble_cache.NewPebbleCache(te, newOpts())
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+
+	flags.Set(t, "cache.pebble.min_time_for_group_tracking_usec", 0)
+	flags.Set(t, "cache.pebble.samples_per_eviction", 1)
+	flags.Set(t, "cache.pebble.deletes_per_eviction", 1)
+
+	pc, err := pebble_cache.NewPebbleCache(te, newOpts())
+	require.NoError(t, err)
+	require.NoError(t, pc.Start())
+	defer pc.Stop()
+
+	// Write 3 times GR1's quota for each group, in 1000 byte blobs.
+	var gr1Digests, gr2Digests []*repb.Digest
+	for i := 0; i < 60; i++ {
+		rn, buf := testdigest.RandomCASResourceBuf(t, 1000)
+		require.NoError(t, pc.Set(ctx1, rn, buf))
+		gr1Digests = append(gr1Digests, rn.GetDigest())
+
+		rn, buf = testdigest.RandomCASResourceBuf(t, 1000)
+		require.NoError(t, pc.Set(ctx2, rn, buf))
+		gr2Digests = append(gr2Digests, rn.GetDigest())
+	}
+
+	// GR1's least recently used entries should be evicted until it's under
+	// its quota.
+	for deadline := time.Now().Add(30 * time.Second); ; {
+		missing, err := pc.FindMissing(ctx1, digestsToCASResourceNames(gr1Digests))
+		require.NoError(t, err)
+		if len(gr1Digests)-len(missing) <= 20 {
+			break
+		}
+		if time.Now().After(deadline) {
+			require.FailNowf(t, "GR1 was not evicted down to its quota", "%d entries remaining", len(gr1Digests)-len(missing))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// GR2 has no quota, and the partition is far from full, so none of its
+	// entries should be evicted.
+	missing, err := pc.FindMissing(ctx2, digestsToCASResourceNames(gr2Digests))
+	require.NoError(t, err)
+	require.Empty(t, missing)
+}
+
+func TestGroupQuotasRespectMinEvictionAge(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	testUsers := testauth.TestUsers("AK1", "GR1")
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testUsers))
+	ctx := te.GetAuthenticator().AuthContextFromAPIKey(context.Background(), "AK1")
+	flags.Set(t, "cache.pebble.min_time_for_group_tracking_usec", 0)
+	flags.Set(t, "cache.pebble.samples_per_eviction", 1)
+	flags.Set(t, "cache.pebble.deletes_per_eviction", 1)
+
+	clock := clockwork.NewFakeClock()
+	minEvictionAge := time.Hour
+	pc, err := pebble_cache.NewPebbleCache(te, &pebble_cache.Options{
+		RootDirectory:               testfs.MakeTempDir(t),
+		MaxSizeBytes:                int64(1_000_000_000), // 1GB
+		Clock:                       clock,
+		MinEvictionAge:              &minEvictionAge,
+		AtimeUpdateThreshold:        pointer(time.Duration(0)),
+		AtimeBufferSize:             pointer(0),
+		MinBytesAutoZstdCompression: math.MaxInt64, // don't compress anything.
+		GroupQuotas: []pebble_cache.GroupQuota{
+			{GroupID: "GR1", MaxSizeBytes: 20_000},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, pc.Start())
+	defer pc.Stop()
+
+	var digests []*repb.Digest
+	for i := 0; i < 60; i++ {
+		rn, buf := testdigest.RandomCASResourceBuf(t, 1000)
+		require.NoError(t, pc.Set(ctx, rn, buf))
+		digests = append(digests, rn.GetDigest())
+	}
+
+	// GR1 is over its quota, but its entries were all used recently.
+	time.Sleep(2 * time.Second)
+	missing, err := pc.FindMissing(ctx, digestsToCASResourceNames(digests))
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	// Once they're old enough, they're evicted until GR1 is under its
+	// quota.
+	clock.Advance(2 * minEvictionAge)
+	require.Eventually(t, func() bool {
+		missing, err := pc.FindMissing(ctx, digestsToCASResourceNames(digests))
+		require.NoError(t, err)
+		return len(digests)-len(missing) <= 20
+	}, 30*time.Second, 100*time.Millisecond)
+}
+
+func digestsToCASResourceNames(digests []*repb.Digest) []*rspb.ResourceName {
+	rns := make([]*rspb.ResourceName, 0, len(digests))
+	for _, d := range digests {
+		rns = append(rns, digest.NewCASResourceName(d, "", repb.DigestFunction_SHA256).ToProto())
+	}
+	return rns
+}
+
 func TestGCSBlobStorageReadAfterTTL(t *testing.T) {
 	te := testenv.GetTestEnv(t)
 	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
@@ -3350,3 +3555,228 @@ func TestGCSBlobStorageReadAfterTTL(t *testing.T) {
 		require.True(t, status.IsNotFoundError(err), err)
 	}
 }
+
+func TestBlobstoreStorage(t *testing.T) {
+	flags.Set(t, "storage.disk.root_directory", testfs.MakeTempDir(t))
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
+	clock := clockwork.NewFakeClock()
+	ctx := getAnonContext(t, te)
+
+	bs, err := blobstore.NewFromConfig(ctx)
+	require.NoError(t, err)
+
+	var minGCSFileSize int64 = 1
+	var blobstoreTTLDays int64 = 1
+	options := &pebble_cache.Options{
+		RootDirectory:          testfs.MakeTempDir(t),
+		MaxSizeBytes:           int64(1_000_000), // 1MB
+		Clock:                  clock,
+		MaxInlineFileSizeBytes: 1,
+		MinGCSFileSizeBytes:    &minGCSFileSize,
+		Blobstore:              bs,
+		BlobstoreAppName:       "app-name",
+		BlobstoreTTLDays:       &blobstoreTTLDays,
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, options)
+	require.NoError(t, err)
+
+	require.NoError(t, pc.Start())
+	defer pc.Stop()
+
+	sampleData := make(map[*rspb.ResourceName][]byte)
+	for i := 0; i < 10; i++ {
+		rn, buf := testdigest.RandomCASResourceBuf(t, 100)
+		sampleData[rn] = buf
+
+		rn, buf = testdigest.RandomACResourceBuf(t, 100)
+		sampleData[rn] = buf
+	}
+
+	// Write some data.
+	for rn, buf := range sampleData {
+		require.NoError(t, pc.Set(ctx, rn, buf))
+	}
+
+	// Ensure the data was written to the blobstore.
+	var blobNames []string
+	err = bs.(interfaces.BlobLister).ListBlobs(ctx, "app-name/", func(blobName string, lastModified time.Time) error {
+		blobNames = append(blobNames, blobName)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, blobNames, len(sampleData))
+
+	// Advance the clock half of the TTL and read everything back.
+	clock.Advance(12 * time.Hour)
+	for rn, buf := range sampleData {
+		readBuf, err := pc.Get(ctx, rn)
+		require.NoError(t, err)
+		require.Equal(t, buf, readBuf)
+	}
+
+	// Reads don't extend the lifetime of blobs in a blobstore without
+	// custom times, so everything expires a day after it was written.
+	clock.Advance(10 * time.Hour)
+	for rn := range sampleData {
+		exists, err := pc.Contains(ctx, rn)
+		require.NoError(t, err)
+		assert.True(t, exists, rn)
+	}
+	clock.Advance(3 * time.Hour)
+	for rn := range sampleData {
+		exists, err := pc.Contains(ctx, rn)
+		require.NoError(t, err)
+		assert.False(t, exists, rn)
+	}
+}
+
+func TestBlobstoreStorage_NoTTL(t *testing.T) {
+	flags.Set(t, "storage.disk.root_directory", testfs.MakeTempDir(t))
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
+	clock := clockwork.NewFakeClock()
+	ctx := getAnonContext(t, te)
+
+	bs, err := blobstore.NewFromConfig(ctx)
+	require.NoError(t, err)
+
+	var minGCSFileSize int64 = 1
+	options := &pebble_cache.Options{
+		RootDirectory:          testfs.MakeTempDir(t),
+		MaxSizeBytes:           int64(1_000_000), // 1MB
+		Clock:                  clock,
+		MaxInlineFileSizeBytes: 1,
+		MinGCSFileSizeBytes:    &minGCSFileSize,
+		Blobstore:              bs,
+		BlobstoreAppName:       "app-name",
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, options)
+	require.NoError(t, err)
+	require.NoError(t, pc.Start())
+	defer pc.Stop()
+
+	rn, buf := testdigest.RandomCASResourceBuf(t, 100)
+	require.NoError(t, pc.Set(ctx, rn, buf))
+
+	// Without a TTL, blobs in the blobstore never expire.
+	clock.Advance(365 * 24 * time.Hour)
+	exists, err := pc.Contains(ctx, rn)
+	require.NoError(t, err)
+	require.True(t, exists)
+	readBuf, err := pc.Get(ctx, rn)
+	require.NoError(t, err)
+	require.Equal(t, buf, readBuf)
+}
+
+func TestDeleteOrphanedBlobs(t *testing.T) {
+	flags.Set(t, "cache.pebble.scan_for_orphaned_files", true)
+	flags.Set(t, "cache.pebble.scan_for_missing_files", true)
+	flags.Set(t, "cache.pebble.orphan_delete_dry_run", false)
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
+	clock := clockwork.NewFakeClock()
+	ctx := getAnonContext(t, te)
+
+	var minGCSFileSize int64 = 1
+	var gcsTTLDays int64 = 7
+
+	mockGCS := mockgcs.New(clock)
+	mockGCS.SetBucketCustomTimeTTL(ctx, gcsTTLDays)
+	fileStorer := filestore.New(filestore.WithGCSBlobstore(mockGCS, "app-name"), filestore.WithClock(clock))
+	options := &pebble_cache.Options{
+		RootDirectory:          testfs.MakeTempDir(t),
+		MaxSizeBytes:           int64(1_000_000), // 1MB
+		Clock:                  clock,
+		FileStorer:             fileStorer,
+		MaxInlineFileSizeBytes: 1,
+		MinGCSFileSizeBytes:    &minGCSFileSize,
+		GCSTTLDays:             &gcsTTLDays,
+	}
+	listBlobs := func() []string {
+		var blobNames []string
+		err := mockGCS.ListBlobs(ctx, "app-name/", func(blobName string, lastModified time.Time) error {
+			blobNames = append(blobNames, blobName)
+			return nil
+		})
+		require.NoError(t, err)
+		return blobNames
+	}
+
+	pc, err := pebble_cache.NewPebbleCache(te, options)
+	require.NoError(t, err)
+	require.NoError(t, pc.Start())
+	for !pc.DoneScanning() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Write an entry whose blob will go missing.
+	missingRN, missingBuf := testdigest.RandomCASResourceBuf(t, 100)
+	require.NoError(t, pc.Set(ctx, missingRN, missingBuf))
+	missingBlobs := listBlobs()
+	require.Len(t, missingBlobs, 1)
+
+	sampleData := make(map[*rspb.ResourceName][]byte)
+	for i := 0; i < 10; i++ {
+		rn, buf := testdigest.RandomCASResourceBuf(t, 100)
+		sampleData[rn] = buf
+
+		rn, buf = testdigest.RandomACResourceBuf(t, 100)
+		sampleData[rn] = buf
+	}
+	for rn, buf := range sampleData {
+		require.NoError(t, pc.Set(ctx, rn, buf))
+	}
+	require.NoError(t, pc.Stop())
+
+	require.NoError(t, mockGCS.DeleteBlob(ctx, missingBlobs[0]))
+	writeOrphan := func() string {
+		rn, _ := testdigest.RandomCASResourceBuf(t, 100)
+		fr := &sgpb.FileRecord{
+			Isolation: &sgpb.Isolation{
+				CacheType:   rn.GetCacheType(),
+				PartitionId: pebble_cache.DefaultPartitionID,
+				GroupId:     filestore.AnonGroupID,
+			},
+			Digest:         rn.GetDigest(),
+			DigestFunction: rn.GetDigestFunction(),
+		}
+		wc, err := fileStorer.BlobWriter(ctx, fr)
+		require.NoError(t, err)
+		_, err = wc.Write([]byte("orphan"))
+		require.NoError(t, err)
+		require.NoError(t, wc.Commit())
+		require.NoError(t, wc.Close())
+		return wc.Metadata().GetGcsMetadata().GetBlobName()
+	}
+	orphan := writeOrphan()
+	clock.Advance(2 * time.Hour)
+	recentOrphan := writeOrphan()
+	require.Len(t, listBlobs(), len(sampleData)+2)
+
+	pc2, err := pebble_cache.NewPebbleCache(te, options)
+	require.NoError(t, err)
+	require.NoError(t, pc2.Start())
+	defer pc2.Stop()
+	for !pc2.DoneScanning() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The old orphan is deleted, but the recently written one, which may
+	// not have had its metadata written yet, is not.
+	blobNames := listBlobs()
+	assert.Len(t, blobNames, len(sampleData)+1)
+	assert.NotContains(t, blobNames, orphan)
+	assert.Contains(t, blobNames, recentOrphan)
+
+	// The entry whose blob went missing is removed, and everything else is
+	// still readable.
+	exists, err := pc2.Contains(ctx, missingRN)
+	require.NoError(t, err)
+	assert.False(t, exists)
+	for rn, buf := range sampleData {
+		readBuf, err := pc2.Get(ctx, rn)
+		require.NoError(t, err)
+		assert.Equal(t, buf, readBuf)
+	}
+}
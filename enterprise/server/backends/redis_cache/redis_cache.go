@@ -6,6 +6,7 @@ import (
 	"flag"
 	"io"
 	"path/filepath"
+	"strings"
 	"time"
 	"unsafe"
 
@@ -18,6 +19,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/util/cache_metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
 	"github.com/buildbuddy-io/buildbuddy/server/util/ioutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
@@ -31,6 +33,13 @@ var maxValueSizeBytes = flag.Int64("cache.redis.max_value_size_bytes", 10000000,
 
 const (
 	ttl = 3 * 24 * time.Hour
+
+	// keyVersionPrefix is prepended to all keys. Values are stored with a
+	// one byte header holding the compressor of the stored data. Values
+	// written before the header was introduced live under unversioned keys;
+	// they are still read (as uncompressed data) until they expire after the
+	// TTL, so that the cache isn't emptied on rollout.
+	keyVersionPrefix = "v2/"
 )
 
 var (
@@ -92,33 +101,75 @@ func (c *Cache) key(ctx context.Context, r *rspb.ResourceName) (string, error) {
 	if len(isolationPrefix) > 0 && isolationPrefix[len(isolationPrefix)-1] != '/' {
 		isolationPrefix += "/"
 	}
-	return userPrefix + isolationPrefix + rn.GetDigest().GetHash(), nil
+	return keyVersionPrefix + userPrefix + isolationPrefix + rn.GetDigest().GetHash(), nil
+}
+
+// legacyKey returns the key that the value for the given (versioned) key was
+// stored under before values had a compressor header.
+func legacyKey(key string) string {
+	return strings.TrimPrefix(key, keyVersionPrefix)
+}
+
+// encodeValue prepends the compressor header to the data that is stored.
+func encodeValue(data []byte, compressor repb.Compressor_Value) []byte {
+	value := make([]byte, len(data)+1)
+	value[0] = byte(compressor)
+	copy(value[1:], data)
+	return value
 }
 
-func (c *Cache) rdbGet(ctx context.Context, key string) ([]byte, error) {
-	bytes, err := c.rdb.Get(ctx, key).Bytes()
-	if err == nil {
-		return bytes, nil
+// decodeValue splits a stored value into the compressor header and the data.
+func decodeValue(value []byte) ([]byte, repb.Compressor_Value, error) {
+	if len(value) == 0 {
+		return nil, repb.Compressor_IDENTITY, status.InternalError("stored value is missing compressor header")
 	}
-	if err == redis.Nil {
-		return nil, status.NotFoundErrorf("Key %q not found in cache", key)
+	return value[1:], repb.Compressor_Value(value[0]), nil
+}
+
+// rdbGetData returns the data stored for the key, converted to the requested
+// compressor.
+func (c *Cache) rdbGetData(ctx context.Context, key string, compressor repb.Compressor_Value) ([]byte, error) {
+	data, storedCompressor, err := c.rdbGet(ctx, key)
+	if err != nil {
+		return nil, err
 	}
-	return nil, err
+	return compression.ConvertBytes(data, storedCompressor, compressor)
+}
+
+// rdbGet returns the data stored for the key and its compressor, falling
+// back to the legacy key if there is no value under the versioned key.
+func (c *Cache) rdbGet(ctx context.Context, key string) ([]byte, repb.Compressor_Value, error) {
+	pipe := c.rdb.Pipeline()
+	cmd := pipe.Get(ctx, key)
+	legacyCmd := pipe.Get(ctx, legacyKey(key))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, repb.Compressor_IDENTITY, err
+	}
+	if value, err := cmd.Bytes(); err == nil {
+		return decodeValue(value)
+	}
+	if value, err := legacyCmd.Bytes(); err == nil {
+		return value, repb.Compressor_IDENTITY, nil
+	}
+	return nil, repb.Compressor_IDENTITY, status.NotFoundErrorf("Key %q not found in cache", key)
 }
 
 func (c *Cache) rdbMultiExists(ctx context.Context, keys ...string) (map[string]bool, error) {
 	result := make(map[string]bool, len(keys))
 	pipe := c.rdb.Pipeline()
 	m := map[string]*redis.BoolCmd{}
+	legacy := map[string]*redis.BoolCmd{}
 	for _, k := range keys {
 		m[k] = pipe.Expire(ctx, k, ttl)
+		legacy[k] = pipe.Expire(ctx, legacyKey(k), ttl)
 	}
 	if _, err := pipe.Exec(ctx); err != nil {
 		return nil, err
 	}
 	for k, v := range m {
 		found, err := v.Result()
-		exists := err == nil && found
+		legacyFound, legacyErr := legacy[k].Result()
+		exists := (err == nil && found) || (legacyErr == nil && legacyFound)
 		result[k] = exists
 	}
 	return result, nil
@@ -144,9 +195,9 @@ func (c *Cache) Contains(ctx context.Context, r *rspb.ResourceName) (bool, error
 		return false, err
 	}
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
-	found, err := c.rdb.Expire(ctx, key, ttl).Result()
+	found, err := c.rdbMultiExists(ctx, key)
 	timer.ObserveContains(err)
-	return found, err
+	return found[key], err
 }
 
 // TODO(buildbuddy-internal#1485) - Add last access and modify time
@@ -157,23 +208,39 @@ func (c *Cache) Metadata(ctx context.Context, r *rspb.ResourceName) (*interfaces
 	if err != nil {
 		return nil, err
 	}
-	found, err := c.rdb.Exists(ctx, key).Result()
-	if err != nil {
+	pipe := c.rdb.Pipeline()
+	valueLenCmd := pipe.StrLen(ctx, key)
+	headerCmd := pipe.GetRange(ctx, key, 0, 0)
+	legacyLenCmd := pipe.StrLen(ctx, legacyKey(key))
+	legacyExistsCmd := pipe.Exists(ctx, legacyKey(key))
+	if _, err := pipe.Exec(ctx); err != nil {
 		return nil, err
 	}
-	if found == 0 {
+	var blobLen int64
+	compressor := repb.Compressor_IDENTITY
+	// StrLen returns 0 for missing keys, and stored values always have at
+	// least the header byte.
+	if valueLen := valueLenCmd.Val(); valueLen > 0 {
+		_, compressor, err = decodeValue([]byte(headerCmd.Val()))
+		if err != nil {
+			return nil, err
+		}
+		blobLen = valueLen - 1
+	} else if legacyExistsCmd.Val() > 0 {
+		// Legacy values have no header and are never compressed.
+		blobLen = legacyLenCmd.Val()
+	} else {
 		d := r.GetDigest()
 		return nil, status.NotFoundErrorf("Digest '%s/%d' not found in cache", d.GetHash(), d.GetSizeBytes())
 	}
-	blobLen, err := c.rdb.StrLen(ctx, key).Result()
-	if err != nil {
-		return nil, err
-	}
 
 	// TODO - Add digest size support for AC
 	digestSizeBytes := int64(-1)
 	if r.GetCacheType() == rspb.CacheType_CAS {
 		digestSizeBytes = blobLen
+		if compressor != repb.Compressor_IDENTITY {
+			digestSizeBytes = r.GetDigest().GetSizeBytes()
+		}
 	}
 
 	return &interfaces.CacheMetadata{
@@ -224,7 +291,7 @@ func (c *Cache) Get(ctx context.Context, r *rspb.ResourceName) ([]byte, error) {
 	}
 
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
-	b, err := c.rdbGet(ctx, k)
+	b, err := c.rdbGetData(ctx, k, r.GetCompressor())
 	timer.ObserveGet(len(b), err)
 	return b, err
 }
@@ -234,17 +301,24 @@ func (c *Cache) GetMulti(ctx context.Context, resources []*rspb.ResourceName) (m
 		return nil, nil
 	}
 	keys := make([]string, 0, len(resources))
-	digestsByKey := make(map[string]*repb.Digest, len(resources))
+	resourcesByKey := make(map[string]*rspb.ResourceName, len(resources))
 	for _, r := range resources {
 		k, err := c.key(ctx, r)
 		if err != nil {
 			return nil, err
 		}
 		keys = append(keys, k)
-		digestsByKey[k] = r.GetDigest()
+		resourcesByKey[k] = r
 	}
 
-	rMap, err := c.rdb.MGet(ctx, keys...).Result()
+	// Look up the legacy keys at the same time, in case the versioned keys
+	// are missing.
+	allKeys := make([]string, 0, 2*len(keys))
+	allKeys = append(allKeys, keys...)
+	for _, k := range keys {
+		allKeys = append(allKeys, legacyKey(k))
+	}
+	rMap, err := c.rdb.MGet(ctx, allKeys...).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -252,11 +326,24 @@ func (c *Cache) GetMulti(ctx context.Context, resources []*rspb.ResourceName) (m
 	// Assemble results.
 	response := make(map[*repb.Digest][]byte, len(keys))
 	for i, k := range keys {
-		d := digestsByKey[k]
-		item, ok := (rMap[i]).(string)
-		if ok {
-			response[d] = stringToBytes(item)
+		r := resourcesByKey[k]
+		var data []byte
+		storedCompressor := repb.Compressor_IDENTITY
+		if item, ok := (rMap[i]).(string); ok {
+			data, storedCompressor, err = decodeValue(stringToBytes(item))
+			if err != nil {
+				return nil, err
+			}
+		} else if item, ok := (rMap[len(keys)+i]).(string); ok {
+			data = stringToBytes(item)
+		} else {
+			continue
 		}
+		data, err = compression.ConvertBytes(data, storedCompressor, r.GetCompressor())
+		if err != nil {
+			return nil, err
+		}
+		response[r.GetDigest()] = data
 	}
 	return response, nil
 }
@@ -282,7 +369,7 @@ func (c *Cache) Set(ctx context.Context, r *rspb.ResourceName, data []byte) erro
 	}
 
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
-	err = c.rdbSet(ctx, k, data)
+	err = c.rdbSet(ctx, k, encodeValue(data, r.GetCompressor()))
 	timer.ObserveSet(len(data), err)
 	return err
 }
@@ -297,7 +384,7 @@ func (c *Cache) SetMulti(ctx context.Context, kvs map[*rspb.ResourceName][]byte)
 		if err != nil {
 			return err
 		}
-		setMap[k] = v
+		setMap[k] = encodeValue(v, r.GetCompressor())
 	}
 	return c.rdbMultiSet(ctx, setMap)
 }
@@ -308,7 +395,7 @@ func (c *Cache) Delete(ctx context.Context, r *rspb.ResourceName) error {
 		return err
 	}
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
-	err = c.rdb.Del(ctx, k).Err()
+	err = c.rdb.Del(ctx, k, legacyKey(k)).Err()
 	timer.ObserveDelete(err)
 	return err
 
@@ -323,10 +410,13 @@ func (c *Cache) Reader(ctx context.Context, rn *rspb.ResourceName, uncompressedO
 	if err != nil {
 		return nil, err
 	}
-	buf, err := c.rdbGet(ctx, k)
+	buf, storedCompressor, err := c.rdbGet(ctx, k)
 	if err != nil {
 		return nil, err
 	}
+	if storedCompressor != repb.Compressor_IDENTITY || rn.GetCompressor() != repb.Compressor_IDENTITY {
+		return compression.NewConvertingReader(io.NopCloser(bytes.NewReader(buf)), storedCompressor, rn.GetCompressor(), uncompressedOffset, limit, rn.GetDigest().GetSizeBytes())
+	}
 
 	r := bytes.NewReader(buf)
 	r.Seek(uncompressedOffset, 0)
@@ -353,7 +443,7 @@ func (c *Cache) Writer(ctx context.Context, r *rspb.ResourceName) (interfaces.Co
 	var buffer bytes.Buffer
 	wc := ioutil.NewCustomCommitWriteCloser(&buffer)
 	wc.CommitFn = func(int64) error {
-		err := c.rdbSet(ctx, k, buffer.Bytes())
+		err := c.rdbSet(ctx, k, encodeValue(buffer.Bytes(), r.GetCompressor()))
 		timer.ObserveWrite(int64(buffer.Len()), err)
 		// Locking and key prefixing are handled in Set.
 		return err
@@ -370,5 +460,5 @@ func (c *Cache) Stop() error {
 }
 
 func (c *Cache) SupportsCompressor(compressor repb.Compressor_Value) bool {
-	return compressor == repb.Compressor_IDENTITY
+	return compressor == repb.Compressor_IDENTITY || compressor == repb.Compressor_ZSTD
 }
@@ -0,0 +1,130 @@
+package redis_cache
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+)
+
+func newTestCache(t *testing.T) (context.Context, *Cache, redis.UniversalClient) {
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te.GetAuthenticator())
+	require.NoError(t, err)
+	target := testredis.Start(t).Target
+	rdb := redis.NewClient(redisutil.TargetToOptions(target))
+	return ctx, NewCache(rdb), rdb
+}
+
+func withCompressor(rn *rspb.ResourceName, compressor repb.Compressor_Value) *rspb.ResourceName {
+	rn = proto.Clone(rn).(*rspb.ResourceName)
+	rn.Compressor = compressor
+	return rn
+}
+
+func TestCompressorRoundTrip(t *testing.T) {
+	ctx, c, _ := newTestCache(t)
+	compressors := []repb.Compressor_Value{repb.Compressor_IDENTITY, repb.Compressor_ZSTD}
+	for _, stored := range compressors {
+		for _, useWriter := range []bool{false, true} {
+			rn, buf := testdigest.RandomCompressibleCASResourceBuf(t, 10_000, "")
+			data := buf
+			if stored == repb.Compressor_ZSTD {
+				data = compression.CompressZstd(nil, buf)
+			}
+			storedRN := withCompressor(rn, stored)
+			if useWriter {
+				w, err := c.Writer(ctx, storedRN)
+				require.NoError(t, err)
+				_, err = w.Write(data)
+				require.NoError(t, err)
+				require.NoError(t, w.Commit())
+				require.NoError(t, w.Close())
+			} else {
+				require.NoError(t, c.Set(ctx, storedRN, data))
+			}
+
+			md, err := c.Metadata(ctx, rn)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(buf)), md.DigestSizeBytes)
+			require.Equal(t, int64(len(data)), md.StoredSizeBytes)
+
+			for _, requested := range compressors {
+				requestedRN := withCompressor(rn, requested)
+				got, err := c.Get(ctx, requestedRN)
+				require.NoError(t, err)
+				decompressed, err := compression.DecompressBytes(requested, got)
+				require.NoError(t, err)
+				require.Equal(t, buf, decompressed, "stored %s, requested %s", stored, requested)
+
+				r, err := c.Reader(ctx, requestedRN, 0, 0)
+				require.NoError(t, err)
+				got, err = io.ReadAll(r)
+				require.NoError(t, err)
+				require.NoError(t, r.Close())
+				decompressed, err = compression.DecompressBytes(requested, got)
+				require.NoError(t, err)
+				require.Equal(t, buf, decompressed, "stored %s, requested %s", stored, requested)
+
+				m, err := c.GetMulti(ctx, []*rspb.ResourceName{requestedRN})
+				require.NoError(t, err)
+				decompressed, err = compression.DecompressBytes(requested, m[rn.GetDigest()])
+				require.NoError(t, err)
+				require.Equal(t, buf, decompressed, "stored %s, requested %s", stored, requested)
+			}
+		}
+	}
+}
+
+func TestLegacyValues(t *testing.T) {
+	ctx, c, rdb := newTestCache(t)
+	rn, buf := testdigest.RandomCompressibleCASResourceBuf(t, 1000, "")
+
+	// Write a value the way it was stored before values had a compressor
+	// header.
+	k, err := c.key(ctx, rn)
+	require.NoError(t, err)
+	require.NoError(t, rdb.Set(ctx, legacyKey(k), buf, ttl).Err())
+
+	found, err := c.Contains(ctx, rn)
+	require.NoError(t, err)
+	require.True(t, found)
+	missing, err := c.FindMissing(ctx, []*rspb.ResourceName{rn})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	md, err := c.Metadata(ctx, rn)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(buf)), md.DigestSizeBytes)
+
+	got, err := c.Get(ctx, rn)
+	require.NoError(t, err)
+	require.Equal(t, buf, got)
+
+	got, err = c.Get(ctx, withCompressor(rn, repb.Compressor_ZSTD))
+	require.NoError(t, err)
+	decompressed, err := compression.DecompressZstd(nil, got)
+	require.NoError(t, err)
+	require.Equal(t, buf, decompressed)
+
+	m, err := c.GetMulti(ctx, []*rspb.ResourceName{rn})
+	require.NoError(t, err)
+	require.Equal(t, buf, m[rn.GetDigest()])
+
+	require.NoError(t, c.Delete(ctx, rn))
+	found, err = c.Contains(ctx, rn)
+	require.NoError(t, err)
+	require.False(t, found)
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/util/cache_metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
@@ -55,6 +56,11 @@ var (
 
 const (
 	bucketWaitTimeout = 10 * time.Second
+
+	// compressorMetadataKey is the object metadata key that records the
+	// compressor used for the stored object. Objects without it are stored
+	// uncompressed.
+	compressorMetadataKey = "compressor"
 )
 
 var (
@@ -66,7 +72,6 @@ type S3Cache struct {
 	client     *s3.Client
 	bucket     *string
 	pathPrefix string
-	downloader *s3manager.Downloader
 	uploader   *s3manager.Uploader
 	ttlInDays  int32
 }
@@ -139,7 +144,6 @@ func NewS3Cache() (*S3Cache, error) {
 		client:     client,
 		bucket:     bucket,
 		pathPrefix: *pathPrefix,
-		downloader: s3manager.NewDownloader(client),
 		uploader:   s3manager.NewUploader(client),
 		ttlInDays:  int32(*ttlDays),
 	}
@@ -266,29 +270,61 @@ func isNotFoundErr(err error) bool {
 	return false
 }
 
+// compressorMetadata returns the object metadata to store for an object
+// written with the given compressor.
+func compressorMetadata(compressor repb.Compressor_Value) map[string]string {
+	if compressor == repb.Compressor_IDENTITY {
+		return nil
+	}
+	return map[string]string{compressorMetadataKey: compressor.String()}
+}
+
+// objectCompressor returns the compressor recorded in the object metadata.
+func objectCompressor(metadata map[string]string) repb.Compressor_Value {
+	if v, ok := repb.Compressor_Value_value[metadata[compressorMetadataKey]]; ok {
+		return repb.Compressor_Value(v)
+	}
+	return repb.Compressor_IDENTITY
+}
+
 func (s3c *S3Cache) Get(ctx context.Context, r *rspb.ResourceName) ([]byte, error) {
 	k, err := s3c.key(ctx, r)
 	if err != nil {
 		return nil, err
 	}
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
-	b, err := s3c.get(ctx, r.GetDigest(), k)
+	b, err := s3c.get(ctx, r, k)
 	timer.ObserveGet(len(b), err)
 	return b, err
 }
 
-func (s3c *S3Cache) get(ctx context.Context, d *repb.Digest, key string) ([]byte, error) {
-	buff := &s3manager.WriteAtBuffer{}
+func (s3c *S3Cache) get(ctx context.Context, r *rspb.ResourceName, key string) ([]byte, error) {
+	result, err := s3c.getObject(ctx, r.GetDigest(), key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+	buf := bytes.NewBuffer(make([]byte, 0, aws.ToInt64(result.ContentLength)))
+	if _, err := buf.ReadFrom(result.Body); err != nil {
+		return nil, err
+	}
+	return compression.ConvertBytes(buf.Bytes(), objectCompressor(result.Metadata), r.GetCompressor())
+}
+
+func (s3c *S3Cache) getObject(ctx context.Context, d *repb.Digest, key string, readRange *string) (*s3.GetObjectOutput, error) {
 	ctx, spn := tracing.StartSpan(ctx)
-	_, err := s3c.downloader.Download(ctx, buff, &s3.GetObjectInput{
+	defer spn.End()
+	result, err := s3c.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: s3c.bucket,
 		Key:    &key,
+		Range:  readRange,
 	})
-	spn.End()
 	if isNotFoundErr(err) {
 		return nil, status.NotFoundErrorf("Digest '%s/%d' not found in cache", d.GetHash(), d.GetSizeBytes())
+	} else if err != nil {
+		return nil, status.InternalErrorf("Error getting s3 object at key %s for cache: %v", key, err)
 	}
-	return buff.Bytes(), err
+	return result, nil
 }
 
 func (s3c *S3Cache) GetMulti(ctx context.Context, resources []*rspb.ResourceName) (map[*repb.Digest][]byte, error) {
@@ -325,9 +361,10 @@ func (s3c *S3Cache) Set(ctx context.Context, r *rspb.ResourceName, data []byte)
 		return err
 	}
 	uploadParams := &s3.PutObjectInput{
-		Bucket: s3c.bucket,
-		Key:    &k,
-		Body:   bytes.NewReader(data),
+		Bucket:   s3c.bucket,
+		Key:      &k,
+		Body:     bytes.NewReader(data),
+		Metadata: compressorMetadata(r.GetCompressor()),
 	}
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
 	ctx, spn := tracing.StartSpan(ctx)
@@ -390,8 +427,8 @@ func (s3c *S3Cache) delete(ctx context.Context, key string) error {
 	)
 }
 
-func (s3c *S3Cache) bumpTTLIfStale(ctx context.Context, key string, t time.Time) bool {
-	if s3c.ttlInDays == 0 || int32(time.Since(t).Hours()) < 24*s3c.ttlInDays/2 {
+func (s3c *S3Cache) bumpTTLIfStale(ctx context.Context, key string, head *s3.HeadObjectOutput) bool {
+	if s3c.ttlInDays == 0 || int32(time.Since(*head.LastModified).Hours()) < 24*s3c.ttlInDays/2 {
 		return true
 	}
 	src := fmt.Sprintf("%s/%s", *s3c.bucket, key)
@@ -400,6 +437,9 @@ func (s3c *S3Cache) bumpTTLIfStale(ctx context.Context, key string, t time.Time)
 		Bucket:            s3c.bucket,
 		Key:               &key,
 		MetadataDirective: s3types.MetadataDirectiveReplace,
+		// Replacing the metadata is what bumps the modification time, but
+		// the compressor has to be carried over.
+		Metadata: head.Metadata,
 	}
 	_, spn := tracing.StartSpan(ctx)
 	_, err := s3c.client.CopyObject(ctx, input)
@@ -429,7 +469,7 @@ func (s3c *S3Cache) Contains(ctx context.Context, r *rspb.ResourceName) (bool, e
 	if err != nil {
 		return false, err
 	}
-	bumped := s3c.bumpTTLIfStale(ctx, key, *metadata.LastModified)
+	bumped := s3c.bumpTTLIfStale(ctx, key, metadata)
 	if bumped {
 		return true, nil
 	}
@@ -451,6 +491,9 @@ func (s3c *S3Cache) Metadata(ctx context.Context, r *rspb.ResourceName) (*interf
 	digestSizeBytes := int64(-1)
 	if r.GetCacheType() == rspb.CacheType_CAS {
 		digestSizeBytes = aws.ToInt64(metadata.ContentLength)
+		if objectCompressor(metadata.Metadata) != repb.Compressor_IDENTITY {
+			digestSizeBytes = r.GetDigest().GetSizeBytes()
+		}
 	}
 
 	return &interfaces.CacheMetadata{
@@ -518,7 +561,6 @@ func (s3c *S3Cache) Reader(ctx context.Context, r *rspb.ResourceName, uncompress
 	if err != nil {
 		return nil, err
 	}
-	ctx, spn := tracing.StartSpan(ctx)
 	// TODO(bduffany): track this as a contains() request, or find a way to
 	// track it as part of the read
 
@@ -529,20 +571,28 @@ func (s3c *S3Cache) Reader(ctx context.Context, r *rspb.ResourceName, uncompress
 		readRange = fmt.Sprintf("bytes=%d-%d", uncompressedOffset, uncompressedOffset+limit-1)
 	}
 
-	result, err := s3c.client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: s3c.bucket,
-		Key:    &k,
-		Range:  &readRange,
-	})
-	spn.End()
-	if isNotFoundErr(err) {
-		d := r.GetDigest()
-		return nil, status.NotFoundErrorf("Digest '%s/%d' not found in cache", d.GetHash(), d.GetSizeBytes())
-	} else if err != nil {
-		return nil, status.InternalErrorf("Error getting s3 object at key %s for cache: %v", k, err)
+	result, err := s3c.getObject(ctx, r.GetDigest(), k, &readRange)
+	if err != nil {
+		return nil, err
+	}
+	storedCompressor := objectCompressor(result.Metadata)
+	if storedCompressor != repb.Compressor_IDENTITY && (uncompressedOffset != 0 || limit != 0) {
+		// The range applies to the compressed bytes, so fetch the whole
+		// object and apply the offset and limit after decompressing.
+		result.Body.Close()
+		if r.GetCompressor() == storedCompressor {
+			return nil, status.FailedPreconditionError("passthrough compression does not support offset/limit")
+		}
+		result, err = s3c.getObject(ctx, r.GetDigest(), k, nil)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		uncompressedOffset, limit = 0, 0
 	}
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
-	return io.NopCloser(timer.NewInstrumentedReader(result.Body, r.GetDigest().GetSizeBytes())), err
+	body := io.NopCloser(timer.NewInstrumentedReader(result.Body, r.GetDigest().GetSizeBytes()))
+	return compression.NewConvertingReader(body, storedCompressor, r.GetCompressor(), uncompressedOffset, limit, r.GetDigest().GetSizeBytes())
 }
 
 type waitForUploadWriteCloser struct {
@@ -582,9 +632,10 @@ func (s3c *S3Cache) Writer(ctx context.Context, rn *rspb.ResourceName) (interfac
 	// TODO(tempoz): r is only closed in case of error
 	r, w := io.Pipe()
 	uploadParams := &s3.PutObjectInput{
-		Bucket: s3c.bucket,
-		Key:    &k,
-		Body:   r,
+		Bucket:   s3c.bucket,
+		Key:      &k,
+		Body:     r,
+		Metadata: compressorMetadata(rn.GetCompressor()),
 	}
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
 	ctx, cancel := context.WithCancel(ctx)
@@ -614,5 +665,5 @@ func (s3c *S3Cache) Stop() error {
 }
 
 func (s3c *S3Cache) SupportsCompressor(compressor repb.Compressor_Value) bool {
-	return compressor == repb.Compressor_IDENTITY
+	return compressor == repb.Compressor_IDENTITY || compressor == repb.Compressor_ZSTD
 }
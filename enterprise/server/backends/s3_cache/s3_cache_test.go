@@ -0,0 +1,212 @@
+package s3_cache_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/s3_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testhttp"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+)
+
+const bucketName = "test-bucket"
+
+type object struct {
+	data     []byte
+	metadata http.Header
+	modified time.Time
+}
+
+// fakeS3 implements the subset of the path-style S3 REST API used by the
+// cache: bucket HEAD, and object PUT, GET (with ranges), HEAD and DELETE.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*object
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/"+bucketName)
+	key = strings.TrimPrefix(key, "/")
+	if key == "" {
+		if r.Method == http.MethodHead {
+			return
+		}
+		http.Error(w, "unsupported bucket request", http.StatusNotImplemented)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		metadata := http.Header{}
+		for k, v := range r.Header {
+			if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+				metadata[k] = v
+			}
+		}
+		f.objects[key] = &object{data: data, metadata: metadata, modified: time.Now()}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodHead, http.MethodGet:
+		o, ok := f.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+			}
+			return
+		}
+		for k, v := range o.metadata {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Last-Modified", o.modified.UTC().Format(http.TimeFormat))
+		data := o.data
+		statusCode := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			var start, end int
+			bounds := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+			start, _ = strconv.Atoi(bounds[0])
+			end = len(data) - 1
+			if bounds[1] != "" {
+				end, _ = strconv.Atoi(bounds[1])
+				end = min(end, len(data)-1)
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			data = data[start : end+1]
+			statusCode = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(statusCode)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		http.Error(w, "unsupported object request", http.StatusNotImplemented)
+	}
+}
+
+func newTestCache(t *testing.T) (context.Context, *s3_cache.S3Cache) {
+	u := testhttp.StartServer(t, &fakeS3{objects: map[string]*object{}})
+	// The fake server doesn't understand the aws-chunked encoding used for
+	// request checksums.
+	t.Setenv("AWS_REQUEST_CHECKSUM_CALCULATION", "when_required")
+	t.Setenv("AWS_RESPONSE_CHECKSUM_VALIDATION", "when_required")
+	flags.Set(t, "cache.s3.bucket", bucketName)
+	flags.Set(t, "cache.s3.region", "us-east-1")
+	flags.Set(t, "cache.s3.endpoint", u.String())
+	flags.Set(t, "cache.s3.static_credentials_id", "test-id")
+	flags.Set(t, "cache.s3.static_credentials_secret", "test-secret")
+	flags.Set(t, "cache.s3.s3_force_path_style", true)
+
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te.GetAuthenticator())
+	require.NoError(t, err)
+	c, err := s3_cache.NewS3Cache()
+	require.NoError(t, err)
+	return ctx, c
+}
+
+func withCompressor(rn *rspb.ResourceName, compressor repb.Compressor_Value) *rspb.ResourceName {
+	rn = proto.Clone(rn).(*rspb.ResourceName)
+	rn.Compressor = compressor
+	return rn
+}
+
+func TestCompressorRoundTrip(t *testing.T) {
+	ctx, c := newTestCache(t)
+	compressors := []repb.Compressor_Value{repb.Compressor_IDENTITY, repb.Compressor_ZSTD}
+	for _, stored := range compressors {
+		for _, useWriter := range []bool{false, true} {
+			rn, buf := testdigest.RandomCompressibleCASResourceBuf(t, 10_000, "")
+			data := buf
+			if stored == repb.Compressor_ZSTD {
+				data = compression.CompressZstd(nil, buf)
+			}
+			storedRN := withCompressor(rn, stored)
+			if useWriter {
+				w, err := c.Writer(ctx, storedRN)
+				require.NoError(t, err)
+				_, err = w.Write(data)
+				require.NoError(t, err)
+				require.NoError(t, w.Commit())
+				require.NoError(t, w.Close())
+			} else {
+				require.NoError(t, c.Set(ctx, storedRN, data))
+			}
+
+			md, err := c.Metadata(ctx, rn)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(buf)), md.DigestSizeBytes)
+			require.Equal(t, int64(len(data)), md.StoredSizeBytes)
+
+			for _, requested := range compressors {
+				requestedRN := withCompressor(rn, requested)
+				got, err := c.Get(ctx, requestedRN)
+				require.NoError(t, err)
+				decompressed, err := compression.DecompressBytes(requested, got)
+				require.NoError(t, err)
+				require.Equal(t, buf, decompressed, "stored %s, requested %s", stored, requested)
+
+				r, err := c.Reader(ctx, requestedRN, 0, 0)
+				require.NoError(t, err)
+				got, err = io.ReadAll(r)
+				require.NoError(t, err)
+				require.NoError(t, r.Close())
+				decompressed, err = compression.DecompressBytes(requested, got)
+				require.NoError(t, err)
+				require.Equal(t, buf, decompressed, "stored %s, requested %s", stored, requested)
+			}
+
+			// Offsets and limits apply to the uncompressed bytes regardless
+			// of how the object is stored.
+			r, err := c.Reader(ctx, withCompressor(rn, repb.Compressor_IDENTITY), 100, 1000)
+			require.NoError(t, err)
+			got, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			require.Equal(t, buf[100:1100], got, "stored %s", stored)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ctx, c := newTestCache(t)
+	rn, buf := testdigest.RandomCASResourceBuf(t, 100)
+	require.NoError(t, c.Set(ctx, rn, buf))
+
+	found, err := c.Contains(ctx, rn)
+	require.NoError(t, err)
+	require.True(t, found)
+
+	require.NoError(t, c.Delete(ctx, rn))
+	found, err = c.Contains(ctx, rn)
+	require.NoError(t, err)
+	require.False(t, found)
+	_, err = c.Get(ctx, rn)
+	require.Error(t, err)
+}
@@ -355,6 +355,13 @@ func main() {
 		log.Fatalf("Error starting task scheduler: %v", err)
 	}
 
+	schedulerOpts := &scheduler_client.Options{}
+	reg, err := scheduler_client.NewRegistration(env, taskScheduler, executorID, executor.HostID(), schedulerOpts)
+	if err != nil {
+		log.Fatalf("Error initializing executor registration: %s", err)
+	}
+	monitoring.RegisterAuthenticatedHandler("/drain", http.HandlerFunc(reg.ServeDrain))
+
 	monitoring.StartMonitoringHandler(env, fmt.Sprintf("%s:%d", *listen, *monitoringPort))
 
 	// Setup SSL for monitoring endpoints (optional).
@@ -370,12 +377,6 @@ func main() {
 	http.Handle("/healthz", env.GetHealthChecker().LivenessHandler())
 	http.Handle("/readyz", env.GetHealthChecker().ReadinessHandler())
 
-	schedulerOpts := &scheduler_client.Options{}
-	reg, err := scheduler_client.NewRegistration(env, taskScheduler, executorID, executor.HostID(), schedulerOpts)
-	if err != nil {
-		log.Fatalf("Error initializing executor registration: %s", err)
-	}
-
 	warmupDone := make(chan struct{})
 	go func() {
 		executor.Warmup()
@@ -59,6 +59,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/bitbucket"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/github"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gitlab"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/workspace"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
@@ -127,6 +128,7 @@ func convertToProdOrDie(ctx context.Context, env *real_environment.RealEnv) {
 	env.SetGitProviders([]interfaces.GitProvider{
 		github.NewProvider(env),
 		bitbucket.NewProvider(),
+		gitlab.NewProvider(),
 	})
 	if err := githubapp.Register(env); err != nil {
 		log.Fatalf("Failed to register GitHub app: %s", err)
@@ -105,6 +105,7 @@ func (c *ComposableCache) GetMulti(ctx context.Context, resources []*rspb.Resour
 				Digest:       d,
 				InstanceName: instanceName,
 				CacheType:    cacheType,
+				Compressor:   r.GetCompressor(),
 			})
 		}
 	}
@@ -274,6 +275,8 @@ func (c *ComposableCache) Writer(ctx context.Context, r *rspb.ResourceName) (int
 	return innerWriter, nil
 }
 
+// SupportsCompressor returns whether both the inner and outer caches can
+// store blobs using the given compressor, since writes go to both.
 func (c *ComposableCache) SupportsCompressor(compressor repb.Compressor_Value) bool {
-	return compressor == repb.Compressor_IDENTITY
+	return c.inner.SupportsCompressor(compressor) && c.outer.SupportsCompressor(compressor)
 }
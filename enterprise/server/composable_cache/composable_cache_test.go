@@ -8,11 +8,14 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/composable_cache"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/stretchr/testify/require"
 
@@ -98,3 +101,42 @@ func TestReadThrough(t *testing.T) {
 		readAndVerifyDigest(ctx, t, outer, rn)
 	}
 }
+
+func TestCompressedReadThrough(t *testing.T) {
+	env, ctx := testEnvAndContext(t)
+	outer := redis_cache.NewCache(env.GetDefaultRedisClient())
+	inner, err := memory_cache.NewMemoryCache(1_000_000)
+	require.NoError(t, err)
+
+	c := composable_cache.NewComposableCache(outer, inner, composable_cache.ModeReadThrough|composable_cache.ModeWriteThrough)
+	require.True(t, c.SupportsCompressor(repb.Compressor_ZSTD))
+
+	rn, buf := testdigest.RandomCompressibleCASResourceBuf(t, 1000, "")
+	compressedBuf := compression.CompressZstd(nil, buf)
+	compressedRN := proto.Clone(rn).(*rspb.ResourceName)
+	compressedRN.Compressor = repb.Compressor_ZSTD
+
+	err = inner.Set(ctx, compressedRN, compressedBuf)
+	require.NoError(t, err)
+
+	// Reading through the composable cache copies the compressed blob to
+	// the outer cache, which stores it as-is.
+	got, err := c.Get(ctx, compressedRN)
+	require.NoError(t, err)
+	require.Equal(t, compressedBuf, got)
+
+	md, err := outer.Metadata(ctx, rn)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(compressedBuf)), md.StoredSizeBytes)
+	require.Equal(t, int64(len(buf)), md.DigestSizeBytes)
+
+	got, err = outer.Get(ctx, compressedRN)
+	require.NoError(t, err)
+	require.Equal(t, compressedBuf, got)
+
+	// Uncompressed reads from the outer cache are decompressed.
+	readAndVerifyDigest(ctx, t, outer, rn)
+	found, err := outer.GetMulti(ctx, []*rspb.ResourceName{rn})
+	require.NoError(t, err)
+	require.Equal(t, buf, found[rn.GetDigest()])
+}
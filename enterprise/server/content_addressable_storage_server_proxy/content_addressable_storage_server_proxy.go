@@ -382,3 +382,23 @@ func (s *CASServerProxy) getTree(req *repb.GetTreeRequest, stream repb.ContentAd
 	}
 	return stream.Send(&resp)
 }
+
+// SplitBlob and SpliceBlob are always served by the remote, authoritative
+// cache, since the chunks they read and write must all live in the same CAS.
+func (s *CASServerProxy) SplitBlob(ctx context.Context, req *repb.SplitBlobRequest) (*repb.SplitBlobResponse, error) {
+	if proxy_util.SkipRemote(ctx) {
+		return nil, status.UnimplementedError("Skip remote not implemented")
+	}
+	ctx, spn := tracing.StartSpan(ctx)
+	defer spn.End()
+	return s.remote.SplitBlob(ctx, req)
+}
+
+func (s *CASServerProxy) SpliceBlob(ctx context.Context, req *repb.SpliceBlobRequest) (*repb.SpliceBlobResponse, error) {
+	if proxy_util.SkipRemote(ctx) {
+		return nil, status.UnimplementedError("Skip remote not implemented")
+	}
+	ctx, spn := tracing.StartSpan(ctx)
+	defer spn.End()
+	return s.remote.SpliceBlob(ctx, req)
+}
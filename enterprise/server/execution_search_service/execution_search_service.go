@@ -136,6 +136,26 @@ func (s *ExecutionSearchService) SearchExecutions(ctx context.Context, req *expb
 		q.AddWhereClause(clause, args...)
 	}
 
+	if invocationID := req.GetQuery().GetInvocationId(); invocationID != "" {
+		q.AddWhereClause("invocation_uuid = ?", strings.ReplaceAll(invocationID, "-", ""))
+	}
+	executionStatusClauses := query_builder.OrClauses{}
+	for _, status := range req.GetQuery().GetExecutionStatus() {
+		switch status {
+		case expb.ExecutionStatus_SUCCEEDED_EXECUTION_STATUS:
+			executionStatusClauses.AddOr("(status_code = ? AND exit_code = ?)", 0, 0)
+		case expb.ExecutionStatus_FAILED_EXECUTION_STATUS:
+			executionStatusClauses.AddOr("(status_code = ? AND exit_code != ?)", 0, 0)
+		case expb.ExecutionStatus_ERRORED_EXECUTION_STATUS:
+			executionStatusClauses.AddOr("status_code != ?", 0)
+		default:
+			continue
+		}
+	}
+	if executionStatusQuery, executionStatusArgs := executionStatusClauses.Build(); executionStatusQuery != "" {
+		q.AddWhereClause("("+executionStatusQuery+")", executionStatusArgs...)
+	}
+
 	statusClauses := query_builder.OrClauses{}
 	for _, status := range req.GetQuery().GetInvocationStatus() {
 		switch status {
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/live_output"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/execution"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
@@ -358,6 +359,24 @@ func (es *ExecutionService) WaitExecution(req *espb.WaitExecutionRequest, stream
 	}
 }
 
+// ReadExecutionOutput streams the output of an execution while it is running.
+func (es *ExecutionService) ReadExecutionOutput(req *espb.ReadExecutionOutputRequest, stream bbspb.BuildBuddyService_ReadExecutionOutputServer) error {
+	rdb := es.env.GetRemoteExecutionRedisClient()
+	if rdb == nil {
+		return status.UnimplementedError("not implemented")
+	}
+	ctx := stream.Context()
+	if err := execution.CheckReadable(ctx, es.env, req.GetExecutionId()); err != nil {
+		return err
+	}
+	return live_output.Read(ctx, rdb, req.GetExecutionId(), req.GetStdoutOffset(), req.GetStderrOffset(), func(chunk *repb.ExecutionOutputChunk) error {
+		if err := stream.Send(&espb.ReadExecutionOutputResponse{Output: chunk}); err != nil {
+			return status.WrapError(err, "send")
+		}
+		return nil
+	})
+}
+
 // WriteExecutionProfile writes the uncompressed JSON execution profile in
 // Google's Trace Event Format.
 func (es *ExecutionService) WriteExecutionProfile(ctx context.Context, w io.Writer, executionID string) error {
@@ -35,6 +35,9 @@ const (
 	// eviction to work correctly. This value should not ever need to
 	// change, but there is little harm in changing it.
 	AnonGroupID = "GR74042147050500190371"
+
+	// The length of the random salt appended to blob names.
+	blobNameSaltLength = 5
 )
 
 // returns partitionID, groupID, isolation, remote_instance_name, hash
@@ -506,21 +509,36 @@ type Store interface {
 	BlobWriter(ctx context.Context, fileRecord *sgpb.FileRecord) (interfaces.CommittedMetadataWriteCloser, error)
 	DeleteStoredBlob(ctx context.Context, b *sgpb.StorageMetadata_GCSMetadata) error
 	UpdateBlobAtime(ctx context.Context, b *sgpb.StorageMetadata_GCSMetadata, t time.Time) error
+	ListStoredBlobs(ctx context.Context, fn func(blobName string, lastModified time.Time) error) error
+	BlobPebbleKey(blobName string) (PebbleKey, error)
 
 	DeleteStoredFile(ctx context.Context, fileDir string, md *sgpb.StorageMetadata) error
 	FileExists(ctx context.Context, fileDir string, md *sgpb.StorageMetadata) bool
 }
 
-type PebbleGCSStorage interface {
-	SetBucketCustomTimeTTL(ctx context.Context, ageInDays int64) error
+// PebbleBlobStorage is an external storage tier that large files may be
+// stored in. Stored blobs are described by GCSMetadata, whatever the
+// underlying storage is.
+type PebbleBlobStorage interface {
 	Reader(ctx context.Context, blobName string) (io.ReadCloser, error)
 	ConditionalWriter(ctx context.Context, blobName string, overwriteExisting bool, customTime time.Time) (interfaces.CommittedWriteCloser, error)
+	BlobExists(ctx context.Context, blobName string) (bool, error)
 	DeleteBlob(ctx context.Context, blobName string) error
+	ListBlobs(ctx context.Context, prefix string, fn func(blobName string, lastModified time.Time) error) error
+
+	// UpdateCustomTime sets the time that the storage's TTL is measured
+	// from. Storage that doesn't support custom times returns an
+	// Unimplemented error, and expires blobs based on their creation time.
 	UpdateCustomTime(ctx context.Context, blobName string, t time.Time) error
 }
 
+type PebbleGCSStorage interface {
+	PebbleBlobStorage
+	SetBucketCustomTimeTTL(ctx context.Context, ageInDays int64) error
+}
+
 type Options struct {
-	gcs     PebbleGCSStorage
+	blobs   PebbleBlobStorage
 	appName string
 	clock   clockwork.Clock
 }
@@ -529,7 +547,17 @@ type Option func(*Options)
 
 func WithGCSBlobstore(gcs PebbleGCSStorage, appName string) Option {
 	return func(o *Options) {
-		o.gcs = gcs
+		o.blobs = gcs
+		o.appName = appName
+	}
+}
+
+// WithBlobstore stores blobs in a generic blobstore, such as S3 or Azure.
+// Unlike GCS, blobs stored this way expire based on their creation time, so
+// any TTL must be configured as a lifecycle rule on the underlying bucket.
+func WithBlobstore(bs interfaces.Blobstore, appName string) Option {
+	return func(o *Options) {
+		o.blobs = &blobstoreStorage{bs}
 		o.appName = appName
 	}
 }
@@ -541,7 +569,7 @@ func WithClock(c clockwork.Clock) Option {
 }
 
 type fileStorer struct {
-	gcs     PebbleGCSStorage
+	blobs   PebbleBlobStorage
 	appName string
 	clock   clockwork.Clock
 }
@@ -556,7 +584,7 @@ func New(opts ...Option) Store {
 		options.clock = clockwork.NewRealClock()
 	}
 	return &fileStorer{
-		gcs:     options.gcs,
+		blobs:   options.blobs,
 		appName: options.appName,
 		clock:   options.clock,
 	}
@@ -761,10 +789,10 @@ func (fs *fileStorer) FileWriter(ctx context.Context, fileDir string, fileRecord
 }
 
 func (fs *fileStorer) BlobReader(ctx context.Context, b *sgpb.StorageMetadata_GCSMetadata, offset, limit int64) (io.ReadCloser, error) {
-	if fs.gcs == nil || fs.appName == "" {
-		return nil, status.FailedPreconditionError("gcs blobstore or appName not configured")
+	if fs.blobs == nil || fs.appName == "" {
+		return nil, status.FailedPreconditionError("blob storage or appName not configured")
 	}
-	return fs.gcs.Reader(ctx, b.GetBlobName())
+	return fs.blobs.Reader(ctx, b.GetBlobName())
 }
 
 type gcsMetadataWriter struct {
@@ -772,7 +800,6 @@ type gcsMetadataWriter struct {
 	ctx        context.Context
 	blobName   string
 	customTime time.Time
-	gcs        PebbleGCSStorage
 }
 
 func (g *gcsMetadataWriter) Commit() error {
@@ -808,21 +835,21 @@ func (g *gcsMetadataWriter) Metadata() *sgpb.StorageMetadata {
 }
 
 func (fs *fileStorer) BlobWriter(ctx context.Context, fileRecord *sgpb.FileRecord) (interfaces.CommittedMetadataWriteCloser, error) {
-	if fs.gcs == nil || fs.appName == "" {
-		return nil, status.FailedPreconditionError("gcs blobstore or appName not configured")
+	if fs.blobs == nil || fs.appName == "" {
+		return nil, status.FailedPreconditionError("blob storage or appName not configured")
 	}
 	blobNameBytes, err := fs.BlobKey(fs.appName, fileRecord)
 	if err != nil {
 		return nil, err
 	}
-	salt, err := random.RandomString(5)
+	salt, err := random.RandomString(blobNameSaltLength)
 	if err != nil {
 		return nil, err
 	}
 	blobName := string(blobNameBytes) + "-" + salt
 
 	customTime := fs.clock.Now()
-	wc, err := fs.gcs.ConditionalWriter(ctx, blobName, true /*=overwriteExisting*/, customTime)
+	wc, err := fs.blobs.ConditionalWriter(ctx, blobName, true /*=overwriteExisting*/, customTime)
 	if err != nil {
 		return nil, err
 	}
@@ -831,28 +858,58 @@ func (fs *fileStorer) BlobWriter(ctx context.Context, fileRecord *sgpb.FileRecor
 		CommittedWriteCloser: wc,
 		blobName:             string(blobName),
 		customTime:           customTime,
-		gcs:                  fs.gcs,
 	}, nil
 }
 
 func (fs *fileStorer) DeleteStoredBlob(ctx context.Context, b *sgpb.StorageMetadata_GCSMetadata) error {
-	if fs.gcs == nil || fs.appName == "" {
-		return status.FailedPreconditionError("gcs blobstore or appName not configured")
+	if fs.blobs == nil || fs.appName == "" {
+		return status.FailedPreconditionError("blob storage or appName not configured")
 	}
-	err := fs.gcs.DeleteBlob(ctx, b.GetBlobName())
-	log.Debugf("Deleted gcs blob: %q with err: %s", b.GetBlobName(), err)
+	err := fs.blobs.DeleteBlob(ctx, b.GetBlobName())
+	log.Debugf("Deleted blob: %q with err: %s", b.GetBlobName(), err)
 	return err
 }
 
 func (fs *fileStorer) UpdateBlobAtime(ctx context.Context, b *sgpb.StorageMetadata_GCSMetadata, t time.Time) error {
-	if fs.gcs == nil || fs.appName == "" {
-		return status.FailedPreconditionError("gcs blobstore or appName not configured")
+	if fs.blobs == nil || fs.appName == "" {
+		return status.FailedPreconditionError("blob storage or appName not configured")
 	}
-	err := fs.gcs.UpdateCustomTime(ctx, b.GetBlobName(), t)
-	log.Debugf("Updated gcs blob: %q atime to %d with err: %s", b.GetBlobName(), t.UnixMicro(), err)
+	err := fs.blobs.UpdateCustomTime(ctx, b.GetBlobName(), t)
+	log.Debugf("Updated blob: %q atime to %d with err: %s", b.GetBlobName(), t.UnixMicro(), err)
 	return err
 }
 
+// ListStoredBlobs calls fn for each blob stored under this store's appName.
+func (fs *fileStorer) ListStoredBlobs(ctx context.Context, fn func(blobName string, lastModified time.Time) error) error {
+	if fs.blobs == nil || fs.appName == "" {
+		return status.FailedPreconditionError("blob storage or appName not configured")
+	}
+	return fs.blobs.ListBlobs(ctx, fs.appName+"/", fn)
+}
+
+// BlobPebbleKey returns the key of the entry that a blob written by
+// BlobWriter belongs to.
+func (fs *fileStorer) BlobPebbleKey(blobName string) (PebbleKey, error) {
+	var key PebbleKey
+	// Blob names look like {appName}/{fileKey}-{salt}. See BlobKey and
+	// BlobWriter.
+	fileKey, ok := strings.CutPrefix(blobName, fs.appName+"/")
+	saltIndex := len(fileKey) - blobNameSaltLength - 1
+	if !ok || saltIndex <= 0 || fileKey[saltIndex] != '-' {
+		return key, status.InvalidArgumentErrorf("%q is not a blob name written by this store", blobName)
+	}
+	parts := strings.Split(fileKey[:saltIndex], "/")
+	if len(parts) < 3 {
+		return key, status.InvalidArgumentErrorf("%q is not a blob name written by this store", blobName)
+	}
+	// Remove the second to last element which is the 4-char hash prefix.
+	parts = append(parts[:len(parts)-2], parts[len(parts)-1])
+	if _, err := key.FromBytes([]byte(strings.Join(parts, "/"))); err != nil {
+		return key, err
+	}
+	return key, nil
+}
+
 func (fs *fileStorer) DeleteStoredFile(ctx context.Context, fileDir string, md *sgpb.StorageMetadata) error {
 	switch {
 	case md.GetFileMetadata() != nil:
@@ -867,7 +924,59 @@ func (fs *fileStorer) FileExists(ctx context.Context, fileDir string, md *sgpb.S
 	case md.GetFileMetadata() != nil:
 		exists, err := disk.FileExists(ctx, fs.FilePath(fileDir, md.GetFileMetadata()))
 		return exists && err == nil
+	case md.GetGcsMetadata() != nil:
+		if fs.blobs == nil {
+			return false
+		}
+		exists, err := fs.blobs.BlobExists(ctx, md.GetGcsMetadata().GetBlobName())
+		if err != nil {
+			// Don't report blobs as missing because of transient errors.
+			log.Warningf("Error checking if blob %q exists: %s", md.GetGcsMetadata().GetBlobName(), err)
+			return true
+		}
+		return exists
 	default:
 		return true
 	}
 }
+
+// blobstoreStorage adapts a generic interfaces.Blobstore to PebbleBlobStorage.
+type blobstoreStorage struct {
+	bs interfaces.Blobstore
+}
+
+func (b *blobstoreStorage) Reader(ctx context.Context, blobName string) (io.ReadCloser, error) {
+	// External blobs can be many GB, so never read them fully into memory
+	// with ReadBlob.
+	reader, ok := b.bs.(interfaces.BlobReader)
+	if !ok {
+		return nil, status.UnimplementedError("blobstore does not support streaming reads")
+	}
+	return reader.Reader(ctx, blobName)
+}
+
+func (b *blobstoreStorage) ConditionalWriter(ctx context.Context, blobName string, overwriteExisting bool, customTime time.Time) (interfaces.CommittedWriteCloser, error) {
+	// Blob names are salted, so there is never an existing blob to
+	// overwrite, and customTime is implicitly the creation time.
+	return b.bs.Writer(ctx, blobName)
+}
+
+func (b *blobstoreStorage) BlobExists(ctx context.Context, blobName string) (bool, error) {
+	return b.bs.BlobExists(ctx, blobName)
+}
+
+func (b *blobstoreStorage) DeleteBlob(ctx context.Context, blobName string) error {
+	return b.bs.DeleteBlob(ctx, blobName)
+}
+
+func (b *blobstoreStorage) ListBlobs(ctx context.Context, prefix string, fn func(blobName string, lastModified time.Time) error) error {
+	lister, ok := b.bs.(interfaces.BlobLister)
+	if !ok {
+		return status.UnimplementedError("blobstore does not support listing blobs")
+	}
+	return lister.ListBlobs(ctx, prefix, fn)
+}
+
+func (b *blobstoreStorage) UpdateCustomTime(ctx context.Context, blobName string, t time.Time) error {
+	return status.UnimplementedError("blobstore does not support custom times")
+}
@@ -1,12 +1,15 @@
 package filestore_test
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/filestore"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/mockgcs"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
 
+	"github.com/jonboulle/clockwork"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -308,3 +311,39 @@ func TestVersion3(t *testing.T) {
 		require.Equal(t, "PTfoo/647c5961cba680d5deeba0169a64c8913d6b5b77495a1ee21c808ac6a514f309/cas/EK456/v3", formatKey(t, fr))
 	}
 }
+
+func TestBlobPebbleKey(t *testing.T) {
+	ctx := context.Background()
+	fs := filestore.New(filestore.WithGCSBlobstore(mockgcs.New(clockwork.NewFakeClock()), "app-name"))
+	for _, cacheType := range []rspb.CacheType{rspb.CacheType_CAS, rspb.CacheType_AC} {
+		r, _ := testdigest.NewRandomResourceAndBuf(t, 100, cacheType, "remote_instance_name")
+		fr := &sgpb.FileRecord{
+			Isolation: &sgpb.Isolation{
+				CacheType:          r.GetCacheType(),
+				RemoteInstanceName: r.GetInstanceName(),
+				PartitionId:        "FOO",
+				GroupId:            "GR7890",
+			},
+			Digest:         r.GetDigest(),
+			DigestFunction: r.GetDigestFunction(),
+		}
+		wc, err := fs.BlobWriter(ctx, fr)
+		require.NoError(t, err)
+		_, err = wc.Write([]byte("data"))
+		require.NoError(t, err)
+		require.NoError(t, wc.Commit())
+		require.NoError(t, wc.Close())
+
+		blobName := wc.Metadata().GetGcsMetadata().GetBlobName()
+		key, err := fs.BlobPebbleKey(blobName)
+		require.NoError(t, err)
+		expected, err := fs.PebbleKey(fr)
+		require.NoError(t, err)
+		assert.Equal(t, expected.String(), key.String())
+	}
+
+	for _, blobName := range []string{"", "app-name/", "other-app/PTFOO/cas/abcd/abcdef-12345", "app-name/PTFOO/cas/abcd/abcdef"} {
+		_, err := fs.BlobPebbleKey(blobName)
+		assert.Error(t, err, blobName)
+	}
+}
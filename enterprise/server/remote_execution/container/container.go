@@ -383,8 +383,8 @@ type CommandContainer interface {
 	// it is done executing.
 	//
 	// It is approximately the same as calling PullImageIfNecessary, Create,
-	// Exec, then Remove.
-	Run(ctx context.Context, command *repb.Command, workingDir string, creds oci.Credentials) *interfaces.CommandResult
+	// Exec, then Remove. Stdio is handled the same way as in Exec.
+	Run(ctx context.Context, command *repb.Command, workingDir string, creds oci.Credentials, stdio *interfaces.Stdio) *interfaces.CommandResult
 
 	// IsImageCached returns whether the configured image is cached locally.
 	IsImageCached(ctx context.Context) (bool, error)
@@ -648,7 +648,7 @@ func (t *TracedCommandContainer) IsolationType() string {
 	return t.Delegate.IsolationType()
 }
 
-func (t *TracedCommandContainer) Run(ctx context.Context, command *repb.Command, workingDir string, creds oci.Credentials) *interfaces.CommandResult {
+func (t *TracedCommandContainer) Run(ctx context.Context, command *repb.Command, workingDir string, creds oci.Credentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	ctx, span := tracing.StartSpan(ctx, trace.WithAttributes(t.implAttr))
 	defer span.End()
 
@@ -658,7 +658,7 @@ func (t *TracedCommandContainer) Run(ctx context.Context, command *repb.Command,
 		return &interfaces.CommandResult{ExitCode: noExitCode, Error: ErrRemoved}
 	}
 
-	return t.Delegate.Run(ctx, command, workingDir, creds)
+	return t.Delegate.Run(ctx, command, workingDir, creds, stdio)
 }
 
 func (t *TracedCommandContainer) IsImageCached(ctx context.Context) (bool, error) {
@@ -33,7 +33,7 @@ type FakeContainer struct {
 func (c *FakeContainer) IsolationType() string {
 	return "fake"
 }
-func (c *FakeContainer) Run(context.Context, *repb.Command, string, oci.Credentials) *interfaces.CommandResult {
+func (c *FakeContainer) Run(context.Context, *repb.Command, string, oci.Credentials, *interfaces.Stdio) *interfaces.CommandResult {
 	return nil
 }
 func (c *FakeContainer) IsImageCached(context.Context) (bool, error) {
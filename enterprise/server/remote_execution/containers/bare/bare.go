@@ -76,11 +76,11 @@ func (c *bareCommandContainer) IsolationType() string {
 	return "bare"
 }
 
-func (c *bareCommandContainer) Run(ctx context.Context, command *repb.Command, workDir string, creds oci.Credentials) *interfaces.CommandResult {
+func (c *bareCommandContainer) Run(ctx context.Context, command *repb.Command, workDir string, creds oci.Credentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	if err := c.Create(ctx, workDir); err != nil {
 		return commandutil.ErrorResult(err)
 	}
-	return c.exec(ctx, command, workDir, nil /*=stdio*/)
+	return c.exec(ctx, command, workDir, stdio)
 }
 
 func (c *bareCommandContainer) Create(ctx context.Context, workDir string) error {
@@ -196,7 +196,7 @@ func (c *dockerCommandContainer) IsolationType() string {
 	return "docker"
 }
 
-func (r *dockerCommandContainer) Run(ctx context.Context, command *repb.Command, workDir string, creds oci.Credentials) *interfaces.CommandResult {
+func (r *dockerCommandContainer) Run(ctx context.Context, command *repb.Command, workDir string, creds oci.Credentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	result := &interfaces.CommandResult{
 		CommandDebugString: fmt.Sprintf("(docker) %s", command.GetArguments()),
 		ExitCode:           commandutil.NoExitCode,
@@ -278,10 +278,7 @@ func (r *dockerCommandContainer) Run(ctx context.Context, command *repb.Command,
 
 	eg := &errgroup.Group{}
 	eg.Go(func() error {
-		var stdout, stderr bytes.Buffer
-		_, err := stdcopy.StdCopy(&stdout, &stderr, hijackedResp.Reader)
-		result.Stdout = stdout.Bytes()
-		result.Stderr = stderr.Bytes()
+		err := copyOutputs(hijackedResp.Reader, result, stdio)
 		mu.Lock()
 		defer mu.Unlock()
 		if state == ctrDidNotExitCleanly {
@@ -365,7 +365,7 @@ func TestFirecrackerRunSimple(t *testing.T) {
 	}
 
 	// Run will handle the full lifecycle: no need to call Remove() here.
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{}, &interfaces.Stdio{})
 	if res.Error != nil {
 		t.Fatal(res.Error)
 	}
@@ -1547,7 +1547,7 @@ func TestFirecrackerComplexFileMapping(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Run will handle the full lifecycle: no need to call Remove() here.
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{}, &interfaces.Stdio{})
 	if res.Error != nil {
 		t.Fatalf("error: %s", res.Error)
 	}
@@ -1651,7 +1651,7 @@ func TestFirecrackerRunWithNetwork(t *testing.T) {
 	}
 
 	// Run will handle the full lifecycle: no need to call Remove() here.
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{}, &interfaces.Stdio{})
 	if res.Error != nil {
 		t.Fatal(res.Error)
 	}
@@ -1747,7 +1747,7 @@ func TestFirecrackerRunWithNetworkPooling(t *testing.T) {
 		}
 		c, err := firecracker.NewContainer(ctx, env, &repb.ExecutionTask{}, opts)
 		require.NoError(t, err)
-		res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{})
+		res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{}, &interfaces.Stdio{})
 		require.NoError(t, err)
 		assert.Equal(t, 0, res.ExitCode)
 		assert.Contains(t, string(res.Stdout), "64 bytes from "+googleDNS)
@@ -1821,7 +1821,7 @@ func TestFirecrackerRun_ReapOrphanedZombieProcess(t *testing.T) {
 	}
 
 	// Run will handle the full lifecycle: no need to call Remove() here.
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{}, &interfaces.Stdio{})
 	if res.Error != nil {
 		t.Fatal(res.Error)
 	}
@@ -1890,7 +1890,7 @@ func TestFirecrackerNonRoot(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{}, &interfaces.Stdio{})
 	if res.Error != nil {
 		t.Fatal(res.Error)
 	}
@@ -1924,7 +1924,7 @@ func TestFirecrackerRunNOPWithZeroDisk(t *testing.T) {
 	require.NoError(t, err)
 
 	// Run will handle the full lifecycle: no need to call Remove() here.
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{}, &interfaces.Stdio{})
 	require.NoError(t, res.Error)
 	assert.Equal(t, 0, res.ExitCode)
 	assert.Equal(t, "", string(res.Stderr))
@@ -1974,7 +1974,7 @@ func TestFirecrackerRunWithDockerOverUDS(t *testing.T) {
 	}
 
 	// Run will handle the full lifecycle: no need to call Remove() here.
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{}, &interfaces.Stdio{})
 	if res.Error != nil {
 		t.Fatal(res.Error)
 	}
@@ -2028,7 +2028,7 @@ func TestFirecrackerRunWithDockerOverTCP(t *testing.T) {
 	}
 
 	// Run will handle the full lifecycle: no need to call Remove() here.
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{}, &interfaces.Stdio{})
 	if res.Error != nil {
 		t.Fatal(res.Error)
 	}
@@ -2072,7 +2072,7 @@ func TestFirecrackerRunWithDockerOverTCPDisabled(t *testing.T) {
 	}
 
 	// Run will handle the full lifecycle: no need to call Remove() here.
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{}, &interfaces.Stdio{})
 	assert.NotEqual(t, 0, res.ExitCode)
 }
 
@@ -2173,7 +2173,7 @@ func TestFirecrackerRunWithDockerMirror(t *testing.T) {
 				},
 			}
 
-			res := c.Run(ctx, cmd, workDir, oci.Credentials{})
+			res := c.Run(ctx, cmd, workDir, oci.Credentials{}, &interfaces.Stdio{})
 			require.NoError(t, res.Error)
 
 			assert.Equal(t, 0, res.ExitCode)
@@ -2529,7 +2529,7 @@ func TestFirecrackerRun_Timeout_DebugOutputIsAvailable(t *testing.T) {
 	`}}
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{}, &interfaces.Stdio{})
 
 	require.True(
 		t, status.IsDeadlineExceededError(res.Error),
@@ -2639,7 +2639,7 @@ func TestFirecrackerLargeResult(t *testing.T) {
 	require.NoError(t, err)
 	const stdoutSize = 10_000_000
 	cmd := &repb.Command{Arguments: []string{"sh", "-c", fmt.Sprintf(`yes | head -c %d`, stdoutSize)}}
-	res := c.Run(ctx, cmd, workDir, oci.Credentials{})
+	res := c.Run(ctx, cmd, workDir, oci.Credentials{}, &interfaces.Stdio{})
 
 	require.NoError(t, res.Error)
 	assert.Equal(t, string(res.Stderr), "")
@@ -2783,7 +2783,7 @@ func TestFirecrackerExecScriptLoadedFromDisk(t *testing.T) {
 	c, err := firecracker.NewContainer(ctx, env, &repb.ExecutionTask{}, opts)
 	require.NoError(t, err)
 
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{}, &interfaces.Stdio{})
 	require.NoError(t, res.Error)
 }
 
@@ -3043,7 +3043,7 @@ func TestBazelBuild(t *testing.T) {
 	require.NoError(t, err)
 
 	// Run will handle the full lifecycle: no need to call Remove() here.
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, oci.Credentials{}, &interfaces.Stdio{})
 	require.NoError(t, res.Error)
 }
 
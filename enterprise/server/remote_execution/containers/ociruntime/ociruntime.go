@@ -512,7 +512,7 @@ func (c *ociContainer) PullImage(ctx context.Context, creds oci.Credentials) err
 	return nil
 }
 
-func (c *ociContainer) Run(ctx context.Context, cmd *repb.Command, workDir string, creds oci.Credentials) *interfaces.CommandResult {
+func (c *ociContainer) Run(ctx context.Context, cmd *repb.Command, workDir string, creds oci.Credentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	c.workDir = workDir
 	cid, err := newCID()
 	if err != nil {
@@ -538,7 +538,7 @@ func (c *ociContainer) Run(ctx context.Context, cmd *repb.Command, workDir strin
 		// Use --keep to prevent the cgroup from being deleted when the
 		// container exits, since we still want to be able to look at stats,
 		// events, etc. after completion.
-		return c.invokeRuntime(ctx, nil /*=cmd*/, &interfaces.Stdio{}, 0 /*=waitDelay*/, "run", "--keep", "--bundle="+c.bundlePath(), c.cid)
+		return c.invokeRuntime(ctx, nil /*=cmd*/, stdio, 0 /*=waitDelay*/, "run", "--keep", "--bundle="+c.bundlePath(), c.cid)
 	})
 }
 
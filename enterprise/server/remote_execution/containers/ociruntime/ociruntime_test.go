@@ -172,7 +172,7 @@ func TestRun(t *testing.T) {
 			{Name: "GREETING", Value: "Hello"},
 		},
 	}
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	res := c.Run(ctx, cmd, wd, oci.Credentials{}, &interfaces.Stdio{})
 	require.NoError(t, res.Error)
 	assert.Equal(t, "Hello world!\n", string(res.Stdout))
 	assert.Empty(t, string(res.Stderr))
@@ -227,7 +227,7 @@ func TestCgroupSettings(t *testing.T) {
 		`},
 	}
 
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	res := c.Run(ctx, cmd, wd, oci.Credentials{}, &interfaces.Stdio{})
 	require.NoError(t, res.Error)
 	assert.Equal(t, "300000 100000\n256\n", string(res.Stdout))
 	assert.Empty(t, string(res.Stderr))
@@ -267,7 +267,7 @@ func TestRunUsageStats(t *testing.T) {
 	// cumulative CPU usage file to reliably return stats even if we don't have
 	// a chance to poll
 	cmd := &repb.Command{Arguments: []string{"sleep", "0.5"}}
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	res := c.Run(ctx, cmd, wd, oci.Credentials{}, &interfaces.Stdio{})
 	require.NoError(t, res.Error)
 	require.Equal(t, 0, res.ExitCode)
 	assert.Greater(t, res.UsageStats.GetPeakMemoryBytes(), int64(0), "memory")
@@ -312,7 +312,7 @@ func TestRunWithImage(t *testing.T) {
 			{Name: "GREETING", Value: "Hello"},
 		},
 	}
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	res := c.Run(ctx, cmd, wd, oci.Credentials{}, &interfaces.Stdio{})
 	require.NoError(t, res.Error)
 	assert.Equal(t, `Hello world!
 GREETING=Hello
@@ -410,7 +410,7 @@ echo "All child processes were killed!"
 cat /sys/fs/cgroup/memory.events
 
 `}}
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	res := c.Run(ctx, cmd, wd, oci.Credentials{}, &interfaces.Stdio{})
 	assert.True(t, status.IsUnavailableError(res.Error), "expected UnavailableError, got %#+v", res.Error)
 	assert.Equal(t, "task process or child process killed by oom killer", status.Message(res.Error))
 	assert.Empty(t, string(res.Stdout))
@@ -491,7 +491,7 @@ func TestTini_Run(t *testing.T) {
 	// script that intentionally creates a zombie process, since shells will
 	// handle SIGCHLD and reap processes.
 	cmd := &repb.Command{Arguments: []string{"cat", "/proc/1/stat"}}
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	res := c.Run(ctx, cmd, wd, oci.Credentials{}, &interfaces.Stdio{})
 	require.NoError(t, res.Error)
 	assert.Empty(t, string(res.Stderr))
 	assert.True(t, strings.HasPrefix(string(res.Stdout), "1 (tini)"), "tini should be pid 1. /proc/1/stat contents: %q", string(res.Stdout))
@@ -871,7 +871,7 @@ func TestDevices(t *testing.T) {
 			cat /dev/zero | head -c1 >/dev/null
 			echo foo >/dev/null
 		`},
-	}, wd, oci.Credentials{})
+	}, wd, oci.Credentials{}, &interfaces.Stdio{})
 	require.NoError(t, res.Error)
 	assert.Equal(t, 0, res.ExitCode)
 	expectedLines := []string{
@@ -928,7 +928,7 @@ func TestSignal(t *testing.T) {
 		require.NoError(t, err)
 	}()
 
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	res := c.Run(ctx, cmd, wd, oci.Credentials{}, &interfaces.Stdio{})
 	assert.NoError(t, res.Error)
 	assert.Equal(t, "Got SIGTERM\n", string(res.Stdout))
 	assert.Empty(t, string(res.Stderr))
@@ -977,7 +977,7 @@ func TestNetwork_Enabled(t *testing.T) {
 			ping -c1 -W2 example.com
 		`},
 	}
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	res := c.Run(ctx, cmd, wd, oci.Credentials{}, &interfaces.Stdio{})
 	require.NoError(t, res.Error)
 	t.Logf("stdout: %s", string(res.Stdout))
 	assert.Empty(t, string(res.Stderr))
@@ -1034,7 +1034,7 @@ func TestNetwork_Disabled(t *testing.T) {
 			fi
 		`},
 	}
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	res := c.Run(ctx, cmd, wd, oci.Credentials{}, &interfaces.Stdio{})
 	require.NoError(t, res.Error)
 	t.Logf("stdout: %s", string(res.Stdout))
 	assert.Empty(t, string(res.Stderr))
@@ -1141,7 +1141,7 @@ func TestUser(t *testing.T) {
 				require.NoError(t, err)
 			})
 			cmd := &repb.Command{Arguments: []string{"id"}}
-			res := c.Run(ctx, cmd, wd, oci.Credentials{})
+			res := c.Run(ctx, cmd, wd, oci.Credentials{}, &interfaces.Stdio{})
 			require.NoError(t, res.Error)
 			assert.Equal(t, test.expectedID, strings.TrimSpace(string(res.Stdout)))
 			assert.Empty(t, string(res.Stderr))
@@ -1186,7 +1186,7 @@ func TestOverlayfsEdgeCases(t *testing.T) {
 		test -e /test/DELETED_FILE && echo >&2 "/test/DELETED_FILE unexpectedly exists"
 		exit 0
 	`}}
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	res := c.Run(ctx, cmd, wd, oci.Credentials{}, &interfaces.Stdio{})
 	require.NoError(t, res.Error)
 	assert.Empty(t, string(res.Stdout))
 	assert.Empty(t, string(res.Stderr))
@@ -1248,7 +1248,7 @@ func TestHighLayerCount(t *testing.T) {
 				require.NoError(t, c.Remove(ctx))
 			})
 			cmd := &repb.Command{Arguments: []string{"sh", "-c", `cat /a.txt`}}
-			res := c.Run(ctx, cmd, wd, oci.Credentials{})
+			res := c.Run(ctx, cmd, wd, oci.Credentials{}, &interfaces.Stdio{})
 			require.NoError(t, res.Error)
 			// Verify last layer wins
 			assert.Equal(t, lastContent, string(res.Stdout))
@@ -1295,7 +1295,7 @@ func TestEntrypoint(t *testing.T) {
 
 	res := c.Run(ctx, &repb.Command{
 		Arguments: []string{"sh", "-c", "echo $FOO"},
-	}, wd, oci.Credentials{})
+	}, wd, oci.Credentials{}, &interfaces.Stdio{})
 
 	require.NoError(t, res.Error)
 	assert.Equal(t, "bar\n", string(res.Stdout))
@@ -1374,7 +1374,7 @@ func TestFileOwnership(t *testing.T) {
 
 	res := c.Run(ctx, &repb.Command{
 		Arguments: []string{"stat", "-c", "%n: %u %g", "/foo.txt", "/bar", "/baz.ln", "/qux.hardlink"},
-	}, wd, oci.Credentials{})
+	}, wd, oci.Credentials{}, &interfaces.Stdio{})
 
 	require.NoError(t, res.Error)
 	require.Empty(t, string(res.Stderr))
@@ -1497,14 +1497,14 @@ func TestPersistentWorker(t *testing.T) {
 	}
 
 	// Start worker (Exec)
-	worker := persistentworker.Start(ctx, ws, c, "proto" /*=protocol*/, &repb.Command{
+	worker := persistentworker.Start(ctx, ws, c, "proto" /*=protocol*/, false /*=multiplex*/, false /*=cancellation*/, &repb.Command{
 		Arguments: []string{"./testworker", "--persistent_worker", "--response_base64", responseBase64},
 	})
 
 	// Send work request.
 	// The command doesn't matter - the test worker always just returns a fixed
 	// response.
-	res := worker.Exec(ctx, &repb.Command{})
+	res := worker.Exec(ctx, ws, &repb.Command{})
 
 	assert.Equal(t, "test-output", string(res.Stderr))
 	assert.Equal(t, 42, res.ExitCode)
@@ -1562,7 +1562,7 @@ func TestCancelRun(t *testing.T) {
 		err := disk.WaitUntilExists(ctx, filepath.Join(wd, "DONE"), disk.WaitOpts{Timeout: -1})
 		require.NoError(t, err)
 	}()
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	res := c.Run(ctx, cmd, wd, oci.Credentials{}, &interfaces.Stdio{})
 	assert.True(t, status.IsCanceledError(res.Error), "expected CanceledError, got %+#v", res.Error)
 	assert.Equal(t, "Hello world!\n", string(res.Stdout))
 	assert.Empty(t, string(res.Stderr))
@@ -1753,7 +1753,7 @@ func TestMounts(t *testing.T) {
 	cmd := &repb.Command{
 		Arguments: []string{"cat", "/mnt/testmount/foo.txt"},
 	}
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	res := c.Run(ctx, cmd, wd, oci.Credentials{}, &interfaces.Stdio{})
 	require.NoError(t, res.Error)
 	assert.Equal(t, "bar", string(res.Stdout))
 	assert.Empty(t, string(res.Stderr))
@@ -373,7 +373,7 @@ func (c *podmanCommandContainer) IsolationType() string {
 	return "podman"
 }
 
-func (c *podmanCommandContainer) Run(ctx context.Context, command *repb.Command, workDir string, creds oci.Credentials) *interfaces.CommandResult {
+func (c *podmanCommandContainer) Run(ctx context.Context, command *repb.Command, workDir string, creds oci.Credentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	c.workDir = workDir
 	defer os.RemoveAll(c.cidFilePath())
 	result := &interfaces.CommandResult{
@@ -399,7 +399,7 @@ func (c *podmanCommandContainer) Run(ctx context.Context, command *repb.Command,
 	podmanRunArgs = append(podmanRunArgs, c.image)
 	podmanRunArgs = append(podmanRunArgs, command.Arguments...)
 	result = c.doWithStatsTracking(ctx, func(ctx context.Context) *interfaces.CommandResult {
-		return c.runPodman(ctx, "run", &interfaces.Stdio{}, podmanRunArgs...)
+		return c.runPodman(ctx, "run", stdio, podmanRunArgs...)
 	})
 
 	if result.ExitCode == podmanCommandNotRunnableExitCode {
@@ -14,6 +14,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/pubsub"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/gcplink"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/action_merger"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/live_output"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/operation"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
@@ -55,6 +56,7 @@ import (
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 	sipb "github.com/buildbuddy-io/buildbuddy/proto/stored_invocation"
 	remote_execution_config "github.com/buildbuddy-io/buildbuddy/server/remote_execution/config"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
 	gcodes "google.golang.org/grpc/codes"
 	gstatus "google.golang.org/grpc/status"
 )
@@ -741,6 +743,7 @@ func (s *ExecutionServer) dispatch(ctx context.Context, req *repb.ExecuteRequest
 		ExecutorGroupId:   pool.GroupID,
 		TaskGroupId:       taskGroupID,
 		Priority:          req.GetExecutionPolicy().GetPriority(),
+		SchedulingTag:     props.SchedulingTag,
 	}
 	scheduleReq := &scpb.ScheduleTaskRequest{
 		TaskId:         executionID,
@@ -1185,6 +1188,10 @@ func (s *ExecutionServer) PublishOperation(stream repb.Execution_PublishOperatio
 			}
 		}
 
+		if err := s.storeLiveOutput(ctx, op); err != nil {
+			log.CtxWarningf(ctx, "PublishOperation: failed to store live output: %s", err)
+		}
+
 		mu.Lock()
 		lastOp = op
 		taskID = op.GetName()
@@ -1274,8 +1281,89 @@ func (s *ExecutionServer) PublishOperation(stream repb.Execution_PublishOperatio
 					log.CtxErrorf(ctx, "Failed to cache execute response: %s", err)
 				}
 			}
+			if err := live_output.MarkDone(ctx, s.rdb, taskID); err != nil {
+				log.CtxWarningf(ctx, "Failed to mark live output done: %s", err)
+			}
+		}
+	}
+}
+
+// storeLiveOutput stores any command output that the executor included in
+// the operation's progress metadata, and removes the output from the
+// operation so that it isn't sent to clients, who read the output using the
+// output streams instead.
+func (s *ExecutionServer) storeLiveOutput(ctx context.Context, op *longrunning.Operation) error {
+	md := &repb.ExecuteOperationMetadata{}
+	if err := op.GetMetadata().UnmarshalTo(md); err != nil {
+		return status.InvalidArgumentErrorf("unmarshal operation metadata: %s", err)
+	}
+	chunk := &repb.ExecutionOutputChunk{}
+	ok, err := rexec.AuxiliaryMetadata(md.GetPartialExecutionMetadata(), chunk)
+	if err != nil || !ok {
+		return err
+	}
+	md.PartialExecutionMetadata.AuxiliaryMetadata = slices.DeleteFunc(md.PartialExecutionMetadata.AuxiliaryMetadata, func(a *anypb.Any) bool {
+		return a.MessageIs(chunk)
+	})
+	if err := op.GetMetadata().MarshalFrom(md); err != nil {
+		return status.InternalErrorf("marshal operation metadata: %s", err)
+	}
+	return live_output.Append(ctx, s.rdb, op.GetName(), chunk)
+}
+
+// ReadOutputStream streams the stdout or stderr of a running execution, as
+// advertised in the execution's ExecuteOperationMetadata. The stream ends
+// when the execution completes. Only executions that are readable by the
+// authenticated user can be streamed.
+func (s *ExecutionServer) ReadOutputStream(req *bspb.ReadRequest, stream bspb.ByteStream_ReadServer) error {
+	executionID, isStderr, ok := rexec.ParseOutputStreamName(req.GetResourceName())
+	if !ok {
+		return status.InvalidArgumentErrorf("invalid output stream name %q", req.GetResourceName())
+	}
+	ctx := log.EnrichContext(stream.Context(), log.ExecutionIDKey, executionID)
+	if err := executil.CheckReadable(ctx, s.env, executionID); err != nil {
+		return err
+	}
+	offset := req.GetReadOffset()
+	remaining := req.GetReadLimit()
+	var stdoutOffset, stderrOffset int64
+	if isStderr {
+		stderrOffset = offset
+	} else {
+		stdoutOffset = offset
+	}
+	errReadLimitReached := status.OutOfRangeError("read limit reached")
+	err := live_output.Read(ctx, s.rdb, executionID, stdoutOffset, stderrOffset, func(chunk *repb.ExecutionOutputChunk) error {
+		chunkOffset, data := chunk.GetStdoutOffset(), chunk.GetStdout()
+		if isStderr {
+			chunkOffset, data = chunk.GetStderrOffset(), chunk.GetStderr()
+		}
+		// ByteStream reads can't skip ahead or start over, so fail if the
+		// output at the current offset was dropped or the command was
+		// restarted.
+		if chunkOffset != offset {
+			return status.OutOfRangeErrorf("output at offset %d is no longer available", offset)
+		}
+		if req.GetReadLimit() > 0 && int64(len(data)) > remaining {
+			data = data[:remaining]
+		}
+		if len(data) == 0 {
+			return nil
 		}
+		if err := stream.Send(&bspb.ReadResponse{Data: data}); err != nil {
+			return err
+		}
+		offset += int64(len(data))
+		remaining -= int64(len(data))
+		if req.GetReadLimit() > 0 && remaining == 0 {
+			return errReadLimitReached
+		}
+		return nil
+	})
+	if err == errReadLimitReached {
+		return nil
 	}
+	return err
 }
 
 // cacheExecuteResponse caches the ExecuteResponse so that the client can see
@@ -1,6 +1,7 @@
 package execution_server_test
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"strings"
@@ -29,6 +30,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/rexec"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/buildbuddy-io/buildbuddy/server/util/usageutil"
@@ -46,6 +48,7 @@ import (
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
 	gstatus "google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/durationpb"
@@ -91,7 +94,7 @@ func (s *schedulerServerMock) CancelTask(ctx context.Context, taskID string) (bo
 func setupEnv(t *testing.T) (*testenv.TestEnv, *grpc.ClientConn, *testredis.Handle) {
 	env := testenv.GetTestEnv(t)
 
-	env.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	env.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1", "US2", "GR2")))
 
 	r := testredis.Start(t)
 	rdb := redis.NewClient(redisutil.TargetToOptions(r.Target))
@@ -793,6 +796,149 @@ func TestInvocationLink_EmptyInvocationID(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestPublishOperation_LiveOutput(t *testing.T) {
+	env, conn, _ := setupEnv(t)
+	client := repb.NewExecutionClient(conn)
+	ctx := context.Background()
+
+	arn := uploadAction(ctx, t, env, "", repb.DigestFunction_SHA256, &repb.Action{})
+	executionClient, err := client.Execute(ctx, &repb.ExecuteRequest{
+		InstanceName:   arn.GetInstanceName(),
+		ActionDigest:   arn.GetDigest(),
+		DigestFunction: arn.GetDigestFunction(),
+	})
+	require.NoError(t, err)
+	err = executionClient.CloseSend()
+	require.NoError(t, err)
+	op, err := executionClient.Recv()
+	require.NoError(t, err)
+	taskID := op.GetName()
+
+	// Publish output the same way that the executor does.
+	publisher, err := operation.Publish(ctx, client, taskID)
+	require.NoError(t, err)
+	err = publisher.PublishOutput(&repb.ExecutionOutputChunk{})
+	require.NoError(t, err)
+	err = publisher.SetState(repb.ExecutionProgress_EXECUTING_COMMAND)
+	require.NoError(t, err)
+	err = publisher.PublishOutput(&repb.ExecutionOutputChunk{Stdout: []byte("hello "), Stderr: []byte("warning\n")})
+	require.NoError(t, err)
+	err = publisher.PublishOutput(&repb.ExecutionOutputChunk{StdoutOffset: 6, Stdout: []byte("world\n"), StderrOffset: 8})
+	require.NoError(t, err)
+	err = operation.PublishOperationDone(publisher, taskID, arn.GetDigest(), operation.ExecuteResponseWithResult(&repb.ActionResult{}, nil))
+	require.NoError(t, err)
+	_, err = publisher.CloseAndRecv()
+	require.NoError(t, err)
+
+	// Clients should see the stream names, but not the output itself.
+	stdoutName, stderrName := rexec.OutputStreamNames(taskID)
+	sawStreamNames := false
+	for !op.GetDone() {
+		op, err = executionClient.Recv()
+		require.NoError(t, err)
+		md := &repb.ExecuteOperationMetadata{}
+		err = op.GetMetadata().UnmarshalTo(md)
+		require.NoError(t, err)
+		if md.GetStdoutStreamName() != "" {
+			sawStreamNames = true
+			require.Equal(t, stdoutName, md.GetStdoutStreamName())
+			require.Equal(t, stderrName, md.GetStderrStreamName())
+		}
+		ok, err := rexec.AuxiliaryMetadata(md.GetPartialExecutionMetadata(), &repb.ExecutionOutputChunk{})
+		require.NoError(t, err)
+		require.False(t, ok, "output should not be forwarded to clients")
+	}
+	require.True(t, sawStreamNames, "expected stream names in operation metadata")
+
+	// The output should be readable from the streams.
+	for _, tc := range []struct {
+		name     string
+		offset   int64
+		expected string
+	}{
+		{name: stdoutName, expected: "hello world\n"},
+		{name: stdoutName, offset: 6, expected: "world\n"},
+		{name: stderrName, expected: "warning\n"},
+	} {
+		stream, err := env.GetByteStreamClient().Read(ctx, &bspb.ReadRequest{
+			ResourceName: tc.name,
+			ReadOffset:   tc.offset,
+		})
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		for {
+			rsp, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			buf.Write(rsp.GetData())
+		}
+		require.Equal(t, tc.expected, buf.String(), "read %s at offset %d", tc.name, tc.offset)
+	}
+}
+
+func TestReadOutputStream_OtherGroup(t *testing.T) {
+	env, conn, _ := setupEnv(t)
+	client := repb.NewExecutionClient(conn)
+	ta := env.GetAuthenticator().(*testauth.TestAuthenticator)
+	ctx, err := ta.WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	otherGroupCtx, err := ta.WithAuthenticatedUser(context.Background(), "US2")
+	require.NoError(t, err)
+
+	arn := uploadAction(ctx, t, env, "", repb.DigestFunction_SHA256, &repb.Action{})
+	executionClient, err := client.Execute(ctx, &repb.ExecuteRequest{
+		InstanceName:   arn.GetInstanceName(),
+		ActionDigest:   arn.GetDigest(),
+		DigestFunction: arn.GetDigestFunction(),
+	})
+	require.NoError(t, err)
+	err = executionClient.CloseSend()
+	require.NoError(t, err)
+	op, err := executionClient.Recv()
+	require.NoError(t, err)
+	taskID := op.GetName()
+
+	publisher, err := operation.Publish(ctx, client, taskID)
+	require.NoError(t, err)
+	err = publisher.SetState(repb.ExecutionProgress_EXECUTING_COMMAND)
+	require.NoError(t, err)
+	err = publisher.PublishOutput(&repb.ExecutionOutputChunk{Stdout: []byte("secret\n")})
+	require.NoError(t, err)
+	err = operation.PublishOperationDone(publisher, taskID, arn.GetDigest(), operation.ExecuteResponseWithResult(&repb.ActionResult{}, nil))
+	require.NoError(t, err)
+	_, err = publisher.CloseAndRecv()
+	require.NoError(t, err)
+
+	stdoutName, _ := rexec.OutputStreamNames(taskID)
+	readAll := func(ctx context.Context) (string, error) {
+		stream, err := env.GetByteStreamClient().Read(ctx, &bspb.ReadRequest{ResourceName: stdoutName})
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		for {
+			rsp, err := stream.Recv()
+			if err == io.EOF {
+				return buf.String(), nil
+			}
+			if err != nil {
+				return "", err
+			}
+			buf.Write(rsp.GetData())
+		}
+	}
+
+	// Users in other groups should not be able to read the output.
+	_, err = readAll(otherGroupCtx)
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	out, err := readAll(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "secret\n", out)
+}
+
 func uploadAction(ctx context.Context, t *testing.T, env *real_environment.RealEnv, instanceName string, df repb.DigestFunction_Value, action *repb.Action) *digest.ResourceName {
 	cmd := &repb.Command{Arguments: []string{"test"}}
 	cd, err := cachetools.UploadProto(ctx, env.GetByteStreamClient(), instanceName, df, cmd)
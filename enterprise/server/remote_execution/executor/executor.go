@@ -57,6 +57,8 @@ var (
 	defaultTerminationGrace          = flag.Duration("executor.default_termination_grace_period", 0, "Default termination grace period for all actions. (Termination grace period is the time to wait between an action timing out and forcefully shutting it down.)")
 	maxTerminationGracePeriod        = flag.Duration("executor.max_termination_grace_period", 1*time.Minute, "Max termination grace period that actions can request. An error will be returned if a task requests a grace period greater than this value. (Termination grace period is the time to wait between an action timing out and forcefully shutting it down.)")
 	checkActionResultBeforeExecution = flag.Bool("executor.check_action_result_before_execution", true, "If true, the executor will call GetActionResult to verify an action does not already exist before running it.")
+	enableLiveOutput                 = flag.Bool("executor.enable_live_output", false, "If true, the executor will publish the stdout and stderr of commands while they are running, so that clients can stream the output before the command completes.")
+	liveOutputFlushInterval          = flag.Duration("executor.live_output_flush_interval", 1*time.Second, "How often the executor should publish the output of running commands, if executor.enable_live_output is set.")
 )
 
 const (
@@ -237,6 +239,11 @@ func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.Sch
 		DoNotCache:               task.GetAction().GetDoNotCache(),
 	}
 	finishWithErrFn := func(finalErr error) (retry bool, err error) {
+		// If the task was preempted, don't publish the error to the client,
+		// since the task will be retried regardless of its retry settings.
+		if rexec.Preempted(ctx) {
+			return true, rexec.ErrPreempted
+		}
 		if shouldRetry(task, finalErr) {
 			return true, finalErr
 		}
@@ -349,12 +356,29 @@ func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.Sch
 		}()
 	}
 
+	// If live output is enabled, publish the initial (empty) output before
+	// publishing the EXECUTING_COMMAND state, so that the state update
+	// includes the output stream names.
+	var outputStreamer *outputStreamer
+	var liveOutput *interfaces.Stdio
+	var flushOutput <-chan time.Time
+	if *enableLiveOutput {
+		outputStreamer = newOutputStreamer(stream)
+		if err := outputStreamer.Flush(); err != nil {
+			log.CtxWarningf(ctx, "Failed to publish live output: %s", err)
+		}
+		liveOutput = outputStreamer.Stdio()
+		flushTicker := time.NewTicker(*liveOutputFlushInterval)
+		defer flushTicker.Stop()
+		flushOutput = flushTicker.C
+	}
+
 	log.CtxDebugf(ctx, "Executing task.")
 	stage.Set("execution")
 	_ = stream.SetState(repb.ExecutionProgress_EXECUTING_COMMAND)
 	cmdResultChan := make(chan *interfaces.CommandResult, 1)
 	go func() {
-		cmdResultChan <- r.Run(ctx, md.IoStats)
+		cmdResultChan <- r.Run(ctx, md.IoStats, liveOutput)
 	}()
 
 	// Run a timer that periodically sends update messages back
@@ -370,6 +394,18 @@ func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb.Sch
 			if err := stream.Ping(); err != nil {
 				return true, status.UnavailableErrorf("could not publish periodic execution update for %q: %s", taskID, err)
 			}
+		case <-flushOutput:
+			// Live output is best-effort, so don't fail the task if it
+			// can't be published. Unpublished output is retried on the
+			// next flush.
+			if err := outputStreamer.Flush(); err != nil {
+				log.CtxWarningf(ctx, "Failed to publish live output: %s", err)
+			}
+		}
+	}
+	if outputStreamer != nil {
+		if err := outputStreamer.Flush(); err != nil {
+			log.CtxWarningf(ctx, "Failed to publish live output: %s", err)
 		}
 	}
 
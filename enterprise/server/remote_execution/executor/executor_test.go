@@ -84,6 +84,10 @@ func (p *mockPublisher) SetState(state repb.ExecutionProgress_ExecutionState) er
 	return nil
 }
 
+func (p *mockPublisher) PublishOutput(chunk *repb.ExecutionOutputChunk) error {
+	return nil
+}
+
 func (p *mockPublisher) CloseAndRecv() (*repb.PublishOperationResponse, error) {
 	return &repb.PublishOperationResponse{}, nil
 }
@@ -0,0 +1,119 @@
+package executor
+
+import (
+	"io"
+	"sync"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// Max number of bytes of output to buffer per stream while waiting for
+	// output to be published. If a command writes more than this in between
+	// flushes, the oldest output is dropped.
+	maxPendingOutputBytes = 1024 * 1024
+)
+
+// outputStreamer buffers the output of a running command and publishes it in
+// chunks so that it can be streamed to clients while the command is running.
+type outputStreamer struct {
+	publisher interfaces.Publisher
+
+	mu        sync.Mutex
+	stdout    pendingOutput
+	stderr    pendingOutput
+	published bool
+}
+
+// pendingOutput is output that has been written to a stream but not yet
+// published.
+type pendingOutput struct {
+	// Offset of buf within the stream.
+	offset int64
+	buf    []byte
+}
+
+func (o *pendingOutput) prepend(offset int64, b []byte) {
+	o.offset = offset
+	o.buf = append(b, o.buf...)
+	o.truncate()
+}
+
+func (o *pendingOutput) append(b []byte) {
+	o.buf = append(o.buf, b...)
+	o.truncate()
+}
+
+func (o *pendingOutput) truncate() {
+	if excess := len(o.buf) - maxPendingOutputBytes; excess > 0 {
+		o.buf = append([]byte(nil), o.buf[excess:]...)
+		o.offset += int64(excess)
+	}
+}
+
+// take returns the pending output and its offset, and clears it.
+func (o *pendingOutput) take() (int64, []byte) {
+	offset, b := o.offset, o.buf
+	o.offset += int64(len(b))
+	o.buf = nil
+	return offset, b
+}
+
+func newOutputStreamer(publisher interfaces.Publisher) *outputStreamer {
+	return &outputStreamer{publisher: publisher}
+}
+
+// Stdio returns writers for the command's stdout and stderr. Writes to these
+// never fail.
+func (s *outputStreamer) Stdio() *interfaces.Stdio {
+	return &interfaces.Stdio{
+		Stdout: &outputStreamWriter{s: s, output: &s.stdout},
+		Stderr: &outputStreamWriter{s: s, output: &s.stderr},
+	}
+}
+
+// Flush publishes any pending output. The first call always publishes a
+// chunk, even if there is no output yet, which tells the app that the command
+// has started (or restarted, if the task is being retried). If publishing
+// fails, the output is kept so that it can be published by the next call.
+//
+// Flush must not be called concurrently with itself.
+func (s *outputStreamer) Flush() error {
+	s.mu.Lock()
+	if s.published && len(s.stdout.buf) == 0 && len(s.stderr.buf) == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	chunk := &repb.ExecutionOutputChunk{}
+	chunk.StdoutOffset, chunk.Stdout = s.stdout.take()
+	chunk.StderrOffset, chunk.Stderr = s.stderr.take()
+	s.mu.Unlock()
+
+	err := s.publisher.PublishOutput(chunk)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.stdout.prepend(chunk.GetStdoutOffset(), chunk.GetStdout())
+		s.stderr.prepend(chunk.GetStderrOffset(), chunk.GetStderr())
+		return err
+	}
+	s.published = true
+	return nil
+}
+
+type outputStreamWriter struct {
+	s      *outputStreamer
+	output *pendingOutput
+}
+
+var _ io.Writer = (*outputStreamWriter)(nil)
+
+func (w *outputStreamWriter) Write(p []byte) (int, error) {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	w.output.append(p)
+	return len(p), nil
+}
@@ -0,0 +1,100 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+type fakeOutputPublisher struct {
+	chunks []*repb.ExecutionOutputChunk
+	err    error
+}
+
+func (p *fakeOutputPublisher) Context() context.Context {
+	return context.Background()
+}
+
+func (p *fakeOutputPublisher) Send(op *longrunning.Operation) error {
+	return nil
+}
+
+func (p *fakeOutputPublisher) Ping() error {
+	return nil
+}
+
+func (p *fakeOutputPublisher) SetState(state repb.ExecutionProgress_ExecutionState) error {
+	return nil
+}
+
+func (p *fakeOutputPublisher) CloseAndRecv() (*repb.PublishOperationResponse, error) {
+	return &repb.PublishOperationResponse{}, nil
+}
+
+func (p *fakeOutputPublisher) PublishOutput(chunk *repb.ExecutionOutputChunk) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.chunks = append(p.chunks, chunk)
+	return nil
+}
+
+func TestOutputStreamer(t *testing.T) {
+	publisher := &fakeOutputPublisher{}
+	s := newOutputStreamer(publisher)
+	stdio := s.Stdio()
+
+	// The first flush publishes an empty chunk.
+	require.NoError(t, s.Flush())
+	// Flushing without new output doesn't publish anything.
+	require.NoError(t, s.Flush())
+
+	_, err := stdio.Stdout.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = stdio.Stderr.Write([]byte("warning"))
+	require.NoError(t, err)
+	require.NoError(t, s.Flush())
+
+	// If publishing fails, the output is published by the next flush.
+	_, err = stdio.Stdout.Write([]byte("world"))
+	require.NoError(t, err)
+	publisher.err = status.UnavailableError("unavailable")
+	require.Error(t, s.Flush())
+	publisher.err = nil
+	_, err = stdio.Stdout.Write([]byte("\n"))
+	require.NoError(t, err)
+	require.NoError(t, s.Flush())
+
+	expected := []*repb.ExecutionOutputChunk{
+		{},
+		{Stdout: []byte("hello "), Stderr: []byte("warning")},
+		{StdoutOffset: 6, Stdout: []byte("world\n"), StderrOffset: 7},
+	}
+	require.Empty(t, cmp.Diff(expected, publisher.chunks, protocmp.Transform()))
+}
+
+func TestOutputStreamer_DropsOldestPendingOutput(t *testing.T) {
+	publisher := &fakeOutputPublisher{}
+	s := newOutputStreamer(publisher)
+	stdio := s.Stdio()
+
+	_, err := stdio.Stdout.Write(bytes.Repeat([]byte("a"), maxPendingOutputBytes))
+	require.NoError(t, err)
+	_, err = stdio.Stdout.Write([]byte("b"))
+	require.NoError(t, err)
+	require.NoError(t, s.Flush())
+
+	require.Len(t, publisher.chunks, 1)
+	chunk := publisher.chunks[0]
+	require.Equal(t, int64(1), chunk.GetStdoutOffset())
+	require.Len(t, chunk.GetStdout(), maxPendingOutputBytes)
+	require.Equal(t, byte('b'), chunk.GetStdout()[maxPendingOutputBytes-1])
+}
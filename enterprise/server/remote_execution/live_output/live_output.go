@@ -0,0 +1,232 @@
+// Package live_output stores the output of running executions in Redis so that
+// it can be streamed to clients before the execution completes.
+package live_output
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/go-redis/redis/v8"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// TTL for live output data. This is refreshed whenever output is
+	// appended, so it only needs to cover the gaps between appends and the
+	// time that clients may spend reading the output after the execution
+	// completes.
+	outputTTL = 1 * time.Hour
+
+	// How often readers poll for new output.
+	pollInterval = 500 * time.Millisecond
+
+	// Max number of bytes returned per stream for each read from Redis.
+	readLimitBytes = 1024 * 1024
+)
+
+var (
+	maxOutputBytes = flag.Int64("remote_execution.live_output_max_bytes", 1024*1024, "Max number of bytes of stdout and stderr to retain for each running execution. Older output is discarded once this limit is reached.")
+
+	// Appends an output chunk.
+	//
+	// KEYS: metadata hash, stdout data, stderr data
+	// ARGV: stdout offset, stdout, stderr offset, stderr, max bytes, TTL (s)
+	//
+	// A chunk with both offsets equal to 0 means the executor has (re)started
+	// the command, so any output from a previous attempt is discarded.
+	redisAppendOutput = redis.NewScript(`
+		local maxBytes = tonumber(ARGV[5])
+		if ARGV[1] == "0" and ARGV[3] == "0" then
+			redis.call("del", KEYS[2], KEYS[3])
+			redis.call("hset", KEYS[1], "stdout_start", 0, "stdout_end", 0, "stderr_start", 0, "stderr_end", 0, "done", 0)
+		end
+		redis.call("hsetnx", KEYS[1], "done", 0)
+
+		local function append(name, dataKey, offset, data)
+			if data == "" then
+				return
+			end
+			local startOffset = tonumber(redis.call("hget", KEYS[1], name .. "_start")) or 0
+			local endOffset = tonumber(redis.call("hget", KEYS[1], name .. "_end")) or 0
+			local n = string.len(data)
+			-- Skip data that we already have.
+			if offset + n <= endOffset then
+				return
+			end
+			if offset > endOffset then
+				-- Some output was dropped by the executor; start over from
+				-- the new offset.
+				redis.call("set", dataKey, data)
+				startOffset = offset
+			else
+				redis.call("append", dataKey, string.sub(data, endOffset - offset + 1))
+			end
+			endOffset = offset + n
+			if endOffset - startOffset > maxBytes then
+				local kept = redis.call("getrange", dataKey, endOffset - startOffset - maxBytes, -1)
+				redis.call("set", dataKey, kept)
+				startOffset = endOffset - maxBytes
+			end
+			redis.call("hset", KEYS[1], name .. "_start", startOffset, name .. "_end", endOffset)
+		end
+		append("stdout", KEYS[2], tonumber(ARGV[1]), ARGV[2])
+		append("stderr", KEYS[3], tonumber(ARGV[3]), ARGV[4])
+
+		for i = 1, 3 do
+			redis.call("expire", KEYS[i], ARGV[6])
+		end
+		return 0
+	`)
+
+	// Marks the output as complete, if any output was stored.
+	//
+	// KEYS: metadata hash
+	redisMarkDone = redis.NewScript(`
+		if redis.call("exists", KEYS[1]) == 1 then
+			redis.call("hset", KEYS[1], "done", 1)
+		end
+		return 0
+	`)
+
+	// Reads output starting at the given offsets.
+	//
+	// KEYS: metadata hash, stdout data, stderr data
+	// ARGV: stdout offset, stderr offset, max bytes per stream
+	//
+	// Returns nil if there is no output for the execution, otherwise
+	// {stdout offset, stdout, stderr offset, stderr, done}. If a requested
+	// offset is no longer stored, or is past the end of the stored output
+	// (because the command was restarted), the returned output starts at the
+	// oldest stored offset instead.
+	redisReadOutput = redis.NewScript(`
+		if redis.call("exists", KEYS[1]) == 0 then
+			return nil
+		end
+		local limit = tonumber(ARGV[3])
+
+		local function read(name, dataKey, offset)
+			local startOffset = tonumber(redis.call("hget", KEYS[1], name .. "_start")) or 0
+			local endOffset = tonumber(redis.call("hget", KEYS[1], name .. "_end")) or 0
+			if offset < startOffset or offset > endOffset then
+				offset = startOffset
+			end
+			local n = math.min(endOffset - offset, limit)
+			if n <= 0 then
+				return offset, ""
+			end
+			return offset, redis.call("getrange", dataKey, offset - startOffset, offset - startOffset + n - 1)
+		end
+		local stdoutOffset, stdout = read("stdout", KEYS[2], tonumber(ARGV[1]))
+		local stderrOffset, stderr = read("stderr", KEYS[3], tonumber(ARGV[2]))
+		local done = tonumber(redis.call("hget", KEYS[1], "done")) or 0
+		return {stdoutOffset, stdout, stderrOffset, stderr, done}
+	`)
+)
+
+// Returns the redis keys for the metadata hash and the stdout and stderr data
+// of an execution. The keys share a hash tag so that they can be accessed by
+// the same script when using Redis Cluster.
+func redisKeys(executionID string) []string {
+	meta := fmt.Sprintf("liveOutput/{%s}", executionID)
+	return []string{meta, meta + "/stdout", meta + "/stderr"}
+}
+
+// Append stores a chunk of output published by the executor running the given
+// execution.
+func Append(ctx context.Context, rdb redis.UniversalClient, executionID string, chunk *repb.ExecutionOutputChunk) error {
+	args := []interface{}{
+		chunk.GetStdoutOffset(),
+		chunk.GetStdout(),
+		chunk.GetStderrOffset(),
+		chunk.GetStderr(),
+		*maxOutputBytes,
+		int64(outputTTL.Seconds()),
+	}
+	return redisAppendOutput.Run(ctx, rdb, redisKeys(executionID), args...).Err()
+}
+
+// MarkDone records that the given execution has completed, so that readers
+// stop waiting for more output once they have read everything.
+func MarkDone(ctx context.Context, rdb redis.UniversalClient, executionID string) error {
+	return redisMarkDone.Run(ctx, rdb, redisKeys(executionID)[:1]).Err()
+}
+
+// read returns the output of the given execution starting at the given
+// offsets, and whether the execution is done. It returns a NotFound error if
+// there is no output stored for the execution.
+func read(ctx context.Context, rdb redis.UniversalClient, executionID string, stdoutOffset, stderrOffset int64) (*repb.ExecutionOutputChunk, bool, error) {
+	res, err := redisReadOutput.Run(ctx, rdb, redisKeys(executionID), stdoutOffset, stderrOffset, readLimitBytes).Slice()
+	if err == redis.Nil {
+		return nil, false, status.NotFoundErrorf("no output found for execution %q", executionID)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(res) != 5 {
+		return nil, false, status.InternalErrorf("unexpected output read result length %d", len(res))
+	}
+	stdoutOffset, ok1 := res[0].(int64)
+	stdout, ok2 := res[1].(string)
+	stderrOffset, ok3 := res[2].(int64)
+	stderr, ok4 := res[3].(string)
+	done, ok5 := res[4].(int64)
+	if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 {
+		return nil, false, status.InternalError("unexpected output read result types")
+	}
+	chunk := &repb.ExecutionOutputChunk{
+		StdoutOffset: stdoutOffset,
+		Stdout:       []byte(stdout),
+		StderrOffset: stderrOffset,
+		Stderr:       []byte(stderr),
+	}
+	return chunk, done == 1, nil
+}
+
+// Read streams the output of the given execution starting at the given
+// offsets, calling fn with each chunk of new output until the execution
+// completes, the output expires, or fn returns an error. The chunk offsets
+// may differ from the offsets that were read previously; see
+// ReadExecutionOutputResponse for how these should be interpreted.
+//
+// It returns a NotFound error if no output is stored for the execution, which
+// is the case if the execution has not started running yet or if its output
+// is not being streamed.
+func Read(ctx context.Context, rdb redis.UniversalClient, executionID string, stdoutOffset, stderrOffset int64, fn func(chunk *repb.ExecutionOutputChunk) error) error {
+	first := true
+	for {
+		chunk, done, err := read(ctx, rdb, executionID, stdoutOffset, stderrOffset)
+		if status.IsNotFoundError(err) && !first {
+			// The output expired while we were reading it.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		first = false
+		if chunk.GetStdoutOffset() != stdoutOffset || chunk.GetStderrOffset() != stderrOffset || len(chunk.GetStdout()) > 0 || len(chunk.GetStderr()) > 0 {
+			if err := fn(chunk); err != nil {
+				return err
+			}
+			stdoutOffset = chunk.GetStdoutOffset() + int64(len(chunk.GetStdout()))
+			stderrOffset = chunk.GetStderrOffset() + int64(len(chunk.GetStderr()))
+			// If we hit the read limit, read again immediately.
+			if len(chunk.GetStdout()) == readLimitBytes || len(chunk.GetStderr()) == readLimitBytes {
+				continue
+			}
+		}
+		if done {
+			// The output was marked done before we read it, so we've read
+			// everything unless we hit the read limit (handled above).
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
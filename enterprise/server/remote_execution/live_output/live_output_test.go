@@ -0,0 +1,129 @@
+package live_output_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/live_output"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const executionID = "instance/uploads/2a5b3ad6-4b3b-4c38-9f8e-dd0b29b1a0e7/blobs/e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855/123"
+
+// readAll reads the output of the execution, which must be marked done, and
+// returns the chunks that were read.
+func readAll(t *testing.T, ctx context.Context, rdb redis.UniversalClient, stdoutOffset, stderrOffset int64) []*repb.ExecutionOutputChunk {
+	var chunks []*repb.ExecutionOutputChunk
+	err := live_output.Read(ctx, rdb, executionID, stdoutOffset, stderrOffset, func(chunk *repb.ExecutionOutputChunk) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	require.NoError(t, err)
+	return chunks
+}
+
+func TestAppendAndRead(t *testing.T) {
+	ctx := context.Background()
+	rdb := testredis.Start(t).Client()
+
+	err := live_output.Read(ctx, rdb, executionID, 0, 0, func(*repb.ExecutionOutputChunk) error { return nil })
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	for _, chunk := range []*repb.ExecutionOutputChunk{
+		{},
+		{Stdout: []byte("hello ")},
+		{StdoutOffset: 6, Stdout: []byte("world"), Stderr: []byte("warning")},
+		// Duplicate and overlapping chunks, e.g. due to retried publishes.
+		{StdoutOffset: 6, Stdout: []byte("world"), StderrOffset: 7},
+		{StdoutOffset: 8, Stdout: []byte("rld\n"), StderrOffset: 7},
+	} {
+		err := live_output.Append(ctx, rdb, executionID, chunk)
+		require.NoError(t, err)
+	}
+	err = live_output.MarkDone(ctx, rdb, executionID)
+	require.NoError(t, err)
+
+	chunks := readAll(t, ctx, rdb, 0, 0)
+	expected := []*repb.ExecutionOutputChunk{
+		{Stdout: []byte("hello world\n"), Stderr: []byte("warning")},
+	}
+	require.Empty(t, cmp.Diff(expected, chunks, protocmp.Transform()))
+
+	// Resume reading from the middle of the output.
+	chunks = readAll(t, ctx, rdb, 6, 7)
+	expected = []*repb.ExecutionOutputChunk{
+		{StdoutOffset: 6, Stdout: []byte("world\n"), StderrOffset: 7},
+	}
+	require.Empty(t, cmp.Diff(expected, chunks, protocmp.Transform()))
+
+	// Reading at the end of the output shouldn't return anything.
+	chunks = readAll(t, ctx, rdb, 12, 7)
+	require.Empty(t, chunks)
+}
+
+func TestOutputIsTruncated(t *testing.T) {
+	flags.Set(t, "remote_execution.live_output_max_bytes", 4)
+	ctx := context.Background()
+	rdb := testredis.Start(t).Client()
+
+	for _, chunk := range []*repb.ExecutionOutputChunk{
+		{Stdout: []byte("abc")},
+		{StdoutOffset: 3, Stdout: []byte("def")},
+		// The executor dropped some output.
+		{StdoutOffset: 10, Stdout: []byte("xy")},
+	} {
+		err := live_output.Append(ctx, rdb, executionID, chunk)
+		require.NoError(t, err)
+	}
+	err := live_output.MarkDone(ctx, rdb, executionID)
+	require.NoError(t, err)
+
+	chunks := readAll(t, ctx, rdb, 0, 0)
+	expected := []*repb.ExecutionOutputChunk{
+		{StdoutOffset: 10, Stdout: []byte("xy")},
+	}
+	require.Empty(t, cmp.Diff(expected, chunks, protocmp.Transform()))
+
+	err = live_output.Append(ctx, rdb, executionID, &repb.ExecutionOutputChunk{StdoutOffset: 12, Stdout: []byte("z")})
+	require.NoError(t, err)
+
+	chunks = readAll(t, ctx, rdb, 0, 0)
+	expected = []*repb.ExecutionOutputChunk{
+		{StdoutOffset: 10, Stdout: []byte("xyz")},
+	}
+	require.Empty(t, cmp.Diff(expected, chunks, protocmp.Transform()))
+}
+
+func TestRestartDiscardsOutput(t *testing.T) {
+	ctx := context.Background()
+	rdb := testredis.Start(t).Client()
+
+	err := live_output.Append(ctx, rdb, executionID, &repb.ExecutionOutputChunk{Stdout: []byte("first attempt")})
+	require.NoError(t, err)
+	err = live_output.MarkDone(ctx, rdb, executionID)
+	require.NoError(t, err)
+
+	// The command is retried, which starts over with an empty chunk.
+	err = live_output.Append(ctx, rdb, executionID, &repb.ExecutionOutputChunk{})
+	require.NoError(t, err)
+	err = live_output.Append(ctx, rdb, executionID, &repb.ExecutionOutputChunk{Stdout: []byte("retry")})
+	require.NoError(t, err)
+	err = live_output.MarkDone(ctx, rdb, executionID)
+	require.NoError(t, err)
+
+	// A reader that had read the first attempt's output is sent back to the
+	// start.
+	chunks := readAll(t, ctx, rdb, 13, 0)
+	expected := []*repb.ExecutionOutputChunk{
+		{Stdout: []byte("retry")},
+	}
+	require.Empty(t, cmp.Diff(expected, chunks, protocmp.Transform()))
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
+	"github.com/buildbuddy-io/buildbuddy/server/util/rexec"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"google.golang.org/genproto/googleapis/longrunning"
 	"google.golang.org/protobuf/types/known/anypb"
@@ -43,6 +44,10 @@ type Publisher struct {
 	// auxiliary metadata.
 	executionStageProgress repb.ExecutionProgress_ExecutionState
 
+	// Whether the output of the executing command is being published, in
+	// which case the output stream names are included in progress updates.
+	streamingOutput bool
+
 	mu     sync.Mutex
 	stream *retryingClient
 }
@@ -68,6 +73,18 @@ func (p *Publisher) Send(op *longrunning.Operation) error {
 
 // Ping re-publishes the current execution progress state.
 func (p *Publisher) Ping() error {
+	return p.publishProgress(nil /*=output*/)
+}
+
+// PublishOutput publishes a chunk of output written by the command that is
+// currently executing. Once this has been called, progress updates also
+// include the names of the streams from which clients can read the output.
+func (p *Publisher) PublishOutput(chunk *repb.ExecutionOutputChunk) error {
+	p.streamingOutput = true
+	return p.publishProgress(chunk)
+}
+
+func (p *Publisher) publishProgress(output *repb.ExecutionOutputChunk) error {
 	progress := &repb.ExecutionProgress{
 		Timestamp:      tspb.Now(),
 		ExecutionState: p.executionStageProgress,
@@ -83,6 +100,16 @@ func (p *Publisher) Ping() error {
 			AuxiliaryMetadata: []*anypb.Any{progressAny},
 		},
 	}
+	if p.streamingOutput {
+		md.StdoutStreamName, md.StderrStreamName = rexec.OutputStreamNames(p.taskID)
+	}
+	if output != nil {
+		outputAny, err := anypb.New(output)
+		if err != nil {
+			return err
+		}
+		md.PartialExecutionMetadata.AuxiliaryMetadata = append(md.PartialExecutionMetadata.AuxiliaryMetadata, outputAny)
+	}
 	op, err := Assemble(p.taskID, md, nil /*=response*/)
 	if err != nil {
 		return status.WrapError(err, "assemble operation")
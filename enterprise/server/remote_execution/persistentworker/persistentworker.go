@@ -7,10 +7,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
@@ -35,6 +37,10 @@ const (
 	// after we send the shutdown signal before giving up.
 	persistentWorkerShutdownTimeout = 10 * time.Second
 
+	// How long to wait for a multiplex worker to respond to a cancel request
+	// before giving up on the request.
+	persistentWorkerCancelTimeout = 5 * time.Second
+
 	// Protocol value identifying the JSON persistent worker protocol.
 	jsonProtocol = "json"
 
@@ -53,6 +59,11 @@ type Worker struct {
 	workspace *workspace.Workspace
 	container container.CommandContainer
 	protocol  string // "json" or "proto"
+	// multiplex is whether the worker supports multiplex work requests, which
+	// are identified by a request ID and may be in flight concurrently.
+	multiplex bool
+	// cancellation is whether the worker supports cancel requests.
+	cancellation bool
 
 	stdinWriter *io.PipeWriter
 	stderr      lockingbuffer.LockingBuffer
@@ -60,6 +71,23 @@ type Worker struct {
 	stdoutReader *bufio.Reader
 	jsonDecoder  *json.Decoder
 
+	// singleplexMu ensures that a singleplex worker is only sent one request
+	// at a time.
+	singleplexMu sync.Mutex
+	// writeMu serializes writes of work requests to stdin.
+	writeMu sync.Mutex
+
+	mu            sync.Mutex // protects(lastRequestID), protects(pending)
+	lastRequestID int32
+	// pending holds the channels which receive the responses to the requests
+	// that are in flight, keyed by request ID.
+	pending map[int32]chan *wkpb.WorkResponse
+
+	// readDone is closed once the worker stops sending responses, after
+	// readErr is set to the error that stopped it.
+	readDone chan struct{}
+	readErr  error
+
 	stop func() error
 }
 
@@ -67,17 +95,25 @@ type Worker struct {
 // a long-running Exec() command.
 // The provided context should be a long-lived context that lives longer
 // than just a single task.
-func Start(ctx context.Context, workspace *workspace.Workspace, container container.CommandContainer, protocol string, command *repb.Command) *Worker {
+// If multiplex is true, the worker is sent multiplex work requests, which
+// allows calling Exec concurrently. If cancellation is also true, the worker
+// is sent a cancel request when a multiplex request's context is done.
+func Start(ctx context.Context, workspace *workspace.Workspace, container container.CommandContainer, protocol string, multiplex, cancellation bool, command *repb.Command) *Worker {
 	stdinReader, stdinWriter := io.Pipe()
 	stdoutReader, stdoutWriter := io.Pipe()
 
 	w := &Worker{
-		container: container,
-		workspace: workspace,
-		protocol:  protocol,
+		container:    container,
+		workspace:    workspace,
+		protocol:     protocol,
+		multiplex:    multiplex,
+		cancellation: cancellation,
 
 		stdinWriter:  stdinWriter,
 		stdoutReader: bufio.NewReader(stdoutReader),
+
+		pending:  make(map[int32]chan *wkpb.WorkResponse),
+		readDone: make(chan struct{}),
 	}
 	if protocol == jsonProtocol {
 		w.jsonDecoder = json.NewDecoder(stdoutReader)
@@ -121,23 +157,38 @@ func Start(ctx context.Context, workspace *workspace.Workspace, container contai
 		res := w.container.Exec(ctx, command, stdio)
 		log.Debugf("Persistent worker exited with response: %+v, flagFiles: %+v, workerArgs: %+v", res, args.FlagFiles, args.WorkerArgs)
 	}()
+	go w.readResponses()
 
 	return w
 }
 
-func (w *Worker) Exec(ctx context.Context, command *repb.Command) *interfaces.CommandResult {
-	// Clear any stderr that might be associated with a previous request.
-	w.stderr.Reset()
+// Exec sends a work request for the given command to the worker and waits for
+// the response. The flag files and inputs of the request are read from the
+// given workspace. For multiplex workers, this may be a workspace inside of
+// the worker's workspace, which is then sent as the request's sandbox
+// directory.
+//
+// If ctx is done before the worker responds, multiplex workers that support
+// cancellation are asked to cancel the request. Other workers may still be
+// working on the abandoned request, so they should not be reused after Exec
+// returns an error.
+func (w *Worker) Exec(ctx context.Context, ws *workspace.Workspace, command *repb.Command) *interfaces.CommandResult {
+	if !w.multiplex {
+		w.singleplexMu.Lock()
+		defer w.singleplexMu.Unlock()
+		// Clear any stderr that might be associated with a previous request.
+		w.stderr.Reset()
+	}
 
 	args := parseArgs(command.GetArguments())
-	expandedArguments, err := w.expandFlagFiles(args.FlagFiles)
+	expandedArguments, err := expandFlagFiles(ws.Path(), args.FlagFiles)
 	if err != nil {
 		return commandutil.ErrorResult(status.WrapError(err, "expand flag files"))
 	}
 
 	// Collect all of the input digests.
-	inputs := make([]*wkpb.Input, 0, len(w.workspace.Inputs))
-	for path, digest := range w.workspace.Inputs {
+	inputs := make([]*wkpb.Input, 0, len(ws.Inputs))
+	for path, digest := range ws.Inputs {
 		digestBytes, err := proto.Marshal(digest)
 		if err != nil {
 			return commandutil.ErrorResult(status.WrapError(err, "marshal input digest"))
@@ -148,30 +199,151 @@ func (w *Worker) Exec(ctx context.Context, command *repb.Command) *interfaces.Co
 		})
 	}
 
-	// Write the encoded request to stdin.
 	req := &wkpb.WorkRequest{
 		Inputs:    inputs,
 		Arguments: expandedArguments,
 	}
+	if w.multiplex {
+		sandboxDir, err := w.sandboxDir(ws)
+		if err != nil {
+			return commandutil.ErrorResult(err)
+		}
+		req.SandboxDir = sandboxDir
+	}
+
+	// Write the encoded request to stdin.
+	rspCh := make(chan *wkpb.WorkResponse, 1)
+	req.RequestId = w.addPendingRequest(rspCh)
 	if err := w.marshalWorkRequest(req); err != nil {
+		w.removePendingRequest(req.RequestId)
 		return commandutil.ErrorResult(status.UnavailableErrorf(
 			"failed to send persistent work request: %s\npersistent worker stderr:\n%s",
 			err, w.stderrDebugString()))
 	}
 
-	// Decode the response from stdout.
-	rsp := &wkpb.WorkResponse{}
-	if err := w.unmarshalWorkResponse(rsp); err != nil {
+	// Wait for the response to be read from stdout.
+	select {
+	case rsp := <-rspCh:
+		return commandResult(rsp)
+	case <-w.readDone:
+		// The response may have been delivered just before the worker
+		// stopped.
+		select {
+		case rsp := <-rspCh:
+			return commandResult(rsp)
+		default:
+		}
 		return commandutil.ErrorResult(status.UnavailableErrorf(
 			"failed to read persistent work response: %s\npersistent worker stderr:\n%s",
-			err, w.stderrDebugString()))
+			w.readErr, w.stderrDebugString()))
+	case <-ctx.Done():
+		w.cancel(ctx, req.RequestId, rspCh)
+		return commandutil.ErrorResult(status.FromContextError(ctx))
 	}
+}
+
+func commandResult(rsp *wkpb.WorkResponse) *interfaces.CommandResult {
 	return &interfaces.CommandResult{
 		Stderr:   []byte(rsp.Output),
 		ExitCode: int(rsp.ExitCode),
 	}
 }
 
+// sandboxDir returns the path of the given workspace relative to the worker's
+// workspace, which is the worker's working directory.
+func (w *Worker) sandboxDir(ws *workspace.Workspace) (string, error) {
+	rel, err := filepath.Rel(w.workspace.Path(), ws.Path())
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", status.InternalErrorf("workspace %q is not inside of the persistent worker workspace %q", ws.Path(), w.workspace.Path())
+	}
+	if rel == "." {
+		return "", nil
+	}
+	return rel, nil
+}
+
+// addPendingRequest registers a channel to receive the response to a new
+// request, and returns the ID of the request. Singleplex requests always have
+// ID 0.
+func (w *Worker) addPendingRequest(rspCh chan *wkpb.WorkResponse) int32 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var id int32
+	if w.multiplex {
+		if w.lastRequestID == math.MaxInt32 {
+			w.lastRequestID = 0
+		}
+		w.lastRequestID++
+		id = w.lastRequestID
+	}
+	w.pending[id] = rspCh
+	return id
+}
+
+func (w *Worker) removePendingRequest(id int32) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.pending, id)
+}
+
+// cancel asks a multiplex worker to cancel a request, and waits for the worker
+// to respond so that the request's sandbox directory is no longer in use
+// when the caller cleans it up. Workers that don't support cancellation are
+// not sent a cancel request, since they may not handle it correctly.
+func (w *Worker) cancel(ctx context.Context, id int32, rspCh chan *wkpb.WorkResponse) {
+	if !w.multiplex || !w.cancellation {
+		w.removePendingRequest(id)
+		return
+	}
+	if err := w.marshalWorkRequest(&wkpb.WorkRequest{RequestId: id, Cancel: true}); err != nil {
+		log.CtxWarningf(ctx, "Failed to cancel persistent work request %d: %s", id, err)
+		w.removePendingRequest(id)
+		return
+	}
+	select {
+	case <-rspCh:
+	case <-w.readDone:
+	case <-time.After(persistentWorkerCancelTimeout):
+		log.CtxWarningf(ctx, "Timed out waiting for persistent worker to cancel work request %d", id)
+		w.removePendingRequest(id)
+	}
+}
+
+// readResponses reads responses from the worker's stdout and delivers each
+// one to the pending request with the same ID, until the worker exits or
+// sends an invalid response.
+func (w *Worker) readResponses() {
+	defer close(w.readDone)
+	for {
+		rsp := &wkpb.WorkResponse{}
+		if err := w.unmarshalWorkResponse(rsp); err != nil {
+			w.readErr = err
+			return
+		}
+		w.mu.Lock()
+		rspCh, ok := w.pending[rsp.GetRequestId()]
+		delete(w.pending, rsp.GetRequestId())
+		w.mu.Unlock()
+		if !ok {
+			// The request may have been abandoned after it was canceled.
+			log.Debugf("Ignoring persistent work response for unknown request ID %d", rsp.GetRequestId())
+			continue
+		}
+		rspCh <- rsp
+	}
+}
+
+// Exited returns whether the worker has stopped responding to requests,
+// because the worker process exited or sent an invalid response.
+func (w *Worker) Exited() bool {
+	select {
+	case <-w.readDone:
+		return true
+	default:
+		return false
+	}
+}
+
 // Stop kills the worker process and waits for it to exit.
 func (w *Worker) Stop() error {
 	return w.stop()
@@ -186,6 +358,8 @@ func (w *Worker) stderrDebugString() string {
 }
 
 func (r *Worker) marshalWorkRequest(requestProto *wkpb.WorkRequest) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
 	if r.protocol == jsonProtocol {
 		marshaler := &protojson.MarshalOptions{EmitUnpopulated: true}
 		out, err := marshaler.Marshal(requestProto)
@@ -239,24 +413,25 @@ func (w *Worker) unmarshalWorkResponse(responseProto *wkpb.WorkResponse) error {
 }
 
 // Recursively expands arguments by replacing @filename args with the contents
-// of the referenced files. The @ itself can be escaped with @@. This
-// deliberately does not expand --flagfile= style arguments, because we want to
-// get rid of the expansion entirely at some point in time.
+// of the referenced files, which are relative to the given directory. The @
+// itself can be escaped with @@. This deliberately does not expand --flagfile=
+// style arguments, because we want to get rid of the expansion entirely at
+// some point in time.
 //
 // Based on:
 // https://github.com/bazelbuild/bazel/blob/e9e6978809b0214e336fee05047d5befe4f4e0c3/src/main/java/com/google/devtools/build/lib/worker/WorkerSpawnRunner.java#L324
-func (w *Worker) expandFlagFiles(args []string) ([]string, error) {
+func expandFlagFiles(dir string, args []string) ([]string, error) {
 	expandedArgs := make([]string, 0)
 	for _, arg := range args {
 		if strings.HasPrefix(arg, "@") && !strings.HasPrefix(arg, "@@") && !externalRepositoryPattern.MatchString(arg) {
-			file, err := os.Open(filepath.Join(w.workspace.Path(), arg[1:]))
+			file, err := os.Open(filepath.Join(dir, arg[1:]))
 			if err != nil {
 				return nil, err
 			}
 			defer file.Close()
 			scanner := bufio.NewScanner(file)
 			for scanner.Scan() {
-				args, err := w.expandFlagFiles([]string{scanner.Text()})
+				args, err := expandFlagFiles(dir, []string{scanner.Text()})
 				if err != nil {
 					return nil, err
 				}
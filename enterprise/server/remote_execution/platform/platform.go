@@ -89,6 +89,8 @@ const (
 	persistentWorkerPropertyName            = "persistent-workers"
 	persistentWorkerKeyPropertyName         = "persistentWorkerKey"
 	persistentWorkerProtocolPropertyName    = "persistentWorkerProtocol"
+	persistentWorkerMultiplexPropertyName   = "supports-multiplex-workers"
+	persistentWorkerCancelPropertyName      = "supports-worker-cancellation"
 	WorkflowIDPropertyName                  = "workflow-id"
 	WorkloadIsolationPropertyName           = "workload-isolation-type"
 	initDockerdPropertyName                 = "init-dockerd"
@@ -107,6 +109,7 @@ const (
 	SnapshotKeyOverridePropertyName         = "snapshot-key-override"
 	RetryPropertyName                       = "retry"
 	SkipResavingActionSnapshotsPropertyName = "skip-resaving-action-snapshots"
+	SchedulingTagPropertyName               = "scheduling-tag"
 
 	OperatingSystemPropertyName = "OSFamily"
 	LinuxOperatingSystemName    = "linux"
@@ -234,6 +237,16 @@ type Properties struct {
 	WorkflowID               string
 	HostedBazelAffinityKey   string
 
+	// PersistentWorkerMultiplex specifies whether the persistent worker
+	// supports multiplex work requests, which allows concurrent tasks to share
+	// a single worker process.
+	PersistentWorkerMultiplex bool
+
+	// PersistentWorkerCancellation specifies whether the persistent worker
+	// supports cancel requests. Only multiplex workers are sent cancel
+	// requests.
+	PersistentWorkerCancellation bool
+
 	// DisableMeasuredTaskSize disables measurement-based task sizing, even if
 	// it is enabled via flag, and instead uses the default / platform based
 	// sizing. Intended for debugging purposes only and should not generally
@@ -266,6 +279,12 @@ type Properties struct {
 	// This property is ignored for bazel executions, because the bazel client
 	// handles retries itself.
 	Retry bool
+
+	// SchedulingTag identifies the kind of work that the action belongs to,
+	// such as "interactive" or "ci". Together with the group ID, it determines
+	// the scheduling class of the action, which can be given its own
+	// fair-share weight and concurrency limit.
+	SchedulingTag string
 }
 
 // ContainerType indicates the type of containerization required by an executor.
@@ -372,45 +391,48 @@ func ParseProperties(task *repb.ExecutionTask) (*Properties, error) {
 	}
 
 	return &Properties{
-		OS:                        strings.ToLower(stringProp(m, OperatingSystemPropertyName, defaultOperatingSystemName)),
-		Arch:                      strings.ToLower(stringProp(m, CPUArchitecturePropertyName, defaultCPUArchitecture)),
-		Pool:                      strings.ToLower(pool),
-		PoolType:                  poolType,
-		EstimatedComputeUnits:     float64Prop(m, EstimatedComputeUnitsPropertyName, 0),
-		EstimatedMemoryBytes:      iecBytesProp(m, EstimatedMemoryPropertyName, 0),
-		EstimatedMilliCPU:         milliCPUProp(m, EstimatedCPUPropertyName, 0),
-		EstimatedFreeDiskBytes:    iecBytesProp(m, EstimatedFreeDiskPropertyName, 0),
-		CustomResources:           customResources,
-		ContainerImage:            stringProp(m, containerImagePropertyName, ""),
-		ContainerRegistryUsername: stringProp(m, containerRegistryUsernamePropertyName, ""),
-		ContainerRegistryPassword: stringProp(m, containerRegistryPasswordPropertyName, ""),
-		WorkloadIsolationType:     isolationType,
-		InitDockerd:               boolProp(m, initDockerdPropertyName, false),
-		EnableDockerdTCP:          boolProp(m, enableDockerdTCPPropertyName, false),
-		DockerForceRoot:           boolProp(m, dockerRunAsRootPropertyName, false),
-		DockerInit:                boolProp(m, DockerInitPropertyName, false),
-		DockerUser:                stringProp(m, DockerUserPropertyName, ""),
-		DockerNetwork:             stringProp(m, dockerNetworkPropertyName, ""),
-		RecycleRunner:             recycleRunner,
-		DefaultTimeout:            timeout,
-		TerminationGracePeriod:    terminationGracePeriod,
-		RunnerRecyclingMaxWait:    runnerRecyclingMaxWait,
-		EnableVFS:                 vfsEnabled,
-		IncludeSecrets:            boolProp(m, IncludeSecretsPropertyName, false),
-		PreserveWorkspace:         boolProp(m, PreserveWorkspacePropertyName, false),
-		OverlayfsWorkspace:        boolProp(m, overlayfsWorkspacePropertyName, false),
-		CleanWorkspaceInputs:      stringProp(m, cleanWorkspaceInputsPropertyName, ""),
-		PersistentWorker:          boolProp(m, persistentWorkerPropertyName, false),
-		PersistentWorkerKey:       stringProp(m, persistentWorkerKeyPropertyName, ""),
-		PersistentWorkerProtocol:  stringProp(m, persistentWorkerProtocolPropertyName, ""),
-		WorkflowID:                stringProp(m, WorkflowIDPropertyName, ""),
-		HostedBazelAffinityKey:    stringProp(m, HostedBazelAffinityKeyPropertyName, ""),
-		DisableMeasuredTaskSize:   boolProp(m, disableMeasuredTaskSizePropertyName, false),
-		DisablePredictedTaskSize:  boolProp(m, disablePredictedTaskSizePropertyName, false),
-		ExtraArgs:                 stringListProp(m, extraArgsPropertyName),
-		EnvOverrides:              envOverrides,
-		OverrideSnapshotKey:       overrideSnapshotKey,
-		Retry:                     boolProp(m, RetryPropertyName, true),
+		OS:                           strings.ToLower(stringProp(m, OperatingSystemPropertyName, defaultOperatingSystemName)),
+		Arch:                         strings.ToLower(stringProp(m, CPUArchitecturePropertyName, defaultCPUArchitecture)),
+		Pool:                         strings.ToLower(pool),
+		PoolType:                     poolType,
+		EstimatedComputeUnits:        float64Prop(m, EstimatedComputeUnitsPropertyName, 0),
+		EstimatedMemoryBytes:         iecBytesProp(m, EstimatedMemoryPropertyName, 0),
+		EstimatedMilliCPU:            milliCPUProp(m, EstimatedCPUPropertyName, 0),
+		EstimatedFreeDiskBytes:       iecBytesProp(m, EstimatedFreeDiskPropertyName, 0),
+		CustomResources:              customResources,
+		ContainerImage:               stringProp(m, containerImagePropertyName, ""),
+		ContainerRegistryUsername:    stringProp(m, containerRegistryUsernamePropertyName, ""),
+		ContainerRegistryPassword:    stringProp(m, containerRegistryPasswordPropertyName, ""),
+		WorkloadIsolationType:        isolationType,
+		InitDockerd:                  boolProp(m, initDockerdPropertyName, false),
+		EnableDockerdTCP:             boolProp(m, enableDockerdTCPPropertyName, false),
+		DockerForceRoot:              boolProp(m, dockerRunAsRootPropertyName, false),
+		DockerInit:                   boolProp(m, DockerInitPropertyName, false),
+		DockerUser:                   stringProp(m, DockerUserPropertyName, ""),
+		DockerNetwork:                stringProp(m, dockerNetworkPropertyName, ""),
+		RecycleRunner:                recycleRunner,
+		DefaultTimeout:               timeout,
+		TerminationGracePeriod:       terminationGracePeriod,
+		RunnerRecyclingMaxWait:       runnerRecyclingMaxWait,
+		EnableVFS:                    vfsEnabled,
+		IncludeSecrets:               boolProp(m, IncludeSecretsPropertyName, false),
+		PreserveWorkspace:            boolProp(m, PreserveWorkspacePropertyName, false),
+		OverlayfsWorkspace:           boolProp(m, overlayfsWorkspacePropertyName, false),
+		CleanWorkspaceInputs:         stringProp(m, cleanWorkspaceInputsPropertyName, ""),
+		PersistentWorker:             boolProp(m, persistentWorkerPropertyName, false),
+		PersistentWorkerKey:          stringProp(m, persistentWorkerKeyPropertyName, ""),
+		PersistentWorkerProtocol:     stringProp(m, persistentWorkerProtocolPropertyName, ""),
+		PersistentWorkerMultiplex:    boolProp(m, persistentWorkerMultiplexPropertyName, false),
+		PersistentWorkerCancellation: boolProp(m, persistentWorkerCancelPropertyName, false),
+		WorkflowID:                   stringProp(m, WorkflowIDPropertyName, ""),
+		HostedBazelAffinityKey:       stringProp(m, HostedBazelAffinityKeyPropertyName, ""),
+		DisableMeasuredTaskSize:      boolProp(m, disableMeasuredTaskSizePropertyName, false),
+		DisablePredictedTaskSize:     boolProp(m, disablePredictedTaskSizePropertyName, false),
+		ExtraArgs:                    stringListProp(m, extraArgsPropertyName),
+		EnvOverrides:                 envOverrides,
+		OverrideSnapshotKey:          overrideSnapshotKey,
+		Retry:                        boolProp(m, RetryPropertyName, true),
+		SchedulingTag:                stringProp(m, SchedulingTagPropertyName, ""),
 	}, nil
 }
 
@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/fs"
 	"math"
 	"os"
@@ -67,6 +68,9 @@ var (
 	// can't be added to the pool and must be cleaned up instead.
 	maxRunnerMemoryUsageBytes = flag.Int64("executor.runner_pool.max_runner_memory_usage_bytes", 0, "Maximum memory usage for a recycled runner; runners exceeding this threshold are not recycled.")
 	podmanWarmupDefaultImages = flag.Bool("executor.podman.warmup_default_images", true, "Whether to warmup the default podman images or not.")
+	// How long a multiplex persistent worker is kept alive when no tasks are
+	// using it.
+	multiplexWorkerIdleTimeout = flag.Duration("executor.runner_pool.multiplex_worker_idle_timeout", 5*time.Minute, "How long to keep a multiplex persistent worker alive after the last task using it has completed. Idle multiplex workers do not count towards the runner pool limits.")
 
 	overlayfsEnabled = flag.Bool("executor.workspace.overlayfs_enabled", false, "Enable overlayfs support for anonymous action workspaces. ** UNSTABLE **")
 )
@@ -190,6 +194,15 @@ type taskRunner struct {
 
 	worker *persistentworker.Worker
 
+	// multiplexWorker is the multiplex persistent worker that the runner's
+	// tasks are sent to, which is shared with other runners. If set, the
+	// runner's workspace is a sandbox directory inside of the worker's
+	// workspace, and the runner's container is the worker's container.
+	multiplexWorker *multiplexWorker
+	// cancelWorkRequest cancels the multiplex work request that is in
+	// flight, if any. Protected by pool.mu.
+	cancelWorkRequest context.CancelFunc
+
 	// Keeps track of whether or not we encountered any errors that make the runner non-reusable.
 	doNotReuse bool
 
@@ -291,7 +304,7 @@ func (r *taskRunner) DownloadInputs(ctx context.Context, ioStats *repb.IOStats)
 }
 
 // Run runs the task that is currently bound to the command runner.
-func (r *taskRunner) Run(ctx context.Context, ioStats *repb.IOStats) (res *interfaces.CommandResult) {
+func (r *taskRunner) Run(ctx context.Context, ioStats *repb.IOStats, liveOutput *interfaces.Stdio) (res *interfaces.CommandResult) {
 	start := time.Now()
 	defer func() {
 		// Discard nonsensical PSI full-stall durations which are greater
@@ -355,7 +368,14 @@ func (r *taskRunner) Run(ctx context.Context, ioStats *repb.IOStats) (res *inter
 		if err != nil {
 			return commandutil.ErrorResult(err)
 		}
-		return r.Container.Run(ctx, command, wsPath, creds)
+		stdio, setOutput := teeOutput(liveOutput)
+		res := r.Container.Run(ctx, command, wsPath, creds, stdio)
+		setOutput(res)
+		return res
+	}
+
+	if r.multiplexWorker != nil {
+		return r.sendMultiplexWorkRequest(ctx, command)
 	}
 
 	// Get the container to "ready" state so that we can exec commands in it.
@@ -397,7 +417,9 @@ func (r *taskRunner) Run(ctx context.Context, ioStats *repb.IOStats) (res *inter
 		return r.sendPersistentWorkRequest(ctx, command)
 	}
 
-	execResult := r.Container.Exec(ctx, command, &interfaces.Stdio{})
+	stdio, setOutput := teeOutput(liveOutput)
+	execResult := r.Container.Exec(ctx, command, stdio)
+	setOutput(execResult)
 
 	if r.hasMaxResourceUtilization(ctx, execResult.UsageStats) {
 		r.doNotReuse = true
@@ -406,7 +428,41 @@ func (r *taskRunner) Run(ctx context.Context, ioStats *repb.IOStats) (res *inter
 	return execResult
 }
 
+// teeOutput returns stdio for running a command which writes the command's
+// output to the given live output writers, if any, while also buffering it.
+// Since containers don't populate the command result's output when stdio
+// writers are given, the returned func must be called with the result to
+// populate it with the buffered output.
+func teeOutput(liveOutput *interfaces.Stdio) (*interfaces.Stdio, func(*interfaces.CommandResult)) {
+	if liveOutput == nil || (liveOutput.Stdout == nil && liveOutput.Stderr == nil) {
+		return &interfaces.Stdio{}, func(*interfaces.CommandResult) {}
+	}
+	var stdout, stderr bytes.Buffer
+	stdio := &interfaces.Stdio{Stdout: &stdout, Stderr: &stderr}
+	if liveOutput.Stdout != nil {
+		stdio.Stdout = io.MultiWriter(&stdout, liveOutput.Stdout)
+	}
+	if liveOutput.Stderr != nil {
+		stdio.Stderr = io.MultiWriter(&stderr, liveOutput.Stderr)
+	}
+	return stdio, func(res *interfaces.CommandResult) {
+		res.Stdout = stdout.Bytes()
+		res.Stderr = stderr.Bytes()
+	}
+}
+
 func (r *taskRunner) GracefulTerminate(ctx context.Context) error {
+	if r.multiplexWorker != nil {
+		// The container is shared with other tasks, so instead of signaling
+		// it, ask the worker to cancel the task's work request.
+		r.p.mu.RLock()
+		cancel := r.cancelWorkRequest
+		r.p.mu.RUnlock()
+		if cancel != nil {
+			cancel()
+		}
+		return nil
+	}
 	return r.Container.Signal(ctx, syscall.SIGTERM)
 }
 
@@ -415,15 +471,135 @@ func (r *taskRunner) sendPersistentWorkRequest(ctx context.Context, command *rep
 	r.doNotReuse = true
 	if r.worker == nil {
 		log.CtxInfof(ctx, "Starting persistent worker")
-		r.worker = persistentworker.Start(r.env.GetServerContext(), r.Workspace, r.Container, r.PlatformProperties.PersistentWorkerProtocol, command)
+		r.worker = persistentworker.Start(r.env.GetServerContext(), r.Workspace, r.Container, r.PlatformProperties.PersistentWorkerProtocol, false /*=multiplex*/, false /*=cancellation*/, command)
 	}
-	res := r.worker.Exec(ctx, command)
+	res := r.worker.Exec(ctx, r.Workspace, command)
 	if res.Error == nil {
 		r.doNotReuse = false
 	}
 	return res
 }
 
+func (r *taskRunner) sendMultiplexWorkRequest(ctx context.Context, command *repb.Command) *interfaces.CommandResult {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r.p.mu.Lock()
+	r.cancelWorkRequest = cancel
+	r.p.mu.Unlock()
+
+	worker, err := r.multiplexWorker.start(ctx, r.env, r.PlatformProperties, command)
+	if err != nil {
+		r.p.discardMultiplexWorker(r.multiplexWorker)
+		return commandutil.ErrorResult(err)
+	}
+	res := worker.Exec(ctx, r.Workspace, command)
+	if worker.Exited() {
+		// Start a new worker for subsequent tasks.
+		r.p.discardMultiplexWorker(r.multiplexWorker)
+	} else if ctx.Err() != nil && !r.PlatformProperties.PersistentWorkerCancellation {
+		// The worker wasn't asked to cancel the request, and may still be
+		// working on it, so don't send it any more tasks.
+		r.p.discardMultiplexWorker(r.multiplexWorker)
+	}
+	return res
+}
+
+// multiplexWorker is a persistent worker that handles multiplex work requests
+// for all of the runners with the same runner key. Each of these runners uses
+// a workspace inside of the worker's workspace, which is sent as the sandbox
+// directory of its work requests, so that the worker can handle the requests
+// concurrently.
+type multiplexWorker struct {
+	// key is the serialized runner key of the runners using the worker.
+	key string
+
+	mu        sync.Mutex // protects(workspace), protects(container), protects(worker)
+	workspace *workspace.Workspace
+	container *container.TracedCommandContainer
+	worker    *persistentworker.Worker
+
+	// refs is the number of runners using the worker. Protected by pool.mu.
+	refs int
+	// discarded is set if the worker should not be used by any more runners.
+	// Protected by pool.mu.
+	discarded bool
+	// idleTimer removes the worker after it hasn't been used for a while.
+	// Protected by pool.mu.
+	idleTimer *time.Timer
+}
+
+// init creates the worker's workspace and container if they don't exist yet.
+func (mw *multiplexWorker) init(ctx context.Context, p *pool, props *platform.Properties, st *repb.ScheduledTask) (*workspace.Workspace, error) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	if mw.workspace != nil {
+		return mw.workspace, nil
+	}
+	ws, err := workspace.New(p.env, p.buildRoot, &workspace.Opts{})
+	if err != nil {
+		return nil, err
+	}
+	ctr, err := p.newContainer(ctx, props, st, ws.Path())
+	if err != nil {
+		if err := ws.Remove(ctx); err != nil {
+			log.CtxWarningf(ctx, "Failed to remove multiplex worker workspace: %s", err)
+		}
+		return nil, err
+	}
+	mw.workspace = ws
+	mw.container = ctr
+	return ws, nil
+}
+
+// start creates the worker's container and starts the worker process if this
+// hasn't been done yet.
+func (mw *multiplexWorker) start(ctx context.Context, env environment.Env, props *platform.Properties, command *repb.Command) (*persistentworker.Worker, error) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	if mw.worker != nil {
+		return mw.worker, nil
+	}
+	creds, err := oci.CredentialsFromProperties(props)
+	if err != nil {
+		return nil, err
+	}
+	if err := container.PullImageIfNecessary(ctx, env, mw.container, creds, props.ContainerImage); err != nil {
+		return nil, status.UnavailableErrorf("Error pulling container: %s", err)
+	}
+	if err := mw.container.Create(ctx, mw.workspace.Path()); err != nil {
+		return nil, err
+	}
+	log.CtxInfof(ctx, "Starting multiplex persistent worker")
+	mw.worker = persistentworker.Start(env.GetServerContext(), mw.workspace, mw.container, props.PersistentWorkerProtocol, true /*=multiplex*/, props.PersistentWorkerCancellation, command)
+	return mw.worker, nil
+}
+
+// remove stops the worker and removes its container and workspace.
+func (mw *multiplexWorker) remove(ctx context.Context) error {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	errs := []error{}
+	if mw.worker != nil {
+		if err := mw.worker.Stop(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if mw.container != nil {
+		if err := mw.container.Remove(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if mw.workspace != nil {
+		if err := mw.workspace.Remove(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errSlice(errs)
+	}
+	return nil
+}
+
 func (r *taskRunner) UploadOutputs(ctx context.Context, ioStats *repb.IOStats, executeResponse *repb.ExecuteResponse, cmdResult *interfaces.CommandResult) error {
 	txInfo, err := r.Workspace.UploadOutputs(ctx, r.task.Command, executeResponse, cmdResult)
 	if err != nil {
@@ -483,7 +659,11 @@ func (r *taskRunner) Remove(ctx context.Context) error {
 			errs = append(errs, err)
 		}
 	}
-	if err := r.Container.Remove(ctx); err != nil {
+	if r.multiplexWorker != nil {
+		// The container belongs to the multiplex worker, which is removed
+		// once it is no longer used by any runners.
+		defer r.p.releaseMultiplexWorker(r.multiplexWorker)
+	} else if err := r.Container.Remove(ctx); err != nil {
 		errs = append(errs, err)
 	}
 	if err := r.Workspace.Remove(ctx); err != nil {
@@ -560,10 +740,16 @@ type pool struct {
 	// pendingRemovals keeps track of which runners are pending removal.
 	pendingRemovals sync.WaitGroup
 
-	mu             sync.RWMutex // protects(isShuttingDown), protects(runners)
+	mu             sync.RWMutex // protects(isShuttingDown), protects(isDraining), protects(runners), protects(multiplexWorkers)
 	isShuttingDown bool
+	// isDraining is set while the executor is draining, in which case runners
+	// are not recycled.
+	isDraining bool
 	// runners holds all runners managed by the pool.
 	runners []*taskRunner
+	// multiplexWorkers holds the multiplex persistent workers that can be
+	// used by new runners, keyed by serialized runner key.
+	multiplexWorkers map[string]*multiplexWorker
 }
 
 func NewPool(env environment.Env, cacheRoot string, opts *PoolOptions) (*pool, error) {
@@ -583,6 +769,8 @@ func NewPool(env environment.Env, cacheRoot string, opts *PoolOptions) (*pool, e
 		cacheRoot:    cacheRoot,
 		cgroupParent: opts.CgroupParent,
 		runners:      []*taskRunner{},
+
+		multiplexWorkers: map[string]*multiplexWorker{},
 	}
 	if err := os.MkdirAll(p.buildRoot, fs.FileMode(0755)); err != nil {
 		return nil, status.InternalErrorf("Failed to create build root directory %q: %s", p.buildRoot, err)
@@ -642,6 +830,12 @@ func (p *pool) checkAddPreconditions(r *taskRunner) *labeledError {
 			"pool_shutting_down",
 		}
 	}
+	if p.isDraining {
+		return &labeledError{
+			status.UnavailableError("pool is draining; new runners cannot be added."),
+			"pool_draining",
+		}
+	}
 	// Note: shutdown can change the state to removed, so we need the lock to be
 	// held for this check.
 	if r.state != ready {
@@ -706,10 +900,10 @@ func (p *pool) add(ctx context.Context, r *taskRunner) *labeledError {
 
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	// The pool might have shut down while we were pausing the container. We don't
-	// hold the lock while pausing since it is relatively slow, so need to re-check
-	// whether the pool shut down here.
-	if p.isShuttingDown {
+	// The pool might have shut down or started draining while we were pausing
+	// the container. We don't hold the lock while pausing since it is
+	// relatively slow, so need to re-check whether the pool shut down here.
+	if p.isShuttingDown || p.isDraining {
 		r.RemoveInBackground(ctx)
 		return nil
 	}
@@ -959,7 +1153,7 @@ func (p *pool) Get(ctx context.Context, st *repb.ScheduledTask) (interfaces.Runn
 				`(recycling was requested via platform property "recycle-runner=true")`)
 	}
 
-	persistentWorkerKey, _ := persistentworker.Key(props, task.GetCommand().GetArguments())
+	persistentWorkerKey, isPersistentWorker := persistentworker.Key(props, task.GetCommand().GetArguments())
 	key := &rnpb.RunnerKey{
 		GroupId:             groupID,
 		InstanceName:        task.GetExecuteRequest().GetInstanceName(),
@@ -967,6 +1161,13 @@ func (p *pool) Get(ctx context.Context, st *repb.ScheduledTask) (interfaces.Runn
 		PersistentWorkerKey: persistentWorkerKey,
 	}
 
+	// Multiplex workers need their sandbox directories to be visible inside
+	// of the worker's container, which isn't the case for firecracker VMs.
+	if props.RecycleRunner && isPersistentWorker && props.PersistentWorkerMultiplex &&
+		platform.ContainerType(props.WorkloadIsolationType) != platform.FirecrackerContainerType {
+		return p.newMultiplexRunner(ctx, key, props, st)
+	}
+
 	// If snapshot sharing is enabled, a firecracker VM can be cloned from the
 	// cache and does not rely on previous state set on the runner, so we can
 	// circumvent the runner pool. In fact we *should* circumvent the runner pool
@@ -1057,6 +1258,139 @@ func (p *pool) newRunner(ctx context.Context, key *rnpb.RunnerKey, props *platfo
 	return r, nil
 }
 
+// newMultiplexRunner creates a runner that sends its task to the multiplex
+// persistent worker for the given runner key, starting a new worker if there
+// is none. The runner's workspace is a new sandbox directory inside of the
+// worker's workspace, and is removed along with the runner once the task is
+// complete.
+func (p *pool) newMultiplexRunner(ctx context.Context, key *rnpb.RunnerKey, props *platform.Properties, st *repb.ScheduledTask) (*taskRunner, error) {
+	mw, err := p.acquireMultiplexWorker(key)
+	if err != nil {
+		return nil, err
+	}
+	workerWorkspace, err := mw.init(ctx, p, props, st)
+	if err != nil {
+		p.discardMultiplexWorker(mw)
+		p.releaseMultiplexWorker(mw)
+		return nil, err
+	}
+	ws, err := workspace.New(p.env, workerWorkspace.Path(), &workspace.Opts{})
+	if err != nil {
+		p.releaseMultiplexWorker(mw)
+		return nil, err
+	}
+	debugID, _ := random.RandomString(8)
+	r := &taskRunner{
+		env:                p.env,
+		p:                  p,
+		key:                key,
+		debugID:            debugID,
+		taskNumber:         1,
+		task:               st.GetExecutionTask(),
+		PlatformProperties: props,
+		Container:          mw.container,
+		Workspace:          ws,
+		multiplexWorker:    mw,
+	}
+
+	p.mu.Lock()
+	if p.isShuttingDown {
+		p.mu.Unlock()
+		if err := ws.Remove(ctx); err != nil {
+			log.CtxWarningf(ctx, "Failed to remove multiplex worker sandbox: %s", err)
+		}
+		p.releaseMultiplexWorker(mw)
+		return nil, status.UnavailableErrorf("Could not get a new task runner because the executor is shutting down.")
+	}
+	p.runners = append(p.runners, r)
+	p.pendingRemovals.Add(1)
+	r.removeCallback = func() {
+		p.pendingRemovals.Done()
+	}
+	p.mu.Unlock()
+	log.CtxInfof(ctx, "Created new multiplex worker %s runner %s for task", props.WorkloadIsolationType, r)
+	return r, nil
+}
+
+// acquireMultiplexWorker returns the multiplex worker for the given runner key,
+// creating it if it doesn't exist, and adds a reference to it which must be
+// released using releaseMultiplexWorker.
+func (p *pool) acquireMultiplexWorker(key *rnpb.RunnerKey) (*multiplexWorker, error) {
+	keyBytes, err := proto.Marshal(key)
+	if err != nil {
+		return nil, status.InternalErrorf("marshal runner key: %s", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.isShuttingDown {
+		return nil, status.UnavailableErrorf("Could not get a new task runner because the executor is shutting down.")
+	}
+	mw := p.multiplexWorkers[string(keyBytes)]
+	if mw == nil {
+		mw = &multiplexWorker{key: string(keyBytes)}
+		p.multiplexWorkers[mw.key] = mw
+		p.pendingRemovals.Add(1)
+	}
+	mw.refs++
+	if mw.idleTimer != nil {
+		mw.idleTimer.Stop()
+		mw.idleTimer = nil
+	}
+	return mw, nil
+}
+
+// releaseMultiplexWorker releases a reference to a multiplex worker. Once the
+// worker is no longer referenced, it is removed after the idle timeout, or
+// immediately if it was discarded or the pool is shutting down or draining.
+func (p *pool) releaseMultiplexWorker(mw *multiplexWorker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	mw.refs--
+	if mw.refs > 0 {
+		return
+	}
+	if mw.discarded || p.isShuttingDown || p.isDraining {
+		p.removeMultiplexWorkerLocked(mw)
+		return
+	}
+	mw.idleTimer = time.AfterFunc(*multiplexWorkerIdleTimeout, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		// The worker may have been acquired again after the timer fired.
+		if mw.refs > 0 || p.multiplexWorkers[mw.key] != mw {
+			return
+		}
+		p.removeMultiplexWorkerLocked(mw)
+	})
+}
+
+// discardMultiplexWorker prevents new runners from using a multiplex worker,
+// e.g. because the worker process exited.
+func (p *pool) discardMultiplexWorker(mw *multiplexWorker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	mw.discarded = true
+	if p.multiplexWorkers[mw.key] == mw {
+		delete(p.multiplexWorkers, mw.key)
+	}
+}
+
+// removeMultiplexWorkerLocked removes an unreferenced multiplex worker in the
+// background. p.mu must be held.
+func (p *pool) removeMultiplexWorkerLocked(mw *multiplexWorker) {
+	if p.multiplexWorkers[mw.key] == mw {
+		delete(p.multiplexWorkers, mw.key)
+	}
+	go func() {
+		defer p.pendingRemovals.Done()
+		ctx, cancel := background.ExtendContextForFinalization(p.env.GetServerContext(), runnerCleanupTimeout)
+		defer cancel()
+		if err := mw.remove(ctx); err != nil {
+			log.Errorf("Failed to remove multiplex persistent worker: %s", err)
+		}
+	}()
+}
+
 func (p *pool) newContainer(ctx context.Context, props *platform.Properties, task *repb.ScheduledTask, workingDir string) (*container.TracedCommandContainer, error) {
 	args := &container.Init{
 		Props:        props,
@@ -1245,10 +1579,41 @@ func (p *pool) pausedRunnerMemoryUsageBytes() int64 {
 func (p *pool) Shutdown(ctx context.Context) error {
 	p.mu.Lock()
 	p.isShuttingDown = true
-	var runnersToRemove []*taskRunner
-	// Remove only paused runners, since active runners should be removed only
-	// after their currently assigned task is canceled due to the shutdown
-	// grace period expiring.
+	runnersToRemove := p.takePausedRunnersLocked()
+	p.mu.Unlock()
+
+	if errs := removeRunners(ctx, runnersToRemove); len(errs) > 0 {
+		return status.InternalErrorf("failed to shut down runner pool: %s", errSlice(errs))
+	}
+	return nil
+}
+
+// Drain removes all paused runners from the pool and prevents runners from
+// being recycled until Undrain is called.
+func (p *pool) Drain(ctx context.Context) error {
+	p.mu.Lock()
+	p.isDraining = true
+	runnersToRemove := p.takePausedRunnersLocked()
+	p.mu.Unlock()
+
+	if errs := removeRunners(ctx, runnersToRemove); len(errs) > 0 {
+		return status.InternalErrorf("failed to drain runner pool: %s", errSlice(errs))
+	}
+	return nil
+}
+
+// Undrain allows runners to be recycled again after a call to Drain.
+func (p *pool) Undrain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.isDraining = false
+}
+
+// takePausedRunnersLocked removes the paused runners from the pool and returns
+// them, and removes idle multiplex workers in the background. Active runners
+// are left in the pool, since they should be removed only after their
+// currently assigned task completes. p.mu must be held.
+func (p *pool) takePausedRunnersLocked() []*taskRunner {
 	var pausedRunners, activeRunners []*taskRunner
 	for _, r := range p.runners {
 		if r.state == paused {
@@ -1257,13 +1622,26 @@ func (p *pool) Shutdown(ctx context.Context) error {
 			activeRunners = append(activeRunners, r)
 		}
 	}
-	runnersToRemove = pausedRunners
 	p.runners = activeRunners
-	if len(runnersToRemove) > 0 {
-		log.Infof("Runner pool: removing %s", runnerSlice(runnersToRemove))
+	if len(pausedRunners) > 0 {
+		log.Infof("Runner pool: removing %s", runnerSlice(pausedRunners))
+	}
+	// Remove idle multiplex workers. The others are removed once the active
+	// runners using them are removed.
+	for _, mw := range p.multiplexWorkers {
+		if mw.refs == 0 {
+			if mw.idleTimer != nil {
+				mw.idleTimer.Stop()
+			}
+			p.removeMultiplexWorkerLocked(mw)
+		}
 	}
-	p.mu.Unlock()
+	return pausedRunners
+}
 
+// removeRunners removes the given runners and returns any errors that
+// occurred.
+func removeRunners(ctx context.Context, runnersToRemove []*taskRunner) []error {
 	removeResults := make(chan error)
 	for _, r := range runnersToRemove {
 		// Remove runners in parallel, since each deletion is blocked on uploads
@@ -1283,10 +1661,7 @@ func (p *pool) Shutdown(ctx context.Context) error {
 			errs = append(errs, err)
 		}
 	}
-	if len(errs) > 0 {
-		return status.InternalErrorf("failed to shut down runner pool: %s", errSlice(errs))
-	}
-	return nil
+	return errs
 }
 
 func (p *pool) Wait() {
@@ -1332,7 +1707,10 @@ func (p *pool) TryRecycle(ctx context.Context, r interfaces.Runner, finishedClea
 		}
 	}()
 
-	if !cr.PlatformProperties.RecycleRunner {
+	// Multiplex worker runners are not recycled, since their workspace is a
+	// sandbox directory for a single task. The worker itself is kept alive
+	// for subsequent tasks.
+	if !cr.PlatformProperties.RecycleRunner || cr.multiplexWorker != nil {
 		return
 	}
 	if !finishedCleanly || cr.doNotReuse {
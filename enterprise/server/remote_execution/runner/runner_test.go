@@ -1,6 +1,7 @@
 package runner
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/binary"
@@ -91,7 +92,7 @@ func (c *fakeContainer) IsolationType() string {
 	return c.Isolation
 }
 
-func (c *fakeContainer) Run(ctx context.Context, cmd *repb.Command, workdir string, creds oci.Credentials) *interfaces.CommandResult {
+func (c *fakeContainer) Run(ctx context.Context, cmd *repb.Command, workdir string, creds oci.Credentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	return c.Result
 }
 
@@ -208,7 +209,7 @@ func withAuthenticatedUser(t *testing.T, ctx context.Context, env *testenv.TestE
 }
 
 func mustRun(t *testing.T, r *taskRunner) {
-	res := r.Run(context.Background(), &repb.IOStats{})
+	res := r.Run(context.Background(), &repb.IOStats{}, nil /*=liveOutput*/)
 	require.NoError(t, res.Error)
 }
 
@@ -400,6 +401,32 @@ func TestRunnerPool_Shutdown_RemovesPausedRunners(t *testing.T) {
 	assert.Equal(t, 0, pool.ActiveRunnerCount())
 }
 
+func TestRunnerPool_Drain(t *testing.T) {
+	env := newTestEnv(t)
+	pool := newRunnerPool(t, env, noLimitsCfg())
+	ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+
+	r1 := mustGetNewRunner(t, ctx, pool, newTask())
+	r2 := mustGetNewRunner(t, ctx, pool, newTask())
+	mustAdd(t, ctx, pool, r1)
+
+	err := pool.Drain(context.Background())
+
+	require.NoError(t, err)
+	assert.Equal(t, 0, pool.PausedRunnerCount())
+	assert.Equal(t, 1, pool.ActiveRunnerCount())
+
+	// Runners can't be recycled while draining.
+	err = pool.Add(ctx, r2)
+	assert.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+	assert.Equal(t, 0, pool.PausedRunnerCount())
+
+	pool.Undrain()
+	r3 := mustGetNewRunner(t, ctx, pool, newTask())
+	mustAdd(t, ctx, pool, r3)
+	assert.Equal(t, 1, pool.PausedRunnerCount())
+}
+
 func TestRunnerPool_Shutdown_RunnersReturnRetriableOrNilError(t *testing.T) {
 	env := newTestEnv(t)
 	ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
@@ -420,7 +447,7 @@ func TestRunnerPool_Shutdown_RunnersReturnRetriableOrNilError(t *testing.T) {
 			// Random delay to simulate downloading inputs
 			sleepRandMicros(10)
 			tasksStarted <- struct{}{}
-			if result := r.Run(ctx, &repb.IOStats{}); result.Error != nil {
+			if result := r.Run(ctx, &repb.IOStats{}, nil /*=liveOutput*/); result.Error != nil {
 				return result.Error
 			}
 			// Random delay to simulate uploading outputs
@@ -749,7 +776,7 @@ func TestRunnerPool_PersistentWorker(t *testing.T) {
 
 			r, err := pool.Get(ctx, newPersistentRunnerTask(t, "abc", "", testCase.protocol, resp))
 			require.NoError(t, err)
-			res := r.Run(ctx, &repb.IOStats{})
+			res := r.Run(ctx, &repb.IOStats{}, nil /*=liveOutput*/)
 			require.NoError(t, res.Error)
 			assert.Equal(t, 0, res.ExitCode)
 			assert.Equal(t, []byte(resp.Output), res.Stderr)
@@ -764,7 +791,7 @@ func TestRunnerPool_PersistentWorker(t *testing.T) {
 
 			r, err := pool.Get(ctx, newPersistentRunnerTask(t, "abc", "", testCase.protocol, resp))
 			require.NoError(t, err)
-			res := r.Run(ctx, &repb.IOStats{})
+			res := r.Run(ctx, &repb.IOStats{}, nil /*=liveOutput*/)
 			require.NoError(t, res.Error)
 			assert.Equal(t, 0, res.ExitCode)
 			assert.Equal(t, []byte(resp.Output), res.Stderr)
@@ -779,7 +806,7 @@ func TestRunnerPool_PersistentWorker(t *testing.T) {
 
 			r, err := pool.Get(ctx, newPersistentRunnerTask(t, "def", "", testCase.protocol, resp))
 			require.NoError(t, err)
-			res := r.Run(ctx, &repb.IOStats{})
+			res := r.Run(ctx, &repb.IOStats{}, nil /*=liveOutput*/)
 			require.NoError(t, res.Error)
 			assert.Equal(t, 0, res.ExitCode)
 			assert.Equal(t, []byte(resp.Output), res.Stderr)
@@ -801,7 +828,7 @@ func TestRunnerPool_PersistentWorkerUnknownProtocol(t *testing.T) {
 	// Make a new persistent worker
 	r, err := pool.Get(ctx, newPersistentRunnerTask(t, "abc", "", "unknown", resp))
 	require.NoError(t, err)
-	res := r.Run(context.Background(), &repb.IOStats{})
+	res := r.Run(context.Background(), &repb.IOStats{}, nil /*=liveOutput*/)
 	require.Error(t, res.Error)
 }
 
@@ -813,7 +840,7 @@ func TestRunnerPool_PersistentWorker_UnknownFlagFileError(t *testing.T) {
 	// Persistent worker with unknown flagfile
 	r, err := pool.Get(ctx, newPersistentRunnerTask(t, "abc", "@flagfile", "", &wkpb.WorkResponse{}))
 	require.NoError(t, err)
-	res := r.Run(context.Background(), &repb.IOStats{})
+	res := r.Run(context.Background(), &repb.IOStats{}, nil /*=liveOutput*/)
 	require.Error(t, res.Error)
 
 	// Make sure that after the error, trying to recycle doesn't put the worker
@@ -830,7 +857,7 @@ func TestRunnerPool_PersistentWorker_Crash_ShowsWorkerStderrInOutput(t *testing.
 	// Persistent worker with runner that crashes
 	r, err := pool.Get(ctx, newPersistentRunnerTask(t, "abc", "--fail_with_stderr=TestStderrMessage", "", &wkpb.WorkResponse{}))
 	require.NoError(t, err)
-	res := r.Run(context.Background(), &repb.IOStats{})
+	res := r.Run(context.Background(), &repb.IOStats{}, nil /*=liveOutput*/)
 	require.Error(t, res.Error)
 	assert.Contains(t, res.Error.Error(), "persistent worker stderr:", res.Error.Error())
 	assert.Contains(t, res.Error.Error(), "TestStderrMessage")
@@ -839,6 +866,138 @@ func TestRunnerPool_PersistentWorker_Crash_ShowsWorkerStderrInOutput(t *testing.
 	assert.Equal(t, 0, pool.PausedRunnerCount())
 }
 
+func newMultiplexRunnerTask(t *testing.T, cancellation bool) *repb.ScheduledTask {
+	workerPath := testfs.RunfilePath(t, testworkerRunfilePath)
+	task := &repb.ExecutionTask{
+		Command: &repb.Command{
+			Arguments: []string{workerPath, "--multiplex", "@flags"},
+			Platform: &repb.Platform{
+				Properties: []*repb.Platform_Property{
+					{Name: "persistentWorkerKey", Value: "abc"},
+					{Name: "supports-multiplex-workers", Value: "true"},
+					{Name: "supports-worker-cancellation", Value: fmt.Sprint(cancellation)},
+					{Name: platform.RecycleRunnerPropertyName, Value: "true"},
+				},
+			},
+		},
+	}
+	return &repb.ScheduledTask{ExecutionTask: task}
+}
+
+func getMultiplexRunner(t *testing.T, ctx context.Context, pool *pool, cancellation bool, flagFileContents, input string) *taskRunner {
+	r, err := get(ctx, pool, newMultiplexRunnerTask(t, cancellation))
+	require.NoError(t, err)
+	testfs.WriteAllFileContents(t, r.Workspace.Path(), map[string]string{
+		"flags":     flagFileContents,
+		"input.txt": input,
+	})
+	return r
+}
+
+func TestRunnerPool_PersistentWorker_Multiplex(t *testing.T) {
+	env := newTestEnv(t)
+	pool := newRunnerPool(t, env, noLimitsCfg())
+	ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+
+	// Send a request that waits to be canceled, and run other tasks while it
+	// is in flight.
+	waitingRunner := getMultiplexRunner(t, ctx, pool, true /*=cancellation*/, "--wait_for_cancel", "")
+	waitingCtx, cancel := context.WithCancel(ctx)
+	waitingResult := make(chan *interfaces.CommandResult, 1)
+	go func() {
+		waitingResult <- waitingRunner.Run(waitingCtx, &repb.IOStats{}, nil /*=liveOutput*/)
+	}()
+
+	for i := range 3 {
+		r := getMultiplexRunner(t, ctx, pool, true /*=cancellation*/, "", fmt.Sprintf("input-%d", i))
+		// All of the runners should share the same worker, with a separate
+		// sandbox directory for each task.
+		require.Same(t, waitingRunner.multiplexWorker, r.multiplexWorker)
+		require.NotEqual(t, waitingRunner.Workspace.Path(), r.Workspace.Path())
+
+		res := r.Run(ctx, &repb.IOStats{}, nil /*=liveOutput*/)
+		require.NoError(t, res.Error)
+		assert.Equal(t, 0, res.ExitCode)
+		assert.Equal(t, fmt.Sprintf("input-%d", i), string(res.Stderr))
+		pool.TryRecycle(ctx, r, true)
+		// Multiplex runners are not added to the pool.
+		assert.Equal(t, 0, pool.PausedRunnerCount())
+	}
+
+	cancel()
+	res := <-waitingResult
+	require.True(t, status.IsCanceledError(res.Error), "expected Canceled error, got %v", res.Error)
+	pool.TryRecycle(ctx, waitingRunner, false)
+
+	// The worker should still be usable after a request was canceled.
+	r := getMultiplexRunner(t, ctx, pool, true /*=cancellation*/, "", "input-after-cancel")
+	require.Same(t, waitingRunner.multiplexWorker, r.multiplexWorker)
+	res = r.Run(ctx, &repb.IOStats{}, nil /*=liveOutput*/)
+	require.NoError(t, res.Error)
+	assert.Equal(t, "input-after-cancel", string(res.Stderr))
+	pool.TryRecycle(ctx, r, true)
+}
+
+func TestRunnerPool_PersistentWorker_Multiplex_NoCancellation(t *testing.T) {
+	env := newTestEnv(t)
+	pool := newRunnerPool(t, env, noLimitsCfg())
+	ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+
+	// The worker doesn't support cancellation, so it never responds to the
+	// waiting request.
+	waitingRunner := getMultiplexRunner(t, ctx, pool, false /*=cancellation*/, "--wait_for_cancel", "")
+	waitingCtx, cancel := context.WithCancel(ctx)
+	waitingResult := make(chan *interfaces.CommandResult, 1)
+	go func() {
+		waitingResult <- waitingRunner.Run(waitingCtx, &repb.IOStats{}, nil /*=liveOutput*/)
+	}()
+
+	// Other tasks can still share the worker while the request is in flight.
+	r := getMultiplexRunner(t, ctx, pool, false /*=cancellation*/, "", "input")
+	require.Same(t, waitingRunner.multiplexWorker, r.multiplexWorker)
+	res := r.Run(ctx, &repb.IOStats{}, nil /*=liveOutput*/)
+	require.NoError(t, res.Error)
+	assert.Equal(t, "input", string(res.Stderr))
+	pool.TryRecycle(ctx, r, true)
+
+	cancel()
+	res = <-waitingResult
+	require.True(t, status.IsCanceledError(res.Error), "expected Canceled error, got %v", res.Error)
+	pool.TryRecycle(ctx, waitingRunner, false)
+
+	// The worker may still be working on the abandoned request, so subsequent
+	// tasks should get a new worker.
+	r = getMultiplexRunner(t, ctx, pool, false /*=cancellation*/, "", "input-after-cancel")
+	require.NotSame(t, waitingRunner.multiplexWorker, r.multiplexWorker)
+	res = r.Run(ctx, &repb.IOStats{}, nil /*=liveOutput*/)
+	require.NoError(t, res.Error)
+	assert.Equal(t, "input-after-cancel", string(res.Stderr))
+	pool.TryRecycle(ctx, r, true)
+}
+
+func TestRunnerPool_PersistentWorker_Multiplex_GracefulTerminateCancelsRequest(t *testing.T) {
+	env := newTestEnv(t)
+	pool := newRunnerPool(t, env, noLimitsCfg())
+	ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+
+	r := getMultiplexRunner(t, ctx, pool, true /*=cancellation*/, "--wait_for_cancel", "")
+	result := make(chan *interfaces.CommandResult, 1)
+	go func() {
+		result <- r.Run(ctx, &repb.IOStats{}, nil /*=liveOutput*/)
+	}()
+	// Keep requesting termination until the request is in flight.
+	for {
+		require.NoError(t, r.GracefulTerminate(ctx))
+		select {
+		case res := <-result:
+			require.True(t, status.IsCanceledError(res.Error), "expected Canceled error, got %v", res.Error)
+			pool.TryRecycle(ctx, r, false)
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
 func TestRunnerPool_RecycleAfterCreateFailed_CallsRemove(t *testing.T) {
 	env := newTestEnv(t)
 	cfg := noLimitsCfg()
@@ -858,7 +1017,7 @@ func TestRunnerPool_RecycleAfterCreateFailed_CallsRemove(t *testing.T) {
 	require.NoError(t, err)
 	// Try running a task; Create() should fail with our fixed error, and be
 	// surfaced in the command result.
-	res := r.Run(ctx, &repb.IOStats{})
+	res := r.Run(ctx, &repb.IOStats{}, nil /*=liveOutput*/)
 	require.Equal(t, fakeCreateError, res.Error)
 	pool.TryRecycle(ctx, r, false /*=finishedCleanly*/)
 	// Remove should be called, closing this channel.
@@ -879,13 +1038,36 @@ func TestDoNotRecycleSpecialFile(t *testing.T) {
 			}
 			r, err := pool.Get(ctx, task)
 			require.NoError(t, err)
-			res := r.Run(ctx, &repb.IOStats{})
+			res := r.Run(ctx, &repb.IOStats{}, nil /*=liveOutput*/)
 			assert.Equal(t, createFile, res.DoNotRecycle)
 			pool.TryRecycle(ctx, r, false)
 		})
 	}
 }
 
+func TestRunnerPool_LiveOutput(t *testing.T) {
+	env := newTestEnv(t)
+	pool := newRunnerPool(t, env, noLimitsCfg())
+	ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+	task := newTask()
+	task.ExecutionTask.Command.Arguments = []string{
+		"sh", "-c", "echo hello && echo world >&2",
+	}
+	r, err := pool.Get(ctx, task)
+	require.NoError(t, err)
+
+	var stdout, stderr bytes.Buffer
+	res := r.Run(ctx, &repb.IOStats{}, &interfaces.Stdio{Stdout: &stdout, Stderr: &stderr})
+
+	require.NoError(t, res.Error)
+	assert.Equal(t, "hello\n", stdout.String())
+	assert.Equal(t, "world\n", stderr.String())
+	// The output should also be returned in the result.
+	assert.Equal(t, "hello\n", string(res.Stdout))
+	assert.Equal(t, "world\n", string(res.Stderr))
+	pool.TryRecycle(ctx, r, true /*=finishedCleanly*/)
+}
+
 func TestImagePullTimeout(t *testing.T) {
 	// Enable OCI isolation so we can pull images.
 	flags.Set(t, "executor.enable_oci", true)
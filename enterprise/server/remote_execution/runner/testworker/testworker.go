@@ -10,8 +10,14 @@ import (
 	"flag"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"sync"
 
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+
+	wkpb "github.com/buildbuddy-io/buildbuddy/proto/worker"
 )
 
 var (
@@ -20,6 +26,7 @@ var (
 	protocol       = flag.String("protocol", "proto", "Serialization protocol: 'json' or 'proto'.")
 	responseBase64 = flag.String("response_base64", "", "Base64-encoded response to return for every request. Includes varint length prefix (for proto responses).")
 	failWithStderr = flag.String("fail_with_stderr", "", "If non-empty, the worker will crash upon receiving the first request, printing the given message to stderr.")
+	multiplex      = flag.Bool("multiplex", false, "If true, the worker handles multiplex requests concurrently, responding with the contents of the input.txt file in each request's sandbox directory. Requests with a --wait_for_cancel argument are only responded to once they are canceled. Only supports the proto protocol.")
 )
 
 func main() {
@@ -29,6 +36,11 @@ func main() {
 		panic("Expected --persistent_worker flag, but was not set.")
 	}
 
+	if *multiplex {
+		serveMultiplex()
+		return
+	}
+
 	resBytes, err := base64.StdEncoding.DecodeString(*responseBase64)
 	if err != nil {
 		panic(err)
@@ -51,7 +63,7 @@ func main() {
 				panic(err)
 			}
 		} else {
-			if err := readProtoRequest(br); err != nil {
+			if _, err := readProtoRequest(br); err != nil {
 				panic(err)
 			}
 		}
@@ -73,19 +85,82 @@ func main() {
 	}
 }
 
-func readProtoRequest(r io.ByteReader) error {
+func serveMultiplex() {
+	br := bufio.NewReader(os.Stdin)
+
+	var mu sync.Mutex // protects(stdout), protects(canceled)
+	// canceled holds a channel for each request waiting to be canceled,
+	// which is closed when the request is canceled.
+	canceled := map[int32]chan struct{}{}
+	respond := func(rsp *wkpb.WorkResponse) {
+		b, err := proto.Marshal(rsp)
+		if err != nil {
+			panic(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := os.Stdout.Write(append(binary.AppendUvarint(nil, uint64(len(b))), b...)); err != nil {
+			panic(err)
+		}
+	}
+
+	for {
+		log.Info("[worker] Waiting for multiplex request...")
+		reqBytes, err := readProtoRequest(br)
+		if err != nil {
+			panic(err)
+		}
+		req := &wkpb.WorkRequest{}
+		if err := proto.Unmarshal(reqBytes, req); err != nil {
+			panic(err)
+		}
+		log.Infof("[worker] Got request %d (cancel: %t)", req.GetRequestId(), req.GetCancel())
+
+		mu.Lock()
+		if req.GetCancel() {
+			if ch, ok := canceled[req.GetRequestId()]; ok {
+				close(ch)
+				delete(canceled, req.GetRequestId())
+			}
+			mu.Unlock()
+			continue
+		}
+		var cancelCh chan struct{}
+		if slices.Contains(req.GetArguments(), "--wait_for_cancel") {
+			cancelCh = make(chan struct{})
+			canceled[req.GetRequestId()] = cancelCh
+		}
+		mu.Unlock()
+
+		go func() {
+			if cancelCh != nil {
+				<-cancelCh
+				respond(&wkpb.WorkResponse{RequestId: req.GetRequestId(), WasCancelled: true})
+				return
+			}
+			b, err := os.ReadFile(filepath.Join(req.GetSandboxDir(), "input.txt"))
+			if err != nil {
+				respond(&wkpb.WorkResponse{RequestId: req.GetRequestId(), ExitCode: 1, Output: err.Error()})
+				return
+			}
+			respond(&wkpb.WorkResponse{RequestId: req.GetRequestId(), Output: string(b)})
+		}()
+	}
+}
+
+func readProtoRequest(r io.ByteReader) ([]byte, error) {
 	reqSizeBytes, err := binary.ReadUvarint(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	reqBytes := make([]byte, reqSizeBytes)
 	for i := 0; i < int(reqSizeBytes); i++ {
 		reqBytes[i], err = r.ReadByte()
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-	return nil
+	return reqBytes, nil
 }
 
 func readJSONRequest(decoder *json.Decoder) error {
@@ -1,10 +1,13 @@
 package priority_task_scheduler
 
 import (
+	"cmp"
 	"container/list"
 	"context"
 	"flag"
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +25,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/priority_queue"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/rexec"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/tracing"
 	"github.com/buildbuddy-io/buildbuddy/server/util/usageutil"
@@ -30,6 +34,7 @@ import (
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
@@ -42,6 +47,17 @@ var (
 	queueTrimInterval       = flag.Duration("executor.queue_trim_interval", 0, "The interval between attempts to prune tasks that have already been completed by other executors.  A value <= 0 disables this feature.")
 	excessCapacityThreshold = flag.Float64("executor.excess_capacity_threshold", .40, "A percentage (of RAM and CPU) utilization below which this executor may request additional work")
 	region                  = flag.String("executor.region", "", "Region metadata associated with executions.")
+	preemptionPriorityGap   = flag.Int("executor.preemption_priority_gap", 0, "If positive, a task at the head of the queue which doesn't fit on the executor preempts running tasks whose priority is lower by at least this amount. Lower priority values mean higher priority, as in the remote execution API. Preempted tasks are re-enqueued without counting as a failed attempt. A value <= 0 disables preemption.")
+	preemptAcrossGroups     = flag.Bool("executor.preempt_across_groups", false, "If true, tasks may preempt the tasks of other groups. By default, tasks only preempt tasks from the same group, since each group sets its own priorities.")
+	maxPreemptionsPerTask   = flag.Int("executor.max_preemptions_per_task", 3, "Max number of times a task may be preempted. Tasks that have been preempted this many times are not preempted again.")
+)
+
+const (
+	// How long to wait before trying to claim a task again after its
+	// scheduling class was at its concurrency limit. The delay doubles with
+	// each failed attempt, up to the max.
+	minConcurrencyLimitRetryDelay = 1 * time.Second
+	maxConcurrencyLimitRetryDelay = 30 * time.Second
 )
 
 var shuttingDownLogOnce sync.Once
@@ -54,63 +70,118 @@ type QueuedTask struct {
 	WorkerQueuedTimestamp time.Time
 }
 
-type groupPriorityQueue struct {
-	*priority_queue.ThreadSafePriorityQueue[*QueuedTask]
+// activeTask is a task that has been dequeued and is being run.
+type activeTask struct {
+	*scpb.EnqueueTaskReservationRequest
+
+	// When the task was dequeued.
+	startTime time.Time
+	// Cancels the execution of the task with rexec.ErrPreempted. This is nil
+	// until the task has been leased and started executing.
+	preempt context.CancelCauseFunc
+	// Whether the task has been preempted.
+	preempted bool
+}
+
+// schedulingClass identifies a set of tasks that share executor capacity
+// fairly with the tasks in other classes. Tasks are classified by the group
+// that issued them and by their scheduling tag.
+type schedulingClass struct {
 	groupID string
+	tag     string
+}
+
+func schedulingClassOf(req *scpb.EnqueueTaskReservationRequest) schedulingClass {
+	return schedulingClass{
+		groupID: req.GetSchedulingMetadata().GetTaskGroupId(),
+		tag:     req.GetSchedulingMetadata().GetSchedulingTag(),
+	}
+}
+
+// classPriorityQueue holds the queued tasks in a scheduling class, ordered by
+// task priority.
+type classPriorityQueue struct {
+	*priority_queue.ThreadSafePriorityQueue[*QueuedTask]
+	class schedulingClass
+
+	// Fair-share weight and concurrency limit of the class. These are taken
+	// from the most recently enqueued task, so that configuration changes on
+	// the scheduler take effect without waiting for the queue to drain.
+	weight             float64
+	maxConcurrentTasks int64
+
+	// Virtual time of the class. Dequeuing a task advances the virtual time
+	// by 1/weight, and tasks are dequeued from the class with the lowest
+	// virtual time, so that classes are served in proportion to their
+	// weights.
+	pass float64
+}
+
+func (pq *classPriorityQueue) Clone() *classPriorityQueue {
+	clone := *pq
+	clone.ThreadSafePriorityQueue = pq.ThreadSafePriorityQueue.Clone()
+	return &clone
 }
 
-func (pq *groupPriorityQueue) Clone() *groupPriorityQueue {
-	return &groupPriorityQueue{
-		ThreadSafePriorityQueue: pq.ThreadSafePriorityQueue.Clone(),
-		groupID:                 pq.groupID,
+// update applies the scheduling class settings of a newly enqueued task.
+func (pq *classPriorityQueue) update(req *scpb.EnqueueTaskReservationRequest) {
+	pq.weight = req.GetSchedulingMetadata().GetSchedulingWeight()
+	if pq.weight <= 0 {
+		pq.weight = 1
 	}
+	pq.maxConcurrentTasks = req.GetSchedulingMetadata().GetMaxConcurrentTasks()
 }
 
 type taskQueueIterator struct {
 	q *taskQueue
-	// Global index across all group queues - ranges from 0 to q.Len()
-	i              int
+	// Number of tasks returned so far from each class queue.
+	numPopped map[*list.Element]int
+	// Virtual time of each class queue after the tasks returned so far.
+	passes         map[*list.Element]float64
 	current        *queuePosition
-	nextGroupQueue *list.Element
-	groupIterators map[*list.Element]*groupPriorityQueue
+	classIterators map[*list.Element]*classPriorityQueue
 }
 
 // Next returns the next task in the taskQueue, or nil if the iterator has
 // reached the end of the queue.
 func (t *taskQueueIterator) Next() *QueuedTask {
 	t.current = nil
-	if t.i >= t.q.Len() {
-		return nil
-	}
-	// Rotate through group queues until we find one that we haven't exhausted,
-	// then return the next task from that group queue.
-	for {
-		currentPQ := t.nextGroupQueue
-
-		// Rotate
-		t.nextGroupQueue = t.nextGroupQueue.Next()
-		if t.nextGroupQueue == nil {
-			t.nextGroupQueue = t.q.pqs.Front()
+	// Pick the class queue that would be dequeued from next if all of the
+	// tasks returned so far had been dequeued, then return the next task from
+	// that class queue.
+	el := t.q.selectClass(func(el *list.Element) (float64, bool) {
+		pq := el.Value.(*classPriorityQueue)
+		if t.numPopped[el] >= pq.Len() {
+			return 0, false
 		}
-
-		// Lazily copy the group queue.
-		if _, ok := t.groupIterators[currentPQ]; !ok {
-			t.groupIterators[currentPQ] = currentPQ.Value.(*groupPriorityQueue).Clone()
+		if pass, ok := t.passes[el]; ok {
+			return pass, true
 		}
+		return pq.pass, true
+	})
+	if el == nil {
+		return nil
+	}
+	pq := el.Value.(*classPriorityQueue)
 
-		// Pop from the iterator's copy of the group queue to get the next task
-		// in the iteration.
-		if groupIterator := t.groupIterators[currentPQ]; groupIterator.Len() > 0 {
-			numPopped := currentPQ.Value.(*groupPriorityQueue).Len() - groupIterator.Len()
-			t.current = &queuePosition{
-				GroupQueue: currentPQ,
-				Index:      numPopped,
-			}
-			t.i++
-			el, _ := groupIterator.Pop()
-			return el
-		}
+	// Lazily copy the class queue.
+	if _, ok := t.classIterators[el]; !ok {
+		t.classIterators[el] = pq.Clone()
 	}
+	t.current = &queuePosition{
+		ClassQueue: el,
+		Index:      t.numPopped[el],
+	}
+	if _, ok := t.passes[el]; !ok {
+		t.passes[el] = pq.pass
+	}
+	t.passes[el] += 1 / pq.weight
+	t.numPopped[el]++
+
+	// Pop from the iterator's copy of the class queue to get the next task in
+	// the iteration.
+	task, _ := t.classIterators[el].Pop()
+	return task
 }
 
 // Current returns the current iteration index as a reference to an element in
@@ -122,24 +193,33 @@ func (t *taskQueueIterator) Current() *queuePosition {
 
 type taskQueue struct {
 	clock clockwork.Clock
-	// List of *groupPriorityQueue items.
+	// List of *classPriorityQueue items, in the order in which the classes
+	// were added to the queue. Ties in virtual time are broken in favor of
+	// classes that were added earlier.
 	pqs *list.List
-	// Map to allow quick lookup of a specific *groupPriorityQueue element in the pqs list.
-	pqByGroupID map[string]*list.Element
-	// Map tracking all task IDs across all groups.
+	// Map to allow quick lookup of a specific *classPriorityQueue element in the pqs list.
+	pqByClass map[schedulingClass]*list.Element
+	// Map tracking all task IDs across all classes.
 	taskIDs map[string]struct{}
-	// The *groupPriorityQueue element from which the next task will be obtained.
-	// Will be nil when there are no tasks remaining.
-	currentPQ *list.Element
+	// Number of queued tasks for each group, for metrics.
+	queueLengthByGroup map[string]int
+	// Number of tasks in each class that were dequeued and are still running.
+	activeTasksByClass map[schedulingClass]int64
+	// Virtual time of the class queue that was most recently dequeued from.
+	// Newly added class queues start at this virtual time, so that they are
+	// served promptly, but don't get extra turns for the time that they spent
+	// with no queued tasks.
+	virtualTime float64
 }
 
 func newTaskQueue(clock clockwork.Clock) *taskQueue {
 	return &taskQueue{
-		clock:       clock,
-		pqs:         list.New(),
-		pqByGroupID: make(map[string]*list.Element),
-		currentPQ:   nil,
-		taskIDs:     make(map[string]struct{}),
+		clock:              clock,
+		pqs:                list.New(),
+		pqByClass:          make(map[schedulingClass]*list.Element),
+		taskIDs:            make(map[string]struct{}),
+		queueLengthByGroup: make(map[string]int),
+		activeTasksByClass: make(map[schedulingClass]int64),
 	}
 }
 
@@ -147,9 +227,9 @@ func (t *taskQueue) GetAll() []*scpb.EnqueueTaskReservationRequest {
 	reservations := make([]*scpb.EnqueueTaskReservationRequest, 0, len(t.taskIDs))
 
 	for e := t.pqs.Front(); e != nil; e = e.Next() {
-		pq, ok := e.Value.(*groupPriorityQueue)
+		pq, ok := e.Value.(*classPriorityQueue)
 		if !ok {
-			log.Error("not a *groupPriorityQueue!??!")
+			log.Error("not a *classPriorityQueue!??!")
 			continue
 		}
 		for _, t := range pq.GetAll() {
@@ -173,26 +253,24 @@ func (t *taskQueue) Enqueue(req *scpb.EnqueueTaskReservationRequest) (ok bool) {
 	if t.HasTask(req.GetTaskId()) {
 		return false
 	}
-	taskGroupID := req.GetSchedulingMetadata().GetTaskGroupId()
-	var pq *groupPriorityQueue
-	if el, ok := t.pqByGroupID[taskGroupID]; ok {
-		pq, ok = el.Value.(*groupPriorityQueue)
+	class := schedulingClassOf(req)
+	var pq *classPriorityQueue
+	if el, ok := t.pqByClass[class]; ok {
+		pq, ok = el.Value.(*classPriorityQueue)
 		if !ok {
 			// Why would this ever happen?
-			log.Error("not a *groupPriorityQueue!??!")
+			log.Error("not a *classPriorityQueue!??!")
 			return false
 		}
 	} else {
-		pq = &groupPriorityQueue{
+		pq = &classPriorityQueue{
 			ThreadSafePriorityQueue: priority_queue.New[*QueuedTask](),
-			groupID:                 taskGroupID,
-		}
-		el := t.pqs.PushBack(pq)
-		t.pqByGroupID[taskGroupID] = el
-		if t.currentPQ == nil {
-			t.currentPQ = el
+			class:                   class,
+			pass:                    t.virtualTime,
 		}
+		t.pqByClass[class] = t.pqs.PushBack(pq)
 	}
+	pq.update(req)
 	qt := &QueuedTask{
 		EnqueueTaskReservationRequest: req,
 		WorkerQueuedTimestamp:         enqueuedAt,
@@ -201,7 +279,8 @@ func (t *taskQueue) Enqueue(req *scpb.EnqueueTaskReservationRequest) (ok bool) {
 	// that tasks with lower priority values should be scheduled first.
 	pq.Push(qt, -float64(req.GetSchedulingMetadata().GetPriority()))
 	t.taskIDs[req.GetTaskId()] = struct{}{}
-	metrics.RemoteExecutionQueueLength.With(prometheus.Labels{metrics.GroupID: taskGroupID}).Set(float64(pq.Len()))
+	t.queueLengthByGroup[class.groupID]++
+	metrics.RemoteExecutionQueueLength.With(prometheus.Labels{metrics.GroupID: class.groupID}).Set(float64(t.queueLengthByGroup[class.groupID]))
 	if req.GetSchedulingMetadata().GetTrackQueuedTaskSize() {
 		metrics.RemoteExecutionAssignedOrQueuedEstimatedMilliCPU.
 			Add(float64(req.TaskSize.EstimatedMilliCpu))
@@ -212,36 +291,70 @@ func (t *taskQueue) Enqueue(req *scpb.EnqueueTaskReservationRequest) (ok bool) {
 	return true
 }
 
+// selectClass returns the class queue element with the lowest virtual time,
+// as returned by pass, among the class queues for which pass returns true.
+// Class queues which are at their concurrency limit are skipped.
+func (t *taskQueue) selectClass(pass func(el *list.Element) (float64, bool)) *list.Element {
+	var selected *list.Element
+	var selectedPass float64
+	for el := t.pqs.Front(); el != nil; el = el.Next() {
+		if t.atConcurrencyLimit(el.Value.(*classPriorityQueue)) {
+			continue
+		}
+		p, ok := pass(el)
+		if !ok {
+			continue
+		}
+		if selected == nil || p < selectedPass {
+			selected, selectedPass = el, p
+		}
+	}
+	return selected
+}
+
+// nextClass returns the class queue element from which the next task should
+// be dequeued, or nil if there are no tasks that can be dequeued.
+func (t *taskQueue) nextClass() *list.Element {
+	return t.selectClass(func(el *list.Element) (float64, bool) {
+		return el.Value.(*classPriorityQueue).pass, true
+	})
+}
+
+func (t *taskQueue) atConcurrencyLimit(pq *classPriorityQueue) bool {
+	return pq.maxConcurrentTasks > 0 && t.activeTasksByClass[pq.class] >= pq.maxConcurrentTasks
+}
+
 // headRef returns a reference to the current head of the task queue.
 func (t *taskQueue) headRef() *queuePosition {
-	if t.currentPQ == nil {
+	el := t.nextClass()
+	if el == nil {
 		return nil
 	}
 	return &queuePosition{
-		GroupQueue: t.currentPQ,
+		ClassQueue: el,
 		Index:      0,
 	}
 }
 
 // Dequeue removes the task at the head of the task queue and returns it.
 func (t *taskQueue) Dequeue() *QueuedTask {
-	if t.currentPQ == nil {
+	pos := t.headRef()
+	if pos == nil {
 		return nil
 	}
-	return t.DequeueAt(t.headRef())
+	return t.DequeueAt(pos)
 }
 
 // DequeueAt removes the task at the given pointer from the taskQueue and
 // returns it.
 //
-// For simplicity, the per-group queues are only rotated when popping from the
-// head of the taskQueue. If we are skipping past tasks that are currently only
-// blocked on custom resources, then we don't rotate to the next the
-// groupPriorityQueue. This is fine for now, because we don't support custom
-// resources in multi-tenant scenarios yet.
+// The task's class is charged for the task even if it is not at the head of
+// the taskQueue (e.g. when skipping past tasks that are currently only blocked
+// on custom resources), so that classes which can skip ahead don't get more
+// than their share of the executor.
 func (t *taskQueue) DequeueAt(pos *queuePosition) *QueuedTask {
-	// Remove from the group queue.
-	pq := pos.GroupQueue.Value.(*groupPriorityQueue)
+	// Remove from the class queue.
+	pq := pos.ClassQueue.Value.(*classPriorityQueue)
 	req, ok := pq.RemoveAt(pos.Index)
 	if !ok {
 		return nil
@@ -250,26 +363,22 @@ func (t *taskQueue) DequeueAt(pos *queuePosition) *QueuedTask {
 	// Remove the task ID from the set of all IDs.
 	delete(t.taskIDs, req.GetTaskId())
 
-	// Rotate to the next group queue but only if we're doing a normal dequeue,
-	// removing from the head of the taskQueue, as opposed to skipping ahead.
-	if pos.GroupQueue == t.currentPQ && pos.Index == 0 {
-		t.currentPQ = t.currentPQ.Next()
-		if t.currentPQ == nil {
-			t.currentPQ = t.pqs.Front()
-		}
-	}
+	// Advance the virtual time of the class.
+	t.virtualTime = max(t.virtualTime, pq.pass)
+	pq.pass += 1 / pq.weight
 
-	// Remove the group queue from the rotation if it's empty.
+	// Remove the class queue from the rotation if it's empty.
 	if pq.Len() == 0 {
-		t.pqs.Remove(pos.GroupQueue)
-		if t.pqs.Front() == nil {
-			// List is empty; clear currentPQ.
-			t.currentPQ = nil
-		}
-		delete(t.pqByGroupID, pq.groupID)
+		t.pqs.Remove(pos.ClassQueue)
+		delete(t.pqByClass, pq.class)
 	}
 
-	metrics.RemoteExecutionQueueLength.With(prometheus.Labels{metrics.GroupID: req.GetSchedulingMetadata().GetTaskGroupId()}).Set(float64(pq.Len()))
+	groupID := pq.class.groupID
+	t.queueLengthByGroup[groupID]--
+	metrics.RemoteExecutionQueueLength.With(prometheus.Labels{metrics.GroupID: groupID}).Set(float64(t.queueLengthByGroup[groupID]))
+	if t.queueLengthByGroup[groupID] <= 0 {
+		delete(t.queueLengthByGroup, groupID)
+	}
 	if req.GetSchedulingMetadata().GetTrackQueuedTaskSize() {
 		metrics.RemoteExecutionAssignedOrQueuedEstimatedMilliCPU.
 			Sub(float64(req.TaskSize.EstimatedMilliCpu))
@@ -279,14 +388,25 @@ func (t *taskQueue) DequeueAt(pos *queuePosition) *QueuedTask {
 	return req
 }
 
+// DequeueAll removes all tasks from the task queue, including tasks in classes
+// that are at their concurrency limit, and returns them.
+func (t *taskQueue) DequeueAll() []*QueuedTask {
+	var tasks []*QueuedTask
+	for el := t.pqs.Front(); el != nil; el = t.pqs.Front() {
+		tasks = append(tasks, t.DequeueAt(&queuePosition{ClassQueue: el, Index: 0}))
+	}
+	return tasks
+}
+
 func (t *taskQueue) Peek() *QueuedTask {
-	if t.currentPQ == nil {
+	el := t.nextClass()
+	if el == nil {
 		return nil
 	}
-	pq, ok := t.currentPQ.Value.(*groupPriorityQueue)
+	pq, ok := el.Value.(*classPriorityQueue)
 	if !ok {
 		// Why would this ever happen?
-		log.Error("not a *groupPriorityQueue!??!")
+		log.Error("not a *classPriorityQueue!??!")
 		return nil
 	}
 	v, _ := pq.Peek()
@@ -297,15 +417,17 @@ func (t *taskQueue) Peek() *QueuedTask {
 //
 // The iterator starts from the next task waiting to be scheduled, and iterates
 // across all tasks in the queue, in the same order in which they would normally
-// be dequeued.
+// be dequeued. Tasks in classes that are at their concurrency limit are
+// skipped.
 //
 // NOTE: while the iterator is in use, the task queue must be locked. Once the
 // task queue is unlocked, the caller cannot use the iterator again.
 func (t *taskQueue) Iterator() *taskQueueIterator {
 	return &taskQueueIterator{
 		q:              t,
-		nextGroupQueue: t.currentPQ,
-		groupIterators: make(map[*list.Element]*groupPriorityQueue, 0),
+		numPopped:      make(map[*list.Element]int),
+		passes:         make(map[*list.Element]float64),
+		classIterators: make(map[*list.Element]*classPriorityQueue, 0),
 	}
 }
 
@@ -318,6 +440,22 @@ func (t *taskQueue) HasTask(taskID string) bool {
 	return ok
 }
 
+// TaskStarted records that a task which was dequeued is running, which counts
+// against the concurrency limit of its class.
+func (t *taskQueue) TaskStarted(req *scpb.EnqueueTaskReservationRequest) {
+	t.activeTasksByClass[schedulingClassOf(req)]++
+}
+
+// TaskFinished records that a task which was passed to TaskStarted is no
+// longer running.
+func (t *taskQueue) TaskFinished(req *scpb.EnqueueTaskReservationRequest) {
+	class := schedulingClassOf(req)
+	t.activeTasksByClass[class]--
+	if t.activeTasksByClass[class] <= 0 {
+		delete(t.activeTasksByClass, class)
+	}
+}
+
 type Options struct {
 	RAMBytesCapacityOverride  int64
 	CPUMillisCapacityOverride int64
@@ -343,9 +481,13 @@ type PriorityTaskScheduler struct {
 	rootContext      context.Context
 	rootCancel       context.CancelFunc
 
+	// Held while the runner pool is being drained in the background, so that
+	// runner pool drains are applied in order.
+	runnerPoolDrainMu sync.Mutex
+
 	mu                      sync.Mutex
 	q                       *taskQueue
-	activeTaskCancelFuncs   map[*context.CancelFunc]struct{}
+	activeTasks             map[*context.CancelFunc]*activeTask
 	ramBytesCapacity        int64
 	ramBytesUsed            int64
 	cpuMillisCapacity       int64
@@ -353,6 +495,11 @@ type PriorityTaskScheduler struct {
 	customResourcesCapacity map[string]customResourceCount
 	customResourcesUsed     map[string]customResourceCount
 	exclusiveTaskScheduling bool
+	preemptionPriorityGap   int64
+	preemptAcrossGroups     bool
+	maxPreemptionsPerTask   int32
+	// When the executor started draining, or zero if it is not draining.
+	drainStartTime time.Time
 }
 
 func NewPriorityTaskScheduler(env environment.Env, exec IExecutor, runnerPool interfaces.RunnerPool, taskLeaser interfaces.TaskLeaser, options *Options) *PriorityTaskScheduler {
@@ -382,13 +529,16 @@ func NewPriorityTaskScheduler(env environment.Env, exec IExecutor, runnerPool in
 		checkQueueSignal:        make(chan struct{}, 64),
 		rootContext:             rootContext,
 		rootCancel:              rootCancel,
-		activeTaskCancelFuncs:   make(map[*context.CancelFunc]struct{}, 0),
+		activeTasks:             make(map[*context.CancelFunc]*activeTask, 0),
 		shuttingDown:            false,
 		ramBytesCapacity:        ramBytesCapacity,
 		cpuMillisCapacity:       cpuMillisCapacity,
 		customResourcesCapacity: customResourcesCapacity,
 		customResourcesUsed:     customResourcesUsed,
 		exclusiveTaskScheduling: *exclusiveTaskScheduling,
+		preemptionPriorityGap:   int64(*preemptionPriorityGap),
+		preemptAcrossGroups:     *preemptAcrossGroups,
+		maxPreemptionsPerTask:   int32(*maxPreemptionsPerTask),
 	}
 	qes.rootContext = qes.enrichContext(qes.rootContext)
 
@@ -459,7 +609,7 @@ func (q *PriorityTaskScheduler) Shutdown(ctx context.Context) error {
 	// Wait for all active tasks to finish.
 	for {
 		q.mu.Lock()
-		activeTasks := len(q.activeTaskCancelFuncs)
+		activeTasks := len(q.activeTasks)
 		q.mu.Unlock()
 		if activeTasks == 0 {
 			break
@@ -499,6 +649,13 @@ func (q *PriorityTaskScheduler) EnqueueTaskReservation(ctx context.Context, req
 
 	enqueueFn := func() {
 		q.mu.Lock()
+		if q.draining() {
+			q.mu.Unlock()
+			// The scheduler tracks unclaimed tasks, so the task will still be
+			// assigned to another executor.
+			log.CtxInfof(ctx, "Executor is draining, dropping task reservation %q", req.GetTaskId())
+			return
+		}
 		ok := q.q.Enqueue(req)
 		q.mu.Unlock()
 		if !ok {
@@ -551,7 +708,7 @@ func (q *PriorityTaskScheduler) publishOperation(ctx context.Context, executionI
 	return operation.Publish(ctx, q.env.GetRemoteExecutionClient(), executionID)
 }
 
-func (q *PriorityTaskScheduler) runTask(ctx context.Context, st *repb.ScheduledTask) (retry bool, err error) {
+func (q *PriorityTaskScheduler) runTask(ctx context.Context, st *repb.ScheduledTask, task *activeTask) (retry bool, err error) {
 	if q.env.GetRemoteExecutionClient() == nil {
 		return false, status.FailedPreconditionError("Execution client not configured")
 	}
@@ -571,8 +728,23 @@ func (q *PriorityTaskScheduler) runTask(ctx context.Context, st *repb.ScheduledT
 	// it too soon after establishing the clientStream, and remove this delay.
 	const closeStreamDelay = 10 * time.Millisecond
 
-	retry, executionError := q.exec.ExecuteTaskAndStreamResults(ctx, st, clientStream)
-	if executionError != nil {
+	// Execute the task with a context that is canceled if the task is
+	// preempted. The operation stream uses the parent context, so that it can
+	// still be closed cleanly after the task is preempted.
+	execCtx, preempt := context.WithCancelCause(ctx)
+	defer preempt(nil)
+	q.mu.Lock()
+	task.preempt = preempt
+	q.mu.Unlock()
+
+	retry, executionError := q.exec.ExecuteTaskAndStreamResults(execCtx, st, clientStream)
+	q.mu.Lock()
+	task.preempt = nil
+	q.mu.Unlock()
+	if executionError != nil && rexec.Preempted(execCtx) {
+		retry, executionError = true, rexec.ErrPreempted
+	}
+	if executionError != nil && !rexec.IsPreemptedError(executionError) {
 		log.CtxWarningf(ctx, "ExecuteTaskAndStreamResults error: %s", executionError)
 	}
 
@@ -588,8 +760,13 @@ func (q *PriorityTaskScheduler) runTask(ctx context.Context, st *repb.ScheduledT
 	return false, nil
 }
 
-func (q *PriorityTaskScheduler) trackTask(res *scpb.EnqueueTaskReservationRequest, cancel *context.CancelFunc) {
-	q.activeTaskCancelFuncs[cancel] = struct{}{}
+func (q *PriorityTaskScheduler) trackTask(res *scpb.EnqueueTaskReservationRequest, cancel *context.CancelFunc) *activeTask {
+	task := &activeTask{
+		EnqueueTaskReservationRequest: res,
+		startTime:                     q.clock.Now(),
+	}
+	q.activeTasks[cancel] = task
+	q.q.TaskStarted(res)
 	if size := res.GetTaskSize(); size != nil {
 		q.ramBytesUsed += size.GetEstimatedMemoryBytes()
 		q.cpuMillisUsed += size.GetEstimatedMilliCpu()
@@ -602,10 +779,12 @@ func (q *PriorityTaskScheduler) trackTask(res *scpb.EnqueueTaskReservationReques
 		metrics.RemoteExecutionAssignedMilliCPU.Set(float64(q.cpuMillisUsed))
 		log.CtxDebugf(q.rootContext, "Claimed task resources. Queue stats: %s", q.stats())
 	}
+	return task
 }
 
 func (q *PriorityTaskScheduler) untrackTask(res *scpb.EnqueueTaskReservationRequest, cancel *context.CancelFunc) {
-	delete(q.activeTaskCancelFuncs, cancel)
+	delete(q.activeTasks, cancel)
+	q.q.TaskFinished(res)
 	if size := res.GetTaskSize(); size != nil {
 		q.ramBytesUsed -= size.GetEstimatedMemoryBytes()
 		q.cpuMillisUsed -= size.GetEstimatedMilliCpu()
@@ -636,7 +815,7 @@ func (q *PriorityTaskScheduler) stats() string {
 		q.cpuMillisUsed, q.cpuMillisCapacity, cpuMillisRemaining,
 		q.ramBytesUsed, q.ramBytesCapacity, ramBytesRemaining,
 		customResourcesDesc,
-		len(q.activeTaskCancelFuncs), q.q.Len())
+		len(q.activeTasks), q.q.Len())
 }
 
 // canFitTask returns whether the task can fit on the executor, and whether the
@@ -644,26 +823,48 @@ func (q *PriorityTaskScheduler) stats() string {
 // Only tasks which _don't_ need custom resources may skip the task in this
 // case.
 func (q *PriorityTaskScheduler) canFitTask(res *QueuedTask) (canFit bool, isSkippable bool) {
+	return q.canFitTaskAfterReleasing(res, nil)
+}
+
+// canFitTaskAfterReleasing is like canFitTask, but assumes that the given
+// active tasks have finished and released their resources.
+func (q *PriorityTaskScheduler) canFitTaskAfterReleasing(res *QueuedTask, released []*activeTask) (canFit bool, isSkippable bool) {
+	ramBytesUsed := q.ramBytesUsed
+	cpuMillisUsed := q.cpuMillisUsed
+	customResourcesUsed := q.customResourcesUsed
+	if len(released) > 0 {
+		customResourcesUsed = maps.Clone(q.customResourcesUsed)
+		for _, t := range released {
+			ramBytesUsed -= t.GetTaskSize().GetEstimatedMemoryBytes()
+			cpuMillisUsed -= t.GetTaskSize().GetEstimatedMilliCpu()
+			for _, r := range t.GetTaskSize().GetCustomResources() {
+				if _, ok := customResourcesUsed[r.GetName()]; ok {
+					customResourcesUsed[r.GetName()] -= customResource(r.GetValue())
+				}
+			}
+		}
+	}
+
 	// If we're running in exclusiveTaskScheduling mode, only ever allow one
 	// task to run at a time. Otherwise fall through to the logic below.
-	if q.exclusiveTaskScheduling && len(q.activeTaskCancelFuncs) >= 1 {
+	if q.exclusiveTaskScheduling && len(q.activeTasks)-len(released) >= 1 {
 		return false, false
 	}
 
 	size := res.GetTaskSize()
 
-	availableRAM := q.ramBytesCapacity - q.ramBytesUsed
+	availableRAM := q.ramBytesCapacity - ramBytesUsed
 	if size.GetEstimatedMemoryBytes() > availableRAM {
 		return false, false
 	}
 
-	availableCPU := q.cpuMillisCapacity - q.cpuMillisUsed
+	availableCPU := q.cpuMillisCapacity - cpuMillisUsed
 	if size.GetEstimatedMilliCpu() > availableCPU {
 		return false, false
 	}
 
 	for _, r := range size.GetCustomResources() {
-		used, ok := q.customResourcesUsed[r.GetName()]
+		used, ok := customResourcesUsed[r.GetName()]
 		if !ok {
 			// The scheduler server should never send us tasks that require
 			// resources we haven't set up in the config.
@@ -688,6 +889,70 @@ func (q *PriorityTaskScheduler) canFitTask(res *QueuedTask) (canFit bool, isSkip
 	return true, false
 }
 
+// preemptTasksFor preempts running tasks to make room for the given queued
+// task, which doesn't fit on the executor. Only tasks whose priority is lower
+// than the queued task's priority by at least the preemption priority gap can
+// be preempted, and tasks are only preempted if that frees up enough resources
+// to run the queued task. Tasks from other groups and tasks that have already
+// been preempted the max number of times are not preempted. The lowest-priority
+// tasks are preempted first, and among tasks with the same priority, the most
+// recently started tasks are preempted first, since they have done the least
+// work.
+func (q *PriorityTaskScheduler) preemptTasksFor(task *QueuedTask) {
+	if q.preemptionPriorityGap <= 0 || task == nil {
+		return
+	}
+	priority := int64(task.GetSchedulingMetadata().GetPriority())
+	var preempted, candidates []*activeTask
+	for _, t := range q.activeTasks {
+		if t.preempted {
+			preempted = append(preempted, t)
+		} else if q.canPreempt(t, task) && int64(t.GetSchedulingMetadata().GetPriority())-priority >= q.preemptionPriorityGap {
+			candidates = append(candidates, t)
+		}
+	}
+	// If the tasks that were already preempted free up enough resources once
+	// they finish, then just wait for them to finish.
+	if canFit, _ := q.canFitTaskAfterReleasing(task, preempted); canFit {
+		return
+	}
+	slices.SortFunc(candidates, func(a, b *activeTask) int {
+		if c := cmp.Compare(b.GetSchedulingMetadata().GetPriority(), a.GetSchedulingMetadata().GetPriority()); c != 0 {
+			return c
+		}
+		return b.startTime.Compare(a.startTime)
+	})
+	for i := range candidates {
+		if canFit, _ := q.canFitTaskAfterReleasing(task, slices.Concat(preempted, candidates[:i+1])); !canFit {
+			continue
+		}
+		for _, t := range candidates[:i+1] {
+			ctx := log.EnrichContext(q.rootContext, log.ExecutionIDKey, t.GetTaskId())
+			log.CtxInfof(ctx, "Preempting task %q (group %q, priority %d) to run task %q (group %q, priority %d)",
+				t.GetTaskId(), t.GetSchedulingMetadata().GetTaskGroupId(), t.GetSchedulingMetadata().GetPriority(),
+				task.GetTaskId(), task.GetSchedulingMetadata().GetTaskGroupId(), task.GetSchedulingMetadata().GetPriority())
+			t.preempted = true
+			t.preempt(rexec.ErrPreempted)
+			metrics.RemoteExecutionPreemptedTaskCount.With(prometheus.Labels{
+				metrics.GroupID: t.GetSchedulingMetadata().GetTaskGroupId(),
+			}).Inc()
+		}
+		return
+	}
+}
+
+// canPreempt returns whether the given running task is eligible to be
+// preempted by the given queued task, regardless of their priorities.
+func (q *PriorityTaskScheduler) canPreempt(t *activeTask, task *QueuedTask) bool {
+	if t.preempt == nil {
+		return false
+	}
+	if !q.preemptAcrossGroups && t.GetSchedulingMetadata().GetTaskGroupId() != task.GetSchedulingMetadata().GetTaskGroupId() {
+		return false
+	}
+	return t.GetSchedulingMetadata().GetPreemptionCount() < q.maxPreemptionsPerTask
+}
+
 func (q *PriorityTaskScheduler) nextTaskForPruning() *QueuedTask {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -752,9 +1017,9 @@ func (q *PriorityTaskScheduler) trimQueue() bool {
 //
 // If the queue is modified, the queuePosition is no longer valid.
 type queuePosition struct {
-	// Which of the per-group queues the task is in.
-	GroupQueue *list.Element
-	// The index of the task within the GroupQueue.
+	// Which of the per-class queues the task is in.
+	ClassQueue *list.Element
+	// The index of the task within the ClassQueue.
 	Index int
 }
 
@@ -807,6 +1072,9 @@ func (q *PriorityTaskScheduler) handleTask() {
 		})
 		return
 	}
+	if q.draining() {
+		return
+	}
 
 	qLen := q.q.Len()
 	if qLen == 0 {
@@ -814,6 +1082,7 @@ func (q *PriorityTaskScheduler) handleTask() {
 	}
 	nextTask, ref := q.getNextSchedulableTask()
 	if nextTask == nil {
+		q.preemptTasksFor(q.q.Peek())
 		return
 	}
 	reservation := q.q.DequeueAt(ref)
@@ -827,7 +1096,7 @@ func (q *PriorityTaskScheduler) handleTask() {
 	ctx = context.WithValue(ctx, authutil.ContextTokenStringKey, reservation.GetJwt())
 	log.CtxInfof(ctx, "Scheduling task of size %s", tasksize.String(nextTask.GetTaskSize()))
 
-	q.trackTask(reservation.EnqueueTaskReservationRequest, &cancel)
+	task := q.trackTask(reservation.EnqueueTaskReservationRequest, &cancel)
 
 	go func() {
 		defer cancel()
@@ -842,8 +1111,14 @@ func (q *PriorityTaskScheduler) handleTask() {
 
 		lease, err := q.taskLeaser.Lease(ctx, reservation.GetTaskId())
 		if err != nil {
-			// NotFound means the task is already claimed.
-			if status.IsNotFoundError(err) {
+			// NotFound means the task is already claimed. ResourceExhausted
+			// means that the task's scheduling class is at its concurrency
+			// limit, in which case the reservation is kept, and the task is
+			// claimed once a slot frees up.
+			if status.IsResourceExhaustedError(err) {
+				log.CtxInfof(ctx, "Could not claim task %q, will retry: %s", reservation.GetTaskId(), err)
+				q.retryReservationLater(ctx, reservation.EnqueueTaskReservationRequest)
+			} else if status.IsNotFoundError(err) {
 				log.CtxInfof(ctx, "Could not claim task %q: %s", reservation.GetTaskId(), err)
 			} else {
 				log.CtxWarningf(ctx, "Error leasing task %q: %s", reservation.GetTaskId(), err)
@@ -860,14 +1135,27 @@ func (q *PriorityTaskScheduler) handleTask() {
 			SchedulingMetadata:    reservation.GetSchedulingMetadata(),
 			WorkerQueuedTimestamp: timestamppb.New(reservation.WorkerQueuedTimestamp),
 		}
-		retry, err := q.runTask(ctx, scheduledTask)
-		if err != nil {
+		retry, err := q.runTask(ctx, scheduledTask, task)
+		if rexec.IsPreemptedError(err) {
+			log.CtxInfof(ctx, "Task %q was preempted, re-enqueueing", reservation.GetTaskId())
+		} else if err != nil {
 			log.CtxErrorf(ctx, "Error running task %q (re-enqueue for retry: %t): %s", reservation.GetTaskId(), retry, err)
 		}
 		lease.Close(ctx, err, retry)
 	}()
 }
 
+// retryReservationLater re-enqueues a task reservation after a delay, which
+// doubles each time the reservation is retried.
+func (q *PriorityTaskScheduler) retryReservationLater(ctx context.Context, req *scpb.EnqueueTaskReservationRequest) {
+	req = req.CloneVT()
+	delay := min(max(2*req.GetDelay().AsDuration(), minConcurrencyLimitRetryDelay), maxConcurrencyLimitRetryDelay)
+	req.Delay = durationpb.New(delay)
+	if _, err := q.EnqueueTaskReservation(ctx, req); err != nil {
+		log.CtxWarningf(ctx, "Could not re-enqueue task reservation %q: %s", req.GetTaskId(), err)
+	}
+}
+
 func (q *PriorityTaskScheduler) Start() error {
 	go func() {
 		for range q.checkQueueSignal {
@@ -904,6 +1192,71 @@ func (q *PriorityTaskScheduler) GetQueuedTaskReservations() []*scpb.EnqueueTaskR
 	return q.q.GetAll()
 }
 
+func (q *PriorityTaskScheduler) draining() bool {
+	return !q.drainStartTime.IsZero()
+}
+
+// Drain stops the scheduler from claiming new tasks while allowing active
+// tasks to finish, and removes the recycled runners from the runner pool in
+// the background. It removes all task reservations from the queue and returns
+// them, so that they can be enqueued on other executors.
+func (q *PriorityTaskScheduler) Drain() []*scpb.EnqueueTaskReservationRequest {
+	q.mu.Lock()
+	if !q.draining() {
+		q.drainStartTime = q.clock.Now()
+		log.CtxInfof(q.rootContext, "Draining executor. Queue stats: %s", q.stats())
+	}
+	var reservations []*scpb.EnqueueTaskReservationRequest
+	for _, task := range q.q.DequeueAll() {
+		reservations = append(reservations, task.EnqueueTaskReservationRequest)
+	}
+	q.mu.Unlock()
+
+	q.runnerPoolDrainMu.Lock()
+	go func() {
+		defer q.runnerPoolDrainMu.Unlock()
+		if err := q.runnerPool.Drain(q.rootContext); err != nil {
+			log.CtxWarningf(q.rootContext, "Failed to remove recycled runners: %s", err)
+		}
+	}()
+	return reservations
+}
+
+// Undrain allows the scheduler to claim new tasks again after a call to
+// Drain.
+func (q *PriorityTaskScheduler) Undrain() {
+	q.mu.Lock()
+	wasDraining := q.draining()
+	q.drainStartTime = time.Time{}
+	q.mu.Unlock()
+
+	q.runnerPoolDrainMu.Lock()
+	q.runnerPool.Undrain()
+	q.runnerPoolDrainMu.Unlock()
+	if wasDraining {
+		log.CtxInfof(q.rootContext, "Stopped draining executor.")
+	}
+}
+
+// DrainStatus returns the progress of the current drain. Only the draining
+// field is set if the executor is not draining.
+func (q *PriorityTaskScheduler) DrainStatus() *scpb.ExecutorDrainStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.draining() {
+		return &scpb.ExecutorDrainStatus{}
+	}
+	activeTasks := len(q.activeTasks)
+	pausedRunners := q.runnerPool.PausedRunnerCount()
+	return &scpb.ExecutorDrainStatus{
+		Draining:          true,
+		StartTime:         timestamppb.New(q.drainStartTime),
+		ActiveTaskCount:   int64(activeTasks),
+		PausedRunnerCount: int64(pausedRunners),
+		Drained:           activeTasks == 0 && pausedRunners == 0,
+	}
+}
+
 // HasExcessCapacity returns a boolean indicating if this executor has excess
 // capacity for work. The scheduler-client may use this to request more work
 // from the scheduler, or reset a timeout if there is no excess capacity.
@@ -911,7 +1264,7 @@ func (q *PriorityTaskScheduler) HasExcessCapacity() bool {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
-	if q.shuttingDown {
+	if q.shuttingDown || q.draining() {
 		return false
 	}
 
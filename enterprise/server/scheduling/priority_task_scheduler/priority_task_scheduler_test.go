@@ -2,6 +2,8 @@ package priority_task_scheduler
 
 import (
 	"context"
+	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -9,6 +11,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/resources"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/rexec"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
@@ -107,6 +110,121 @@ func TestTaskQueue_DedupesTasks(t *testing.T) {
 	require.Nil(t, q.Dequeue())
 }
 
+func newWeightedTaskReservationRequest(taskID, taskGroupID, tag string, weight float64, maxConcurrentTasks int64) *scpb.EnqueueTaskReservationRequest {
+	req := newTaskReservationRequest(taskID, taskGroupID, 0)
+	req.SchedulingMetadata.SchedulingTag = tag
+	req.SchedulingMetadata.SchedulingWeight = weight
+	req.SchedulingMetadata.MaxConcurrentTasks = maxConcurrentTasks
+	return req
+}
+
+func TestTaskQueue_Weights(t *testing.T) {
+	q := newTaskQueue(clockwork.NewRealClock())
+
+	// Group 1 has twice the weight of group 2, so it should get two turns
+	// for each turn that group 2 gets.
+	for i := 1; i <= 6; i++ {
+		q.Enqueue(newWeightedTaskReservationRequest(fmt.Sprintf("group1Task%d", i), testGroupID1, "", 2, 0))
+		q.Enqueue(newWeightedTaskReservationRequest(fmt.Sprintf("group2Task%d", i), testGroupID2, "", 1, 0))
+	}
+
+	// The iterator should return tasks in the same order as Dequeue.
+	var iterated []string
+	it := q.Iterator()
+	for task := it.Next(); task != nil; task = it.Next() {
+		iterated = append(iterated, task.GetTaskId())
+	}
+	var dequeued []string
+	for task := q.Dequeue(); task != nil; task = q.Dequeue() {
+		dequeued = append(dequeued, task.GetTaskId())
+	}
+	require.Equal(t, []string{
+		"group1Task1",
+		"group2Task1",
+		"group1Task2",
+		"group1Task3",
+		"group2Task2",
+		"group1Task4",
+		"group1Task5",
+		"group2Task3",
+		"group1Task6",
+		"group2Task4",
+		"group2Task5",
+		"group2Task6",
+	}, dequeued)
+	require.Equal(t, dequeued, iterated)
+}
+
+func TestTaskQueue_NewClassDoesNotGetExtraTurns(t *testing.T) {
+	q := newTaskQueue(clockwork.NewRealClock())
+
+	for i := 1; i <= 3; i++ {
+		q.Enqueue(newTaskReservationRequest(fmt.Sprintf("group1Task%d", i), testGroupID1, 0))
+	}
+	require.Equal(t, "group1Task1", q.Dequeue().GetTaskId())
+	require.Equal(t, "group1Task2", q.Dequeue().GetTaskId())
+
+	// Group 2 wasn't waiting while group 1 ran, so it should alternate with
+	// group 1 rather than catching up on the turns it missed.
+	q.Enqueue(newTaskReservationRequest("group2Task1", testGroupID2, 0))
+	q.Enqueue(newTaskReservationRequest("group2Task2", testGroupID2, 0))
+	q.Enqueue(newTaskReservationRequest("group1Task4", testGroupID1, 0))
+
+	require.Equal(t, "group2Task1", q.Dequeue().GetTaskId())
+	require.Equal(t, "group1Task3", q.Dequeue().GetTaskId())
+	require.Equal(t, "group2Task2", q.Dequeue().GetTaskId())
+	require.Equal(t, "group1Task4", q.Dequeue().GetTaskId())
+	require.Nil(t, q.Dequeue())
+}
+
+func TestTaskQueue_MaxConcurrentTasks(t *testing.T) {
+	q := newTaskQueue(clockwork.NewRealClock())
+
+	// The "ci" class of group 1 can only run 1 task at a time, while the
+	// "interactive" class is unlimited.
+	q.Enqueue(newWeightedTaskReservationRequest("ci1", testGroupID1, "ci", 1, 1))
+	q.Enqueue(newWeightedTaskReservationRequest("ci2", testGroupID1, "ci", 1, 1))
+	q.Enqueue(newWeightedTaskReservationRequest("interactive1", testGroupID1, "interactive", 1, 0))
+	q.Enqueue(newWeightedTaskReservationRequest("interactive2", testGroupID1, "interactive", 1, 0))
+
+	ci1 := q.Dequeue()
+	require.Equal(t, "ci1", ci1.GetTaskId())
+	q.TaskStarted(ci1.EnqueueTaskReservationRequest)
+
+	// While ci1 is running, only interactive tasks can be dequeued.
+	require.Equal(t, "interactive1", q.Peek().GetTaskId())
+	var iterated []string
+	it := q.Iterator()
+	for task := it.Next(); task != nil; task = it.Next() {
+		iterated = append(iterated, task.GetTaskId())
+	}
+	require.Equal(t, []string{"interactive1", "interactive2"}, iterated)
+	require.Equal(t, "interactive1", q.Dequeue().GetTaskId())
+	require.Equal(t, "interactive2", q.Dequeue().GetTaskId())
+	require.Nil(t, q.Dequeue())
+	require.Equal(t, 1, q.Len())
+
+	// Once ci1 finishes, ci2 can be dequeued.
+	q.TaskFinished(ci1.EnqueueTaskReservationRequest)
+	require.Equal(t, "ci2", q.Dequeue().GetTaskId())
+	require.Equal(t, 0, q.Len())
+}
+
+func TestTaskQueue_DequeueAllIgnoresConcurrencyLimits(t *testing.T) {
+	q := newTaskQueue(clockwork.NewRealClock())
+
+	q.Enqueue(newWeightedTaskReservationRequest("1", testGroupID1, "", 1, 1))
+	q.Enqueue(newWeightedTaskReservationRequest("2", testGroupID1, "", 1, 1))
+	task := q.Dequeue()
+	q.TaskStarted(task.EnqueueTaskReservationRequest)
+	require.Nil(t, q.Dequeue())
+
+	tasks := q.DequeueAll()
+	require.Len(t, tasks, 1)
+	require.Equal(t, "2", tasks[0].GetTaskId())
+	require.Equal(t, 0, q.Len())
+}
+
 func TestPriorityTaskScheduler_CustomResourcesDontPreventNormalTaskScheduling(t *testing.T) {
 	env := testenv.GetTestEnv(t)
 	env.SetRemoteExecutionClient(&FakeExecutionClient{})
@@ -264,6 +382,137 @@ func TestPriorityTaskScheduler_ExecutionErrorHandling(t *testing.T) {
 	}
 }
 
+func TestPriorityTaskScheduler_Preemption(t *testing.T) {
+	flags.Set(t, "executor.preemption_priority_gap", 10)
+	env := testenv.GetTestEnv(t)
+	env.SetRemoteExecutionClient(&FakeExecutionClient{})
+	executor := NewFakeExecutor()
+	runnerPool := &FakeRunnerPool{}
+	leaser := NewFakeTaskLeaser()
+	// Only one task fits on the executor at a time.
+	scheduler := NewPriorityTaskScheduler(env, executor, runnerPool, leaser, &Options{
+		RAMBytesCapacityOverride:  1000,
+		CPUMillisCapacityOverride: 1000,
+	})
+	scheduler.Start()
+	t.Cleanup(func() {
+		err := scheduler.Stop()
+		require.NoError(t, err)
+	})
+	ctx := context.Background()
+
+	size := &scpb.TaskSize{EstimatedMilliCpu: 1000, EstimatedMemoryBytes: 1000}
+	enqueue := func(taskID string, priority int32) {
+		_, err := scheduler.EnqueueTaskReservation(ctx, &scpb.EnqueueTaskReservationRequest{
+			TaskId:             taskID,
+			TaskSize:           size,
+			SchedulingMetadata: &scpb.SchedulingMetadata{TaskSize: size, Priority: priority},
+		})
+		require.NoError(t, err)
+	}
+
+	lowPriorityTaskID := fakeTaskID("low-priority")
+	enqueue(lowPriorityTaskID, 100)
+	lowPriorityExecution := <-executor.StartedExecutions
+	lowPriorityLease := <-leaser.GrantedLeases
+
+	// A task whose priority is higher by less than the priority gap shouldn't
+	// preempt the running task.
+	mediumPriorityTaskID := fakeTaskID("medium-priority")
+	enqueue(mediumPriorityTaskID, 95)
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, lowPriorityExecution.Context.Err())
+
+	// A task whose priority is higher by at least the priority gap should
+	// preempt the running task.
+	highPriorityTaskID := fakeTaskID("high-priority")
+	enqueue(highPriorityTaskID, 0)
+	<-lowPriorityExecution.Context.Done()
+	require.True(t, rexec.Preempted(lowPriorityExecution.Context))
+	lowPriorityExecution.CompleteWith(false /*=retry*/, status.AbortedError("context canceled"))
+
+	// The preempted task should be re-enqueued, regardless of the error
+	// returned by the executor.
+	retry, err := lowPriorityLease.WaitClosed()
+	require.True(t, retry)
+	require.True(t, rexec.IsPreemptedError(err), "expected preempted error, got %v", err)
+
+	highPriorityExecution := <-executor.StartedExecutions
+	require.Equal(t, highPriorityTaskID, highPriorityExecution.ScheduledTask.GetExecutionTask().GetExecutionId())
+	highPriorityExecution.Complete()
+	mediumPriorityExecution := <-executor.StartedExecutions
+	require.Equal(t, mediumPriorityTaskID, mediumPriorityExecution.ScheduledTask.GetExecutionTask().GetExecutionId())
+	mediumPriorityExecution.Complete()
+}
+
+func TestPriorityTaskScheduler_PreemptionEligibility(t *testing.T) {
+	for _, test := range []struct {
+		name                string
+		preemptAcrossGroups bool
+		runningGroupID      string
+		preemptionCount     int32
+		expectPreempted     bool
+	}{
+		{name: "SameGroup", runningGroupID: "GR1", expectPreempted: true},
+		{name: "OtherGroup", runningGroupID: "GR2", expectPreempted: false},
+		{name: "OtherGroupAllowed", preemptAcrossGroups: true, runningGroupID: "GR2", expectPreempted: true},
+		{name: "MaxPreemptionsReached", runningGroupID: "GR1", preemptionCount: 3, expectPreempted: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			flags.Set(t, "executor.preemption_priority_gap", 10)
+			flags.Set(t, "executor.preempt_across_groups", test.preemptAcrossGroups)
+			flags.Set(t, "executor.max_preemptions_per_task", 3)
+			env := testenv.GetTestEnv(t)
+			env.SetRemoteExecutionClient(&FakeExecutionClient{})
+			executor := NewFakeExecutor()
+			// Only one task fits on the executor at a time.
+			scheduler := NewPriorityTaskScheduler(env, executor, &FakeRunnerPool{}, NewFakeTaskLeaser(), &Options{
+				RAMBytesCapacityOverride:  1000,
+				CPUMillisCapacityOverride: 1000,
+			})
+			scheduler.Start()
+			t.Cleanup(func() {
+				err := scheduler.Stop()
+				require.NoError(t, err)
+			})
+			ctx := context.Background()
+
+			size := &scpb.TaskSize{EstimatedMilliCpu: 1000, EstimatedMemoryBytes: 1000}
+			_, err := scheduler.EnqueueTaskReservation(ctx, &scpb.EnqueueTaskReservationRequest{
+				TaskId:   fakeTaskID("running"),
+				TaskSize: size,
+				SchedulingMetadata: &scpb.SchedulingMetadata{
+					TaskSize:        size,
+					Priority:        100,
+					TaskGroupId:     test.runningGroupID,
+					PreemptionCount: test.preemptionCount,
+				},
+			})
+			require.NoError(t, err)
+			runningExecution := <-executor.StartedExecutions
+
+			_, err = scheduler.EnqueueTaskReservation(ctx, &scpb.EnqueueTaskReservationRequest{
+				TaskId:             fakeTaskID("queued"),
+				TaskSize:           size,
+				SchedulingMetadata: &scpb.SchedulingMetadata{TaskSize: size, TaskGroupId: "GR1"},
+			})
+			require.NoError(t, err)
+
+			if test.expectPreempted {
+				<-runningExecution.Context.Done()
+				require.True(t, rexec.Preempted(runningExecution.Context))
+				runningExecution.CompleteWith(true /*=retry*/, status.AbortedError("context canceled"))
+			} else {
+				time.Sleep(100 * time.Millisecond)
+				require.NoError(t, runningExecution.Context.Err())
+				runningExecution.Complete()
+			}
+			queuedExecution := <-executor.StartedExecutions
+			queuedExecution.Complete()
+		})
+	}
+}
+
 func TestLocalEnqueueTimestamp(t *testing.T) {
 	ctx := context.Background()
 	env := testenv.GetTestEnv(t)
@@ -292,6 +541,126 @@ func TestLocalEnqueueTimestamp(t *testing.T) {
 	require.Equal(t, startTime, task.ScheduledTask.GetWorkerQueuedTimestamp().AsTime())
 }
 
+func TestPriorityTaskScheduler_Drain(t *testing.T) {
+	env := testenv.GetTestEnv(t)
+	env.SetRemoteExecutionClient(&FakeExecutionClient{})
+
+	flags.Set(t, "executor.millicpu", 1000)
+	flags.Set(t, "executor.memory_bytes", 64_000_000_000)
+	err := resources.Configure(false /*=mmapLRUEnabled*/)
+	require.NoError(t, err)
+
+	executor := NewFakeExecutor()
+	runnerPool := &FakeRunnerPool{}
+	leaser := NewFakeTaskLeaser()
+	scheduler := NewPriorityTaskScheduler(env, executor, runnerPool, leaser, &Options{})
+	scheduler.Start()
+	t.Cleanup(func() {
+		err := scheduler.Stop()
+		require.NoError(t, err)
+	})
+	ctx := context.Background()
+
+	oneCPU := &scpb.TaskSize{
+		EstimatedMilliCpu:    1000,
+		EstimatedMemoryBytes: 1000,
+	}
+	enqueue := func(taskID string) {
+		_, err := scheduler.EnqueueTaskReservation(ctx, &scpb.EnqueueTaskReservationRequest{
+			TaskId:             taskID,
+			TaskSize:           oneCPU,
+			SchedulingMetadata: &scpb.SchedulingMetadata{TaskSize: oneCPU},
+		})
+		require.NoError(t, err)
+	}
+
+	// Start a task that uses all of the executor's CPU, and queue another
+	// one behind it.
+	task1ID := fakeTaskID("task-1")
+	task2ID := fakeTaskID("task-2")
+	enqueue(task1ID)
+	enqueue(task2ID)
+	execution1 := <-executor.StartedExecutions
+	require.Equal(t, task1ID, execution1.ScheduledTask.GetExecutionTask().GetExecutionId())
+	require.False(t, scheduler.DrainStatus().GetDraining())
+
+	// Draining should return the queued task and remove the paused runners,
+	// but let the active task finish.
+	runnerPool.pausedRunners.Store(2)
+	reservations := scheduler.Drain()
+	require.Len(t, reservations, 1)
+	require.Equal(t, task2ID, reservations[0].GetTaskId())
+	require.Equal(t, 0, scheduler.q.Len())
+	require.False(t, scheduler.HasExcessCapacity())
+	require.Eventually(t, runnerPool.drained.Load, 5*time.Second, 10*time.Millisecond)
+	drainStatus := scheduler.DrainStatus()
+	require.True(t, drainStatus.GetDraining())
+	require.Equal(t, int64(1), drainStatus.GetActiveTaskCount())
+	require.Equal(t, int64(0), drainStatus.GetPausedRunnerCount())
+	require.False(t, drainStatus.GetDrained())
+
+	// Task reservations received while draining should be dropped.
+	enqueue(fakeTaskID("task-3"))
+	require.Equal(t, 0, scheduler.q.Len())
+
+	execution1.Complete()
+	require.Eventually(t, func() bool {
+		return scheduler.DrainStatus().GetDrained()
+	}, 5*time.Second, 10*time.Millisecond)
+	select {
+	case execution := <-executor.StartedExecutions:
+		require.FailNowf(t, "unexpected execution", "task %q started while draining", execution.ScheduledTask.GetExecutionTask().GetExecutionId())
+	default:
+	}
+
+	// Once undrained, the executor should accept tasks again.
+	scheduler.Undrain()
+	require.False(t, runnerPool.drained.Load())
+	require.False(t, scheduler.DrainStatus().GetDraining())
+	task4ID := fakeTaskID("task-4")
+	enqueue(task4ID)
+	execution4 := <-executor.StartedExecutions
+	require.Equal(t, task4ID, execution4.ScheduledTask.GetExecutionTask().GetExecutionId())
+	execution4.Complete()
+}
+
+func TestPriorityTaskScheduler_RetriesTasksAtConcurrencyLimit(t *testing.T) {
+	env := testenv.GetTestEnv(t)
+	env.SetRemoteExecutionClient(&FakeExecutionClient{})
+
+	flags.Set(t, "executor.millicpu", 1000)
+	flags.Set(t, "executor.memory_bytes", 64_000_000_000)
+	err := resources.Configure(false /*=mmapLRUEnabled*/)
+	require.NoError(t, err)
+
+	executor := NewFakeExecutor()
+	leaser := NewFakeTaskLeaser()
+	scheduler := NewPriorityTaskScheduler(env, executor, &FakeRunnerPool{}, leaser, &Options{})
+	scheduler.Start()
+	t.Cleanup(func() {
+		err := scheduler.Stop()
+		require.NoError(t, err)
+	})
+
+	// The task's scheduling class is at its concurrency limit the first time
+	// the executor tries to claim it, so the reservation should be kept and
+	// the task claimed on a later attempt.
+	leaser.LeaseErrors <- status.ResourceExhaustedError("scheduling class is at its limit")
+	taskSize := &scpb.TaskSize{EstimatedMilliCpu: 1000, EstimatedMemoryBytes: 1000}
+	taskID := fakeTaskID("task")
+	_, err = scheduler.EnqueueTaskReservation(context.Background(), &scpb.EnqueueTaskReservationRequest{
+		TaskId:             taskID,
+		TaskSize:           taskSize,
+		SchedulingMetadata: &scpb.SchedulingMetadata{TaskSize: taskSize},
+	})
+	require.NoError(t, err)
+
+	execution := <-executor.StartedExecutions
+	require.Equal(t, taskID, execution.ScheduledTask.GetExecutionTask().GetExecutionId())
+	require.Empty(t, leaser.LeaseErrors)
+	execution.Complete()
+}
+
 func fakeTaskID(label string) string {
 	return label + "/uploads/" + uuid.New() + "/blobs/2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae/3"
 }
@@ -308,6 +677,7 @@ func NewFakeExecutor() *FakeExecutor {
 
 type FakeExecution struct {
 	ScheduledTask *repb.ScheduledTask
+	Context       context.Context
 	retry         bool
 	err           error
 	completeCh    chan struct{}
@@ -335,6 +705,7 @@ func (e *FakeExecutor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb
 	log.Debugf("FakeExecutor: starting task %q", st.GetExecutionTask().GetExecutionId())
 	fe := &FakeExecution{
 		ScheduledTask: st,
+		Context:       ctx,
 		completeCh:    make(chan struct{}),
 	}
 	e.StartedExecutions <- fe
@@ -345,22 +716,48 @@ func (e *FakeExecutor) ExecuteTaskAndStreamResults(ctx context.Context, st *repb
 
 type FakeRunnerPool struct {
 	interfaces.RunnerPool
+
+	drained       atomic.Bool
+	pausedRunners atomic.Int64
 }
 
 func (*FakeRunnerPool) Wait() {
 }
 
+func (p *FakeRunnerPool) Drain(ctx context.Context) error {
+	p.drained.Store(true)
+	p.pausedRunners.Store(0)
+	return nil
+}
+
+func (p *FakeRunnerPool) Undrain() {
+	p.drained.Store(false)
+}
+
+func (p *FakeRunnerPool) PausedRunnerCount() int {
+	return int(p.pausedRunners.Load())
+}
+
 type FakeTaskLeaser struct {
 	GrantedLeases chan *FakeLease
+	// LeaseErrors holds errors to return from Lease instead of granting a
+	// lease.
+	LeaseErrors chan error
 }
 
 func NewFakeTaskLeaser() *FakeTaskLeaser {
 	return &FakeTaskLeaser{
 		GrantedLeases: make(chan *FakeLease, 512),
+		LeaseErrors:   make(chan error, 512),
 	}
 }
 
 func (f *FakeTaskLeaser) Lease(ctx context.Context, taskID string) (interfaces.TaskLease, error) {
+	select {
+	case err := <-f.LeaseErrors:
+		return nil, err
+	default:
+	}
 	lease := &FakeLease{
 		ctx:    ctx,
 		taskID: taskID,
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -23,6 +24,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/statusz"
 	"github.com/buildbuddy-io/buildbuddy/server/version"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/encoding/prototext"
 
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
@@ -92,11 +94,16 @@ type Registration struct {
 	apiKey          string
 	shutdownSignal  chan struct{}
 
-	mu             sync.Mutex
-	connected      bool
-	idleSeconds    atomic.Int64
-	paused         atomic.Bool
-	updateRunState chan bool
+	mu        sync.Mutex
+	connected bool
+	// IDs of task reservations removed from the queue when the executor
+	// started draining, which have not been returned to the scheduler yet.
+	returnedTaskIDs []string
+
+	idleSeconds       atomic.Int64
+	paused            atomic.Bool
+	updateRunState    chan bool
+	drainStateChanged chan struct{}
 }
 
 func (r *Registration) getConnected() bool {
@@ -121,6 +128,7 @@ func (r *Registration) Check(ctx context.Context) error {
 
 const templateContent = `
 <div>
+  {{if .DrainStatus}}<p>{{.DrainStatus}}</p>{{end}}
   <input type="checkbox" id="paused" {{if .Paused}}checked{{end}}>
   <label for="paused">Pause scheduling (stop accepting new work)</label>
   <script>
@@ -143,10 +151,14 @@ var statusTemplate = template.Must(template.New("scheduler_client").Parse(templa
 
 func (r *Registration) Statusz(ctx context.Context) string {
 	data := struct {
-		Paused bool
+		Paused      bool
+		DrainStatus string
 	}{
 		Paused: r.paused.Load(),
 	}
+	if ds := r.taskScheduler.DrainStatus(); ds.GetDraining() {
+		data.DrainStatus = fmt.Sprintf("Draining since %s: %d active tasks, %d recycled runners remaining.", ds.GetStartTime().AsTime().Format(time.RFC3339), ds.GetActiveTaskCount(), ds.GetPausedRunnerCount())
+	}
 	buf := &bytes.Buffer{}
 	if err := statusTemplate.Execute(buf, data); err != nil {
 		return fmt.Sprintf("Failed to execute template: %s", err)
@@ -165,11 +177,98 @@ func (r *Registration) UpdateStatusz(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Scheduler_RegisterAndStreamWorkClient, schedulerMsgs chan *scpb.RegisterAndStreamWorkResponse, schedulerErr chan error, registrationTicker, requestMoreWorkTicker *time.Ticker) (bool, error) {
-	registrationMsg := &scpb.RegisterAndStreamWorkRequest{
-		RegisterExecutorRequest: &scpb.RegisterExecutorRequest{Node: r.node},
+// setDraining starts or stops draining the executor. When the executor starts
+// draining, the task reservations in its queue are returned to the scheduler
+// so that they can run on other executors.
+func (r *Registration) setDraining(drain bool) {
+	if drain {
+		reservations := r.taskScheduler.Drain()
+		r.mu.Lock()
+		for _, res := range reservations {
+			r.returnedTaskIDs = append(r.returnedTaskIDs, res.GetTaskId())
+		}
+		r.mu.Unlock()
+	} else {
+		r.taskScheduler.Undrain()
+	}
+	// Let the scheduler know about the new drain state right away, instead of
+	// at the next check-in.
+	select {
+	case r.drainStateChanged <- struct{}{}:
+	default:
+	}
+}
+
+// ServeDrain serves the executor's drain endpoint. GET requests return the
+// drain progress as JSON. POST requests with the form value drain=true or
+// drain=false start or stop draining the executor, and then return the drain
+// progress.
+func (r *Registration) ServeDrain(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := req.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		drain, err := strconv.ParseBool(req.FormValue("drain"))
+		if err != nil {
+			http.Error(w, `form value "drain" must be "true" or "false"`, http.StatusBadRequest)
+			return
+		}
+		r.setDraining(drain)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(r.taskScheduler.DrainStatus())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// registrationMsg returns the message that registers the executor with the
+// scheduler, which includes the drain progress if the executor is draining.
+func (r *Registration) registrationMsg() *scpb.RegisterAndStreamWorkRequest {
+	node := r.node
+	if drainStatus := r.taskScheduler.DrainStatus(); drainStatus.GetDraining() {
+		node = node.CloneVT()
+		node.DrainStatus = drainStatus
+	}
+	return &scpb.RegisterAndStreamWorkRequest{
+		RegisterExecutorRequest: &scpb.RegisterExecutorRequest{Node: node},
+	}
+}
+
+// sendReturnedTaskReservations returns the task reservations that were
+// removed from the queue when the executor started draining to the scheduler.
+func (r *Registration) sendReturnedTaskReservations(stream scpb.Scheduler_RegisterAndStreamWorkClient) error {
+	r.mu.Lock()
+	taskIDs := r.returnedTaskIDs
+	r.returnedTaskIDs = nil
+	r.mu.Unlock()
+	if len(taskIDs) == 0 {
+		return nil
+	}
+	msg := &scpb.RegisterAndStreamWorkRequest{
+		ReturnTaskReservationsRequest: &scpb.ReturnTaskReservationsRequest{
+			TaskId: taskIDs,
+		},
+	}
+	if err := stream.Send(msg); err != nil {
+		r.mu.Lock()
+		r.returnedTaskIDs = append(taskIDs, r.returnedTaskIDs...)
+		r.mu.Unlock()
+		return status.UnavailableErrorf("could not return task reservations: %s", err)
 	}
+	log.Infof("Returned %d task reservations to the scheduler since the executor is draining.", len(taskIDs))
+	return nil
+}
 
+func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Scheduler_RegisterAndStreamWorkClient, schedulerMsgs chan *scpb.RegisterAndStreamWorkResponse, schedulerErr chan error, registrationTicker, requestMoreWorkTicker *time.Ticker) (bool, error) {
 	select {
 	case <-ctx.Done():
 		log.Debugf("Context cancelled, cancelling node registration.")
@@ -195,6 +294,13 @@ func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Schedu
 			requestMoreWorkTicker.Reset(moreWorkResponse.GetDelay().AsDuration())
 			return false, nil
 		}
+		if drainRequest := msg.GetDrainRequest(); drainRequest != nil {
+			log.Infof("Scheduler requested drain=%t", drainRequest.GetDrain())
+			// Undraining waits for any runner pool drain in progress, so
+			// don't block the stream.
+			go r.setDraining(drainRequest.GetDrain())
+			return false, nil
+		}
 		if msg.EnqueueTaskReservationRequest == nil {
 			out, _ := prototext.Marshal(msg)
 			return false, status.FailedPreconditionErrorf("message from scheduler did not contain a task reservation request:\n%s", string(out))
@@ -213,9 +319,19 @@ func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Schedu
 	case err := <-schedulerErr:
 		return false, status.WrapError(err, "failed to receive message from scheduler")
 	case <-registrationTicker.C:
-		if err := stream.Send(registrationMsg); err != nil {
+		if err := stream.Send(r.registrationMsg()); err != nil {
+			return false, status.UnavailableErrorf("could not send registration message: %s", err)
+		}
+		if err := r.sendReturnedTaskReservations(stream); err != nil {
+			return false, err
+		}
+	case <-r.drainStateChanged:
+		if err := stream.Send(r.registrationMsg()); err != nil {
 			return false, status.UnavailableErrorf("could not send registration message: %s", err)
 		}
+		if err := r.sendReturnedTaskReservations(stream); err != nil {
+			return false, err
+		}
 	case <-requestMoreWorkTicker.C:
 		if idleSeconds := r.idleSeconds.Load(); idleSeconds < 5 {
 			requestMoreWorkTicker.Reset(idleExecutorMoreWorkTimeout)
@@ -254,10 +370,6 @@ func (r *Registration) monitorExcessCapacity(ctx context.Context) {
 // maintainRegistrationAndStreamWork maintains registration with a scheduler server using the newer
 // RegisterAndStreamWork API which supports both registration and task reservations.
 func (r *Registration) maintainRegistrationAndStreamWork(ctx context.Context) {
-	registrationMsg := &scpb.RegisterAndStreamWorkRequest{
-		RegisterExecutorRequest: &scpb.RegisterExecutorRequest{Node: r.node},
-	}
-
 	defer r.setConnected(false)
 
 	registrationTicker := time.NewTicker(schedulerCheckInInterval)
@@ -275,7 +387,7 @@ func (r *Registration) maintainRegistrationAndStreamWork(ctx context.Context) {
 			}
 			continue
 		}
-		if err := stream.Send(registrationMsg); err != nil {
+		if err := stream.Send(r.registrationMsg()); err != nil {
 			log.Errorf("error registering node with scheduler: %s, will retry...", err)
 			continue
 		}
@@ -386,12 +498,13 @@ func NewRegistration(env environment.Env, taskScheduler *priority_task_scheduler
 	})
 
 	registration := &Registration{
-		schedulerClient: env.GetSchedulerClient(),
-		taskScheduler:   taskScheduler,
-		node:            node,
-		apiKey:          apiKey,
-		shutdownSignal:  shutdownSignal,
-		updateRunState:  make(chan bool),
+		schedulerClient:   env.GetSchedulerClient(),
+		taskScheduler:     taskScheduler,
+		node:              node,
+		apiKey:            apiKey,
+		shutdownSignal:    shutdownSignal,
+		updateRunState:    make(chan bool),
+		drainStateChanged: make(chan struct{}, 1),
 	}
 	env.GetHealthChecker().AddHealthCheck("registered_to_scheduler", registration)
 	statusz.AddSection("scheduler_client", "Remote execution scheduler client", registration)
@@ -2,7 +2,6 @@ package scheduler_server
 
 import (
 	"context"
-	"flag"
 	"fmt"
 	"io"
 	"math/rand"
@@ -25,6 +24,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/background"
 	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
 	"github.com/buildbuddy-io/buildbuddy/server/util/error_util"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
@@ -57,8 +57,19 @@ var (
 	leaseReconnectGracePeriod    = flag.Duration("remote_execution.lease_reconnect_grace_period", 1*time.Second, "How long to delay re-enqueued tasks in order to allow the previous lease holder to renew its lease (following a server shutdown).")
 	maxSchedulingDelay           = flag.Duration("remote_execution.max_scheduling_delay", 5*time.Second, "Max duration that actions can sit in a non-preferred executor's queue before they are executed.")
 	cgroupSettingsEnabled        = flag.Bool("remote_execution.cgroup_settings_enabled", true, "Apply cgroup2 settings to Linux executions.")
+	maxPreemptionsPerTask        = flag.Int("remote_execution.max_preemptions_per_task", 3, "Max number of times a task may be re-enqueued because it was preempted without counting as a failed attempt. Once a task has been preempted this many times, further preemptions reported by executors count toward its max attempt count and respect its retry settings.")
+	schedulingClasses            = flag.Slice("remote_execution.scheduling_classes", []SchedulingClass{}, "Fair-share weights and concurrency limits for tasks, by group ID and scheduling tag. Each task uses the most specific class that matches it: a class matching both its group ID and tag, then a class matching its group ID, then a class matching its tag.")
 )
 
+// SchedulingClass configures how tasks are scheduled based on the group that
+// issued them and their scheduling tag.
+type SchedulingClass struct {
+	GroupID            string  `yaml:"group_id" json:"group_id" usage:"The group ID that this class applies to. If empty, the class applies to all groups."`
+	Tag                string  `yaml:"tag" json:"tag" usage:"The scheduling tag that this class applies to, as set by the scheduling-tag platform property. If empty, the class applies to all tags."`
+	Weight             float64 `yaml:"weight" json:"weight" usage:"Relative share of executor capacity given to tasks in this class when tasks from multiple classes are queued. Defaults to 1."`
+	MaxConcurrentTasks int64   `yaml:"max_concurrent_tasks" json:"max_concurrent_tasks" usage:"Max number of tasks in this class that may run at the same time across all executors. 0 means no limit."`
+}
+
 const (
 	// This number controls how many reservations the scheduler will
 	// enqueue (across executor nodes) for each task. Typically this
@@ -90,6 +101,10 @@ const (
 	// Maximum task TTL in Redis.
 	taskTTL = 24 * time.Hour
 
+	// TTL of the Redis sets that track the claimed tasks in each scheduling
+	// class. This is extended whenever a task is claimed.
+	schedulingClassClaimsTTL = 24 * time.Hour
+
 	// Names of task fields in Redis task hash.
 	redisTaskProtoField       = "taskProto"
 	redisTaskMetadataField    = "schedulingMetadataProto"
@@ -118,6 +133,14 @@ const (
 	// How often we revalidate credentials for an open registration stream.
 	checkRegistrationCredentialsInterval = 5 * time.Minute
 
+	// How long a drain request waits for the executor to check in before it
+	// is dropped.
+	executorDrainRequestTTL = 1 * time.Hour
+
+	// Values of the executor drain request Redis keys.
+	redisDrainRequestDrain  = "drain"
+	redisDrainRequestResume = "resume"
+
 	// Platform property value corresponding with the darwin (Mac) operating system.
 	darwinOperatingSystemName = "darwin"
 
@@ -208,6 +231,58 @@ var (
 		else 
 			return 0 
 		end`)
+	// Records a claim on a task in the set of claimed tasks of its scheduling
+	// class, unless the class is at its concurrency limit. The set is scored by
+	// the time at which each claim expires, so that claims which are never
+	// released (e.g. because the app was killed) stop counting against the
+	// limit once they expire. Recording a claim that is already in the set
+	// only extends its expiration.
+	//
+	// KEYS: claimed task set
+	// ARGV: task ID, concurrency limit (0 for no limit), current time (ms),
+	//       claim expiration time (ms), set TTL (s)
+	// Return values:
+	//  - 0 if the class is at its concurrency limit
+	//  - 1 if the claim was recorded
+	//  - 2 if the claim was already recorded and its expiration was extended
+	redisAddSchedulingClassClaim = redis.NewScript(`
+		redis.call("zremrangebyscore", KEYS[1], "-inf", ARGV[3])
+		if redis.call("zscore", KEYS[1], ARGV[1]) then
+			redis.call("zadd", KEYS[1], ARGV[4], ARGV[1])
+			return 2
+		end
+		local limit = tonumber(ARGV[2])
+		if limit > 0 and redis.call("zcard", KEYS[1]) >= limit then
+			return 0
+		end
+		redis.call("zadd", KEYS[1], ARGV[4], ARGV[1])
+		redis.call("expire", KEYS[1], ARGV[5])
+		return 1
+		`)
+	// Records that the given lease of a task was preempted by giving back the
+	// attempt made by the lease. Each lease is only recorded once, so that
+	// re-enqueueing the same preempted lease more than once doesn't give back
+	// attempts made by other leases.
+	//
+	// KEYS: task key
+	// ARGV: lease ID
+	// Return values:
+	//  - 0 if the task doesn't exist or the lease was already recorded
+	//  - 1 if the preemption was recorded
+	redisRecordPreemption = redis.NewScript(`
+		if ARGV[1] == "" or redis.call("exists", KEYS[1]) == 0 then
+			return 0
+		end
+		if redis.call("hget", KEYS[1], "preemptedLeaseId") == ARGV[1] then
+			return 0
+		end
+		redis.call("hset", KEYS[1], "preemptedLeaseId", ARGV[1])
+		local attemptCount = tonumber(redis.call("hget", KEYS[1], "attemptCount") or "0")
+		if attemptCount > 0 then
+			redis.call("hincrby", KEYS[1], "attemptCount", -1)
+		end
+		return 1
+		`)
 	// Task deleted if claim field is present.
 	redisDeleteClaimedTask = redis.NewScript(`
 		if redis.call("hget", KEYS[1], "claimed") == "1" then 
@@ -373,10 +448,18 @@ func (h *executorHandle) Serve(ctx context.Context) error {
 				for _, taskID := range req.GetShuttingDownRequest().GetTaskId() {
 					leaseID := ""
 					reconnectToken := ""
-					if err := h.scheduler.reEnqueueTask(ctx, taskID, leaseID, reconnectToken, 1 /*=numReplicas*/, "executor shutting down"); err != nil {
+					if err := h.scheduler.reEnqueueTask(ctx, taskID, leaseID, reconnectToken, 1 /*=numReplicas*/, "executor shutting down", false /*=preempted*/); err != nil {
 						log.CtxWarningf(ctx, "Could not re-enqueue task reservation for executor %q going down: %s", executorID, err)
 					}
 				}
+			} else if req.GetReturnTaskReservationsRequest() != nil {
+				taskIDs := req.GetReturnTaskReservationsRequest().GetTaskId()
+				log.CtxInfof(ctx, "Executor %q is draining, re-enqueueing %d returned task reservations", executorID, len(taskIDs))
+				for _, taskID := range taskIDs {
+					if err := h.scheduler.enqueueReturnedTaskReservation(ctx, taskID); err != nil {
+						log.CtxWarningf(ctx, "Could not re-enqueue task reservation returned by draining executor %q: %s", executorID, err)
+					}
+				}
 			} else if req.GetAskForMoreWorkRequest() != nil {
 				poolKey := h.nodePoolKey(h.getRegistration())
 
@@ -556,6 +639,19 @@ func (h *executorHandle) setMoreWorkDelay(d time.Duration) {
 	h.requests <- enqueueTaskReservationRequest{proto: msg}
 }
 
+// requestDrain asks the executor to start or stop draining.
+func (h *executorHandle) requestDrain(ctx context.Context, drain bool) error {
+	msg := &scpb.RegisterAndStreamWorkResponse{
+		DrainRequest: &scpb.DrainRequest{Drain: drain},
+	}
+	select {
+	case h.requests <- enqueueTaskReservationRequest{proto: msg}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (h *executorHandle) startTaskReservationStreamer() {
 	go func() {
 		for {
@@ -733,6 +829,10 @@ func (np *nodePool) fetchExecutionNodes(ctx context.Context) ([]*executionNode,
 			}
 			continue
 		}
+		// Draining executors don't accept new tasks.
+		if node.GetRegistration().GetDrainStatus().GetDraining() {
+			continue
+		}
 
 		executors = append(executors, &executionNode{
 			ExecutionNode:     node.GetRegistration(),
@@ -1024,6 +1124,9 @@ type SchedulerServer struct {
 	pools map[nodePoolKey]*nodePool
 
 	leaseDuration, leaseGracePeriod time.Duration
+
+	// Whether any scheduling class has a concurrency limit.
+	enforceConcurrencyLimits bool
 }
 
 func Register(env *real_environment.RealEnv) error {
@@ -1086,6 +1189,18 @@ func NewSchedulerServerWithOptions(env environment.Env, options *Options) (*Sche
 	if options.LeaseDuration == 0 {
 		options.LeaseDuration = *leaseDuration
 	}
+	enforceConcurrencyLimits := false
+	for _, c := range *schedulingClasses {
+		if c.Weight < 0 {
+			return nil, status.InvalidArgumentErrorf("invalid weight %f for scheduling class (group %q, tag %q): weight must not be negative", c.Weight, c.GroupID, c.Tag)
+		}
+		if c.MaxConcurrentTasks < 0 {
+			return nil, status.InvalidArgumentErrorf("invalid max_concurrent_tasks %d for scheduling class (group %q, tag %q): limit must not be negative", c.MaxConcurrentTasks, c.GroupID, c.Tag)
+		}
+		if c.MaxConcurrentTasks > 0 {
+			enforceConcurrencyLimits = true
+		}
+	}
 	s := &SchedulerServer{
 		env:                               env,
 		pools:                             make(map[nodePoolKey]*nodePool),
@@ -1102,6 +1217,7 @@ func NewSchedulerServerWithOptions(env environment.Env, options *Options) (*Sche
 		actionMergingLeaseTTL:             actionMergingLeaseTTL,
 		leaseDuration:                     options.LeaseDuration,
 		leaseGracePeriod:                  options.LeaseGracePeriod,
+		enforceConcurrencyLimits:          enforceConcurrencyLimits,
 	}
 	s.schedulerClientCache = newSchedulerClientCache(env, s.ownHostPort, s)
 	return s, nil
@@ -1183,7 +1299,8 @@ func (s *SchedulerServer) RemoveConnectedExecutor(ctx context.Context, handle *e
 	nodePoolKey := handle.nodePoolKey(node)
 	pool, ok := s.getPool(nodePoolKey)
 	if ok {
-		if !pool.RemoveConnectedExecutor(node.GetExecutorId()) {
+		// Draining executors are already removed from the pool.
+		if !pool.RemoveConnectedExecutor(node.GetExecutorId()) && !node.GetDrainStatus().GetDraining() {
 			log.CtxWarningf(ctx, "Executor %q not in pool %+v", node.GetExecutorId(), nodePoolKey)
 		}
 	} else {
@@ -1213,8 +1330,19 @@ func (s *SchedulerServer) AddConnectedExecutor(ctx context.Context, handle *exec
 	if err != nil {
 		return err
 	}
+	if err := s.deliverDrainRequest(ctx, handle, node); err != nil {
+		log.CtxWarningf(ctx, "Could not deliver drain request to executor %q: %s", node.GetExecutorId(), err)
+	}
 
 	pool := s.getOrCreatePool(poolKey)
+	if node.GetDrainStatus().GetDraining() {
+		// Draining executors stay registered so that their drain progress is
+		// visible, but they aren't sent any new tasks.
+		if pool.RemoveConnectedExecutor(node.GetExecutorId()) {
+			log.CtxInfof(ctx, "Scheduler: executor %q (host ID %q) is draining", node.GetExecutorId(), node.GetExecutorHostId())
+		}
+		return nil
+	}
 	newExecutor := pool.AddConnectedExecutor(node, handle)
 	if !newExecutor {
 		return nil
@@ -1230,6 +1358,30 @@ func (s *SchedulerServer) AddConnectedExecutor(ctx context.Context, handle *exec
 	return nil
 }
 
+func (s *SchedulerServer) redisKeyForExecutorDrainRequest(executorID string) string {
+	return "executorDrainRequest/" + executorID
+}
+
+// deliverDrainRequest sends a pending DrainExecutors request to an executor
+// that just checked in. The request is deleted once the executor reports that
+// it applied it, so that later drain state changes made on the executor
+// itself are not overridden.
+func (s *SchedulerServer) deliverDrainRequest(ctx context.Context, handle *executorHandle, node *scpb.ExecutionNode) error {
+	key := s.redisKeyForExecutorDrainRequest(node.GetExecutorId())
+	request, err := s.rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	drain := request == redisDrainRequestDrain
+	if drain == node.GetDrainStatus().GetDraining() {
+		return s.rdb.Del(ctx, key).Err()
+	}
+	return handle.requestDrain(ctx, drain)
+}
+
 func (s *SchedulerServer) redisKeyForExecutorPools(groupID string) string {
 	key := "executorPools/"
 	if s.enableUserOwnedExecutors {
@@ -1434,6 +1586,138 @@ func (s *SchedulerServer) claimTask(ctx context.Context, taskID, reconnectToken
 	return leaseId, nil
 }
 
+// schedulingClassFor returns the configured scheduling class for tasks with
+// the given group ID and scheduling tag, or nil if no class applies. A class
+// matching both the group ID and tag takes precedence over one matching only
+// the group ID, which takes precedence over one matching only the tag.
+func schedulingClassFor(groupID, tag string) *SchedulingClass {
+	var match *SchedulingClass
+	matchSpecificity := -1
+	for i := range *schedulingClasses {
+		c := &(*schedulingClasses)[i]
+		if (c.GroupID != "" && c.GroupID != groupID) || (c.Tag != "" && c.Tag != tag) {
+			continue
+		}
+		specificity := 0
+		if c.GroupID != "" {
+			specificity += 2
+		}
+		if c.Tag != "" {
+			specificity += 1
+		}
+		if specificity > matchSpecificity {
+			match, matchSpecificity = c, specificity
+		}
+	}
+	return match
+}
+
+// applySchedulingClass sets the fair-share weight and concurrency limit of a
+// task based on its scheduling class.
+func applySchedulingClass(metadata *scpb.SchedulingMetadata) {
+	c := schedulingClassFor(metadata.GetTaskGroupId(), metadata.GetSchedulingTag())
+	if c == nil {
+		return
+	}
+	metadata.SchedulingWeight = c.Weight
+	metadata.MaxConcurrentTasks = c.MaxConcurrentTasks
+}
+
+// redisKeyForSchedulingClassClaims returns the key of the set of claimed tasks
+// in the scheduling class of the given task. The key identifies the class
+// rather than the task's group and tag, so that e.g. the limit of a class
+// which only matches a tag applies to the tasks of all groups combined.
+func redisKeyForSchedulingClassClaims(metadata *scpb.SchedulingMetadata) string {
+	groupID, tag := metadata.GetTaskGroupId(), metadata.GetSchedulingTag()
+	if c := schedulingClassFor(groupID, tag); c != nil {
+		groupID, tag = c.GroupID, c.Tag
+	}
+	return fmt.Sprintf("schedulingClassClaims/%s/%s", groupID, tag)
+}
+
+// schedulingTagLabel returns the metrics label for a scheduling tag. Tags
+// that are not configured in any scheduling class are reported as "other",
+// since clients can set arbitrary tags.
+func schedulingTagLabel(tag string) string {
+	if tag == "" {
+		return ""
+	}
+	for _, c := range *schedulingClasses {
+		if c.Tag == tag {
+			return tag
+		}
+	}
+	return "other"
+}
+
+// addSchedulingClassClaim records a claim on a task in the set of claimed
+// tasks of its scheduling class, or extends the expiration of an existing
+// claim. A limit of 0 means no limit.
+//
+// It returns a ResourceExhausted error if the class is already at the limit,
+// and whether the claim was newly recorded otherwise.
+func (s *SchedulerServer) addSchedulingClassClaim(ctx context.Context, key, taskID string, limit int64) (bool, error) {
+	now := s.clock.Now()
+	expiration := now.Add(s.leaseDuration + s.leaseGracePeriod)
+	r, err := redisAddSchedulingClassClaim.Run(
+		ctx, s.rdb,
+		[]string{key},
+		taskID, limit, now.UnixMilli(), expiration.UnixMilli(), int64(schedulingClassClaimsTTL.Seconds()),
+	).Int64()
+	if err != nil {
+		return false, status.InternalErrorf("could not record scheduling class claim: %s", err)
+	}
+	if r == 0 {
+		return false, status.ResourceExhaustedErrorf("scheduling class %q is at its limit of %d concurrent tasks", key, limit)
+	}
+	return r == 1, nil
+}
+
+// acquireSchedulingClassSlot counts a claim on the given task against the
+// concurrency limit of its scheduling class. It returns the Redis key under
+// which the claim was recorded, or "" if the class has no limit, and whether
+// the claim was newly recorded. It returns a ResourceExhausted error if the
+// class is at its limit, unless the executor is reconnecting to a task that it
+// had already claimed.
+func (s *SchedulerServer) acquireSchedulingClassSlot(ctx context.Context, taskID string, reconnecting bool) (string, bool, error) {
+	if !s.enforceConcurrencyLimits {
+		return "", false, nil
+	}
+	serializedMetadata, err := s.rdb.HGet(ctx, s.redisKeyForTask(taskID), redisTaskMetadataField).Result()
+	if err == redis.Nil {
+		return "", false, status.NotFoundError("task does not exist")
+	}
+	if err != nil {
+		return "", false, status.InternalErrorf("could not read task metadata from redis: %s", err)
+	}
+	metadata := &scpb.SchedulingMetadata{}
+	if err := proto.Unmarshal([]byte(serializedMetadata), metadata); err != nil {
+		return "", false, status.InternalErrorf("could not deserialize metadata proto: %s", err)
+	}
+	limit := metadata.GetMaxConcurrentTasks()
+	if limit <= 0 {
+		return "", false, nil
+	}
+	if reconnecting {
+		limit = 0
+	}
+	key := redisKeyForSchedulingClassClaims(metadata)
+	added, err := s.addSchedulingClassClaim(ctx, key, taskID, limit)
+	if err != nil {
+		return "", false, err
+	}
+	return key, added, nil
+}
+
+func (s *SchedulerServer) releaseSchedulingClassSlot(ctx context.Context, key, taskID string) {
+	if key == "" {
+		return
+	}
+	if err := s.rdb.ZRem(ctx, key, taskID).Err(); err != nil {
+		log.CtxWarningf(ctx, "Could not release scheduling class claim: %s", err)
+	}
+}
+
 func (s *SchedulerServer) readTasks(ctx context.Context, taskIDs []string) ([]*persistedTask, error) {
 	var tasks []*persistedTask
 
@@ -1608,6 +1892,11 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 	taskID := ""
 	reconnectToken := ""
 	leaseID := ""
+	// Redis key under which the claim is counted against the concurrency
+	// limit of the task's scheduling class, if it has one.
+	schedulingClassClaimsKey := ""
+	// Whether the executor reported that the task was preempted.
+	preempted := false
 
 	// TODO(vadim): remove after executor ID in lease request is rolled out
 	executorID := "unknown"
@@ -1625,10 +1914,15 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 		ctx, cancel := background.ExtendContextForFinalization(ctx, 3*time.Second)
 		defer cancel()
 		reEnqueueReason := "stream closed with task still claimed"
-		if err := s.reEnqueueTask(ctx, taskID, leaseID, reconnectToken, probesPerTask, reEnqueueReason); err != nil {
+		if err := s.reEnqueueTask(ctx, taskID, leaseID, reconnectToken, probesPerTask, reEnqueueReason, preempted); err != nil {
 			log.CtxErrorf(ctx, "LeaseTask %q tried to re-enqueue task but failed with err: %s", taskID, err.Error())
 		} // Success case will be logged by ReEnqueueTask flow.
 	}()
+	defer func() {
+		ctx, cancel := background.ExtendContextForFinalization(ctx, 3*time.Second)
+		defer cancel()
+		s.releaseSchedulingClassSlot(ctx, schedulingClassClaimsKey, taskID)
+	}()
 
 	msgs := make(chan *leaseMessage)
 	go func() {
@@ -1686,11 +1980,22 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 		}
 		if !claimed {
 			log.CtxInfof(ctx, "LeaseTask attempt (reconnect=%t) from executor %q", req.GetReconnectToken() != "", executorID)
+			classClaimsKey, addedClassClaim, err := s.acquireSchedulingClassSlot(ctx, taskID, req.GetReconnectToken() != "")
+			if err != nil {
+				log.CtxDebugf(ctx, "LeaseTask claim attempt (reconnect=%t) failed: %s", req.GetReconnectToken() != "", err)
+				return err
+			}
 			leaseID, err = s.claimTask(ctx, taskID, req.GetReconnectToken(), req.GetSupportsReconnect())
 			if err != nil {
+				// Don't release a slot that is held by the current claim
+				// holder.
+				if addedClassClaim {
+					s.releaseSchedulingClassSlot(ctx, classClaimsKey, taskID)
+				}
 				log.CtxDebugf(ctx, "LeaseTask claim attempt (reconnect=%t) failed: %s", req.GetReconnectToken() != "", err)
 				return err
 			}
+			schedulingClassClaimsKey = classClaimsKey
 			claimed = true
 			task, err := s.readTask(ctx, req.GetTaskId())
 			if err != nil {
@@ -1718,6 +2023,10 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 			// Prometheus: observe queue wait time.
 			ageInMillis := time.Since(task.queuedTimestamp).Milliseconds()
 			queueWaitTimeMs.Observe(float64(ageInMillis))
+			metrics.RemoteExecutionQueueWaitDurationUsec.With(prometheus.Labels{
+				metrics.GroupID:       task.metadata.GetTaskGroupId(),
+				metrics.SchedulingTag: schedulingTagLabel(task.metadata.GetSchedulingTag()),
+			}).Observe(float64(time.Since(task.queuedTimestamp).Microseconds()))
 			rsp.SerializedTask = task.serializedTask
 			rsp.LeaseId = leaseID
 			// If both the client and server have lease reconnect enabled,
@@ -1737,6 +2046,11 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 				claimed = false
 				return status.NotFoundErrorf("task %q disappeared, possibly cancelled", req.GetTaskId())
 			}
+			if schedulingClassClaimsKey != "" {
+				if _, err := s.addSchedulingClassClaim(ctx, schedulingClassClaimsKey, taskID, 0 /*=limit*/); err != nil {
+					log.CtxWarningf(ctx, "Could not renew scheduling class claim: %s", err)
+				}
+			}
 		}
 
 		done := req.GetFinalize() || req.GetRelease() || req.GetReEnqueue()
@@ -1771,8 +2085,13 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 				log.CtxWarningf(ctx, "Could not release lease for task %q: %s", taskID, err)
 			}
 
-			if req.GetReEnqueue() {
-				if _, err := s.ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{TaskId: taskID, Reason: req.GetReEnqueueReason().GetMessage()}); err != nil {
+			// Only re-enqueue the task if this lease released it. If the task
+			// is claimed by another executor, it's not ours to re-enqueue,
+			// and if the claim could not be released, the task is still
+			// claimed and will be re-enqueued when the stream closes.
+			preempted = req.GetPreempted()
+			if req.GetReEnqueue() && err == nil {
+				if _, err := s.ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{TaskId: taskID, LeaseId: leaseID, Reason: req.GetReEnqueueReason().GetMessage(), Preempted: preempted}); err != nil {
 					log.CtxErrorf(ctx, "LeaseTask %q tried to re-enqueue task requested by executor but failed with err: %s", taskID, err)
 				}
 			}
@@ -2081,6 +2400,7 @@ func (s *SchedulerServer) ScheduleTask(ctx context.Context, req *scpb.ScheduleTa
 	}
 	taskID := req.GetTaskId()
 	metadata := req.GetMetadata()
+	applySchedulingClass(metadata)
 	if err := s.insertTask(ctx, taskID, metadata, req.GetSerializedTask()); err != nil {
 		return nil, err
 	}
@@ -2138,7 +2458,11 @@ func (s *SchedulerServer) EnqueueTaskReservation(ctx context.Context, req *scpb.
 	return &scpb.EnqueueTaskReservationResponse{}, nil
 }
 
-func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID, leaseID, reconnectToken string, numReplicas int, reason string) error {
+// reEnqueueTask re-enqueues a task that could not be run to completion. If the
+// task was preempted, it is re-enqueued regardless of its retry settings, and
+// the preempted attempt doesn't count toward its max attempt count, unless the
+// task was already preempted the max number of times.
+func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID, leaseID, reconnectToken string, numReplicas int, reason string, preempted bool) error {
 	if taskID == "" {
 		return status.FailedPreconditionError("A task_id is required")
 	}
@@ -2147,7 +2471,15 @@ func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID, leaseID, re
 		return err
 	}
 
-	if scheduledTask.attemptCount >= maxTaskAttemptCount {
+	// Preemption is reported by the executor, so don't rely on the executor
+	// to stop preempting a task: once the task has been preempted the max
+	// number of times, treat further preemptions as failed attempts.
+	if preempted && int(scheduledTask.metadata.GetPreemptionCount()) >= *maxPreemptionsPerTask {
+		log.CtxInfof(ctx, "Task %q was preempted again after %d preemptions; counting it as a failed attempt", taskID, scheduledTask.metadata.GetPreemptionCount())
+		preempted = false
+	}
+
+	if !preempted && scheduledTask.attemptCount >= maxTaskAttemptCount {
 		if _, err := s.deleteTask(ctx, taskID); err != nil {
 			return err
 		}
@@ -2165,7 +2497,7 @@ func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID, leaseID, re
 	if err := proto.Unmarshal(scheduledTask.serializedTask, task); err != nil {
 		return status.InternalErrorf("failed to unmarshal ExecutionTask: %s", err)
 	}
-	if !platform.Retryable(task) {
+	if !preempted && !platform.Retryable(task) {
 		if _, err := s.deleteTask(ctx, taskID); err != nil {
 			return err
 		}
@@ -2185,6 +2517,15 @@ func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID, leaseID, re
 		log.CtxDebugf(ctx, "Failed to unclaim task: %s", err)
 		// Proceed despite error - it's fine if it's already unclaimed.
 	}
+	metadata := scheduledTask.metadata
+	if preempted {
+		log.CtxInfof(ctx, "Re-enqueueing task %q preempted by a higher-priority task", taskID)
+		if m, err := s.recordPreemption(ctx, taskID, leaseID, metadata); err != nil {
+			log.CtxWarningf(ctx, "Could not record preemption of task %q: %s", taskID, err)
+		} else {
+			metadata = m
+		}
+	}
 	log.CtxDebugf(ctx, "Re-enqueueing task")
 	delay := time.Duration(0)
 	if reconnectToken != "" {
@@ -2192,8 +2533,8 @@ func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID, leaseID, re
 	}
 	enqueueRequest := &scpb.EnqueueTaskReservationRequest{
 		TaskId:             taskID,
-		TaskSize:           scheduledTask.metadata.GetTaskSize(),
-		SchedulingMetadata: scheduledTask.metadata,
+		TaskSize:           metadata.GetTaskSize(),
+		SchedulingMetadata: metadata,
 		Delay:              durationpb.New(delay),
 	}
 	opts := enqueueTaskReservationOpts{
@@ -2213,17 +2554,85 @@ func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID, leaseID, re
 	return nil
 }
 
+// recordPreemption gives back the attempt made by the preempted lease and
+// increments the preemption count in the task's scheduling metadata, so that
+// executors can stop preempting tasks which were already preempted too many
+// times. It returns the updated metadata, or the given metadata if the lease
+// was already recorded.
+func (s *SchedulerServer) recordPreemption(ctx context.Context, taskID, leaseID string, metadata *scpb.SchedulingMetadata) (*scpb.SchedulingMetadata, error) {
+	key := s.redisKeyForTask(taskID)
+	recorded, err := redisRecordPreemption.Run(ctx, s.rdb, []string{key}, leaseID).Int()
+	if err != nil {
+		return metadata, err
+	}
+	if recorded != 1 {
+		return metadata, nil
+	}
+	metadata = metadata.CloneVT()
+	metadata.PreemptionCount++
+	serializedMetadata, err := proto.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rdb.HSet(ctx, key, redisTaskMetadataField, serializedMetadata).Err(); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
 func (s *SchedulerServer) ReEnqueueTask(ctx context.Context, req *scpb.ReEnqueueTaskRequest) (*scpb.ReEnqueueTaskResponse, error) {
 	ctx = log.EnrichContext(ctx, log.ExecutionIDKey, req.GetTaskId())
 	reconnectToken := ""
-	if err := s.reEnqueueTask(ctx, req.GetTaskId(), req.GetLeaseId(), reconnectToken, probesPerTask, req.GetReason()); err != nil {
+	if err := s.reEnqueueTask(ctx, req.GetTaskId(), req.GetLeaseId(), reconnectToken, probesPerTask, req.GetReason(), req.GetPreempted()); err != nil {
 		log.CtxErrorf(ctx, "ReEnqueueTask failed for task %q: %s", req.GetTaskId(), err)
 		return nil, err
 	}
 	return &scpb.ReEnqueueTaskResponse{}, nil
 }
 
+// enqueueReturnedTaskReservation enqueues a new reservation for a task whose
+// reservation was returned by a draining executor. Unlike reEnqueueTask, the
+// task's attempt count is not incremented, since the executor never attempted
+// to run it.
+func (s *SchedulerServer) enqueueReturnedTaskReservation(ctx context.Context, taskID string) error {
+	ctx = log.EnrichContext(ctx, log.ExecutionIDKey, taskID)
+	scheduledTask, err := s.readTask(ctx, taskID)
+	if err != nil {
+		// The task may have completed on another executor in the meantime.
+		if status.IsNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	task := &repb.ExecutionTask{}
+	if err := proto.Unmarshal(scheduledTask.serializedTask, task); err != nil {
+		return status.InternalErrorf("failed to unmarshal ExecutionTask: %s", err)
+	}
+	enqueueRequest := &scpb.EnqueueTaskReservationRequest{
+		TaskId:             taskID,
+		TaskSize:           scheduledTask.metadata.GetTaskSize(),
+		SchedulingMetadata: scheduledTask.metadata,
+	}
+	opts := enqueueTaskReservationOpts{
+		numReplicas:                  1,
+		scheduleOnConnectedExecutors: false,
+	}
+	return s.enqueueTaskReservations(ctx, enqueueRequest, task, opts)
+}
+
 func (s *SchedulerServer) getExecutionNodesFromRedis(ctx context.Context, groupID string) ([]*scpb.ExecutionNode, error) {
+	registeredNodes, err := s.getRegisteredExecutionNodesFromRedis(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	executionNodes := make([]*scpb.ExecutionNode, 0, len(registeredNodes))
+	for _, registeredNode := range registeredNodes {
+		executionNodes = append(executionNodes, registeredNode.GetRegistration())
+	}
+	return executionNodes, nil
+}
+
+func (s *SchedulerServer) getRegisteredExecutionNodesFromRedis(ctx context.Context, groupID string) ([]*scpb.RegisteredExecutionNode, error) {
 	user, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
 	if err != nil {
 		return nil, err
@@ -2233,7 +2642,7 @@ func (s *SchedulerServer) getExecutionNodesFromRedis(ctx context.Context, groupI
 	if err != nil {
 		return nil, err
 	}
-	var executionNodes []*scpb.ExecutionNode
+	var registeredNodes []*scpb.RegisteredExecutionNode
 	for _, k := range poolKeys {
 		executors, err := s.rdb.HGetAll(ctx, k).Result()
 		if err != nil {
@@ -2249,10 +2658,10 @@ func (s *SchedulerServer) getExecutionNodesFromRedis(ctx context.Context, groupI
 			if err != nil {
 				continue
 			}
-			executionNodes = append(executionNodes, registeredNode.GetRegistration())
+			registeredNodes = append(registeredNodes, registeredNode)
 		}
 	}
-	return executionNodes, nil
+	return registeredNodes, nil
 }
 
 func (s *SchedulerServer) GetExecutionNodes(ctx context.Context, req *scpb.GetExecutionNodesRequest) (*scpb.GetExecutionNodesResponse, error) {
@@ -2301,10 +2710,7 @@ func (s *SchedulerServer) GetExecutionNodes(ctx context.Context, req *scpb.GetEx
 		}
 	}
 	slices.SortFunc(executors, func(a, b *scpb.GetExecutionNodesResponse_Executor) int {
-		if c := strings.Compare(a.GetNode().GetHost(), b.GetNode().GetHost()); c != 0 {
-			return c
-		}
-		return strings.Compare(a.GetNode().GetExecutorId(), b.GetNode().GetExecutorId())
+		return compareExecutionNodes(a.GetNode(), b.GetNode())
 	})
 
 	return &scpb.GetExecutionNodesResponse{
@@ -2313,6 +2719,81 @@ func (s *SchedulerServer) GetExecutionNodes(ctx context.Context, req *scpb.GetEx
 	}, nil
 }
 
+func compareExecutionNodes(a, b *scpb.ExecutionNode) int {
+	if c := strings.Compare(a.GetHost(), b.GetHost()); c != 0 {
+		return c
+	}
+	return strings.Compare(a.GetExecutorId(), b.GetExecutorId())
+}
+
+// DrainExecutors asks the executors owned by the group that match the request
+// to start or stop draining. If executor authorization is disabled, the
+// executors are shared by all groups, and only server admins may drain them.
+// The request is stored in Redis and delivered to each executor by the
+// scheduler it is connected to when it next checks in.
+func (s *SchedulerServer) DrainExecutors(ctx context.Context, req *scpb.DrainExecutorsRequest) (*scpb.DrainExecutorsResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if groupID == "" {
+		return nil, status.InvalidArgumentError("group not specified")
+	}
+	if req.GetExecutorHostId() == "" && req.GetPool() == "" {
+		return nil, status.InvalidArgumentError("executor_host_id or pool is required")
+	}
+	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := authutil.AuthorizeOrgAdmin(u, groupID); err != nil {
+		return nil, err
+	}
+
+	// If executor auth is not enabled, executors do not belong to any group,
+	// so only server admins may drain them.
+	if !s.requireExecutorAuthorization {
+		adminGroupID := s.env.GetAuthenticator().AdminGroupID()
+		if adminGroupID == "" {
+			return nil, status.PermissionDeniedError("draining executors requires executor authorization to be enabled")
+		}
+		if err := authutil.AuthorizeOrgAdmin(u, adminGroupID); err != nil {
+			return nil, err
+		}
+		groupID = ""
+	}
+
+	registeredNodes, err := s.getRegisteredExecutionNodesFromRedis(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	request := redisDrainRequestDrain
+	if req.GetResume() {
+		request = redisDrainRequestResume
+	}
+	rsp := &scpb.DrainExecutorsResponse{}
+	for _, registeredNode := range registeredNodes {
+		node := registeredNode.GetRegistration()
+		if registeredNode.GetGroupId() != groupID {
+			continue
+		}
+		if req.GetExecutorHostId() != "" && node.GetExecutorHostId() != req.GetExecutorHostId() {
+			continue
+		}
+		if req.GetPool() != "" && !strings.EqualFold(node.GetPool(), req.GetPool()) {
+			continue
+		}
+		key := s.redisKeyForExecutorDrainRequest(node.GetExecutorId())
+		if err := s.rdb.Set(ctx, key, request, executorDrainRequestTTL).Err(); err != nil {
+			return nil, err
+		}
+		rsp.Executor = append(rsp.Executor, node)
+	}
+	if len(rsp.Executor) == 0 {
+		return nil, status.NotFoundError("no registered executors match the request")
+	}
+	slices.SortFunc(rsp.Executor, compareExecutionNodes)
+	log.CtxInfof(ctx, "Requested %s of %d executors (host ID %q, pool %q)", request, len(rsp.Executor), req.GetExecutorHostId(), req.GetPool())
+	return rsp, nil
+}
+
 func errTaskSizeTooLarge(pool, os, arch string, size *scpb.TaskSize) error {
 	return status.UnavailableErrorf(
 		"no registered executors in pool %q with os %q with arch %q can fit a task with %s",
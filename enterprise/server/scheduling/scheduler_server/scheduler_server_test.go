@@ -28,6 +28,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/types/known/durationpb"
 
+	cappb "github.com/buildbuddy-io/buildbuddy/proto/capability"
 	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
@@ -271,7 +272,8 @@ func TestSchedulerServerGetPoolInfoSelfHostedByDefault(t *testing.T) {
 }
 
 type task struct {
-	delay time.Duration
+	delay           time.Duration
+	preemptionCount int32
 }
 
 type Result[T any] struct {
@@ -385,7 +387,10 @@ func (e *fakeExecutor) Register() {
 					e.mu.Lock()
 					log.CtxInfof(ctx, "Executor %s got task %q with scheduling delay %s", e.id, rsp.GetEnqueueTaskReservationRequest().GetTaskId(), rsp.GetEnqueueTaskReservationRequest().GetDelay())
 					taskID := rsp.GetEnqueueTaskReservationRequest().GetTaskId()
-					e.tasks[taskID] = task{delay: rsp.GetEnqueueTaskReservationRequest().GetDelay().AsDuration()}
+					e.tasks[taskID] = task{
+						delay:           rsp.GetEnqueueTaskReservationRequest().GetDelay().AsDuration(),
+						preemptionCount: rsp.GetEnqueueTaskReservationRequest().GetSchedulingMetadata().GetPreemptionCount(),
+					}
 					e.mu.Unlock()
 					// Best effort: notify the test of every scheduler reply.
 					select {
@@ -437,6 +442,12 @@ func (e *fakeExecutor) EnsureTaskNotReceived(taskID string) {
 	}
 }
 
+func (e *fakeExecutor) PreemptionCount(taskID string) int32 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.tasks[taskID].preemptionCount
+}
+
 func (e *fakeExecutor) ResetTasks() {
 	e.mu.Lock()
 	e.tasks = make(map[string]task)
@@ -640,6 +651,98 @@ func TestExecutorReEnqueue_RetriesDisabled(t *testing.T) {
 	fe.EnsureTaskNotReceived(taskID)
 }
 
+func TestExecutorReEnqueue_Preempted(t *testing.T) {
+	env, ctx := getEnv(t, &schedulerOpts{}, "user1")
+
+	fe := newFakeExecutor(ctx, t, env.GetSchedulerClient())
+	fe.Register()
+
+	// Preempted tasks should be re-enqueued even if retries are disabled, and
+	// preemptions don't count toward the max attempt count.
+	flags.Set(t, "remote_execution.max_preemptions_per_task", maxTaskAttemptCount+1)
+	taskID := scheduleTask(ctx, t, env, map[string]string{platform.RetryPropertyName: "false"})
+	fe.WaitForTask(taskID)
+	for i := 0; i < maxTaskAttemptCount+1; i++ {
+		lease := fe.Claim(taskID)
+		fe.ResetTasks()
+
+		_, err := env.GetSchedulerClient().ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{
+			TaskId:    taskID,
+			Reason:    "preempted",
+			LeaseId:   lease.leaseID,
+			Preempted: true,
+		})
+		require.NoError(t, err)
+		fe.WaitForTask(taskID)
+		require.Equal(t, int32(i+1), fe.PreemptionCount(taskID))
+	}
+}
+
+func TestExecutorReEnqueue_PreemptedTooManyTimes(t *testing.T) {
+	flags.Set(t, "remote_execution.max_preemptions_per_task", 2)
+	env, ctx := getEnv(t, &schedulerOpts{}, "user1")
+
+	fe := newFakeExecutor(ctx, t, env.GetSchedulerClient())
+	fe.Register()
+
+	taskID := scheduleTask(ctx, t, env, map[string]string{platform.RetryPropertyName: "false"})
+	fe.WaitForTask(taskID)
+	for i := 0; i < 2; i++ {
+		lease := fe.Claim(taskID)
+		fe.ResetTasks()
+
+		_, err := env.GetSchedulerClient().ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{
+			TaskId:    taskID,
+			Reason:    "preempted",
+			LeaseId:   lease.leaseID,
+			Preempted: true,
+		})
+		require.NoError(t, err)
+		fe.WaitForTask(taskID)
+		require.Equal(t, int32(i+1), fe.PreemptionCount(taskID))
+	}
+
+	// Once the task has been preempted the max number of times, further
+	// preemptions reported by the executor count as failed attempts, so the
+	// task should not be retried since retries are disabled.
+	lease := fe.Claim(taskID)
+	fe.ResetTasks()
+	_, err := env.GetSchedulerClient().ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{
+		TaskId:    taskID,
+		Reason:    "preempted",
+		LeaseId:   lease.leaseID,
+		Preempted: true,
+	})
+	require.NoError(t, err)
+	fe.EnsureTaskNotReceived(taskID)
+}
+
+func TestExecutorReEnqueue_PreemptedTwice(t *testing.T) {
+	env, ctx := getEnv(t, &schedulerOpts{}, "user1")
+
+	fe := newFakeExecutor(ctx, t, env.GetSchedulerClient())
+	fe.Register()
+
+	taskID := scheduleTask(ctx, t, env, map[string]string{})
+	fe.WaitForTask(taskID)
+	lease := fe.Claim(taskID)
+
+	// Re-enqueueing the same preempted lease twice should only record the
+	// preemption once.
+	for i := 0; i < 2; i++ {
+		fe.ResetTasks()
+		_, err := env.GetSchedulerClient().ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{
+			TaskId:    taskID,
+			Reason:    "preempted",
+			LeaseId:   lease.leaseID,
+			Preempted: true,
+		})
+		require.NoError(t, err)
+		fe.WaitForTask(taskID)
+		require.Equal(t, int32(1), fe.PreemptionCount(taskID))
+	}
+}
+
 func TestLeaseExpiration(t *testing.T) {
 	fakeClock := clockwork.NewFakeClock()
 	env, ctx := getEnv(t, &schedulerOpts{options: Options{
@@ -912,3 +1015,154 @@ func TestGetExecutionNodes(t *testing.T) {
 		}
 	}
 }
+
+func TestDrainExecutors(t *testing.T) {
+	env, ctx := getEnv(t, &schedulerOpts{}, "user1")
+
+	executors := map[string]*fakeExecutor{}
+	for _, hostID := range []string{"a", "b"} {
+		executor := newFakeExecutor(ctx, t, env.GetSchedulerClient())
+		executor.node.ExecutorHostId = hostID
+		executor.Register()
+		executors[hostID] = executor
+	}
+
+	developer := testauth.User("developer", "group1")
+	developerCtx := testauth.WithAuthenticatedUserInfo(ctx, developer)
+	admin := testauth.User("admin", "group1")
+	admin.GroupMemberships[0].Capabilities = []cappb.Capability{cappb.Capability_ORG_ADMIN}
+	adminCtx := testauth.WithAuthenticatedUserInfo(ctx, admin)
+	reqCtx := &ctxpb.RequestContext{GroupId: "group1"}
+
+	_, err := env.GetSchedulerService().DrainExecutors(developerCtx, &scpb.DrainExecutorsRequest{RequestContext: reqCtx, ExecutorHostId: "a"})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+	// Executor authorization is disabled, so the executors are shared by all
+	// groups, and only server admins can drain them.
+	_, err = env.GetSchedulerService().DrainExecutors(adminCtx, &scpb.DrainExecutorsRequest{RequestContext: reqCtx, ExecutorHostId: "a"})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+	env.GetAuthenticator().(*testauth.TestAuthenticator).ServerAdminGroupID = "group2"
+	_, err = env.GetSchedulerService().DrainExecutors(adminCtx, &scpb.DrainExecutorsRequest{RequestContext: reqCtx, ExecutorHostId: "a"})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+	env.GetAuthenticator().(*testauth.TestAuthenticator).ServerAdminGroupID = "group1"
+
+	_, err = env.GetSchedulerService().DrainExecutors(adminCtx, &scpb.DrainExecutorsRequest{RequestContext: reqCtx})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+	_, err = env.GetSchedulerService().DrainExecutors(adminCtx, &scpb.DrainExecutorsRequest{RequestContext: reqCtx, ExecutorHostId: "unknown"})
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	rsp, err := env.GetSchedulerService().DrainExecutors(adminCtx, &scpb.DrainExecutorsRequest{
+		RequestContext: reqCtx,
+		ExecutorHostId: "a",
+	})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetExecutor(), 1)
+	require.Equal(t, executors["a"].id, rsp.GetExecutor()[0].GetExecutorId())
+
+	// The drain request should be delivered when the executor next checks in.
+	executors["a"].Send(&scpb.RegisterAndStreamWorkRequest{
+		RegisterExecutorRequest: &scpb.RegisterExecutorRequest{Node: executors["a"].node},
+	})
+	msg := <-executors["a"].schedulerMessages
+	require.True(t, msg.GetDrainRequest().GetDrain())
+
+	// Once the executor reports that it is draining, it should not be
+	// assigned any new tasks.
+	drainingNode := executors["a"].node.CloneVT()
+	drainingNode.DrainStatus = &scpb.ExecutorDrainStatus{Draining: true}
+	executors["a"].Send(&scpb.RegisterAndStreamWorkRequest{
+		RegisterExecutorRequest: &scpb.RegisterExecutorRequest{Node: drainingNode},
+	})
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		taskID := scheduleTask(ctx, t, env, map[string]string{})
+		executors["b"].WaitForTask(taskID)
+		executors["a"].EnsureTaskNotReceived(taskID)
+	}
+}
+
+func TestSchedulingClassFor(t *testing.T) {
+	flags.Set(t, "remote_execution.scheduling_classes", []SchedulingClass{
+		{Tag: "ci", Weight: 1},
+		{GroupID: "group1", Weight: 2},
+		{GroupID: "group1", Tag: "ci", Weight: 3},
+	})
+
+	for _, tc := range []struct {
+		groupID, tag   string
+		expectedWeight float64
+	}{
+		{groupID: "group1", tag: "ci", expectedWeight: 3},
+		{groupID: "group1", tag: "interactive", expectedWeight: 2},
+		{groupID: "group1", tag: "", expectedWeight: 2},
+		{groupID: "group2", tag: "ci", expectedWeight: 1},
+		{groupID: "group2", tag: "interactive", expectedWeight: 0},
+	} {
+		c := schedulingClassFor(tc.groupID, tc.tag)
+		if tc.expectedWeight == 0 {
+			require.Nil(t, c, "group %q, tag %q", tc.groupID, tc.tag)
+			continue
+		}
+		require.NotNil(t, c, "group %q, tag %q", tc.groupID, tc.tag)
+		require.Equal(t, tc.expectedWeight, c.Weight, "group %q, tag %q", tc.groupID, tc.tag)
+	}
+}
+
+func TestSchedulingClassClaimsKey(t *testing.T) {
+	flags.Set(t, "remote_execution.scheduling_classes", []SchedulingClass{
+		{Tag: "ci", MaxConcurrentTasks: 10},
+		{GroupID: "group1", MaxConcurrentTasks: 10},
+	})
+
+	// Tasks that use the same class share its limit, regardless of their
+	// group and tag.
+	ci1 := redisKeyForSchedulingClassClaims(&scpb.SchedulingMetadata{TaskGroupId: "group2", SchedulingTag: "ci"})
+	ci2 := redisKeyForSchedulingClassClaims(&scpb.SchedulingMetadata{TaskGroupId: "group3", SchedulingTag: "ci"})
+	require.Equal(t, ci1, ci2)
+	group1CI := redisKeyForSchedulingClassClaims(&scpb.SchedulingMetadata{TaskGroupId: "group1", SchedulingTag: "ci"})
+	group1 := redisKeyForSchedulingClassClaims(&scpb.SchedulingMetadata{TaskGroupId: "group1"})
+	require.Equal(t, group1, group1CI)
+	require.NotEqual(t, ci1, group1)
+}
+
+func TestSchedulingTagLabel(t *testing.T) {
+	flags.Set(t, "remote_execution.scheduling_classes", []SchedulingClass{
+		{Tag: "ci", Weight: 1},
+		{GroupID: "group1", Weight: 2},
+	})
+
+	require.Equal(t, "", schedulingTagLabel(""))
+	require.Equal(t, "ci", schedulingTagLabel("ci"))
+	require.Equal(t, "other", schedulingTagLabel("interactive"))
+}
+
+func TestSchedulingClass_MaxConcurrentTasks(t *testing.T) {
+	flags.Set(t, "remote_execution.scheduling_classes", []SchedulingClass{
+		{MaxConcurrentTasks: 1},
+	})
+	env, ctx := getEnv(t, &schedulerOpts{}, "user1")
+
+	fe := newFakeExecutor(ctx, t, env.GetSchedulerClient())
+	fe.Register()
+
+	taskID1 := scheduleTask(ctx, t, env, map[string]string{})
+	fe.WaitForTask(taskID1)
+	taskID2 := scheduleTask(ctx, t, env, map[string]string{})
+	fe.WaitForTask(taskID2)
+
+	lease := fe.Claim(taskID1)
+
+	// The class is at its limit, so the second task can't be claimed.
+	stream, err := env.GetSchedulerClient().LeaseTask(ctx)
+	require.NoError(t, err)
+	err = stream.Send(&scpb.LeaseTaskRequest{TaskId: taskID2})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.True(t, status.IsResourceExhaustedError(err), "expected ResourceExhausted, got %v", err)
+
+	// Once the first task is done, the second task can be claimed.
+	err = lease.Finalize()
+	require.NoError(t, err)
+	_, err = lease.stream.Recv()
+	require.ErrorIs(t, err, io.EOF)
+	fe.Claim(taskID2)
+}
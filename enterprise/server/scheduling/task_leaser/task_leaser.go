@@ -13,6 +13,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
+	"github.com/buildbuddy-io/buildbuddy/server/util/rexec"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
@@ -158,11 +159,12 @@ func (t *TaskLease) pingServer(ctx context.Context) (b []byte, err error) {
 	return rsp.GetSerializedTask(), nil
 }
 
-func (t *TaskLease) reEnqueueTask(ctx context.Context, reason string) error {
+func (t *TaskLease) reEnqueueTask(ctx context.Context, reason string, preempted bool) error {
 	req := &scpb.ReEnqueueTaskRequest{
-		TaskId:  t.taskID,
-		LeaseId: t.leaseID,
-		Reason:  reason,
+		TaskId:    t.taskID,
+		LeaseId:   t.leaseID,
+		Reason:    reason,
+		Preempted: preempted,
 	}
 	_, err := t.env.GetSchedulerClient().ReEnqueueTask(ctx, req)
 	return err
@@ -232,12 +234,14 @@ func (t *TaskLease) Close(ctx context.Context, taskErr error, retry bool) {
 	// and we're not going to retry it.
 	// Otherwise, we should let the scheduler know that the task needs to be
 	// retried.
+	preempted := rexec.IsPreemptedError(taskErr)
 	if taskErr == nil || !retry {
 		req.Finalize = true
 	} else {
 		req.ReEnqueue = true
 		s, _ := gstatus.FromError(taskErr)
 		req.ReEnqueueReason = s.Proto()
+		req.Preempted = preempted
 	}
 	if err := t.stream.Send(req); err != nil {
 		log.CtxWarningf(ctx, "Failed to send final message on task lease stream: %s", err)
@@ -265,7 +269,7 @@ func (t *TaskLease) Close(ctx context.Context, taskErr error, retry bool) {
 		if jwt := t.ctx.Value(authutil.ContextTokenStringKey); jwt != nil {
 			ctx = context.WithValue(ctx, authutil.ContextTokenStringKey, jwt)
 		}
-		if err := t.reEnqueueTask(ctx, reason); err != nil {
+		if err := t.reEnqueueTask(ctx, reason, preempted); err != nil {
 			log.CtxWarningf(ctx, "TaskLeaser %q: error re-enqueueing task: %s", t.taskID, err.Error())
 		} else {
 			log.CtxInfof(ctx, "TaskLeaser %q: Successfully re-enqueued.", t.taskID)
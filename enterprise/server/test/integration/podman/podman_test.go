@@ -161,7 +161,7 @@ func TestRunHelloWorld(t *testing.T) {
 	}
 	c, err := provider.New(ctx, &container.Init{Props: props})
 	require.NoError(t, err)
-	result := c.Run(ctx, cmd, workDir, oci.Credentials{})
+	result := c.Run(ctx, cmd, workDir, oci.Credentials{}, &interfaces.Stdio{})
 
 	require.NoError(t, result.Error)
 	assert.Equal(t, "Hello world!", string(result.Stdout),
@@ -297,7 +297,7 @@ func TestRun_Timeout(t *testing.T) {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	res := c.Run(ctx, cmd, workDir, oci.Credentials{})
+	res := c.Run(ctx, cmd, workDir, oci.Credentials{}, &interfaces.Stdio{})
 
 	assert.True(
 		t, status.IsDeadlineExceededError(res.Error),
@@ -348,7 +348,7 @@ func TestExec_Timeout(t *testing.T) {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	res := c.Run(ctx, cmd, workDir, oci.Credentials{})
+	res := c.Run(ctx, cmd, workDir, oci.Credentials{}, &interfaces.Stdio{})
 
 	assert.True(
 		t, status.IsDeadlineExceededError(res.Error),
@@ -465,7 +465,7 @@ func TestForceRoot(t *testing.T) {
 			}
 			c, err := provider.New(ctx, &container.Init{Props: props})
 			require.NoError(t, err)
-			result := c.Run(ctx, cmd, workDir, oci.Credentials{})
+			result := c.Run(ctx, cmd, workDir, oci.Credentials{}, &interfaces.Stdio{})
 			require.NoError(t, result.Error)
 			assert.Equal(t, tc.wantUID, strings.TrimSpace(string(result.Stdout)))
 			assert.Empty(t, string(result.Stderr), "stderr should be empty")
@@ -515,7 +515,7 @@ func TestUser(t *testing.T) {
 			require.NoError(t, err)
 			result := c.Run(ctx, &repb.Command{
 				Arguments: []string{"id", "-u", "-n"},
-			}, workDir, oci.Credentials{})
+			}, workDir, oci.Credentials{}, &interfaces.Stdio{})
 			u := strings.TrimSpace(string(result.Stdout))
 			if tc.wantUser != "" {
 				assert.Equal(t, tc.wantUser, u)
@@ -528,7 +528,7 @@ func TestUser(t *testing.T) {
 
 			result = c.Run(ctx, &repb.Command{
 				Arguments: []string{"id", "-g", "-n"},
-			}, workDir, oci.Credentials{})
+			}, workDir, oci.Credentials{}, &interfaces.Stdio{})
 			g := strings.TrimSpace(string(result.Stdout))
 			if tc.wantGroup != "" {
 				assert.Equal(t, tc.wantGroup, g)
@@ -564,7 +564,7 @@ func TestPodmanRun_LongRunningProcess_CanGetAllLogs(t *testing.T) {
 	c, err := provider.New(ctx, &container.Init{Props: props})
 	require.NoError(t, err)
 
-	res := c.Run(ctx, cmd, workDir, oci.Credentials{})
+	res := c.Run(ctx, cmd, workDir, oci.Credentials{}, &interfaces.Stdio{})
 
 	assert.Equal(t, "Hello world\nHello again\n", string(res.Stdout))
 }
@@ -590,7 +590,7 @@ func TestPodmanRun_CommandNotExecuted_RecordsStats(t *testing.T) {
 	c, err := provider.New(ctx, &container.Init{Props: props})
 	require.NoError(t, err)
 
-	res := c.Run(ctx, cmd, workDir, oci.Credentials{})
+	res := c.Run(ctx, cmd, workDir, oci.Credentials{}, &interfaces.Stdio{})
 
 	require.NotEqual(t, 0, res.ExitCode, "sanity check: command should have failed")
 	require.NotNil(t, res.UsageStats, "usage stats should not be nil")
@@ -633,7 +633,7 @@ func TestPodmanRun_RecordsStats(t *testing.T) {
 	c, err := provider.New(ctx, &container.Init{Props: props})
 	require.NoError(t, err)
 
-	res := c.Run(ctx, cmd, workDir, oci.Credentials{})
+	res := c.Run(ctx, cmd, workDir, oci.Credentials{}, &interfaces.Stdio{})
 	require.NoError(t, res.Error)
 	t.Log(string(res.Stderr))
 	require.Equal(t, res.ExitCode, 0)
@@ -674,7 +674,7 @@ func TestSignal(t *testing.T) {
 		require.NoError(t, err)
 	}()
 
-	result := c.Run(ctx, cmd, workDir, oci.Credentials{})
+	result := c.Run(ctx, cmd, workDir, oci.Credentials{}, &interfaces.Stdio{})
 	assert.NoError(t, result.Error)
 	assert.Empty(t, string(result.Stderr))
 	assert.Equal(t, "Got SIGTERM\n", string(result.Stdout))
@@ -1241,7 +1241,7 @@ func (r *Env) Execute(command *repb.Command, opts *ExecuteOpts) *Command {
 }
 
 // RunFunc is the function signature for runner.Runner.Run().
-type RunFunc func(ctx context.Context, ioStats *repb.IOStats) *interfaces.CommandResult
+type RunFunc func(ctx context.Context, ioStats *repb.IOStats, liveOutput *interfaces.Stdio) *interfaces.CommandResult
 
 // RunInterceptor returns a command result for testing purposes, optionally
 // delegating to the real runner implementation to execute the command and get a
@@ -1265,7 +1265,7 @@ func ReturnForFirstAttempt(result *interfaces.CommandResult) RunInterceptor {
 		if n := atomic.AddInt32(&attempt, 1); n == 1 {
 			return result
 		}
-		return original(ctx, &repb.IOStats{})
+		return original(ctx, &repb.IOStats{}, nil /*=liveOutput*/)
 	}
 }
 
@@ -1332,9 +1332,9 @@ type testRunner struct {
 	downloadInputs DownloadInputsFunc
 }
 
-func (r *testRunner) Run(ctx context.Context, ioStats *repb.IOStats) *interfaces.CommandResult {
+func (r *testRunner) Run(ctx context.Context, ioStats *repb.IOStats, liveOutput *interfaces.Stdio) *interfaces.CommandResult {
 	if r.run == nil {
-		return r.Runner.Run(ctx, ioStats)
+		return r.Runner.Run(ctx, ioStats, liveOutput)
 	}
 	return r.run(ctx, r.Runner.Run)
 }
@@ -5,9 +5,13 @@ import (
 	"strings"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
@@ -237,3 +241,35 @@ func GetCachedExecuteResponse(ctx context.Context, ac repb.ActionCacheClient, ta
 	}
 	return executeResponse, nil
 }
+
+// CheckReadable returns a NotFound error if the execution does not exist in
+// the primary DB or is not readable by the authenticated user.
+func CheckReadable(ctx context.Context, env environment.Env, executionID string) error {
+	if env.GetDBHandle() == nil {
+		return status.FailedPreconditionError("database not configured")
+	}
+	q := query_builder.NewQuery(`
+		SELECT e.* FROM "Executions" e
+		LEFT JOIN "Invocations" i ON i.invocation_id = e.invocation_id
+	`)
+	q.AddWhereClause(`e.execution_id = ?`, executionID)
+	permClauses, err := perms.GetPermissionsCheckClauses(ctx, env, q, "e")
+	if err != nil {
+		return err
+	}
+	// Executions inherit OTHERS_READ from their invocation.
+	permClauses.AddOr("i.perms IS NOT NULL AND i.perms & ? != 0", perms.OTHERS_READ)
+	permQuery, permArgs := permClauses.Build()
+	q.AddWhereClause("("+permQuery+")", permArgs...)
+
+	queryStr, args := q.Build()
+	rq := env.GetDBHandle().NewQuery(ctx, "execution_check_readable").Raw(queryStr, args...)
+	executions, err := db.ScanAll(rq, &tables.Execution{})
+	if err != nil {
+		return err
+	}
+	if len(executions) == 0 {
+		return status.NotFoundErrorf("execution %q not found", executionID)
+	}
+	return nil
+}
@@ -7,34 +7,82 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/fieldgetter"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/restapi"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	gh_backend "github.com/buildbuddy-io/buildbuddy/server/backends/github"
+)
+
+var (
+	serverURL   = flag.String("bitbucket.server_url", "", "The URL of the Bitbucket Server or Data Center instance that hosts workflow repos, including https:// and no trailing slash. If unset, workflow repos are expected to be hosted on Bitbucket Cloud. ** Enterprise only **")
+	cloudAPIURL = flag.String("bitbucket.cloud_api_url", "https://api.bitbucket.org/2.0", "The URL of the Bitbucket Cloud REST API. ** Enterprise only **")
 )
 
 const (
 	expectedUserAgent = "Bitbucket-Webhooks/2.0"
-	repoBaseURL       = "https://bitbucket.org/"
+	cloudHost         = "bitbucket.org"
+
+	// Name of the webhooks registered by BuildBuddy.
+	webhookName = "BuildBuddy"
 )
 
-type bitbucketGitProvider struct{}
+// restAPI is implemented by the Bitbucket Cloud and Bitbucket Server REST
+// APIs, which differ in how repos, users, and webhooks are identified.
+type restAPI interface {
+	registerWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error)
+	unregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error
+	getFileContents(ctx context.Context, accessToken, repoURL, filePath, ref string) ([]byte, error)
+	isTrusted(ctx context.Context, accessToken, repoURL, user string) (bool, error)
+	createStatus(ctx context.Context, accessToken, repoURL, commitSHA string, s *buildStatus) error
+}
+
+type bitbucketGitProvider struct {
+	client *restapi.Client
+}
 
 func NewProvider() interfaces.GitProvider {
-	return &bitbucketGitProvider{}
+	return &bitbucketGitProvider{client: restapi.New("Bitbucket")}
+}
+
+// api returns the REST API of the configured Bitbucket deployment.
+func (p *bitbucketGitProvider) api() (restAPI, error) {
+	if *serverURL == "" {
+		return &cloudAPI{client: p.client, baseURL: strings.TrimSuffix(*cloudAPIURL, "/")}, nil
+	}
+	u, err := url.Parse(strings.TrimSuffix(*serverURL, "/"))
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid bitbucket.server_url %q: %s", *serverURL, err)
+	}
+	return &serverAPI{client: p.client, serverURL: u}, nil
 }
 
 func (*bitbucketGitProvider) ParseWebhookData(r *http.Request) (*interfaces.WebhookData, error) {
+	eventName := r.Header.Get("X-Event-Key")
+	// Bitbucket Server event names are prefixed with "pr:" rather than
+	// "pullrequest:", and Bitbucket Server sends "repo:refs_changed" rather
+	// than "repo:push".
+	if strings.HasPrefix(eventName, "pr:") || eventName == "repo:refs_changed" {
+		return parseServerWebhookData(r, eventName)
+	}
 	if userAgent := r.Header.Get("User-Agent"); userAgent != expectedUserAgent {
 		return nil, status.UnimplementedErrorf("unexpected user agent: %q; only %q is supported", userAgent, expectedUserAgent)
 	}
-	switch eventName := r.Header.Get("X-Event-Key"); eventName {
+	switch eventName {
 	case "repo:push":
 		payload := &PushEventPayload{}
 		if err := unmarshalBody(r, payload); err != nil {
 			return nil, status.InvalidArgumentErrorf("failed to unmarshal push event payload: %s", err)
 		}
+		// Ignore branch deletion events.
+		if payload.Push != nil && len(payload.Push.Changes) > 0 && payload.Push.Changes[0].New == nil {
+			return nil, nil
+		}
 		v, err := fieldgetter.ExtractValues(
 			payload,
 			"Push.Changes.0.New.Name",
@@ -58,13 +106,15 @@ func (*bitbucketGitProvider) ParseWebhookData(r *http.Request) (*interfaces.Webh
 			TargetBranch:  branch,
 			SHA:           v["Push.Changes.0.New.Target.Hash"],
 		}, nil
-	case "pullrequest:created", "pullrequest:updated":
+	case "pullrequest:created", "pullrequest:updated", "pullrequest:approved":
 		payload := &PullRequestEventPayload{}
 		if err := unmarshalBody(r, payload); err != nil {
 			return nil, status.InvalidArgumentErrorf("failed to unmarshal %q event payload: %s", eventName, err)
 		}
 		v, err := fieldgetter.ExtractValues(
 			payload,
+			"PullRequest.ID",
+			"PullRequest.Author.UUID",
 			"PullRequest.Destination.Repository.UUID",
 			"PullRequest.Destination.Repository.Links.HTML.Href",
 			"PullRequest.Destination.Branch.Name",
@@ -76,14 +126,25 @@ func (*bitbucketGitProvider) ParseWebhookData(r *http.Request) (*interfaces.Webh
 		if err != nil {
 			return nil, err
 		}
-		return &interfaces.WebhookData{
-			EventName:     webhook_data.EventName.PullRequest,
-			PushedRepoURL: v["PullRequest.Source.Repository.Links.HTML.Href"],
-			PushedBranch:  v["PullRequest.Source.Branch.Name"],
-			SHA:           v["PullRequest.Source.Commit.Hash"],
-			TargetRepoURL: v["PullRequest.Destination.Repository.Links.HTML.Href"],
-			TargetBranch:  v["PullRequest.Destination.Branch.Name"],
-		}, nil
+		wd := &interfaces.WebhookData{
+			EventName:         webhook_data.EventName.PullRequest,
+			PushedRepoURL:     v["PullRequest.Source.Repository.Links.HTML.Href"],
+			PushedBranch:      v["PullRequest.Source.Branch.Name"],
+			SHA:               v["PullRequest.Source.Commit.Hash"],
+			TargetRepoURL:     v["PullRequest.Destination.Repository.Links.HTML.Href"],
+			TargetBranch:      v["PullRequest.Destination.Branch.Name"],
+			PullRequestNumber: payload.PullRequest.ID,
+			// Bitbucket Cloud's permissions API identifies users by UUID, so
+			// use UUIDs rather than usernames for trust checks.
+			PullRequestAuthor: v["PullRequest.Author.UUID"],
+		}
+		if eventName == "pullrequest:approved" {
+			if payload.Approval == nil || payload.Approval.User == nil || payload.Approval.User.UUID == "" {
+				return nil, status.InvalidArgumentError("pull request approval event payload is missing the approving user")
+			}
+			wd.PullRequestApprover = payload.Approval.User.UUID
+		}
+		return wd, nil
 	default:
 		log.Printf("Ignoring webhook event: %s", eventName)
 		return nil, nil
@@ -91,31 +152,105 @@ func (*bitbucketGitProvider) ParseWebhookData(r *http.Request) (*interfaces.Webh
 }
 
 func (*bitbucketGitProvider) MatchRepoURL(u *url.URL) bool {
-	return u.Host == "bitbucket.com"
+	if *serverURL == "" {
+		return u.Host == cloudHost
+	}
+	su, err := url.Parse(*serverURL)
+	if err != nil {
+		return false
+	}
+	return u.Host == su.Host
 }
 
 func (*bitbucketGitProvider) MatchWebhookRequest(r *http.Request) bool {
 	return r.Header.Get("X-Event-Key") != ""
 }
 
-func (*bitbucketGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error) {
-	return "", status.UnimplementedError("Not implemented")
+// RegisterWebhook registers the given webhook to the repo and returns the ID of
+// the registered webhook.
+func (p *bitbucketGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error) {
+	api, err := p.api()
+	if err != nil {
+		return "", err
+	}
+	return api.registerWebhook(ctx, accessToken, repoURL, webhookURL)
 }
 
-func (*bitbucketGitProvider) UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
-	return status.UnimplementedError("Not implemented")
+// UnregisterWebhook removes the webhook from the repo.
+func (p *bitbucketGitProvider) UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
+	api, err := p.api()
+	if err != nil {
+		return err
+	}
+	return api.unregisterWebhook(ctx, accessToken, repoURL, webhookID)
 }
 
-func (*bitbucketGitProvider) GetFileContents(ctx context.Context, accessToken, repoURL, filePath, ref string) ([]byte, error) {
-	return nil, status.UnimplementedError("Not implemented")
+func (p *bitbucketGitProvider) GetFileContents(ctx context.Context, accessToken, repoURL, filePath, ref string) ([]byte, error) {
+	api, err := p.api()
+	if err != nil {
+		return nil, err
+	}
+	return api.getFileContents(ctx, accessToken, repoURL, filePath, ref)
 }
 
-func (*bitbucketGitProvider) IsTrusted(ctx context.Context, accessToken, repoURL, user string) (bool, error) {
-	return false, status.UnimplementedError("Not implemented")
+func (p *bitbucketGitProvider) IsTrusted(ctx context.Context, accessToken, repoURL, user string) (bool, error) {
+	api, err := p.api()
+	if err != nil {
+		return false, err
+	}
+	return api.isTrusted(ctx, accessToken, repoURL, user)
 }
 
-func (*bitbucketGitProvider) CreateStatus(ctx context.Context, accessToken, repoURL, commitSHA string, payload any) error {
-	return status.UnimplementedError("Not implemented")
+// CreateStatus publishes a build status to the given commit. The payload is a
+// GitHub status payload, which is translated to its Bitbucket equivalent.
+func (p *bitbucketGitProvider) CreateStatus(ctx context.Context, accessToken, repoURL, commitSHA string, payload any) error {
+	s, ok := payload.(*gh_backend.GithubStatusPayload)
+	if !ok {
+		return status.InvalidArgumentErrorf("invalid status payload type %T (expected %T)", payload, &gh_backend.GithubStatusPayload{})
+	}
+	api, err := p.api()
+	if err != nil {
+		return err
+	}
+	return api.createStatus(ctx, accessToken, repoURL, commitSHA, &buildStatus{
+		Key:         s.GetContext(),
+		State:       buildStatusState(gh_backend.State(s.GetState())),
+		Name:        s.GetContext(),
+		URL:         s.GetTargetURL(),
+		Description: s.GetDescription(),
+	})
+}
+
+// buildStatus is the request body of the Bitbucket Cloud and Bitbucket Server
+// build status APIs, which share the same schema.
+type buildStatus struct {
+	Key         string `json:"key"`
+	State       string `json:"state"`
+	Name        string `json:"name,omitempty"`
+	URL         string `json:"url"`
+	Description string `json:"description,omitempty"`
+}
+
+// buildStatusState returns the Bitbucket build status state corresponding to
+// the given GitHub status state.
+func buildStatusState(state gh_backend.State) string {
+	switch state {
+	case gh_backend.PendingState:
+		return "INPROGRESS"
+	case gh_backend.SuccessState:
+		return "SUCCESSFUL"
+	default:
+		return "FAILED"
+	}
+}
+
+// escapePath escapes each segment of a slash-separated path.
+func escapePath(p string) string {
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
 }
 
 func unmarshalBody(r *http.Request, payload interface{}) error {
@@ -136,6 +271,8 @@ type PushDetails struct {
 	Changes []*PushedChange `json:"changes"`
 }
 type PushedChange struct {
+	// New contains the state of the ref after the push. It is nil if the ref
+	// was deleted.
 	New *RefState `json:"new"`
 }
 type RefState struct {
@@ -152,8 +289,12 @@ type RefState struct {
 type PullRequestEventPayload struct {
 	PullRequest *PullRequestDetails `json:"pullrequest"`
 	Repository  *Repository         `json:"repository"`
+	// Approval is only set for approval events.
+	Approval *Approval `json:"approval"`
 }
 type PullRequestDetails struct {
+	ID          int64            `json:"id"`
+	Author      *User            `json:"author"`
 	Source      *PullRequestSide `json:"source"`
 	Destination *PullRequestSide `json:"destination"`
 }
@@ -165,6 +306,9 @@ type PullRequestSide struct {
 type Branch struct {
 	Name string `json:"name"`
 }
+type Approval struct {
+	User *User `json:"user"`
+}
 
 // Repository represents a subset of Bitbucket's Repository schema, which is
 // a common entity used in multiple webhook events.
@@ -181,6 +325,13 @@ type RepositoryLink struct {
 	Href string `json:"href"`
 }
 
+// User represents a subset of Bitbucket's User schema.
+// See https://support.atlassian.com/bitbucket-cloud/docs/event-payloads/#User
+type User struct {
+	UUID      string `json:"uuid"`
+	AccountID string `json:"account_id"`
+}
+
 // Commit represents a subset of Bitbucket's Commit schema, which is
 // a common entity used in multiple webhook events.
 // It isn't officially documented, but multiple event types use this
@@ -2,13 +2,23 @@ package bitbucket_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/bitbucket"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/bitbucket/test_data"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	gh_backend "github.com/buildbuddy-io/buildbuddy/server/backends/github"
 )
 
 func webhookRequest(t *testing.T, eventType string, payload []byte) *http.Request {
@@ -45,11 +55,206 @@ func TestParseRequest_ValidPullRequestEvent_Success(t *testing.T) {
 
 	assert.NoError(t, err)
 	assert.Equal(t, &interfaces.WebhookData{
-		EventName:     "pull_request",
-		PushedRepoURL: "https://bitbucket.org/buildbuddy/buildbuddy-ci-playground",
-		PushedBranch:  "test-1614450472",
-		SHA:           "a4822151d5d2",
-		TargetRepoURL: "https://bitbucket.org/buildbuddy/buildbuddy-ci-playground",
+		EventName:         "pull_request",
+		PushedRepoURL:     "https://bitbucket.org/buildbuddy/buildbuddy-ci-playground",
+		PushedBranch:      "test-1614450472",
+		SHA:               "a4822151d5d2",
+		TargetRepoURL:     "https://bitbucket.org/buildbuddy/buildbuddy-ci-playground",
+		TargetBranch:      "main",
+		PullRequestNumber: 2,
+		PullRequestAuthor: "{0cc3a8ab-9405-400d-9bf9-ebfd456a170b}",
+	}, data)
+}
+
+func serverWebhookRequest(t *testing.T, eventType string, payload []byte) *http.Request {
+	req, err := http.NewRequest("POST", "https://buildbuddy.io/webhooks/foo", bytes.NewReader(payload))
+	require.NoError(t, err)
+	req.Header.Add("X-Event-Key", eventType)
+	req.Header.Add("User-Agent", "Atlassian HttpClient 4.0.0 / Bitbucket-8.9.0 (8009000) / Default")
+	req.Header.Add("Content-Type", "application/json; charset=utf-8")
+	return req
+}
+
+func TestParseRequest_ValidServerPushEvent_Success(t *testing.T) {
+	flags.Set(t, "bitbucket.server_url", "https://git.acme.com")
+	req := serverWebhookRequest(t, "repo:refs_changed", test_data.ServerPushEvent)
+
+	data, err := bitbucket.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:     "push",
+		PushedRepoURL: "https://git.acme.com/scm/bb/buildbuddy-ci-playground.git",
+		PushedBranch:  "main",
+		SHA:           "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+		TargetRepoURL: "https://git.acme.com/scm/bb/buildbuddy-ci-playground.git",
 		TargetBranch:  "main",
 	}, data)
 }
+
+func TestParseRequest_ValidServerPullRequestEvent_Success(t *testing.T) {
+	flags.Set(t, "bitbucket.server_url", "https://git.acme.com")
+	req := serverWebhookRequest(t, "pr:opened", test_data.ServerPullRequestEvent)
+
+	data, err := bitbucket.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:         "pull_request",
+		PushedRepoURL:     "https://git.acme.com/scm/~test/buildbuddy-ci-playground.git",
+		PushedBranch:      "test-1709288571",
+		SHA:               "a4822151d5d2b79ebd7e5d7a38bd0de8c6e1e62b",
+		TargetRepoURL:     "https://git.acme.com/scm/bb/buildbuddy-ci-playground.git",
+		TargetBranch:      "main",
+		PullRequestNumber: 7,
+		PullRequestAuthor: "test",
+	}, data)
+}
+
+// fakeAPI is a fake Bitbucket REST API that serves the given responses,
+// keyed by method and escaped path, and records request bodies.
+type fakeAPI struct {
+	responses map[string]string
+	requests  map[string]map[string]any
+}
+
+func newFakeAPI(t *testing.T, responses map[string]string) (*fakeAPI, string) {
+	f := &fakeAPI{responses: responses, requests: map[string]map[string]any{}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer TOKEN" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		key := r.Method + " " + r.URL.EscapedPath()
+		if r.URL.RawQuery != "" {
+			key += "?" + r.URL.RawQuery
+		}
+		rsp, ok := f.responses[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Body != nil {
+			body := map[string]any{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err == nil {
+				f.requests[key] = body
+			}
+		}
+		io.WriteString(w, rsp)
+	}))
+	t.Cleanup(server.Close)
+	return f, server.URL
+}
+
+func TestCloudAPI(t *testing.T) {
+	const repoPath = "/2.0/repositories/acme/api"
+	f, apiURL := newFakeAPI(t, map[string]string{
+		"GET " + repoPath: `{"uuid": "{repo}"}`,
+		"GET " + repoPath + "/src/abc123/buildbuddy.yaml":                                          "actions: []\n",
+		"POST " + repoPath + "/hooks":                                                              `{"uuid": "{hook-uuid}"}`,
+		"DELETE " + repoPath + "/hooks/%7Bhook-uuid%7D":                                            ``,
+		"POST " + repoPath + "/commit/abc123/statuses/build":                                       `{}`,
+		"GET /2.0/workspaces/acme/permissions/repositories/api?q=user.uuid%3D%22%7Bwriter%7D%22":   `{"values": [{"permission": "write", "user": {"uuid": "{writer}"}}]}`,
+		"GET /2.0/workspaces/acme/permissions/repositories/api?q=user.uuid%3D%22%7Breader%7D%22":   `{"values": [{"permission": "read", "user": {"uuid": "{reader}"}}]}`,
+		"GET /2.0/workspaces/acme/permissions/repositories/api?q=user.uuid%3D%22%7Bstranger%7D%22": `{"values": []}`,
+	})
+	flags.Set(t, "bitbucket.cloud_api_url", apiURL+"/2.0")
+
+	ctx := context.Background()
+	repoURL := "https://bitbucket.org/acme/api"
+	provider := bitbucket.NewProvider()
+
+	b, err := provider.GetFileContents(ctx, "TOKEN", repoURL, "buildbuddy.yaml", "abc123")
+	require.NoError(t, err)
+	assert.Equal(t, "actions: []\n", string(b))
+	_, err = provider.GetFileContents(ctx, "TOKEN", repoURL, "buildbuddy.yaml", "def456")
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+	_, err = provider.GetFileContents(ctx, "TOKEN", "https://bitbucket.org/acme/missing", "buildbuddy.yaml", "abc123")
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+
+	for user, expected := range map[string]bool{"{writer}": true, "{reader}": false, "{stranger}": false} {
+		trusted, err := provider.IsTrusted(ctx, "TOKEN", repoURL, user)
+		require.NoError(t, err)
+		assert.Equal(t, expected, trusted, "user %s", user)
+	}
+
+	payload := gh_backend.NewGithubStatusPayload("Test", "https://app.buildbuddy.io/invocation/1", "Running", gh_backend.PendingState)
+	err = provider.CreateStatus(ctx, "TOKEN", repoURL, "abc123", payload)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"key":         "Test",
+		"state":       "INPROGRESS",
+		"name":        "Test",
+		"url":         "https://app.buildbuddy.io/invocation/1",
+		"description": "Running",
+	}, f.requests["POST "+repoPath+"/commit/abc123/statuses/build"])
+
+	id, err := provider.RegisterWebhook(ctx, "TOKEN", repoURL, "https://app.buildbuddy.io/webhooks/workflow/1")
+	require.NoError(t, err)
+	assert.Equal(t, "{hook-uuid}", id)
+	assert.Equal(t, "https://app.buildbuddy.io/webhooks/workflow/1", f.requests["POST "+repoPath+"/hooks"]["url"])
+	err = provider.UnregisterWebhook(ctx, "TOKEN", repoURL, id)
+	require.NoError(t, err)
+
+	_, err = provider.GetFileContents(ctx, "WRONG_TOKEN", repoURL, "buildbuddy.yaml", "abc123")
+	assert.True(t, status.IsUnauthenticatedError(err), "expected Unauthenticated, got %v", err)
+}
+
+func TestServerAPI(t *testing.T) {
+	const repoPath = "/bitbucket/rest/api/1.0/projects/BB/repos/api"
+	const projectPath = "/bitbucket/rest/api/1.0/projects/BB"
+	f, serverURL := newFakeAPI(t, map[string]string{
+		"GET " + repoPath: `{"slug": "api"}`,
+		"GET " + repoPath + "/raw/buildbuddy.yaml?at=abc123":      "actions: []\n",
+		"POST " + repoPath + "/webhooks":                          `{"id": 12}`,
+		"DELETE " + repoPath + "/webhooks/12":                     ``,
+		"POST " + repoPath + "/commits/abc123/builds":             ``,
+		"GET " + repoPath + "/permissions/users?filter=writer":    `{"values": [{"user": {"name": "writer"}, "permission": "REPO_WRITE"}]}`,
+		"GET " + repoPath + "/permissions/users?filter=reader":    `{"values": [{"user": {"name": "reader"}, "permission": "REPO_READ"}]}`,
+		"GET " + projectPath + "/permissions/users?filter=reader": `{"values": []}`,
+		"GET " + repoPath + "/permissions/users?filter=admin":     `{"values": []}`,
+		"GET " + projectPath + "/permissions/users?filter=admin":  `{"values": [{"user": {"name": "admin"}, "permission": "PROJECT_ADMIN"}]}`,
+
+		// Users can also get write access through groups.
+		"GET " + repoPath + "/permissions/users?filter=developer":                                                `{"values": []}`,
+		"GET " + projectPath + "/permissions/users?filter=developer":                                             `{"values": []}`,
+		"GET " + repoPath + "/permissions/groups?start=0&limit=1000":                                             `{"values": [{"group": {"name": "viewers"}, "permission": "REPO_READ"}], "isLastPage": false, "nextPageStart": 1}`,
+		"GET " + repoPath + "/permissions/groups?start=1&limit=1000":                                             `{"values": [{"group": {"name": "devs"}, "permission": "REPO_WRITE"}], "isLastPage": true}`,
+		"GET " + projectPath + "/permissions/groups?start=0&limit=1000":                                          `{"values": [], "isLastPage": true}`,
+		"GET /bitbucket/rest/api/1.0/admin/groups/more-members?context=devs&filter=developer&start=0&limit=1000": `{"values": [{"name": "developer"}], "isLastPage": true}`,
+		"GET /bitbucket/rest/api/1.0/admin/groups/more-members?context=devs&filter=reader&start=0&limit=1000":    `{"values": [{"name": "reader2"}], "isLastPage": true}`,
+	})
+	flags.Set(t, "bitbucket.server_url", serverURL+"/bitbucket")
+
+	ctx := context.Background()
+	provider := bitbucket.NewProvider()
+	for _, repoURL := range []string{serverURL + "/bitbucket/scm/BB/api.git", serverURL + "/bitbucket/projects/BB/repos/api/browse"} {
+		u, err := url.Parse(repoURL)
+		require.NoError(t, err)
+		assert.True(t, provider.MatchRepoURL(u))
+
+		b, err := provider.GetFileContents(ctx, "TOKEN", repoURL, "buildbuddy.yaml", "abc123")
+		require.NoError(t, err)
+		assert.Equal(t, "actions: []\n", string(b))
+		_, err = provider.GetFileContents(ctx, "TOKEN", repoURL, "buildbuddy.yaml", "def456")
+		assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+	}
+	repoURL := serverURL + "/bitbucket/scm/BB/api.git"
+
+	for user, expected := range map[string]bool{"writer": true, "reader": false, "admin": true, "developer": true} {
+		trusted, err := provider.IsTrusted(ctx, "TOKEN", repoURL, user)
+		require.NoError(t, err)
+		assert.Equal(t, expected, trusted, "user %s", user)
+	}
+
+	payload := gh_backend.NewGithubStatusPayload("Test", "https://app.buildbuddy.io/invocation/1", "Failed", gh_backend.FailureState)
+	err := provider.CreateStatus(ctx, "TOKEN", repoURL, "abc123", payload)
+	require.NoError(t, err)
+	assert.Equal(t, "FAILED", f.requests["POST "+repoPath+"/commits/abc123/builds"]["state"])
+
+	id, err := provider.RegisterWebhook(ctx, "TOKEN", repoURL, "https://app.buildbuddy.io/webhooks/workflow/1")
+	require.NoError(t, err)
+	assert.Equal(t, "12", id)
+	err = provider.UnregisterWebhook(ctx, "TOKEN", repoURL, id)
+	require.NoError(t, err)
+}
@@ -0,0 +1,145 @@
+package bitbucket
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/restapi"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+var (
+	// Bitbucket Cloud event names to listen for on the webhook.
+	cloudEventsToReceive = []string{"repo:push", "pullrequest:created", "pullrequest:updated", "pullrequest:approved"}
+)
+
+// cloudAPI implements the Bitbucket Cloud REST API.
+// See https://developer.atlassian.com/cloud/bitbucket/rest/
+type cloudAPI struct {
+	client  *restapi.Client
+	baseURL string
+}
+
+// parseCloudRepoURL returns the workspace and repo slug of the repo with the
+// given URL.
+// Ex: "https://bitbucket.org/acme/backend.git" -> "acme", "backend"
+func parseCloudRepoURL(repoURL string) (string, string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", "", status.InvalidArgumentErrorf("invalid repo URL %q: %s", repoURL, err)
+	}
+	parts := strings.Split(strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", status.InvalidArgumentErrorf("invalid Bitbucket Cloud repo URL %q", repoURL)
+	}
+	return parts[0], parts[1], nil
+}
+
+// repoAPIURL returns the API URL of the repo with the given URL.
+func (a *cloudAPI) repoAPIURL(repoURL string) (string, error) {
+	workspace, repoSlug, err := parseCloudRepoURL(repoURL)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/repositories/%s/%s", a.baseURL, url.PathEscape(workspace), url.PathEscape(repoSlug)), nil
+}
+
+func (a *cloudAPI) registerWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error) {
+	repoAPIURL, err := a.repoAPIURL(repoURL)
+	if err != nil {
+		return "", err
+	}
+	req := &cloudWebhook{
+		Description: webhookName,
+		URL:         webhookURL,
+		Active:      true,
+		Events:      cloudEventsToReceive,
+	}
+	hook := &cloudWebhook{}
+	if err := a.client.Do(ctx, accessToken, http.MethodPost, repoAPIURL+"/hooks", req, hook); err != nil {
+		return "", err
+	}
+	if hook.UUID == "" {
+		return "", status.UnknownError("Bitbucket returned invalid response from hooks API (missing uuid field).")
+	}
+	return hook.UUID, nil
+}
+
+func (a *cloudAPI) unregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
+	repoAPIURL, err := a.repoAPIURL(repoURL)
+	if err != nil {
+		return err
+	}
+	return a.client.Do(ctx, accessToken, http.MethodDelete, repoAPIURL+"/hooks/"+url.PathEscape(webhookID), nil, nil)
+}
+
+func (a *cloudAPI) getFileContents(ctx context.Context, accessToken, repoURL, filePath, ref string) ([]byte, error) {
+	repoAPIURL, err := a.repoAPIURL(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	fileURL := repoAPIURL + "/src/" + url.PathEscape(ref) + "/" + escapePath(filePath)
+	return a.client.GetFile(ctx, accessToken, fileURL, repoAPIURL, repoURL, filePath)
+}
+
+// isTrusted returns whether the user with the given UUID has write access to
+// the repo.
+func (a *cloudAPI) isTrusted(ctx context.Context, accessToken, repoURL, user string) (bool, error) {
+	workspace, repoSlug, err := parseCloudRepoURL(repoURL)
+	if err != nil {
+		return false, err
+	}
+	// This API returns the effective permission of the user, including
+	// permissions granted through groups.
+	permissionsURL := fmt.Sprintf(
+		"%s/workspaces/%s/permissions/repositories/%s?q=%s",
+		a.baseURL, url.PathEscape(workspace), url.PathEscape(repoSlug),
+		url.QueryEscape(fmt.Sprintf("user.uuid=%q", user)))
+	rsp := &cloudRepoPermissions{}
+	if err := a.client.Do(ctx, accessToken, http.MethodGet, permissionsURL, nil, rsp); err != nil {
+		return false, status.UnknownErrorf("get repository permissions: %s", err)
+	}
+	for _, p := range rsp.Values {
+		if p.User == nil || p.User.UUID != user {
+			continue
+		}
+		// Trusted workflows get cache write perms, so if the user doesn't
+		// have write perms for the repo then don't consider the workflow
+		// trusted.
+		if p.Permission == "write" || p.Permission == "admin" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (a *cloudAPI) createStatus(ctx context.Context, accessToken, repoURL, commitSHA string, s *buildStatus) error {
+	repoAPIURL, err := a.repoAPIURL(repoURL)
+	if err != nil {
+		return err
+	}
+	statusURL := repoAPIURL + "/commit/" + url.PathEscape(commitSHA) + "/statuses/build"
+	return a.client.Do(ctx, accessToken, http.MethodPost, statusURL, s, nil)
+}
+
+// cloudWebhook is the request and response body of Bitbucket Cloud's webhooks
+// API.
+type cloudWebhook struct {
+	UUID        string   `json:"uuid,omitempty"`
+	Description string   `json:"description"`
+	URL         string   `json:"url"`
+	Active      bool     `json:"active"`
+	Events      []string `json:"events"`
+}
+
+// cloudRepoPermissions is the response body of Bitbucket Cloud's repository
+// permissions API.
+type cloudRepoPermissions struct {
+	Values []struct {
+		Permission string `json:"permission"`
+		User       *User  `json:"user"`
+	} `json:"values"`
+}
@@ -0,0 +1,407 @@
+package bitbucket
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/fieldgetter"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/restapi"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+var (
+	// Bitbucket Server event names to listen for on the webhook.
+	serverEventsToReceive = []string{"repo:refs_changed", "pr:opened", "pr:from_ref_updated", "pr:modified", "pr:reviewer:approved"}
+)
+
+// The maximum number of results requested per page from paginated Bitbucket
+// Server APIs.
+const serverPageLimit = 1000
+
+// serverAPI implements the Bitbucket Server and Data Center REST API.
+// See https://developer.atlassian.com/server/bitbucket/rest/
+type serverAPI struct {
+	client    *restapi.Client
+	serverURL *url.URL
+}
+
+// parseServerRepoURL returns the project key and repo slug of the repo with
+// the given URL, which may be either a clone URL or a browse URL.
+// Ex: "https://git.acme.com/scm/be/api.git" -> "be", "api"
+// Ex: "https://git.acme.com/projects/BE/repos/api/browse" -> "BE", "api"
+func parseServerRepoURL(serverURL *url.URL, repoURL string) (string, string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", "", status.InvalidArgumentErrorf("invalid repo URL %q: %s", repoURL, err)
+	}
+	// Bitbucket Server may be served under a context path, e.g.
+	// https://acme.com/bitbucket.
+	p := strings.Trim(strings.TrimPrefix(u.Path, serverURL.Path), "/")
+	parts := strings.Split(p, "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "scm":
+		return parts[1], strings.TrimSuffix(parts[2], ".git"), nil
+	case len(parts) >= 4 && parts[0] == "projects" && parts[2] == "repos":
+		return parts[1], parts[3], nil
+	default:
+		return "", "", status.InvalidArgumentErrorf("invalid Bitbucket Server repo URL %q", repoURL)
+	}
+}
+
+// serverCloneURL returns the HTTP clone URL of the given repo.
+func serverCloneURL(serverURL string, repo *ServerRepository) string {
+	return fmt.Sprintf("%s/scm/%s/%s.git", strings.TrimSuffix(serverURL, "/"), strings.ToLower(repo.Project.Key), repo.Slug)
+}
+
+// projectAPIURL returns the API URL of the project containing the repo with
+// the given URL.
+func (a *serverAPI) projectAPIURL(repoURL string) (string, error) {
+	projectKey, _, err := parseServerRepoURL(a.serverURL, repoURL)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/rest/api/1.0/projects/%s", a.serverURL, url.PathEscape(projectKey)), nil
+}
+
+// repoAPIURL returns the API URL of the repo with the given URL.
+func (a *serverAPI) repoAPIURL(repoURL string) (string, error) {
+	projectKey, repoSlug, err := parseServerRepoURL(a.serverURL, repoURL)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/rest/api/1.0/projects/%s/repos/%s", a.serverURL, url.PathEscape(projectKey), url.PathEscape(repoSlug)), nil
+}
+
+func (a *serverAPI) registerWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error) {
+	repoAPIURL, err := a.repoAPIURL(repoURL)
+	if err != nil {
+		return "", err
+	}
+	req := &serverWebhook{
+		Name:   webhookName,
+		URL:    webhookURL,
+		Active: true,
+		Events: serverEventsToReceive,
+	}
+	hook := &serverWebhook{}
+	if err := a.client.Do(ctx, accessToken, http.MethodPost, repoAPIURL+"/webhooks", req, hook); err != nil {
+		return "", err
+	}
+	if hook.ID == 0 {
+		return "", status.UnknownError("Bitbucket returned invalid response from webhooks API (missing id field).")
+	}
+	return strconv.FormatInt(hook.ID, 10), nil
+}
+
+func (a *serverAPI) unregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
+	repoAPIURL, err := a.repoAPIURL(repoURL)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.ParseInt(webhookID, 10 /*=base*/, 64 /*=bitSize*/); err != nil {
+		return status.InvalidArgumentErrorf("invalid Bitbucket Server webhook ID %q", webhookID)
+	}
+	return a.client.Do(ctx, accessToken, http.MethodDelete, repoAPIURL+"/webhooks/"+webhookID, nil, nil)
+}
+
+func (a *serverAPI) getFileContents(ctx context.Context, accessToken, repoURL, filePath, ref string) ([]byte, error) {
+	repoAPIURL, err := a.repoAPIURL(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	fileURL := repoAPIURL + "/raw/" + escapePath(filePath) + "?at=" + url.QueryEscape(ref)
+	return a.client.GetFile(ctx, accessToken, fileURL, repoAPIURL, repoURL, filePath)
+}
+
+// isTrusted returns whether the user with the given username has write
+// access to the repo, either directly or through the project that contains
+// it, and either as an individual user or as a member of a group.
+func (a *serverAPI) isTrusted(ctx context.Context, accessToken, repoURL, user string) (bool, error) {
+	repoAPIURL, err := a.repoAPIURL(repoURL)
+	if err != nil {
+		return false, err
+	}
+	projectAPIURL, err := a.projectAPIURL(repoURL)
+	if err != nil {
+		return false, err
+	}
+	// Trusted workflows get cache write perms, so if the user doesn't have
+	// write perms for the repo then don't consider the workflow trusted.
+	checks := []struct {
+		permissionsURL     string
+		trustedPermissions []string
+	}{
+		{repoAPIURL + "/permissions", []string{"REPO_WRITE", "REPO_ADMIN"}},
+		{projectAPIURL + "/permissions", []string{"PROJECT_WRITE", "PROJECT_ADMIN"}},
+	}
+	for _, c := range checks {
+		rsp := &serverUserPermissions{}
+		if err := a.client.Do(ctx, accessToken, http.MethodGet, c.permissionsURL+"/users?filter="+url.QueryEscape(user), nil, rsp); err != nil {
+			return false, status.UnknownErrorf("get user permissions: %s", err)
+		}
+		for _, p := range rsp.Values {
+			if p.User != nil && p.User.Name == user && slices.Contains(c.trustedPermissions, p.Permission) {
+				return true, nil
+			}
+		}
+	}
+	for _, c := range checks {
+		groups, err := listServerPages[serverGroupPermission](ctx, a.client, accessToken, c.permissionsURL+"/groups")
+		if err != nil {
+			return false, status.UnknownErrorf("get group permissions: %s", err)
+		}
+		for _, p := range groups {
+			if p.Group == nil || !slices.Contains(c.trustedPermissions, p.Permission) {
+				continue
+			}
+			isMember, err := a.isGroupMember(ctx, accessToken, p.Group.Name, user)
+			if err != nil {
+				return false, status.UnknownErrorf("get members of group %q: %s", p.Group.Name, err)
+			}
+			if isMember {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// isGroupMember returns whether the user with the given username is a member
+// of the group.
+func (a *serverAPI) isGroupMember(ctx context.Context, accessToken, group, user string) (bool, error) {
+	membersURL := fmt.Sprintf("%s/rest/api/1.0/admin/groups/more-members?context=%s&filter=%s", a.serverURL, url.QueryEscape(group), url.QueryEscape(user))
+	// The filter matches substrings of usernames, so other users may be
+	// listed too.
+	members, err := listServerPages[ServerUser](ctx, a.client, accessToken, membersURL)
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(members, func(m ServerUser) bool { return m.Name == user }), nil
+}
+
+// listServerPages returns the values from every page of a paginated
+// Bitbucket Server API.
+func listServerPages[T any](ctx context.Context, client *restapi.Client, accessToken, apiURL string) ([]T, error) {
+	sep := "?"
+	if strings.Contains(apiURL, "?") {
+		sep = "&"
+	}
+	var values []T
+	start := 0
+	for {
+		page := &serverPage[T]{}
+		pageURL := fmt.Sprintf("%s%sstart=%d&limit=%d", apiURL, sep, start, serverPageLimit)
+		if err := client.Do(ctx, accessToken, http.MethodGet, pageURL, nil, page); err != nil {
+			return nil, err
+		}
+		values = append(values, page.Values...)
+		if page.IsLastPage || len(page.Values) == 0 {
+			return values, nil
+		}
+		start = page.NextPageStart
+	}
+}
+
+func (a *serverAPI) createStatus(ctx context.Context, accessToken, repoURL, commitSHA string, s *buildStatus) error {
+	repoAPIURL, err := a.repoAPIURL(repoURL)
+	if err != nil {
+		return err
+	}
+	statusURL := repoAPIURL + "/commits/" + url.PathEscape(commitSHA) + "/builds"
+	return a.client.Do(ctx, accessToken, http.MethodPost, statusURL, s, nil)
+}
+
+func parseServerWebhookData(r *http.Request, eventName string) (*interfaces.WebhookData, error) {
+	if *serverURL == "" {
+		return nil, status.FailedPreconditionErrorf("received Bitbucket Server %q event, but bitbucket.server_url is not configured", eventName)
+	}
+	switch eventName {
+	case "repo:refs_changed":
+		payload := &ServerRefsChangedEventPayload{}
+		if err := unmarshalBody(r, payload); err != nil {
+			return nil, status.InvalidArgumentErrorf("failed to unmarshal %q event payload: %s", eventName, err)
+		}
+		v, err := fieldgetter.ExtractValues(
+			payload,
+			"Changes.0.Ref.DisplayID",
+			"Changes.0.Ref.Type",
+			"Changes.0.Type",
+			"Changes.0.ToHash",
+			"Repository.Slug",
+			"Repository.Project.Key",
+			"Repository.Public",
+		)
+		if err != nil {
+			return nil, err
+		}
+		if t := v["Changes.0.Ref.Type"]; t != "BRANCH" {
+			log.Printf("Ignoring non-branch push event (type %q)", t)
+			return nil, nil
+		}
+		// Ignore branch deletion events.
+		if v["Changes.0.Type"] == "DELETE" {
+			return nil, nil
+		}
+		repoURL := serverCloneURL(*serverURL, payload.Repository)
+		branch := v["Changes.0.Ref.DisplayID"]
+		return &interfaces.WebhookData{
+			EventName:          webhook_data.EventName.Push,
+			PushedRepoURL:      repoURL,
+			PushedBranch:       branch,
+			TargetRepoURL:      repoURL,
+			TargetBranch:       branch,
+			SHA:                v["Changes.0.ToHash"],
+			IsTargetRepoPublic: v["Repository.Public"] == "true",
+		}, nil
+	case "pr:opened", "pr:from_ref_updated", "pr:modified", "pr:reviewer:approved":
+		payload := &ServerPullRequestEventPayload{}
+		if err := unmarshalBody(r, payload); err != nil {
+			return nil, status.InvalidArgumentErrorf("failed to unmarshal %q event payload: %s", eventName, err)
+		}
+		// "pr:modified" is also sent when the title or description changes,
+		// so only handle it if the target branch changed.
+		if eventName == "pr:modified" && payload.PreviousTarget == nil {
+			return nil, nil
+		}
+		v, err := fieldgetter.ExtractValues(
+			payload,
+			"PullRequest.ID",
+			"PullRequest.Author.User.Name",
+			"PullRequest.FromRef.DisplayID",
+			"PullRequest.FromRef.LatestCommit",
+			"PullRequest.FromRef.Repository.Slug",
+			"PullRequest.ToRef.DisplayID",
+			"PullRequest.ToRef.Repository.Slug",
+			"PullRequest.ToRef.Repository.Public",
+		)
+		if err != nil {
+			return nil, err
+		}
+		pr := payload.PullRequest
+		if pr.FromRef.Repository.Project == nil || pr.ToRef.Repository.Project == nil {
+			return nil, status.InvalidArgumentErrorf("%q event payload is missing repository project", eventName)
+		}
+		wd := &interfaces.WebhookData{
+			EventName:          webhook_data.EventName.PullRequest,
+			PushedRepoURL:      serverCloneURL(*serverURL, pr.FromRef.Repository),
+			PushedBranch:       v["PullRequest.FromRef.DisplayID"],
+			SHA:                v["PullRequest.FromRef.LatestCommit"],
+			TargetRepoURL:      serverCloneURL(*serverURL, pr.ToRef.Repository),
+			TargetBranch:       v["PullRequest.ToRef.DisplayID"],
+			IsTargetRepoPublic: v["PullRequest.ToRef.Repository.Public"] == "true",
+			PullRequestNumber:  pr.ID,
+			PullRequestAuthor:  v["PullRequest.Author.User.Name"],
+		}
+		if eventName == "pr:reviewer:approved" {
+			if payload.Participant == nil || payload.Participant.User == nil || payload.Participant.User.Name == "" {
+				return nil, status.InvalidArgumentError("pull request approval event payload is missing the approving user")
+			}
+			wd.PullRequestApprover = payload.Participant.User.Name
+		}
+		return wd, nil
+	default:
+		log.Printf("Ignoring webhook event: %s", eventName)
+		return nil, nil
+	}
+}
+
+// serverWebhook is the request and response body of Bitbucket Server's
+// webhooks API.
+type serverWebhook struct {
+	ID     int64    `json:"id,omitempty"`
+	Name   string   `json:"name"`
+	URL    string   `json:"url"`
+	Active bool     `json:"active"`
+	Events []string `json:"events"`
+}
+
+// serverPage is a page of results from a paginated Bitbucket Server API.
+type serverPage[T any] struct {
+	Values        []T  `json:"values"`
+	IsLastPage    bool `json:"isLastPage"`
+	NextPageStart int  `json:"nextPageStart"`
+}
+
+// serverGroupPermission is an entry in the response body of Bitbucket
+// Server's group permissions APIs.
+type serverGroupPermission struct {
+	Group *struct {
+		Name string `json:"name"`
+	} `json:"group"`
+	Permission string `json:"permission"`
+}
+
+// serverUserPermissions is the response body of Bitbucket Server's user
+// permissions APIs.
+type serverUserPermissions struct {
+	Values []struct {
+		User       *ServerUser `json:"user"`
+		Permission string      `json:"permission"`
+	} `json:"values"`
+}
+
+// ServerRefsChangedEventPayload represents a subset of Bitbucket Server's
+// "repo:refs_changed" event schema.
+// See https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Push
+type ServerRefsChangedEventPayload struct {
+	Repository *ServerRepository  `json:"repository"`
+	Changes    []*ServerRefChange `json:"changes"`
+}
+type ServerRefChange struct {
+	Ref *ServerRef `json:"ref"`
+	// ToHash is the SHA of the ref after the change.
+	ToHash string `json:"toHash"`
+	// Type is one of "ADD", "UPDATE" or "DELETE".
+	Type string `json:"type"`
+}
+type ServerRef struct {
+	DisplayID string `json:"displayId"`
+	// Type is either "BRANCH" or "TAG".
+	Type string `json:"type"`
+}
+
+// ServerPullRequestEventPayload represents a subset of Bitbucket Server's
+// pull request event schema.
+// See https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Pullrequest
+type ServerPullRequestEventPayload struct {
+	PullRequest *ServerPullRequest `json:"pullRequest"`
+	// PreviousTarget is only set for "pr:modified" events if the target
+	// branch changed.
+	PreviousTarget *ServerPullRequestRef `json:"previousTarget"`
+	// Participant is only set for reviewer events.
+	Participant *ServerParticipant `json:"participant"`
+}
+type ServerPullRequest struct {
+	ID      int64                 `json:"id"`
+	Author  *ServerParticipant    `json:"author"`
+	FromRef *ServerPullRequestRef `json:"fromRef"`
+	ToRef   *ServerPullRequestRef `json:"toRef"`
+}
+type ServerPullRequestRef struct {
+	DisplayID    string            `json:"displayId"`
+	LatestCommit string            `json:"latestCommit"`
+	Repository   *ServerRepository `json:"repository"`
+}
+type ServerParticipant struct {
+	User *ServerUser `json:"user"`
+}
+type ServerUser struct {
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+type ServerRepository struct {
+	Slug    string         `json:"slug"`
+	Public  bool           `json:"public"`
+	Project *ServerProject `json:"project"`
+}
+type ServerProject struct {
+	Key string `json:"key"`
+}
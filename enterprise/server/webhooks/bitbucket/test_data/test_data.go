@@ -7,3 +7,9 @@ var PushEvent []byte
 
 //go:embed pull_request_event.json
 var PullRequestEvent []byte
+
+//go:embed server_push_event.json
+var ServerPushEvent []byte
+
+//go:embed server_pull_request_event.json
+var ServerPullRequestEvent []byte
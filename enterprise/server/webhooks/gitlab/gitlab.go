@@ -0,0 +1,390 @@
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/fieldgetter"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/restapi"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	gh_backend "github.com/buildbuddy-io/buildbuddy/server/backends/github"
+)
+
+var (
+	baseURL = flag.String("gitlab.base_url", "https://gitlab.com", "The URL of the GitLab instance that hosts workflow repos, including https:// and no trailing slash. Set this when using a self-hosted GitLab instance. ** Enterprise only **")
+)
+
+const (
+	// GitLab access level of the Developer role. Users with at least this
+	// role can push to the repo.
+	// See https://docs.gitlab.com/ee/api/members.html#roles
+	developerAccessLevel = 30
+
+	// GitLab visibility level of public projects.
+	publicVisibilityLevel = 20
+)
+
+type gitlabGitProvider struct {
+	client *restapi.Client
+}
+
+func NewProvider() interfaces.GitProvider {
+	return &gitlabGitProvider{client: restapi.New("GitLab")}
+}
+
+func gitlabURL() (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSuffix(*baseURL, "/"))
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid gitlab.base_url %q: %s", *baseURL, err)
+	}
+	return u, nil
+}
+
+func (*gitlabGitProvider) MatchRepoURL(u *url.URL) bool {
+	glURL, err := gitlabURL()
+	if err != nil {
+		return false
+	}
+	return u.Host == glURL.Host
+}
+
+func (*gitlabGitProvider) MatchWebhookRequest(r *http.Request) bool {
+	return r.Header.Get("X-Gitlab-Event") != ""
+}
+
+func (*gitlabGitProvider) ParseWebhookData(r *http.Request) (*interfaces.WebhookData, error) {
+	switch eventName := r.Header.Get("X-Gitlab-Event"); eventName {
+	case "Push Hook":
+		payload := &PushEventPayload{}
+		if err := unmarshalBody(r, payload); err != nil {
+			return nil, status.InvalidArgumentErrorf("failed to unmarshal push event payload: %s", err)
+		}
+		// Ignore branch deletion events.
+		if payload.CheckoutSHA == "" {
+			return nil, nil
+		}
+		v, err := fieldgetter.ExtractValues(
+			payload,
+			"Ref",
+			"CheckoutSHA",
+			"Project.WebURL",
+			"Project.DefaultBranch",
+			"Project.VisibilityLevel",
+		)
+		if err != nil {
+			return nil, err
+		}
+		branch := strings.TrimPrefix(v["Ref"], "refs/heads/")
+		return &interfaces.WebhookData{
+			EventName:               webhook_data.EventName.Push,
+			PushedRepoURL:           v["Project.WebURL"],
+			PushedBranch:            branch,
+			SHA:                     v["CheckoutSHA"],
+			TargetRepoURL:           v["Project.WebURL"],
+			TargetRepoDefaultBranch: v["Project.DefaultBranch"],
+			TargetBranch:            branch,
+			IsTargetRepoPublic:      v["Project.VisibilityLevel"] == strconv.Itoa(publicVisibilityLevel),
+		}, nil
+	case "Merge Request Hook":
+		payload := &MergeRequestEventPayload{}
+		if err := unmarshalBody(r, payload); err != nil {
+			return nil, status.InvalidArgumentErrorf("failed to unmarshal %q event payload: %s", eventName, err)
+		}
+		attrs := payload.ObjectAttributes
+		if attrs == nil {
+			return nil, status.InvalidArgumentError("merge request event payload is missing object_attributes")
+		}
+		// Run workflows when the merge request is opened or reopened, when
+		// commits are pushed to it, when its target branch changes, and when
+		// it's approved.
+		switch {
+		case attrs.Action == "open" || attrs.Action == "reopen" || attrs.Action == "approved":
+		case attrs.Action == "update" && (attrs.OldRev != "" || payload.Changes.TargetBranch != nil):
+		default:
+			return nil, nil
+		}
+		v, err := fieldgetter.ExtractValues(
+			payload,
+			"ObjectAttributes.IID",
+			"ObjectAttributes.AuthorID",
+			"ObjectAttributes.SourceBranch",
+			"ObjectAttributes.TargetBranch",
+			"ObjectAttributes.LastCommit.ID",
+			"ObjectAttributes.Source.WebURL",
+			"ObjectAttributes.Target.WebURL",
+			"ObjectAttributes.Target.DefaultBranch",
+			"ObjectAttributes.Target.VisibilityLevel",
+		)
+		if err != nil {
+			return nil, err
+		}
+		iid, err := strconv.ParseInt(v["ObjectAttributes.IID"], 10, 64)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid merge request IID %q", v["ObjectAttributes.IID"])
+		}
+		wd := &interfaces.WebhookData{
+			EventName:               webhook_data.EventName.PullRequest,
+			PushedRepoURL:           v["ObjectAttributes.Source.WebURL"],
+			PushedBranch:            v["ObjectAttributes.SourceBranch"],
+			SHA:                     v["ObjectAttributes.LastCommit.ID"],
+			TargetRepoURL:           v["ObjectAttributes.Target.WebURL"],
+			TargetRepoDefaultBranch: v["ObjectAttributes.Target.DefaultBranch"],
+			TargetBranch:            v["ObjectAttributes.TargetBranch"],
+			IsTargetRepoPublic:      v["ObjectAttributes.Target.VisibilityLevel"] == strconv.Itoa(publicVisibilityLevel),
+			PullRequestNumber:       iid,
+			// GitLab's members API identifies users by ID, so use user IDs
+			// rather than usernames for trust checks.
+			PullRequestAuthor: v["ObjectAttributes.AuthorID"],
+		}
+		if attrs.Action == "approved" {
+			if payload.User == nil || payload.User.ID == 0 {
+				return nil, status.InvalidArgumentError("merge request approval event payload is missing the approving user")
+			}
+			wd.PullRequestApprover = strconv.FormatInt(payload.User.ID, 10)
+		}
+		return wd, nil
+	default:
+		log.Debugf("Ignoring GitLab webhook event: %s", eventName)
+		return nil, nil
+	}
+}
+
+// RegisterWebhook registers the given webhook to the project and returns the
+// ID of the registered webhook.
+func (g *gitlabGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error) {
+	projectPath, err := projectAPIPath(repoURL)
+	if err != nil {
+		return "", err
+	}
+	req := &projectHook{
+		URL:                 webhookURL,
+		PushEvents:          true,
+		MergeRequestsEvents: true,
+	}
+	hook := &projectHook{}
+	if err := g.do(ctx, accessToken, http.MethodPost, projectPath+"/hooks", req, hook); err != nil {
+		return "", err
+	}
+	if hook.ID == 0 {
+		return "", status.UnknownError("GitLab returned invalid response from hooks API (missing ID field).")
+	}
+	return strconv.FormatInt(hook.ID, 10), nil
+}
+
+// UnregisterWebhook removes the webhook from the project.
+func (g *gitlabGitProvider) UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
+	projectPath, err := projectAPIPath(repoURL)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.ParseInt(webhookID, 10 /*=base*/, 64 /*=bitSize*/); err != nil {
+		return status.InvalidArgumentErrorf("invalid GitLab webhook ID %q", webhookID)
+	}
+	return g.do(ctx, accessToken, http.MethodDelete, projectPath+"/hooks/"+webhookID, nil, nil)
+}
+
+func (g *gitlabGitProvider) GetFileContents(ctx context.Context, accessToken, repoURL, filePath, ref string) ([]byte, error) {
+	projectPath, err := projectAPIPath(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	glURL, err := gitlabURL()
+	if err != nil {
+		return nil, err
+	}
+	filesURL := glURL.String() + projectPath + "/repository/files/" + url.PathEscape(filePath) + "/raw?ref=" + url.QueryEscape(ref)
+	return g.client.GetFile(ctx, accessToken, filesURL, glURL.String()+projectPath, repoURL, filePath)
+}
+
+func (g *gitlabGitProvider) IsTrusted(ctx context.Context, accessToken, repoURL, user string) (bool, error) {
+	projectPath, err := projectAPIPath(repoURL)
+	if err != nil {
+		return false, err
+	}
+	if _, err := strconv.ParseInt(user, 10, 64); err != nil {
+		return false, status.InvalidArgumentErrorf("invalid GitLab user ID %q", user)
+	}
+	member := &projectMember{}
+	// The "all" endpoint includes members inherited from parent groups.
+	if err := g.do(ctx, accessToken, http.MethodGet, projectPath+"/members/all/"+user, nil, member); err != nil {
+		if status.IsNotFoundError(err) {
+			// User is not a member of this project.
+			return false, nil
+		}
+		return false, status.UnknownErrorf("get project member: %s", err)
+	}
+	// Trusted workflows get cache write perms, so if the user can't push to
+	// the repo then don't consider the workflow trusted.
+	return member.AccessLevel >= developerAccessLevel, nil
+}
+
+// CreateStatus publishes a commit status to the project. The payload is a
+// GitHub status payload, which is translated to its GitLab equivalent.
+func (g *gitlabGitProvider) CreateStatus(ctx context.Context, accessToken, repoURL, commitSHA string, payload any) error {
+	s, ok := payload.(*gh_backend.GithubStatusPayload)
+	if !ok {
+		return status.InvalidArgumentErrorf("invalid status payload type %T (expected %T)", payload, &gh_backend.GithubStatusPayload{})
+	}
+	projectPath, err := projectAPIPath(repoURL)
+	if err != nil {
+		return err
+	}
+	req := &commitStatus{
+		State:       commitStatusState(gh_backend.State(s.GetState())),
+		Name:        s.GetContext(),
+		TargetURL:   s.GetTargetURL(),
+		Description: s.GetDescription(),
+	}
+	return g.do(ctx, accessToken, http.MethodPost, projectPath+"/statuses/"+url.PathEscape(commitSHA), req, nil)
+}
+
+// commitStatusState returns the GitLab commit status state corresponding to
+// the given GitHub status state.
+func commitStatusState(state gh_backend.State) string {
+	switch state {
+	case gh_backend.PendingState:
+		return "pending"
+	case gh_backend.SuccessState:
+		return "success"
+	case gh_backend.FailureState, gh_backend.ErrorState:
+		return "failed"
+	default:
+		return string(state)
+	}
+}
+
+// projectAPIPath returns the API path of the project with the given repo URL,
+// relative to the GitLab instance URL.
+// Ex: "https://gitlab.com/acme/backend/api.git" -> "/api/v4/projects/acme%2Fbackend%2Fapi"
+func projectAPIPath(repoURL string) (string, error) {
+	glURL, err := gitlabURL()
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", status.InvalidArgumentErrorf("invalid repo URL %q: %s", repoURL, err)
+	}
+	if u.Host != glURL.Host {
+		return "", status.InvalidArgumentErrorf("repo URL %q is not hosted on %s", repoURL, glURL.Host)
+	}
+	// GitLab instances may be served under a relative URL, e.g.
+	// https://example.com/gitlab.
+	projectPath := strings.TrimPrefix(u.Path, glURL.Path)
+	projectPath = strings.TrimSuffix(strings.Trim(projectPath, "/"), ".git")
+	if !strings.Contains(projectPath, "/") {
+		return "", status.InvalidArgumentErrorf("invalid GitLab project URL %q", repoURL)
+	}
+	return "/api/v4/projects/" + url.PathEscape(projectPath), nil
+}
+
+// do sends an API request to the GitLab instance and decodes the JSON
+// response into rsp, if not nil.
+func (g *gitlabGitProvider) do(ctx context.Context, accessToken, method, apiPath string, body, rsp any) error {
+	glURL, err := gitlabURL()
+	if err != nil {
+		return err
+	}
+	return g.client.Do(ctx, accessToken, method, glURL.String()+apiPath, body, rsp)
+}
+
+func unmarshalBody(r *http.Request, payload interface{}) error {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, payload)
+}
+
+// PushEventPayload represents a subset of GitLab's push event schema.
+// See https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#push-events
+type PushEventPayload struct {
+	Ref string `json:"ref"`
+	// CheckoutSHA is the SHA of the most recent commit after the push. It is
+	// empty if the branch was deleted.
+	CheckoutSHA string   `json:"checkout_sha"`
+	Project     *Project `json:"project"`
+}
+
+// MergeRequestEventPayload represents a subset of GitLab's merge request event
+// schema.
+// See https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#merge-request-events
+type MergeRequestEventPayload struct {
+	// User is the user that triggered the event.
+	User             *User                   `json:"user"`
+	Project          *Project                `json:"project"`
+	ObjectAttributes *MergeRequestAttributes `json:"object_attributes"`
+	Changes          MergeRequestChanges     `json:"changes"`
+}
+type MergeRequestAttributes struct {
+	IID          int64    `json:"iid"`
+	AuthorID     int64    `json:"author_id"`
+	SourceBranch string   `json:"source_branch"`
+	TargetBranch string   `json:"target_branch"`
+	Source       *Project `json:"source"`
+	Target       *Project `json:"target"`
+	LastCommit   *Commit  `json:"last_commit"`
+	// Action is the action that triggered the event, e.g. "open" or "update".
+	Action string `json:"action"`
+	// OldRev is set on "update" events if new commits were pushed.
+	OldRev string `json:"oldrev"`
+}
+type MergeRequestChanges struct {
+	TargetBranch *struct {
+		Previous string `json:"previous"`
+		Current  string `json:"current"`
+	} `json:"target_branch"`
+}
+
+// Project represents a subset of GitLab's project schema, which is a common
+// entity used in multiple webhook events.
+type Project struct {
+	ID              int64  `json:"id"`
+	WebURL          string `json:"web_url"`
+	DefaultBranch   string `json:"default_branch"`
+	VisibilityLevel int    `json:"visibility_level"`
+}
+
+type User struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+type Commit struct {
+	ID string `json:"id"`
+}
+
+// projectHook is the request and response body of GitLab's project hooks API.
+// See https://docs.gitlab.com/ee/api/projects.html#add-project-hook
+type projectHook struct {
+	ID                  int64  `json:"id,omitempty"`
+	URL                 string `json:"url"`
+	PushEvents          bool   `json:"push_events"`
+	MergeRequestsEvents bool   `json:"merge_requests_events"`
+}
+
+// projectMember is the response body of GitLab's project members API.
+// See https://docs.gitlab.com/ee/api/members.html
+type projectMember struct {
+	ID          int64 `json:"id"`
+	AccessLevel int   `json:"access_level"`
+}
+
+// commitStatus is the request body of GitLab's commit status API.
+// See https://docs.gitlab.com/ee/api/commits.html#set-the-pipeline-status-of-a-commit
+type commitStatus struct {
+	State       string `json:"state"`
+	Name        string `json:"name,omitempty"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description,omitempty"`
+}
@@ -0,0 +1,162 @@
+package gitlab_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gitlab"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gitlab/test_data"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	gh_backend "github.com/buildbuddy-io/buildbuddy/server/backends/github"
+)
+
+func webhookRequest(t *testing.T, eventType string, payload []byte) *http.Request {
+	req, err := http.NewRequest("POST", "https://buildbuddy.io/webhooks/foo", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Gitlab-Event", eventType)
+	req.Header.Add("Content-Type", "application/json")
+	return req
+}
+
+func TestParseRequest_ValidPushEvent_Success(t *testing.T) {
+	req := webhookRequest(t, "Push Hook", test_data.PushEvent)
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:               "push",
+		PushedRepoURL:           "https://gitlab.com/buildbuddy/buildbuddy-ci-playground",
+		PushedBranch:            "main",
+		SHA:                     "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+		TargetRepoURL:           "https://gitlab.com/buildbuddy/buildbuddy-ci-playground",
+		TargetRepoDefaultBranch: "main",
+		TargetBranch:            "main",
+		IsTargetRepoPublic:      true,
+	}, data)
+}
+
+func TestParseRequest_ValidMergeRequestEvent_Success(t *testing.T) {
+	req := webhookRequest(t, "Merge Request Hook", test_data.MergeRequestEvent)
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:               "pull_request",
+		PushedRepoURL:           "https://gitlab.com/test/buildbuddy-ci-playground",
+		PushedBranch:            "test-1709288571",
+		SHA:                     "a4822151d5d2b79ebd7e5d7a38bd0de8c6e1e62b",
+		TargetRepoURL:           "https://gitlab.com/buildbuddy/buildbuddy-ci-playground",
+		TargetRepoDefaultBranch: "main",
+		TargetBranch:            "main",
+		IsTargetRepoPublic:      true,
+		PullRequestNumber:       7,
+		PullRequestAuthor:       "51",
+	}, data)
+}
+
+func TestParseRequest_MergeRequestUpdateWithoutNewCommits_Ignored(t *testing.T) {
+	payload := map[string]any{}
+	require.NoError(t, json.Unmarshal(test_data.MergeRequestEvent, &payload))
+	delete(payload["object_attributes"].(map[string]any), "oldrev")
+	b, err := json.Marshal(payload)
+	require.NoError(t, err)
+	req := webhookRequest(t, "Merge Request Hook", b)
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+func TestAPI_SelfHostedInstance(t *testing.T) {
+	var statusRequest map[string]string
+	const projectPath = "/gitlab/api/v4/projects/acme%2Fbackend%2Fapi"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer TOKEN" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method + " " + r.URL.EscapedPath() {
+		case "GET " + projectPath:
+			io.WriteString(w, `{"id": 15}`)
+		case "GET " + projectPath + "/repository/files/buildbuddy.yaml/raw":
+			if r.URL.Query().Get("ref") != "abc123" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			io.WriteString(w, "actions: []\n")
+		case "GET " + projectPath + "/members/all/51":
+			io.WriteString(w, `{"id": 51, "access_level": 30}`)
+		case "GET " + projectPath + "/members/all/52":
+			io.WriteString(w, `{"id": 52, "access_level": 20}`)
+		case "POST " + projectPath + "/statuses/abc123":
+			if err := json.NewDecoder(r.Body).Decode(&statusRequest); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			io.WriteString(w, `{"id": 1}`)
+		case "POST " + projectPath + "/hooks":
+			io.WriteString(w, `{"id": 1234}`)
+		case "DELETE " + projectPath + "/hooks/1234":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	flags.Set(t, "gitlab.base_url", server.URL+"/gitlab")
+
+	ctx := context.Background()
+	repoURL := server.URL + "/gitlab/acme/backend/api.git"
+	provider := gitlab.NewProvider()
+
+	b, err := provider.GetFileContents(ctx, "TOKEN", repoURL, "buildbuddy.yaml", "abc123")
+	require.NoError(t, err)
+	assert.Equal(t, "actions: []\n", string(b))
+
+	_, err = provider.GetFileContents(ctx, "TOKEN", repoURL, "buildbuddy.yaml", "def456")
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	trusted, err := provider.IsTrusted(ctx, "TOKEN", repoURL, "51")
+	require.NoError(t, err)
+	assert.True(t, trusted)
+	trusted, err = provider.IsTrusted(ctx, "TOKEN", repoURL, "52")
+	require.NoError(t, err)
+	assert.False(t, trusted)
+	trusted, err = provider.IsTrusted(ctx, "TOKEN", repoURL, "53")
+	require.NoError(t, err)
+	assert.False(t, trusted)
+
+	payload := gh_backend.NewGithubStatusPayload("Test", "https://app.buildbuddy.io/invocation/1", "Failed", gh_backend.FailureState)
+	err = provider.CreateStatus(ctx, "TOKEN", repoURL, "abc123", payload)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"state":       "failed",
+		"name":        "Test",
+		"target_url":  "https://app.buildbuddy.io/invocation/1",
+		"description": "Failed",
+	}, statusRequest)
+
+	id, err := provider.RegisterWebhook(ctx, "TOKEN", repoURL, "https://app.buildbuddy.io/webhooks/workflow/1")
+	require.NoError(t, err)
+	assert.Equal(t, "1234", id)
+	err = provider.UnregisterWebhook(ctx, "TOKEN", repoURL, id)
+	require.NoError(t, err)
+
+	_, err = provider.GetFileContents(ctx, "WRONG_TOKEN", repoURL, "buildbuddy.yaml", "abc123")
+	assert.True(t, status.IsUnauthenticatedError(err), "expected Unauthenticated, got %v", err)
+}
@@ -0,0 +1,132 @@
+// Package restapi sends requests to the JSON REST APIs of the git providers
+// that host workflow repos.
+package restapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// Client sends requests to a git provider's REST API.
+type Client struct {
+	// name is the name of the git provider, used in error messages.
+	name   string
+	client *http.Client
+}
+
+// New returns a client for the REST API of the named git provider.
+//
+// Self-hosted git providers are often only reachable on private IPs, so the
+// client doesn't use the httpclient package, which blocks them. This is only
+// safe because requests go to the provider URL configured by the server
+// admin. Code that sends requests to URLs configured by users, such as event
+// sinks, must use the httpclient package instead.
+func New(name string) *Client {
+	return &Client{
+		name:   name,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Request sends an API request with the given JSON body, if not nil. The
+// caller is responsible for closing the response body.
+func (c *Client) Request(ctx context.Context, accessToken, method, apiURL string, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, apiURL, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// GitLab and Bitbucket accept OAuth tokens as well as their various
+	// kinds of access tokens as bearer tokens.
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	return c.client.Do(req)
+}
+
+// Do sends an API request and decodes the JSON response into rsp, if not
+// nil.
+func (c *Client) Do(ctx context.Context, accessToken, method, apiURL string, body, rsp any) error {
+	res, err := c.Request(ctx, accessToken, method, apiURL, body)
+	if err != nil {
+		return status.UnavailableErrorf("%s API request failed: %s", c.name, err)
+	}
+	defer res.Body.Close()
+	if err := c.CheckResponse(res); err != nil {
+		return err
+	}
+	if rsp == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(rsp); err != nil {
+		return status.UnknownErrorf("failed to decode %s API response: %s", c.name, err)
+	}
+	return nil
+}
+
+// GetFile returns the contents of the file at fileURL. repoAPIURL is the API
+// URL of the repo containing the file, which is used to tell missing files
+// apart from missing repos.
+func (c *Client) GetFile(ctx context.Context, accessToken, fileURL, repoAPIURL, repoURL, filePath string) ([]byte, error) {
+	rsp, err := c.Request(ctx, accessToken, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, status.UnavailableErrorf("get %s from %s: %s", filePath, repoURL, err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotFound {
+		// Git providers return 404 both if the repo doesn't exist and if the
+		// file isn't found. Make another request to check whether the repo
+		// exists, so that the workflow is aborted if it doesn't, rather than
+		// using the default config.
+		if err := c.Do(ctx, accessToken, http.MethodGet, repoAPIURL, nil, nil); err != nil {
+			if status.IsNotFoundError(err) {
+				return nil, status.FailedPreconditionErrorf("repository %q not found or inaccessible with the configured access token", repoURL)
+			}
+			return nil, status.UnavailableErrorf("get repository %q: %s", repoURL, err)
+		}
+		return nil, status.NotFoundErrorf("%s: not found in %s", filePath, repoURL)
+	}
+	if err := c.CheckResponse(rsp); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(rsp.Body)
+}
+
+// CheckResponse returns an error if the response has a non-2XX status code.
+func (c *Client) CheckResponse(rsp *http.Response) error {
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(rsp.Body, 1024))
+	msg := fmt.Sprintf("%s API returned HTTP %d: %s", c.name, rsp.StatusCode, strings.TrimSpace(string(b)))
+	switch rsp.StatusCode {
+	case http.StatusNotFound:
+		return status.NotFoundError(msg)
+	case http.StatusUnauthorized:
+		return status.UnauthenticatedError(msg)
+	case http.StatusForbidden:
+		return status.PermissionDeniedError(msg)
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return status.InvalidArgumentError(msg)
+	case http.StatusTooManyRequests:
+		return status.ResourceExhaustedError(msg)
+	default:
+		return status.UnavailableError(msg)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cache_snapshot"
+	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// This tool exports the AC and CAS entries of a group from a running
+// BuildBuddy server to a snapshot file, and imports snapshot files into
+// another server. It can be used to warm up a new cache, or to move cache
+// contents between clusters.
+//
+// Entries are read and written through the server's gRPC APIs on behalf of
+// the group that owns the API key. Exporting requires an org admin API key;
+// importing requires an API key with cache write capability.
+//
+// When the server uses the distributed cache, each server lists only the
+// entries that are stored locally, so export from each server to export the
+// whole cache. Importing skips entries that are already present, so the
+// overlap between replicas only costs archive space.
+//
+// Ex. export the entries of a group:
+//
+//	bazel run //enterprise/tools/cache_snapshot -- export \
+//		--target=grpcs://cache.source.example.com \
+//		--api_key=$SOURCE_ADMIN_API_KEY \
+//		--output=/tmp/cache.snapshot
+//
+// Ex. import the snapshot into another server, writing at most 50MB/s. If the
+// import is interrupted, running the same command again resumes it from the
+// last checkpoint:
+//
+//	bazel run //enterprise/tools/cache_snapshot -- import \
+//		--target=grpcs://cache.dest.example.com \
+//		--api_key=$DEST_API_KEY \
+//		--input=/tmp/cache.snapshot \
+//		--checkpoint_file=/tmp/cache.snapshot.checkpoint \
+//		--max_bytes_per_second=50000000
+
+var (
+	target = flag.String("target", "grpcs://remote.buildbuddy.io", "The gRPC target of the server to export from or import into.")
+	apiKey = flag.String("api_key", "", "The API key of the group whose entries are exported or imported.")
+
+	output       = flag.String("output", "", "export: The file to write the snapshot to.")
+	partitionIDs = flag.Slice("partition_ids", []string{}, "export: Only export entries from these partitions. All partitions are exported if empty.")
+
+	input               = flag.String("input", "", "import: The snapshot file to import.")
+	checkpointFile      = flag.String("checkpoint_file", "", "import: If set, import progress is recorded in this file, and an interrupted import resumes from the last checkpoint.")
+	maxBytesPerSecond   = flag.Int64("max_bytes_per_second", 0, "import: The maximum rate at which data is written to the server. Unlimited if 0.")
+	maxEntriesPerSecond = flag.Float64("max_entries_per_second", 0, "import: The maximum rate at which entries are written to the server. Unlimited if 0.")
+)
+
+const usage = "usage: cache_snapshot export|import [flags]"
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatal(usage)
+	}
+	mode := os.Args[1]
+	if err := flag.CommandLine.Parse(os.Args[2:]); err != nil {
+		log.Fatalf("Could not parse flags: %s", err)
+	}
+	if err := log.Configure(); err != nil {
+		log.Fatalf("Could not configure logger: %s", err)
+	}
+	if err := run(mode); err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
+func run(mode string) error {
+	ctx := context.Background()
+	if *apiKey != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-buildbuddy-api-key", *apiKey)
+	}
+	conn, err := grpc_client.DialSimpleWithoutPooling(*target)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", *target, err)
+	}
+	defer conn.Close()
+
+	switch mode {
+	case "export":
+		return runExport(ctx, conn)
+	case "import":
+		return runImport(ctx, conn)
+	default:
+		return errors.New(usage)
+	}
+}
+
+func runExport(ctx context.Context, conn *grpc.ClientConn) error {
+	if *output == "" {
+		return errors.New("--output is required")
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	stats, err := cache_snapshot.Export(ctx, conn, f, &cache_snapshot.ExportOptions{
+		PartitionIDs: *partitionIDs,
+	})
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("export failed: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Infof("Exported %d entries (%d bytes) to %q, skipped %d entries that could not be read", stats.Entries, stats.Bytes, *output, stats.Skipped)
+	return nil
+}
+
+func runImport(ctx context.Context, conn *grpc.ClientConn) error {
+	if *input == "" {
+		return errors.New("--input is required")
+	}
+	f, err := os.Open(*input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	opts := &cache_snapshot.ImportOptions{
+		BytesPerSecond:   *maxBytesPerSecond,
+		EntriesPerSecond: *maxEntriesPerSecond,
+	}
+	if *checkpointFile != "" {
+		offset, err := readCheckpoint(*checkpointFile)
+		if err != nil {
+			return err
+		}
+		if offset > 0 {
+			log.Infof("Resuming import from offset %d", offset)
+		}
+		opts.StartOffset = offset
+		opts.Checkpoint = func(offset int64) error {
+			_, err := disk.WriteFile(ctx, *checkpointFile, []byte(strconv.FormatInt(offset, 10)))
+			return err
+		}
+	}
+	stats, err := cache_snapshot.Import(ctx, conn, f, opts)
+	if err != nil {
+		return fmt.Errorf("import failed: %w", err)
+	}
+	log.Infof("Imported %d entries (%d bytes) from %q, skipped %d entries that were already present", stats.Entries, stats.Bytes, *input, stats.Skipped)
+	return nil
+}
+
+// readCheckpoint returns the offset recorded in the checkpoint file, or 0 if
+// the file doesn't exist.
+func readCheckpoint(path string) (int64, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid checkpoint file %q: %w", path, err)
+	}
+	return offset, nil
+}
@@ -39,7 +39,8 @@ func ActionLabelKey(groupID, iid, targetLabel string) string {
 	return groupID + "/api/a/" + base64.RawURLEncoding.EncodeToString([]byte(iid+targetLabel))
 }
 
-func filesFromOutput(output []*bespb.File) []*apipb.File {
+// FilesFromOutput converts build event output files to API files.
+func FilesFromOutput(output []*bespb.File) []*apipb.File {
 	files := []*apipb.File{}
 	for _, output := range output {
 		if output == nil {
@@ -109,13 +110,13 @@ func FillActionFromBuildEvent(event *bespb.BuildEvent, action *apipb.Action) *ap
 func FillActionOutputFilesFromBuildEvent(event *bespb.BuildEvent, action *apipb.Action) *apipb.Action {
 	switch p := event.GetPayload().(type) {
 	case *bespb.BuildEvent_Action:
-		action.File = filesFromOutput([]*bespb.File{p.Action.GetStderr(), p.Action.GetStdout()})
+		action.File = FilesFromOutput([]*bespb.File{p.Action.GetStderr(), p.Action.GetStdout()})
 		return action
 	case *bespb.BuildEvent_Completed:
-		action.File = filesFromOutput(p.Completed.GetDirectoryOutput())
+		action.File = FilesFromOutput(p.Completed.GetDirectoryOutput())
 		return action
 	case *bespb.BuildEvent_TestResult:
-		action.File = filesFromOutput(p.TestResult.GetTestActionOutput())
+		action.File = FilesFromOutput(p.TestResult.GetTestActionOutput())
 		return action
 	default:
 		return nil
@@ -145,6 +146,73 @@ func TestStatusToStatus(testStatus bespb.TestStatus) cmnpb.Status {
 	}
 }
 
+// UpdateTargetStatus updates the status of the target that the event belongs
+// to in the given map of statuses, keyed by label. It returns the label and
+// the new status if the event changed the status of a target.
+//
+// A TargetComplete event does not override the status set by an earlier
+// TestSummary or Aborted event, since those statuses are more specific.
+func UpdateTargetStatus(statuses map[string]cmnpb.Status, event *bespb.BuildEvent) (label string, status cmnpb.Status, changed bool) {
+	label, status, ok := targetStatusFromEvent(event)
+	if !ok {
+		return "", cmnpb.Status_STATUS_UNSPECIFIED, false
+	}
+	current, seen := statuses[label]
+	if _, isCompleted := event.GetPayload().(*bespb.BuildEvent_Completed); isCompleted && seen && current != cmnpb.Status_BUILDING {
+		return "", cmnpb.Status_STATUS_UNSPECIFIED, false
+	}
+	if seen && current == status {
+		return "", cmnpb.Status_STATUS_UNSPECIFIED, false
+	}
+	statuses[label] = status
+	return label, status, true
+}
+
+func targetStatusFromEvent(event *bespb.BuildEvent) (label string, status cmnpb.Status, ok bool) {
+	switch p := event.GetPayload().(type) {
+	case *bespb.BuildEvent_Configured:
+		return event.GetId().GetTargetConfigured().GetLabel(), cmnpb.Status_BUILDING, true
+	case *bespb.BuildEvent_Completed:
+		if p.Completed.GetSuccess() {
+			return event.GetId().GetTargetCompleted().GetLabel(), cmnpb.Status_BUILT, true
+		}
+		return event.GetId().GetTargetCompleted().GetLabel(), cmnpb.Status_FAILED_TO_BUILD, true
+	case *bespb.BuildEvent_TestSummary:
+		return event.GetId().GetTestSummary().GetLabel(), TestStatusToStatus(p.TestSummary.GetOverallStatus()), true
+	case *bespb.BuildEvent_Aborted:
+		switch id := event.GetId().GetId().(type) {
+		case *bespb.BuildEventId_TargetConfigured:
+			label = id.TargetConfigured.GetLabel()
+		case *bespb.BuildEventId_TargetCompleted:
+			label = id.TargetCompleted.GetLabel()
+		case *bespb.BuildEventId_ConfiguredLabel:
+			label = id.ConfiguredLabel.GetLabel()
+		case *bespb.BuildEventId_UnconfiguredLabel:
+			label = id.UnconfiguredLabel.GetLabel()
+		}
+		if label == "" {
+			return "", cmnpb.Status_STATUS_UNSPECIFIED, false
+		}
+		return label, AbortReasonToStatus(p.Aborted.GetReason()), true
+	}
+	return "", cmnpb.Status_STATUS_UNSPECIFIED, false
+}
+
+// AbortReasonToStatus returns the status of a target that was aborted for the
+// given reason.
+func AbortReasonToStatus(reason bespb.Aborted_AbortReason) cmnpb.Status {
+	switch reason {
+	case bespb.Aborted_SKIPPED:
+		return cmnpb.Status_SKIPPED
+	case bespb.Aborted_USER_INTERRUPTED:
+		return cmnpb.Status_CANCELLED
+	case bespb.Aborted_INCOMPLETE:
+		return cmnpb.Status_INCOMPLETE
+	default:
+		return cmnpb.Status_FAILED_TO_BUILD
+	}
+}
+
 type TargetMap struct {
 	Targets  map[string]*apipb.Target
 	selector *apipb.TargetSelector
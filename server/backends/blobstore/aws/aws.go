@@ -193,6 +193,21 @@ func (a *AwsS3BlobStore) ReadBlob(ctx context.Context, blobName string) ([]byte,
 	return util.Decompress(b, err)
 }
 
+func (a *AwsS3BlobStore) Reader(ctx context.Context, blobName string) (io.ReadCloser, error) {
+	out, err := a.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: a.bucket,
+		Key:    &blobName,
+	})
+	if err != nil {
+		var nsk *s3types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return nil, status.NotFoundError(err.Error())
+		}
+		return nil, err
+	}
+	return util.NewDecompressingReader(out.Body)
+}
+
 func (a *AwsS3BlobStore) download(ctx context.Context, blobName string) ([]byte, error) {
 	buff := &s3manager.WriteAtBuffer{}
 
@@ -287,6 +302,27 @@ func (a *AwsS3BlobStore) BlobExists(ctx context.Context, blobName string) (bool,
 	return true, nil
 }
 
+func (a *AwsS3BlobStore) ListBlobs(ctx context.Context, prefix string, fn func(blobName string, lastModified time.Time) error) error {
+	ctx, spn := tracing.StartSpan(ctx)
+	defer spn.End()
+	paginator := s3.NewListObjectsV2Paginator(a.client, &s3.ListObjectsV2Input{
+		Bucket: a.bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			if err := fn(aws.ToString(obj.Key), aws.ToTime(obj.LastModified)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (a *AwsS3BlobStore) Writer(ctx context.Context, blobName string) (interfaces.CommittedWriteCloser, error) {
 	// Open a pipe.
 	pr, pw := io.Pipe()
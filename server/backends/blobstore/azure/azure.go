@@ -122,6 +122,18 @@ func (z *AzureBlobStore) ReadBlob(ctx context.Context, blobName string) ([]byte,
 	return util.Decompress(b, err)
 }
 
+func (z *AzureBlobStore) Reader(ctx context.Context, blobName string) (io.ReadCloser, error) {
+	blobURL := z.containerURL.NewBlockBlobURL(blobName)
+	response, err := blobURL.Download(ctx, 0 /*=offset*/, azblob.CountToEnd, azblob.BlobAccessConditions{}, false /*=rangeGetContentMD5*/, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if z.isAzureError(err, azblob.ServiceCodeBlobNotFound) {
+			return nil, status.NotFoundError(err.Error())
+		}
+		return nil, err
+	}
+	return util.NewDecompressingReader(response.Body(azblob.RetryReaderOptions{}))
+}
+
 func (z *AzureBlobStore) WriteBlob(ctx context.Context, blobName string, data []byte) (int, error) {
 	compressedData, err := util.Compress(data)
 	if err != nil {
@@ -160,6 +172,24 @@ func (z *AzureBlobStore) BlobExists(ctx context.Context, blobName string) (bool,
 	return true, nil
 }
 
+func (z *AzureBlobStore) ListBlobs(ctx context.Context, prefix string, fn func(blobName string, lastModified time.Time) error) error {
+	ctx, spn := tracing.StartSpan(ctx)
+	defer spn.End()
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		rsp, err := z.containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			return err
+		}
+		for _, item := range rsp.Segment.BlobItems {
+			if err := fn(item.Name, item.Properties.LastModified); err != nil {
+				return err
+			}
+		}
+		marker = rsp.NextMarker
+	}
+	return nil
+}
+
 func (z *AzureBlobStore) Writer(ctx context.Context, blobName string) (interfaces.CommittedWriteCloser, error) {
 	// Open a pipe.
 	pr, pw := io.Pipe()
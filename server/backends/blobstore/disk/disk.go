@@ -4,6 +4,8 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -14,6 +16,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/ioutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/tracing"
 )
 
@@ -87,6 +90,21 @@ func (d *DiskBlobStore) ReadBlob(ctx context.Context, blobName string) ([]byte,
 	return util.Decompress(b, err)
 }
 
+func (d *DiskBlobStore) Reader(ctx context.Context, blobName string) (io.ReadCloser, error) {
+	fullPath, err := d.blobPath(blobName)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.NotFoundError(err.Error())
+		}
+		return nil, err
+	}
+	return util.NewDecompressingReader(f)
+}
+
 func (d *DiskBlobStore) DeleteBlob(ctx context.Context, blobName string) error {
 	if blobName == "" {
 		log.Errorf("DeleteBlob called with empty blobName")
@@ -127,6 +145,42 @@ func (d *DiskBlobStore) BlobExists(ctx context.Context, blobName string) (bool,
 	return disk.FileExists(ctx, fullPath)
 }
 
+func (d *DiskBlobStore) ListBlobs(ctx context.Context, prefix string, fn func(blobName string, lastModified time.Time) error) error {
+	// Only walk the deepest directory that contains all blobs with the given
+	// prefix.
+	walkDir, err := d.blobPath(prefix)
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		walkDir = filepath.Dir(walkDir)
+	}
+	err = filepath.WalkDir(walkDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		blobName, err := filepath.Rel(d.rootDir, path)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(blobName, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(blobName, info.ModTime())
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
 func (d *DiskBlobStore) Writer(ctx context.Context, blobName string) (interfaces.CommittedWriteCloser, error) {
 	fullPath, err := d.blobPath(blobName)
 	if err != nil {
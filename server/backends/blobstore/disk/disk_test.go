@@ -3,13 +3,18 @@ package disk
 import (
 	"context"
 	"fmt"
+	"io"
 	"math/rand"
+	"os"
 	"path/filepath"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore/util"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/stretchr/testify/require"
 )
 
@@ -95,6 +100,13 @@ func TestDiskBlobStore(t *testing.T) {
 			require.NoError(t, err)
 			require.Equal(t, b, tc.blob)
 
+			r, err := bs.(interfaces.BlobReader).Reader(ctx, tc.blobName)
+			require.NoError(t, err)
+			b, err = io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			require.Equal(t, tc.blob, b)
+
 			err = bs.DeleteBlob(ctx, tc.blobName)
 			require.NoError(t, err)
 
@@ -105,6 +117,67 @@ func TestDiskBlobStore(t *testing.T) {
 	}
 }
 
+func TestListBlobs(t *testing.T) {
+	originalRootDir := *rootDirectory
+	*rootDirectory = t.TempDir()
+	t.Cleanup(func() {
+		*rootDirectory = originalRootDir
+	})
+
+	var bs interfaces.Blobstore
+	bs, err := NewDiskBlobStore()
+	require.NoError(t, err)
+	bs = util.NewPrefixBlobstore(bs, "my_prefix")
+
+	ctx := context.Background()
+	for _, name := range []string{"app/a/1", "app/a/2", "app/b/1", "apple/1", "other/1"} {
+		_, err := bs.WriteBlob(ctx, name, []byte(name))
+		require.NoError(t, err)
+	}
+
+	list := func(prefix string) []string {
+		var names []string
+		err := bs.(interfaces.BlobLister).ListBlobs(ctx, prefix, func(blobName string, lastModified time.Time) error {
+			require.False(t, lastModified.IsZero())
+			names = append(names, blobName)
+			return nil
+		})
+		require.NoError(t, err)
+		sort.Strings(names)
+		return names
+	}
+	require.Equal(t, []string{"app/a/1", "app/a/2", "app/b/1"}, list("app/"))
+	require.Equal(t, []string{"app/a/1", "app/a/2", "app/b/1", "apple/1"}, list("app"))
+	require.Equal(t, []string{"app/a/1", "app/a/2"}, list("app/a/"))
+	require.Equal(t, []string{"app/a/1", "app/a/2", "app/b/1", "apple/1", "other/1"}, list(""))
+	require.Empty(t, list("missing/"))
+}
+
+func TestReader_Uncompressed(t *testing.T) {
+	originalRootDir := *rootDirectory
+	*rootDirectory = t.TempDir()
+	t.Cleanup(func() {
+		*rootDirectory = originalRootDir
+	})
+
+	bs, err := NewDiskBlobStore()
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// Blobs written before compression was added are read as-is.
+	err = os.WriteFile(filepath.Join(*rootDirectory, "legacy"), []byte("uncompressed"), 0644)
+	require.NoError(t, err)
+	r, err := bs.Reader(ctx, "legacy")
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, "uncompressed", string(b))
+
+	_, err = bs.Reader(ctx, "missing")
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+}
+
 type namedBlob struct {
 	name string
 	buf  []byte
@@ -16,6 +16,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/tracing"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
@@ -201,6 +202,24 @@ func (g *GCSBlobStore) BlobExists(ctx context.Context, blobName string) (bool, e
 	}
 }
 
+func (g *GCSBlobStore) ListBlobs(ctx context.Context, prefix string, fn func(blobName string, lastModified time.Time) error) error {
+	ctx, spn := tracing.StartSpan(ctx)
+	defer spn.End()
+	it := g.bucketHandle.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(attrs.Name, attrs.Updated); err != nil {
+			return err
+		}
+	}
+}
+
 // ConditionalWriter is a custom writer for storing expiring artifacts that
 // contain already compressed cache bytes. You probably want to use the Writer
 // API instead.
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
@@ -8,10 +9,12 @@ import (
 	"fmt"
 	"io"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/prometheus/client_golang/prometheus"
 
 	gstatus "google.golang.org/grpc/status"
@@ -58,6 +61,39 @@ func Decompress(in []byte, err error) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
+// NewDecompressingReader returns a reader of the decompressed contents of a
+// blob read from rc, which it takes ownership of. Like Decompress, blobs that
+// aren't compressed are read as-is.
+func NewDecompressingReader(rc io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(rc)
+	header, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		rc.Close()
+		return nil, err
+	}
+	if !bytes.Equal(header, []byte{0x1f, 0x8b}) {
+		return &readCloser{Reader: br, close: rc.Close}, nil
+	}
+	zr, err := NewCompressReader(br)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: zr, close: func() error {
+		zr.Close()
+		return rc.Close()
+	}}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
+
 func Compress(in []byte) ([]byte, error) {
 	var buf bytes.Buffer
 	zr := NewCompressWriter(&buf)
@@ -114,6 +150,34 @@ func (p *prefixBlobstore) Writer(ctx context.Context, blobName string) (interfac
 	return p.blobstore.Writer(ctx, p.blobPath(blobName))
 }
 
+func (p *prefixBlobstore) Reader(ctx context.Context, blobName string) (io.ReadCloser, error) {
+	reader, ok := p.blobstore.(interfaces.BlobReader)
+	if !ok {
+		return nil, status.UnimplementedError("blobstore does not support streaming reads")
+	}
+	return reader.Reader(ctx, p.blobPath(blobName))
+}
+
+func (p *prefixBlobstore) ListBlobs(ctx context.Context, prefix string, fn func(blobName string, lastModified time.Time) error) error {
+	lister, ok := p.blobstore.(interfaces.BlobLister)
+	if !ok {
+		return status.UnimplementedError("blobstore does not support listing blobs")
+	}
+	fullPrefix := p.blobPath(prefix)
+	// filepath.Join strips trailing slashes, which would change the meaning
+	// of the prefix.
+	if fullPrefix != "" && (prefix == "" || strings.HasSuffix(prefix, "/")) {
+		fullPrefix += "/"
+	}
+	return lister.ListBlobs(ctx, fullPrefix, func(blobName string, lastModified time.Time) error {
+		rel, err := filepath.Rel(p.prefix, blobName)
+		if err != nil {
+			return err
+		}
+		return fn(rel, lastModified)
+	})
+}
+
 func RecordWriteMetrics(typeLabel string, startTime time.Time, size int, err error) {
 	duration := time.Since(startTime)
 	metrics.BlobstoreWriteCount.With(prometheus.Labels{
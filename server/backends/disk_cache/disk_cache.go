@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -21,6 +22,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/util/alert"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/ioutil"
@@ -64,6 +66,10 @@ const (
 	PartitionDirectoryPrefix = "PT"
 	HashPrefixDirPrefixLen   = 4
 	V2Dir                    = "v2"
+
+	// zstdFileSuffix is appended to the names of files that hold
+	// zstd-compressed blobs. Only the v2 layout stores compressed blobs.
+	zstdFileSuffix = ".zst"
 )
 
 var (
@@ -72,7 +78,8 @@ var (
 	partitionMappingsFlag = flag.Slice("cache.disk.partition_mappings", []disk.PartitionMapping{}, "")
 	useV2LayoutFlag       = flag.Bool("cache.disk.use_v2_layout", false, "If enabled, files will be stored using the v2 layout. See disk_cache.MigrateToV2Layout for a description.")
 
-	migrateDiskCacheToV2AndExit = flag.Bool("migrate_disk_cache_to_v2_and_exit", false, "If true, attempt to migrate disk cache to v2 layout.")
+	migrateDiskCacheToV2AndExit   = flag.Bool("migrate_disk_cache_to_v2_and_exit", false, "If true, attempt to migrate disk cache to v2 layout.")
+	migrateDiskCacheToZstdAndExit = flag.Bool("migrate_disk_cache_to_zstd_and_exit", false, "If true, attempt to compress the existing CAS entries of a v2 layout disk cache with zstd. See disk_cache.MigrateToZstd for a description.")
 )
 
 type Options struct {
@@ -160,6 +167,89 @@ func MigrateToV2Layout(rootDir string) error {
 	return nil
 }
 
+// MigrateToZstd compresses the uncompressed CAS entries of a v2 layout cache
+// with zstd. Compressed entries are stored next to where the uncompressed
+// entry was, with a ".zst" suffix, and are served to clients that request
+// zstd without transcoding.
+//
+// Entries that don't get smaller when compressed are left as-is. Access and
+// modification times are carried over so that eviction order is unaffected.
+// The cache must not be running while it is migrated.
+func MigrateToZstd(rootDir string) error {
+	v2Root := filepath.Join(rootDir, V2Dir)
+	if _, err := os.Stat(v2Root); err != nil {
+		if os.IsNotExist(err) {
+			return status.FailedPreconditionErrorf("%q does not use the v2 layout, migrate it to v2 first", rootDir)
+		}
+		return err
+	}
+	log.Info("Starting zstd migration.")
+	numMigrated := 0
+	numSkipped := 0
+	savedBytes := int64(0)
+	start := time.Now()
+	walkFn := func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, zstdFileSuffix) || disk.IsWriteTempFile(path) {
+			return nil
+		}
+		// AC entries live in an "ac" directory above the hash prefix
+		// directory. They are small and are left uncompressed.
+		if filepath.Base(filepath.Dir(filepath.Dir(path))) == digest.CacheTypeToPrefix(rspb.CacheType_AC) {
+			return nil
+		}
+		if _, err := decodeDigest(d.Name()); err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Size() == 0 {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return status.InternalErrorf("Could not read %q: %s", path, err)
+		}
+		compressed := compression.CompressZstd(nil, data)
+		if len(compressed) >= len(data) {
+			numSkipped++
+			return nil
+		}
+		newPath := path + zstdFileSuffix
+		if _, err := disk.WriteFile(context.Background(), newPath, compressed); err != nil {
+			return status.InternalErrorf("Could not write %q: %s", newPath, err)
+		}
+		atime := time.Unix(0, getLastUseNanos(info))
+		if err := os.Chtimes(newPath, atime, info.ModTime()); err != nil {
+			return status.InternalErrorf("Could not set times on %q: %s", newPath, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return status.InternalErrorf("Could not remove %q: %s", path, err)
+		}
+
+		numMigrated++
+		savedBytes += int64(len(data) - len(compressed))
+		if numMigrated%1_000_000 == 0 {
+			log.Infof("Compressed %d files in %s.", numMigrated, time.Since(start))
+			log.Infof("Most recent migration: %q -> %q", path, newPath)
+		}
+		return nil
+	}
+	if err := filepath.WalkDir(v2Root, walkFn); err != nil {
+		return err
+	}
+	log.Infof("Compressed %d digests (skipped %d incompressible, saved %s) in %s.", numMigrated, numSkipped, units.BytesSize(float64(savedBytes)), time.Since(start))
+	return nil
+}
+
 // DiskCache stores data on disk as files.
 // It is broken up into partitions which are independent and maintain their own LRUs.
 type DiskCache struct {
@@ -210,6 +300,14 @@ func NewDiskCache(env environment.Env, opts *Options, defaultMaxSizeBytes int64)
 		os.Exit(0)
 	}
 
+	if *migrateDiskCacheToZstdAndExit {
+		if err := MigrateToZstd(opts.RootDirectory); err != nil {
+			log.Errorf("Migration failed: %s", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	useV2Layout := opts.UseV2Layout
 	// Logic to auto-promote new users to v2 layout.
 	if !useV2Layout && !opts.ForceV1Layout {
@@ -369,6 +467,9 @@ func (c *DiskCache) Metadata(ctx context.Context, r *rspb.ResourceName) (*interf
 	digestSizeBytes := int64(-1)
 	if r.GetCacheType() == rspb.CacheType_CAS {
 		digestSizeBytes = fileInfo.Size()
+		if lruRecord.key.compressor != repb.Compressor_IDENTITY {
+			digestSizeBytes = d.GetSizeBytes()
+		}
 	}
 
 	return &interfaces.CacheMetadata{
@@ -840,7 +941,7 @@ func decodeDigest(d string) ([]byte, error) {
 	return dst, nil
 }
 
-func parseFilePath(rootDir, fullPath string, useV2Layout bool) (cacheType rspb.CacheType, userPrefix, remoteInstanceName string, digestBytes []byte, err error) {
+func parseFilePath(rootDir, fullPath string, useV2Layout bool) (cacheType rspb.CacheType, userPrefix, remoteInstanceName string, digestBytes []byte, compressor repb.Compressor_Value, err error) {
 	p := strings.TrimPrefix(fullPath, rootDir+"/")
 	parts := strings.Split(p, "/")
 
@@ -859,7 +960,12 @@ func parseFilePath(rootDir, fullPath string, useV2Layout bool) (cacheType rspb.C
 
 	// pull digest off the end
 	if len(parts) > 0 {
-		db, decodeErr := decodeDigest(parts[len(parts)-1])
+		name := parts[len(parts)-1]
+		if useV2Layout && strings.HasSuffix(name, zstdFileSuffix) {
+			name = strings.TrimSuffix(name, zstdFileSuffix)
+			compressor = repb.Compressor_ZSTD
+		}
+		db, decodeErr := decodeDigest(name)
 		if decodeErr != nil {
 			err = parseError()
 			return
@@ -907,12 +1013,14 @@ type fileKey struct {
 	userPrefix         string
 	remoteInstanceName string
 	digestBytes        []byte
+	// compressor is the compressor used for the stored file.
+	compressor repb.Compressor_Value
 }
 
 func (fk *fileKey) FromPartitionAndPath(part *partition, fullPath string) error {
 	fk.part = part
 
-	cacheType, userPrefix, remoteInstanceName, digestBytes, err := parseFilePath(fk.part.rootDir, fullPath, fk.part.useV2Layout)
+	cacheType, userPrefix, remoteInstanceName, digestBytes, compressor, err := parseFilePath(fk.part.rootDir, fullPath, fk.part.useV2Layout)
 	if err != nil {
 		return err
 	}
@@ -921,6 +1029,7 @@ func (fk *fileKey) FromPartitionAndPath(part *partition, fullPath string) error
 	fk.digestBytes = digestBytes
 	fk.cacheType = cacheType
 	fk.remoteInstanceName = fk.part.internString(remoteInstanceName)
+	fk.compressor = compressor
 
 	return nil
 }
@@ -931,7 +1040,19 @@ func (fk *fileKey) FullPath() string {
 	if fk.part.useV2Layout {
 		hashPrefixDir = digestHash[0:HashPrefixDirPrefixLen] + "/"
 	}
-	return filepath.Join(fk.part.rootDir, fk.userPrefix, fk.remoteInstanceName, digest.CacheTypeToPrefix(fk.cacheType), hashPrefixDir+digestHash)
+	fileName := digestHash
+	if fk.compressor == repb.Compressor_ZSTD {
+		fileName += zstdFileSuffix
+	}
+	return filepath.Join(fk.part.rootDir, fk.userPrefix, fk.remoteInstanceName, digest.CacheTypeToPrefix(fk.cacheType), hashPrefixDir+fileName)
+}
+
+// withCompressor returns a copy of the key for the file that stores the blob
+// using the given compressor.
+func (fk *fileKey) withCompressor(compressor repb.Compressor_Value) *fileKey {
+	k := *fk
+	k.compressor = compressor
+	return &k
 }
 
 func (p *partition) key(ctx context.Context, pbRN *rspb.ResourceName) (*fileKey, error) {
@@ -955,15 +1076,74 @@ func (p *partition) key(ctx context.Context, pbRN *rspb.ResourceName) (*fileKey,
 	if err != nil {
 		return nil, err
 	}
+	compressor := repb.Compressor_IDENTITY
+	if p.supportsCompressor(rn.GetCompressor()) {
+		compressor = rn.GetCompressor()
+	}
 	return &fileKey{
 		part:               p,
 		cacheType:          rn.GetCacheType(),
 		userPrefix:         p.internString(userPrefix),
 		remoteInstanceName: p.internString(rn.GetInstanceName()),
 		digestBytes:        digestBytes,
+		compressor:         compressor,
 	}, nil
 }
 
+func (p *partition) supportsCompressor(compressor repb.Compressor_Value) bool {
+	return compressor == repb.Compressor_IDENTITY || (p.useV2Layout && compressor == repb.Compressor_ZSTD)
+}
+
+func (p *partition) checkWriteCompressor(r *rspb.ResourceName) error {
+	if !p.supportsCompressor(r.GetCompressor()) {
+		return status.InvalidArgumentErrorf("compressor %s is not supported by this disk cache", r.GetCompressor())
+	}
+	return nil
+}
+
+// storedVariants returns the keys of all of the files that may store the
+// blob, starting with the given key.
+func (p *partition) storedVariants(k *fileKey) []*fileKey {
+	if !p.useV2Layout {
+		return []*fileKey{k}
+	}
+	other := repb.Compressor_ZSTD
+	if k.compressor == repb.Compressor_ZSTD {
+		other = repb.Compressor_IDENTITY
+	}
+	return []*fileKey{k, k.withCompressor(other)}
+}
+
+// storedKey returns the key of the file storing the blob, preferring the file
+// that matches the requested compressor. If no file is known, the given key is
+// returned.
+// NB: Callers are responsible for locking the LRU before calling this function.
+func (p *partition) storedKey(k *fileKey) *fileKey {
+	variants := p.storedVariants(k)
+	for _, v := range variants {
+		if p.lru.Contains(v.FullPath()) {
+			return v
+		}
+	}
+	if !p.diskIsMapped {
+		for _, v := range variants {
+			if _, err := os.Stat(v.FullPath()); err == nil {
+				return v
+			}
+		}
+	}
+	return k
+}
+
+// removeOtherVariants removes any files storing the blob with a different
+// compressor than the given key, so that only the latest write is kept.
+// NB: Callers are responsible for locking the LRU before calling this function.
+func (p *partition) removeOtherVariants(k *fileKey) {
+	for _, v := range p.storedVariants(k)[1:] {
+		p.lru.Remove(v.FullPath())
+	}
+}
+
 func (p *partition) lruAdd(record *fileRecord) {
 	p.lru.Add(record.FullPath(), record)
 }
@@ -1008,16 +1188,21 @@ func (p *partition) lruGet(ctx context.Context, rn *rspb.ResourceName) (*fileRec
 	// if necessary and applicable.
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	v, ok := p.lru.Get(k.FullPath())
-	if ok {
-		return v, nil
+	variants := p.storedVariants(k)
+	for _, v := range variants {
+		if record, ok := p.lru.Get(v.FullPath()); ok {
+			return record, nil
+		}
 	}
 	if !p.diskIsMapped {
 		// OK if we're here it means the disk contents are still being loaded
 		// into the LRU. But we still need to return an answer! So we'll go
 		// check the FS, and if the file is there we'll add it to the LRU.
-		lruRecord := p.addFileToLRUIfExists(k)
-		return lruRecord, nil
+		for _, v := range variants {
+			if lruRecord := p.addFileToLRUIfExists(v); lruRecord != nil {
+				return lruRecord, nil
+			}
+		}
 	}
 	return nil, nil
 }
@@ -1059,11 +1244,15 @@ func (p *partition) get(ctx context.Context, r *rspb.ResourceName) ([]byte, erro
 	if err != nil {
 		return nil, err
 	}
+	p.mu.Lock()
+	k = p.storedKey(k)
+	p.mu.Unlock()
+
 	buf, err := disk.ReadFile(ctx, k.FullPath())
 	p.mu.Lock()
-	defer p.mu.Unlock()
 	if err != nil {
 		p.lru.Remove(k.FullPath()) // remove it just in case
+		p.mu.Unlock()
 		return nil, status.NotFoundErrorf("DiskCache missing file: %s", err)
 	}
 
@@ -1072,7 +1261,8 @@ func (p *partition) get(ctx context.Context, r *rspb.ResourceName) ([]byte, erro
 	} else if !p.diskIsMapped {
 		p.addFileToLRUIfExists(k)
 	}
-	return buf, nil
+	p.mu.Unlock()
+	return compression.ConvertBytes(buf, k.compressor, r.GetCompressor())
 }
 
 func (p *partition) getMulti(ctx context.Context, resources []*rspb.ResourceName) (map[*repb.Digest][]byte, error) {
@@ -1108,6 +1298,9 @@ func (p *partition) getMulti(ctx context.Context, resources []*rspb.ResourceName
 }
 
 func (p *partition) set(ctx context.Context, r *rspb.ResourceName, data []byte) error {
+	if err := p.checkWriteCompressor(r); err != nil {
+		return err
+	}
 	k, err := p.key(ctx, r)
 	if err != nil {
 		return err
@@ -1125,6 +1318,7 @@ func (p *partition) set(ctx context.Context, r *rspb.ResourceName, data []byte)
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	p.lruAdd(record)
+	p.removeOtherVariants(k)
 	metrics.DiskCacheAddedFileSizeBytes.With(prometheus.Labels{metrics.CacheNameLabel: cacheName}).Observe(float64(n))
 	return err
 }
@@ -1145,7 +1339,12 @@ func (p *partition) delete(ctx context.Context, r *rspb.ResourceName) error {
 	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	removed := p.lru.Remove(k.FullPath())
+	removed := false
+	for _, v := range p.storedVariants(k) {
+		if p.lru.Remove(v.FullPath()) {
+			removed = true
+		}
+	}
 	if !removed {
 		d := r.GetDigest()
 		return status.NotFoundErrorf("digest %s/%d not found in disk cache", d.GetHash(), d.GetSizeBytes())
@@ -1158,17 +1357,31 @@ func (p *partition) reader(ctx context.Context, rn *rspb.ResourceName, offset, l
 	if err != nil {
 		return nil, err
 	}
+	p.mu.Lock()
+	k = p.storedKey(k)
+	p.mu.Unlock()
+
+	// Uncompressed files can be read from the offset directly, but
+	// compressed files have to be decompressed from the start.
+	fileOffset, fileLimit := offset, limit
+	if k.compressor != repb.Compressor_IDENTITY {
+		fileOffset, fileLimit = 0, 0
+	} else {
+		offset, limit = 0, 0
+	}
+
 	// Can't specify length because this might be ActionCache
-	r, err := disk.FileReader(ctx, k.FullPath(), offset, limit)
+	r, err := disk.FileReader(ctx, k.FullPath(), fileOffset, fileLimit)
 	p.mu.Lock()
-	defer p.mu.Unlock()
 	if err != nil {
 		p.lru.Remove(k.FullPath()) // remove it just in case
+		p.mu.Unlock()
 		return nil, status.NotFoundErrorf("DiskCache missing file: %s", err)
 	} else {
 		p.lru.Get(k.FullPath()) // mark the file as used.
 	}
-	return r, nil
+	p.mu.Unlock()
+	return compression.NewConvertingReader(r, k.compressor, rn.GetCompressor(), offset, limit, rn.GetDigest().GetSizeBytes())
 }
 
 type dbCloseFn func(totalBytesWritten int64) error
@@ -1193,6 +1406,9 @@ func (d *dbWriteOnClose) Close() error {
 }
 
 func (p *partition) writer(ctx context.Context, r *rspb.ResourceName) (interfaces.CommittedWriteCloser, error) {
+	if err := p.checkWriteCompressor(r); err != nil {
+		return nil, err
+	}
 	k, err := p.key(ctx, r)
 	if err != nil {
 		return nil, err
@@ -1220,6 +1436,7 @@ func (p *partition) writer(ctx context.Context, r *rspb.ResourceName) (interface
 		p.mu.Lock()
 		defer p.mu.Unlock()
 		p.lruAdd(record)
+		p.removeOtherVariants(k)
 		metrics.DiskCacheAddedFileSizeBytes.With(prometheus.Labels{metrics.CacheNameLabel: cacheName}).Observe(float64(totalBytesWritten))
 		return nil
 	}
@@ -1227,5 +1444,105 @@ func (p *partition) writer(ctx context.Context, r *rspb.ResourceName) (interface
 }
 
 func (c *DiskCache) SupportsCompressor(compressor repb.Compressor_Value) bool {
-	return compressor == repb.Compressor_IDENTITY
+	return c.defaultPartition.supportsCompressor(compressor)
+}
+
+// ListEntries walks the files stored in the given partitions (or all
+// partitions if none are given) and calls fn with each of them. The disk cache
+// doesn't record digest functions, so they are inferred from the hash length.
+func (c *DiskCache) ListEntries(ctx context.Context, partitionIDs []string, fn func(info *interfaces.CacheEntryInfo) error) error {
+	ids := make([]string, 0, len(c.partitions))
+	for id := range c.partitions {
+		if len(partitionIDs) == 0 || slices.Contains(partitionIDs, id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := c.partitions[id].listEntries(ctx, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *partition) listEntries(ctx context.Context, fn func(info *interfaces.CacheEntryInfo) error) error {
+	walkFn := func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() {
+			// See initializeCache: the v1 default partition shares its root
+			// directory with the other partitions.
+			if !p.useV2Layout && p.id == DefaultPartitionID && strings.HasPrefix(d.Name(), PartitionDirectoryPrefix) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if disk.IsWriteTempFile(path) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Size() == 0 {
+			return nil
+		}
+		key := &fileKey{}
+		if err := key.FromPartitionAndPath(p, path); err != nil {
+			log.Debugf("Skipping unrecognized file %q: %s", path, err)
+			return nil
+		}
+		sizeBytes := info.Size()
+		if key.compressor != repb.Compressor_IDENTITY {
+			sizeBytes, err = decompressedSize(path, key.compressor)
+			if os.IsNotExist(err) {
+				// The file was evicted while we were walking.
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		dg := &repb.Digest{Hash: hex.EncodeToString(key.digestBytes), SizeBytes: sizeBytes}
+		return fn(&interfaces.CacheEntryInfo{
+			Resource: &rspb.ResourceName{
+				Digest:         dg,
+				InstanceName:   key.remoteInstanceName,
+				Compressor:     key.compressor,
+				CacheType:      key.cacheType,
+				DigestFunction: digest.InferOldStyleDigestFunctionInDesperation(dg),
+			},
+			GroupID:            key.userPrefix,
+			PartitionID:        p.id,
+			LastAccessTimeUsec: getLastUseNanos(info) / 1e3,
+		})
+	}
+	if err := filepath.WalkDir(p.rootDir, walkFn); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// decompressedSize returns the size of the data stored in the compressed file
+// at path.
+func decompressedSize(path string, compressor repb.Compressor_Value) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	r, err := compression.NewDecompressingReader(compressor, f)
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(io.Discard, r)
 }
@@ -18,8 +18,10 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
@@ -1091,3 +1093,160 @@ func TestV2LayoutMigration(t *testing.T) {
 	require.NoError(t, err)
 	testfs.AssertExactFileContents(t, rootDir, expectedContents)
 }
+
+func TestZstdStorage(t *testing.T) {
+	rootDir := testfs.MakeTempDir(t)
+	dc, ctx := newCacheAndContext(t, &disk_cache.Options{RootDirectory: rootDir, UseV2Layout: true}, 100_000_000)
+	require.True(t, dc.SupportsCompressor(repb.Compressor_ZSTD))
+
+	rn, buf := testdigest.RandomCompressibleCASResourceBuf(t, 10_000, "")
+	compressedBuf := compression.CompressZstd(nil, buf)
+	compressedRN := proto.Clone(rn).(*rspb.ResourceName)
+	compressedRN.Compressor = repb.Compressor_ZSTD
+
+	w, err := dc.Writer(ctx, compressedRN)
+	require.NoError(t, err)
+	_, err = w.Write(compressedBuf)
+	require.NoError(t, err)
+	require.NoError(t, w.Commit())
+	require.NoError(t, w.Close())
+
+	// The blob is stored compressed, with a suffix marking the compressor.
+	hash := rn.GetDigest().GetHash()
+	dPath := filepath.Join(rootDir, disk_cache.V2Dir, disk_cache.PartitionDirectoryPrefix+disk_cache.DefaultPartitionID, interfaces.AuthAnonymousUser, hash[:disk_cache.HashPrefixDirPrefixLen], hash)
+	require.NoFileExists(t, dPath)
+	stored, err := os.ReadFile(dPath + ".zst")
+	require.NoError(t, err)
+	require.Equal(t, compressedBuf, stored)
+
+	// Lookups find the blob regardless of the requested compressor.
+	missing, err := dc.FindMissing(ctx, []*rspb.ResourceName{rn, compressedRN})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	md, err := dc.Metadata(ctx, rn)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(compressedBuf)), md.StoredSizeBytes)
+	require.Equal(t, int64(len(buf)), md.DigestSizeBytes)
+
+	got, err := dc.Get(ctx, compressedRN)
+	require.NoError(t, err)
+	require.Equal(t, compressedBuf, got)
+	got, err = dc.Get(ctx, rn)
+	require.NoError(t, err)
+	require.Equal(t, buf, got)
+
+	r, err := dc.Reader(ctx, rn, 100, 50)
+	require.NoError(t, err)
+	got, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, buf[100:150], got)
+
+	_, err = dc.Reader(ctx, compressedRN, 100, 0)
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+
+	// Rewriting the blob uncompressed replaces the compressed file.
+	err = dc.Set(ctx, rn, buf)
+	require.NoError(t, err)
+	require.FileExists(t, dPath)
+	require.NoFileExists(t, dPath+".zst")
+
+	r, err = dc.Reader(ctx, compressedRN, 0, 0)
+	require.NoError(t, err)
+	got, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	got, err = compression.DecompressZstd(nil, got)
+	require.NoError(t, err)
+	require.Equal(t, buf, got)
+
+	err = dc.Delete(ctx, compressedRN)
+	require.NoError(t, err)
+	require.NoFileExists(t, dPath)
+}
+
+func TestZstdNotSupportedInV1Layout(t *testing.T) {
+	dc, ctx := newCacheAndContext(t, &disk_cache.Options{ForceV1Layout: true}, 100_000_000)
+	require.False(t, dc.SupportsCompressor(repb.Compressor_ZSTD))
+
+	rn, buf := testdigest.RandomCompressibleCASResourceBuf(t, 1000, "")
+	compressedRN := proto.Clone(rn).(*rspb.ResourceName)
+	compressedRN.Compressor = repb.Compressor_ZSTD
+	err := dc.Set(ctx, compressedRN, compression.CompressZstd(nil, buf))
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+
+	// Uncompressed blobs can still be read back compressed.
+	err = dc.Set(ctx, rn, buf)
+	require.NoError(t, err)
+	got, err := dc.Get(ctx, compressedRN)
+	require.NoError(t, err)
+	got, err = compression.DecompressZstd(nil, got)
+	require.NoError(t, err)
+	require.Equal(t, buf, got)
+}
+
+func TestZstdMigration(t *testing.T) {
+	rootDir := testfs.MakeTempDir(t)
+	te := getTestEnv(t, emptyUserMap)
+	ctx := getAnonContext(t, te)
+
+	userRoot := filepath.Join(rootDir, disk_cache.V2Dir, disk_cache.PartitionDirectoryPrefix+disk_cache.DefaultPartitionID, interfaces.AuthAnonymousUser)
+	pathFor := func(rn *rspb.ResourceName) string {
+		hash := rn.GetDigest().GetHash()
+		parts := []string{userRoot, rn.GetInstanceName()}
+		if rn.GetCacheType() == rspb.CacheType_AC {
+			parts = append(parts, "ac")
+		}
+		return filepath.Join(append(parts, hash[:disk_cache.HashPrefixDirPrefixLen], hash)...)
+	}
+	writeFile := func(rn *rspb.ResourceName, data []byte) {
+		p := pathFor(rn)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, data, 0644))
+	}
+
+	casRN, casBuf := testdigest.RandomCompressibleCASResourceBuf(t, 10_000, "prefix")
+	writeFile(casRN, casBuf)
+	// Tiny blobs don't get smaller when compressed and are left alone.
+	incompressibleRN, incompressibleBuf := testdigest.RandomCASResourceBuf(t, 8)
+	writeFile(incompressibleRN, incompressibleBuf)
+	acRN, acBuf := testdigest.RandomACResourceBuf(t, 1000)
+	writeFile(acRN, bytes.Repeat(acBuf[:1], len(acBuf)))
+
+	mtime := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(pathFor(casRN), mtime, mtime))
+
+	err := disk_cache.MigrateToZstd(rootDir)
+	require.NoError(t, err)
+
+	require.NoFileExists(t, pathFor(casRN))
+	info, err := os.Stat(pathFor(casRN) + ".zst")
+	require.NoError(t, err)
+	require.Equal(t, mtime, info.ModTime())
+	require.FileExists(t, pathFor(incompressibleRN))
+	require.FileExists(t, pathFor(acRN))
+
+	dc, err := disk_cache.NewDiskCache(te, &disk_cache.Options{RootDirectory: rootDir, UseV2Layout: true}, 100_000_000)
+	require.NoError(t, err)
+	dc.WaitUntilMapped()
+
+	got, err := dc.Get(ctx, casRN)
+	require.NoError(t, err)
+	require.Equal(t, casBuf, got)
+	got, err = dc.Get(ctx, incompressibleRN)
+	require.NoError(t, err)
+	require.Equal(t, incompressibleBuf, got)
+	_, err = dc.Get(ctx, acRN)
+	require.NoError(t, err)
+
+	// Migrating again is a no-op.
+	err = disk_cache.MigrateToZstd(rootDir)
+	require.NoError(t, err)
+	require.FileExists(t, pathFor(casRN)+".zst")
+}
+
+func TestZstdMigrationRequiresV2Layout(t *testing.T) {
+	err := disk_cache.MigrateToZstd(testfs.MakeTempDir(t))
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
 	"github.com/buildbuddy-io/buildbuddy/server/util/ioutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
@@ -25,14 +26,22 @@ import (
 var cacheInMemory = flag.Bool("cache.in_memory", false, "Whether or not to use the in_memory cache.")
 
 type MemoryCache struct {
-	l    interfaces.LRU[[]byte]
+	l    interfaces.LRU[*entry]
 	lock *sync.RWMutex
 }
 
-func sizeFn(value []byte) int64 {
+// entry is a blob stored in the cache, along with the compressor that was
+// used to write it. Compressed blobs are stored as-is and only transcoded if
+// a reader requests a different compressor.
+type entry struct {
+	data       []byte
+	compressor repb.Compressor_Value
+}
+
+func sizeFn(value *entry) int64 {
 	size := int64(0)
 	if value != nil {
-		size += int64(len(value))
+		size += int64(len(value.data))
 	}
 	return size
 }
@@ -57,7 +66,7 @@ func Register(env *real_environment.RealEnv) error {
 }
 
 func NewMemoryCache(maxSizeBytes int64) (*MemoryCache, error) {
-	l, err := lru.NewLRU[[]byte](&lru.Config[[]byte]{MaxSize: maxSizeBytes, SizeFn: sizeFn})
+	l, err := lru.NewLRU[*entry](&lru.Config[*entry]{MaxSize: maxSizeBytes, SizeFn: sizeFn})
 	if err != nil {
 		return nil, err
 	}
@@ -117,11 +126,14 @@ func (m *MemoryCache) Metadata(ctx context.Context, r *rspb.ResourceName) (*inte
 	// TODO - Add digest size support for AC
 	digestSizeBytes := int64(-1)
 	if r.GetCacheType() == rspb.CacheType_CAS {
-		digestSizeBytes = int64(len(v))
+		digestSizeBytes = int64(len(v.data))
+		if v.compressor != repb.Compressor_IDENTITY {
+			digestSizeBytes = d.GetSizeBytes()
+		}
 	}
 
 	return &interfaces.CacheMetadata{
-		StoredSizeBytes: int64(len(v)),
+		StoredSizeBytes: int64(len(v.data)),
 		DigestSizeBytes: digestSizeBytes,
 	}, nil
 }
@@ -141,7 +153,7 @@ func (m *MemoryCache) FindMissing(ctx context.Context, resources []*rspb.Resourc
 	return missing, nil
 }
 
-func (m *MemoryCache) Get(ctx context.Context, r *rspb.ResourceName) ([]byte, error) {
+func (m *MemoryCache) get(ctx context.Context, r *rspb.ResourceName) (*entry, error) {
 	k, err := m.key(ctx, r)
 	if err != nil {
 		return nil, err
@@ -155,6 +167,14 @@ func (m *MemoryCache) Get(ctx context.Context, r *rspb.ResourceName) ([]byte, er
 	return v, nil
 }
 
+func (m *MemoryCache) Get(ctx context.Context, r *rspb.ResourceName) ([]byte, error) {
+	v, err := m.get(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return compression.ConvertBytes(v.data, v.compressor, r.GetCompressor())
+}
+
 func (m *MemoryCache) GetMulti(ctx context.Context, resources []*rspb.ResourceName) (map[*repb.Digest][]byte, error) {
 	foundMap := make(map[*repb.Digest][]byte, len(resources))
 	// No parallelism here either. Not necessary for an in-memory cache.
@@ -177,7 +197,7 @@ func (m *MemoryCache) Set(ctx context.Context, r *rspb.ResourceName, data []byte
 		return err
 	}
 	m.lock.Lock()
-	m.l.Add(k, data)
+	m.l.Add(k, &entry{data: data, compressor: r.GetCompressor()})
 	m.lock.Unlock()
 	return nil
 }
@@ -208,21 +228,25 @@ func (m *MemoryCache) Delete(ctx context.Context, r *rspb.ResourceName) error {
 
 // Low level interface used for seeking and stream-writing.
 func (m *MemoryCache) Reader(ctx context.Context, rn *rspb.ResourceName, uncompressedOffset, limit int64) (io.ReadCloser, error) {
-	// Locking and key prefixing are handled in Get.
-	buf, err := m.Get(ctx, rn)
+	// Locking and key prefixing are handled in get.
+	v, err := m.get(ctx, rn)
 	if err != nil {
 		return nil, err
 	}
-	r := bytes.NewReader(buf)
+	if v.compressor != repb.Compressor_IDENTITY {
+		return compression.NewConvertingReader(io.NopCloser(bytes.NewReader(v.data)), v.compressor, rn.GetCompressor(), uncompressedOffset, limit, rn.GetDigest().GetSizeBytes())
+	}
+	r := bytes.NewReader(v.data)
 	r.Seek(uncompressedOffset, 0)
-	length := int64(len(buf))
+	length := int64(len(v.data))
 	if limit != 0 && limit < length {
 		length = limit
 	}
+	var rc io.ReadCloser = io.NopCloser(r)
 	if length > 0 {
-		return io.NopCloser(io.LimitReader(r, length)), nil
+		rc = io.NopCloser(io.LimitReader(r, length))
 	}
-	return io.NopCloser(r), nil
+	return compression.NewConvertingReader(rc, v.compressor, rn.GetCompressor(), 0, 0, rn.GetDigest().GetSizeBytes())
 }
 
 func (m *MemoryCache) Writer(ctx context.Context, r *rspb.ResourceName) (interfaces.CommittedWriteCloser, error) {
@@ -244,5 +268,5 @@ func (m *MemoryCache) Stop() error {
 }
 
 func (m *MemoryCache) SupportsCompressor(compressor repb.Compressor_Value) bool {
-	return compressor == repb.Compressor_IDENTITY
+	return compressor == repb.Compressor_IDENTITY || compressor == repb.Compressor_ZSTD
 }
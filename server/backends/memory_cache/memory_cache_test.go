@@ -12,7 +12,10 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/stretchr/testify/require"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
@@ -274,6 +277,60 @@ func TestReadOffsetLimit(t *testing.T) {
 	require.Equal(t, buf[offset:offset+limit], readBuf[:limit])
 }
 
+func TestCompression(t *testing.T) {
+	mc, err := memory_cache.NewMemoryCache(100_000)
+	require.NoError(t, err)
+	ctx := getAnonContext(t)
+
+	rn, buf := testdigest.RandomCompressibleCASResourceBuf(t, 10_000, "")
+	compressedBuf := compression.CompressZstd(nil, buf)
+	compressedRN := proto.Clone(rn).(*rspb.ResourceName)
+	compressedRN.Compressor = repb.Compressor_ZSTD
+
+	// Write the compressed blob, which should be stored as-is.
+	require.True(t, mc.SupportsCompressor(repb.Compressor_ZSTD))
+	err = mc.Set(ctx, compressedRN, compressedBuf)
+	require.NoError(t, err)
+
+	md, err := mc.Metadata(ctx, rn)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(compressedBuf)), md.StoredSizeBytes)
+	require.Equal(t, int64(len(buf)), md.DigestSizeBytes)
+
+	// Compressed reads are served without transcoding.
+	got, err := mc.Get(ctx, compressedRN)
+	require.NoError(t, err)
+	require.Equal(t, compressedBuf, got)
+
+	// Uncompressed reads are decompressed.
+	got, err = mc.Get(ctx, rn)
+	require.NoError(t, err)
+	require.Equal(t, buf, got)
+
+	reader, err := mc.Reader(ctx, rn, 10, 20)
+	require.NoError(t, err)
+	got, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, buf[10:30], got)
+
+	_, err = mc.Reader(ctx, compressedRN, 10, 0)
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+
+	// Uncompressed blobs can be read back compressed.
+	rn2, buf2 := testdigest.RandomCompressibleCASResourceBuf(t, 10_000, "")
+	err = mc.Set(ctx, rn2, buf2)
+	require.NoError(t, err)
+	compressedRN2 := proto.Clone(rn2).(*rspb.ResourceName)
+	compressedRN2.Compressor = repb.Compressor_ZSTD
+	reader, err = mc.Reader(ctx, compressedRN2, 0, 0)
+	require.NoError(t, err)
+	got, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	decompressed, err := compression.DecompressZstd(nil, got)
+	require.NoError(t, err)
+	require.Equal(t, buf2, decompressed)
+}
+
 func TestSizeLimit(t *testing.T) {
 	maxSizeBytes := int64(1000) // 1000 bytes
 	mc, err := memory_cache.NewMemoryCache(maxSizeBytes)
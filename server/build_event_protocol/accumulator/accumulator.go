@@ -33,6 +33,10 @@ const (
 	// If codesearch is enabled, and an invocation contains a single file with the
 	// following name, attempt to ingest this kythe sstable file in codesearch.
 	KytheOutputName = "kythe_serving.sst"
+
+	// The name of the build tool log that Bazel uploads when the
+	// --execution_log_compact_file flag is set.
+	CompactExecutionLogName = "execution_log.binpb.zst"
 )
 
 var (
@@ -85,6 +89,7 @@ type BEValues struct {
 	buildToolLogURIs          []*url.URL
 	outputFilesMap            map[string]*build_event_stream.File
 	kytheSSTableResourceName  *rspb.ResourceName
+	compactExecutionLog       *build_event_stream.File
 	profileName               string
 
 	failedTestOutputURIs []*url.URL
@@ -173,6 +178,9 @@ func (v *BEValues) AddEvent(event *build_event_stream.BuildEvent) error {
 					log.Warningf("Error parsing uri from BuildToolLogs: %s", uri)
 				} else if url.Scheme == "bytestream" {
 					v.buildToolLogURIs = append(v.buildToolLogURIs, url)
+					if toolLog.GetName() == CompactExecutionLogName {
+						v.compactExecutionLog = toolLog
+					}
 				}
 			}
 		}
@@ -234,6 +242,12 @@ func (v *BEValues) KytheSSTableResourceName() *rspb.ResourceName {
 	return v.kytheSSTableResourceName
 }
 
+// CompactExecutionLog returns the compact execution log uploaded by the
+// invocation, or nil if it did not upload one.
+func (v *BEValues) CompactExecutionLog() *build_event_stream.File {
+	return v.compactExecutionLog
+}
+
 func (v *BEValues) DisableCommitStatusReporting() bool {
 	return v.getBoolValue(disableCommitStatusReportingFieldName)
 }
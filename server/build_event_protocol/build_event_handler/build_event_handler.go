@@ -21,7 +21,10 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/backends/invocationdb"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/accumulator"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_status_reporter"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_sink"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_format"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_subscription"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/spawn_records"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/target_tracker"
 	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/build_buddy_url"
 	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/cache_api_url"
@@ -76,6 +79,14 @@ const (
 	// How many workers to spin up for writing cache stats to the DB.
 	numStatsRecorderWorkers = 8
 
+	// How many workers to spin up for ingesting compact execution logs.
+	// Parsing a log is CPU and memory intensive, so only a few logs are
+	// ingested at a time.
+	numExecutionLogWorkers = 2
+	// How many compact execution logs can be waiting to be ingested. Logs
+	// enqueued while the buffer is full are not ingested.
+	executionLogTaskBufferSize = 256
+
 	// How many workers to spin up for looking up invocations before
 	// webhooks are notified.
 	numWebhookInvocationLookupWorkers = 8
@@ -233,6 +244,7 @@ type recordStatsTask struct {
 	files                    map[string]*build_event_stream.File
 	persist                  *PersistArtifacts
 	kytheSSTableResourceName *rspb.ResourceName
+	compactExecutionLog      *build_event_stream.File
 	invocationStatus         inspb.InvocationStatus
 }
 
@@ -250,14 +262,20 @@ type statsRecorder struct {
 	mu      sync.Mutex // protects(tasks, stopped)
 	tasks   chan *recordStatsTask
 	stopped bool
+
+	// executionLogTasks is written to by the stats recorder workers and
+	// closed once they have all exited.
+	executionLogTasks chan *recordStatsTask
+	executionLogEG    errgroup.Group
 }
 
 func newStatsRecorder(env environment.Env, openChannels *sync.WaitGroup, onStatsRecorded chan<- *invocationInfo) *statsRecorder {
 	return &statsRecorder{
-		env:             env,
-		openChannels:    openChannels,
-		onStatsRecorded: onStatsRecorded,
-		tasks:           make(chan *recordStatsTask, 4096),
+		env:               env,
+		openChannels:      openChannels,
+		onStatsRecorded:   onStatsRecorded,
+		tasks:             make(chan *recordStatsTask, 4096),
+		executionLogTasks: make(chan *recordStatsTask, executionLogTaskBufferSize),
 	}
 }
 
@@ -297,6 +315,7 @@ func (r *statsRecorder) Enqueue(ctx context.Context, beValues *accumulator.BEVal
 		invocationStatus:         invocation.GetInvocationStatus(),
 		persist:                  persist,
 		kytheSSTableResourceName: beValues.KytheSSTableResourceName(),
+		compactExecutionLog:      beValues.CompactExecutionLog(),
 	}
 	select {
 	case r.tasks <- req:
@@ -320,6 +339,14 @@ func (r *statsRecorder) Start() {
 			return nil
 		})
 	}
+	for i := 0; i < numExecutionLogWorkers; i++ {
+		r.executionLogEG.Go(func() error {
+			for task := range r.executionLogTasks {
+				r.ingestExecutionLog(ctx, task)
+			}
+			return nil
+		})
+	}
 }
 
 func (r *statsRecorder) lookupInvocation(ctx context.Context, ij *invocationInfo) (*tables.Invocation, error) {
@@ -425,6 +452,33 @@ func (r *statsRecorder) maybeIngestKytheSST(ctx context.Context, ij *invocationI
 	return err
 }
 
+// maybeEnqueueExecutionLog enqueues the compact execution log uploaded by
+// the invocation, if any, to be ingested in the background so that a large
+// log doesn't hold up recording the stats of other invocations.
+func (r *statsRecorder) maybeEnqueueExecutionLog(ctx context.Context, task *recordStatsTask) {
+	if task.compactExecutionLog == nil || !spawn_records.Enabled() {
+		return
+	}
+	select {
+	case r.executionLogTasks <- task:
+	default:
+		log.CtxWarningf(ctx, "Not ingesting compact execution log: too many logs are waiting to be ingested.")
+	}
+}
+
+// ingestExecutionLog stores the spawns in the compact execution log uploaded
+// by the invocation, so that they can be queried later.
+func (r *statsRecorder) ingestExecutionLog(ctx context.Context, task *recordStatsTask) {
+	ctx = log.EnrichContext(ctx, log.InvocationIDKey, task.invocationInfo.id)
+	ctx = r.env.GetAuthenticator().AuthContextFromTrustedJWT(ctx, task.invocationInfo.jwt)
+	// When fetching the log, make sure we associate the cache requests with
+	// the app, not bazel.
+	ctx = usageutil.WithLocalServerLabels(ctx)
+	if err := spawn_records.Ingest(ctx, r.env, task.invocationInfo.id, task.invocationInfo.attempt, task.compactExecutionLog); err != nil {
+		log.CtxWarningf(ctx, "Failed to ingest compact execution log: %s", err)
+	}
+}
+
 func (r *statsRecorder) handleTask(ctx context.Context, task *recordStatsTask) {
 	start := time.Now()
 	defer func() {
@@ -490,7 +544,10 @@ func (r *statsRecorder) handleTask(ctx context.Context, task *recordStatsTask) {
 		)
 	}
 
+	r.maybeEnqueueExecutionLog(ctx, task)
+
 	ctx = r.env.GetAuthenticator().AuthContextFromTrustedJWT(ctx, task.invocationInfo.jwt)
+
 	eg, ctx := errgroup.WithContext(ctx)
 	eg.SetLimit(50) // Max concurrency when copying files from cache->blobstore.
 
@@ -550,6 +607,13 @@ func (r *statsRecorder) Stop() {
 		log.Error(err.Error())
 	}
 
+	// The stats recorder workers have exited, so no more execution logs will
+	// be enqueued.
+	close(r.executionLogTasks)
+	if err := r.executionLogEG.Wait(); err != nil {
+		log.Error(err.Error())
+	}
+
 	close(r.onStatsRecorded)
 }
 
@@ -811,6 +875,8 @@ type EventChannel struct {
 	statsRecorder  *statsRecorder
 	collector      interfaces.MetricsCollector
 	apiTargetMap   *api_common.TargetMap
+	eventSink      *event_sink.Streamer
+	publisher      *invocation_subscription.Publisher
 
 	startedEvent                     *build_event_stream.BuildEvent_Started
 	bufferedEvents                   []*inpb.InvocationEvent
@@ -834,6 +900,10 @@ func (e *EventChannel) Context() context.Context {
 }
 
 func (e *EventChannel) Close() {
+	if e.eventSink != nil {
+		e.eventSink.Close()
+	}
+	e.publisher.Close()
 	e.onClose()
 }
 
@@ -880,6 +950,7 @@ func (e *EventChannel) FinalizeInvocation(iid string) error {
 	}
 
 	e.flushAPIFacets(iid)
+	e.publisher.Complete(invocation.GetSuccess(), invocation.GetInvocationStatus())
 
 	// Report a disconnect only if we successfully updated the invocation.
 	// This reduces the likelihood that the disconnected invocation's status
@@ -1092,6 +1163,11 @@ func (e *EventChannel) handleEvent(event *pepb.PublishBuildToolEventStreamReques
 		e.attempt = ti.Attempt
 		e.ctx = log.EnrichContext(e.ctx, "invocation_attempt", fmt.Sprintf("%d", e.attempt))
 		log.CtxInfof(e.ctx, "Created invocation %q, attempt %d", ti.InvocationID, ti.Attempt)
+		e.eventSink, err = event_sink.NewStreamer(e.ctx, e.env, iid, e.attempt)
+		if err != nil {
+			log.CtxWarningf(e.ctx, "Failed to set up event sinks: %s", err)
+		}
+		e.publisher = invocation_subscription.NewPublisher(e.env, iid)
 		chunkFileSizeBytes := *chunkFileSizeBytes
 		if chunkFileSizeBytes == 0 {
 			chunkFileSizeBytes = defaultChunkFileSizeBytes
@@ -1189,6 +1265,11 @@ func (e *EventChannel) processSingleEvent(event *inpb.InvocationEvent, iid strin
 	if err := e.beValues.AddEvent(event.GetBuildEvent()); err != nil {
 		return err
 	}
+	// Publish and stream before the progress output is cleared below.
+	e.publisher.Publish(event.GetBuildEvent())
+	if e.eventSink != nil {
+		e.eventSink.Stream(event)
+	}
 
 	switch p := event.GetBuildEvent().GetPayload().(type) {
 	case *build_event_stream.BuildEvent_Progress:
@@ -3,6 +3,10 @@ package build_event_handler_test
 import (
 	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -16,7 +20,9 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -27,6 +33,7 @@ import (
 	bspb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
 	clpb "github.com/buildbuddy-io/buildbuddy/proto/command_line"
+	espb "github.com/buildbuddy-io/buildbuddy/proto/event_sink"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 	inspb "github.com/buildbuddy-io/buildbuddy/proto/invocation_status"
 	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
@@ -740,6 +747,56 @@ func TestFinishedFinalizeWithCanceledContext(t *testing.T) {
 	assert.Equal(t, inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS, invocation.InvocationStatus)
 }
 
+func TestEventSinkReceivesProgressOutput(t *testing.T) {
+	flags.Set(t, "integrations.event_sink.enabled", true)
+	flags.Set(t, "integrations.event_sink.flush_interval", 10*time.Millisecond)
+	te := testenv.GetTestEnv(t)
+	auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
+	te.SetAuthenticator(auth)
+	bodies := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies <- b
+	}))
+	t.Cleanup(server.Close)
+	err := te.GetDBHandle().NewQuery(context.Background(), "create_sink").Create(&tables.EventSink{
+		EventSinkID: "ES1",
+		GroupID:     "GROUP1",
+		URL:         server.URL,
+		Format:      "proto",
+		EventTypes:  "progress",
+	})
+	require.NoError(t, err)
+	testUUID, err := uuid.NewRandom()
+	require.NoError(t, err)
+	testInvocationID := testUUID.String()
+
+	handler := build_event_handler.NewBuildEventHandler(te)
+	channel, err := handler.OpenChannel(context.Background(), testInvocationID)
+	require.NoError(t, err)
+	request := streamRequest(startedEvent("--remote_header='"+authutil.APIKeyHeader+"=USER1'"), testInvocationID, 1)
+	err = channel.HandleEvent(request)
+	require.NoError(t, err)
+	request = streamRequest(progressEventWithOutput("some stdout", "some stderr"), testInvocationID, 2)
+	err = channel.HandleEvent(request)
+	require.NoError(t, err)
+
+	// The progress output is written to the event log, but the event sink
+	// should still receive it.
+	select {
+	case b := <-bodies:
+		batch := &espb.EventBatch{}
+		require.NoError(t, proto.Unmarshal(b, batch))
+		require.Len(t, batch.GetEvent(), 1)
+		progress := batch.GetEvent()[0].GetBuildEvent().GetProgress()
+		assert.Equal(t, "some stdout", progress.GetStdout())
+		assert.Equal(t, "some stderr", progress.GetStderr())
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "timed out waiting for event sink request")
+	}
+}
+
 func TestFinishedFinalize(t *testing.T) {
 	te := testenv.GetTestEnv(t)
 	auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
@@ -1763,6 +1820,185 @@ func TestBuildStatusReporting_LegacyMethods(t *testing.T) {
 	}
 }
 
+type FakeGitProvider struct {
+	Statuses []*FakeGitProviderStatus
+}
+
+type FakeGitProviderStatus struct {
+	AccessToken string
+	RepoURL     string
+	CommitSHA   string
+}
+
+func (p *FakeGitProvider) MatchRepoURL(u *url.URL) bool {
+	return u.Host == "gitlab.example.com"
+}
+
+func (p *FakeGitProvider) MatchWebhookRequest(req *http.Request) bool {
+	return false
+}
+
+func (p *FakeGitProvider) ParseWebhookData(req *http.Request) (*interfaces.WebhookData, error) {
+	return nil, status.UnimplementedError("not implemented")
+}
+
+func (p *FakeGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error) {
+	return "", status.UnimplementedError("not implemented")
+}
+
+func (p *FakeGitProvider) UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
+	return status.UnimplementedError("not implemented")
+}
+
+func (p *FakeGitProvider) GetFileContents(ctx context.Context, accessToken, repoURL, filePath, ref string) ([]byte, error) {
+	return nil, status.UnimplementedError("not implemented")
+}
+
+func (p *FakeGitProvider) IsTrusted(ctx context.Context, accessToken, repoURL, user string) (bool, error) {
+	return false, status.UnimplementedError("not implemented")
+}
+
+func (p *FakeGitProvider) CreateStatus(ctx context.Context, accessToken, repoURL, commitSHA string, payload any) error {
+	p.Statuses = append(p.Statuses, &FakeGitProviderStatus{
+		AccessToken: accessToken,
+		RepoURL:     repoURL,
+		CommitSHA:   commitSHA,
+	})
+	return nil
+}
+
+func TestBuildStatusReporting_GitProvider(t *testing.T) {
+	const repoURL = "https://gitlab.example.com/testowner/testrepo"
+	const commitSHA = "0c894fe31c2e91d59cb1a59bb25aaa78089919c2"
+	for _, test := range []struct {
+		name          string
+		workflows     []*tables.Workflow
+		workflowID    string
+		expectedToken string
+	}{
+		{
+			name: "Workflow that started the invocation",
+			workflows: []*tables.Workflow{
+				{WorkflowID: "WF1", GroupID: "GROUP1", RepoURL: "https://gitlab.example.com/testowner/otherrepo", AccessToken: "account-token"},
+				{WorkflowID: "WF2", GroupID: "GROUP1", RepoURL: "https://gitlab.example.com/testowner/testrepo", AccessToken: "workflow-token"},
+			},
+			workflowID:    "WF2",
+			expectedToken: "workflow-token",
+		},
+		{
+			name: "Workflow of another group",
+			workflows: []*tables.Workflow{
+				{WorkflowID: "WF1", GroupID: "GROUP1", RepoURL: "https://gitlab.example.com/testowner/otherrepo", AccessToken: "account-token"},
+				{WorkflowID: "WF2", GroupID: "GROUP2", RepoURL: "https://gitlab.example.com/testowner/testrepo", AccessToken: "other-group-token"},
+			},
+			workflowID:    "WF2",
+			expectedToken: "account-token",
+		},
+		{
+			name: "Prefers the account linked for the repo",
+			workflows: []*tables.Workflow{
+				{WorkflowID: "WF1", GroupID: "GROUP1", RepoURL: "https://gitlab.example.com/testowner/otherrepo", AccessToken: "account-token"},
+				{WorkflowID: "WF2", GroupID: "GROUP1", RepoURL: "https://gitlab.example.com/testowner/testrepo", AccessToken: "repo-token"},
+				{WorkflowID: "WF3", GroupID: "GROUP1", RepoURL: "https://gitlab.example.com/testowner/thirdrepo", AccessToken: "third-token"},
+			},
+			expectedToken: "repo-token",
+		},
+		{
+			name: "No linked account",
+			workflows: []*tables.Workflow{
+				{WorkflowID: "WF1", GroupID: "GROUP1", RepoURL: "https://github.com/testowner/testrepo", AccessToken: "github-token"},
+				{WorkflowID: "WF2", GroupID: "GROUP2", RepoURL: "https://gitlab.example.com/testowner/testrepo", AccessToken: "other-group-token"},
+			},
+			workflowID: "WF2",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			te := testenv.GetTestEnv(t)
+			provider := &FakeGitProvider{}
+			te.SetGitProviders(interfaces.GitProviders{provider})
+			auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
+			te.SetAuthenticator(auth)
+			ctx, err := auth.WithAuthenticatedUser(context.Background(), "USER1")
+			require.NoError(t, err)
+			handler := build_event_handler.NewBuildEventHandler(te)
+
+			for _, wf := range test.workflows {
+				err := te.GetDBHandle().NewQuery(context.Background(), "create_workflow_for_test").Create(wf)
+				require.NoError(t, err)
+			}
+
+			buildEvents := []*bspb.BuildEvent{
+				{
+					Id: &bspb.BuildEventId{Id: &bspb.BuildEventId_BuildMetadata{}},
+					Payload: &bspb.BuildEvent_BuildMetadata{BuildMetadata: &bspb.BuildMetadata{
+						Metadata: map[string]string{"ROLE": "CI"},
+					}},
+				},
+				{
+					Id: &bspb.BuildEventId{Id: &bspb.BuildEventId_WorkspaceStatus{}},
+					Payload: &bspb.BuildEvent_WorkspaceStatus{WorkspaceStatus: &bspb.WorkspaceStatus{
+						Item: []*bspb.WorkspaceStatus_Item{
+							{Key: "REPO_URL", Value: repoURL + ".git"},
+							{Key: "COMMIT_SHA", Value: commitSHA},
+						},
+					}},
+				},
+			}
+			if test.workflowID != "" {
+				buildEvents = append(buildEvents, &bspb.BuildEvent{
+					Id: &bspb.BuildEventId{Id: &bspb.BuildEventId_WorkflowConfigured{}},
+					Payload: &bspb.BuildEvent_WorkflowConfigured{WorkflowConfigured: &bspb.WorkflowConfigured{
+						WorkflowId: test.workflowID,
+						ActionName: "Test all targets",
+					}},
+				})
+			}
+
+			seq := NewBESSequence(t)
+			channel, err := handler.OpenChannel(ctx, seq.InvocationID)
+			require.NoError(t, err)
+			var metadataEventIDs []*bspb.BuildEventId
+			for _, e := range buildEvents {
+				metadataEventIDs = append(metadataEventIDs, e.GetId())
+			}
+			started := &bspb.BuildEvent{
+				Id:       &bspb.BuildEventId{Id: &bspb.BuildEventId_Started{}},
+				Children: metadataEventIDs,
+				Payload: &bspb.BuildEvent_Started{Started: &bspb.BuildStarted{
+					Command:            "build",
+					OptionsDescription: "--some_build_options",
+				}},
+			}
+			err = channel.HandleEvent(seq.NextRequest(started))
+			require.NoError(t, err)
+			for _, event := range buildEvents {
+				err := channel.HandleEvent(seq.NextRequest(event))
+				require.NoError(t, err)
+			}
+			fin := &bspb.BuildEvent{
+				Id: &bspb.BuildEventId{Id: &bspb.BuildEventId_BuildFinished{}},
+				Payload: &bspb.BuildEvent_Finished{Finished: &bspb.BuildFinished{
+					ExitCode: &bspb.BuildFinished_ExitCode{
+						Name: "SUCCESS",
+						Code: 0,
+					},
+				}},
+			}
+			err = channel.HandleEvent(seq.NextRequest(fin))
+			require.NoError(t, err)
+
+			if test.expectedToken == "" {
+				require.Empty(t, provider.Statuses)
+				return
+			}
+			// Expect a pending status once metadata is loaded, and a final
+			// status once the build finishes.
+			expected := &FakeGitProviderStatus{AccessToken: test.expectedToken, RepoURL: repoURL, CommitSHA: commitSHA}
+			require.Equal(t, []*FakeGitProviderStatus{expected, expected}, provider.Statuses)
+		})
+	}
+}
+
 func TestTruncateStringSlice(t *testing.T) {
 	for _, test := range []struct {
 		Strings   []string
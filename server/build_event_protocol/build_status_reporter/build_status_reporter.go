@@ -29,6 +29,8 @@ type BuildStatusReporter struct {
 	baseBBURL                  string
 	env                        environment.Env
 	githubClient               interfaces.GitHubStatusClient
+	gitProvider                interfaces.GitProvider
+	gitProviderAccessToken     string
 	buildEventAccumulator      accumulator.Accumulator
 	groups                     map[string]*GroupStatus
 	inFlight                   map[string]bool
@@ -75,8 +77,87 @@ func (r *BuildStatusReporter) initGHClient(ctx context.Context) interfaces.GitHu
 	return r.env.GetGitHubStatusService().GetStatusClient(accessToken)
 }
 
+// nonGitHubProvider returns the git provider that hosts the repo, or nil if
+// the repo is hosted on GitHub or no provider handles it.
+func (r *BuildStatusReporter) nonGitHubProvider(repoURL string) interfaces.GitProvider {
+	if _, err := gitutil.ParseGitHubRepoURL(repoURL); err == nil {
+		return nil
+	}
+	u, err := gitutil.NormalizeRepoURL(repoURL)
+	if err != nil || u.Scheme == "file" {
+		return nil
+	}
+	for _, provider := range r.env.GetGitProviders() {
+		if provider.MatchRepoURL(u) {
+			return provider
+		}
+	}
+	return nil
+}
+
+// initGitProvider sets up status reporting through the given git provider.
+// Statuses are created with the access token of the group's workflow that
+// started the invocation, or else with the token of the provider account that
+// the group linked when creating its workflows, preferring a workflow for the
+// invocation's repo. It returns false if the group has no such workflow.
+func (r *BuildStatusReporter) initGitProvider(ctx context.Context, provider interfaces.GitProvider, repoURL string) bool {
+	dbh := r.env.GetDBHandle()
+	if dbh == nil {
+		return false
+	}
+	userInfo, err := r.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		log.CtxInfof(ctx, "Failed to report commit status, no authenticated user: %s", err)
+		return false
+	}
+	accessToken := ""
+	if workflowID := r.buildEventAccumulator.WorkflowID(); workflowID != "" {
+		workflow := &tables.Workflow{}
+		if err := dbh.NewQuery(ctx, "build_status_reporter_get_group_workflow").Raw(
+			`SELECT * from "Workflows" WHERE workflow_id = ? AND group_id = ?`, workflowID, userInfo.GetGroupID()).Take(workflow); err == nil {
+			accessToken = workflow.AccessToken
+		}
+	}
+	if accessToken == "" {
+		normalizedURL, err := gitutil.NormalizeRepoURL(repoURL)
+		if err != nil {
+			return false
+		}
+		rq := dbh.NewQuery(ctx, "build_status_reporter_get_group_workflows").Raw(
+			`SELECT * from "Workflows" WHERE group_id = ? AND access_token <> ''`, userInfo.GetGroupID())
+		err = db.ScanEach(rq, func(ctx context.Context, workflow *tables.Workflow) error {
+			// Workflow repo URLs may be formatted differently than the
+			// invocation's repo URL, so compare normalized URLs.
+			u, err := gitutil.NormalizeRepoURL(workflow.RepoURL)
+			if err != nil || u.Host != normalizedURL.Host || !provider.MatchRepoURL(u) {
+				return nil
+			}
+			if u.String() == normalizedURL.String() || accessToken == "" {
+				accessToken = workflow.AccessToken
+			}
+			return nil
+		})
+		if err != nil {
+			log.CtxWarningf(ctx, "Failed to report commit status for %s, failed to query Workflows: %s", repoURL, err)
+			return false
+		}
+	}
+	if accessToken == "" {
+		log.CtxDebugf(ctx, "Not reporting commit status for %s: group has no linked provider account", repoURL)
+		return false
+	}
+	r.gitProvider = provider
+	r.gitProviderAccessToken = accessToken
+	return true
+}
+
 func (r *BuildStatusReporter) isStatusReportingEnabled(ctx context.Context, repoURL string) bool {
 	r.once.Do(func() {
+		if provider := r.nonGitHubProvider(repoURL); provider != nil {
+			r.shouldReportCommitStatuses = r.initGitProvider(ctx, provider, repoURL)
+			return
+		}
+
 		if github.AlwaysEnableStatusReporting() {
 			r.shouldReportCommitStatuses = true
 			return
@@ -140,7 +221,8 @@ func (r *BuildStatusReporter) isStatusReportingEnabled(ctx context.Context, repo
 	return r.shouldReportCommitStatuses
 }
 
-// ReportStatusForEvent reports a status to GitHub for the event if applicable.
+// ReportStatusForEvent reports a status to the repo's git provider for the
+// event if applicable.
 // This function must be called after the accumulator has been updated with
 // the given event data.
 func (r *BuildStatusReporter) ReportStatusForEvent(ctx context.Context, event *build_event_stream.BuildEvent) {
@@ -198,11 +280,6 @@ func (r *BuildStatusReporter) ReportDisconnect(ctx context.Context) {
 }
 
 func (r *BuildStatusReporter) flushPayloadsIfMetadataLoaded(ctx context.Context) {
-	// TODO: support other providers than just GitHub
-	if r.env.GetGitHubStatusService() == nil {
-		return
-	}
-
 	// Don't report statuses if we don't yet have the metadata, it's explicitly
 	// disabled in build metadata, or it's not enabled for this repo.
 	if !r.buildEventAccumulator.MetadataIsLoaded() ||
@@ -211,7 +288,10 @@ func (r *BuildStatusReporter) flushPayloadsIfMetadataLoaded(ctx context.Context)
 		return
 	}
 
-	if r.githubClient == nil {
+	if r.gitProvider == nil && r.githubClient == nil {
+		if r.env.GetGitHubStatusService() == nil {
+			return
+		}
 		r.githubClient = r.initGHClient(ctx)
 	}
 
@@ -224,6 +304,19 @@ func (r *BuildStatusReporter) flushPayloadsIfMetadataLoaded(ctx context.Context)
 
 		// TODO(siggisim): Kick these into a queue or something (but maintain order).
 		repoURL := r.buildEventAccumulator.Invocation().GetRepoUrl()
+		if r.gitProvider != nil {
+			// Git providers translate GitHub status payloads to their own
+			// status format.
+			commitSHA := r.buildEventAccumulator.Invocation().GetCommitSha()
+			if commitSHA == "" {
+				log.CtxDebugf(ctx, "Not reporting commit status (missing COMMIT_SHA metadata)")
+				continue
+			}
+			if err := r.gitProvider.CreateStatus(ctx, r.gitProviderAccessToken, repoURL, commitSHA, payload); err != nil {
+				log.CtxInfof(ctx, "Failed to report commit status for %q @ %q: %s", repoURL, commitSHA, err)
+			}
+			continue
+		}
 		ownerRepo, err := gitutil.OwnerRepoFromRepoURL(repoURL)
 		if err != nil {
 			log.CtxWarningf(ctx, "Failed to report GitHub status: %s", err)
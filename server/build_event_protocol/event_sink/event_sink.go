@@ -0,0 +1,589 @@
+// Package event_sink streams build events to HTTP endpoints that are
+// configured per group, while the invocation is still in progress.
+//
+// Events are sent in batches (see event_sink.EventBatch) using POST requests.
+// If the sink has a secret configured, each request is signed with an
+// HMAC-SHA256 of the request body. Secrets are stored encrypted with the KMS
+// master key. Batches that cannot be delivered after all retries are written
+// to the EventSinkDeadLetters table.
+package event_sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/http/httpclient"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
+	espb "github.com/buildbuddy-io/buildbuddy/proto/event_sink"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+var (
+	enabled           = flag.Bool("integrations.event_sink.enabled", false, "Whether to stream build events to the HTTP event sinks configured per-Group.")
+	maxBatchSize      = flag.Int("integrations.event_sink.max_batch_size", 100, "The maximum number of build events sent to an event sink in a single request.")
+	flushInterval     = flag.Duration("integrations.event_sink.flush_interval", 1*time.Second, "How often buffered build events are sent to event sinks, if a full batch has not been accumulated.")
+	maxRetries        = flag.Int("integrations.event_sink.max_retries", 5, "How many times to retry sending a batch of build events to an event sink before writing it to the dead-letter table.")
+	initialBackoff    = flag.Duration("integrations.event_sink.initial_backoff", 1*time.Second, "How long to wait before the first retry of a failed event sink request. Subsequent retries back off exponentially.")
+	requestTimeout    = flag.Duration("integrations.event_sink.request_timeout", 10*time.Second, "Timeout for a single event sink request.")
+	maxPendingEvents  = flag.Int("integrations.event_sink.max_pending_events", 10_000, "The maximum number of build events buffered per event sink and invocation. Events received while the buffer is full are dropped.")
+	allowedPrivateIPs = flag.Slice("integrations.event_sink.allowed_private_ips", []string{}, "Allowed private IP ranges for event sink URLs. Private IPs are disallowed by default.")
+)
+
+const (
+	// SignatureHeader is the request header containing the HMAC-SHA256
+	// signature of the request body, formatted as "sha256=<hex digest>".
+	SignatureHeader = "X-BuildBuddy-Signature-256"
+	// InvocationIDHeader is the request header containing the ID of the
+	// invocation that the events in the request belong to.
+	InvocationIDHeader = "X-BuildBuddy-Invocation-Id"
+	// EventSinkIDHeader is the request header containing the ID of the event
+	// sink that the request is being sent to.
+	EventSinkIDHeader = "X-BuildBuddy-Event-Sink-Id"
+
+	jsonFormat  = "json"
+	protoFormat = "proto"
+
+	jsonContentType  = "application/json"
+	protoContentType = "application/x-protobuf"
+
+	// How long to keep trying to write a dead letter after delivery fails.
+	deadLetterWriteTimeout = 10 * time.Second
+	maxRetryBackoff        = 30 * time.Second
+)
+
+// Signature returns the value of the SignatureHeader for the given request
+// body, signed with the given secret.
+func Signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// EventType returns the name of the payload field that is set on the given
+// build event, e.g. "test_result". This is the name used to select events in
+// an event sink's EventTypes.
+func EventType(event *build_event_stream.BuildEvent) string {
+	m := event.ProtoReflect()
+	fd := m.WhichOneof(m.Descriptor().Oneofs().ByName("payload"))
+	if fd == nil {
+		return ""
+	}
+	return string(fd.Name())
+}
+
+// Streamer streams the build events of a single invocation attempt to all of
+// the event sinks configured for the invocation's group.
+type Streamer struct {
+	streams []*sinkStream
+}
+
+// NewStreamer returns a Streamer for the given invocation attempt, using the
+// group of the authenticated user in the given context. A nil Streamer is
+// returned if event sinks are disabled, the invocation is not authenticated,
+// or the group has no event sinks configured.
+func NewStreamer(ctx context.Context, env environment.Env, iid string, attempt uint64) (*Streamer, error) {
+	if !*enabled || env.GetDBHandle() == nil {
+		return nil, nil
+	}
+	u, err := env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil || u.GetGroupID() == "" {
+		return nil, nil
+	}
+	rq := env.GetDBHandle().NewQuery(ctx, "event_sink_get_sinks").Raw(
+		`SELECT * FROM "EventSinks" WHERE group_id = ?`, u.GetGroupID())
+	sinks, err := db.ScanAll(rq, &tables.EventSink{})
+	if err != nil {
+		return nil, status.InternalErrorf("look up event sinks: %s", err)
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	client, err := newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// Deliver events using the server context rather than the build event
+	// stream context, so that buffered events are still delivered after the
+	// stream is closed.
+	serverCtx := env.GetServerContext()
+	s := &Streamer{}
+	for _, sink := range sinks {
+		ss, err := newSinkStream(env, client, sink, iid, attempt)
+		if err != nil {
+			log.CtxWarningf(ctx, "Skipping event sink %q: %s", sink.EventSinkID, err)
+			continue
+		}
+		s.streams = append(s.streams, ss)
+		go ss.run(serverCtx)
+	}
+	if len(s.streams) == 0 {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// Stream enqueues the given event to be sent to each event sink that has
+// selected the event's type. It does not block on delivery.
+func (s *Streamer) Stream(event *inpb.InvocationEvent) {
+	eventType := EventType(event.GetBuildEvent())
+	var clone *inpb.InvocationEvent
+	for _, ss := range s.streams {
+		if !ss.selects(eventType) {
+			continue
+		}
+		// The event may be modified by the caller after it is streamed, so
+		// buffer a copy of it.
+		if clone == nil {
+			clone = proto.Clone(event).(*inpb.InvocationEvent)
+		}
+		ss.enqueue(clone)
+	}
+}
+
+// Close flushes any buffered events to the event sinks, marking the final
+// batch sent to each sink as the last batch. It does not block on delivery.
+func (s *Streamer) Close() {
+	for _, ss := range s.streams {
+		ss.close()
+	}
+}
+
+// sinkStream buffers and delivers the events of one invocation attempt to a
+// single event sink. Batches are delivered sequentially so that the sink
+// receives events in order.
+type sinkStream struct {
+	env        environment.Env
+	client     *http.Client
+	sink       *tables.EventSink
+	secret     string
+	format     string
+	eventTypes map[string]struct{}
+	iid        string
+	attempt    uint64
+
+	// flush is signaled when a full batch is available or the stream is
+	// closed.
+	flush chan struct{}
+
+	mu            sync.Mutex
+	pending       []*inpb.InvocationEvent
+	closed        bool
+	droppedEvents int64
+
+	// sequenceNumber is the sequence number of the last batch that was
+	// sent. Only accessed by the run goroutine.
+	sequenceNumber int64
+}
+
+// newHTTPClient returns a client that blocks requests to private IPs, other
+// than the ones allowed by integrations.event_sink.allowed_private_ips.
+func newHTTPClient() (*http.Client, error) {
+	allowedPrivateIPNets := make([]*net.IPNet, 0, len(*allowedPrivateIPs))
+	for _, r := range *allowedPrivateIPs {
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("parse 'integrations.event_sink.allowed_private_ips': %s", err)
+		}
+		allowedPrivateIPNets = append(allowedPrivateIPNets, ipNet)
+	}
+	client := httpclient.NewWithAllowedPrivateIPs(allowedPrivateIPNets)
+	client.Timeout = *requestTimeout
+	return client, nil
+}
+
+func newSinkStream(env environment.Env, client *http.Client, sink *tables.EventSink, iid string, attempt uint64) (*sinkStream, error) {
+	if sink.URL == "" {
+		return nil, status.FailedPreconditionError("missing URL")
+	}
+	format, err := normalizeFormat(sink.Format)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := decryptSecret(env, sink)
+	if err != nil {
+		return nil, err
+	}
+	eventTypes := make(map[string]struct{})
+	for _, t := range strings.Split(sink.EventTypes, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			eventTypes[t] = struct{}{}
+		}
+	}
+	return &sinkStream{
+		env:        env,
+		client:     client,
+		sink:       sink,
+		secret:     secret,
+		format:     format,
+		eventTypes: eventTypes,
+		iid:        iid,
+		attempt:    attempt,
+		flush:      make(chan struct{}, 1),
+	}, nil
+}
+
+func (ss *sinkStream) selects(eventType string) bool {
+	if len(ss.eventTypes) == 0 {
+		return true
+	}
+	_, ok := ss.eventTypes[eventType]
+	return ok
+}
+
+func (ss *sinkStream) enqueue(event *inpb.InvocationEvent) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closed {
+		return
+	}
+	if len(ss.pending) >= *maxPendingEvents {
+		if ss.droppedEvents == 0 {
+			log.Warningf("Event sink %q is not keeping up with invocation %s; dropping events.", ss.sink.EventSinkID, ss.iid)
+		}
+		ss.droppedEvents++
+		return
+	}
+	ss.pending = append(ss.pending, event)
+	if len(ss.pending) >= *maxBatchSize {
+		ss.signalFlush()
+	}
+}
+
+func (ss *sinkStream) close() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closed {
+		return
+	}
+	ss.closed = true
+	ss.signalFlush()
+}
+
+// signalFlush wakes up the run goroutine. Must be called with mu held.
+func (ss *sinkStream) signalFlush() {
+	select {
+	case ss.flush <- struct{}{}:
+	default:
+	}
+}
+
+// nextBatch removes up to maxBatchSize events from the buffer. It also
+// returns whether the stream is closed and the returned events are the last
+// ones that will be buffered.
+func (ss *sinkStream) nextBatch() ([]*inpb.InvocationEvent, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	n := min(len(ss.pending), *maxBatchSize)
+	events := ss.pending[:n:n]
+	ss.pending = ss.pending[n:]
+	return events, ss.closed && len(ss.pending) == 0
+}
+
+func (ss *sinkStream) run(ctx context.Context) {
+	ticker := time.NewTicker(*flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-ss.flush:
+		}
+		for {
+			events, last := ss.nextBatch()
+			if len(events) == 0 && !last {
+				break
+			}
+			ss.sequenceNumber++
+			ss.deliver(ctx, &espb.EventBatch{
+				InvocationId:   ss.iid,
+				Attempt:        ss.attempt,
+				SequenceNumber: ss.sequenceNumber,
+				LastBatch:      last,
+				Event:          events,
+			})
+			if last {
+				if ss.droppedEvents > 0 {
+					log.Warningf("Dropped %d events for invocation %s that could not be buffered for event sink %q.", ss.droppedEvents, ss.iid, ss.sink.EventSinkID)
+				}
+				return
+			}
+			if len(events) < *maxBatchSize {
+				// Wait for more events to accumulate.
+				break
+			}
+		}
+	}
+}
+
+func (ss *sinkStream) encode(batch *espb.EventBatch) ([]byte, string, error) {
+	if ss.format == protoFormat {
+		b, err := proto.Marshal(batch)
+		return b, protoContentType, err
+	}
+	b, err := protojson.Marshal(batch)
+	return b, jsonContentType, err
+}
+
+// deliver sends the batch to the event sink, retrying on failure. If the
+// batch could not be delivered, it is written to the dead-letter table.
+func (ss *sinkStream) deliver(ctx context.Context, batch *espb.EventBatch) {
+	body, contentType, err := ss.encode(batch)
+	if err != nil {
+		log.Warningf("Failed to encode events for invocation %s: %s", ss.iid, err)
+		return
+	}
+	attempts := int64(0)
+	opts := &retry.Options{
+		MaxRetries:            *maxRetries,
+		InitialBackoff:        *initialBackoff,
+		MaxBackoff:            maxRetryBackoff,
+		Multiplier:            2,
+		DontLogFailedAttempts: true,
+	}
+	err = retry.DoVoid(ctx, opts, func(ctx context.Context) error {
+		attempts++
+		return ss.post(ctx, body, contentType)
+	})
+	if err == nil {
+		return
+	}
+	log.Warningf("Failed to deliver events for invocation %s to event sink %q after %d attempt(s): %s", ss.iid, ss.sink.EventSinkID, attempts, err)
+	if err := ss.writeDeadLetter(ctx, body, contentType, attempts, err); err != nil {
+		log.Warningf("Failed to write dead letter for event sink %q: %s", ss.sink.EventSinkID, err)
+	}
+}
+
+func (ss *sinkStream) post(ctx context.Context, body []byte, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ss.sink.URL, bytes.NewReader(body))
+	if err != nil {
+		return retry.NonRetryableError(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(InvocationIDHeader, ss.iid)
+	req.Header.Set(EventSinkIDHeader, ss.sink.EventSinkID)
+	if ss.secret != "" {
+		req.Header.Set(SignatureHeader, Signature(ss.secret, body))
+	}
+	rsp, err := ss.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	io.Copy(io.Discard, rsp.Body)
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("HTTP %d %s", rsp.StatusCode, http.StatusText(rsp.StatusCode))
+	// Other client errors won't succeed on retry.
+	if rsp.StatusCode >= 400 && rsp.StatusCode < 500 && rsp.StatusCode != http.StatusRequestTimeout && rsp.StatusCode != http.StatusTooManyRequests {
+		return retry.NonRetryableError(err)
+	}
+	return err
+}
+
+func (ss *sinkStream) writeDeadLetter(ctx context.Context, body []byte, contentType string, attempts int64, deliveryErr error) error {
+	// The delivery may have failed because the server is shutting down, so
+	// don't let that prevent the dead letter from being written.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), deadLetterWriteTimeout)
+	defer cancel()
+	pk, err := tables.PrimaryKeyForTable((&tables.EventSinkDeadLetter{}).TableName())
+	if err != nil {
+		return err
+	}
+	return ss.env.GetDBHandle().NewQuery(ctx, "event_sink_write_dead_letter").Create(&tables.EventSinkDeadLetter{
+		DeadLetterID: pk,
+		EventSinkID:  ss.sink.EventSinkID,
+		GroupID:      ss.sink.GroupID,
+		InvocationID: ss.iid,
+		ContentType:  contentType,
+		Payload:      body,
+		Attempts:     attempts,
+		LastError:    deliveryErr.Error(),
+	})
+}
+
+func normalizeFormat(format string) (string, error) {
+	f := strings.ToLower(strings.TrimSpace(format))
+	if f == "" {
+		return jsonFormat, nil
+	}
+	if f != jsonFormat && f != protoFormat {
+		return "", status.InvalidArgumentErrorf("unsupported format %q", format)
+	}
+	return f, nil
+}
+
+func encryptSecret(env environment.Env, eventSinkID, secret string) ([]byte, error) {
+	if env.GetKMS() == nil {
+		return nil, status.FailedPreconditionError("event sink secrets require a KMS to be configured")
+	}
+	masterKey, err := env.GetKMS().FetchMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	return masterKey.Encrypt([]byte(secret), []byte(eventSinkID))
+}
+
+func decryptSecret(env environment.Env, sink *tables.EventSink) (string, error) {
+	if len(sink.EncryptedSecret) == 0 {
+		return "", nil
+	}
+	if env.GetKMS() == nil {
+		return "", status.FailedPreconditionError("event sink secrets require a KMS to be configured")
+	}
+	masterKey, err := env.GetKMS().FetchMasterKey()
+	if err != nil {
+		return "", err
+	}
+	secret, err := masterKey.Decrypt(sink.EncryptedSecret, []byte(sink.EventSinkID))
+	if err != nil {
+		return "", status.InternalErrorf("decrypt secret: %s", err)
+	}
+	return string(secret), nil
+}
+
+func authorizeGroupAdmin(ctx context.Context, env environment.Env, reqCtx *ctxpb.RequestContext) (string, error) {
+	if env.GetDBHandle() == nil {
+		return "", status.UnimplementedError("event sinks require a database")
+	}
+	u, err := env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return "", err
+	}
+	groupID := reqCtx.GetGroupId()
+	if groupID == "" {
+		return "", status.InvalidArgumentError("missing group ID")
+	}
+	if err := authutil.AuthorizeOrgAdmin(u, groupID); err != nil {
+		return "", err
+	}
+	return groupID, nil
+}
+
+func toProto(sink *tables.EventSink) *espb.EventSink {
+	var eventTypes []string
+	for _, t := range strings.Split(sink.EventTypes, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			eventTypes = append(eventTypes, t)
+		}
+	}
+	return &espb.EventSink{
+		EventSinkId: sink.EventSinkID,
+		Url:         sink.URL,
+		EventTypes:  eventTypes,
+		Format:      sink.Format,
+		HasSecret:   len(sink.EncryptedSecret) > 0,
+	}
+}
+
+// CreateEventSink creates an event sink for the requested group. The caller
+// must be an admin of the group.
+func CreateEventSink(ctx context.Context, env environment.Env, req *espb.CreateEventSinkRequest) (*espb.CreateEventSinkResponse, error) {
+	groupID, err := authorizeGroupAdmin(ctx, env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	es := req.GetEventSink()
+	u, err := url.Parse(es.GetUrl())
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, status.InvalidArgumentErrorf("invalid event sink URL %q", es.GetUrl())
+	}
+	format, err := normalizeFormat(es.GetFormat())
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range es.GetEventTypes() {
+		if strings.Contains(t, ",") {
+			return nil, status.InvalidArgumentErrorf("invalid event type %q", t)
+		}
+	}
+	pk, err := tables.PrimaryKeyForTable((&tables.EventSink{}).TableName())
+	if err != nil {
+		return nil, err
+	}
+	sink := &tables.EventSink{
+		EventSinkID: pk,
+		GroupID:     groupID,
+		URL:         u.String(),
+		EventTypes:  strings.Join(es.GetEventTypes(), ","),
+		Format:      format,
+	}
+	if req.GetSecret() != "" {
+		sink.EncryptedSecret, err = encryptSecret(env, pk, req.GetSecret())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := env.GetDBHandle().NewQuery(ctx, "event_sink_create").Create(sink); err != nil {
+		return nil, status.InternalErrorf("create event sink: %s", err)
+	}
+	return &espb.CreateEventSinkResponse{EventSink: toProto(sink)}, nil
+}
+
+// GetEventSinks returns the event sinks of the requested group. The caller
+// must be an admin of the group. Secrets are never returned.
+func GetEventSinks(ctx context.Context, env environment.Env, req *espb.GetEventSinksRequest) (*espb.GetEventSinksResponse, error) {
+	groupID, err := authorizeGroupAdmin(ctx, env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	rq := env.GetDBHandle().NewQuery(ctx, "event_sink_list").Raw(
+		`SELECT * FROM "EventSinks" WHERE group_id = ? ORDER BY created_at_usec`, groupID)
+	sinks, err := db.ScanAll(rq, &tables.EventSink{})
+	if err != nil {
+		return nil, status.InternalErrorf("look up event sinks: %s", err)
+	}
+	rsp := &espb.GetEventSinksResponse{}
+	for _, sink := range sinks {
+		rsp.EventSink = append(rsp.EventSink, toProto(sink))
+	}
+	return rsp, nil
+}
+
+// DeleteEventSink deletes an event sink of the requested group. The caller
+// must be an admin of the group.
+func DeleteEventSink(ctx context.Context, env environment.Env, req *espb.DeleteEventSinkRequest) (*espb.DeleteEventSinkResponse, error) {
+	groupID, err := authorizeGroupAdmin(ctx, env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	if req.GetEventSinkId() == "" {
+		return nil, status.InvalidArgumentError("missing event sink ID")
+	}
+	rsp := env.GetDBHandle().NewQuery(ctx, "event_sink_delete").Raw(
+		`DELETE FROM "EventSinks" WHERE event_sink_id = ? AND group_id = ?`,
+		req.GetEventSinkId(), groupID).Exec()
+	if rsp.Error != nil {
+		return nil, status.InternalErrorf("delete event sink: %s", rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		return nil, status.NotFoundErrorf("event sink %q not found", req.GetEventSinkId())
+	}
+	return &espb.DeleteEventSinkResponse{}, nil
+}
@@ -0,0 +1,447 @@
+package event_sink_test
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_sink"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/claims"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	cappb "github.com/buildbuddy-io/buildbuddy/proto/capability"
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
+	espb "github.com/buildbuddy-io/buildbuddy/proto/event_sink"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const testIID = "c7fbfe97-8d4f-4d6c-9e8a-2b1d8c6f3a10"
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// sinkServer is a test HTTP server that records the requests that it
+// receives and responds with a configurable status code.
+type sinkServer struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	statusCode int
+	requests   []*request
+	received   chan struct{}
+}
+
+func newSinkServer(t *testing.T, statusCode int) *sinkServer {
+	s := &sinkServer{statusCode: statusCode, received: make(chan struct{}, 100)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		s.mu.Lock()
+		s.requests = append(s.requests, &request{header: r.Header.Clone(), body: b})
+		s.mu.Unlock()
+		w.WriteHeader(s.statusCode)
+		s.received <- struct{}{}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *sinkServer) waitForRequests(t *testing.T, n int) []*request {
+	for i := 0; i < n; i++ {
+		select {
+		case <-s.received:
+		case <-time.After(10 * time.Second):
+			require.FailNowf(t, "timed out", "received %d of %d requests", i, n)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// fakeKMS is a KMS with a single, randomly generated AES-GCM master key.
+type fakeKMS struct {
+	masterKey *fakeAEAD
+}
+
+func (k *fakeKMS) FetchMasterKey() (interfaces.AEAD, error) {
+	return k.masterKey, nil
+}
+
+func (k *fakeKMS) FetchKey(uri string) (interfaces.AEAD, error) {
+	return nil, status.UnimplementedError("not implemented")
+}
+
+func (k *fakeKMS) SupportedTypes() []interfaces.KMSType {
+	return nil
+}
+
+type fakeAEAD struct {
+	gcm cipher.AEAD
+}
+
+func (a *fakeAEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	nonce := make([]byte, a.gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return a.gcm.Seal(nonce, nonce, plaintext, associatedData), nil
+}
+
+func (a *fakeAEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	n := a.gcm.NonceSize()
+	return a.gcm.Open(nil, ciphertext[:n], ciphertext[n:], associatedData)
+}
+
+func newFakeKMS(t *testing.T) *fakeKMS {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	return &fakeKMS{masterKey: &fakeAEAD{gcm: gcm}}
+}
+
+// setup returns an environment with US1, an admin of GR1, and US2, a member
+// of GR1 that is not an admin, along with a context authenticated as US1.
+func setup(t *testing.T) (*real_environment.RealEnv, context.Context) {
+	flags.Set(t, "integrations.event_sink.enabled", true)
+	flags.Set(t, "integrations.event_sink.flush_interval", 10*time.Millisecond)
+	flags.Set(t, "integrations.event_sink.initial_backoff", time.Millisecond)
+	te := testenv.GetTestEnv(t)
+	te.SetKMS(newFakeKMS(t))
+	users := testauth.TestUsers("US1", "GR1", "US2", "GR1")
+	admin := users["US1"].(*claims.Claims)
+	admin.GroupMemberships[0].Capabilities = append(admin.GroupMemberships[0].Capabilities, cappb.Capability_ORG_ADMIN)
+	ta := testauth.NewTestAuthenticator(users)
+	te.SetAuthenticator(ta)
+	ctx, err := ta.WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	return te, ctx
+}
+
+func createSink(t *testing.T, te *real_environment.RealEnv, sink *tables.EventSink) {
+	err := te.GetDBHandle().NewQuery(context.Background(), "create_sink").Create(sink)
+	require.NoError(t, err)
+}
+
+func createSinkWithAPI(t *testing.T, te *real_environment.RealEnv, ctx context.Context, sink *espb.EventSink, secret string) *espb.EventSink {
+	rsp, err := event_sink.CreateEventSink(ctx, te, &espb.CreateEventSinkRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: "GR1"},
+		EventSink:      sink,
+		Secret:         secret,
+	})
+	require.NoError(t, err)
+	return rsp.GetEventSink()
+}
+
+func event(seq int64, be *build_event_stream.BuildEvent) *inpb.InvocationEvent {
+	return &inpb.InvocationEvent{SequenceNumber: seq, BuildEvent: be}
+}
+
+func progressEvent(seq int64) *inpb.InvocationEvent {
+	return event(seq, &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_Progress{Progress: &build_event_stream.Progress{}},
+	})
+}
+
+func testResultEvent(seq int64, label string) *inpb.InvocationEvent {
+	return event(seq, &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{
+			Id: &build_event_stream.BuildEventId_TestResult{
+				TestResult: &build_event_stream.BuildEventId_TestResultId{Label: label},
+			},
+		},
+		Payload: &build_event_stream.BuildEvent_TestResult{
+			TestResult: &build_event_stream.TestResult{Status: build_event_stream.TestStatus_FAILED},
+		},
+	})
+}
+
+func TestEventType(t *testing.T) {
+	assert.Equal(t, "progress", event_sink.EventType(progressEvent(1).GetBuildEvent()))
+	assert.Equal(t, "test_result", event_sink.EventType(testResultEvent(1, "//:test").GetBuildEvent()))
+	assert.Equal(t, "", event_sink.EventType(&build_event_stream.BuildEvent{}))
+}
+
+func TestNewStreamer_NoSinks(t *testing.T) {
+	te, ctx := setup(t)
+
+	s, err := event_sink.NewStreamer(ctx, te, testIID, 1)
+	require.NoError(t, err)
+	assert.Nil(t, s)
+}
+
+func TestNewStreamer_Unauthenticated(t *testing.T) {
+	te, _ := setup(t)
+	server := newSinkServer(t, http.StatusOK)
+	createSink(t, te, &tables.EventSink{EventSinkID: "ES1", GroupID: "GR1", URL: server.URL})
+
+	s, err := event_sink.NewStreamer(context.Background(), te, testIID, 1)
+	require.NoError(t, err)
+	assert.Nil(t, s)
+}
+
+func TestStream_JSON(t *testing.T) {
+	te, ctx := setup(t)
+	server := newSinkServer(t, http.StatusOK)
+	sink := createSinkWithAPI(t, te, ctx, &espb.EventSink{
+		Url:        server.URL,
+		EventTypes: []string{"test_result", "aborted"},
+		Format:     "json",
+	}, "s3cr3t")
+	// Sinks belonging to other groups should not receive events.
+	otherServer := newSinkServer(t, http.StatusOK)
+	createSink(t, te, &tables.EventSink{EventSinkID: "ES2", GroupID: "GR2", URL: otherServer.URL})
+
+	s, err := event_sink.NewStreamer(ctx, te, testIID, 2)
+	require.NoError(t, err)
+	require.NotNil(t, s)
+
+	s.Stream(progressEvent(1))
+	s.Stream(testResultEvent(2, "//:a_test"))
+	s.Stream(testResultEvent(3, "//:b_test"))
+	s.Close()
+
+	// Events may be split across batches depending on timing, so read
+	// requests until the last batch is received.
+	var events []*inpb.InvocationEvent
+	for i := 1; ; i++ {
+		reqs := server.waitForRequests(t, 1)
+		require.Len(t, reqs, i)
+		req := reqs[i-1]
+		assert.Equal(t, "application/json", req.header.Get("Content-Type"))
+		assert.Equal(t, testIID, req.header.Get(event_sink.InvocationIDHeader))
+		assert.Equal(t, sink.GetEventSinkId(), req.header.Get(event_sink.EventSinkIDHeader))
+		assert.Equal(t, event_sink.Signature("s3cr3t", req.body), req.header.Get(event_sink.SignatureHeader))
+
+		batch := &espb.EventBatch{}
+		require.NoError(t, protojson.Unmarshal(req.body, batch))
+		assert.Equal(t, testIID, batch.GetInvocationId())
+		assert.Equal(t, uint64(2), batch.GetAttempt())
+		assert.Equal(t, int64(i), batch.GetSequenceNumber())
+		events = append(events, batch.GetEvent()...)
+		if batch.GetLastBatch() {
+			break
+		}
+	}
+	require.Len(t, events, 2)
+	assert.Equal(t, "//:a_test", events[0].GetBuildEvent().GetId().GetTestResult().GetLabel())
+	assert.Equal(t, "//:b_test", events[1].GetBuildEvent().GetId().GetTestResult().GetLabel())
+
+	otherServer.mu.Lock()
+	defer otherServer.mu.Unlock()
+	assert.Empty(t, otherServer.requests)
+}
+
+func TestStream_ProtoBatches(t *testing.T) {
+	te, ctx := setup(t)
+	flags.Set(t, "integrations.event_sink.max_batch_size", 2)
+	// Only flush full batches or on close.
+	flags.Set(t, "integrations.event_sink.flush_interval", time.Hour)
+	server := newSinkServer(t, http.StatusOK)
+	createSink(t, te, &tables.EventSink{EventSinkID: "ES1", GroupID: "GR1", URL: server.URL, Format: "proto"})
+
+	s, err := event_sink.NewStreamer(ctx, te, testIID, 1)
+	require.NoError(t, err)
+	require.NotNil(t, s)
+
+	for i := int64(1); i <= 5; i++ {
+		s.Stream(progressEvent(i))
+	}
+	s.Close()
+
+	reqs := server.waitForRequests(t, 3)
+	var seqs []int64
+	for i, req := range reqs {
+		assert.Equal(t, "application/x-protobuf", req.header.Get("Content-Type"))
+		assert.Empty(t, req.header.Get(event_sink.SignatureHeader))
+		batch := &espb.EventBatch{}
+		require.NoError(t, proto.Unmarshal(req.body, batch))
+		assert.Equal(t, int64(i+1), batch.GetSequenceNumber())
+		assert.Equal(t, i == len(reqs)-1, batch.GetLastBatch())
+		for _, e := range batch.GetEvent() {
+			seqs = append(seqs, e.GetSequenceNumber())
+		}
+	}
+	assert.Equal(t, []int64{1, 2, 3, 4, 5}, seqs)
+}
+
+func TestStream_DeadLetter(t *testing.T) {
+	te, ctx := setup(t)
+	flags.Set(t, "integrations.event_sink.max_retries", 2)
+	server := newSinkServer(t, http.StatusServiceUnavailable)
+	createSink(t, te, &tables.EventSink{EventSinkID: "ES1", GroupID: "GR1", URL: server.URL})
+
+	s, err := event_sink.NewStreamer(ctx, te, testIID, 1)
+	require.NoError(t, err)
+	require.NotNil(t, s)
+
+	s.Stream(testResultEvent(1, "//:a_test"))
+	s.Close()
+
+	// The initial attempt plus 2 retries.
+	server.waitForRequests(t, 3)
+
+	var deadLetters []*tables.EventSinkDeadLetter
+	require.Eventually(t, func() bool {
+		rq := te.GetDBHandle().NewQuery(ctx, "get_dead_letters").Raw(`SELECT * FROM "EventSinkDeadLetters"`)
+		deadLetters, err = db.ScanAll(rq, &tables.EventSinkDeadLetter{})
+		require.NoError(t, err)
+		return len(deadLetters) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+
+	dl := deadLetters[0]
+	assert.Equal(t, "ES1", dl.EventSinkID)
+	assert.Equal(t, "GR1", dl.GroupID)
+	assert.Equal(t, testIID, dl.InvocationID)
+	assert.Equal(t, "application/json", dl.ContentType)
+	assert.Equal(t, int64(3), dl.Attempts)
+	assert.Contains(t, dl.LastError, "503")
+	batch := &espb.EventBatch{}
+	require.NoError(t, protojson.Unmarshal(dl.Payload, batch))
+	require.Len(t, batch.GetEvent(), 1)
+	assert.True(t, batch.GetLastBatch())
+}
+
+func TestStream_ClientErrorIsNotRetried(t *testing.T) {
+	te, ctx := setup(t)
+	server := newSinkServer(t, http.StatusBadRequest)
+	createSink(t, te, &tables.EventSink{EventSinkID: "ES1", GroupID: "GR1", URL: server.URL})
+
+	s, err := event_sink.NewStreamer(ctx, te, testIID, 1)
+	require.NoError(t, err)
+	require.NotNil(t, s)
+	s.Close()
+
+	server.waitForRequests(t, 1)
+	require.Eventually(t, func() bool {
+		rq := te.GetDBHandle().NewQuery(ctx, "get_dead_letters").Raw(`SELECT * FROM "EventSinkDeadLetters"`)
+		deadLetters, err := db.ScanAll(rq, &tables.EventSinkDeadLetter{})
+		require.NoError(t, err)
+		return len(deadLetters) == 1 && deadLetters[0].Attempts == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	assert.Len(t, server.requests, 1)
+}
+
+func TestEventSinkAPI(t *testing.T) {
+	te, ctx := setup(t)
+	reqCtx := &ctxpb.RequestContext{GroupId: "GR1"}
+
+	created := createSinkWithAPI(t, te, ctx, &espb.EventSink{
+		Url:        "https://example.com/events",
+		EventTypes: []string{"test_result"},
+	}, "s3cr3t")
+	assert.NotEmpty(t, created.GetEventSinkId())
+	assert.Equal(t, "json", created.GetFormat())
+	assert.True(t, created.GetHasSecret())
+
+	// The secret is stored encrypted.
+	rq := te.GetDBHandle().NewQuery(ctx, "get_sinks").Raw(`SELECT * FROM "EventSinks"`)
+	sinks, err := db.ScanAll(rq, &tables.EventSink{})
+	require.NoError(t, err)
+	require.Len(t, sinks, 1)
+	assert.NotEmpty(t, sinks[0].EncryptedSecret)
+	assert.NotContains(t, string(sinks[0].EncryptedSecret), "s3cr3t")
+
+	rsp, err := event_sink.GetEventSinks(ctx, te, &espb.GetEventSinksRequest{RequestContext: reqCtx})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetEventSink(), 1)
+	assert.True(t, proto.Equal(created, rsp.GetEventSink()[0]), "got %v, want %v", rsp.GetEventSink()[0], created)
+
+	_, err = event_sink.DeleteEventSink(ctx, te, &espb.DeleteEventSinkRequest{RequestContext: reqCtx, EventSinkId: created.GetEventSinkId()})
+	require.NoError(t, err)
+	rsp, err = event_sink.GetEventSinks(ctx, te, &espb.GetEventSinksRequest{RequestContext: reqCtx})
+	require.NoError(t, err)
+	assert.Empty(t, rsp.GetEventSink())
+}
+
+func TestEventSinkAPI_InvalidSink(t *testing.T) {
+	te, ctx := setup(t)
+	for _, sink := range []*espb.EventSink{
+		{Url: "ftp://example.com"},
+		{Url: "not a url"},
+		{Url: "https://example.com", Format: "xml"},
+	} {
+		_, err := event_sink.CreateEventSink(ctx, te, &espb.CreateEventSinkRequest{
+			RequestContext: &ctxpb.RequestContext{GroupId: "GR1"},
+			EventSink:      sink,
+		})
+		assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument for %v, got %v", sink, err)
+	}
+}
+
+func TestEventSinkAPI_RequiresGroupAdmin(t *testing.T) {
+	te, adminCtx := setup(t)
+	created := createSinkWithAPI(t, te, adminCtx, &espb.EventSink{Url: "https://example.com/events"}, "")
+
+	memberCtx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US2")
+	require.NoError(t, err)
+	for _, test := range []struct {
+		name    string
+		ctx     context.Context
+		groupID string
+	}{
+		{name: "NonAdminMember", ctx: memberCtx, groupID: "GR1"},
+		{name: "OtherGroup", ctx: adminCtx, groupID: "GR2"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reqCtx := &ctxpb.RequestContext{GroupId: test.groupID}
+			_, err := event_sink.CreateEventSink(test.ctx, te, &espb.CreateEventSinkRequest{RequestContext: reqCtx, EventSink: &espb.EventSink{Url: "https://example.com"}})
+			assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+			_, err = event_sink.GetEventSinks(test.ctx, te, &espb.GetEventSinksRequest{RequestContext: reqCtx})
+			assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+			_, err = event_sink.DeleteEventSink(test.ctx, te, &espb.DeleteEventSinkRequest{RequestContext: reqCtx, EventSinkId: created.GetEventSinkId()})
+			assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+		})
+	}
+}
+
+func TestStream_PrivateIPBlocked(t *testing.T) {
+	te, ctx := setup(t)
+	flags.Set(t, "integrations.event_sink.max_retries", 1)
+	flags.Set(t, "http.client.allow_localhost", false)
+	server := newSinkServer(t, http.StatusOK)
+	createSink(t, te, &tables.EventSink{EventSinkID: "ES1", GroupID: "GR1", URL: server.URL})
+
+	s, err := event_sink.NewStreamer(ctx, te, testIID, 1)
+	require.NoError(t, err)
+	require.NotNil(t, s)
+	s.Close()
+
+	// Delivery fails without reaching the server.
+	require.Eventually(t, func() bool {
+		rq := te.GetDBHandle().NewQuery(ctx, "get_dead_letters").Raw(`SELECT * FROM "EventSinkDeadLetters"`)
+		deadLetters, err := db.ScanAll(rq, &tables.EventSinkDeadLetter{})
+		require.NoError(t, err)
+		return len(deadLetters) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	assert.Empty(t, server.requests)
+}
@@ -0,0 +1,350 @@
+package invocation_compare
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/encoding/protodelim"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	spawnpb "github.com/buildbuddy-io/buildbuddy/proto/spawn"
+)
+
+var (
+	maxDecompressedSizeBytes = flag.Int64("execution_log.max_decompressed_size_bytes", 1024*1024*1024, "The maximum decompressed size of a compact execution log that will be parsed. Logs are parsed in memory.")
+	maxEntries               = flag.Int64("execution_log.max_entries", 10_000_000, "The maximum number of entries in a compact execution log that will be parsed.")
+)
+
+const (
+	// The maximum size of a compact execution log that FetchExecutionLog will
+	// read. Logs are parsed in memory, and the parsed log is several times
+	// larger than the compressed log.
+	maxExecutionLogSizeBytes = 256 * 1024 * 1024
+
+	// The maximum size of a single entry in a compact execution log.
+	maxEntrySizeBytes = 64 * 1024 * 1024
+)
+
+// limitedReader is like io.LimitedReader, but returns a ResourceExhausted
+// error instead of EOF once the limit is exceeded.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	limit     int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, status.ResourceExhaustedErrorf("execution log exceeds max decompressed size of %d bytes", l.limit)
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// ExecutionLog is a parsed compact execution log, as written by Bazel's
+// --execution_log_compact_file flag.
+type ExecutionLog struct {
+	// All entries that can be referenced by other entries, keyed by ID.
+	entries map[uint32]*spawnpb.ExecLogEntry
+	// All spawns that have at least one output, keyed by the path of their
+	// first output. Unlike entry IDs, output paths are stable across
+	// invocations.
+	spawns map[string]*spawnpb.ExecLogEntry_Spawn
+
+	// Fingerprints of runfiles trees that have already been computed, keyed
+	// by entry ID.
+	runfilesFingerprints map[uint32]string
+}
+
+// ReadExecutionLog parses a zstd-compressed compact execution log. Logs that
+// exceed the configured max decompressed size or number of entries are
+// rejected with a ResourceExhausted error.
+func ReadExecutionLog(r io.Reader) (*ExecutionLog, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	br := bufio.NewReader(&limitedReader{r: d, remaining: *maxDecompressedSizeBytes, limit: *maxDecompressedSizeBytes})
+
+	l := &ExecutionLog{
+		entries:              make(map[uint32]*spawnpb.ExecLogEntry),
+		spawns:               make(map[string]*spawnpb.ExecLogEntry_Spawn),
+		runfilesFingerprints: make(map[uint32]string),
+	}
+	unmarshalOpts := protodelim.UnmarshalOptions{MaxSize: maxEntrySizeBytes}
+	for n := int64(0); ; n++ {
+		entry := &spawnpb.ExecLogEntry{}
+		err := unmarshalOpts.UnmarshalFrom(br, entry)
+		if err == io.EOF {
+			break
+		}
+		if status.IsResourceExhaustedError(err) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid compact execution log: %s", err)
+		}
+		if n >= *maxEntries {
+			return nil, status.ResourceExhaustedErrorf("execution log exceeds max of %d entries", *maxEntries)
+		}
+		if id := entry.GetId(); id != 0 {
+			l.entries[id] = entry
+		}
+		if spawn := entry.GetSpawn(); spawn != nil && len(spawn.GetOutputs()) > 0 {
+			if output := l.outputPath(spawn.GetOutputs()[0]); output != "" {
+				l.spawns[output] = spawn
+			}
+		}
+	}
+	return l, nil
+}
+
+// FetchExecutionLog fetches a compact execution log referenced by a build
+// event from the cache and parses it.
+func FetchExecutionLog(ctx context.Context, env environment.Env, file *build_event_stream.File) (*ExecutionLog, error) {
+	bsClient := env.GetPooledByteStreamClient()
+	if bsClient == nil {
+		return nil, status.UnavailableError("bytestream client is not configured")
+	}
+	u, err := url.Parse(file.GetUri())
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid execution log URI %q: %s", file.GetUri(), err)
+	}
+	rn, err := digest.ParseDownloadResourceName(u.Path)
+	if err != nil {
+		return nil, err
+	}
+	if size := rn.GetDigest().GetSizeBytes(); size > maxExecutionLogSizeBytes {
+		return nil, status.ResourceExhaustedErrorf("execution log size %d exceeds max of %d bytes", size, maxExecutionLogSizeBytes)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(bsClient.StreamBytestreamFile(ctx, u, pw))
+	}()
+	defer pr.Close()
+	return ReadExecutionLog(pr)
+}
+
+// PrimaryOutputs returns the primary outputs of all spawns in the log, sorted.
+// The primary output of a spawn is the path of its first output.
+func (l *ExecutionLog) PrimaryOutputs() []string {
+	return slices.Sorted(maps.Keys(l.spawns))
+}
+
+// Spawn returns the spawn with the given primary output, or nil if there is
+// no such spawn.
+func (l *ExecutionLog) Spawn(primaryOutput string) *spawnpb.ExecLogEntry_Spawn {
+	return l.spawns[primaryOutput]
+}
+
+func (l *ExecutionLog) entryPath(id uint32) string {
+	switch e := l.entries[id].GetType().(type) {
+	case *spawnpb.ExecLogEntry_File_:
+		return e.File.GetPath()
+	case *spawnpb.ExecLogEntry_Directory_:
+		return e.Directory.GetPath()
+	case *spawnpb.ExecLogEntry_UnresolvedSymlink_:
+		return e.UnresolvedSymlink.GetPath()
+	case *spawnpb.ExecLogEntry_RunfilesTree_:
+		return e.RunfilesTree.GetPath()
+	}
+	return ""
+}
+
+func (l *ExecutionLog) outputPath(output *spawnpb.ExecLogEntry_Output) string {
+	switch o := output.GetType().(type) {
+	case *spawnpb.ExecLogEntry_Output_OutputId:
+		return l.entryPath(o.OutputId)
+	case *spawnpb.ExecLogEntry_Output_InvalidOutputPath:
+		return o.InvalidOutputPath
+	case *spawnpb.ExecLogEntry_Output_FileId:
+		return l.entryPath(o.FileId)
+	case *spawnpb.ExecLogEntry_Output_DirectoryId:
+		return l.entryPath(o.DirectoryId)
+	case *spawnpb.ExecLogEntry_Output_UnresolvedSymlinkId:
+		return l.entryPath(o.UnresolvedSymlinkId)
+	}
+	return ""
+}
+
+// DigestString formats a digest as "hash/size".
+func DigestString(d *spawnpb.Digest) string {
+	return fmt.Sprintf("%s/%d", d.GetHash(), d.GetSizeBytes())
+}
+
+// Inputs returns the digests of all inputs and tools of the spawn, keyed by
+// path. Files in input directories are listed individually, symlinks are
+// summarized as "symlink:<target>" and runfiles trees as
+// "runfiles:<fingerprint>".
+func (l *ExecutionLog) Inputs(spawn *spawnpb.ExecLogEntry_Spawn) map[string]string {
+	inputs := make(map[string]string)
+	visited := make(map[uint32]struct{})
+	l.addInputSet(inputs, visited, spawn.GetInputSetId())
+	l.addInputSet(inputs, visited, spawn.GetToolSetId())
+	return inputs
+}
+
+// Outputs returns the digests of all outputs of the spawn, keyed by path, in
+// the same format as Inputs. Outputs that were not created have an empty
+// digest.
+func (l *ExecutionLog) Outputs(spawn *spawnpb.ExecLogEntry_Spawn) map[string]string {
+	outputs := make(map[string]string)
+	for _, output := range spawn.GetOutputs() {
+		switch o := output.GetType().(type) {
+		case *spawnpb.ExecLogEntry_Output_OutputId:
+			l.addInput(outputs, o.OutputId)
+		case *spawnpb.ExecLogEntry_Output_InvalidOutputPath:
+			outputs[o.InvalidOutputPath] = ""
+		case *spawnpb.ExecLogEntry_Output_FileId:
+			l.addInput(outputs, o.FileId)
+		case *spawnpb.ExecLogEntry_Output_DirectoryId:
+			l.addInput(outputs, o.DirectoryId)
+		case *spawnpb.ExecLogEntry_Output_UnresolvedSymlinkId:
+			l.addInput(outputs, o.UnresolvedSymlinkId)
+		}
+	}
+	return outputs
+}
+
+func (l *ExecutionLog) addInputSet(inputs map[string]string, visited map[uint32]struct{}, id uint32) {
+	if _, ok := visited[id]; ok || id == 0 {
+		return
+	}
+	visited[id] = struct{}{}
+	set := l.entries[id].GetInputSet()
+	for _, ids := range [][]uint32{set.GetInputIds(), set.GetFileIds(), set.GetDirectoryIds(), set.GetUnresolvedSymlinkIds()} {
+		for _, inputID := range ids {
+			l.addInput(inputs, inputID)
+		}
+	}
+	for _, transitiveID := range set.GetTransitiveSetIds() {
+		l.addInputSet(inputs, visited, transitiveID)
+	}
+}
+
+func (l *ExecutionLog) addInput(inputs map[string]string, id uint32) {
+	switch e := l.entries[id].GetType().(type) {
+	case *spawnpb.ExecLogEntry_File_:
+		inputs[e.File.GetPath()] = DigestString(e.File.GetDigest())
+	case *spawnpb.ExecLogEntry_Directory_:
+		for _, f := range e.Directory.GetFiles() {
+			inputs[e.Directory.GetPath()+"/"+f.GetPath()] = DigestString(f.GetDigest())
+		}
+	case *spawnpb.ExecLogEntry_UnresolvedSymlink_:
+		inputs[e.UnresolvedSymlink.GetPath()] = "symlink:" + e.UnresolvedSymlink.GetTargetPath()
+	case *spawnpb.ExecLogEntry_RunfilesTree_:
+		inputs[e.RunfilesTree.GetPath()] = "runfiles:" + l.runfilesFingerprint(id, e.RunfilesTree)
+	}
+}
+
+func (l *ExecutionLog) addSymlinkEntrySet(contents map[string]string, visited map[uint32]struct{}, prefix string, id uint32) {
+	if _, ok := visited[id]; ok || id == 0 {
+		return
+	}
+	visited[id] = struct{}{}
+	set := l.entries[id].GetSymlinkEntrySet()
+	for name, targetID := range set.GetDirectEntries() {
+		target := make(map[string]string)
+		l.addInput(target, targetID)
+		for path, digest := range target {
+			contents[prefix+name+" -> "+path] = digest
+		}
+	}
+	for _, transitiveID := range set.GetTransitiveSetIds() {
+		l.addSymlinkEntrySet(contents, visited, prefix, transitiveID)
+	}
+}
+
+// runfilesFingerprint returns a hash of everything that determines the
+// contents of a runfiles tree. Runfiles trees are compared as a whole rather
+// than file by file, since computing the layout of the tree is non-trivial.
+func (l *ExecutionLog) runfilesFingerprint(id uint32, tree *spawnpb.ExecLogEntry_RunfilesTree) string {
+	if fp, ok := l.runfilesFingerprints[id]; ok {
+		return fp
+	}
+	contents := make(map[string]string)
+	l.addInputSet(contents, make(map[uint32]struct{}), tree.GetInputSetId())
+	l.addSymlinkEntrySet(contents, make(map[uint32]struct{}), "symlink ", tree.GetSymlinksId())
+	l.addSymlinkEntrySet(contents, make(map[uint32]struct{}), "root_symlink ", tree.GetRootSymlinksId())
+	for _, f := range tree.GetEmptyFiles() {
+		contents["empty_file "+f] = ""
+	}
+	if m := tree.GetRepoMappingManifest(); m != nil {
+		contents["repo_mapping_manifest "+m.GetPath()] = DigestString(m.GetDigest())
+	}
+	h := sha256.New()
+	for _, k := range slices.Sorted(maps.Keys(contents)) {
+		fmt.Fprintf(h, "%s\x00%s\x00", k, contents[k])
+	}
+	fp := hex.EncodeToString(h.Sum(nil))
+	l.runfilesFingerprints[id] = fp
+	return fp
+}
+
+func sameDigest(a, b *spawnpb.Digest) bool {
+	return a.GetHash() != "" && a.GetHash() == b.GetHash() && a.GetSizeBytes() == b.GetSizeBytes()
+}
+
+// DiffExecutionLogs returns the spawns that ran in both invocations but whose
+// inputs differ, sorted by primary output path. Spawns that only ran in one of
+// the invocations are not included.
+func DiffExecutionLogs(old, new *ExecutionLog) []*apipb.SpawnDiff {
+	var diffs []*apipb.SpawnDiff
+	for _, output := range slices.Sorted(maps.Keys(new.spawns)) {
+		newSpawn := new.spawns[output]
+		oldSpawn, ok := old.spawns[output]
+		if !ok {
+			continue
+		}
+		// The spawn digest covers all of the spawn's inputs, so there is no
+		// need to compare them individually if it matches.
+		if sameDigest(oldSpawn.GetDigest(), newSpawn.GetDigest()) {
+			continue
+		}
+		oldInputs := old.Inputs(oldSpawn)
+		newInputs := new.Inputs(newSpawn)
+		diff := &apipb.SpawnDiff{
+			PrimaryOutput: output,
+			TargetLabel:   newSpawn.GetTargetLabel(),
+			Mnemonic:      newSpawn.GetMnemonic(),
+		}
+		for _, path := range UnionKeys(oldInputs, newInputs, strings.Compare) {
+			oldDigest, oldOK := oldInputs[path]
+			newDigest, newOK := newInputs[path]
+			if oldOK == newOK && oldDigest == newDigest {
+				continue
+			}
+			diff.DifferingInputCount++
+			if diff.FirstDifferingInput == nil {
+				diff.FirstDifferingInput = &apipb.InputDiff{
+					Path:      path,
+					OldDigest: oldDigest,
+					NewDigest: newDigest,
+				}
+			}
+		}
+		if diff.DifferingInputCount > 0 {
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,160 @@
+// Package invocation_compare computes the differences between two
+// invocations: their command line options, workspace status, build metadata,
+// target statuses and, when compact execution logs were uploaded, the spawns
+// whose inputs differ.
+package invocation_compare
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/proto/command_line"
+	"github.com/buildbuddy-io/buildbuddy/server/api/common"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/accumulator"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_parser"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	cmnpb "github.com/buildbuddy-io/buildbuddy/proto/api/v1/common"
+)
+
+type optionKey struct {
+	section string
+	name    string
+}
+
+// Summary accumulates the parts of an invocation's build events that are
+// compared by Compare.
+type Summary struct {
+	options         map[optionKey][]string
+	workspaceStatus map[string]string
+	buildMetadata   map[string]string
+	targetStatuses  map[string]cmnpb.Status
+	executionLog    *build_event_stream.File
+}
+
+func NewSummary() *Summary {
+	return &Summary{
+		options:         make(map[optionKey][]string),
+		workspaceStatus: make(map[string]string),
+		buildMetadata:   make(map[string]string),
+		targetStatuses:  make(map[string]cmnpb.Status),
+	}
+}
+
+// ProcessEvent records the parts of the event that are compared.
+func (s *Summary) ProcessEvent(event *build_event_stream.BuildEvent) {
+	common.UpdateTargetStatus(s.targetStatuses, event)
+	switch p := event.GetPayload().(type) {
+	case *build_event_stream.BuildEvent_StructuredCommandLine:
+		s.processCommandLine(p.StructuredCommandLine)
+	case *build_event_stream.BuildEvent_WorkspaceStatus:
+		for _, item := range p.WorkspaceStatus.GetItem() {
+			s.workspaceStatus[item.GetKey()] = item.GetValue()
+		}
+	case *build_event_stream.BuildEvent_BuildMetadata:
+		maps.Copy(s.buildMetadata, p.BuildMetadata.GetMetadata())
+	case *build_event_stream.BuildEvent_BuildToolLogs:
+		for _, f := range p.BuildToolLogs.GetLog() {
+			if f.GetName() == accumulator.CompactExecutionLogName && strings.HasPrefix(f.GetUri(), "bytestream://") {
+				s.executionLog = f
+			}
+		}
+	}
+}
+
+func (s *Summary) processCommandLine(commandLine *command_line.CommandLine) {
+	if commandLine.GetCommandLineLabel() != event_parser.StructuredCommandLineLabelCanonical {
+		return
+	}
+	for _, section := range commandLine.GetSections() {
+		for _, option := range section.GetOptionList().GetOption() {
+			key := optionKey{section: section.GetSectionLabel(), name: option.GetOptionName()}
+			s.options[key] = append(s.options[key], option.GetOptionValue())
+		}
+	}
+}
+
+// ExecutionLog returns the compact execution log uploaded by the invocation,
+// or nil if it did not upload one.
+func (s *Summary) ExecutionLog() *build_event_stream.File {
+	return s.executionLog
+}
+
+// Compare returns the differences between the old and new invocations. The
+// spawn diffs are not computed; see DiffExecutionLogs.
+func Compare(old, new *Summary) *apipb.CompareInvocationsResponse {
+	return &apipb.CompareInvocationsResponse{
+		OptionDiff:          diffOptions(old.options, new.options),
+		WorkspaceStatusDiff: diffKeyValues(old.workspaceStatus, new.workspaceStatus),
+		BuildMetadataDiff:   diffKeyValues(old.buildMetadata, new.buildMetadata),
+		TargetStatusDiff:    diffTargetStatuses(old.targetStatuses, new.targetStatuses),
+	}
+}
+
+// UnionKeys returns the union of the keys of both maps, sorted using cmp.
+func UnionKeys[K comparable, V any](a, b map[K]V, cmp func(K, K) int) []K {
+	keys := slices.Collect(maps.Keys(a))
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.SortFunc(keys, cmp)
+	return keys
+}
+
+func diffOptions(old, new map[optionKey][]string) []*apipb.OptionDiff {
+	var diffs []*apipb.OptionDiff
+	keys := UnionKeys(old, new, func(a, b optionKey) int {
+		if c := strings.Compare(a.section, b.section); c != 0 {
+			return c
+		}
+		return strings.Compare(a.name, b.name)
+	})
+	for _, k := range keys {
+		if slices.Equal(old[k], new[k]) {
+			continue
+		}
+		diffs = append(diffs, &apipb.OptionDiff{
+			Section:    k.section,
+			OptionName: k.name,
+			OldValue:   old[k],
+			NewValue:   new[k],
+		})
+	}
+	return diffs
+}
+
+func diffKeyValues(old, new map[string]string) []*apipb.KeyValueDiff {
+	var diffs []*apipb.KeyValueDiff
+	for _, k := range UnionKeys(old, new, strings.Compare) {
+		oldValue, oldOK := old[k]
+		newValue, newOK := new[k]
+		if oldOK == newOK && oldValue == newValue {
+			continue
+		}
+		diffs = append(diffs, &apipb.KeyValueDiff{
+			Key:      k,
+			OldValue: oldValue,
+			NewValue: newValue,
+		})
+	}
+	return diffs
+}
+
+func diffTargetStatuses(old, new map[string]cmnpb.Status) []*apipb.TargetStatusDiff {
+	var diffs []*apipb.TargetStatusDiff
+	for _, label := range UnionKeys(old, new, strings.Compare) {
+		if old[label] == new[label] {
+			continue
+		}
+		diffs = append(diffs, &apipb.TargetStatusDiff{
+			Label:     label,
+			OldStatus: old[label],
+			NewStatus: new[label],
+		})
+	}
+	return diffs
+}
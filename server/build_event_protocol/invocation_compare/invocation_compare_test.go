@@ -0,0 +1,357 @@
+package invocation_compare_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/proto/command_line"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_compare"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/google/go-cmp/cmp"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	cmnpb "github.com/buildbuddy-io/buildbuddy/proto/api/v1/common"
+	spawnpb "github.com/buildbuddy-io/buildbuddy/proto/spawn"
+)
+
+func commandLineEvent(label string, options ...*command_line.Option) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_StructuredCommandLine{
+			StructuredCommandLine: &command_line.CommandLine{
+				CommandLineLabel: label,
+				Sections: []*command_line.CommandLineSection{{
+					SectionLabel: "command options",
+					SectionType: &command_line.CommandLineSection_OptionList{
+						OptionList: &command_line.OptionList{Option: options},
+					},
+				}},
+			},
+		},
+	}
+}
+
+func option(name, value string) *command_line.Option {
+	return &command_line.Option{OptionName: name, OptionValue: value}
+}
+
+func workspaceStatusEvent(kvs ...string) *build_event_stream.BuildEvent {
+	ws := &build_event_stream.WorkspaceStatus{}
+	for i := 0; i < len(kvs); i += 2 {
+		ws.Item = append(ws.Item, &build_event_stream.WorkspaceStatus_Item{Key: kvs[i], Value: kvs[i+1]})
+	}
+	return &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_WorkspaceStatus{WorkspaceStatus: ws},
+	}
+}
+
+func buildMetadataEvent(metadata map[string]string) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_BuildMetadata{
+			BuildMetadata: &build_event_stream.BuildMetadata{Metadata: metadata},
+		},
+	}
+}
+
+func configuredEvent(label string) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{Id: &build_event_stream.BuildEventId_TargetConfigured{
+			TargetConfigured: &build_event_stream.BuildEventId_TargetConfiguredId{Label: label},
+		}},
+		Payload: &build_event_stream.BuildEvent_Configured{Configured: &build_event_stream.TargetConfigured{}},
+	}
+}
+
+func completedEvent(label string, success bool) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{Id: &build_event_stream.BuildEventId_TargetCompleted{
+			TargetCompleted: &build_event_stream.BuildEventId_TargetCompletedId{Label: label},
+		}},
+		Payload: &build_event_stream.BuildEvent_Completed{Completed: &build_event_stream.TargetComplete{Success: success}},
+	}
+}
+
+func testSummaryEvent(label string, s build_event_stream.TestStatus) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{Id: &build_event_stream.BuildEventId_TestSummary{
+			TestSummary: &build_event_stream.BuildEventId_TestSummaryId{Label: label},
+		}},
+		Payload: &build_event_stream.BuildEvent_TestSummary{TestSummary: &build_event_stream.TestSummary{OverallStatus: s}},
+	}
+}
+
+func executionLogEvent(uri string) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_BuildToolLogs{BuildToolLogs: &build_event_stream.BuildToolLogs{
+			Log: []*build_event_stream.File{{
+				Name: "execution_log.binpb.zst",
+				File: &build_event_stream.File_Uri{Uri: uri},
+			}},
+		}},
+	}
+}
+
+func summary(events ...*build_event_stream.BuildEvent) *invocation_compare.Summary {
+	s := invocation_compare.NewSummary()
+	for _, e := range events {
+		s.ProcessEvent(e)
+	}
+	return s
+}
+
+func TestCompare(t *testing.T) {
+	old := summary(
+		commandLineEvent("original", option("config", "ci")),
+		commandLineEvent("canonical", option("compilation_mode", "opt"), option("copt", "-O2"), option("keep_going", "1")),
+		workspaceStatusEvent("BUILD_HOST", "ci-runner", "BUILD_USER", "ci"),
+		buildMetadataEvent(map[string]string{"ROLE": "CI", "REPO_URL": "https://github.com/foo/bar"}),
+		configuredEvent("//:lib"),
+		configuredEvent("//:test"),
+		configuredEvent("//:old"),
+		completedEvent("//:lib", true),
+		completedEvent("//:test", true),
+		completedEvent("//:old", true),
+		testSummaryEvent("//:test", build_event_stream.TestStatus_PASSED),
+	)
+	new := summary(
+		commandLineEvent("canonical", option("compilation_mode", "fastbuild"), option("copt", "-O2"), option("copt", "-g"), option("keep_going", "1")),
+		workspaceStatusEvent("BUILD_HOST", "laptop", "BUILD_USER", "ci"),
+		buildMetadataEvent(map[string]string{"REPO_URL": "https://github.com/foo/bar", "VISIBILITY": "PUBLIC"}),
+		configuredEvent("//:lib"),
+		configuredEvent("//:test"),
+		configuredEvent("//:new"),
+		completedEvent("//:lib", false),
+		completedEvent("//:test", true),
+		completedEvent("//:new", true),
+		testSummaryEvent("//:test", build_event_stream.TestStatus_FAILED),
+	)
+
+	expected := &apipb.CompareInvocationsResponse{
+		OptionDiff: []*apipb.OptionDiff{
+			{Section: "command options", OptionName: "compilation_mode", OldValue: []string{"opt"}, NewValue: []string{"fastbuild"}},
+			{Section: "command options", OptionName: "copt", OldValue: []string{"-O2"}, NewValue: []string{"-O2", "-g"}},
+		},
+		WorkspaceStatusDiff: []*apipb.KeyValueDiff{
+			{Key: "BUILD_HOST", OldValue: "ci-runner", NewValue: "laptop"},
+		},
+		BuildMetadataDiff: []*apipb.KeyValueDiff{
+			{Key: "ROLE", OldValue: "CI"},
+			{Key: "VISIBILITY", NewValue: "PUBLIC"},
+		},
+		TargetStatusDiff: []*apipb.TargetStatusDiff{
+			{Label: "//:lib", OldStatus: cmnpb.Status_BUILT, NewStatus: cmnpb.Status_FAILED_TO_BUILD},
+			{Label: "//:new", NewStatus: cmnpb.Status_BUILT},
+			{Label: "//:old", OldStatus: cmnpb.Status_BUILT},
+			{Label: "//:test", OldStatus: cmnpb.Status_PASSED, NewStatus: cmnpb.Status_FAILED},
+		},
+	}
+	require.Empty(t, cmp.Diff(expected, invocation_compare.Compare(old, new), protocmp.Transform()))
+}
+
+func TestExecutionLog(t *testing.T) {
+	s := summary(executionLogEvent("bytestream://localhost:1985/blobs/abc/123"))
+	require.Equal(t, "bytestream://localhost:1985/blobs/abc/123", s.ExecutionLog().GetUri())
+
+	s = summary(executionLogEvent("file:///tmp/execution_log.binpb.zst"))
+	require.Nil(t, s.ExecutionLog())
+}
+
+func compressExecutionLog(t *testing.T, entries ...*spawnpb.ExecLogEntry) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	w, err := zstd.NewWriter(buf)
+	require.NoError(t, err)
+	for _, e := range entries {
+		_, err := protodelim.MarshalTo(w, e)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return buf
+}
+
+func writeExecutionLog(t *testing.T, entries ...*spawnpb.ExecLogEntry) *invocation_compare.ExecutionLog {
+	l, err := invocation_compare.ReadExecutionLog(compressExecutionLog(t, entries...))
+	require.NoError(t, err)
+	return l
+}
+
+func fileEntry(id uint32, path, hash string) *spawnpb.ExecLogEntry {
+	return &spawnpb.ExecLogEntry{
+		Id: id,
+		Type: &spawnpb.ExecLogEntry_File_{File: &spawnpb.ExecLogEntry_File{
+			Path:   path,
+			Digest: &spawnpb.Digest{Hash: hash, SizeBytes: int64(len(hash))},
+		}},
+	}
+}
+
+func inputSetEntry(id uint32, inputIDs []uint32, transitiveIDs ...uint32) *spawnpb.ExecLogEntry {
+	return &spawnpb.ExecLogEntry{
+		Id: id,
+		Type: &spawnpb.ExecLogEntry_InputSet_{InputSet: &spawnpb.ExecLogEntry_InputSet{
+			InputIds:         inputIDs,
+			TransitiveSetIds: transitiveIDs,
+		}},
+	}
+}
+
+func spawnEntry(label, mnemonic string, inputSetID, toolSetID, outputID uint32, digest string) *spawnpb.ExecLogEntry {
+	spawn := &spawnpb.ExecLogEntry_Spawn{
+		TargetLabel: label,
+		Mnemonic:    mnemonic,
+		InputSetId:  inputSetID,
+		ToolSetId:   toolSetID,
+		Outputs: []*spawnpb.ExecLogEntry_Output{{
+			Type: &spawnpb.ExecLogEntry_Output_OutputId{OutputId: outputID},
+		}},
+	}
+	if digest != "" {
+		spawn.Digest = &spawnpb.Digest{Hash: digest, SizeBytes: 100}
+	}
+	return &spawnpb.ExecLogEntry{Type: &spawnpb.ExecLogEntry_Spawn_{Spawn: spawn}}
+}
+
+func TestDiffExecutionLogs(t *testing.T) {
+	old := writeExecutionLog(t,
+		fileEntry(1, "external/cc_toolchain/gcc", "tool"),
+		inputSetEntry(2, []uint32{1}),
+		fileEntry(3, "lib.h", "h1"),
+		fileEntry(4, "lib.cc", "cc1"),
+		inputSetEntry(5, []uint32{4}, 6),
+		inputSetEntry(6, []uint32{3}),
+		fileEntry(7, "bazel-out/k8-fastbuild/bin/_objs/lib/lib.o", "o1"),
+		spawnEntry("//:lib", "CppCompile", 5, 2, 7, ""),
+		fileEntry(8, "main.cc", "main"),
+		inputSetEntry(9, []uint32{8}),
+		fileEntry(10, "bazel-out/k8-fastbuild/bin/_objs/main/main.o", "m1"),
+		spawnEntry("//:main", "CppCompile", 9, 2, 10, ""),
+		fileEntry(11, "data.txt", "d1"),
+		inputSetEntry(12, []uint32{11}),
+		fileEntry(13, "bazel-out/k8-fastbuild/bin/data.out", "do"),
+		spawnEntry("//:data", "Genrule", 12, 0, 13, "same"),
+		fileEntry(14, "bazel-out/k8-fastbuild/bin/old_only.out", "oo"),
+		spawnEntry("//:old_only", "Genrule", 0, 0, 14, ""),
+	)
+	new := writeExecutionLog(t,
+		fileEntry(1, "external/cc_toolchain/gcc", "tool"),
+		inputSetEntry(2, []uint32{1}),
+		fileEntry(3, "lib.h", "h2"),
+		fileEntry(4, "lib.cc", "cc1"),
+		fileEntry(5, "extra.h", "e1"),
+		inputSetEntry(6, []uint32{3, 5}),
+		inputSetEntry(7, []uint32{4}, 6),
+		fileEntry(8, "bazel-out/k8-fastbuild/bin/_objs/lib/lib.o", "o2"),
+		spawnEntry("//:lib", "CppCompile", 7, 2, 8, ""),
+		fileEntry(9, "main.cc", "main"),
+		inputSetEntry(10, []uint32{9}),
+		fileEntry(11, "bazel-out/k8-fastbuild/bin/_objs/main/main.o", "m1"),
+		spawnEntry("//:main", "CppCompile", 10, 2, 11, ""),
+		// Inputs differ, but the spawn digest is the same.
+		fileEntry(12, "data.txt", "d2"),
+		inputSetEntry(13, []uint32{12}),
+		fileEntry(14, "bazel-out/k8-fastbuild/bin/data.out", "do"),
+		spawnEntry("//:data", "Genrule", 13, 0, 14, "same"),
+	)
+
+	diffs := invocation_compare.DiffExecutionLogs(old, new)
+	expected := []*apipb.SpawnDiff{{
+		PrimaryOutput:       "bazel-out/k8-fastbuild/bin/_objs/lib/lib.o",
+		TargetLabel:         "//:lib",
+		Mnemonic:            "CppCompile",
+		DifferingInputCount: 2,
+		FirstDifferingInput: &apipb.InputDiff{
+			Path:      "extra.h",
+			NewDigest: "e1/2",
+		},
+	}}
+	require.Empty(t, cmp.Diff(expected, diffs, protocmp.Transform()))
+}
+
+func TestDiffExecutionLogs_RunfilesTree(t *testing.T) {
+	runfilesLog := func(hash string) *invocation_compare.ExecutionLog {
+		return writeExecutionLog(t,
+			fileEntry(1, "tool.py", hash),
+			inputSetEntry(2, []uint32{1}),
+			&spawnpb.ExecLogEntry{
+				Id: 3,
+				Type: &spawnpb.ExecLogEntry_RunfilesTree_{RunfilesTree: &spawnpb.ExecLogEntry_RunfilesTree{
+					Path:       "bazel-out/k8-opt-exec/bin/tool.runfiles",
+					InputSetId: 2,
+				}},
+			},
+			inputSetEntry(4, []uint32{3}),
+			fileEntry(5, "bazel-out/k8-fastbuild/bin/gen.out", "g"),
+			spawnEntry("//:gen", "Genrule", 0, 4, 5, ""),
+		)
+	}
+
+	require.Empty(t, invocation_compare.DiffExecutionLogs(runfilesLog("t1"), runfilesLog("t1")))
+
+	diffs := invocation_compare.DiffExecutionLogs(runfilesLog("t1"), runfilesLog("t2"))
+	require.Len(t, diffs, 1)
+	require.Equal(t, "bazel-out/k8-opt-exec/bin/tool.runfiles", diffs[0].GetFirstDifferingInput().GetPath())
+	require.Regexp(t, "^runfiles:[0-9a-f]{64}$", diffs[0].GetFirstDifferingInput().GetOldDigest())
+	require.NotEqual(t, diffs[0].GetFirstDifferingInput().GetOldDigest(), diffs[0].GetFirstDifferingInput().GetNewDigest())
+}
+
+func TestReadExecutionLog_Invalid(t *testing.T) {
+	_, err := invocation_compare.ReadExecutionLog(bytes.NewReader([]byte("not a compact execution log")))
+	require.Error(t, err)
+}
+
+func TestExecutionLog_Spawns(t *testing.T) {
+	l := writeExecutionLog(t,
+		fileEntry(1, "lib.cc", "cc"),
+		inputSetEntry(2, []uint32{1}),
+		&spawnpb.ExecLogEntry{
+			Id: 3,
+			Type: &spawnpb.ExecLogEntry_Directory_{Directory: &spawnpb.ExecLogEntry_Directory{
+				Path: "bazel-out/k8-fastbuild/bin/gen",
+				Files: []*spawnpb.ExecLogEntry_File{
+					{Path: "a.h", Digest: &spawnpb.Digest{Hash: "a", SizeBytes: 1}},
+				},
+			}},
+		},
+		&spawnpb.ExecLogEntry{Type: &spawnpb.ExecLogEntry_Spawn_{Spawn: &spawnpb.ExecLogEntry_Spawn{
+			InputSetId: 2,
+			Outputs: []*spawnpb.ExecLogEntry_Output{
+				{Type: &spawnpb.ExecLogEntry_Output_OutputId{OutputId: 3}},
+				{Type: &spawnpb.ExecLogEntry_Output_InvalidOutputPath{InvalidOutputPath: "bazel-out/k8-fastbuild/bin/missing"}},
+			},
+		}}},
+	)
+
+	require.Equal(t, []string{"bazel-out/k8-fastbuild/bin/gen"}, l.PrimaryOutputs())
+	spawn := l.Spawn("bazel-out/k8-fastbuild/bin/gen")
+	require.NotNil(t, spawn)
+	require.Nil(t, l.Spawn("lib.cc"))
+	require.Equal(t, map[string]string{"lib.cc": "cc/2"}, l.Inputs(spawn))
+	require.Equal(t, map[string]string{
+		"bazel-out/k8-fastbuild/bin/gen/a.h": "a/1",
+		"bazel-out/k8-fastbuild/bin/missing": "",
+	}, l.Outputs(spawn))
+}
+
+func TestReadExecutionLog_Limits(t *testing.T) {
+	entries := []*spawnpb.ExecLogEntry{
+		fileEntry(1, "a.txt", "aaa"),
+		fileEntry(2, "b.txt", "bbb"),
+		fileEntry(3, "c.txt", "ccc"),
+	}
+
+	flags.Set(t, "execution_log.max_entries", int64(2))
+	_, err := invocation_compare.ReadExecutionLog(compressExecutionLog(t, entries...))
+	require.True(t, status.IsResourceExhaustedError(err), "expected ResourceExhausted, got %v", err)
+
+	flags.Set(t, "execution_log.max_entries", int64(3))
+	_, err = invocation_compare.ReadExecutionLog(compressExecutionLog(t, entries...))
+	require.NoError(t, err)
+
+	flags.Set(t, "execution_log.max_decompressed_size_bytes", int64(10))
+	_, err = invocation_compare.ReadExecutionLog(compressExecutionLog(t, entries...))
+	require.True(t, status.IsResourceExhaustedError(err), "expected ResourceExhausted, got %v", err)
+}
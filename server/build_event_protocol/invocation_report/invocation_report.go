@@ -0,0 +1,275 @@
+// Package invocation_report builds reports of an invocation's results in
+// formats understood by other CI and code review tools: an aggregated JUnit
+// XML report of all test results, a plain-text summary of failed targets, and
+// a SARIF report of build failures.
+package invocation_report
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+var maxTotalFileSizeBytes = flag.Int64("api.invocation_report.max_total_file_size_bytes", 256*1024*1024, "The max total size of the files (test.xml files or action stderr) read to build a single invocation report. Files read after the limit is reached are left out of the report.")
+
+const (
+	JUnitXMLContentType       = "application/xml"
+	FailureSummaryContentType = "text/plain; charset=utf-8"
+	SARIFContentType          = "application/sarif+json"
+
+	// Max size of a test.xml file that will be included in the JUnit report.
+	maxTestXMLSizeBytes = 32 * 1024 * 1024
+	// Max size of action stderr that will be parsed for the SARIF report.
+	maxStderrSizeBytes = 1024 * 1024
+
+	// How many files to fetch in parallel.
+	fetchParallelism = 8
+)
+
+// FileFetcher fetches the contents of files referenced by build events.
+// interfaces.PooledByteStreamClient satisfies this interface.
+type FileFetcher interface {
+	StreamBytestreamFile(ctx context.Context, url *url.URL, writer io.Writer) error
+}
+
+// testRunKey identifies a single run of a single shard of a test target.
+// Retried attempts of the same run and shard share a key.
+type testRunKey struct {
+	label           string
+	configurationID string
+	run             int32
+	shard           int32
+}
+
+type testAttempt struct {
+	attempt int32
+	result  *build_event_stream.TestResult
+}
+
+type failedAction struct {
+	label    string
+	mnemonic string
+	action   *build_event_stream.ActionExecuted
+}
+
+type abortedTarget struct {
+	label   string
+	aborted *build_event_stream.Aborted
+}
+
+// Collector accumulates the build events of an invocation that are needed to
+// build reports.
+type Collector struct {
+	testAttempts  map[testRunKey][]*testAttempt
+	testSummaries map[string]build_event_stream.TestStatus
+	failedTargets map[string]struct{}
+	failedActions []*failedAction
+	aborted       []*abortedTarget
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		testAttempts:  make(map[testRunKey][]*testAttempt),
+		testSummaries: make(map[string]build_event_stream.TestStatus),
+		failedTargets: make(map[string]struct{}),
+	}
+}
+
+// ProcessEvent records the parts of the event that are relevant to reports.
+// Events must be processed in the order that they were received.
+func (c *Collector) ProcessEvent(event *build_event_stream.BuildEvent) {
+	label := labelFromEvent(event)
+	switch p := event.GetPayload().(type) {
+	case *build_event_stream.BuildEvent_TestResult:
+		id := event.GetId().GetTestResult()
+		key := testRunKey{
+			label:           id.GetLabel(),
+			configurationID: id.GetConfiguration().GetId(),
+			run:             id.GetRun(),
+			shard:           id.GetShard(),
+		}
+		c.testAttempts[key] = append(c.testAttempts[key], &testAttempt{
+			attempt: id.GetAttempt(),
+			result:  p.TestResult,
+		})
+	case *build_event_stream.BuildEvent_TestSummary:
+		c.testSummaries[label] = p.TestSummary.GetOverallStatus()
+	case *build_event_stream.BuildEvent_Completed:
+		if !p.Completed.GetSuccess() && label != "" {
+			c.failedTargets[label] = struct{}{}
+		}
+	case *build_event_stream.BuildEvent_Action:
+		if !p.Action.GetSuccess() {
+			if label == "" {
+				label = p.Action.GetLabel()
+			}
+			c.failedActions = append(c.failedActions, &failedAction{
+				label:    label,
+				mnemonic: p.Action.GetType(),
+				action:   p.Action,
+			})
+		}
+	case *build_event_stream.BuildEvent_Aborted:
+		if label != "" {
+			c.aborted = append(c.aborted, &abortedTarget{label: label, aborted: p.Aborted})
+		}
+	}
+}
+
+// FailureSummary returns a plain-text summary of the targets that failed to
+// build or whose tests did not pass, with one "<label> <status>" line per
+// target, sorted by label.
+func (c *Collector) FailureSummary() []byte {
+	statuses := make(map[string]string)
+	for label := range c.failedTargets {
+		statuses[label] = "FAILED_TO_BUILD"
+	}
+	for _, a := range c.aborted {
+		if _, ok := statuses[a.label]; !ok {
+			statuses[a.label] = "ABORTED_" + a.aborted.GetReason().String()
+		}
+	}
+	// Test statuses are more specific than build failures, so they take
+	// precedence.
+	for label, s := range c.testSummaries {
+		switch s {
+		case build_event_stream.TestStatus_PASSED, build_event_stream.TestStatus_FLAKY:
+			delete(statuses, label)
+		default:
+			statuses[label] = s.String()
+		}
+	}
+	buf := &bytes.Buffer{}
+	for _, label := range slices.Sorted(maps.Keys(statuses)) {
+		fmt.Fprintf(buf, "%s %s\n", label, statuses[label])
+	}
+	return buf.Bytes()
+}
+
+// sortedTestRunKeys returns the keys of all test runs, sorted by label,
+// configuration, run, and shard.
+func (c *Collector) sortedTestRunKeys() []testRunKey {
+	keys := make([]testRunKey, 0, len(c.testAttempts))
+	for k := range c.testAttempts {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b testRunKey) int {
+		if a.label != b.label {
+			return strings.Compare(a.label, b.label)
+		}
+		if a.configurationID != b.configurationID {
+			return strings.Compare(a.configurationID, b.configurationID)
+		}
+		if a.run != b.run {
+			return int(a.run - b.run)
+		}
+		return int(a.shard - b.shard)
+	})
+	return keys
+}
+
+func labelFromEvent(event *build_event_stream.BuildEvent) string {
+	switch id := event.GetId().GetId().(type) {
+	case *build_event_stream.BuildEventId_TargetConfigured:
+		return id.TargetConfigured.GetLabel()
+	case *build_event_stream.BuildEventId_TargetCompleted:
+		return id.TargetCompleted.GetLabel()
+	case *build_event_stream.BuildEventId_TestResult:
+		return id.TestResult.GetLabel()
+	case *build_event_stream.BuildEventId_TestSummary:
+		return id.TestSummary.GetLabel()
+	case *build_event_stream.BuildEventId_ActionCompleted:
+		return id.ActionCompleted.GetLabel()
+	case *build_event_stream.BuildEventId_ConfiguredLabel:
+		return id.ConfiguredLabel.GetLabel()
+	case *build_event_stream.BuildEventId_UnconfiguredLabel:
+		return id.UnconfiguredLabel.GetLabel()
+	}
+	return ""
+}
+
+// sizeBudget limits the total number of bytes of the files fetched for a
+// single report. It is safe for concurrent use.
+type sizeBudget struct {
+	limit     int64
+	remaining atomic.Int64
+}
+
+func newSizeBudget() *sizeBudget {
+	b := &sizeBudget{limit: *maxTotalFileSizeBytes}
+	b.remaining.Store(b.limit)
+	return b
+}
+
+func (b *sizeBudget) take(n int) error {
+	if b.remaining.Add(-int64(n)) < 0 {
+		return status.ResourceExhaustedErrorf("report exceeds max total file size of %d bytes", b.limit)
+	}
+	return nil
+}
+
+// limitedBuffer is an io.Writer that fails once more than limit bytes have
+// been written, or once the budget is exhausted.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit  int
+	budget *sizeBudget
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, status.ResourceExhaustedErrorf("file exceeds max size of %d bytes", b.limit)
+	}
+	if err := b.budget.take(len(p)); err != nil {
+		return 0, err
+	}
+	return b.Buffer.Write(p)
+}
+
+// fetchFile returns the contents of the file, which must be at most limit
+// bytes. The size of the file is deducted from the budget.
+func fetchFile(ctx context.Context, fetcher FileFetcher, file *build_event_stream.File, limit int, budget *sizeBudget) ([]byte, error) {
+	if contents := file.GetContents(); contents != nil {
+		if len(contents) > limit {
+			return nil, status.ResourceExhaustedErrorf("file exceeds max size of %d bytes", limit)
+		}
+		if err := budget.take(len(contents)); err != nil {
+			return nil, err
+		}
+		return contents, nil
+	}
+	if file.GetUri() == "" {
+		return nil, status.NotFoundErrorf("file %q has no URI", file.GetName())
+	}
+	if fetcher == nil {
+		return nil, status.UnavailableError("no file fetcher is configured")
+	}
+	u, err := url.Parse(file.GetUri())
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid URI %q: %s", file.GetUri(), err)
+	}
+	buf := &limitedBuffer{limit: limit, budget: budget}
+	if err := fetcher.StreamBytestreamFile(ctx, u, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func findFile(files []*build_event_stream.File, name string) *build_event_stream.File {
+	for _, f := range files {
+		if f.GetName() == name {
+			return f
+		}
+	}
+	return nil
+}
@@ -0,0 +1,440 @@
+package invocation_report_test
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_report"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeFetcher serves file contents from a map of URI to contents.
+type fakeFetcher map[string]string
+
+func (f fakeFetcher) StreamBytestreamFile(ctx context.Context, u *url.URL, w io.Writer) error {
+	contents, ok := f[u.String()]
+	if !ok {
+		return status.NotFoundErrorf("%s not found", u)
+	}
+	_, err := w.Write([]byte(contents))
+	return err
+}
+
+func testResult(label string, run, shard, attempt int32, testStatus build_event_stream.TestStatus, testXMLURI string) *build_event_stream.BuildEvent {
+	var outputs []*build_event_stream.File
+	if testXMLURI != "" {
+		outputs = append(outputs, &build_event_stream.File{
+			Name: "test.xml",
+			File: &build_event_stream.File_Uri{Uri: testXMLURI},
+		})
+	}
+	return &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{
+			Id: &build_event_stream.BuildEventId_TestResult{
+				TestResult: &build_event_stream.BuildEventId_TestResultId{
+					Label:   label,
+					Run:     run,
+					Shard:   shard,
+					Attempt: attempt,
+				},
+			},
+		},
+		Payload: &build_event_stream.BuildEvent_TestResult{
+			TestResult: &build_event_stream.TestResult{
+				Status:           testStatus,
+				TestActionOutput: outputs,
+			},
+		},
+	}
+}
+
+func testSummary(label string, testStatus build_event_stream.TestStatus) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{
+			Id: &build_event_stream.BuildEventId_TestSummary{
+				TestSummary: &build_event_stream.BuildEventId_TestSummaryId{Label: label},
+			},
+		},
+		Payload: &build_event_stream.BuildEvent_TestSummary{
+			TestSummary: &build_event_stream.TestSummary{OverallStatus: testStatus},
+		},
+	}
+}
+
+func targetCompleted(label string, success bool) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{
+			Id: &build_event_stream.BuildEventId_TargetCompleted{
+				TargetCompleted: &build_event_stream.BuildEventId_TargetCompletedId{Label: label},
+			},
+		},
+		Payload: &build_event_stream.BuildEvent_Completed{
+			Completed: &build_event_stream.TargetComplete{Success: success},
+		},
+	}
+}
+
+func failedAction(label, mnemonic, stderrURI string) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{
+			Id: &build_event_stream.BuildEventId_ActionCompleted{
+				ActionCompleted: &build_event_stream.BuildEventId_ActionCompletedId{Label: label},
+			},
+		},
+		Payload: &build_event_stream.BuildEvent_Action{
+			Action: &build_event_stream.ActionExecuted{
+				Type:     mnemonic,
+				ExitCode: 1,
+				Stderr: &build_event_stream.File{
+					Name: "stderr",
+					File: &build_event_stream.File_Uri{Uri: stderrURI},
+				},
+			},
+		},
+	}
+}
+
+func aborted(label string, reason build_event_stream.Aborted_AbortReason, description string) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{
+			Id: &build_event_stream.BuildEventId_ConfiguredLabel{
+				ConfiguredLabel: &build_event_stream.BuildEventId_ConfiguredLabelId{Label: label},
+			},
+		},
+		Payload: &build_event_stream.BuildEvent_Aborted{
+			Aborted: &build_event_stream.Aborted{Reason: reason, Description: description},
+		},
+	}
+}
+
+type testSuites struct {
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Suites   []*testSuite `xml:"testsuite"`
+}
+
+type testSuite struct {
+	Name       string `xml:"name,attr"`
+	Tests      int    `xml:"tests,attr"`
+	Failures   int    `xml:"failures,attr"`
+	Errors     int    `xml:"errors,attr"`
+	Properties []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value,attr"`
+	} `xml:"properties>property"`
+	TestCases []struct {
+		Name     string `xml:"name,attr"`
+		Failures []struct {
+			Message string `xml:"message,attr"`
+		} `xml:"failure"`
+		Errors []struct {
+			Message string `xml:"message,attr"`
+		} `xml:"error"`
+	} `xml:"testcase"`
+}
+
+func (s *testSuite) property(name string) string {
+	for _, p := range s.Properties {
+		if p.Name == name {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+const passingTestXML = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="com.example.FooTest" tests="2" failures="0" errors="0" time="1.5">
+    <testcase name="testA" classname="com.example.FooTest" time="1.0"/>
+    <testcase name="testB" classname="com.example.FooTest" time="0.5"/>
+  </testsuite>
+</testsuites>`
+
+const failingTestXML = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuite name="com.example.FooTest" tests="2" failures="1" errors="0" time="2">
+  <testcase name="testA" classname="com.example.FooTest" time="1.0"/>
+  <testcase name="testB" classname="com.example.FooTest" time="1.0">
+    <failure message="expected 1 but was 2">stack trace</failure>
+  </testcase>
+</testsuite>`
+
+func TestJUnitXML(t *testing.T) {
+	fetcher := fakeFetcher{
+		"bytestream://cache/foo/1": failingTestXML,
+		"bytestream://cache/foo/2": passingTestXML,
+		"bytestream://cache/bar/1": passingTestXML,
+		"bytestream://cache/bar/2": failingTestXML,
+	}
+	c := invocation_report.NewCollector()
+	for _, e := range []*build_event_stream.BuildEvent{
+		// A flaky test that failed on the first attempt and passed on the
+		// second.
+		testResult("//:foo_test", 1, 0, 1, build_event_stream.TestStatus_FAILED, "bytestream://cache/foo/1"),
+		testResult("//:foo_test", 1, 0, 2, build_event_stream.TestStatus_PASSED, "bytestream://cache/foo/2"),
+		testSummary("//:foo_test", build_event_stream.TestStatus_FLAKY),
+		// A sharded test with one failing shard.
+		testResult("//:bar_test", 1, 0, 1, build_event_stream.TestStatus_PASSED, "bytestream://cache/bar/1"),
+		testResult("//:bar_test", 1, 1, 1, build_event_stream.TestStatus_FAILED, "bytestream://cache/bar/2"),
+		testSummary("//:bar_test", build_event_stream.TestStatus_FAILED),
+		// A test that timed out without writing a test.xml.
+		testResult("//:baz_test", 1, 0, 1, build_event_stream.TestStatus_TIMEOUT, ""),
+		testSummary("//:baz_test", build_event_stream.TestStatus_TIMEOUT),
+		// A test that failed to build.
+		testSummary("//:qux_test", build_event_stream.TestStatus_FAILED_TO_BUILD),
+	} {
+		c.ProcessEvent(e)
+	}
+
+	b, err := c.JUnitXML(context.Background(), fetcher)
+	require.NoError(t, err)
+
+	report := &testSuites{}
+	require.NoError(t, xml.Unmarshal(b, report), string(b))
+	require.Len(t, report.Suites, 5, string(b))
+
+	// Suites are sorted by label, then shard.
+	bar0, bar1, baz, foo, qux := report.Suites[0], report.Suites[1], report.Suites[2], report.Suites[3], report.Suites[4]
+
+	assert.Equal(t, "com.example.FooTest", bar0.Name)
+	assert.Equal(t, "//:bar_test", bar0.property("bazel.label"))
+	assert.Equal(t, "0", bar0.property("bazel.shard"))
+	assert.Equal(t, 2, bar0.Tests)
+	assert.Equal(t, 0, bar0.Failures)
+
+	assert.Equal(t, "1", bar1.property("bazel.shard"))
+	assert.Equal(t, "FAILED", bar1.property("bazel.status"))
+	assert.Equal(t, 2, bar1.Tests)
+	assert.Equal(t, 1, bar1.Failures)
+
+	assert.Equal(t, "//:baz_test", baz.Name)
+	assert.Equal(t, 1, baz.Errors)
+	require.Len(t, baz.TestCases, 1)
+	require.Len(t, baz.TestCases[0].Errors, 1)
+	assert.Equal(t, "TIMEOUT", baz.TestCases[0].Errors[0].Message)
+
+	// Only the final attempt of the flaky test is included.
+	assert.Equal(t, "//:foo_test", foo.property("bazel.label"))
+	assert.Equal(t, "2", foo.property("bazel.attempt"))
+	assert.Equal(t, "1", foo.property("bazel.failed_attempts"))
+	assert.Equal(t, "true", foo.property("bazel.flaky"))
+	assert.Equal(t, 0, foo.Failures)
+
+	assert.Equal(t, "//:qux_test", qux.Name)
+	assert.Equal(t, "FAILED_TO_BUILD", qux.property("bazel.status"))
+	assert.Equal(t, 1, qux.Errors)
+
+	assert.Equal(t, 2+2+1+2+1, report.Tests)
+	assert.Equal(t, 1, report.Failures)
+	assert.Equal(t, 2, report.Errors)
+}
+
+func TestJUnitXML_FailedRunWithPassingTestXML(t *testing.T) {
+	fetcher := fakeFetcher{"bytestream://cache/foo/1": passingTestXML}
+	c := invocation_report.NewCollector()
+	c.ProcessEvent(testResult("//:foo_test", 1, 0, 1, build_event_stream.TestStatus_FAILED, "bytestream://cache/foo/1"))
+
+	b, err := c.JUnitXML(context.Background(), fetcher)
+	require.NoError(t, err)
+
+	report := &testSuites{}
+	require.NoError(t, xml.Unmarshal(b, report), string(b))
+	require.Len(t, report.Suites, 1)
+	assert.Equal(t, 3, report.Suites[0].Tests)
+	assert.Equal(t, 1, report.Suites[0].Failures)
+	assert.Equal(t, 1, report.Failures)
+}
+
+func TestJUnitXML_InvalidTestXML(t *testing.T) {
+	fetcher := fakeFetcher{"bytestream://cache/foo/1": "not xml"}
+	c := invocation_report.NewCollector()
+	c.ProcessEvent(testResult("//:foo_test", 1, 0, 1, build_event_stream.TestStatus_PASSED, "bytestream://cache/foo/1"))
+	// test.xml is missing from the cache.
+	c.ProcessEvent(testResult("//:bar_test", 1, 0, 1, build_event_stream.TestStatus_FAILED, "bytestream://cache/bar/1"))
+
+	b, err := c.JUnitXML(context.Background(), fetcher)
+	require.NoError(t, err)
+
+	report := &testSuites{}
+	require.NoError(t, xml.Unmarshal(b, report), string(b))
+	require.Len(t, report.Suites, 2)
+	assert.Equal(t, "//:bar_test", report.Suites[0].Name)
+	assert.Equal(t, 1, report.Suites[0].Failures)
+	assert.Equal(t, "//:foo_test", report.Suites[1].Name)
+	assert.Equal(t, 1, report.Suites[1].Tests)
+	assert.Equal(t, 0, report.Suites[1].Failures)
+}
+
+func TestJUnitXML_TotalSizeLimit(t *testing.T) {
+	// Only one of the test.xml files fits in the report.
+	flags.Set(t, "api.invocation_report.max_total_file_size_bytes", int64(len(failingTestXML)+10))
+	fetcher := fakeFetcher{
+		"bytestream://cache/foo/1": failingTestXML,
+		"bytestream://cache/bar/1": failingTestXML,
+	}
+	c := invocation_report.NewCollector()
+	c.ProcessEvent(testResult("//:foo_test", 1, 0, 1, build_event_stream.TestStatus_FAILED, "bytestream://cache/foo/1"))
+	c.ProcessEvent(testResult("//:bar_test", 1, 0, 1, build_event_stream.TestStatus_FAILED, "bytestream://cache/bar/1"))
+
+	b, err := c.JUnitXML(context.Background(), fetcher)
+	require.NoError(t, err)
+
+	report := &testSuites{}
+	require.NoError(t, xml.Unmarshal(b, report), string(b))
+	require.Len(t, report.Suites, 2)
+	var names []string
+	for _, s := range report.Suites {
+		names = append(names, s.Name)
+		assert.Equal(t, 1, s.Failures)
+	}
+	// Files are fetched in parallel, so either one may be left out.
+	assert.Contains(t, names, "com.example.FooTest")
+	assert.Condition(t, func() bool {
+		return slices.Contains(names, "//:foo_test") || slices.Contains(names, "//:bar_test")
+	}, "expected a synthesized suite, got %v", names)
+}
+
+func TestFailureSummary(t *testing.T) {
+	c := invocation_report.NewCollector()
+	for _, e := range []*build_event_stream.BuildEvent{
+		targetCompleted("//:lib", false),
+		targetCompleted("//:ok", true),
+		targetCompleted("//:flaky_test", true),
+		testSummary("//:flaky_test", build_event_stream.TestStatus_FLAKY),
+		targetCompleted("//:failing_test", true),
+		testSummary("//:failing_test", build_event_stream.TestStatus_FAILED),
+		aborted("//:skipped", build_event_stream.Aborted_SKIPPED, ""),
+	} {
+		c.ProcessEvent(e)
+	}
+
+	expected := "//:failing_test FAILED\n" +
+		"//:lib FAILED_TO_BUILD\n" +
+		"//:skipped ABORTED_SKIPPED\n"
+	assert.Equal(t, expected, string(c.FailureSummary()))
+}
+
+type sarifLog struct {
+	Version string `json:"version"`
+	Runs    []struct {
+		Tool struct {
+			Driver struct {
+				Name  string `json:"name"`
+				Rules []struct {
+					ID string `json:"id"`
+				} `json:"rules"`
+			} `json:"driver"`
+		} `json:"tool"`
+		Results []struct {
+			RuleID  string `json:"ruleId"`
+			Level   string `json:"level"`
+			Message struct {
+				Text string `json:"text"`
+			} `json:"message"`
+			Locations []struct {
+				PhysicalLocation *struct {
+					ArtifactLocation struct {
+						URI string `json:"uri"`
+					} `json:"artifactLocation"`
+					Region struct {
+						StartLine   int `json:"startLine"`
+						StartColumn int `json:"startColumn"`
+					} `json:"region"`
+				} `json:"physicalLocation"`
+				LogicalLocations []struct {
+					FullyQualifiedName string `json:"fullyQualifiedName"`
+				} `json:"logicalLocations"`
+			} `json:"locations"`
+		} `json:"results"`
+	} `json:"runs"`
+}
+
+func TestSARIF(t *testing.T) {
+	fetcher := fakeFetcher{
+		"bytestream://cache/cc/stderr": "\x1b[1m/home/user/.cache/bazel/_bazel_user/abc/execroot/_main/foo/foo.cc:12:5: \x1b[31merror:\x1b[0m use of undeclared identifier 'x'\n" +
+			"foo/foo.h:3:1: warning: unused variable 'y'\n" +
+			"1 error generated.\n",
+		"bytestream://cache/go/stderr": "bar/bar.go:7:2: undefined: z\n",
+		"bytestream://cache/sh/stderr": "something went wrong\n",
+	}
+	c := invocation_report.NewCollector()
+	for _, e := range []*build_event_stream.BuildEvent{
+		failedAction("//foo:foo", "CppCompile", "bytestream://cache/cc/stderr"),
+		failedAction("//bar:bar", "GoCompilePkg", "bytestream://cache/go/stderr"),
+		failedAction("//baz:gen", "Genrule", "bytestream://cache/sh/stderr"),
+		failedAction("//qux:gen", "Genrule", "bytestream://cache/missing"),
+		aborted("//skipped:target", build_event_stream.Aborted_ANALYSIS_FAILURE, "Analysis of target failed"),
+	} {
+		c.ProcessEvent(e)
+	}
+
+	b, err := c.SARIF(context.Background(), fetcher)
+	require.NoError(t, err)
+
+	report := &sarifLog{}
+	require.NoError(t, json.Unmarshal(b, report), string(b))
+	assert.Equal(t, "2.1.0", report.Version)
+	require.Len(t, report.Runs, 1)
+	run := report.Runs[0]
+	assert.Equal(t, "BuildBuddy", run.Tool.Driver.Name)
+	var ruleIDs []string
+	for _, r := range run.Tool.Driver.Rules {
+		ruleIDs = append(ruleIDs, r.ID)
+	}
+	assert.Equal(t, []string{"bazel/CppCompile", "bazel/GoCompilePkg", "bazel/Genrule", "bazel/aborted/ANALYSIS_FAILURE"}, ruleIDs)
+
+	results := run.Results
+	require.Len(t, results, 6, string(b))
+
+	assert.Equal(t, "bazel/CppCompile", results[0].RuleID)
+	assert.Equal(t, "error", results[0].Level)
+	assert.Equal(t, "use of undeclared identifier 'x'", results[0].Message.Text)
+	require.NotNil(t, results[0].Locations[0].PhysicalLocation)
+	assert.Equal(t, "foo/foo.cc", results[0].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	assert.Equal(t, 12, results[0].Locations[0].PhysicalLocation.Region.StartLine)
+	assert.Equal(t, 5, results[0].Locations[0].PhysicalLocation.Region.StartColumn)
+	assert.Equal(t, "//foo:foo", results[0].Locations[0].LogicalLocations[0].FullyQualifiedName)
+
+	assert.Equal(t, "warning", results[1].Level)
+	assert.Equal(t, "foo/foo.h", results[1].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+
+	assert.Equal(t, "bazel/GoCompilePkg", results[2].RuleID)
+	assert.Equal(t, "error", results[2].Level)
+	assert.Equal(t, "undefined: z", results[2].Message.Text)
+	assert.Equal(t, "bar/bar.go", results[2].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+
+	// Stderr without diagnostics is included in the message.
+	assert.Equal(t, "Genrule action failed with exit code 1.\nsomething went wrong", results[3].Message.Text)
+	assert.Nil(t, results[3].Locations[0].PhysicalLocation)
+	assert.Equal(t, "//baz:gen", results[3].Locations[0].LogicalLocations[0].FullyQualifiedName)
+
+	// Missing stderr still produces a result.
+	assert.Equal(t, "Genrule action failed with exit code 1.", results[4].Message.Text)
+
+	assert.Equal(t, "bazel/aborted/ANALYSIS_FAILURE", results[5].RuleID)
+	assert.Equal(t, "Analysis of target failed", results[5].Message.Text)
+	assert.Equal(t, "//skipped:target", results[5].Locations[0].LogicalLocations[0].FullyQualifiedName)
+}
+
+func TestSARIF_NoFailures(t *testing.T) {
+	c := invocation_report.NewCollector()
+	c.ProcessEvent(targetCompleted("//:ok", true))
+
+	b, err := c.SARIF(context.Background(), fakeFetcher{})
+	require.NoError(t, err)
+
+	report := &sarifLog{}
+	require.NoError(t, json.Unmarshal(b, report))
+	require.Len(t, report.Runs, 1)
+	assert.Empty(t, report.Runs[0].Results)
+	assert.Contains(t, string(b), `"results": []`)
+}
@@ -0,0 +1,328 @@
+package invocation_report
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/sync/errgroup"
+)
+
+// Names of the properties added to each test suite in the merged JUnit
+// report, identifying the Bazel test run that it came from.
+const (
+	labelProperty          = "bazel.label"
+	runProperty            = "bazel.run"
+	shardProperty          = "bazel.shard"
+	attemptProperty        = "bazel.attempt"
+	statusProperty         = "bazel.status"
+	flakyProperty          = "bazel.flaky"
+	failedAttemptsProperty = "bazel.failed_attempts"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name          `xml:"testsuites"`
+	Name     string            `xml:"name,attr,omitempty"`
+	Tests    int               `xml:"tests,attr"`
+	Failures int               `xml:"failures,attr"`
+	Errors   int               `xml:"errors,attr"`
+	Skipped  int               `xml:"skipped,attr"`
+	Time     string            `xml:"time,attr,omitempty"`
+	Suites   []*junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string            `xml:"name,attr"`
+	Tests      int               `xml:"tests,attr"`
+	Failures   int               `xml:"failures,attr"`
+	Errors     int               `xml:"errors,attr"`
+	Skipped    int               `xml:"skipped,attr"`
+	Time       string            `xml:"time,attr,omitempty"`
+	Timestamp  string            `xml:"timestamp,attr,omitempty"`
+	Hostname   string            `xml:"hostname,attr,omitempty"`
+	Properties *junitProperties  `xml:"properties,omitempty"`
+	TestCases  []*junitTestCase  `xml:"testcase"`
+	Suites     []*junitTestSuite `xml:"testsuite"`
+	SystemOut  string            `xml:"system-out,omitempty"`
+	SystemErr  string            `xml:"system-err,omitempty"`
+}
+
+type junitProperties struct {
+	Properties []*junitProperty `xml:"property"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string         `xml:"name,attr"`
+	ClassName string         `xml:"classname,attr,omitempty"`
+	Time      string         `xml:"time,attr,omitempty"`
+	Status    string         `xml:"status,attr,omitempty"`
+	Result    string         `xml:"result,attr,omitempty"`
+	Failures  []*junitResult `xml:"failure"`
+	Errors    []*junitResult `xml:"error"`
+	Skipped   *junitResult   `xml:"skipped"`
+	SystemOut string         `xml:"system-out,omitempty"`
+	SystemErr string         `xml:"system-err,omitempty"`
+}
+
+type junitResult struct {
+	Message string `xml:"message,attr,omitempty"`
+	Type    string `xml:"type,attr,omitempty"`
+	Body    string `xml:",chardata"`
+}
+
+// parseTestXML parses a test.xml file, which may have either a <testsuites>
+// or a <testsuite> root element. The file is decoded in a single pass.
+func parseTestXML(b []byte) ([]*junitTestSuite, error) {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("missing root element")
+		}
+		if err != nil {
+			return nil, err
+		}
+		root, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch root.Name.Local {
+		case "testsuites":
+			suites := &junitTestSuites{}
+			if err := d.DecodeElement(suites, &root); err != nil {
+				return nil, err
+			}
+			return suites.Suites, nil
+		case "testsuite":
+			suite := &junitTestSuite{}
+			if err := d.DecodeElement(suite, &root); err != nil {
+				return nil, err
+			}
+			return []*junitTestSuite{suite}, nil
+		default:
+			return nil, fmt.Errorf("unexpected root element <%s>", root.Name.Local)
+		}
+	}
+}
+
+// updateCounts recomputes the test counts of the suite from its test cases
+// and nested suites. Suites without any test cases keep the counts from the
+// original test.xml.
+func (s *junitTestSuite) updateCounts() {
+	for _, child := range s.Suites {
+		child.updateCounts()
+	}
+	if len(s.TestCases) == 0 && len(s.Suites) == 0 {
+		return
+	}
+	s.Tests, s.Failures, s.Errors, s.Skipped = 0, 0, 0, 0
+	for _, tc := range s.TestCases {
+		s.Tests++
+		switch {
+		case len(tc.Errors) > 0:
+			s.Errors++
+		case len(tc.Failures) > 0:
+			s.Failures++
+		case tc.Skipped != nil:
+			s.Skipped++
+		}
+	}
+	for _, child := range s.Suites {
+		s.Tests += child.Tests
+		s.Failures += child.Failures
+		s.Errors += child.Errors
+		s.Skipped += child.Skipped
+	}
+}
+
+func (s *junitTestSuite) addProperty(name, value string) {
+	if s.Properties == nil {
+		s.Properties = &junitProperties{}
+	}
+	s.Properties.Properties = append(s.Properties.Properties, &junitProperty{Name: name, Value: value})
+}
+
+// syntheticTestSuite returns a test suite with a single test case describing
+// the result of a test run that did not produce a usable test.xml, e.g.
+// because it timed out or failed to build.
+func syntheticTestSuite(label string, testStatus build_event_stream.TestStatus, details string) *junitTestSuite {
+	tc := &junitTestCase{Name: label, ClassName: label}
+	result := &junitResult{Message: testStatus.String(), Body: details}
+	switch testStatus {
+	case build_event_stream.TestStatus_PASSED, build_event_stream.TestStatus_FLAKY:
+	case build_event_stream.TestStatus_FAILED:
+		tc.Failures = append(tc.Failures, result)
+	case build_event_stream.TestStatus_NO_STATUS:
+		tc.Skipped = result
+	default:
+		tc.Errors = append(tc.Errors, result)
+	}
+	return &junitTestSuite{Name: label, TestCases: []*junitTestCase{tc}}
+}
+
+func isPassing(testStatus build_event_stream.TestStatus) bool {
+	return testStatus == build_event_stream.TestStatus_PASSED || testStatus == build_event_stream.TestStatus_FLAKY
+}
+
+// testRunSuites returns the test suites for a single test run. The final
+// attempt determines the result of the run; earlier failed attempts are
+// recorded as properties on the suites so that flaky tests can be
+// identified.
+func testRunSuites(ctx context.Context, fetcher FileFetcher, budget *sizeBudget, key testRunKey, attempts []*testAttempt) []*junitTestSuite {
+	final := attempts[0]
+	failedAttempts := 0
+	for _, a := range attempts {
+		if a.attempt > final.attempt {
+			final = a
+		}
+	}
+	for _, a := range attempts {
+		if a != final && !isPassing(a.result.GetStatus()) {
+			failedAttempts++
+		}
+	}
+	finalStatus := final.result.GetStatus()
+
+	var suites []*junitTestSuite
+	var fetchErr error
+	if f := findFile(final.result.GetTestActionOutput(), "test.xml"); f != nil {
+		b, err := fetchFile(ctx, fetcher, f, maxTestXMLSizeBytes, budget)
+		fetchErr = err
+		if err == nil {
+			suites, err = parseTestXML(b)
+		}
+		if err != nil {
+			log.CtxInfof(ctx, "Could not read test.xml for %s: %s", key.label, err)
+		}
+	}
+	if len(suites) == 0 {
+		details := final.result.GetStatusDetails()
+		if status.IsResourceExhaustedError(fetchErr) {
+			details = fmt.Sprintf("The test.xml file of %s was left out of the report: %s", key.label, status.Message(fetchErr))
+		} else if details == "" && !isPassing(finalStatus) {
+			details = fmt.Sprintf("%s did not produce a test.xml file.", key.label)
+		}
+		suites = []*junitTestSuite{syntheticTestSuite(key.label, finalStatus, details)}
+	}
+
+	for _, s := range suites {
+		if s.Name == "" {
+			s.Name = key.label
+		}
+		s.addProperty(labelProperty, key.label)
+		s.addProperty(runProperty, strconv.Itoa(int(key.run)))
+		s.addProperty(shardProperty, strconv.Itoa(int(key.shard)))
+		s.addProperty(attemptProperty, strconv.Itoa(int(final.attempt)))
+		s.addProperty(statusProperty, finalStatus.String())
+		if failedAttempts > 0 {
+			s.addProperty(failedAttemptsProperty, strconv.Itoa(failedAttempts))
+			if isPassing(finalStatus) {
+				s.addProperty(flakyProperty, "true")
+			}
+		}
+		s.updateCounts()
+	}
+
+	// Make sure that failed runs are reported as failures, even if the
+	// test.xml file doesn't contain any failed test cases (e.g. if the test
+	// crashed after writing it).
+	if !isPassing(finalStatus) {
+		failed := false
+		for _, s := range suites {
+			failed = failed || s.Failures > 0 || s.Errors > 0
+		}
+		if !failed {
+			details := final.result.GetStatusDetails()
+			s := suites[0]
+			s.TestCases = append(s.TestCases, syntheticTestSuite(key.label, finalStatus, details).TestCases...)
+			s.updateCounts()
+		}
+	}
+	return suites
+}
+
+// JUnitXML returns a single JUnit XML report that merges the test.xml files
+// of every test run in the invocation. For tests that were retried, only the
+// final attempt is included. Test runs without a usable test.xml file are
+// represented by a single synthesized test case, as are test targets that
+// failed to build.
+func (c *Collector) JUnitXML(ctx context.Context, fetcher FileFetcher) ([]byte, error) {
+	keys := c.sortedTestRunKeys()
+	budget := newSizeBudget()
+	suitesByRun := make([][]*junitTestSuite, len(keys))
+	eg, gctx := errgroup.WithContext(ctx)
+	eg.SetLimit(fetchParallelism)
+	for i, key := range keys {
+		eg.Go(func() error {
+			suitesByRun[i] = testRunSuites(gctx, fetcher, budget, key, c.testAttempts[key])
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	report := &junitTestSuites{}
+	for _, suites := range suitesByRun {
+		report.Suites = append(report.Suites, suites...)
+	}
+	// Test targets that did not run at all (e.g. because they failed to
+	// build) only have a summary.
+	hasResults := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		hasResults[k.label] = true
+	}
+	for _, label := range slices.Sorted(maps.Keys(c.testSummaries)) {
+		testStatus := c.testSummaries[label]
+		if hasResults[label] || isPassing(testStatus) {
+			continue
+		}
+		s := syntheticTestSuite(label, testStatus, fmt.Sprintf("%s did not run.", label))
+		s.addProperty(labelProperty, label)
+		s.addProperty(statusProperty, testStatus.String())
+		s.updateCounts()
+		report.Suites = append(report.Suites, s)
+	}
+
+	totalTime := 0.0
+	hasTime := false
+	for _, s := range report.Suites {
+		report.Tests += s.Tests
+		report.Failures += s.Failures
+		report.Errors += s.Errors
+		report.Skipped += s.Skipped
+		if t, err := strconv.ParseFloat(s.Time, 64); err == nil {
+			totalTime += t
+			hasTime = true
+		}
+	}
+	if hasTime {
+		report.Time = strconv.FormatFloat(totalTime, 'f', 3, 64)
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
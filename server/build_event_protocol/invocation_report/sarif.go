@@ -0,0 +1,250 @@
+package invocation_report
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+)
+
+const (
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	sarifVersion = "2.1.0"
+	sarifTool    = "BuildBuddy"
+
+	// Max length of a result message that is not parsed from a diagnostic.
+	maxSARIFMessageLength = 4096
+)
+
+var (
+	// Matches compiler diagnostics of the form
+	// "path/to/file.cc:12:5: error: message", where the column and severity
+	// are optional.
+	diagnosticRegexp = regexp.MustCompile(`^([^\s:][^:]*):(\d+):(?:(\d+):)?\s*(?:(fatal error|error|warning|note):\s*)?(.+)$`)
+
+	// Matches ANSI color and cursor control sequences.
+	ansiEscapeRegexp = regexp.MustCompile("\x1b\\[[0-9;?]*[a-zA-Z]")
+)
+
+type sarifLog struct {
+	Schema  string      `json:"$schema"`
+	Version string      `json:"version"`
+	Runs    []*sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    *sarifToolComponent `json:"tool"`
+	Results []*sarifResult      `json:"results"`
+}
+
+type sarifToolComponent struct {
+	Driver *sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string       `json:"name"`
+	InformationURI string       `json:"informationUri,omitempty"`
+	Rules          []*sarifRule `json:"rules,omitempty"`
+}
+
+type sarifRule struct {
+	ID string `json:"id"`
+}
+
+type sarifResult struct {
+	RuleID    string           `json:"ruleId"`
+	Level     string           `json:"level"`
+	Message   *sarifMessage    `json:"message"`
+	Locations []*sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation *sarifPhysicalLocation  `json:"physicalLocation,omitempty"`
+	LogicalLocations []*sarifLogicalLocation `json:"logicalLocations,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation *sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion           `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+type sarifLogicalLocation struct {
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+	Kind               string `json:"kind,omitempty"`
+}
+
+// workspaceRelativePath strips the execution root from absolute paths in
+// diagnostics, so that the path is relative to the workspace root.
+func workspaceRelativePath(path string) string {
+	path = strings.TrimPrefix(path, "./")
+	if i := strings.Index(path, "/execroot/"); i >= 0 {
+		// Strip everything up to and including the workspace name, e.g.
+		// "/home/user/.cache/bazel/_bazel_user/abc/execroot/_main/".
+		rest := path[i+len("/execroot/"):]
+		if j := strings.Index(rest, "/"); j >= 0 {
+			return rest[j+1:]
+		}
+	}
+	return path
+}
+
+func sarifLevel(severity string) string {
+	switch severity {
+	case "warning":
+		return "warning"
+	case "note":
+		return "note"
+	default:
+		return "error"
+	}
+}
+
+// parseDiagnostics returns a SARIF result for each compiler diagnostic found
+// in the given output.
+func parseDiagnostics(ruleID, label, output string) []*sarifResult {
+	var results []*sarifResult
+	for _, line := range strings.Split(output, "\n") {
+		m := diagnosticRegexp.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if m == nil {
+			continue
+		}
+		lineNumber, err := strconv.Atoi(m[2])
+		if err != nil || lineNumber == 0 {
+			continue
+		}
+		region := &sarifRegion{StartLine: lineNumber}
+		if col, err := strconv.Atoi(m[3]); err == nil {
+			region.StartColumn = col
+		}
+		results = append(results, &sarifResult{
+			RuleID:  ruleID,
+			Level:   sarifLevel(m[4]),
+			Message: &sarifMessage{Text: m[5]},
+			Locations: []*sarifLocation{{
+				PhysicalLocation: &sarifPhysicalLocation{
+					ArtifactLocation: &sarifArtifactLocation{URI: workspaceRelativePath(m[1])},
+					Region:           region,
+				},
+				LogicalLocations: labelLocation(label),
+			}},
+		})
+	}
+	return results
+}
+
+func labelLocation(label string) []*sarifLogicalLocation {
+	if label == "" {
+		return nil
+	}
+	return []*sarifLogicalLocation{{FullyQualifiedName: label, Kind: "module"}}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// failedActionResults returns the SARIF results for a failed action. The
+// action's stderr is parsed for compiler diagnostics; if none are found, a
+// single result containing the stderr is returned.
+func failedActionResults(ctx context.Context, fetcher FileFetcher, budget *sizeBudget, a *failedAction) []*sarifResult {
+	mnemonic := a.mnemonic
+	if mnemonic == "" {
+		mnemonic = "Action"
+	}
+	ruleID := "bazel/" + mnemonic
+	stderr := ""
+	if f := a.action.GetStderr(); f != nil {
+		b, err := fetchFile(ctx, fetcher, f, maxStderrSizeBytes, budget)
+		if err != nil {
+			log.CtxInfof(ctx, "Could not read stderr for failed %s action of %s: %s", mnemonic, a.label, err)
+		} else {
+			stderr = ansiEscapeRegexp.ReplaceAllString(string(b), "")
+		}
+	}
+	if results := parseDiagnostics(ruleID, a.label, stderr); len(results) > 0 {
+		return results
+	}
+	text := fmt.Sprintf("%s action failed with exit code %d.", mnemonic, a.action.GetExitCode())
+	if stderr = strings.TrimSpace(stderr); stderr != "" {
+		text += "\n" + truncate(stderr, maxSARIFMessageLength)
+	}
+	return []*sarifResult{{
+		RuleID:    ruleID,
+		Level:     "error",
+		Message:   &sarifMessage{Text: text},
+		Locations: []*sarifLocation{{LogicalLocations: labelLocation(a.label)}},
+	}}
+}
+
+// SARIF returns a SARIF report of the build failures in the invocation: one
+// result per compiler diagnostic printed by failed actions (or one result per
+// failed action if no diagnostics could be parsed), and one result per
+// aborted target.
+func (c *Collector) SARIF(ctx context.Context, fetcher FileFetcher) ([]byte, error) {
+	var results []*sarifResult
+	budget := newSizeBudget()
+	for _, a := range c.failedActions {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		results = append(results, failedActionResults(ctx, fetcher, budget, a)...)
+	}
+	for _, a := range c.aborted {
+		text := a.aborted.GetDescription()
+		if text == "" {
+			text = fmt.Sprintf("%s was aborted (%s).", a.label, a.aborted.GetReason())
+		}
+		results = append(results, &sarifResult{
+			RuleID:    "bazel/aborted/" + a.aborted.GetReason().String(),
+			Level:     "error",
+			Message:   &sarifMessage{Text: text},
+			Locations: []*sarifLocation{{LogicalLocations: labelLocation(a.label)}},
+		})
+	}
+
+	// Declare each rule that was used by a result.
+	var rules []*sarifRule
+	seenRules := make(map[string]bool)
+	for _, r := range results {
+		if !seenRules[r.RuleID] {
+			seenRules[r.RuleID] = true
+			rules = append(rules, &sarifRule{ID: r.RuleID})
+		}
+	}
+	if results == nil {
+		results = []*sarifResult{}
+	}
+	report := &sarifLog{
+		Schema:  sarifSchema,
+		Version: sarifVersion,
+		Runs: []*sarifRun{{
+			Tool: &sarifToolComponent{Driver: &sarifDriver{
+				Name:           sarifTool,
+				InformationURI: "https://www.buildbuddy.io",
+				Rules:          rules,
+			}},
+			Results: results,
+		}},
+	}
+	return json.MarshalIndent(report, "", "  ")
+}
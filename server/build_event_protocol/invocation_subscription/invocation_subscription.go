@@ -0,0 +1,284 @@
+// Package invocation_subscription lets clients subscribe to the updates of an
+// in-progress invocation: new build events, progress output and target status
+// changes.
+//
+// The app that is handling the invocation's build event stream publishes
+// updates to a PubSub channel for the invocation, so subscribers can be
+// connected to any app.
+package invocation_subscription
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/api/common"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	cmnpb "github.com/buildbuddy-io/buildbuddy/proto/api/v1/common"
+	inspb "github.com/buildbuddy-io/buildbuddy/proto/invocation_status"
+)
+
+var (
+	enabled           = flag.Bool("app.invocation_subscriptions.enabled", false, "Whether to publish the updates of in-progress invocations, so that clients can subscribe to them using the SubscribeInvocation API. Requires PubSub to be configured.")
+	maxPendingUpdates = flag.Int("app.invocation_subscriptions.max_pending_updates", 1000, "The maximum number of updates buffered per invocation while waiting to be published. Updates received while the buffer is full are dropped.")
+)
+
+const (
+	// How often subscribers check whether the invocation has completed, in
+	// case the app handling the invocation went away before publishing the
+	// final update.
+	statusPollInterval = 15 * time.Second
+)
+
+// Channel returns the PubSub channel that updates for the given invocation are
+// published to.
+func Channel(iid string) string {
+	return fmt.Sprintf("invocation/%s/updates", iid)
+}
+
+// UpdateType returns the name of the update field that is set on the given
+// update, e.g. "build_event".
+func UpdateType(update *apipb.SubscribeInvocationResponse) string {
+	m := update.ProtoReflect()
+	fd := m.WhichOneof(m.Descriptor().Oneofs().ByName("update"))
+	if fd == nil {
+		return ""
+	}
+	return string(fd.Name())
+}
+
+func encode(update *apipb.SubscribeInvocationResponse) (string, error) {
+	b, err := proto.Marshal(update)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func decode(message string) (*apipb.SubscribeInvocationResponse, error) {
+	b, err := base64.StdEncoding.DecodeString(message)
+	if err != nil {
+		return nil, err
+	}
+	update := &apipb.SubscribeInvocationResponse{}
+	if err := proto.Unmarshal(b, update); err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+// Publisher publishes the updates of a single invocation. Updates are
+// published asynchronously, in order, so that publishing does not slow down
+// the handling of the build event stream.
+type Publisher struct {
+	iid            string
+	pubsub         interfaces.PubSub
+	targetStatuses map[string]cmnpb.Status
+
+	updates       chan string
+	loggedDropped bool
+}
+
+// NewPublisher returns a publisher for the given invocation, or nil if
+// invocation subscriptions are disabled.
+func NewPublisher(env environment.Env, iid string) *Publisher {
+	if !*enabled || env.GetPubSub() == nil {
+		return nil
+	}
+	p := &Publisher{
+		iid:            iid,
+		pubsub:         env.GetPubSub(),
+		targetStatuses: make(map[string]cmnpb.Status),
+		updates:        make(chan string, *maxPendingUpdates),
+	}
+	// Publish using the server context, so that the final updates are still
+	// published after the build event stream has been closed.
+	go p.run(env.GetServerContext())
+	return p
+}
+
+func (p *Publisher) run(ctx context.Context) {
+	channel := Channel(p.iid)
+	for message := range p.updates {
+		if err := p.pubsub.Publish(ctx, channel, message); err != nil {
+			log.CtxWarningf(ctx, "Failed to publish update for invocation %s: %s", p.iid, err)
+		}
+	}
+}
+
+func (p *Publisher) enqueue(update *apipb.SubscribeInvocationResponse) {
+	message, err := encode(update)
+	if err != nil {
+		log.Warningf("Failed to encode update for invocation %s: %s", p.iid, err)
+		return
+	}
+	select {
+	case p.updates <- message:
+	default:
+		if !p.loggedDropped {
+			log.Warningf("Dropping updates for invocation %s: too many pending updates", p.iid)
+			p.loggedDropped = true
+		}
+	}
+}
+
+// Publish publishes the updates for a build event. It must be called before
+// the stdout and stderr of progress events are cleared.
+func (p *Publisher) Publish(event *build_event_stream.BuildEvent) {
+	if p == nil {
+		return
+	}
+	if progress := event.GetProgress(); progress != nil {
+		if output := progress.GetStderr() + progress.GetStdout(); output != "" {
+			p.enqueue(&apipb.SubscribeInvocationResponse{
+				Update: &apipb.SubscribeInvocationResponse_ProgressOutput{ProgressOutput: output},
+			})
+		}
+		return
+	}
+	p.enqueue(&apipb.SubscribeInvocationResponse{
+		Update: &apipb.SubscribeInvocationResponse_BuildEvent{BuildEvent: event},
+	})
+	if label, status, changed := common.UpdateTargetStatus(p.targetStatuses, event); changed {
+		p.enqueue(&apipb.SubscribeInvocationResponse{
+			Update: &apipb.SubscribeInvocationResponse_TargetStatus{TargetStatus: &apipb.TargetStatusUpdate{
+				Label:  label,
+				Status: status,
+			}},
+		})
+	}
+}
+
+// Complete publishes the final update of the invocation, after which
+// subscribers are disconnected.
+func (p *Publisher) Complete(success bool, invocationStatus inspb.InvocationStatus) {
+	if p == nil {
+		return
+	}
+	p.enqueue(completedUpdate(success, invocationStatus))
+}
+
+// Close stops the publisher once all pending updates have been published. No
+// updates may be published after calling Close.
+func (p *Publisher) Close() {
+	if p == nil {
+		return
+	}
+	close(p.updates)
+}
+
+func completedUpdate(success bool, invocationStatus inspb.InvocationStatus) *apipb.SubscribeInvocationResponse {
+	return &apipb.SubscribeInvocationResponse{
+		Update: &apipb.SubscribeInvocationResponse_InvocationCompleted{InvocationCompleted: &apipb.InvocationCompleted{
+			Success:          success,
+			InvocationStatus: apipb.InvocationStatus(invocationStatus),
+		}},
+	}
+}
+
+// lookupCompletion returns the final update of the invocation if it is no
+// longer in progress, or nil if it is still in progress.
+func lookupCompletion(ctx context.Context, env environment.Env, iid string) (*apipb.SubscribeInvocationResponse, error) {
+	ti, err := env.GetInvocationDB().LookupInvocation(ctx, iid)
+	if err != nil {
+		if db.IsRecordNotFound(err) {
+			return nil, status.NotFoundError("invocation not found")
+		}
+		return nil, err
+	}
+	if ti.InvocationStatus == int64(inspb.InvocationStatus_PARTIAL_INVOCATION_STATUS) {
+		return nil, nil
+	}
+	return completedUpdate(ti.Success, inspb.InvocationStatus(ti.InvocationStatus)), nil
+}
+
+// Subscription receives the updates of a single invocation.
+type Subscription struct {
+	ctx        context.Context
+	env        environment.Env
+	iid        string
+	subscriber interfaces.Subscriber
+	ticker     *time.Ticker
+
+	// The final update, if it was found before being published.
+	completed *apipb.SubscribeInvocationResponse
+	done      bool
+}
+
+// Subscribe subscribes to the updates of the given invocation. It returns an
+// error if the invocation does not exist or the authenticated user is not
+// allowed to view it. The caller must close the returned subscription.
+func Subscribe(ctx context.Context, env environment.Env, iid string) (*Subscription, error) {
+	if !*enabled || env.GetPubSub() == nil {
+		return nil, status.UnimplementedError("Invocation subscriptions are not enabled")
+	}
+	// Subscribe before checking whether the invocation is in progress, so
+	// that no updates are missed if the invocation completes in between.
+	subscriber := env.GetPubSub().Subscribe(ctx, Channel(iid))
+	completed, err := lookupCompletion(ctx, env, iid)
+	if err != nil {
+		subscriber.Close()
+		return nil, err
+	}
+	return &Subscription{
+		ctx:        ctx,
+		env:        env,
+		iid:        iid,
+		subscriber: subscriber,
+		ticker:     time.NewTicker(statusPollInterval),
+		completed:  completed,
+	}, nil
+}
+
+// Recv blocks until the next update is available and returns it. The last
+// update is always an InvocationCompleted update, after which Recv returns
+// io.EOF. If the invocation had already completed when subscribing, only the
+// final update is returned.
+func (s *Subscription) Recv() (*apipb.SubscribeInvocationResponse, error) {
+	if s.done {
+		return nil, io.EOF
+	}
+	for s.completed == nil {
+		select {
+		case <-s.ctx.Done():
+			return nil, s.ctx.Err()
+		case <-s.ticker.C:
+			completed, err := lookupCompletion(s.ctx, s.env, s.iid)
+			if err != nil {
+				return nil, err
+			}
+			s.completed = completed
+		case message, ok := <-s.subscriber.Chan():
+			if !ok {
+				return nil, status.UnavailableError("invocation subscription closed")
+			}
+			update, err := decode(message)
+			if err != nil {
+				log.CtxWarningf(s.ctx, "Failed to decode update for invocation %s: %s", s.iid, err)
+				continue
+			}
+			if update.GetInvocationCompleted() != nil {
+				s.done = true
+			}
+			return update, nil
+		}
+	}
+	s.done = true
+	return s.completed, nil
+}
+
+func (s *Subscription) Close() {
+	s.ticker.Stop()
+	s.subscriber.Close()
+}
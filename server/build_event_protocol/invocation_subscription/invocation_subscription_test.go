@@ -0,0 +1,194 @@
+package invocation_subscription_test
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_subscription"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	cmnpb "github.com/buildbuddy-io/buildbuddy/proto/api/v1/common"
+	inspb "github.com/buildbuddy-io/buildbuddy/proto/invocation_status"
+)
+
+// fakePubSub delivers every published message to the subscribers of the
+// channel, without dropping messages.
+type fakePubSub struct {
+	mu   sync.Mutex
+	subs map[string][]chan string
+}
+
+func (p *fakePubSub) Publish(ctx context.Context, channelName string, message string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, ch := range p.subs[channelName] {
+		ch <- message
+	}
+	return nil
+}
+
+func (p *fakePubSub) Subscribe(ctx context.Context, channelName string) interfaces.Subscriber {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch := make(chan string, 100)
+	p.subs[channelName] = append(p.subs[channelName], ch)
+	return &fakeSubscriber{ch: ch}
+}
+
+type fakeSubscriber struct {
+	ch chan string
+}
+
+func (s *fakeSubscriber) Close() error {
+	return nil
+}
+
+func (s *fakeSubscriber) Chan() <-chan string {
+	return s.ch
+}
+
+func setup(t *testing.T, invocationStatus inspb.InvocationStatus) (*testenv.TestEnv, string) {
+	flags.Set(t, "app.invocation_subscriptions.enabled", true)
+	te := testenv.GetTestEnv(t)
+	te.SetPubSub(&fakePubSub{subs: make(map[string][]chan string)})
+	iid := uuid.New().String()
+	_, err := te.GetInvocationDB().CreateInvocation(context.Background(), &tables.Invocation{
+		InvocationID:     iid,
+		Perms:            perms.OTHERS_READ,
+		Success:          true,
+		InvocationStatus: int64(invocationStatus),
+	})
+	require.NoError(t, err)
+	return te, iid
+}
+
+func recvAll(t *testing.T, s *invocation_subscription.Subscription) []*apipb.SubscribeInvocationResponse {
+	var updates []*apipb.SubscribeInvocationResponse
+	for {
+		update, err := s.Recv()
+		if err == io.EOF {
+			return updates
+		}
+		require.NoError(t, err)
+		updates = append(updates, update)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	te, iid := setup(t, inspb.InvocationStatus_PARTIAL_INVOCATION_STATUS)
+	ctx := context.Background()
+
+	s, err := invocation_subscription.Subscribe(ctx, te, iid)
+	require.NoError(t, err)
+	defer s.Close()
+
+	label := "//foo:bar"
+	progress := &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_Progress{Progress: &build_event_stream.Progress{
+			Stderr: "Building...\n",
+		}},
+	}
+	configured := &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{Id: &build_event_stream.BuildEventId_TargetConfigured{
+			TargetConfigured: &build_event_stream.BuildEventId_TargetConfiguredId{Label: label},
+		}},
+		Payload: &build_event_stream.BuildEvent_Configured{Configured: &build_event_stream.TargetConfigured{}},
+	}
+	completed := &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{Id: &build_event_stream.BuildEventId_TargetCompleted{
+			TargetCompleted: &build_event_stream.BuildEventId_TargetCompletedId{Label: label},
+		}},
+		Payload: &build_event_stream.BuildEvent_Completed{Completed: &build_event_stream.TargetComplete{Success: true}},
+	}
+
+	p := invocation_subscription.NewPublisher(te, iid)
+	require.NotNil(t, p)
+	p.Publish(progress)
+	p.Publish(configured)
+	p.Publish(completed)
+	// Publishing the same status again should not produce another target
+	// status update.
+	p.Publish(completed)
+	p.Complete(true, inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS)
+	p.Close()
+
+	expected := []*apipb.SubscribeInvocationResponse{
+		{Update: &apipb.SubscribeInvocationResponse_ProgressOutput{ProgressOutput: "Building...\n"}},
+		{Update: &apipb.SubscribeInvocationResponse_BuildEvent{BuildEvent: configured}},
+		{Update: &apipb.SubscribeInvocationResponse_TargetStatus{TargetStatus: &apipb.TargetStatusUpdate{
+			Label:  label,
+			Status: cmnpb.Status_BUILDING,
+		}}},
+		{Update: &apipb.SubscribeInvocationResponse_BuildEvent{BuildEvent: completed}},
+		{Update: &apipb.SubscribeInvocationResponse_TargetStatus{TargetStatus: &apipb.TargetStatusUpdate{
+			Label:  label,
+			Status: cmnpb.Status_BUILT,
+		}}},
+		{Update: &apipb.SubscribeInvocationResponse_BuildEvent{BuildEvent: completed}},
+		{Update: &apipb.SubscribeInvocationResponse_InvocationCompleted{InvocationCompleted: &apipb.InvocationCompleted{
+			Success:          true,
+			InvocationStatus: apipb.InvocationStatus_COMPLETE_INVOCATION_STATUS,
+		}}},
+	}
+	updates := recvAll(t, s)
+	require.Empty(t, cmp.Diff(expected, updates, protocmp.Transform()))
+
+	var types []string
+	for _, update := range updates {
+		types = append(types, invocation_subscription.UpdateType(update))
+	}
+	require.Equal(t, []string{
+		"progress_output",
+		"build_event",
+		"target_status",
+		"build_event",
+		"target_status",
+		"build_event",
+		"invocation_completed",
+	}, types)
+}
+
+func TestSubscribe_CompletedInvocation(t *testing.T) {
+	te, iid := setup(t, inspb.InvocationStatus_COMPLETE_INVOCATION_STATUS)
+
+	s, err := invocation_subscription.Subscribe(context.Background(), te, iid)
+	require.NoError(t, err)
+	defer s.Close()
+
+	expected := []*apipb.SubscribeInvocationResponse{
+		{Update: &apipb.SubscribeInvocationResponse_InvocationCompleted{InvocationCompleted: &apipb.InvocationCompleted{
+			Success:          true,
+			InvocationStatus: apipb.InvocationStatus_COMPLETE_INVOCATION_STATUS,
+		}}},
+	}
+	require.Empty(t, cmp.Diff(expected, recvAll(t, s), protocmp.Transform()))
+}
+
+func TestSubscribe_NotFound(t *testing.T) {
+	te, _ := setup(t, inspb.InvocationStatus_PARTIAL_INVOCATION_STATUS)
+
+	_, err := invocation_subscription.Subscribe(context.Background(), te, uuid.New().String())
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+}
+
+func TestSubscribe_Disabled(t *testing.T) {
+	te, iid := setup(t, inspb.InvocationStatus_PARTIAL_INVOCATION_STATUS)
+	flags.Set(t, "app.invocation_subscriptions.enabled", false)
+
+	_, err := invocation_subscription.Subscribe(context.Background(), te, iid)
+	require.True(t, status.IsUnimplementedError(err), "expected Unimplemented, got %v", err)
+	require.Nil(t, invocation_subscription.NewPublisher(te, iid))
+}
@@ -0,0 +1,300 @@
+// Package spawn_records stores the spawns recorded in the compact execution
+// logs uploaded by invocations, so that they can be queried without fetching
+// and parsing the logs again, and explains cache misses by comparing a spawn
+// with the spawn that produced the same output in another invocation.
+package spawn_records
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_compare"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/paging"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	pgpb "github.com/buildbuddy-io/buildbuddy/proto/pagination"
+	sprpb "github.com/buildbuddy-io/buildbuddy/proto/spawn_record"
+)
+
+var (
+	enabled           = flag.Bool("app.spawn_records.enabled", false, "If true, the compact execution logs uploaded by invocations are parsed after the invocation completes, and the spawns they contain are stored so that they can be queried using the GetSpawns API.")
+	maxInputsPerSpawn = flag.Int("app.spawn_records.max_inputs_per_spawn", 10_000, "The maximum number of inputs stored per spawn. Only the first inputs (sorted by path) of spawns with more inputs are stored.")
+)
+
+const (
+	// Default page size when a page token is not included in the request.
+	defaultPageSize = 100
+)
+
+// Enabled returns whether spawn records are stored for invocations.
+func Enabled() bool {
+	return *enabled
+}
+
+func blobName(invocationID string, invocationAttempt uint64) string {
+	// WARNING: Things will break if this is changed, because we use this name
+	// to lookup data from historical invocations.
+	return filepath.Join(invocationID, fmt.Sprint(invocationAttempt), "spawns.pb")
+}
+
+// Ingest fetches and parses the compact execution log uploaded by an
+// invocation attempt and stores its spawns. It does nothing if spawn records
+// are disabled.
+func Ingest(ctx context.Context, env environment.Env, invocationID string, invocationAttempt uint64, executionLog *build_event_stream.File) error {
+	if !*enabled {
+		return nil
+	}
+	l, err := invocation_compare.FetchExecutionLog(ctx, env, executionLog)
+	if err != nil {
+		return status.WrapError(err, "read compact execution log")
+	}
+	return Write(ctx, env, invocationID, invocationAttempt, FromExecutionLog(l))
+}
+
+// FromExecutionLog returns a record for each spawn in the execution log that
+// has at least one output, sorted by primary output.
+func FromExecutionLog(l *invocation_compare.ExecutionLog) *sprpb.SpawnRecords {
+	records := &sprpb.SpawnRecords{}
+	for _, primaryOutput := range l.PrimaryOutputs() {
+		spawn := l.Spawn(primaryOutput)
+		inputs := l.Inputs(spawn)
+		r := &sprpb.SpawnRecord{
+			PrimaryOutput:   primaryOutput,
+			TargetLabel:     spawn.GetTargetLabel(),
+			Mnemonic:        spawn.GetMnemonic(),
+			Runner:          spawn.GetRunner(),
+			CacheHit:        spawn.GetCacheHit(),
+			Remote:          strings.HasPrefix(spawn.GetRunner(), "remote"),
+			Remotable:       spawn.GetRemotable(),
+			Cacheable:       spawn.GetCacheable(),
+			RemoteCacheable: spawn.GetRemoteCacheable(),
+			ExitCode:        spawn.GetExitCode(),
+			Duration:        spawn.GetMetrics().GetTotalTime(),
+			Args:            spawn.GetArgs(),
+			Inputs:          files(inputs, *maxInputsPerSpawn),
+			InputCount:      int64(len(inputs)),
+			Outputs:         files(l.Outputs(spawn), -1),
+		}
+		if spawn.GetDigest().GetHash() != "" {
+			r.Digest = invocation_compare.DigestString(spawn.GetDigest())
+		}
+		if len(spawn.GetEnvVars()) > 0 {
+			r.Env = make(map[string]string, len(spawn.GetEnvVars()))
+			for _, v := range spawn.GetEnvVars() {
+				r.Env[v.GetName()] = v.GetValue()
+			}
+		}
+		records.Spawns = append(records.Spawns, r)
+	}
+	return records
+}
+
+// files returns the given digests keyed by path as a list sorted by path,
+// truncated to the given limit unless it is negative.
+func files(digests map[string]string, limit int) []*sprpb.File {
+	paths := slices.Sorted(maps.Keys(digests))
+	if limit >= 0 && len(paths) > limit {
+		paths = paths[:limit]
+	}
+	files := make([]*sprpb.File, 0, len(paths))
+	for _, path := range paths {
+		files = append(files, &sprpb.File{Path: path, Digest: digests[path]})
+	}
+	return files
+}
+
+// Read reads the spawn records of an invocation attempt from the configured
+// blobstore.
+func Read(ctx context.Context, env environment.Env, invocationID string, invocationAttempt uint64) (*sprpb.SpawnRecords, error) {
+	buf, err := env.GetBlobstore().ReadBlob(ctx, blobName(invocationID, invocationAttempt))
+	if err != nil {
+		return nil, err
+	}
+	records := &sprpb.SpawnRecords{}
+	if err := proto.Unmarshal(buf, records); err != nil {
+		return nil, status.WrapError(err, "unmarshal spawn records")
+	}
+	return records, nil
+}
+
+// Write writes the spawn records of an invocation attempt to the configured
+// blobstore.
+func Write(ctx context.Context, env environment.Env, invocationID string, invocationAttempt uint64, records *sprpb.SpawnRecords) error {
+	buf, err := proto.Marshal(records)
+	if err != nil {
+		return err
+	}
+	_, err = env.GetBlobstore().WriteBlob(ctx, blobName(invocationID, invocationAttempt), buf)
+	return err
+}
+
+// readForInvocation reads the spawn records of the latest attempt of an
+// invocation, after checking that the authenticated user can view it.
+func readForInvocation(ctx context.Context, env environment.Env, invocationID string) (*sprpb.SpawnRecords, error) {
+	invocation, err := env.GetInvocationDB().LookupInvocation(ctx, invocationID)
+	if err != nil {
+		if db.IsRecordNotFound(err) {
+			return nil, status.NotFoundErrorf("invocation %q not found", invocationID)
+		}
+		return nil, err
+	}
+	records, err := Read(ctx, env, invocationID, invocation.Attempt)
+	if err != nil {
+		if status.IsNotFoundError(err) {
+			return nil, status.NotFoundErrorf("no spawns were recorded for invocation %q", invocationID)
+		}
+		return nil, status.WrapErrorf(err, "read spawn records for invocation %q", invocationID)
+	}
+	return records, nil
+}
+
+func matchesFilter(r *sprpb.SpawnRecord, filter *sprpb.GetSpawnsRequest_Filter) bool {
+	if filter.GetMnemonic() != "" && r.GetMnemonic() != filter.GetMnemonic() {
+		return false
+	}
+	if filter.GetTargetLabel() != "" && r.GetTargetLabel() != filter.GetTargetLabel() {
+		return false
+	}
+	if filter.GetPrimaryOutput() != "" && r.GetPrimaryOutput() != filter.GetPrimaryOutput() {
+		return false
+	}
+	if filter.GetCacheMissOnly() && r.GetCacheHit() {
+		return false
+	}
+	return true
+}
+
+// GetSpawns returns a page of the spawns recorded for an invocation.
+func GetSpawns(ctx context.Context, env environment.Env, req *sprpb.GetSpawnsRequest) (*sprpb.GetSpawnsResponse, error) {
+	if req.GetInvocationId() == "" {
+		return nil, status.InvalidArgumentError("invocation_id is required")
+	}
+	page := &pgpb.OffsetLimit{Offset: 0, Limit: defaultPageSize}
+	if req.GetPageToken() != "" {
+		reqPage, err := paging.DecodeOffsetLimit(req.GetPageToken())
+		if err != nil {
+			return nil, err
+		}
+		page = reqPage
+	}
+	if page.Offset < 0 || page.Limit <= 0 {
+		return nil, status.InvalidArgumentError("invalid page token")
+	}
+
+	records, err := readForInvocation(ctx, env, req.GetInvocationId())
+	if err != nil {
+		return nil, err
+	}
+	var baseline map[string]*sprpb.SpawnRecord
+	if req.GetBaselineInvocationId() != "" {
+		baselineRecords, err := readForInvocation(ctx, env, req.GetBaselineInvocationId())
+		if err != nil {
+			return nil, err
+		}
+		baseline = make(map[string]*sprpb.SpawnRecord, len(baselineRecords.GetSpawns()))
+		for _, r := range baselineRecords.GetSpawns() {
+			baseline[r.GetPrimaryOutput()] = r
+		}
+	}
+
+	var matches []*sprpb.SpawnRecord
+	for _, r := range records.GetSpawns() {
+		if matchesFilter(r, req.GetFilter()) {
+			matches = append(matches, r)
+		}
+	}
+	start := min(page.Offset, int64(len(matches)))
+	end := min(start+page.Limit, int64(len(matches)))
+
+	rsp := &sprpb.GetSpawnsResponse{}
+	for _, r := range matches[start:end] {
+		spawn := &sprpb.GetSpawnsResponse_Spawn{Record: r}
+		if baseline != nil && !r.GetCacheHit() {
+			spawn.CacheMissExplanation = ExplainCacheMiss(r, baseline[r.GetPrimaryOutput()])
+		}
+		if !req.GetIncludeInputs() {
+			r.Inputs = nil
+		}
+		rsp.Spawns = append(rsp.Spawns, spawn)
+	}
+	if end < int64(len(matches)) {
+		next, err := paging.EncodeOffsetLimit(&pgpb.OffsetLimit{
+			Offset: end,
+			Limit:  page.Limit,
+		})
+		if err != nil {
+			return nil, err
+		}
+		rsp.NextPageToken = next
+	}
+	return rsp, nil
+}
+
+// ExplainCacheMiss compares a spawn with the spawn that produced the same
+// primary output in a baseline invocation, which may be nil if there was no
+// such spawn.
+func ExplainCacheMiss(spawn, baseline *sprpb.SpawnRecord) *sprpb.CacheMissExplanation {
+	if baseline == nil {
+		return &sprpb.CacheMissExplanation{}
+	}
+	e := &sprpb.CacheMissExplanation{
+		BaselineFound:   true,
+		SameDigest:      spawn.GetDigest() != "" && spawn.GetDigest() == baseline.GetDigest(),
+		InputsTruncated: isTruncated(spawn) || isTruncated(baseline),
+	}
+
+	oldInputs := digestsByPath(baseline.GetInputs())
+	newInputs := digestsByPath(spawn.GetInputs())
+	for _, path := range invocation_compare.UnionKeys(oldInputs, newInputs, strings.Compare) {
+		oldDigest, oldOK := oldInputs[path]
+		newDigest, newOK := newInputs[path]
+		if oldOK == newOK && oldDigest == newDigest {
+			continue
+		}
+		e.InputDiffs = append(e.InputDiffs, &sprpb.InputDiff{
+			Path:      path,
+			OldDigest: oldDigest,
+			NewDigest: newDigest,
+		})
+	}
+
+	if !slices.Equal(baseline.GetArgs(), spawn.GetArgs()) {
+		e.OldArgs = baseline.GetArgs()
+		e.NewArgs = spawn.GetArgs()
+	}
+
+	for _, name := range invocation_compare.UnionKeys(baseline.GetEnv(), spawn.GetEnv(), strings.Compare) {
+		oldValue, oldOK := baseline.GetEnv()[name]
+		newValue, newOK := spawn.GetEnv()[name]
+		if oldOK == newOK && oldValue == newValue {
+			continue
+		}
+		e.EnvDiffs = append(e.EnvDiffs, &sprpb.EnvVarDiff{
+			Name:     name,
+			OldValue: oldValue,
+			NewValue: newValue,
+		})
+	}
+	return e
+}
+
+func isTruncated(r *sprpb.SpawnRecord) bool {
+	return int64(len(r.GetInputs())) < r.GetInputCount()
+}
+
+func digestsByPath(files []*sprpb.File) map[string]string {
+	digests := make(map[string]string, len(files))
+	for _, f := range files {
+		digests[f.GetPath()] = f.GetDigest()
+	}
+	return digests
+}
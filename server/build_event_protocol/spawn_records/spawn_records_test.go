@@ -0,0 +1,250 @@
+package spawn_records_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_compare"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/spawn_records"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/paging"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pgpb "github.com/buildbuddy-io/buildbuddy/proto/pagination"
+	spawnpb "github.com/buildbuddy-io/buildbuddy/proto/spawn"
+	sprpb "github.com/buildbuddy-io/buildbuddy/proto/spawn_record"
+)
+
+func readExecutionLog(t *testing.T, entries ...*spawnpb.ExecLogEntry) *invocation_compare.ExecutionLog {
+	buf := &bytes.Buffer{}
+	w, err := zstd.NewWriter(buf)
+	require.NoError(t, err)
+	for _, e := range entries {
+		_, err := protodelim.MarshalTo(w, e)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	l, err := invocation_compare.ReadExecutionLog(buf)
+	require.NoError(t, err)
+	return l
+}
+
+func fileEntry(id uint32, path, hash string) *spawnpb.ExecLogEntry {
+	return &spawnpb.ExecLogEntry{
+		Id: id,
+		Type: &spawnpb.ExecLogEntry_File_{File: &spawnpb.ExecLogEntry_File{
+			Path:   path,
+			Digest: &spawnpb.Digest{Hash: hash, SizeBytes: int64(len(hash))},
+		}},
+	}
+}
+
+func TestFromExecutionLog(t *testing.T) {
+	flags.Set(t, "app.spawn_records.max_inputs_per_spawn", 1)
+	l := readExecutionLog(t,
+		fileEntry(1, "lib.cc", "cc"),
+		fileEntry(2, "lib.h", "h"),
+		&spawnpb.ExecLogEntry{
+			Id: 3,
+			Type: &spawnpb.ExecLogEntry_InputSet_{InputSet: &spawnpb.ExecLogEntry_InputSet{
+				InputIds: []uint32{1, 2},
+			}},
+		},
+		fileEntry(4, "bazel-out/k8-fastbuild/bin/_objs/lib/lib.o", "o"),
+		&spawnpb.ExecLogEntry{Type: &spawnpb.ExecLogEntry_Spawn_{Spawn: &spawnpb.ExecLogEntry_Spawn{
+			Args:        []string{"gcc", "-c", "lib.cc"},
+			EnvVars:     []*spawnpb.EnvironmentVariable{{Name: "PATH", Value: "/bin"}},
+			InputSetId:  3,
+			Outputs:     []*spawnpb.ExecLogEntry_Output{{Type: &spawnpb.ExecLogEntry_Output_OutputId{OutputId: 4}}},
+			TargetLabel: "//:lib",
+			Mnemonic:    "CppCompile",
+			Runner:      "remote cache hit",
+			CacheHit:    true,
+			Remotable:   true,
+			Cacheable:   true,
+			Digest:      &spawnpb.Digest{Hash: "abc", SizeBytes: 100},
+			Metrics:     &spawnpb.SpawnMetrics{TotalTime: durationpb.New(1500_000_000)},
+		}}},
+		// Spawns without outputs are not recorded.
+		&spawnpb.ExecLogEntry{Type: &spawnpb.ExecLogEntry_Spawn_{Spawn: &spawnpb.ExecLogEntry_Spawn{
+			Mnemonic: "TestRunner",
+		}}},
+	)
+
+	expected := &sprpb.SpawnRecords{Spawns: []*sprpb.SpawnRecord{{
+		PrimaryOutput: "bazel-out/k8-fastbuild/bin/_objs/lib/lib.o",
+		TargetLabel:   "//:lib",
+		Mnemonic:      "CppCompile",
+		Runner:        "remote cache hit",
+		CacheHit:      true,
+		Remote:        true,
+		Remotable:     true,
+		Cacheable:     true,
+		Digest:        "abc/100",
+		Duration:      durationpb.New(1500_000_000),
+		Args:          []string{"gcc", "-c", "lib.cc"},
+		Env:           map[string]string{"PATH": "/bin"},
+		Inputs:        []*sprpb.File{{Path: "lib.cc", Digest: "cc/2"}},
+		InputCount:    2,
+		Outputs:       []*sprpb.File{{Path: "bazel-out/k8-fastbuild/bin/_objs/lib/lib.o", Digest: "o/1"}},
+	}}}
+	require.Empty(t, cmp.Diff(expected, spawn_records.FromExecutionLog(l), protocmp.Transform()))
+}
+
+func TestExplainCacheMiss(t *testing.T) {
+	baseline := &sprpb.SpawnRecord{
+		Digest:     "abc/100",
+		Args:       []string{"gcc", "-c", "lib.cc"},
+		Env:        map[string]string{"PATH": "/bin", "TMPDIR": "/tmp"},
+		Inputs:     []*sprpb.File{{Path: "lib.cc", Digest: "cc/2"}, {Path: "lib.h", Digest: "h1/2"}},
+		InputCount: 2,
+	}
+	spawn := &sprpb.SpawnRecord{
+		Digest:     "def/100",
+		Args:       []string{"gcc", "-O2", "-c", "lib.cc"},
+		Env:        map[string]string{"PATH": "/usr/bin", "TMPDIR": "/tmp"},
+		Inputs:     []*sprpb.File{{Path: "extra.h", Digest: "e/1"}, {Path: "lib.cc", Digest: "cc/2"}, {Path: "lib.h", Digest: "h2/2"}},
+		InputCount: 4,
+	}
+
+	expected := &sprpb.CacheMissExplanation{
+		BaselineFound: true,
+		InputDiffs: []*sprpb.InputDiff{
+			{Path: "extra.h", NewDigest: "e/1"},
+			{Path: "lib.h", OldDigest: "h1/2", NewDigest: "h2/2"},
+		},
+		InputsTruncated: true,
+		OldArgs:         []string{"gcc", "-c", "lib.cc"},
+		NewArgs:         []string{"gcc", "-O2", "-c", "lib.cc"},
+		EnvDiffs:        []*sprpb.EnvVarDiff{{Name: "PATH", OldValue: "/bin", NewValue: "/usr/bin"}},
+	}
+	require.Empty(t, cmp.Diff(expected, spawn_records.ExplainCacheMiss(spawn, baseline), protocmp.Transform()))
+
+	expected = &sprpb.CacheMissExplanation{BaselineFound: true, SameDigest: true}
+	require.Empty(t, cmp.Diff(expected, spawn_records.ExplainCacheMiss(baseline, baseline), protocmp.Transform()))
+
+	require.False(t, spawn_records.ExplainCacheMiss(spawn, nil).GetBaselineFound())
+}
+
+func createInvocation(t *testing.T, te *testenv.TestEnv, records *sprpb.SpawnRecords) string {
+	ctx := context.Background()
+	iid := uuid.New().String()
+	ti := &tables.Invocation{
+		InvocationID: iid,
+		Perms:        perms.OTHERS_READ,
+	}
+	_, err := te.GetInvocationDB().CreateInvocation(ctx, ti)
+	require.NoError(t, err)
+	if records != nil {
+		require.NoError(t, spawn_records.Write(ctx, te, iid, ti.Attempt, records))
+	}
+	return iid
+}
+
+func TestGetSpawns(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ctx := context.Background()
+	compile := &sprpb.SpawnRecord{
+		PrimaryOutput: "bazel-out/bin/lib.o",
+		TargetLabel:   "//:lib",
+		Mnemonic:      "CppCompile",
+		Digest:        "new/1",
+		Inputs:        []*sprpb.File{{Path: "lib.cc", Digest: "cc2/3"}},
+		InputCount:    1,
+	}
+	link := &sprpb.SpawnRecord{
+		PrimaryOutput: "bazel-out/bin/lib.so",
+		TargetLabel:   "//:lib",
+		Mnemonic:      "CppLink",
+		CacheHit:      true,
+	}
+	genrule := &sprpb.SpawnRecord{
+		PrimaryOutput: "bazel-out/bin/out.txt",
+		TargetLabel:   "//:gen",
+		Mnemonic:      "Genrule",
+	}
+	iid := createInvocation(t, te, &sprpb.SpawnRecords{Spawns: []*sprpb.SpawnRecord{compile, link, genrule}})
+	baselineIID := createInvocation(t, te, &sprpb.SpawnRecords{Spawns: []*sprpb.SpawnRecord{{
+		PrimaryOutput: "bazel-out/bin/lib.o",
+		Digest:        "old/1",
+		Inputs:        []*sprpb.File{{Path: "lib.cc", Digest: "cc1/3"}},
+		InputCount:    1,
+	}}})
+
+	rsp, err := spawn_records.GetSpawns(ctx, te, &sprpb.GetSpawnsRequest{
+		InvocationId:         iid,
+		Filter:               &sprpb.GetSpawnsRequest_Filter{TargetLabel: "//:lib"},
+		BaselineInvocationId: baselineIID,
+	})
+	require.NoError(t, err)
+	expected := &sprpb.GetSpawnsResponse{Spawns: []*sprpb.GetSpawnsResponse_Spawn{
+		{
+			Record: &sprpb.SpawnRecord{
+				PrimaryOutput: "bazel-out/bin/lib.o",
+				TargetLabel:   "//:lib",
+				Mnemonic:      "CppCompile",
+				Digest:        "new/1",
+				InputCount:    1,
+			},
+			CacheMissExplanation: &sprpb.CacheMissExplanation{
+				BaselineFound: true,
+				InputDiffs:    []*sprpb.InputDiff{{Path: "lib.cc", OldDigest: "cc1/3", NewDigest: "cc2/3"}},
+			},
+		},
+		{Record: link},
+	}}
+	require.Empty(t, cmp.Diff(expected, rsp, protocmp.Transform()))
+
+	// Page through the cache misses one at a time, including inputs.
+	pageToken, err := paging.EncodeOffsetLimit(&pgpb.OffsetLimit{Offset: 0, Limit: 1})
+	require.NoError(t, err)
+	var primaryOutputs []string
+	req := &sprpb.GetSpawnsRequest{
+		InvocationId:  iid,
+		PageToken:     pageToken,
+		Filter:        &sprpb.GetSpawnsRequest_Filter{CacheMissOnly: true},
+		IncludeInputs: true,
+	}
+	for {
+		rsp, err := spawn_records.GetSpawns(ctx, te, req)
+		require.NoError(t, err)
+		require.Len(t, rsp.GetSpawns(), 1)
+		for _, spawn := range rsp.GetSpawns() {
+			primaryOutputs = append(primaryOutputs, spawn.GetRecord().GetPrimaryOutput())
+			require.Nil(t, spawn.GetCacheMissExplanation())
+			require.Len(t, spawn.GetRecord().GetInputs(), int(spawn.GetRecord().GetInputCount()))
+		}
+		if rsp.GetNextPageToken() == "" {
+			break
+		}
+		req.PageToken = rsp.GetNextPageToken()
+	}
+	require.Equal(t, []string{"bazel-out/bin/lib.o", "bazel-out/bin/out.txt"}, primaryOutputs)
+}
+
+func TestGetSpawns_NotFound(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ctx := context.Background()
+
+	_, err := spawn_records.GetSpawns(ctx, te, &sprpb.GetSpawnsRequest{InvocationId: uuid.New().String()})
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	iid := createInvocation(t, te, nil)
+	_, err = spawn_records.GetSpawns(ctx, te, &sprpb.GetSpawnsRequest{InvocationId: iid})
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	_, err = spawn_records.GetSpawns(ctx, te, &sprpb.GetSpawnsRequest{})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
@@ -19,6 +19,8 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/backends/chunkstore"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_index"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_sink"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/spawn_records"
 	"github.com/buildbuddy-io/buildbuddy/server/capabilities_filter"
 	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/build_buddy_url"
 	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/cache_api_url"
@@ -56,6 +58,7 @@ import (
 	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
 	cappb "github.com/buildbuddy-io/buildbuddy/proto/capability"
 	enpb "github.com/buildbuddy-io/buildbuddy/proto/encryption"
+	esinkpb "github.com/buildbuddy-io/buildbuddy/proto/event_sink"
 	elpb "github.com/buildbuddy-io/buildbuddy/proto/eventlog"
 	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	gcpb "github.com/buildbuddy-io/buildbuddy/proto/gcp"
@@ -70,6 +73,7 @@ import (
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 	srpb "github.com/buildbuddy-io/buildbuddy/proto/search"
 	skpb "github.com/buildbuddy-io/buildbuddy/proto/secrets"
+	sprpb "github.com/buildbuddy-io/buildbuddy/proto/spawn_record"
 	stpb "github.com/buildbuddy-io/buildbuddy/proto/stats"
 	supb "github.com/buildbuddy-io/buildbuddy/proto/suggestion"
 	trpb "github.com/buildbuddy-io/buildbuddy/proto/target"
@@ -1275,6 +1279,13 @@ func (s *BuildBuddyServer) WaitExecution(req *espb.WaitExecutionRequest, stream
 	return status.UnimplementedError("Not implemented")
 }
 
+func (s *BuildBuddyServer) ReadExecutionOutput(req *espb.ReadExecutionOutputRequest, stream bbspb.BuildBuddyService_ReadExecutionOutputServer) error {
+	if es := s.env.GetExecutionService(); es != nil {
+		return es.ReadExecutionOutput(req, stream)
+	}
+	return status.UnimplementedError("Not implemented")
+}
+
 func (s *BuildBuddyServer) GetTreeDirectorySizes(ctx context.Context, req *capb.GetTreeDirectorySizesRequest) (*capb.GetTreeDirectorySizesResponse, error) {
 	return directory_size.GetTreeDirectorySizes(ctx, s.env, req)
 }
@@ -1287,6 +1298,13 @@ func (s *BuildBuddyServer) GetExecutionNodes(ctx context.Context, req *scpb.GetE
 	return nil, status.UnimplementedError("Not implemented")
 }
 
+func (s *BuildBuddyServer) DrainExecutors(ctx context.Context, req *scpb.DrainExecutorsRequest) (*scpb.DrainExecutorsResponse, error) {
+	if ss := s.env.GetSchedulerService(); ss != nil {
+		return ss.DrainExecutors(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
 func (s *BuildBuddyServer) SearchExecution(ctx context.Context, req *espb.SearchExecutionRequest) (*espb.SearchExecutionResponse, error) {
 	if req == nil {
 		return nil, status.InvalidArgumentErrorf("SearchExecutionRequest cannot be empty")
@@ -1785,6 +1803,10 @@ func (s *BuildBuddyServer) GetCacheScoreCard(ctx context.Context, req *capb.GetC
 	return scorecard.GetCacheScoreCard(ctx, s.env, req)
 }
 
+func (s *BuildBuddyServer) GetSpawns(ctx context.Context, req *sprpb.GetSpawnsRequest) (*sprpb.GetSpawnsResponse, error) {
+	return spawn_records.GetSpawns(ctx, s.env, req)
+}
+
 func (s *BuildBuddyServer) GetNamespace(ctx context.Context, req *qpb.GetNamespaceRequest) (*qpb.GetNamespaceResponse, error) {
 	if qm := s.env.GetQuotaManager(); qm != nil {
 		return qm.GetNamespace(ctx, req)
@@ -1850,6 +1872,18 @@ func (s *BuildBuddyServer) DeleteSecret(ctx context.Context, req *skpb.DeleteSec
 	return nil, status.UnimplementedError("Not implemented")
 }
 
+func (s *BuildBuddyServer) CreateEventSink(ctx context.Context, req *esinkpb.CreateEventSinkRequest) (*esinkpb.CreateEventSinkResponse, error) {
+	return event_sink.CreateEventSink(ctx, s.env, req)
+}
+
+func (s *BuildBuddyServer) GetEventSinks(ctx context.Context, req *esinkpb.GetEventSinksRequest) (*esinkpb.GetEventSinksResponse, error) {
+	return event_sink.GetEventSinks(ctx, s.env, req)
+}
+
+func (s *BuildBuddyServer) DeleteEventSink(ctx context.Context, req *esinkpb.DeleteEventSinkRequest) (*esinkpb.DeleteEventSinkResponse, error) {
+	return event_sink.DeleteEventSink(ctx, s.env, req)
+}
+
 type bsLookup struct {
 	URL      *url.URL
 	Filename string
@@ -179,6 +179,14 @@ func (p *CacheProxy) FindMissingBlobs(ctx context.Context, req *repb.FindMissing
 	return p.casClient.FindMissingBlobs(ctx, req)
 }
 
+func (p *CacheProxy) SplitBlob(ctx context.Context, req *repb.SplitBlobRequest) (*repb.SplitBlobResponse, error) {
+	return p.casClient.SplitBlob(ctx, req)
+}
+
+func (p *CacheProxy) SpliceBlob(ctx context.Context, req *repb.SpliceBlobRequest) (*repb.SpliceBlobResponse, error) {
+	return p.casClient.SpliceBlob(ctx, req)
+}
+
 func (p *CacheProxy) hasBlobLocally(ctx context.Context, instanceName string, d *repb.Digest) bool {
 	rsp, err := p.localCAS.FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{
 		InstanceName: instanceName,
@@ -37,6 +37,7 @@ var (
 		"GetTargetHistory",
 		"GetExecution",
 		"WaitExecution",
+		"ReadExecutionOutput",
 		"GetZipManifest",
 		// Users do not need any particular role within their current group to be
 		// able to create another group or request to join an existing group.
@@ -48,6 +49,10 @@ var (
 		// TODO(bduffany): prefix all of these with the service name,
 		// since API methods and BuildBuddyService methods may be the same.
 		"GetInvocation",
+		"GetInvocationReport",
+		"CompareInvocations",
+		"SubscribeInvocation",
+		"GetSpawns",
 		"GetLog",
 		"DeleteFile",
 		"GetTarget",
@@ -171,6 +176,7 @@ var (
 		"InvalidateAllSnapshotsForRepo",
 		// RBE deployment view
 		"GetExecutionNodes",
+		"DrainExecutors",
 		// BuildBuddy usage data
 		"GetUsage",
 		// Encryption.
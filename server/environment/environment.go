@@ -10,6 +10,7 @@ import (
 	"github.com/jonboulle/clockwork"
 	"google.golang.org/grpc"
 
+	cspb "github.com/buildbuddy-io/buildbuddy/proto/cache_snapshot"
 	hitpb "github.com/buildbuddy-io/buildbuddy/proto/hit_tracker"
 	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
 	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
@@ -138,5 +139,6 @@ type Env interface {
 	GetCPULeaser() interfaces.CPULeaser
 	GetHitTrackerFactory() interfaces.HitTrackerFactory
 	GetHitTrackerServiceServer() hitpb.HitTrackerServiceServer
+	GetCacheSnapshotServiceServer() cspb.CacheSnapshotServiceServer
 	GetExperimentFlagProvider() interfaces.ExperimentFlagProvider
 }
@@ -258,6 +258,23 @@ type Blobstore interface {
 	Writer(ctx context.Context, blobName string) (CommittedWriteCloser, error)
 }
 
+// BlobReader is implemented by Blobstores that can stream a blob's contents
+// instead of reading the whole blob into memory.
+type BlobReader interface {
+	// Reader returns a reader of the (decompressed) contents of the blob.
+	// Returns a NotFound error if the blob does not exist.
+	Reader(ctx context.Context, blobName string) (io.ReadCloser, error)
+}
+
+// BlobLister is implemented by Blobstores that can enumerate the blobs they
+// store.
+type BlobLister interface {
+	// ListBlobs calls fn with the name and last modification time of each
+	// blob whose name starts with prefix. Iteration stops at the first error
+	// returned by fn.
+	ListBlobs(ctx context.Context, prefix string, fn func(blobName string, lastModified time.Time) error) error
+}
+
 type CacheMetadata struct {
 	// Size of the cached data. If the data was compressed, this is the compressed size
 	StoredSizeBytes    int64
@@ -295,6 +312,29 @@ type StoppableCache interface {
 	Stop() error
 }
 
+// CacheEntryInfo describes an entry enumerated by a CacheLister.
+type CacheEntryInfo struct {
+	// Resource identifies the entry. Its compressor is the compressor that
+	// the entry is stored with.
+	Resource *rspb.ResourceName
+
+	// GroupID is the group that owns the entry, or AuthAnonymousUser for
+	// entries written anonymously.
+	GroupID string
+
+	PartitionID        string
+	LastAccessTimeUsec int64
+}
+
+// CacheLister is implemented by Caches that can enumerate the entries they
+// store.
+type CacheLister interface {
+	// ListEntries calls fn with each AC and CAS entry stored in the given
+	// partitions, or in all partitions if none are given. Iteration stops at
+	// the first error returned by fn.
+	ListEntries(ctx context.Context, partitionIDs []string, fn func(info *CacheEntryInfo) error) error
+}
+
 type PooledByteStreamClient interface {
 	StreamBytestreamFile(ctx context.Context, url *url.URL, writer io.Writer) error
 	FetchBytestreamZipManifest(ctx context.Context, url *url.URL) (*zipb.Manifest, error)
@@ -601,6 +641,8 @@ type UsageTracker interface {
 type ApiService interface {
 	apipb.ApiServiceServer
 	GetFileHandler() http.Handler
+	GetInvocationReportHandler() http.Handler
+	SubscribeInvocationHandler() http.Handler
 	GetMetricsHandler() http.Handler
 	CacheEnabled() bool
 }
@@ -848,6 +890,9 @@ type RemoteExecutionService interface {
 	Execute(req *repb.ExecuteRequest, stream repb.Execution_ExecuteServer) error
 	WaitExecution(req *repb.WaitExecutionRequest, stream repb.Execution_WaitExecutionServer) error
 	PublishOperation(stream repb.Execution_PublishOperationServer) error
+	// ReadOutputStream serves ByteStream reads of the output streams of
+	// running executions. See rexec.OutputStreamNames.
+	ReadOutputStream(req *bspb.ReadRequest, stream bspb.ByteStream_ReadServer) error
 	MarkExecutionFailed(ctx context.Context, taskID string, reason error) error
 	Cancel(ctx context.Context, invocationID string) error
 	RedisAvailabilityMonitoringEnabled() bool
@@ -896,6 +941,7 @@ type SchedulerService interface {
 	ReEnqueueTask(ctx context.Context, req *scpb.ReEnqueueTaskRequest) (*scpb.ReEnqueueTaskResponse, error)
 	TaskExists(ctx context.Context, req *scpb.TaskExistsRequest) (*scpb.TaskExistsResponse, error)
 	GetExecutionNodes(ctx context.Context, req *scpb.GetExecutionNodesRequest) (*scpb.GetExecutionNodesResponse, error)
+	DrainExecutors(ctx context.Context, req *scpb.DrainExecutorsRequest) (*scpb.DrainExecutorsResponse, error)
 	GetPoolInfo(ctx context.Context, os, requestedPool, workflowID string, poolType PoolType) (*PoolInfo, error)
 	GetSharedExecutorPoolGroupID() string
 }
@@ -919,6 +965,7 @@ type PoolInfo struct {
 type ExecutionService interface {
 	GetExecution(ctx context.Context, req *espb.GetExecutionRequest) (*espb.GetExecutionResponse, error)
 	WaitExecution(req *espb.WaitExecutionRequest, stream bbspb.BuildBuddyService_WaitExecutionServer) error
+	ReadExecutionOutput(req *espb.ReadExecutionOutputRequest, stream bbspb.BuildBuddyService_ReadExecutionOutputServer) error
 	WriteExecutionProfile(ctx context.Context, w io.Writer, executionID string) error
 }
 
@@ -948,6 +995,8 @@ type Publisher interface {
 	Send(op *longrunning.Operation) error
 	Ping() error
 	SetState(state repb.ExecutionProgress_ExecutionState) error
+	// PublishOutput publishes output written by the executing command.
+	PublishOutput(chunk *repb.ExecutionOutputChunk) error
 	CloseAndRecv() (*repb.PublishOperationResponse, error)
 }
 
@@ -1025,7 +1074,9 @@ type TaskLease interface {
 	// as soon as possible after the context is canceled.
 	Context() context.Context
 
-	// Close releases the lease.
+	// Close releases the lease. If retry is true and err is non-nil, the task
+	// is re-enqueued. If err is rexec.ErrPreempted, the task is re-enqueued as
+	// a preempted task, which doesn't count as a failed attempt.
 	Close(ctx context.Context, err error, retry bool)
 }
 
@@ -1048,7 +1099,12 @@ type Runner interface {
 	DownloadInputs(ctx context.Context, ioStats *repb.IOStats) error
 
 	// Run runs the task that is currently assigned to the runner.
-	Run(ctx context.Context, ioStats *repb.IOStats) *CommandResult
+	//
+	// If liveOutput is non-nil, the command's stdout and stderr are also
+	// written to the non-nil liveOutput writers while the command is running,
+	// if the runner supports it. Writes to these should not fail. Either way,
+	// the full output is returned in the command result.
+	Run(ctx context.Context, ioStats *repb.IOStats, liveOutput *Stdio) *CommandResult
 
 	// GracefulTerminate sends a graceful termination signal to the runner.
 	GracefulTerminate(ctx context.Context) error
@@ -1102,6 +1158,16 @@ type RunnerPool interface {
 	// Shutdown removes all runners from the pool.
 	Shutdown(ctx context.Context) error
 
+	// Drain removes all paused runners from the pool, and stops runners from
+	// being recycled until Undrain is called.
+	Drain(ctx context.Context) error
+
+	// Undrain allows runners to be recycled again after a call to Drain.
+	Undrain()
+
+	// PausedRunnerCount returns the number of paused runners in the pool.
+	PausedRunnerCount() int
+
 	// Wait waits for all background cleanup jobs to complete. This is intended to
 	// be called during shutdown, after all tasks have finished executing (to ensure
 	// that no new cleanup jobs will be needed after this returns).
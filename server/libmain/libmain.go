@@ -36,6 +36,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_cache_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_client"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cache_snapshot_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/capabilities_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/content_addressable_storage_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/hit_tracker"
@@ -60,6 +61,7 @@ import (
 	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
 	authpb "github.com/buildbuddy-io/buildbuddy/proto/auth"
 	bbspb "github.com/buildbuddy-io/buildbuddy/proto/buildbuddy_service"
+	cspb "github.com/buildbuddy-io/buildbuddy/proto/cache_snapshot"
 	hitpb "github.com/buildbuddy-io/buildbuddy/proto/hit_tracker"
 	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
 	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
@@ -322,6 +324,9 @@ func registerServices(env *real_environment.RealEnv, grpcServer *grpc.Server) {
 	if ht := env.GetHitTrackerServiceServer(); ht != nil {
 		hitpb.RegisterHitTrackerServiceServer(grpcServer, ht)
 	}
+	if cs := env.GetCacheSnapshotServiceServer(); cs != nil {
+		cspb.RegisterCacheSnapshotServiceServer(grpcServer, cs)
+	}
 }
 
 func registerLocalGRPCClients(env *real_environment.RealEnv) error {
@@ -405,6 +410,9 @@ func StartAndRunServices(env *real_environment.RealEnv) {
 	if err := capabilities_server.Register(env); err != nil {
 		log.Fatalf("%v", err)
 	}
+	if err := cache_snapshot_server.Register(env); err != nil {
+		log.Fatalf("%v", err)
+	}
 
 	if err := startInternalGRPCServers(env); err != nil {
 		log.Fatalf("%v", err)
@@ -452,6 +460,10 @@ func StartAndRunServices(env *real_environment.RealEnv) {
 		mux.Handle("/api/v1/", interceptors.WrapAuthenticatedExternalProtoletHandler(env, "/api/v1/", apiProtoHandlers))
 		// Protolet doesn't currently support streaming RPCs, so we'll register a regular old http handler.
 		mux.Handle("/api/v1/GetFile", interceptors.WrapAuthenticatedExternalHandler(env, api.GetFileHandler()))
+		// Reports are returned as raw files rather than as a JSON-encoded proto.
+		mux.Handle("/api/v1/GetInvocationReport", interceptors.WrapAuthenticatedExternalHandler(env, api.GetInvocationReportHandler()))
+		// Invocation updates are streamed as server-sent events.
+		mux.Handle("/api/v1/SubscribeInvocation", interceptors.WrapAuthenticatedExternalHandler(env, api.SubscribeInvocationHandler()))
 		mux.Handle("/api/v1/metrics", interceptors.WrapAuthenticatedExternalHandler(env, api.GetMetricsHandler()))
 	}
 
@@ -137,6 +137,11 @@ const (
 	// CPU architecture associated with the request.
 	Arch = "arch"
 
+	// Scheduling tag of a remotely executed task, set by the `scheduling-tag`
+	// platform property (e.g. `interactive` or `ci`). Empty if not set, and
+	// `other` if the tag is not configured in any scheduling class.
+	SchedulingTag = "scheduling_tag"
+
 	// The name used to identify the type of an unexpected event.
 	EventName = "name"
 
@@ -696,6 +701,28 @@ var (
 		GroupID,
 	})
 
+	DiskCachePartitionGroupQuotaBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "disk_cache_partition_group_quota_bytes",
+		Help:      "Maximum number of bytes that a group may store in the partition, by group ID. Only set for groups with an explicitly configured quota.",
+	}, []string{
+		PartitionID,
+		CacheNameLabel,
+		GroupID,
+	})
+
+	DiskCacheGroupQuotaEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "disk_cache_group_quota_evictions",
+		Help:      "Number of entries evicted from the partition because the group that owns them exceeded its quota.",
+	}, []string{
+		PartitionID,
+		CacheNameLabel,
+		GroupID,
+	})
+
 	DiskCachePartitionCapacityBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_cache",
@@ -781,6 +808,45 @@ var (
 		CacheHitMissStatus,
 	})
 
+	DistributedCacheHandoffEntries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "distributed_cache_handoff_entries",
+		Help:      "Number of entries handled while handing off data to new owners after a distributed cache membership change, by status: `transferred`, `present` (the new owner already had the entry) or `failed`.",
+	}, []string{
+		StatusHumanReadableLabel,
+	})
+
+	DistributedCacheHandoffBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "distributed_cache_handoff_bytes",
+		Help:      "Number of bytes transferred to new owners after a distributed cache membership change.",
+	})
+
+	DistributedCacheHandoffInProgress = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "distributed_cache_handoff_in_progress",
+		Help:      "Whether this node is handing off data after a distributed cache membership change (1) or not (0).",
+	})
+
+	DistributedCacheAntiEntropyCheckedEntries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "distributed_cache_anti_entropy_checked_entries",
+		Help:      "Number of entry replicas checked by the distributed cache anti-entropy process.",
+	})
+
+	DistributedCacheAntiEntropyMissingReplicas = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "distributed_cache_anti_entropy_missing_replicas",
+		Help:      "Number of replicas found missing by the distributed cache anti-entropy process, by repair status: `repaired` or `failed`.",
+	}, []string{
+		StatusHumanReadableLabel,
+	})
+
 	MigrationNotFoundErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_cache",
@@ -953,6 +1019,22 @@ var (
 		Help:      "Number of tasks started remotely, but not necessarily completed. Includes retry attempts of the same task.",
 	})
 
+	RemoteExecutionPreemptedTaskCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "preempted_task_count",
+		Help:      "Number of running tasks that were preempted by the executor to make room for higher-priority tasks.",
+	}, []string{
+		GroupID,
+	})
+
+	// #### Examples
+	//
+	// ```promql
+	// # Rate of task preemptions by group
+	// sum by (group_id) (rate(buildbuddy_remote_execution_preempted_task_count[5m]))
+	// ```
+
 	RemoteExecutionExecutedActionMetadataDurationsUsec = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_execution",
@@ -1162,6 +1244,24 @@ var (
 	// quantile(0.5, buildbuddy_remote_execution_queue_length)
 	// ```
 
+	RemoteExecutionQueueWaitDurationUsec = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "queue_wait_duration_usec",
+		Help:      "Time that tasks spend waiting to be claimed by an executor, in **microseconds**.",
+		Buckets:   durationUsecBuckets(1*time.Millisecond, 1*day, 2),
+	}, []string{
+		GroupID,
+		SchedulingTag,
+	})
+
+	// #### Examples
+	//
+	// ```promql
+	// # 95th percentile queue wait time by scheduling tag
+	// histogram_quantile(0.95, sum(rate(buildbuddy_remote_execution_queue_wait_duration_usec_bucket[5m])) by (le, scheduling_tag))
+	// ```
+
 	RemoteExecutionTasksExecuting = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_execution",
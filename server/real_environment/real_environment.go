@@ -11,6 +11,7 @@ import (
 	"github.com/jonboulle/clockwork"
 	"google.golang.org/grpc"
 
+	cspb "github.com/buildbuddy-io/buildbuddy/proto/cache_snapshot"
 	hitpb "github.com/buildbuddy-io/buildbuddy/proto/hit_tracker"
 	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
 	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
@@ -137,6 +138,7 @@ type RealEnv struct {
 	ociRegistry                      interfaces.OCIRegistry
 	hitTrackerFactory                interfaces.HitTrackerFactory
 	hitTrackerServiceServer          hitpb.HitTrackerServiceServer
+	cacheSnapshotServiceServer       cspb.CacheSnapshotServiceServer
 	experimentFlagProvider           interfaces.ExperimentFlagProvider
 }
 
@@ -840,6 +842,13 @@ func (r *RealEnv) SetHitTrackerServiceServer(hitTrackerServiceServer hitpb.HitTr
 	r.hitTrackerServiceServer = hitTrackerServiceServer
 }
 
+func (r *RealEnv) GetCacheSnapshotServiceServer() cspb.CacheSnapshotServiceServer {
+	return r.cacheSnapshotServiceServer
+}
+func (r *RealEnv) SetCacheSnapshotServiceServer(cacheSnapshotServiceServer cspb.CacheSnapshotServiceServer) {
+	r.cacheSnapshotServiceServer = cacheSnapshotServiceServer
+}
+
 func (r *RealEnv) GetExperimentFlagProvider() interfaces.ExperimentFlagProvider {
 	return r.experimentFlagProvider
 }
@@ -0,0 +1,264 @@
+// Package asset_mapping stores and looks up Remote Asset API mappings from a
+// URI and its qualifiers to a blob or directory in the CAS.
+//
+// Mappings are stored in the action cache, so they get the same auth,
+// per-group isolation and eviction as other AC entries. Each URI is stored
+// under its own key, so that a fetch for any one of the pushed URIs finds
+// the mapping.
+package asset_mapping
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
+	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+)
+
+const (
+	// keyPrefix is mixed into every mapping key so that mapping keys can't
+	// collide with the digests of real Actions.
+	keyPrefix = "buildbuddy-remote-asset-mapping-v1"
+
+	// Qualifier prefixes that only affect how the server fetches an asset
+	// (not the identity of the asset), and are therefore not part of the key.
+	// These must stay in sync with the qualifiers handled by fetch_server.
+	httpHeaderPrefixQualifier    = "http_header:"
+	httpHeaderUrlPrefixQualifier = "http_header_url:"
+
+	// checksumQualifier is the name of the qualifier holding the expected
+	// Subresource Integrity checksum of a blob.
+	checksumQualifier = "checksum.sri"
+)
+
+// AssetType distinguishes blob mappings from directory mappings, which are
+// stored under different keys even for the same URI and qualifiers.
+type AssetType int
+
+const (
+	BlobAsset AssetType = iota
+	DirectoryAsset
+)
+
+func (t AssetType) String() string {
+	if t == DirectoryAsset {
+		return "directory"
+	}
+	return "blob"
+}
+
+func assetTypeOf(mapping *capb.RemoteAssetMapping) AssetType {
+	if mapping.GetRootDirectoryDigest() != nil {
+		return DirectoryAsset
+	}
+	return BlobAsset
+}
+
+func isKeyQualifier(q *rapb.Qualifier) bool {
+	return !strings.HasPrefix(q.GetName(), httpHeaderPrefixQualifier) &&
+		!strings.HasPrefix(q.GetName(), httpHeaderUrlPrefixQualifier)
+}
+
+// ParseChecksumQualifier returns a digest function and digest hash given a
+// "checksum.sri" qualifier. If the qualifier uses an unsupported hash
+// algorithm, DigestFunction_UNKNOWN is returned with no error.
+func ParseChecksumQualifier(qualifier *rapb.Qualifier) (repb.DigestFunction_Value, string, error) {
+	for _, digestFunc := range digest.SupportedDigestFunctions() {
+		pr := fmt.Sprintf("%s-", strings.ToLower(repb.DigestFunction_Value_name[int32(digestFunc)]))
+		if strings.HasPrefix(qualifier.GetValue(), pr) {
+			b64hash := strings.TrimPrefix(qualifier.GetValue(), pr)
+			decodedHash, err := base64.StdEncoding.DecodeString(b64hash)
+			if err != nil {
+				return repb.DigestFunction_UNKNOWN, "", status.FailedPreconditionErrorf("Error decoding qualifier %q: %s", qualifier.GetName(), err.Error())
+			}
+			expectedChecksum := fmt.Sprintf("%x", decodedHash)
+			return digestFunc, expectedChecksum, nil
+		}
+	}
+	return repb.DigestFunction_UNKNOWN, "", nil
+}
+
+// VerifyChecksumQualifiers checks that the content of the given blob matches
+// any "checksum.sri" qualifiers, so that a pushed mapping can't later be
+// served for a checksum that it doesn't satisfy. The blob must already be
+// present in the CAS. If the qualifier uses the same digest function as the
+// blob, the hashes are compared directly; otherwise the blob is read back
+// and hashed.
+func VerifyChecksumQualifiers(ctx context.Context, cache interfaces.Cache, instanceName string, digestFunction repb.DigestFunction_Value, blobDigest *repb.Digest, qualifiers []*rapb.Qualifier) error {
+	for _, q := range qualifiers {
+		if q.GetName() != checksumQualifier {
+			continue
+		}
+		checksumFunc, expectedChecksum, err := ParseChecksumQualifier(q)
+		if err != nil {
+			return status.InvalidArgumentError(status.Message(err))
+		}
+		if checksumFunc == repb.DigestFunction_UNKNOWN {
+			return status.InvalidArgumentErrorf("unsupported %s qualifier %q", checksumQualifier, q.GetValue())
+		}
+		actualChecksum := blobDigest.GetHash()
+		if checksumFunc != digestFunction {
+			rn := digest.NewCASResourceName(blobDigest, instanceName, digestFunction)
+			r, err := cache.Reader(ctx, rn.ToProto(), 0, 0)
+			if err != nil {
+				return err
+			}
+			d, err := digest.Compute(r, checksumFunc)
+			r.Close()
+			if err != nil {
+				return err
+			}
+			actualChecksum = d.GetHash()
+		}
+		if actualChecksum != expectedChecksum {
+			return status.InvalidArgumentErrorf("blob %s does not match %s qualifier %q", digest.String(blobDigest), checksumQualifier, q.GetValue())
+		}
+	}
+	return nil
+}
+
+// ResourceName returns the AC resource name under which the mapping for the
+// given asset type, URI and qualifiers is stored. Qualifier order does not
+// matter.
+func ResourceName(instanceName string, digestFunction repb.DigestFunction_Value, assetType AssetType, uri string, qualifiers []*rapb.Qualifier) (*digest.ACResourceName, error) {
+	if digestFunction == repb.DigestFunction_UNKNOWN {
+		digestFunction = repb.DigestFunction_SHA256
+	}
+	keyQualifiers := make([]*rapb.Qualifier, 0, len(qualifiers))
+	for _, q := range qualifiers {
+		if isKeyQualifier(q) {
+			keyQualifiers = append(keyQualifiers, q)
+		}
+	}
+	slices.SortFunc(keyQualifiers, func(a, b *rapb.Qualifier) int {
+		if c := cmp.Compare(a.GetName(), b.GetName()); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.GetValue(), b.GetValue())
+	})
+
+	// Length-prefix each field so that distinct URI/qualifier combinations
+	// can never serialize to the same key.
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n%s\n%d:%s\n", keyPrefix, assetType, len(uri), uri)
+	for _, q := range keyQualifiers {
+		fmt.Fprintf(&b, "%d:%s=%d:%s\n", len(q.GetName()), q.GetName(), len(q.GetValue()), q.GetValue())
+	}
+	d, err := digest.Compute(strings.NewReader(b.String()), digestFunction)
+	if err != nil {
+		return nil, err
+	}
+	return digest.NewACResourceName(d, instanceName, digestFunction), nil
+}
+
+// Store writes a mapping for each of the given URIs. The uri field of the
+// given mapping is ignored and set per-URI.
+func Store(ctx context.Context, cache interfaces.Cache, instanceName string, uris []string, qualifiers []*rapb.Qualifier, mapping *capb.RemoteAssetMapping) error {
+	if len(uris) == 0 {
+		return status.InvalidArgumentError("at least one URI is required")
+	}
+	kvs := make(map[*rspb.ResourceName][]byte, len(uris))
+	for _, uri := range uris {
+		if uri == "" {
+			return status.InvalidArgumentError("URIs must not be empty")
+		}
+		rn, err := ResourceName(instanceName, mapping.GetDigestFunction(), assetTypeOf(mapping), uri, qualifiers)
+		if err != nil {
+			return err
+		}
+		m := mapping.CloneVT()
+		m.Uri = uri
+		buf, err := proto.Marshal(m)
+		if err != nil {
+			return err
+		}
+		kvs[rn.ToProto()] = buf
+	}
+	return cache.SetMulti(ctx, kvs)
+}
+
+// Lookup returns the first unexpired mapping of the given type found for any
+// of the given URIs, checking them in order. Mappings whose referenced CAS content is no longer
+// present are skipped. Returns a NotFound error if no mapping is usable.
+func Lookup(ctx context.Context, cache interfaces.Cache, now time.Time, instanceName string, digestFunction repb.DigestFunction_Value, assetType AssetType, uris []string, qualifiers []*rapb.Qualifier) (*capb.RemoteAssetMapping, error) {
+	for _, uri := range uris {
+		rn, err := ResourceName(instanceName, digestFunction, assetType, uri, qualifiers)
+		if err != nil {
+			return nil, err
+		}
+		buf, err := cache.Get(ctx, rn.ToProto())
+		if err != nil {
+			if !status.IsNotFoundError(err) {
+				log.CtxWarningf(ctx, "Failed to look up remote asset mapping for %q: %s", uri, err)
+			}
+			continue
+		}
+		mapping := &capb.RemoteAssetMapping{}
+		if err := proto.Unmarshal(buf, mapping); err != nil {
+			log.CtxWarningf(ctx, "Failed to unmarshal remote asset mapping for %q: %s", uri, err)
+			continue
+		}
+		if mapping.GetExpireAt() != nil && !now.Before(mapping.GetExpireAt().AsTime()) {
+			log.CtxDebugf(ctx, "Remote asset mapping for %q expired at %s", uri, mapping.GetExpireAt().AsTime())
+			continue
+		}
+		ok, err := AllExist(ctx, cache, instanceName, mapping.GetDigestFunction(), ContentDigests(mapping))
+		if err != nil {
+			log.CtxWarningf(ctx, "Failed to check remote asset content for %q: %s", uri, err)
+			continue
+		}
+		if !ok {
+			log.CtxDebugf(ctx, "Remote asset content for %q is no longer in the CAS", uri)
+			continue
+		}
+		return mapping, nil
+	}
+	return nil, status.NotFoundErrorf("no remote asset %s mapping found for %s", assetType, uris)
+}
+
+// ContentDigests returns all of the CAS digests that the mapping points to.
+func ContentDigests(mapping *capb.RemoteAssetMapping) []*repb.Digest {
+	digests := make([]*repb.Digest, 0, 1+len(mapping.GetReferencesBlobs())+len(mapping.GetReferencesDirectories()))
+	if d := mapping.GetBlobDigest(); d != nil {
+		digests = append(digests, d)
+	}
+	if d := mapping.GetRootDirectoryDigest(); d != nil {
+		digests = append(digests, d)
+	}
+	digests = append(digests, mapping.GetReferencesBlobs()...)
+	digests = append(digests, mapping.GetReferencesDirectories()...)
+	return digests
+}
+
+// AllExist returns whether all of the given digests are present in the CAS.
+func AllExist(ctx context.Context, cache interfaces.Cache, instanceName string, digestFunction repb.DigestFunction_Value, digests []*repb.Digest) (bool, error) {
+	rns := make([]*rspb.ResourceName, 0, len(digests))
+	for _, d := range digests {
+		rn := digest.NewCASResourceName(d, instanceName, digestFunction)
+		if rn.IsEmpty() {
+			continue
+		}
+		rns = append(rns, rn.ToProto())
+	}
+	if len(rns) == 0 {
+		return true, nil
+	}
+	missing, err := cache.FindMissing(ctx, rns)
+	if err != nil {
+		return false, err
+	}
+	return len(missing) == 0, nil
+}
@@ -0,0 +1,458 @@
+package fetch_server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+)
+
+// Files up to this size are buffered in memory while unpacking; larger
+// files are staged on disk before being uploaded.
+const maxInMemoryFileSizeBytes = 4 * 1024 * 1024
+
+type archiveType int
+
+const (
+	unknownArchive archiveType = iota
+	tarArchive
+	tarGzArchive
+	tarZstdArchive
+	zipArchive
+)
+
+// archiveTypeFromResourceType maps the MIME type given in a resource_type
+// qualifier to an archive type.
+func archiveTypeFromResourceType(resourceType string) (archiveType, error) {
+	switch resourceType {
+	case "application/x-tar":
+		return tarArchive, nil
+	case "application/gzip", "application/x-gzip", "application/x-tar+gzip", "application/x-compressed-tar":
+		return tarGzArchive, nil
+	case "application/zstd", "application/x-zstd", "application/x-tar+zstd", "application/x-zstd-compressed-tar":
+		return tarZstdArchive, nil
+	case "application/zip", "application/x-zip-compressed":
+		return zipArchive, nil
+	}
+	return unknownArchive, status.InvalidArgumentErrorf("unsupported %s %q", ResourceTypeQualifier, resourceType)
+}
+
+// archiveTypeFromURI guesses the archive type from the extension of the URI
+// path, returning unknownArchive if there is no recognized extension.
+func archiveTypeFromURI(uri string) archiveType {
+	p := uri
+	if u, err := url.Parse(uri); err == nil {
+		p = u.Path
+	}
+	p = strings.ToLower(p)
+	switch {
+	case strings.HasSuffix(p, ".tar"):
+		return tarArchive
+	case strings.HasSuffix(p, ".tar.gz"), strings.HasSuffix(p, ".tgz"):
+		return tarGzArchive
+	case strings.HasSuffix(p, ".tar.zst"), strings.HasSuffix(p, ".tzst"):
+		return tarZstdArchive
+	case strings.HasSuffix(p, ".zip"):
+		return zipArchive
+	}
+	return unknownArchive
+}
+
+// sniffArchiveType determines the archive type from the leading bytes of the
+// file, and seeks the file back to the start.
+func sniffArchiveType(f *os.File) (archiveType, error) {
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return unknownArchive, status.UnavailableErrorf("read archive header: %s", err)
+	}
+	header = header[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return unknownArchive, status.UnavailableErrorf("seek archive: %s", err)
+	}
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return tarGzArchive, nil
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return tarZstdArchive, nil
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return zipArchive, nil
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return tarArchive, nil
+	}
+	return unknownArchive, status.InvalidArgumentError("unrecognized archive format")
+}
+
+// unpackArchive reads all entries of the archive into the tree builder.
+func unpackArchive(f *os.File, at archiveType, tb *treeBuilder) error {
+	switch at {
+	case tarArchive:
+		return unpackTar(f, tb)
+	case tarGzArchive:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return status.InvalidArgumentErrorf("invalid gzip archive: %s", err)
+		}
+		defer gz.Close()
+		return unpackTar(gz, tb)
+	case tarZstdArchive:
+		zr, err := compression.NewZstdDecompressingReader(io.NopCloser(f))
+		if err != nil {
+			return status.InvalidArgumentErrorf("invalid zstd archive: %s", err)
+		}
+		defer zr.Close()
+		return unpackTar(zr, tb)
+	case zipArchive:
+		return unpackZip(f, tb)
+	}
+	return status.InvalidArgumentError("unrecognized archive format")
+}
+
+func unpackTar(r io.Reader, tb *treeBuilder) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return status.InvalidArgumentErrorf("invalid tar archive: %s", err)
+		}
+		if err := tb.countEntry(); err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = tb.AddDirectory(hdr.Name)
+		case tar.TypeReg:
+			err = tb.AddFile(hdr.Name, tr, hdr.Size, hdr.Mode&0111 != 0)
+		case tar.TypeSymlink:
+			err = tb.AddSymlink(hdr.Name, hdr.Linkname)
+		case tar.TypeLink:
+			err = tb.AddHardlink(hdr.Name, hdr.Linkname)
+		default:
+			log.CtxDebugf(tb.ctx, "Ignoring unsupported tar entry %q with type %q", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func unpackZip(f *os.File, tb *treeBuilder) error {
+	info, err := f.Stat()
+	if err != nil {
+		return status.UnavailableErrorf("stat archive: %s", err)
+	}
+	zr, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return status.InvalidArgumentErrorf("invalid zip archive: %s", err)
+	}
+	for _, zf := range zr.File {
+		if err := tb.countEntry(); err != nil {
+			return err
+		}
+		mode := zf.Mode()
+		if err := func() error {
+			if mode.IsDir() {
+				return tb.AddDirectory(zf.Name)
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				return status.InvalidArgumentErrorf("invalid zip entry %q: %s", zf.Name, err)
+			}
+			defer rc.Close()
+			if mode&os.ModeSymlink != 0 {
+				target, err := io.ReadAll(io.LimitReader(rc, 4096))
+				if err != nil {
+					return status.InvalidArgumentErrorf("read zip symlink %q: %s", zf.Name, err)
+				}
+				return tb.AddSymlink(zf.Name, string(target))
+			}
+			return tb.AddFile(zf.Name, rc, int64(zf.UncompressedSize64), mode&0111 != 0)
+		}(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type treeNode struct {
+	dirs     map[string]*treeNode
+	files    map[string]*repb.FileNode
+	symlinks map[string]*repb.SymlinkNode
+}
+
+func newTreeNode() *treeNode {
+	return &treeNode{
+		dirs:     make(map[string]*treeNode),
+		files:    make(map[string]*repb.FileNode),
+		symlinks: make(map[string]*repb.SymlinkNode),
+	}
+}
+
+// treeBuilder uploads the files of an unpacked archive to the CAS as they are
+// read, and then uploads the REAPI Directory tree describing them.
+type treeBuilder struct {
+	ctx            context.Context
+	bsClient       bspb.ByteStreamClient
+	instanceName   string
+	digestFunction repb.DigestFunction_Value
+	stripPrefix    string
+	root           *treeNode
+
+	// Limits on the archive contents, so that an archive bomb can't fill
+	// up scratch space and the CAS.
+	maxSizeBytes  int64
+	maxEntries    int
+	unpackedBytes int64
+	entries       int
+}
+
+func newTreeBuilder(ctx context.Context, bsClient bspb.ByteStreamClient, instanceName string, digestFunction repb.DigestFunction_Value, stripPrefix string) *treeBuilder {
+	return &treeBuilder{
+		ctx:            ctx,
+		bsClient:       bsClient,
+		instanceName:   instanceName,
+		digestFunction: digestFunction,
+		stripPrefix:    strings.Trim(path.Clean("/"+stripPrefix), "/"),
+		root:           newTreeNode(),
+		maxSizeBytes:   *maxUnpackedArchiveSizeBytes,
+		maxEntries:     *maxUnpackedArchiveEntries,
+	}
+}
+
+// countEntry records that another archive entry was read, returning an
+// error if the archive has too many entries.
+func (tb *treeBuilder) countEntry() error {
+	tb.entries++
+	if tb.entries > tb.maxEntries {
+		return status.InvalidArgumentErrorf("archive has more than %d entries", tb.maxEntries)
+	}
+	return nil
+}
+
+// relPath returns the path of the archive entry relative to the output root,
+// after stripping the prefix. ok is false if the entry is outside of the
+// prefix and should be skipped.
+func (tb *treeBuilder) relPath(name string) (p string, ok bool, err error) {
+	if path.IsAbs(name) || slices.Contains(strings.Split(name, "/"), "..") {
+		return "", false, status.InvalidArgumentErrorf("invalid archive entry name %q", name)
+	}
+	p = strings.Trim(path.Clean(name), "/")
+	if p == "." {
+		p = ""
+	}
+	if tb.stripPrefix == "" {
+		return p, true, nil
+	}
+	if p == tb.stripPrefix {
+		return "", true, nil
+	}
+	if rest, found := strings.CutPrefix(p, tb.stripPrefix+"/"); found {
+		return rest, true, nil
+	}
+	return "", false, nil
+}
+
+// dir returns the node for the directory at the given relative path,
+// creating it and any parents as needed.
+func (tb *treeBuilder) dir(p string) (*treeNode, error) {
+	n := tb.root
+	if p == "" {
+		return n, nil
+	}
+	for _, name := range strings.Split(p, "/") {
+		if _, ok := n.files[name]; ok {
+			return nil, status.InvalidArgumentErrorf("archive entry %q is both a file and a directory", p)
+		}
+		if _, ok := n.symlinks[name]; ok {
+			return nil, status.InvalidArgumentErrorf("archive entry %q is both a symlink and a directory", p)
+		}
+		child, ok := n.dirs[name]
+		if !ok {
+			child = newTreeNode()
+			n.dirs[name] = child
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// parent returns the parent directory node and base name of a relative path.
+// Entries that resolve to the root itself are reported with an empty name.
+func (tb *treeBuilder) parent(name string) (*treeNode, string, error) {
+	p, ok, err := tb.relPath(name)
+	if err != nil || !ok || p == "" {
+		return nil, "", err
+	}
+	dir, base := path.Split(p)
+	n, err := tb.dir(strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		return nil, "", err
+	}
+	return n, base, nil
+}
+
+func (tb *treeBuilder) AddDirectory(name string) error {
+	p, ok, err := tb.relPath(name)
+	if err != nil || !ok {
+		return err
+	}
+	_, err = tb.dir(p)
+	return err
+}
+
+func (tb *treeBuilder) AddFile(name string, r io.Reader, sizeBytes int64, executable bool) error {
+	n, base, err := tb.parent(name)
+	if err != nil || n == nil {
+		return err
+	}
+	if _, ok := n.dirs[base]; ok {
+		return status.InvalidArgumentErrorf("archive entry %q is both a file and a directory", name)
+	}
+	remaining := tb.maxSizeBytes - tb.unpackedBytes
+	if sizeBytes > remaining {
+		return tb.sizeLimitError()
+	}
+	// Don't trust the size in the entry header; stop reading once the
+	// limit is exceeded.
+	lr := &io.LimitedReader{R: r, N: remaining + 1}
+	r = lr
+	defer func() {
+		tb.unpackedBytes += remaining + 1 - lr.N
+	}()
+	var d *repb.Digest
+	if sizeBytes <= maxInMemoryFileSizeBytes {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return status.InvalidArgumentErrorf("read archive entry %q: %s", name, err)
+		}
+		if lr.N == 0 {
+			return tb.sizeLimitError()
+		}
+		d, err = cachetools.UploadBlobToCAS(tb.ctx, tb.bsClient, tb.instanceName, tb.digestFunction, b)
+		if err != nil {
+			return status.UnavailableErrorf("upload archive entry %q: %s", name, err)
+		}
+	} else {
+		tmpPath, err := tempCopy(r)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := os.Remove(tmpPath); err != nil {
+				log.Errorf("Failed to remove temp file: %s", err)
+			}
+		}()
+		if lr.N == 0 {
+			return tb.sizeLimitError()
+		}
+		d, err = cachetools.UploadFile(tb.ctx, tb.bsClient, tb.instanceName, tb.digestFunction, tmpPath)
+		if err != nil {
+			return status.UnavailableErrorf("upload archive entry %q: %s", name, err)
+		}
+	}
+	delete(n.symlinks, base)
+	n.files[base] = &repb.FileNode{Name: base, Digest: d, IsExecutable: executable}
+	return nil
+}
+
+func (tb *treeBuilder) sizeLimitError() error {
+	return status.InvalidArgumentErrorf("archive contents are larger than %d bytes", tb.maxSizeBytes)
+}
+
+func (tb *treeBuilder) AddSymlink(name, target string) error {
+	n, base, err := tb.parent(name)
+	if err != nil || n == nil {
+		return err
+	}
+	if _, ok := n.dirs[base]; ok {
+		return status.InvalidArgumentErrorf("archive entry %q is both a symlink and a directory", name)
+	}
+	delete(n.files, base)
+	n.symlinks[base] = &repb.SymlinkNode{Name: base, Target: target}
+	return nil
+}
+
+// AddHardlink adds a copy of a previously added file.
+func (tb *treeBuilder) AddHardlink(name, target string) error {
+	tn, tbase, err := tb.parent(target)
+	if err != nil {
+		return err
+	}
+	var targetNode *repb.FileNode
+	if tn != nil {
+		targetNode = tn.files[tbase]
+	}
+	if targetNode == nil {
+		log.CtxDebugf(tb.ctx, "Ignoring hard link %q to missing or excluded file %q", name, target)
+		return nil
+	}
+	n, base, err := tb.parent(name)
+	if err != nil || n == nil {
+		return err
+	}
+	if _, ok := n.dirs[base]; ok {
+		return status.InvalidArgumentErrorf("archive entry %q is both a file and a directory", name)
+	}
+	delete(n.symlinks, base)
+	n.files[base] = &repb.FileNode{Name: base, Digest: targetNode.GetDigest(), IsExecutable: targetNode.GetIsExecutable()}
+	return nil
+}
+
+// Finish uploads all Directory protos to the CAS and returns the digest of
+// the root directory.
+func (tb *treeBuilder) Finish() (*repb.Digest, error) {
+	if tb.stripPrefix != "" && len(tb.root.dirs) == 0 && len(tb.root.files) == 0 && len(tb.root.symlinks) == 0 {
+		return nil, status.InvalidArgumentErrorf("%s %q not found in archive", DirectoryQualifier, tb.stripPrefix)
+	}
+	return tb.upload(tb.root)
+}
+
+func (tb *treeBuilder) upload(n *treeNode) (*repb.Digest, error) {
+	dir := &repb.Directory{}
+	// REAPI requires Directory children to be sorted by name.
+	for _, name := range sortedKeys(n.dirs) {
+		d, err := tb.upload(n.dirs[name])
+		if err != nil {
+			return nil, err
+		}
+		dir.Directories = append(dir.Directories, &repb.DirectoryNode{Name: name, Digest: d})
+	}
+	for _, name := range sortedKeys(n.files) {
+		dir.Files = append(dir.Files, n.files[name])
+	}
+	for _, name := range sortedKeys(n.symlinks) {
+		dir.Symlinks = append(dir.Symlinks, n.symlinks[name])
+	}
+	d, err := cachetools.UploadProto(tb.ctx, tb.bsClient, tb.instanceName, tb.digestFunction, dir)
+	if err != nil {
+		return nil, status.UnavailableErrorf("upload directory: %s", err)
+	}
+	return d, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -2,7 +2,6 @@ package fetch_server
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
 	"io"
 	"net"
@@ -16,6 +15,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/http/httpclient"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/asset_mapping"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
@@ -25,6 +25,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"google.golang.org/protobuf/types/known/durationpb"
 
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
 	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	bspb "google.golang.org/genproto/googleapis/bytestream"
@@ -36,6 +37,9 @@ import (
 
 var (
 	allowedPrivateIPs = flag.Slice("remote_asset.allowed_private_ips", []string{}, "Allowed IP ranges for fetching remote assets. Private IPs are disallowed by default.")
+
+	maxUnpackedArchiveSizeBytes = flag.Int64("remote_asset.max_unpacked_archive_size_bytes", 10_000_000_000 /* 10 GB */, "The maximum total size of the files unpacked from a single archive by FetchDirectory.")
+	maxUnpackedArchiveEntries   = flag.Int("remote_asset.max_unpacked_archive_entries", 1_000_000, "The maximum number of entries unpacked from a single archive by FetchDirectory.")
 )
 
 const (
@@ -44,6 +48,11 @@ const (
 	BazelHttpHeaderPrefixQualifier    = "http_header:"
 	BazelHttpHeaderUrlPrefixQualifier = "http_header_url:"
 
+	// Standard qualifiers for directory fetches. See
+	// https://github.com/bazelbuild/remote-apis/blob/main/build/bazel/remote/asset/v1/qualifiers.md
+	ResourceTypeQualifier = "resource_type"
+	DirectoryQualifier    = "directory"
+
 	maxHTTPTimeout = 60 * time.Minute
 )
 
@@ -131,49 +140,42 @@ func (s *FetchServer) computeRequestTimeout(ctx context.Context, protoTimeout *d
 	return timeout
 }
 
-// parseChecksumQualifier returns a digest function and digest hash
-// given a "checksum.sri" qualifier.
-func parseChecksumQualifier(qualifier *rapb.Qualifier) (repb.DigestFunction_Value, string, error) {
-	for _, digestFunc := range digest.SupportedDigestFunctions() {
-		pr := fmt.Sprintf("%s-", strings.ToLower(repb.DigestFunction_Value_name[int32(digestFunc)]))
-		if strings.HasPrefix(qualifier.GetValue(), pr) {
-			b64hash := strings.TrimPrefix(qualifier.GetValue(), pr)
-			decodedHash, err := base64.StdEncoding.DecodeString(b64hash)
-			if err != nil {
-				return repb.DigestFunction_UNKNOWN, "", status.FailedPreconditionErrorf("Error decoding qualifier %q: %s", qualifier.GetName(), err.Error())
-			}
-			expectedChecksum := fmt.Sprintf("%x", decodedHash)
-			return digestFunc, expectedChecksum, nil
-		}
-	}
-	return repb.DigestFunction_UNKNOWN, "", nil
+// fetchQualifiers holds the parsed qualifiers of a Fetch request.
+type fetchQualifiers struct {
+	checksumFunc     repb.DigestFunction_Value
+	expectedChecksum string
+	sharedHeader     http.Header
+	uriHeaders       map[int]http.Header
+	// canonicalID scopes checksum-based cache hits: content fetched under
+	// one canonical ID is not reused for a request with a different one.
+	canonicalID string
+
+	// Only used for directory fetches.
+	resourceType string
+	directory    string
+
+	unsupportedNames []string
 }
 
-func (p *FetchServer) FetchBlob(ctx context.Context, req *rapb.FetchBlobRequest) (*rapb.FetchBlobResponse, error) {
-	ctx, err := prefix.AttachUserPrefixToContext(ctx, p.env.GetAuthenticator())
-	if err != nil {
-		return nil, err
+// parseQualifiers parses the qualifiers of a Fetch request. Qualifiers that
+// aren't supported are collected in unsupportedNames rather than returned as
+// an error, since they may still match an asset registered via the Push API.
+func parseQualifiers(ctx context.Context, qualifiers []*rapb.Qualifier, directory bool) (*fetchQualifiers, error) {
+	q := &fetchQualifiers{
+		sharedHeader: make(http.Header),
+		uriHeaders:   make(map[int]http.Header),
 	}
-
-	storageFunc := req.GetDigestFunction()
-	if storageFunc == repb.DigestFunction_UNKNOWN {
-		storageFunc = repb.DigestFunction_SHA256
-	}
-	var unsupportedQualifierNames []string
-	sharedHeader := make(http.Header)
-	uriHeaders := make(map[int]http.Header)
-	var checksumFunc repb.DigestFunction_Value
-	var expectedChecksum string
-	for _, qualifier := range req.GetQualifiers() {
+	for _, qualifier := range qualifiers {
 		if qualifier.GetName() == ChecksumQualifier {
-			checksumFunc, expectedChecksum, err = parseChecksumQualifier(qualifier)
+			var err error
+			q.checksumFunc, q.expectedChecksum, err = asset_mapping.ParseChecksumQualifier(qualifier)
 			if err != nil {
 				return nil, err
 			}
 			continue
 		}
 		if strings.HasPrefix(qualifier.GetName(), BazelHttpHeaderPrefixQualifier) {
-			sharedHeader.Add(
+			q.sharedHeader.Add(
 				strings.TrimPrefix(qualifier.GetName(), BazelHttpHeaderPrefixQualifier),
 				qualifier.GetValue(),
 			)
@@ -197,23 +199,82 @@ func (p *FetchServer) FetchBlob(ctx context.Context, req *rapb.FetchBlobRequest)
 				log.CtxWarningf(ctx, "Failed to decode URI index: %s", err)
 				continue
 			}
-			if _, found := uriHeaders[uriIndex]; !found {
+			if _, found := q.uriHeaders[uriIndex]; !found {
 				// If the URI index is not found, create a new header map.
-				uriHeaders[uriIndex] = make(http.Header)
+				q.uriHeaders[uriIndex] = make(http.Header)
 			}
-			uriHeaders[uriIndex].Add(halves[1], qualifier.GetValue())
+			q.uriHeaders[uriIndex].Add(halves[1], qualifier.GetValue())
 			continue
 		}
 		if qualifier.GetName() == BazelCanonicalIDQualifier {
-			// TODO: Implement canonical ID handling.
+			q.canonicalID = qualifier.GetValue()
+			continue
+		}
+		if directory && qualifier.GetName() == ResourceTypeQualifier {
+			q.resourceType = qualifier.GetValue()
+			continue
+		}
+		if directory && qualifier.GetName() == DirectoryQualifier {
+			q.directory = qualifier.GetValue()
 			continue
 		}
-		unsupportedQualifierNames = append(unsupportedQualifierNames, qualifier.GetName())
+		q.unsupportedNames = append(q.unsupportedNames, qualifier.GetName())
 	}
-	if len(unsupportedQualifierNames) > 0 {
-		return nil, makeUnsupportedQualifiersErrStatus(unsupportedQualifierNames)
+	return q, nil
+}
+
+// headerForURI returns the HTTP headers to use when fetching the URI at the
+// given index in the request.
+func (q *fetchQualifiers) headerForURI(i int) http.Header {
+	header := q.sharedHeader.Clone()
+	if uriHeader, found := q.uriHeaders[i]; found {
+		for k, v := range uriHeader {
+			for _, vv := range v {
+				// URI-specific headers take precedence over shared headers.
+				header.Set(k, vv)
+			}
+		}
+	}
+	return header
+}
+
+func (p *FetchServer) FetchBlob(ctx context.Context, req *rapb.FetchBlobRequest) (*rapb.FetchBlobResponse, error) {
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, p.env.GetAuthenticator())
+	if err != nil {
+		return nil, err
+	}
+
+	storageFunc := req.GetDigestFunction()
+	if storageFunc == repb.DigestFunction_UNKNOWN {
+		storageFunc = repb.DigestFunction_SHA256
+	}
+	q, err := parseQualifiers(ctx, req.GetQualifiers(), false /*=directory*/)
+	if err != nil {
+		return nil, err
 	}
-	if len(expectedChecksum) != 0 {
+	// Serve assets that were previously registered via the Push API without
+	// going to the network. Pushed assets may use arbitrary qualifiers, so
+	// check for them before rejecting unsupported ones.
+	if mapping, err := asset_mapping.Lookup(ctx, p.env.GetCache(), p.env.GetClock().Now(), req.GetInstanceName(), storageFunc, asset_mapping.BlobAsset, req.GetUris(), req.GetQualifiers()); err == nil {
+		log.CtxDebugf(ctx, "FetchServer found pushed mapping for %q", mapping.GetUri())
+		return &rapb.FetchBlobResponse{
+			Uri:            mapping.GetUri(),
+			Qualifiers:     req.GetQualifiers(),
+			ExpiresAt:      mapping.GetExpireAt(),
+			Status:         &statuspb.Status{Code: int32(gcodes.OK)},
+			BlobDigest:     mapping.GetBlobDigest(),
+			DigestFunction: storageFunc,
+		}, nil
+	}
+	if len(q.unsupportedNames) > 0 {
+		return nil, makeUnsupportedQualifiersErrStatus(q.unsupportedNames)
+	}
+	checksumFunc, expectedChecksum := q.checksumFunc, q.expectedChecksum
+	// Blobs in the CAS don't record the canonical ID they were fetched
+	// with, so only look them up by checksum alone when there isn't one.
+	// Fetches with a canonical ID are remembered as mappings keyed on the
+	// ID instead (see below), which the Lookup above will find.
+	if len(expectedChecksum) != 0 && q.canonicalID == "" {
 		blobDigest := p.findBlobInCache(ctx, req.GetInstanceName(), checksumFunc, expectedChecksum)
 		// If the digestFunc is supplied and differ from the checksum sri,
 		// after looking up the cached blob using checksum sri, re-upload
@@ -246,22 +307,13 @@ func (p *FetchServer) FetchBlob(ctx context.Context, req *rapb.FetchBlobRequest)
 		if err != nil {
 			return nil, status.InvalidArgumentErrorf("unparsable URI: %q", uri)
 		}
-		header := sharedHeader.Clone()
-		if uriHeader, found := uriHeaders[i]; found {
-			for k, v := range uriHeader {
-				for _, vv := range v {
-					// URI-specific headers take precedence over shared headers.
-					header.Set(k, vv)
-				}
-			}
-		}
 		blobDigest, err := mirrorToCache(
 			ctx,
 			p.env.GetByteStreamClient(),
 			req.GetInstanceName(),
 			httpClient,
 			uri,
-			header,
+			q.headerForURI(i),
 			storageFunc,
 			checksumFunc,
 			expectedChecksum,
@@ -272,6 +324,15 @@ func (p *FetchServer) FetchBlob(ctx context.Context, req *rapb.FetchBlobRequest)
 			log.CtxWarningf(ctx, "Failed to mirror %q to cache: %s", uri, err)
 			continue
 		}
+		if expectedChecksum != "" && q.canonicalID != "" {
+			mapping := &capb.RemoteAssetMapping{
+				BlobDigest:     blobDigest,
+				DigestFunction: storageFunc,
+			}
+			if err := asset_mapping.Store(ctx, p.env.GetCache(), req.GetInstanceName(), []string{uri}, req.GetQualifiers(), mapping); err != nil {
+				log.CtxWarningf(ctx, "Failed to store blob mapping for %q: %s", uri, err)
+			}
+		}
 		return &rapb.FetchBlobResponse{
 			Uri:            uri,
 			Status:         &statuspb.Status{Code: int32(gcodes.OK)},
@@ -308,7 +369,176 @@ func (p *FetchServer) FetchBlob(ctx context.Context, req *rapb.FetchBlobRequest)
 }
 
 func (p *FetchServer) FetchDirectory(ctx context.Context, req *rapb.FetchDirectoryRequest) (*rapb.FetchDirectoryResponse, error) {
-	return nil, status.UnimplementedError("FetchDirectory is not yet implemented")
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, p.env.GetAuthenticator())
+	if err != nil {
+		return nil, err
+	}
+
+	storageFunc := req.GetDigestFunction()
+	if storageFunc == repb.DigestFunction_UNKNOWN {
+		storageFunc = repb.DigestFunction_SHA256
+	}
+	q, err := parseQualifiers(ctx, req.GetQualifiers(), true /*=directory*/)
+	if err != nil {
+		return nil, err
+	}
+	if mapping, err := asset_mapping.Lookup(ctx, p.env.GetCache(), p.env.GetClock().Now(), req.GetInstanceName(), storageFunc, asset_mapping.DirectoryAsset, req.GetUris(), req.GetQualifiers()); err == nil {
+		log.CtxDebugf(ctx, "FetchServer found directory mapping for %q", mapping.GetUri())
+		return &rapb.FetchDirectoryResponse{
+			Uri:                 mapping.GetUri(),
+			Qualifiers:          req.GetQualifiers(),
+			ExpiresAt:           mapping.GetExpireAt(),
+			Status:              &statuspb.Status{Code: int32(gcodes.OK)},
+			RootDirectoryDigest: mapping.GetRootDirectoryDigest(),
+			DigestFunction:      storageFunc,
+		}, nil
+	}
+	if len(q.unsupportedNames) > 0 {
+		return nil, makeUnsupportedQualifiersErrStatus(q.unsupportedNames)
+	}
+	var forcedArchiveType archiveType
+	if q.resourceType != "" {
+		forcedArchiveType, err = archiveTypeFromResourceType(q.resourceType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	httpClient := httpclient.NewWithAllowedPrivateIPs(p.allowedPrivateIPNets)
+
+	ctx, cancel := context.WithTimeout(ctx, p.computeRequestTimeout(ctx, req.GetTimeout()))
+	defer cancel()
+
+	var lastFetchErr error
+	var lastFetchUri string
+	for i, uri := range req.GetUris() {
+		if _, err := url.Parse(uri); err != nil {
+			return nil, status.InvalidArgumentErrorf("unparsable URI: %q", uri)
+		}
+		rootDigest, err := p.fetchDirectory(ctx, httpClient, req.GetInstanceName(), uri, q.headerForURI(i), storageFunc, q, forcedArchiveType)
+		if err != nil {
+			lastFetchErr = fmt.Errorf("%s: %w", uri, err)
+			lastFetchUri = uri
+			log.CtxWarningf(ctx, "Failed to fetch directory %q: %s", uri, err)
+			continue
+		}
+		// Only remember the mapping when the archive contents were pinned by a
+		// checksum; otherwise the upstream contents may change and should be
+		// re-fetched next time, just like FetchBlob.
+		if q.expectedChecksum != "" {
+			mapping := &capb.RemoteAssetMapping{
+				RootDirectoryDigest: rootDigest,
+				DigestFunction:      storageFunc,
+			}
+			if err := asset_mapping.Store(ctx, p.env.GetCache(), req.GetInstanceName(), []string{uri}, req.GetQualifiers(), mapping); err != nil {
+				log.CtxWarningf(ctx, "Failed to store directory mapping for %q: %s", uri, err)
+			}
+		}
+		return &rapb.FetchDirectoryResponse{
+			Uri:                 uri,
+			Qualifiers:          req.GetQualifiers(),
+			Status:              &statuspb.Status{Code: int32(gcodes.OK)},
+			RootDirectoryDigest: rootDigest,
+			DigestFunction:      storageFunc,
+		}, nil
+	}
+
+	log.CtxInfof(ctx, "FetchDirectory: returning NotFound for %s", req.GetUris())
+	code := gcodes.NotFound
+	if status.IsInvalidArgumentError(lastFetchErr) {
+		// Checksum mismatches and malformed archives are not going to succeed
+		// on retry.
+		code = gcodes.InvalidArgument
+	}
+	return &rapb.FetchDirectoryResponse{
+		Status: &statuspb.Status{
+			Code:    int32(code),
+			Message: status.Message(lastFetchErr),
+		},
+		Uri: lastFetchUri,
+	}, nil
+}
+
+// fetchDirectory fetches the archive at the given URI (or finds it in the
+// cache by its checksum), unpacks it, and uploads the unpacked tree to the
+// CAS, returning the root directory digest.
+func (p *FetchServer) fetchDirectory(ctx context.Context, httpClient *http.Client, instanceName, uri string, header http.Header, storageFunc repb.DigestFunction_Value, q *fetchQualifiers, forcedArchiveType archiveType) (*repb.Digest, error) {
+	bsClient := p.env.GetByteStreamClient()
+
+	var archivePath string
+	if q.expectedChecksum != "" && q.canonicalID == "" {
+		if d := p.findBlobInCache(ctx, instanceName, q.checksumFunc, q.expectedChecksum); d != nil {
+			rn := digest.NewCASResourceName(d, instanceName, q.checksumFunc)
+			reader, err := p.env.GetCache().Reader(ctx, rn.ToProto(), 0, 0)
+			if err != nil {
+				log.CtxWarningf(ctx, "Failed to read cached archive %s: %s", digest.String(d), err)
+			} else {
+				archivePath, err = tempCopy(reader)
+				reader.Close()
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if archivePath == "" {
+		rsp, err := httpGet(ctx, httpClient, uri, header)
+		if err != nil {
+			return nil, err
+		}
+		archivePath, err = tempCopy(rsp.Body)
+		rsp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if q.expectedChecksum != "" {
+			rn, err := cachetools.ComputeFileDigest(archivePath, instanceName, q.checksumFunc)
+			if err != nil {
+				os.Remove(archivePath)
+				return nil, status.UnavailableErrorf("failed to compute checksum digest: %s", err)
+			}
+			if rn.GetDigest().GetHash() != q.expectedChecksum {
+				os.Remove(archivePath)
+				return nil, status.InvalidArgumentErrorf("response body checksum for %q was %q but wanted %q", uri, rn.GetDigest().GetHash(), q.expectedChecksum)
+			}
+			// Cache the archive itself so that subsequent fetches with a
+			// different directory or resource_type don't need to download it.
+			if _, err := cachetools.UploadFile(ctx, bsClient, instanceName, q.checksumFunc, archivePath); err != nil {
+				log.CtxWarningf(ctx, "Failed to cache archive for %q: %s", uri, err)
+			}
+		}
+	}
+	defer func() {
+		if err := os.Remove(archivePath); err != nil {
+			log.Errorf("Failed to remove temp file: %s", err)
+		}
+	}()
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, status.UnavailableErrorf("open downloaded archive: %s", err)
+	}
+	defer f.Close()
+	at := forcedArchiveType
+	if at == unknownArchive {
+		at = archiveTypeFromURI(uri)
+	}
+	if at == unknownArchive {
+		at, err = sniffArchiveType(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tb := newTreeBuilder(ctx, bsClient, instanceName, storageFunc, q.directory)
+	if err := unpackArchive(f, at, tb); err != nil {
+		return nil, err
+	}
+	rootDigest, err := tb.Finish()
+	if err != nil {
+		return nil, err
+	}
+	log.CtxInfof(ctx, "Unpacked %s to cache (root directory digest: %s)", uri, digest.String(rootDigest))
+	return rootDigest, nil
 }
 
 func (p *FetchServer) rewriteToCache(ctx context.Context, blobDigest *repb.Digest, instanceName string, fromFunc, toFunc repb.DigestFunction_Value) *repb.Digest {
@@ -396,20 +626,11 @@ func mirrorToCache(
 	checksumFunc repb.DigestFunction_Value,
 	expectedChecksum string,
 ) (*repb.Digest, error) {
-	log.CtxDebugf(ctx, "Fetching %s", uri)
-	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
-	if err != nil {
-		return nil, status.UnavailableErrorf("failed to fetch %q: create request failed: %s", uri, err)
-	}
-	req.Header = header
-	rsp, err := httpClient.Do(req)
+	rsp, err := httpGet(ctx, httpClient, uri, header)
 	if err != nil {
-		return nil, status.UnavailableErrorf("failed to fetch %q: HTTP GET failed: %s", uri, err)
+		return nil, err
 	}
 	defer rsp.Body.Close()
-	if rsp.StatusCode < 200 || rsp.StatusCode >= 400 {
-		return nil, status.UnavailableErrorf("failed to fetch %q: HTTP %s", uri, rsp.Status)
-	}
 
 	// If we know what the hash should be and the content length is known,
 	// then we know the full digest, and can pipe directly from the HTTP
@@ -479,6 +700,26 @@ func mirrorToCache(
 	return blobDigest, nil
 }
 
+// httpGet issues a GET request for the given URI, returning an error if the
+// response status is not successful. The caller must close the body.
+func httpGet(ctx context.Context, httpClient *http.Client, uri string, header http.Header) (*http.Response, error) {
+	log.CtxDebugf(ctx, "Fetching %s", uri)
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to fetch %q: create request failed: %s", uri, err)
+	}
+	req.Header = header
+	rsp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to fetch %q: HTTP GET failed: %s", uri, err)
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 400 {
+		rsp.Body.Close()
+		return nil, status.UnavailableErrorf("failed to fetch %q: HTTP %s", uri, rsp.Status)
+	}
+	return rsp, nil
+}
+
 func tempCopy(r io.Reader) (path string, err error) {
 	f, err := scratchspace.CreateTemp("remote-asset-fetch-*")
 	if err != nil {
@@ -1,21 +1,28 @@
 package fetch_server_test
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"path"
 	"strings"
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/proto/resource"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/fetch_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testtar"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/scratchspace"
@@ -583,13 +590,338 @@ func TestFetchBlobWithUnknownQualifiers(t *testing.T) {
 	assert.True(t, proto.Equal(expectedDetail, actualDetail))
 }
 
+// readTree reads back the directory tree rooted at the given digest from the
+// cache, returning a map from file path to contents. Symlinks are represented
+// as "-> target" and executable files are suffixed with " (x)".
+func readTree(ctx context.Context, t *testing.T, te *testenv.TestEnv, rootDigest *repb.Digest, digestFunc repb.DigestFunction_Value) map[string]string {
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te.GetAuthenticator())
+	require.NoError(t, err)
+	contents := make(map[string]string)
+	var walk func(dirPath string, d *repb.Digest)
+	walk = func(dirPath string, d *repb.Digest) {
+		dir := &repb.Directory{}
+		if d.GetSizeBytes() > 0 {
+			rn := digest.NewCASResourceName(d, "", digestFunc)
+			err := cachetools.ReadProtoFromCAS(ctx, te.GetCache(), rn, dir)
+			require.NoError(t, err)
+		}
+		for _, f := range dir.GetFiles() {
+			var b []byte
+			if f.GetDigest().GetSizeBytes() > 0 {
+				rn := digest.NewResourceName(f.GetDigest(), "", resource.CacheType_CAS, digestFunc)
+				var err error
+				b, err = te.GetCache().Get(ctx, rn.ToProto())
+				require.NoError(t, err)
+			}
+			v := string(b)
+			if f.GetIsExecutable() {
+				v += " (x)"
+			}
+			contents[path.Join(dirPath, f.GetName())] = v
+		}
+		for _, s := range dir.GetSymlinks() {
+			contents[path.Join(dirPath, s.GetName())] = "-> " + s.GetTarget()
+		}
+		for _, sub := range dir.GetDirectories() {
+			contents[path.Join(dirPath, sub.GetName())+"/"] = ""
+			walk(path.Join(dirPath, sub.GetName()), sub.GetDigest())
+		}
+	}
+	walk("", rootDigest)
+	return contents
+}
+
+func testTarEntries(t *testing.T) []byte {
+	return testtar.EntriesBytes(t, []testtar.Entry{
+		{Header: &tar.Header{Name: "repo-1.0/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{Header: &tar.Header{Name: "repo-1.0/BUILD", Typeflag: tar.TypeReg, Mode: 0644}, Data: []byte("build")},
+		{Header: &tar.Header{Name: "repo-1.0/bin/tool", Typeflag: tar.TypeReg, Mode: 0755}, Data: []byte("tool")},
+		{Header: &tar.Header{Name: "repo-1.0/bin/tool-link", Typeflag: tar.TypeSymlink, Linkname: "tool"}},
+		{Header: &tar.Header{Name: "repo-1.0/bin/tool-copy", Typeflag: tar.TypeLink, Linkname: "repo-1.0/bin/tool"}},
+		{Header: &tar.Header{Name: "repo-1.0/empty/", Typeflag: tar.TypeDir, Mode: 0755}},
+	})
+}
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func zipBytes(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		fh := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		fh.SetMode(0644)
+		f, err := w.CreateHeader(fh)
+		require.NoError(t, err)
+		_, err = f.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
 func TestFetchDirectory(t *testing.T) {
+	tarBytes := testTarEntries(t)
+	for _, tc := range []struct {
+		name       string
+		path       string
+		archive    []byte
+		qualifiers []*rapb.Qualifier
+		expected   map[string]string
+	}{
+		{
+			name:    "tar_gz_by_extension",
+			path:    "/archive.tar.gz",
+			archive: gzipBytes(t, tarBytes),
+			expected: map[string]string{
+				"repo-1.0/":              "",
+				"repo-1.0/BUILD":         "build",
+				"repo-1.0/bin/":          "",
+				"repo-1.0/bin/tool":      "tool (x)",
+				"repo-1.0/bin/tool-link": "-> tool",
+				"repo-1.0/bin/tool-copy": "tool (x)",
+				"repo-1.0/empty/":        "",
+			},
+		},
+		{
+			name:       "tar_zst_by_resource_type_with_strip_prefix",
+			path:       "/download",
+			archive:    compression.CompressZstd(nil, tarBytes),
+			qualifiers: []*rapb.Qualifier{{Name: fetch_server.ResourceTypeQualifier, Value: "application/x-tar+zstd"}, {Name: fetch_server.DirectoryQualifier, Value: "repo-1.0"}},
+			expected: map[string]string{
+				"BUILD":         "build",
+				"bin/":          "",
+				"bin/tool":      "tool (x)",
+				"bin/tool-link": "-> tool",
+				"bin/tool-copy": "tool (x)",
+				"empty/":        "",
+			},
+		},
+		{
+			name:       "sniffed_tar_with_nested_strip_prefix",
+			path:       "/download",
+			archive:    tarBytes,
+			qualifiers: []*rapb.Qualifier{{Name: fetch_server.DirectoryQualifier, Value: "repo-1.0/bin/"}},
+			expected: map[string]string{
+				"tool":      "tool (x)",
+				"tool-link": "-> tool",
+				"tool-copy": "tool (x)",
+			},
+		},
+		{
+			name:    "zip",
+			path:    "/archive.zip",
+			archive: zipBytes(t, map[string]string{"a/b.txt": "b", "c.txt": "c"}),
+			expected: map[string]string{
+				"a/":      "",
+				"a/b.txt": "b",
+				"c.txt":   "c",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			te := testenv.GetTestEnv(t)
+			require.NoError(t, scratchspace.Init())
+			clientConn := runFetchServer(ctx, t, te)
+			fetchClient := rapb.NewFetchClient(clientConn)
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(tc.archive)
+			}))
+			defer ts.Close()
+
+			resp, err := fetchClient.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+				Uris:       []string{ts.URL + tc.path},
+				Qualifiers: tc.qualifiers,
+			})
+			require.NoError(t, err)
+			require.Equal(t, int32(gcodes.OK), resp.GetStatus().GetCode(), resp.GetStatus().GetMessage())
+			assert.Equal(t, ts.URL+tc.path, resp.GetUri())
+			assert.Equal(t, repb.DigestFunction_SHA256, resp.GetDigestFunction())
+			assert.Equal(t, tc.expected, readTree(ctx, t, te, resp.GetRootDirectoryDigest(), repb.DigestFunction_SHA256))
+		})
+	}
+}
+
+func TestFetchDirectory_Checksum(t *testing.T) {
 	ctx := context.Background()
 	te := testenv.GetTestEnv(t)
+	require.NoError(t, scratchspace.Init())
 	clientConn := runFetchServer(ctx, t, te)
 	fetchClient := rapb.NewFetchClient(clientConn)
 
-	resp, err := fetchClient.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{})
-	assert.EqualError(t, err, "rpc error: code = Unimplemented desc = FetchDirectory is not yet implemented")
-	assert.Nil(t, resp)
+	archive := gzipBytes(t, testTarEntries(t))
+	archiveDigest, err := digest.Compute(bytes.NewReader(archive), repb.DigestFunction_SHA256)
+	require.NoError(t, err)
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(archive)
+	}))
+	defer ts.Close()
+
+	// A mismatched checksum fails with InvalidArgument.
+	resp, err := fetchClient.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+		Uris:       []string{ts.URL + "/archive.tar.gz"},
+		Qualifiers: []*rapb.Qualifier{{Name: fetch_server.ChecksumQualifier, Value: sha256CRI}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(gcodes.InvalidArgument), resp.GetStatus().GetCode())
+
+	qualifiers := []*rapb.Qualifier{
+		{Name: fetch_server.ChecksumQualifier, Value: checksumQualifierFromContent(t, archiveDigest.GetHash(), repb.DigestFunction_SHA256)},
+		{Name: fetch_server.DirectoryQualifier, Value: "repo-1.0"},
+	}
+	resp, err = fetchClient.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+		Uris:       []string{ts.URL + "/archive.tar.gz"},
+		Qualifiers: qualifiers,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.OK), resp.GetStatus().GetCode(), resp.GetStatus().GetMessage())
+	rootDigest := resp.GetRootDirectoryDigest()
+	assert.Equal(t, 2, requests)
+
+	// The same request is now served from the stored mapping.
+	resp, err = fetchClient.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+		Uris:       []string{ts.URL + "/archive.tar.gz"},
+		Qualifiers: qualifiers,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.OK), resp.GetStatus().GetCode())
+	assert.True(t, proto.Equal(rootDigest, resp.GetRootDirectoryDigest()))
+	assert.Equal(t, 2, requests)
+
+	// A different strip prefix re-uses the cached archive without
+	// downloading it again.
+	resp, err = fetchClient.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+		Uris: []string{ts.URL + "/other-mirror/archive.tar.gz"},
+		Qualifiers: []*rapb.Qualifier{
+			qualifiers[0],
+			{Name: fetch_server.DirectoryQualifier, Value: "repo-1.0/bin"},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.OK), resp.GetStatus().GetCode())
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, "tool (x)", readTree(ctx, t, te, resp.GetRootDirectoryDigest(), repb.DigestFunction_SHA256)["tool"])
+}
+
+func TestFetchDirectory_InvalidArchive(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	require.NoError(t, scratchspace.Init())
+	clientConn := runFetchServer(ctx, t, te)
+	fetchClient := rapb.NewFetchClient(clientConn)
+
+	for _, archive := range [][]byte{
+		[]byte("not an archive"),
+		testtar.EntryBytes(t, &tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644}, []byte("x")),
+		testtar.EntriesBytes(t, []testtar.Entry{
+			{Header: &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"}},
+			{Header: &tar.Header{Name: "link/passwd", Typeflag: tar.TypeReg, Mode: 0644}, Data: []byte("x")},
+		}),
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(archive)
+		}))
+		resp, err := fetchClient.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+			Uris: []string{ts.URL},
+		})
+		ts.Close()
+		require.NoError(t, err)
+		assert.Equal(t, int32(gcodes.InvalidArgument), resp.GetStatus().GetCode())
+	}
+
+	_, err := fetchClient.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+		Uris:       []string{"https://example.com/archive"},
+		Qualifiers: []*rapb.Qualifier{{Name: fetch_server.ResourceTypeQualifier, Value: "application/x-rar"}},
+	})
+	require.Error(t, err)
+	assert.Equal(t, gcodes.InvalidArgument, gstatus.Code(err))
+}
+
+func TestFetchDirectory_Limits(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		flagName    string
+		flagValue   any
+		expectError bool
+	}{
+		{name: "within_limits", flagName: "remote_asset.max_unpacked_archive_entries", flagValue: 6},
+		{name: "too_many_entries", flagName: "remote_asset.max_unpacked_archive_entries", flagValue: 5, expectError: true},
+		{name: "too_large", flagName: "remote_asset.max_unpacked_archive_size_bytes", flagValue: int64(len("build") + len("tool") - 1), expectError: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			flags.Set(t, tc.flagName, tc.flagValue)
+			ctx := context.Background()
+			te := testenv.GetTestEnv(t)
+			require.NoError(t, scratchspace.Init())
+			clientConn := runFetchServer(ctx, t, te)
+			fetchClient := rapb.NewFetchClient(clientConn)
+
+			archive := testTarEntries(t)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(archive)
+			}))
+			defer ts.Close()
+
+			resp, err := fetchClient.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+				Uris: []string{ts.URL + "/archive.tar"},
+			})
+			require.NoError(t, err)
+			if tc.expectError {
+				assert.Equal(t, int32(gcodes.InvalidArgument), resp.GetStatus().GetCode())
+			} else {
+				assert.Equal(t, int32(gcodes.OK), resp.GetStatus().GetCode(), resp.GetStatus().GetMessage())
+			}
+		})
+	}
+}
+
+func TestFetchBlob_CanonicalID(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	require.NoError(t, scratchspace.Init())
+	clientConn := runFetchServer(ctx, t, te)
+	fetchClient := rapb.NewFetchClient(clientConn)
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, content)
+	}))
+	defer ts.Close()
+
+	fetch := func(canonicalID string) {
+		qualifiers := []*rapb.Qualifier{{Name: fetch_server.ChecksumQualifier, Value: sha256CRI}}
+		if canonicalID != "" {
+			qualifiers = append(qualifiers, &rapb.Qualifier{Name: fetch_server.BazelCanonicalIDQualifier, Value: canonicalID})
+		}
+		resp, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+			Uris:       []string{ts.URL},
+			Qualifiers: qualifiers,
+		})
+		require.NoError(t, err)
+		require.Equal(t, int32(gcodes.OK), resp.GetStatus().GetCode(), resp.GetStatus().GetMessage())
+	}
+
+	// The blob is already in the CAS after the first fetch, but a fetch
+	// with a canonical ID that hasn't been seen before still downloads it.
+	fetch("")
+	require.Equal(t, 1, requests)
+	fetch("id-1")
+	require.Equal(t, 2, requests)
+	fetch("id-1")
+	require.Equal(t, 2, requests)
+	fetch("id-2")
+	require.Equal(t, 3, requests)
+	fetch("")
+	require.Equal(t, 3, requests)
 }
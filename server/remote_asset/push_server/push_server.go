@@ -2,12 +2,21 @@ package push_server
 
 import (
 	"context"
+	"net/url"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/asset_mapping"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
+	cappb "github.com/buildbuddy-io/buildbuddy/proto/capability"
 	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 )
 
 type PushServer struct {
@@ -30,9 +39,92 @@ func NewPushServer(env environment.Env) *PushServer {
 }
 
 func (p *PushServer) PushBlob(ctx context.Context, req *rapb.PushBlobRequest) (*rapb.PushBlobResponse, error) {
-	return nil, status.UnimplementedError("PushBlob is not yet implemented")
+	if req.GetBlobDigest() == nil {
+		return nil, status.InvalidArgumentError("blob_digest is a required field")
+	}
+	mapping := &capb.RemoteAssetMapping{
+		BlobDigest:            req.GetBlobDigest(),
+		DigestFunction:        req.GetDigestFunction(),
+		ExpireAt:              req.GetExpireAt(),
+		ReferencesBlobs:       req.GetReferencesBlobs(),
+		ReferencesDirectories: req.GetReferencesDirectories(),
+	}
+	if err := p.push(ctx, req.GetInstanceName(), req.GetUris(), req.GetQualifiers(), mapping); err != nil {
+		return nil, err
+	}
+	return &rapb.PushBlobResponse{}, nil
 }
 
 func (p *PushServer) PushDirectory(ctx context.Context, req *rapb.PushDirectoryRequest) (*rapb.PushDirectoryResponse, error) {
-	return nil, status.UnimplementedError("PushDirectory is not yet implemented")
+	if req.GetRootDirectoryDigest() == nil {
+		return nil, status.InvalidArgumentError("root_directory_digest is a required field")
+	}
+	mapping := &capb.RemoteAssetMapping{
+		RootDirectoryDigest:   req.GetRootDirectoryDigest(),
+		DigestFunction:        req.GetDigestFunction(),
+		ExpireAt:              req.GetExpireAt(),
+		ReferencesBlobs:       req.GetReferencesBlobs(),
+		ReferencesDirectories: req.GetReferencesDirectories(),
+	}
+	if err := p.push(ctx, req.GetInstanceName(), req.GetUris(), req.GetQualifiers(), mapping); err != nil {
+		return nil, err
+	}
+	return &rapb.PushDirectoryResponse{}, nil
+}
+
+// push validates the mapping, checks that the content it points to has
+// already been uploaded to the CAS (and matches any checksum qualifier), and
+// stores it for each of the given URIs.
+func (p *PushServer) push(ctx context.Context, instanceName string, uris []string, qualifiers []*rapb.Qualifier, mapping *capb.RemoteAssetMapping) error {
+	if len(uris) == 0 {
+		return status.InvalidArgumentError("at least one URI is required")
+	}
+	for _, uri := range uris {
+		if _, err := url.Parse(uri); err != nil {
+			return status.InvalidArgumentErrorf("unparsable URI: %q", uri)
+		}
+	}
+	if mapping.GetDigestFunction() == repb.DigestFunction_UNKNOWN {
+		mapping.DigestFunction = repb.DigestFunction_SHA256
+	}
+	if mapping.GetExpireAt() != nil && !mapping.GetExpireAt().AsTime().After(p.env.GetClock().Now()) {
+		return status.InvalidArgumentErrorf("expire_at %s is in the past", mapping.GetExpireAt().AsTime())
+	}
+	digests := asset_mapping.ContentDigests(mapping)
+	for _, d := range digests {
+		if err := digest.NewCASResourceName(d, instanceName, mapping.GetDigestFunction()).Validate(); err != nil {
+			return err
+		}
+	}
+
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, p.env.GetAuthenticator())
+	if err != nil {
+		return err
+	}
+	canWrite, err := capabilities.IsGranted(ctx, p.env.GetAuthenticator(), cappb.Capability_CACHE_WRITE)
+	if err != nil {
+		return err
+	}
+	if !canWrite {
+		return status.PermissionDeniedError("cache write permission is required to push remote assets")
+	}
+
+	cache := p.env.GetCache()
+	exist, err := asset_mapping.AllExist(ctx, cache, instanceName, mapping.GetDigestFunction(), digests)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return status.FailedPreconditionError("pushed content must be uploaded to the CAS first")
+	}
+	if mapping.GetBlobDigest() != nil {
+		if err := asset_mapping.VerifyChecksumQualifiers(ctx, cache, instanceName, mapping.GetDigestFunction(), mapping.GetBlobDigest(), qualifiers); err != nil {
+			return err
+		}
+	}
+	if err := asset_mapping.Store(ctx, cache, instanceName, uris, qualifiers, mapping); err != nil {
+		return err
+	}
+	log.CtxDebugf(ctx, "Pushed remote asset mapping for %s", uris)
+	return nil
 }
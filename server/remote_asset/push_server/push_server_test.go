@@ -0,0 +1,312 @@
+package push_server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/resource"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/fetch_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/push_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	gcodes "google.golang.org/grpc/codes"
+)
+
+func runAssetServers(ctx context.Context, t *testing.T, env *testenv.TestEnv) *grpc.ClientConn {
+	byteStreamServer, err := byte_stream_server.NewByteStreamServer(env)
+	require.NoError(t, err)
+
+	// Allow 127.0.0.1 so we can dial the server in the test.
+	flags.Set(t, "remote_asset.allowed_private_ips", []string{"127.0.0.0/8"})
+
+	fetchServer, err := fetch_server.NewFetchServer(env)
+	require.NoError(t, err)
+	pushServer := push_server.NewPushServer(env)
+
+	grpcServer, runFunc, lis := testenv.RegisterLocalGRPCServer(t, env)
+	bspb.RegisterByteStreamServer(grpcServer, byteStreamServer)
+	rapb.RegisterFetchServer(grpcServer, fetchServer)
+	rapb.RegisterPushServer(grpcServer, pushServer)
+
+	go runFunc()
+
+	clientConn, err := testenv.LocalGRPCConn(ctx, lis)
+	require.NoError(t, err)
+
+	env.SetByteStreamClient(bspb.NewByteStreamClient(clientConn))
+	return clientConn
+}
+
+func uploadToCAS(ctx context.Context, t *testing.T, env *testenv.TestEnv, content string) *repb.Digest {
+	d, err := digest.Compute(bytes.NewReader([]byte(content)), repb.DigestFunction_SHA256)
+	require.NoError(t, err)
+	rn := digest.NewResourceName(d, "", resource.CacheType_CAS, repb.DigestFunction_SHA256)
+	err = env.GetCache().Set(ctx, rn.ToProto(), []byte(content))
+	require.NoError(t, err)
+	return d
+}
+
+// failingHTTPServer returns a server that fails the test if it is ever
+// requested, to verify that pushed assets are served without a fetch.
+func failingHTTPServer(t *testing.T) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL)
+		http.Error(w, "should not request this", http.StatusForbidden)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestPushBlob_ThenFetch(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	clientConn := runAssetServers(ctx, t, te)
+	pushClient := rapb.NewPushClient(clientConn)
+	fetchClient := rapb.NewFetchClient(clientConn)
+
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te.GetAuthenticator())
+	require.NoError(t, err)
+
+	d := uploadToCAS(ctx, t, te, "pushed-content")
+	ts := failingHTTPServer(t)
+	mirrorURI := ts.URL + "/mirror/archive.tar.gz"
+	originURI := ts.URL + "/origin/archive.tar.gz"
+
+	_, err = pushClient.PushBlob(ctx, &rapb.PushBlobRequest{
+		Uris: []string{mirrorURI, originURI},
+		Qualifiers: []*rapb.Qualifier{
+			{Name: "bazel.canonical_id", Value: "foo"},
+			{Name: "custom", Value: "bar"},
+		},
+		BlobDigest:     d,
+		DigestFunction: repb.DigestFunction_SHA256,
+	})
+	require.NoError(t, err)
+
+	// Fetch by the second URI only, with the qualifiers in a different order
+	// and an additional http_header qualifier that isn't part of the key.
+	resp, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris: []string{originURI},
+		Qualifiers: []*rapb.Qualifier{
+			{Name: "custom", Value: "bar"},
+			{Name: "http_header:Authorization", Value: "Bearer token"},
+			{Name: "bazel.canonical_id", Value: "foo"},
+		},
+		DigestFunction: repb.DigestFunction_SHA256,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(gcodes.OK), resp.GetStatus().GetCode())
+	assert.Equal(t, originURI, resp.GetUri())
+	assert.Equal(t, d.GetHash(), resp.GetBlobDigest().GetHash())
+	assert.Equal(t, d.GetSizeBytes(), resp.GetBlobDigest().GetSizeBytes())
+}
+
+func TestPushBlob_DifferentQualifiersMiss(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	clientConn := runAssetServers(ctx, t, te)
+	pushClient := rapb.NewPushClient(clientConn)
+	fetchClient := rapb.NewFetchClient(clientConn)
+
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te.GetAuthenticator())
+	require.NoError(t, err)
+
+	d := uploadToCAS(ctx, t, te, "pushed-content")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	_, err = pushClient.PushBlob(ctx, &rapb.PushBlobRequest{
+		Uris:       []string{ts.URL},
+		Qualifiers: []*rapb.Qualifier{{Name: "bazel.canonical_id", Value: "v1"}},
+		BlobDigest: d,
+	})
+	require.NoError(t, err)
+
+	resp, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris:       []string{ts.URL},
+		Qualifiers: []*rapb.Qualifier{{Name: "bazel.canonical_id", Value: "v2"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(gcodes.NotFound), resp.GetStatus().GetCode())
+}
+
+func TestPushBlob_Expired(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	clock := clockwork.NewFakeClock()
+	te.SetClock(clock)
+	clientConn := runAssetServers(ctx, t, te)
+	pushClient := rapb.NewPushClient(clientConn)
+	fetchClient := rapb.NewFetchClient(clientConn)
+
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te.GetAuthenticator())
+	require.NoError(t, err)
+
+	d := uploadToCAS(ctx, t, te, "pushed-content")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	_, err = pushClient.PushBlob(ctx, &rapb.PushBlobRequest{
+		Uris:       []string{ts.URL},
+		BlobDigest: d,
+		ExpireAt:   timestamppb.New(clock.Now().Add(time.Hour)),
+	})
+	require.NoError(t, err)
+
+	resp, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{Uris: []string{ts.URL}})
+	require.NoError(t, err)
+	assert.Equal(t, int32(gcodes.OK), resp.GetStatus().GetCode())
+	assert.Equal(t, d.GetHash(), resp.GetBlobDigest().GetHash())
+	assert.WithinDuration(t, clock.Now().Add(time.Hour), resp.GetExpiresAt().AsTime(), 0)
+
+	clock.Advance(2 * time.Hour)
+
+	resp, err = fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{Uris: []string{ts.URL}})
+	require.NoError(t, err)
+	assert.Equal(t, int32(gcodes.NotFound), resp.GetStatus().GetCode())
+
+	// Pushing an already-expired mapping is rejected.
+	_, err = pushClient.PushBlob(ctx, &rapb.PushBlobRequest{
+		Uris:       []string{ts.URL},
+		BlobDigest: d,
+		ExpireAt:   timestamppb.New(clock.Now().Add(-time.Minute)),
+	})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
+
+func TestPushDirectory_ThenFetch(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	clientConn := runAssetServers(ctx, t, te)
+	pushClient := rapb.NewPushClient(clientConn)
+	fetchClient := rapb.NewFetchClient(clientConn)
+
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te.GetAuthenticator())
+	require.NoError(t, err)
+
+	fileDigest := uploadToCAS(ctx, t, te, "file-content")
+	dir := &repb.Directory{Files: []*repb.FileNode{{Name: "file.txt", Digest: fileDigest}}}
+	dirBytes, err := proto.Marshal(dir)
+	require.NoError(t, err)
+	dirDigest := uploadToCAS(ctx, t, te, string(dirBytes))
+	// The directory is only reachable through the pushed mapping.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	_, err = pushClient.PushDirectory(ctx, &rapb.PushDirectoryRequest{
+		Uris:                []string{ts.URL + "/repo.tar.gz"},
+		RootDirectoryDigest: dirDigest,
+		ReferencesBlobs:     []*repb.Digest{fileDigest},
+	})
+	require.NoError(t, err)
+
+	resp, err := fetchClient.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+		Uris: []string{ts.URL + "/repo.tar.gz"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(gcodes.OK), resp.GetStatus().GetCode())
+	assert.Equal(t, dirDigest.GetHash(), resp.GetRootDirectoryDigest().GetHash())
+
+	// A blob fetch for the same URI doesn't match the directory mapping.
+	blobResp, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris: []string{ts.URL + "/repo.tar.gz"},
+	})
+	require.NoError(t, err)
+	assert.NotEqual(t, int32(gcodes.OK), blobResp.GetStatus().GetCode())
+}
+
+func TestPushBlob_MissingContent(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	clientConn := runAssetServers(ctx, t, te)
+	pushClient := rapb.NewPushClient(clientConn)
+
+	d, err := digest.Compute(bytes.NewReader([]byte("never-uploaded")), repb.DigestFunction_SHA256)
+	require.NoError(t, err)
+
+	_, err = pushClient.PushBlob(ctx, &rapb.PushBlobRequest{
+		Uris:       []string{"https://example.com/foo"},
+		BlobDigest: d,
+	})
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+
+	_, err = pushClient.PushBlob(ctx, &rapb.PushBlobRequest{
+		BlobDigest: d,
+	})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
+
+func TestPushBlob_ChecksumQualifier(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	clientConn := runAssetServers(ctx, t, te)
+	pushClient := rapb.NewPushClient(clientConn)
+
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te.GetAuthenticator())
+	require.NoError(t, err)
+
+	content := "pushed-content"
+	d := uploadToCAS(ctx, t, te, content)
+	other := uploadToCAS(ctx, t, te, "other-content")
+	sha384Digest, err := digest.Compute(bytes.NewReader([]byte(content)), repb.DigestFunction_SHA384)
+	require.NoError(t, err)
+
+	sri := func(t *testing.T, digestFunc repb.DigestFunction_Value, hash string) string {
+		b, err := hex.DecodeString(hash)
+		require.NoError(t, err)
+		return strings.ToLower(digestFunc.String()) + "-" + base64.StdEncoding.EncodeToString(b)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		sri     string
+		wantErr bool
+	}{
+		{name: "matching sha256", sri: sri(t, repb.DigestFunction_SHA256, d.GetHash())},
+		{name: "matching sha384", sri: sri(t, repb.DigestFunction_SHA384, sha384Digest.GetHash())},
+		{name: "mismatched sha256", sri: sri(t, repb.DigestFunction_SHA256, other.GetHash()), wantErr: true},
+		{name: "mismatched sha384", sri: sri(t, repb.DigestFunction_SHA384, strings.Repeat("00", 48)), wantErr: true},
+		{name: "unsupported algorithm", sri: "md5-AAAAAAAAAAAAAAAAAAAAAA==", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := pushClient.PushBlob(ctx, &rapb.PushBlobRequest{
+				Uris:           []string{"https://example.com/" + tc.name},
+				Qualifiers:     []*rapb.Qualifier{{Name: fetch_server.ChecksumQualifier, Value: tc.sri}},
+				BlobDigest:     d,
+				DigestFunction: repb.DigestFunction_SHA256,
+			})
+			if tc.wantErr {
+				require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
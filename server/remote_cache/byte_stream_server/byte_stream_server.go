@@ -19,6 +19,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/ioutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/rexec"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 
 	cappb "github.com/buildbuddy-io/buildbuddy/proto/capability"
@@ -90,6 +91,15 @@ func (s *ByteStreamServer) Read(req *bspb.ReadRequest, stream bspb.ByteStream_Re
 	if err := checkReadPreconditions(req); err != nil {
 		return err
 	}
+	// Output streams of running executions are served by the remote
+	// execution service, which checks that the caller can read the
+	// execution.
+	if _, _, ok := rexec.ParseOutputStreamName(req.GetResourceName()); ok {
+		if res := s.env.GetRemoteExecutionService(); res != nil {
+			return res.ReadOutputStream(req, stream)
+		}
+		return status.NotFoundErrorf("output stream %q not found", req.GetResourceName())
+	}
 	r, err := digest.ParseDownloadResourceName(req.GetResourceName())
 	if err != nil {
 		return err
@@ -147,6 +157,13 @@ func (s *ByteStreamServer) Read(req *bspb.ReadRequest, stream bspb.ByteStream_Re
 			return status.InternalErrorf("Failed to compress blob: %s", err)
 		}
 		defer reader.Close()
+	} else if r.GetCompressor() != repb.Compressor_IDENTITY && !passthroughCompressionEnabled {
+		counter = &ioutil.Counter{}
+		reader, err = compression.NewCompressingReader(r.GetCompressor(), io.NopCloser(io.TeeReader(reader, counter)), bufSize)
+		if err != nil {
+			return status.InternalErrorf("Failed to compress blob: %s", err)
+		}
+		defer reader.Close()
 	}
 
 	copyBuf := s.bufferPool.Get(bufSize)
@@ -294,11 +311,11 @@ func (s *ByteStreamServer) BeginWrite(ctx context.Context, req *bspb.WriteReques
 	ws.checksum = NewChecksum(hasher, r.GetDigestFunction())
 	ws.writer = io.MultiWriter(ws.checksum, committedWriteCloser)
 
-	if r.GetCompressor() == repb.Compressor_ZSTD {
+	if r.GetCompressor() != repb.Compressor_IDENTITY {
 		if s.cache.SupportsCompressor(r.GetCompressor()) {
 			// If the cache supports compression, write compressed bytes to the cache with committedWriteCloser
 			// but wrap the checksum in a decompressor to validate the decompressed data
-			decompressingChecksum, err := compression.NewZstdDecompressor(ws.checksum)
+			decompressingChecksum, err := compression.NewDecompressor(r.GetCompressor(), ws.checksum)
 			if err != nil {
 				return nil, err
 			}
@@ -306,7 +323,7 @@ func (s *ByteStreamServer) BeginWrite(ctx context.Context, req *bspb.WriteReques
 			ws.decompressorCloser = decompressingChecksum
 		} else {
 			// If the cache doesn't support compression, wrap both the checksum and cache writer in a decompressor
-			decompressor, err := compression.NewZstdDecompressor(ws.writer)
+			decompressor, err := compression.NewDecompressor(r.GetCompressor(), ws.writer)
 			if err != nil {
 				return nil, err
 			}
@@ -439,8 +456,7 @@ func (s *ByteStreamServer) Write(stream bspb.ByteStream_WriteServer) error {
 }
 
 func (s *ByteStreamServer) supportsCompressor(compression repb.Compressor_Value) bool {
-	return compression == repb.Compressor_IDENTITY ||
-		compression == repb.Compressor_ZSTD && remote_cache_config.ZstdTranscodingEnabled()
+	return remote_cache_config.TranscodingEnabled(compression)
 }
 
 // `QueryWriteStatus()` is used to find the `committed_size` for a resource
@@ -446,6 +446,73 @@ func TestRPCWriteUncompressedReadCompressed(t *testing.T) {
 	}
 }
 
+func TestRPCWriteAndReadOtherCompressors(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+
+	clientConn := runByteStreamServer(ctx, t, te)
+	bsClient := bspb.NewByteStreamClient(clientConn)
+
+	for _, compressor := range []repb.Compressor_Value{repb.Compressor_DEFLATE, repb.Compressor_BROTLI} {
+		for _, blobSize := range []int64{1, 1e4, 1e6} {
+			t.Run(fmt.Sprintf("%s/%d", compressor, blobSize), func(t *testing.T) {
+				rn, blob := testdigest.RandomCompressibleCASResourceBuf(t, blobSize, "" /*instanceName*/)
+				compressedBlob, err := compression.CompressBytes(compressor, blob)
+				require.NoError(t, err)
+				d := rn.GetDigest()
+				segment := strings.ToLower(compressor.String())
+
+				// Upload the compressed blob.
+				uploadResourceName := fmt.Sprintf("uploads/%s/compressed-blobs/%s/%s/%d", newUUID(t), segment, d.Hash, d.SizeBytes)
+				byte_stream.MustUploadChunked(t, ctx, bsClient, defaultBazelVersion, uploadResourceName, compressedBlob, true)
+
+				// Read it back compressed.
+				downloadBuf := readAll(t, ctx, bsClient, fmt.Sprintf("compressed-blobs/%s/%s/%d", segment, d.Hash, d.SizeBytes))
+				decompressedBlob, err := compression.DecompressBytes(compressor, downloadBuf)
+				require.NoError(t, err)
+				require.Equal(t, blob, decompressedBlob)
+
+				// Read it back uncompressed.
+				downloadBuf = readAll(t, ctx, bsClient, fmt.Sprintf("blobs/%s/%d", d.Hash, d.SizeBytes))
+				require.Equal(t, blob, downloadBuf)
+			})
+		}
+	}
+}
+
+func TestRPCRejectsDisabledCompressor(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	flags.Set(t, "cache.brotli_transcoding_enabled", false)
+
+	clientConn := runByteStreamServer(ctx, t, te)
+	bsClient := bspb.NewByteStreamClient(clientConn)
+
+	rn, _ := testdigest.RandomCASResourceBuf(t, 100)
+	d := rn.GetDigest()
+	readStream, err := bsClient.Read(ctx, &bspb.ReadRequest{
+		ResourceName: fmt.Sprintf("compressed-blobs/brotli/%s/%d", d.Hash, d.SizeBytes),
+	})
+	require.NoError(t, err)
+	_, err = readStream.Recv()
+	require.True(t, status.IsUnimplementedError(err), "expected Unimplemented, got %v", err)
+}
+
+func readAll(t *testing.T, ctx context.Context, bsClient bspb.ByteStreamClient, resourceName string) []byte {
+	downloadStream, err := bsClient.Read(ctx, &bspb.ReadRequest{ResourceName: resourceName})
+	require.NoError(t, err)
+	var buf []byte
+	for {
+		res, err := downloadStream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		buf = append(buf, res.Data...)
+	}
+	return buf
+}
+
 func Test_CacheHandlesCompression(t *testing.T) {
 	// Make blob big enough to require multiple chunks to upload
 	rn, blob := testdigest.RandomCompressibleCASResourceBuf(t, 5e6, "" /*instanceName*/)
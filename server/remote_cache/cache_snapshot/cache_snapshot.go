@@ -0,0 +1,613 @@
+// Package cache_snapshot exports the AC and CAS entries of a group from a
+// running server to a portable archive, and imports those archives into
+// another server.
+//
+// Entries are listed with the CacheSnapshotService, and their data is read
+// and written through the ByteStream and ActionCache APIs, so exports and
+// imports go through the same authorization, validation and quota checks as
+// any other client. Entry data is stored uncompressed in the archive.
+// Importing skips CAS entries that the destination already contains, so an
+// interrupted import can be resumed from its last checkpoint, or simply
+// restarted.
+package cache_snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protodelim"
+
+	cspb "github.com/buildbuddy-io/buildbuddy/proto/cache_snapshot"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+)
+
+const (
+	// magic is written at the start of every archive.
+	magic = "BBCACHESNAPSHOT\n"
+
+	// version is the version of the archive format written by Export.
+	version = 1
+
+	// chunkSize is the maximum size of the data chunks written after each
+	// entry.
+	chunkSize = 256 * 1024
+
+	// maxActionResultSizeBytes bounds the size of the AC entries read from
+	// an archive.
+	maxActionResultSizeBytes = 64 * 1024 * 1024
+
+	// defaultCheckpointInterval is how many entries are imported between
+	// checkpoints if ImportOptions.CheckpointInterval isn't set.
+	defaultCheckpointInterval = 1000
+
+	// progressLogInterval is how often progress is logged.
+	progressLogInterval = time.Minute
+)
+
+// Stats summarizes an export or import.
+type Stats struct {
+	// Entries is the number of entries exported or imported.
+	Entries int64
+	// Bytes is the amount of entry data exported or imported, as stored in
+	// the archive.
+	Bytes int64
+	// Skipped is the number of entries that were skipped: entries that could
+	// no longer be read when exporting, or entries that were already present
+	// when importing.
+	Skipped int64
+}
+
+type ExportOptions struct {
+	// PartitionIDs restricts the export to the given partitions. Entries
+	// from all partitions are exported if empty.
+	PartitionIDs []string
+}
+
+// Export writes the entries owned by the authenticated group to w. The
+// entries are listed before any data is read, so that the server doesn't
+// hold its cache iterator open for the duration of the export.
+func Export(ctx context.Context, conn grpc.ClientConnInterface, w io.Writer, opts *ExportOptions) (*Stats, error) {
+	listing, groupID, err := listEntries(ctx, cspb.NewCacheSnapshotServiceClient(conn), opts.PartitionIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		listing.Close()
+		os.Remove(listing.Name())
+	}()
+
+	bw := bufio.NewWriterSize(w, chunkSize)
+	if _, err := bw.WriteString(magic); err != nil {
+		return nil, err
+	}
+	header := &cspb.Header{
+		Version:      version,
+		CreatedUsec:  time.Now().UnixMicro(),
+		PartitionIds: opts.PartitionIDs,
+		GroupId:      groupID,
+	}
+	if _, err := protodelim.MarshalTo(bw, header); err != nil {
+		return nil, err
+	}
+
+	bsClient := bspb.NewByteStreamClient(conn)
+	acClient := repb.NewActionCacheClient(conn)
+	stats := &Stats{}
+	lastLog := time.Now()
+	lr := bufio.NewReader(listing)
+	for {
+		entry := &cspb.Entry{}
+		if err := protodelim.UnmarshalFrom(lr, entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var n int64
+		if entry.GetResource().GetCacheType() == rspb.CacheType_AC {
+			n, err = exportActionResult(ctx, acClient, bw, entry)
+		} else {
+			n, err = exportBlob(ctx, bsClient, bw, entry)
+		}
+		if status.IsNotFoundError(err) {
+			// The entry may have been evicted since it was listed.
+			stats.Skipped++
+			continue
+		}
+		if err != nil {
+			return nil, status.WrapErrorf(err, "export %s", entry.GetResource().GetDigest().GetHash())
+		}
+		stats.Entries++
+		stats.Bytes += n
+		if time.Since(lastLog) > progressLogInterval {
+			log.Infof("Cache snapshot: exported %d entries (%d bytes) so far", stats.Entries, stats.Bytes)
+			lastLog = time.Now()
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// listEntries writes the listed entries to a temporary file, and returns the
+// file positioned at its start along with the group that owns the entries.
+func listEntries(ctx context.Context, client cspb.CacheSnapshotServiceClient, partitionIDs []string) (*os.File, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.ListEntries(ctx, &cspb.ListEntriesRequest{PartitionIds: partitionIDs})
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := os.CreateTemp("", "cache-snapshot-listing-*")
+	if err != nil {
+		return nil, "", err
+	}
+	groupID, err := spoolEntries(stream, f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+	return f, groupID, nil
+}
+
+func spoolEntries(stream cspb.CacheSnapshotService_ListEntriesClient, f *os.File) (string, error) {
+	bw := bufio.NewWriter(f)
+	groupID := ""
+	for {
+		rsp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		for _, entry := range rsp.GetEntries() {
+			groupID = entry.GetGroupId()
+			if _, err := protodelim.MarshalTo(bw, entry); err != nil {
+				return "", err
+			}
+		}
+	}
+	return groupID, bw.Flush()
+}
+
+// exportBlob reads a CAS entry through the ByteStream API and writes it to w.
+// Nothing is written if the blob is not found.
+func exportBlob(ctx context.Context, bsClient bspb.ByteStreamClient, w io.Writer, entry *cspb.Entry) (int64, error) {
+	rn, err := digest.CASResourceNameFromProto(entry.GetResource())
+	if err != nil {
+		return 0, err
+	}
+	rn.SetCompressor(repb.Compressor_IDENTITY)
+	cw := &chunkWriter{w: w, entry: &cspb.Entry{
+		Resource:    rn.ToProto(),
+		GroupId:     entry.GetGroupId(),
+		PartitionId: entry.GetPartitionId(),
+	}}
+	if err := cachetools.GetBlob(ctx, bsClient, rn, cw); err != nil {
+		if cw.started && status.IsNotFoundError(err) {
+			// Part of the entry has already been written, so the archive
+			// can't be completed.
+			return 0, status.DataLossErrorf("blob disappeared while it was being read: %s", err)
+		}
+		return 0, err
+	}
+	return cw.n, cw.Close()
+}
+
+// exportActionResult reads an AC entry through the ActionCache API and writes
+// it to w.
+func exportActionResult(ctx context.Context, acClient repb.ActionCacheClient, w io.Writer, entry *cspb.Entry) (int64, error) {
+	rn, err := digest.ACResourceNameFromProto(entry.GetResource())
+	if err != nil {
+		return 0, err
+	}
+	rn.SetCompressor(repb.Compressor_IDENTITY)
+	ar, err := cachetools.GetActionResult(ctx, acClient, rn)
+	if err != nil {
+		return 0, err
+	}
+	data, err := proto.Marshal(ar)
+	if err != nil {
+		return 0, err
+	}
+	out := &cspb.Entry{
+		Resource:    rn.ToProto(),
+		GroupId:     entry.GetGroupId(),
+		PartitionId: entry.GetPartitionId(),
+	}
+	if _, err := protodelim.MarshalTo(w, out); err != nil {
+		return 0, err
+	}
+	return writeChunks(w, bytes.NewReader(data), make([]byte, chunkSize))
+}
+
+// chunkWriter writes an entry followed by the data written to it as
+// length-prefixed chunks. The entry is written along with the first chunk,
+// and Close writes the empty chunk that terminates the data.
+type chunkWriter struct {
+	w       io.Writer
+	entry   *cspb.Entry
+	buf     []byte
+	started bool
+	// n is the number of data bytes written so far.
+	n int64
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if c.buf == nil {
+			c.buf = make([]byte, 0, chunkSize)
+		}
+		n := min(len(p), chunkSize-len(c.buf))
+		c.buf = append(c.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(c.buf) == chunkSize {
+			if err := c.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (c *chunkWriter) flush() error {
+	if !c.started {
+		if _, err := protodelim.MarshalTo(c.w, c.entry); err != nil {
+			return err
+		}
+		c.started = true
+	}
+	if len(c.buf) == 0 {
+		return nil
+	}
+	if err := writeChunk(c.w, c.buf); err != nil {
+		return err
+	}
+	c.n += int64(len(c.buf))
+	c.buf = c.buf[:0]
+	return nil
+}
+
+func (c *chunkWriter) Close() error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+	return writeChunk(c.w, nil)
+}
+
+// writeChunk writes a single length-prefixed chunk.
+func writeChunk(w io.Writer, p []byte) error {
+	var lenBuf [binary.MaxVarintLen64]byte
+	l := binary.PutUvarint(lenBuf[:], uint64(len(p)))
+	if _, err := w.Write(lenBuf[:l]); err != nil {
+		return err
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+// writeChunks copies r to w as a sequence of length-prefixed chunks followed
+// by an empty chunk, and returns the number of data bytes written.
+func writeChunks(w io.Writer, r io.Reader, buf []byte) (int64, error) {
+	total := int64(0)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := writeChunk(w, buf[:n]); err != nil {
+				return total, err
+			}
+			total += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, writeChunk(w, nil)
+}
+
+type ImportOptions struct {
+	// StartOffset is the archive offset to resume the import from. It must
+	// be an offset that was passed to Checkpoint by an earlier import of the
+	// same archive. The import starts at the first entry if zero.
+	StartOffset int64
+	// BytesPerSecond limits the rate at which entry data is written to the
+	// cache. The rate is unlimited if zero.
+	BytesPerSecond int64
+	// EntriesPerSecond limits the rate at which entries are written to the
+	// cache. The rate is unlimited if zero.
+	EntriesPerSecond float64
+	// Checkpoint, if set, is called with the offset of the next entry to
+	// import every CheckpointInterval entries, and once the import is done.
+	// The import stops if it returns an error.
+	Checkpoint func(offset int64) error
+	// CheckpointInterval is how many entries are imported between calls to
+	// Checkpoint. Defaults to 1000.
+	CheckpointInterval int
+}
+
+// Import writes the entries in the archive read from r to the server, on
+// behalf of the authenticated group.
+func Import(ctx context.Context, conn grpc.ClientConnInterface, r io.ReadSeeker, opts *ImportOptions) (*Stats, error) {
+	ar := &archiveReader{r: bufio.NewReaderSize(r, chunkSize)}
+	m := make([]byte, len(magic))
+	if _, err := io.ReadFull(ar, m); err != nil || !bytes.Equal(m, []byte(magic)) {
+		return nil, status.InvalidArgumentError("input is not a cache snapshot")
+	}
+	header := &cspb.Header{}
+	if err := protodelim.UnmarshalFrom(ar, header); err != nil {
+		return nil, status.InvalidArgumentErrorf("read snapshot header: %s", err)
+	}
+	if header.GetVersion() > version {
+		return nil, status.FailedPreconditionErrorf("snapshot version %d is not supported (max supported version is %d)", header.GetVersion(), version)
+	}
+	if opts.StartOffset > 0 {
+		if opts.StartOffset < ar.offset {
+			return nil, status.InvalidArgumentErrorf("start offset %d is inside the snapshot header", opts.StartOffset)
+		}
+		if _, err := r.Seek(opts.StartOffset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		ar = &archiveReader{r: bufio.NewReaderSize(r, chunkSize), offset: opts.StartOffset}
+	}
+
+	var entryLimiter, byteLimiter *rate.Limiter
+	if opts.EntriesPerSecond > 0 {
+		entryLimiter = rate.NewLimiter(rate.Limit(opts.EntriesPerSecond), 1)
+	}
+	if opts.BytesPerSecond > 0 {
+		byteLimiter = rate.NewLimiter(rate.Limit(opts.BytesPerSecond), chunkSize)
+	}
+	checkpointInterval := opts.CheckpointInterval
+	if checkpointInterval <= 0 {
+		checkpointInterval = defaultCheckpointInterval
+	}
+	checkpoint := func() error {
+		if opts.Checkpoint == nil {
+			return nil
+		}
+		return opts.Checkpoint(ar.offset)
+	}
+
+	im := &importer{
+		bsClient:  bspb.NewByteStreamClient(conn),
+		casClient: repb.NewContentAddressableStorageClient(conn),
+		acClient:  repb.NewActionCacheClient(conn),
+		limiter:   byteLimiter,
+	}
+	stats := &Stats{}
+	lastLog := time.Now()
+	for n := 1; ; n++ {
+		entry := &cspb.Entry{}
+		if err := protodelim.UnmarshalFrom(ar, entry); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, status.InvalidArgumentErrorf("read snapshot entry at offset %d: %s", ar.offset, err)
+		}
+		if entryLimiter != nil {
+			if err := entryLimiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+		written, imported, err := im.importEntry(ctx, entry, &chunkReader{r: ar})
+		if err != nil {
+			return nil, status.WrapErrorf(err, "import %s", entry.GetResource().GetDigest().GetHash())
+		}
+		if imported {
+			stats.Entries++
+			stats.Bytes += written
+		} else {
+			stats.Skipped++
+		}
+		if n%checkpointInterval == 0 {
+			if err := checkpoint(); err != nil {
+				return nil, err
+			}
+		}
+		if time.Since(lastLog) > progressLogInterval {
+			log.Infof("Cache snapshot: imported %d entries (%d bytes) so far, skipped %d", stats.Entries, stats.Bytes, stats.Skipped)
+			lastLog = time.Now()
+		}
+	}
+	if err := checkpoint(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+type importer struct {
+	bsClient  bspb.ByteStreamClient
+	casClient repb.ContentAddressableStorageClient
+	acClient  repb.ActionCacheClient
+	limiter   *rate.Limiter
+}
+
+// importEntry writes the entry's data to the server unless the server
+// already contains it, and returns the number of data bytes read and whether
+// the entry was written. The data is always read to the end.
+func (im *importer) importEntry(ctx context.Context, entry *cspb.Entry, data *chunkReader) (int64, bool, error) {
+	rn := entry.GetResource()
+	var src io.Reader = data
+	if rn.GetCompressor() != repb.Compressor_IDENTITY {
+		dr, err := compression.NewDecompressingReader(rn.GetCompressor(), io.NopCloser(data))
+		if err != nil {
+			return 0, false, err
+		}
+		defer dr.Close()
+		src = dr
+	}
+	if im.limiter != nil {
+		src = &rateLimitedReader{ctx: ctx, r: src, limiter: im.limiter}
+	}
+
+	var imported bool
+	var err error
+	if rn.GetCacheType() == rspb.CacheType_AC {
+		imported, err = im.importActionResult(ctx, rn, src)
+	} else {
+		imported, err = im.importBlob(ctx, rn, src)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	// Skipped entries and decompressors may not read to the end of the data.
+	if _, err := io.Copy(io.Discard, data); err != nil {
+		return 0, false, err
+	}
+	return data.n, imported, nil
+}
+
+func (im *importer) importBlob(ctx context.Context, r *rspb.ResourceName, src io.Reader) (bool, error) {
+	rn, err := digest.CASResourceNameFromProto(r)
+	if err != nil {
+		return false, err
+	}
+	rn.SetCompressor(repb.Compressor_IDENTITY)
+	rsp, err := im.casClient.FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{
+		InstanceName:   rn.GetInstanceName(),
+		BlobDigests:    []*repb.Digest{rn.GetDigest()},
+		DigestFunction: rn.GetDigestFunction(),
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(rsp.GetMissingBlobDigests()) == 0 {
+		return false, nil
+	}
+	if _, _, err := cachetools.UploadFromReader(ctx, im.bsClient, rn, src); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (im *importer) importActionResult(ctx context.Context, r *rspb.ResourceName, src io.Reader) (bool, error) {
+	rn, err := digest.ACResourceNameFromProto(r)
+	if err != nil {
+		return false, err
+	}
+	data, err := io.ReadAll(io.LimitReader(src, maxActionResultSizeBytes+1))
+	if err != nil {
+		return false, err
+	}
+	if len(data) > maxActionResultSizeBytes {
+		return false, status.InvalidArgumentErrorf("action result is larger than %d bytes", maxActionResultSizeBytes)
+	}
+	ar := &repb.ActionResult{}
+	if err := proto.Unmarshal(data, ar); err != nil {
+		return false, status.InvalidArgumentErrorf("unmarshal action result: %s", err)
+	}
+	if err := cachetools.UploadActionResult(ctx, im.acClient, rn, ar); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// archiveReader tracks the offset of the data read from an archive.
+type archiveReader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+func (r *archiveReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *archiveReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.offset++
+	}
+	return b, err
+}
+
+// chunkReader reads the data chunks that follow an entry, and returns io.EOF
+// after the empty chunk that terminates them.
+type chunkReader struct {
+	r *archiveReader
+	// remaining is the number of bytes left in the current chunk.
+	remaining uint64
+	done      bool
+	// n is the number of data bytes read so far.
+	n int64
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	if r.remaining == 0 {
+		l, err := binary.ReadUvarint(r.r)
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if l == 0 {
+			r.done = true
+			return 0, io.EOF
+		}
+		r.remaining = l
+	}
+	if uint64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.r.Read(p)
+	r.remaining -= uint64(n)
+	r.n += int64(n)
+	if err != nil {
+		return n, unexpectedEOF(err)
+	}
+	return n, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// rateLimitedReader waits for the limiter before returning the data it reads.
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if b := r.limiter.Burst(); len(p) > b {
+		p = p[:b]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.limiter.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,252 @@
+package cache_snapshot_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/disk_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cache_snapshot"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cache_snapshot_server"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testcache"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/claims"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	cspb "github.com/buildbuddy-io/buildbuddy/proto/cache_snapshot"
+	cappb "github.com/buildbuddy-io/buildbuddy/proto/capability"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+)
+
+const maxSizeBytes = 100_000_000
+
+// testUsers returns org admins US1 and US2 in GR1 and GR2, and US3, a GR1
+// member that can only write to the cache. Their user IDs are also their API
+// keys.
+func testUsers() map[string]interfaces.UserInfo {
+	users := testauth.TestUsers("US1", "GR1", "US2", "GR2", "US3", "GR1")
+	for _, id := range []string{"US1", "US2"} {
+		u := users[id].(*claims.Claims)
+		u.GroupMemberships[0].Capabilities = append(u.GroupMemberships[0].Capabilities, cappb.Capability_ORG_ADMIN)
+	}
+	return users
+}
+
+type testServer struct {
+	env   *testenv.TestEnv
+	cache *disk_cache.DiskCache
+	conn  *grpc.ClientConn
+}
+
+// runServer starts a server with the CAS, AC and cache snapshot APIs, backed
+// by a disk cache.
+func runServer(t *testing.T, useV2Layout bool) *testServer {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testUsers()))
+	dc, err := disk_cache.NewDiskCache(te, &disk_cache.Options{RootDirectory: testfs.MakeTempDir(t), UseV2Layout: useV2Layout}, maxSizeBytes)
+	require.NoError(t, err)
+	dc.WaitUntilMapped()
+	te.SetCache(dc)
+
+	_, runFunc, lis := testenv.RegisterLocalGRPCServer(t, te)
+	testcache.Setup(t, te, lis)
+	cspb.RegisterCacheSnapshotServiceServer(te.GetGRPCServer(), cache_snapshot_server.NewCacheSnapshotServer(te, dc))
+	go runFunc()
+
+	conn, err := testenv.LocalGRPCConn(context.Background(), lis)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &testServer{env: te, cache: dc, conn: conn}
+}
+
+func apiKeyContext(apiKey string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "x-buildbuddy-api-key", apiKey)
+}
+
+type entry struct {
+	groupID string
+	rn      *rspb.ResourceName
+	data    []byte
+}
+
+func (s *testServer) groupContext(t *testing.T, groupID string) context.Context {
+	ctx := claims.AuthContextWithJWT(context.Background(), &claims.Claims{GroupID: groupID, AllowedGroups: []string{groupID}}, nil)
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, s.env.GetAuthenticator())
+	require.NoError(t, err)
+	return ctx
+}
+
+// writeEntries writes an AC entry, an uncompressed CAS entry and a zstd
+// compressed CAS entry for each group to the server's cache.
+func (s *testServer) writeEntries(t *testing.T, groupIDs ...string) []*entry {
+	var entries []*entry
+	for _, g := range groupIDs {
+		ctx := s.groupContext(t, g)
+		ac, _ := testdigest.RandomACResourceBuf(t, 100)
+		acData, err := proto.Marshal(&repb.ActionResult{ExitCode: 7, StdoutRaw: []byte(g)})
+		require.NoError(t, err)
+		cas, casData := testdigest.RandomCASResourceBuf(t, 1000)
+		zstdCAS, zstdData := testdigest.RandomCompressibleCASResourceBuf(t, 300_000, "")
+		require.NoError(t, s.cache.Set(ctx, ac, acData))
+		require.NoError(t, s.cache.Set(ctx, cas, casData))
+		zstdCAS.Compressor = repb.Compressor_ZSTD
+		require.NoError(t, s.cache.Set(ctx, zstdCAS, compression.CompressZstd(nil, zstdData)))
+		entries = append(entries, &entry{g, ac, acData}, &entry{g, cas, casData}, &entry{g, zstdCAS, zstdData})
+	}
+	return entries
+}
+
+func (s *testServer) requireContains(t *testing.T, e *entry) {
+	rn := proto.Clone(e.rn).(*rspb.ResourceName)
+	rn.Compressor = repb.Compressor_IDENTITY
+	data, err := s.cache.Get(s.groupContext(t, e.groupID), rn)
+	require.NoError(t, err)
+	if rn.GetCacheType() == rspb.CacheType_AC {
+		expected := &repb.ActionResult{}
+		require.NoError(t, proto.Unmarshal(e.data, expected))
+		actual := &repb.ActionResult{}
+		require.NoError(t, proto.Unmarshal(data, actual))
+		require.Equal(t, expected.GetExitCode(), actual.GetExitCode())
+		require.Equal(t, expected.GetStdoutRaw(), actual.GetStdoutRaw())
+		return
+	}
+	require.Equal(t, e.data, data)
+}
+
+func (s *testServer) requireMissing(t *testing.T, e *entry) {
+	exists, err := s.cache.Contains(s.groupContext(t, e.groupID), e.rn)
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func export(t *testing.T, s *testServer, apiKey string) []byte {
+	buf := &bytes.Buffer{}
+	_, err := cache_snapshot.Export(apiKeyContext(apiKey), s.conn, buf, &cache_snapshot.ExportOptions{})
+	require.NoError(t, err)
+	return buf.Bytes()
+}
+
+func TestExportImport(t *testing.T) {
+	for _, test := range []struct {
+		name             string
+		destUsesV2Layout bool
+	}{
+		{name: "CompressedDestination", destUsesV2Layout: true},
+		{name: "UncompressedDestination", destUsesV2Layout: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			src := runServer(t, true /*=useV2Layout*/)
+			gr1Entries := src.writeEntries(t, "GR1")
+			gr2Entries := src.writeEntries(t, "GR2")
+
+			// Only the entries of the API key's group are exported.
+			snapshot := export(t, src, "US1")
+
+			dest := runServer(t, test.destUsesV2Layout)
+			stats, err := cache_snapshot.Import(apiKeyContext("US1"), dest.conn, bytes.NewReader(snapshot), &cache_snapshot.ImportOptions{})
+			require.NoError(t, err)
+			require.Equal(t, int64(len(gr1Entries)), stats.Entries)
+			require.Equal(t, int64(0), stats.Skipped)
+			for _, e := range gr1Entries {
+				dest.requireContains(t, e)
+			}
+			for _, e := range gr2Entries {
+				dest.requireMissing(t, e)
+			}
+
+			// Importing again skips the blobs that were already imported.
+			// Action results are always rewritten.
+			stats, err = cache_snapshot.Import(apiKeyContext("US1"), dest.conn, bytes.NewReader(snapshot), &cache_snapshot.ImportOptions{})
+			require.NoError(t, err)
+			require.Equal(t, int64(1), stats.Entries)
+			require.Equal(t, int64(len(gr1Entries)-1), stats.Skipped)
+		})
+	}
+}
+
+func TestExport_RequiresOrgAdmin(t *testing.T) {
+	src := runServer(t, true /*=useV2Layout*/)
+	src.writeEntries(t, "GR1")
+
+	_, err := cache_snapshot.Export(apiKeyContext("US3"), src.conn, &bytes.Buffer{}, &cache_snapshot.ExportOptions{})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+	_, err = cache_snapshot.Export(context.Background(), src.conn, &bytes.Buffer{}, &cache_snapshot.ExportOptions{})
+	require.Error(t, err)
+}
+
+func TestImport_Resume(t *testing.T) {
+	src := runServer(t, true /*=useV2Layout*/)
+	entries := src.writeEntries(t, "GR1", "GR1")
+	snapshot := export(t, src, "US1")
+
+	// Interrupt the import after a couple of entries.
+	dest := runServer(t, true /*=useV2Layout*/)
+	var offsets []int64
+	_, err := cache_snapshot.Import(apiKeyContext("US1"), dest.conn, bytes.NewReader(snapshot), &cache_snapshot.ImportOptions{
+		CheckpointInterval: 1,
+		Checkpoint: func(offset int64) error {
+			offsets = append(offsets, offset)
+			if len(offsets) == 2 {
+				return status.CanceledError("interrupted")
+			}
+			return nil
+		},
+	})
+	require.True(t, status.IsCanceledError(err), "expected Canceled, got %v", err)
+
+	stats, err := cache_snapshot.Import(apiKeyContext("US1"), dest.conn, bytes.NewReader(snapshot), &cache_snapshot.ImportOptions{
+		StartOffset: offsets[1],
+		Checkpoint: func(offset int64) error {
+			offsets = append(offsets, offset)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(entries)-2), stats.Entries)
+	require.Equal(t, int64(0), stats.Skipped)
+	require.Equal(t, int64(len(snapshot)), offsets[len(offsets)-1])
+	for _, e := range entries {
+		dest.requireContains(t, e)
+	}
+}
+
+func TestImport_RateLimited(t *testing.T) {
+	src := runServer(t, true /*=useV2Layout*/)
+	entries := src.writeEntries(t, "GR1")
+	snapshot := export(t, src, "US1")
+
+	dest := runServer(t, true /*=useV2Layout*/)
+	stats, err := cache_snapshot.Import(apiKeyContext("US1"), dest.conn, bytes.NewReader(snapshot), &cache_snapshot.ImportOptions{
+		BytesPerSecond:   100_000_000,
+		EntriesPerSecond: 1000,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(entries)), stats.Entries)
+	for _, e := range entries {
+		dest.requireContains(t, e)
+	}
+}
+
+func TestImport_InvalidSnapshot(t *testing.T) {
+	dest := runServer(t, true /*=useV2Layout*/)
+	_, err := cache_snapshot.Import(apiKeyContext("US1"), dest.conn, bytes.NewReader([]byte("not a snapshot")), &cache_snapshot.ImportOptions{})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+
+	// A truncated snapshot fails at the truncated entry.
+	src := runServer(t, true /*=useV2Layout*/)
+	src.writeEntries(t, "GR1")
+	snapshot := export(t, src, "US1")
+	_, err = cache_snapshot.Import(apiKeyContext("US1"), dest.conn, bytes.NewReader(snapshot[:len(snapshot)-10]), &cache_snapshot.ImportOptions{})
+	require.Error(t, err)
+}
@@ -0,0 +1,75 @@
+package cache_snapshot_server
+
+import (
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+
+	cspb "github.com/buildbuddy-io/buildbuddy/proto/cache_snapshot"
+)
+
+// listBatchSize is the maximum number of entries sent in each ListEntries
+// response.
+const listBatchSize = 1000
+
+type CacheSnapshotServer struct {
+	env    environment.Env
+	lister interfaces.CacheLister
+}
+
+func Register(env *real_environment.RealEnv) error {
+	// OPTIONAL API -- only enable if the cache can enumerate its entries.
+	lister, ok := env.GetCache().(interfaces.CacheLister)
+	if !ok {
+		return nil
+	}
+	env.SetCacheSnapshotServiceServer(NewCacheSnapshotServer(env, lister))
+	return nil
+}
+
+func NewCacheSnapshotServer(env environment.Env, lister interfaces.CacheLister) *CacheSnapshotServer {
+	return &CacheSnapshotServer{
+		env:    env,
+		lister: lister,
+	}
+}
+
+// ListEntries streams the entries owned by the authenticated group. Listing
+// enumerates the group's whole cache, so it requires an org admin.
+func (s *CacheSnapshotServer) ListEntries(req *cspb.ListEntriesRequest, stream cspb.CacheSnapshotService_ListEntriesServer) error {
+	ctx := stream.Context()
+	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return err
+	}
+	groupID := u.GetGroupID()
+	if err := authutil.AuthorizeOrgAdmin(u, groupID); err != nil {
+		return err
+	}
+
+	var entries []*cspb.Entry
+	err = s.lister.ListEntries(ctx, req.GetPartitionIds(), func(info *interfaces.CacheEntryInfo) error {
+		if info.GroupID != groupID {
+			return nil
+		}
+		entries = append(entries, &cspb.Entry{
+			Resource:    info.Resource,
+			GroupId:     info.GroupID,
+			PartitionId: info.PartitionID,
+		})
+		if len(entries) < listBatchSize {
+			return nil
+		}
+		err := stream.Send(&cspb.ListEntriesResponse{Entries: entries})
+		entries = nil
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return stream.Send(&cspb.ListEntriesResponse{Entries: entries})
+}
@@ -399,6 +399,16 @@ func (f *fakeCasClient) FindMissingBlobs(ctx context.Context, in *repb.FindMissi
 	panic("unimplemented")
 }
 
+// SplitBlob implements remote_execution.ContentAddressableStorageClient.
+func (f *fakeCasClient) SplitBlob(ctx context.Context, in *repb.SplitBlobRequest, opts ...grpc.CallOption) (*repb.SplitBlobResponse, error) {
+	panic("unimplemented")
+}
+
+// SpliceBlob implements remote_execution.ContentAddressableStorageClient.
+func (f *fakeCasClient) SpliceBlob(ctx context.Context, in *repb.SpliceBlobRequest, opts ...grpc.CallOption) (*repb.SpliceBlobResponse, error) {
+	panic("unimplemented")
+}
+
 // GetTree implements remote_execution.ContentAddressableStorageClient.
 func (f *fakeCasClient) GetTree(ctx context.Context, in *repb.GetTreeRequest, opts ...grpc.CallOption) (repb.ContentAddressableStorage_GetTreeClient, error) {
 	if f.treeDigest.GetHash() != in.GetRootDigest().GetHash() || f.treeDigest.GetSizeBytes() != in.GetRootDigest().GetSizeBytes() {
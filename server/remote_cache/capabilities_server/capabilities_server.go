@@ -60,7 +60,15 @@ func (s *CapabilitiesServer) GetCapabilities(ctx context.Context, req *repb.GetC
 	}
 	var compressors []repb.Compressor_Value
 	if s.supportZstd {
-		compressors = []repb.Compressor_Value{repb.Compressor_IDENTITY, repb.Compressor_ZSTD}
+		compressors = append(compressors, repb.Compressor_ZSTD)
+	}
+	for _, c := range []repb.Compressor_Value{repb.Compressor_DEFLATE, repb.Compressor_BROTLI} {
+		if remote_cache_config.TranscodingEnabled(c) {
+			compressors = append(compressors, c)
+		}
+	}
+	if len(compressors) > 0 {
+		compressors = append([]repb.Compressor_Value{repb.Compressor_IDENTITY}, compressors...)
 	}
 	if s.supportCAS {
 		c.CacheCapabilities = &repb.CacheCapabilities{
@@ -80,6 +88,8 @@ func (s *CapabilitiesServer) GetCapabilities(ctx context.Context, req *repb.GetC
 			SymlinkAbsolutePathStrategy:     repb.SymlinkAbsolutePathStrategy_ALLOWED,
 			SupportedCompressors:            compressors,
 			SupportedBatchUpdateCompressors: compressors,
+			SplitBlobSupport:                remote_cache_config.SplitSpliceEnabled(),
+			SpliceBlobSupport:               remote_cache_config.SplitSpliceEnabled(),
 		}
 	}
 	if s.supportRemoteExec {
@@ -1,9 +1,67 @@
 package config
 
-import "flag"
+import (
+	"flag"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
 
 var zstdTranscodingEnabled = flag.Bool("cache.zstd_transcoding_enabled", true, "Whether to accept requests to read/write zstd-compressed blobs, compressing/decompressing outgoing/incoming blobs on the fly.")
+var deflateTranscodingEnabled = flag.Bool("cache.deflate_transcoding_enabled", true, "Whether to accept requests to read/write deflate-compressed blobs, compressing/decompressing outgoing/incoming blobs on the fly.")
+var brotliTranscodingEnabled = flag.Bool("cache.brotli_transcoding_enabled", true, "Whether to accept requests to read/write brotli-compressed blobs, compressing/decompressing outgoing/incoming blobs on the fly.")
 
 func ZstdTranscodingEnabled() bool {
 	return *zstdTranscodingEnabled
 }
+
+// TranscodingEnabled returns whether requests to read/write blobs using the
+// given compressor should be accepted. IDENTITY is always accepted.
+func TranscodingEnabled(compressor repb.Compressor_Value) bool {
+	switch compressor {
+	case repb.Compressor_IDENTITY:
+		return true
+	case repb.Compressor_ZSTD:
+		return *zstdTranscodingEnabled
+	case repb.Compressor_DEFLATE:
+		return *deflateTranscodingEnabled
+	case repb.Compressor_BROTLI:
+		return *brotliTranscodingEnabled
+	default:
+		return false
+	}
+}
+
+const (
+	// The range of average chunk sizes supported by the chunker.
+	minSplitBlobAverageChunkSizeBytes = 256
+	maxSplitBlobAverageChunkSizeBytes = 256 * 1024 * 1024
+)
+
+var splitBlobAverageChunkSizeBytes = flag.Int("cache.split_blob_average_chunk_size_bytes", 0, "If set, enable the SplitBlob and SpliceBlob CAS APIs, splitting blobs into content-defined chunks of this average size. Must be in the range 256B to 256MB. Disabled if 0.")
+
+// SplitSpliceEnabled returns whether the SplitBlob and SpliceBlob CAS APIs
+// are enabled.
+func SplitSpliceEnabled() bool {
+	return *splitBlobAverageChunkSizeBytes > 0
+}
+
+// SplitBlobAverageChunkSizeBytes returns the average chunk size that SplitBlob
+// aims for.
+func SplitBlobAverageChunkSizeBytes() int {
+	return *splitBlobAverageChunkSizeBytes
+}
+
+// ValidateSplitBlobAverageChunkSize returns an error if SplitBlob is enabled
+// with an average chunk size that the chunker doesn't support.
+func ValidateSplitBlobAverageChunkSize() error {
+	size := *splitBlobAverageChunkSizeBytes
+	if size == 0 {
+		return nil
+	}
+	if size < minSplitBlobAverageChunkSizeBytes || size > maxSplitBlobAverageChunkSizeBytes {
+		return status.InvalidArgumentErrorf("cache.split_blob_average_chunk_size_bytes must be in the range %d to %d, got %d", minSplitBlobAverageChunkSizeBytes, maxSplitBlobAverageChunkSizeBytes, size)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"slices"
@@ -21,6 +22,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/background"
 	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
 	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
+	"github.com/buildbuddy-io/buildbuddy/server/util/chunker"
 	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
 	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
 	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_server"
@@ -89,6 +91,9 @@ func NewContentAddressableStorageServer(env environment.Env) (*ContentAddressabl
 	if cache == nil {
 		return nil, fmt.Errorf("A cache is required to enable the ContentAddressableStorageServer")
 	}
+	if err := remote_cache_config.ValidateSplitBlobAverageChunkSize(); err != nil {
+		return nil, err
+	}
 	return &ContentAddressableStorageServer{
 		env:   env,
 		cache: cache,
@@ -211,8 +216,8 @@ func (s *ContentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context,
 			return nil, err
 		}
 		decompressedData := uploadRequest.GetData()
-		if uploadRequest.Compressor == repb.Compressor_ZSTD {
-			decompressedData, err = zstdDecompress(uploadRequest.GetData(), uploadRequest.GetDigest().GetSizeBytes())
+		if uploadRequest.Compressor != repb.Compressor_IDENTITY {
+			decompressedData, err = decompress(uploadRequest.Compressor, uploadRequest.GetData(), uploadRequest.GetDigest().GetSizeBytes())
 			if err != nil {
 				rsp.Responses = append(rsp.Responses, &repb.BatchUpdateBlobsResponse_Response{
 					Digest: rn.GetDigest(),
@@ -303,8 +308,8 @@ func (s *ContentAddressableStorageServer) BatchReadBlobs(ctx context.Context, re
 
 	cacheRequest := make([]*rspb.ResourceName, 0, len(req.Digests))
 	rsp.Responses = make([]*repb.BatchReadBlobsResponse_Response, 0, len(req.Digests))
-	clientAcceptsZstd := remote_cache_config.ZstdTranscodingEnabled() && clientAcceptsCompressor(req.AcceptableCompressors, repb.Compressor_ZSTD)
-	readZstd := clientAcceptsZstd && s.cache.SupportsCompressor(repb.Compressor_ZSTD)
+	readCompressor := s.batchReadCompressor(req.AcceptableCompressors)
+	readCompressed := readCompressor != repb.Compressor_IDENTITY && s.cache.SupportsCompressor(readCompressor)
 
 	requestedResources := make([]*digest.ResourceName, 0, len(req.GetDigests()))
 	for _, readDigest := range req.GetDigests() {
@@ -321,8 +326,8 @@ func (s *ContentAddressableStorageServer) BatchReadBlobs(ctx context.Context, re
 					log.Debugf("BatchReadBlobs: download tracker CloseWithBytesTransferred error: %s", err)
 				}
 			})
-			if readZstd {
-				rn.SetCompressor(repb.Compressor_ZSTD)
+			if readCompressed {
+				rn.SetCompressor(readCompressor)
 			}
 			cacheRequest = append(cacheRequest, rn.ToProto())
 		}
@@ -343,15 +348,13 @@ func (s *ContentAddressableStorageServer) BatchReadBlobs(ctx context.Context, re
 			Digest: rn.GetDigest(),
 			Data:   data,
 		}
-		if clientAcceptsZstd {
-			blobRsp.Compressor = repb.Compressor_ZSTD
-		}
+		blobRsp.Compressor = readCompressor
 		bytesFromCache := len(data)
 		bytesToClient := len(data)
 
 		if !ok || os.IsNotExist(err) {
 			blobRsp.Status = &statuspb.Status{Code: int32(codes.NotFound)}
-		} else if rn.GetDigest().GetSizeBytes() != int64(len(data)) && !readZstd {
+		} else if rn.GetDigest().GetSizeBytes() != int64(len(data)) && !readCompressed {
 			// We only expect the data length to be different from the digest if we read compressed data.
 			// If we weren't reading compressed data, consider the data corrupted and return that it is not found
 			blobRsp.Status = &statuspb.Status{Code: int32(codes.NotFound)}
@@ -360,10 +363,13 @@ func (s *ContentAddressableStorageServer) BatchReadBlobs(ctx context.Context, re
 		} else {
 			blobRsp.Status = &statuspb.Status{Code: int32(codes.OK)}
 
-			// If the cache doesn't support zstd compression but the client will accept it, compress data before sending
-			if clientAcceptsZstd && !s.cache.SupportsCompressor(repb.Compressor_ZSTD) {
-				blobRsp.Data = compression.CompressZstd(nil, blobRsp.Data)
-				blobRsp.Compressor = repb.Compressor_ZSTD
+			// If the cache doesn't support the compressor but the client will accept it, compress data before sending
+			if readCompressor != repb.Compressor_IDENTITY && !readCompressed {
+				compressed, err := compression.CompressBytes(readCompressor, blobRsp.Data)
+				if err != nil {
+					return nil, err
+				}
+				blobRsp.Data = compressed
 				bytesToClient = len(blobRsp.Data)
 			}
 		}
@@ -383,9 +389,274 @@ func (s *ContentAddressableStorageServer) BatchReadBlobs(ctx context.Context, re
 	return rsp, nil
 }
 
+// Split a blob into chunks.
+//
+// The blob is split with content-defined chunking, so that blobs that differ
+// only in a small region share most of their chunks. The chunks are stored in
+// the CAS, and their digests are returned in order.
+//
+// Errors:
+//
+// * `NOT_FOUND`: The requested blob is not present in the CAS.
+// * `UNIMPLEMENTED`: Blob splitting is not enabled on this server.
+func (s *ContentAddressableStorageServer) SplitBlob(ctx context.Context, req *repb.SplitBlobRequest) (*repb.SplitBlobResponse, error) {
+	if !remote_cache_config.SplitSpliceEnabled() {
+		return nil, status.UnimplementedError("SplitBlob is not enabled")
+	}
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, s.env.GetAuthenticator())
+	if err != nil {
+		return nil, err
+	}
+	rn := digest.NewCASResourceName(req.GetBlobDigest(), req.GetInstanceName(), req.GetDigestFunction())
+	if err := rn.Validate(); err != nil {
+		return nil, err
+	}
+	rsp := &repb.SplitBlobResponse{DigestFunction: rn.GetDigestFunction()}
+	if rn.IsEmpty() {
+		return rsp, nil
+	}
+
+	// The returned chunks must be present in the CAS, so splitting a blob
+	// writes them, which read-only and anonymous callers may not do.
+	canWrite, err := capabilities.IsGranted(ctx, s.env.GetAuthenticator(), cappb.Capability_CACHE_WRITE|cappb.Capability_CAS_WRITE)
+	if err != nil {
+		return nil, err
+	}
+	if !canWrite {
+		return nil, status.PermissionDeniedError("SplitBlob stores chunks in the CAS and requires cache write permission")
+	}
+
+	reader, err := s.cache.Reader(ctx, rn.ToProto(), 0, 0)
+	if err != nil {
+		if status.IsNotFoundError(err) {
+			return nil, status.NotFoundErrorf("blob %s not found", digest.String(rn.GetDigest()))
+		}
+		return nil, err
+	}
+	defer reader.Close()
+
+	uploader := &chunkUploader{
+		ctx:            ctx,
+		cache:          s.cache,
+		instanceName:   req.GetInstanceName(),
+		digestFunction: rn.GetDigestFunction(),
+	}
+	c, err := chunker.New(ctx, remote_cache_config.SplitBlobAverageChunkSizeBytes(), func(chunk []byte) error {
+		d, err := uploader.add(chunk)
+		if err != nil {
+			return err
+		}
+		rsp.ChunkDigests = append(rsp.ChunkDigests, d)
+		return nil
+	})
+	if err != nil {
+		return nil, status.InternalErrorf("create chunker: %s", err)
+	}
+	if _, err := io.Copy(c, reader); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := c.Close(); err != nil {
+		return nil, err
+	}
+	if err := uploader.flush(); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// Splice a blob from chunks.
+//
+// The chunks are concatenated in the given order, and the result is stored in
+// the CAS if its digest matches the expected blob digest.
+//
+// Errors:
+//
+// * `NOT_FOUND`: At least one of the blob chunks is not present in the CAS.
+// * `INVALID_ARGUMENT`: The digest of the spliced blob is different from the
+// provided expected digest.
+// * `UNIMPLEMENTED`: Blob splicing is not enabled on this server.
+func (s *ContentAddressableStorageServer) SpliceBlob(ctx context.Context, req *repb.SpliceBlobRequest) (*repb.SpliceBlobResponse, error) {
+	if !remote_cache_config.SplitSpliceEnabled() {
+		return nil, status.UnimplementedError("SpliceBlob is not enabled")
+	}
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, s.env.GetAuthenticator())
+	if err != nil {
+		return nil, err
+	}
+	rn := digest.NewCASResourceName(req.GetBlobDigest(), req.GetInstanceName(), req.GetDigestFunction())
+	if err := rn.Validate(); err != nil {
+		return nil, err
+	}
+	rsp := &repb.SpliceBlobResponse{BlobDigest: rn.GetDigest()}
+
+	chunks := make([]*rspb.ResourceName, 0, len(req.GetChunkDigests()))
+	totalSize := int64(0)
+	for _, d := range req.GetChunkDigests() {
+		chunkRN := digest.NewCASResourceName(d, req.GetInstanceName(), rn.GetDigestFunction())
+		if err := chunkRN.Validate(); err != nil {
+			return nil, err
+		}
+		totalSize += d.GetSizeBytes()
+		if chunkRN.IsEmpty() {
+			continue
+		}
+		chunks = append(chunks, chunkRN.ToProto())
+	}
+	if totalSize != rn.GetDigest().GetSizeBytes() {
+		return nil, status.InvalidArgumentErrorf("chunk sizes add up to %d bytes, but the blob is %d bytes", totalSize, rn.GetDigest().GetSizeBytes())
+	}
+
+	canWrite, err := capabilities.IsGranted(ctx, s.env.GetAuthenticator(), cappb.Capability_CACHE_WRITE|cappb.Capability_CAS_WRITE)
+	if err != nil {
+		return nil, err
+	}
+	if !canWrite || rn.IsEmpty() {
+		// For read-only API keys, pretend the write succeeded, as
+		// BatchUpdateBlobs does.
+		return rsp, nil
+	}
+
+	missing, err := s.cache.FindMissing(ctx, append(chunks, rn.ToProto()))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range missing {
+		if d.GetHash() != rn.GetDigest().GetHash() {
+			return nil, status.NotFoundErrorf("chunk %s not found", digest.String(d))
+		}
+	}
+	if len(missing) == 0 {
+		// The blob is already present; no need to splice it again.
+		return rsp, nil
+	}
+
+	w, err := s.cache.Writer(ctx, rn.ToProto())
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	h, err := digest.HashForDigestType(rn.GetDigestFunction())
+	if err != nil {
+		return nil, err
+	}
+	mw := io.MultiWriter(w, h)
+	for _, chunk := range chunks {
+		if err := s.copyChunk(ctx, mw, chunk); err != nil {
+			return nil, err
+		}
+	}
+	if computed := fmt.Sprintf("%x", h.Sum(nil)); computed != rn.GetDigest().GetHash() {
+		return nil, status.InvalidArgumentErrorf("spliced blob hash %q does not match expected hash %q", computed, rn.GetDigest().GetHash())
+	}
+	if err := w.Commit(); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+func (s *ContentAddressableStorageServer) copyChunk(ctx context.Context, w io.Writer, chunk *rspb.ResourceName) error {
+	r, err := s.cache.Reader(ctx, chunk, 0, 0)
+	if err != nil {
+		if status.IsNotFoundError(err) {
+			return status.NotFoundErrorf("chunk %s not found", digest.String(chunk.GetDigest()))
+		}
+		return err
+	}
+	defer r.Close()
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if n != chunk.GetDigest().GetSizeBytes() {
+		return status.DataLossErrorf("chunk %s: read %d bytes", digest.String(chunk.GetDigest()), n)
+	}
+	return nil
+}
+
+// chunkUploaderBatchSizeBytes is the approximate number of chunk bytes that
+// chunkUploader buffers before writing them to the cache.
+const chunkUploaderBatchSizeBytes = 4 * 1024 * 1024
+
+// chunkUploader writes the chunks produced by SplitBlob to the cache in
+// batches, skipping chunks that are already present.
+type chunkUploader struct {
+	ctx            context.Context
+	cache          interfaces.Cache
+	instanceName   string
+	digestFunction repb.DigestFunction_Value
+
+	pending      map[*rspb.ResourceName][]byte
+	pendingBytes int
+}
+
+func (u *chunkUploader) add(chunk []byte) (*repb.Digest, error) {
+	d, err := digest.Compute(bytes.NewReader(chunk), u.digestFunction)
+	if err != nil {
+		return nil, err
+	}
+	if u.pending == nil {
+		u.pending = make(map[*rspb.ResourceName][]byte)
+	}
+	// The chunker reuses its buffer, so the chunk must be copied.
+	rn := digest.NewCASResourceName(d, u.instanceName, u.digestFunction)
+	u.pending[rn.ToProto()] = slices.Clone(chunk)
+	u.pendingBytes += len(chunk)
+	if u.pendingBytes >= chunkUploaderBatchSizeBytes {
+		if err := u.flush(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (u *chunkUploader) flush() error {
+	if len(u.pending) == 0 {
+		return nil
+	}
+	rns := make([]*rspb.ResourceName, 0, len(u.pending))
+	for rn := range u.pending {
+		rns = append(rns, rn)
+	}
+	missing, err := u.cache.FindMissing(u.ctx, rns)
+	if err != nil {
+		return err
+	}
+	isMissing := make(map[string]bool, len(missing))
+	for _, d := range missing {
+		isMissing[d.GetHash()] = true
+	}
+	kvs := make(map[*rspb.ResourceName][]byte, len(missing))
+	for rn, data := range u.pending {
+		if isMissing[rn.GetDigest().GetHash()] {
+			kvs[rn] = data
+		}
+	}
+	u.pending = nil
+	u.pendingBytes = 0
+	if len(kvs) == 0 {
+		return nil
+	}
+	return u.cache.SetMulti(u.ctx, kvs)
+}
+
 func (s *ContentAddressableStorageServer) supportsCompressor(compressor repb.Compressor_Value) bool {
-	return compressor == repb.Compressor_IDENTITY ||
-		compressor == repb.Compressor_ZSTD && remote_cache_config.ZstdTranscodingEnabled()
+	return remote_cache_config.TranscodingEnabled(compressor)
+}
+
+// batchReadCompressor returns the compressor to use for BatchReadBlobs
+// responses. ZSTD is preferred if the client accepts it; otherwise the first
+// supported compressor in the client's list is used, falling back to IDENTITY.
+func (s *ContentAddressableStorageServer) batchReadCompressor(acceptableCompressors []repb.Compressor_Value) repb.Compressor_Value {
+	if s.supportsCompressor(repb.Compressor_ZSTD) && clientAcceptsCompressor(acceptableCompressors, repb.Compressor_ZSTD) {
+		return repb.Compressor_ZSTD
+	}
+	for _, c := range acceptableCompressors {
+		if c != repb.Compressor_IDENTITY && s.supportsCompressor(c) {
+			return c
+		}
+	}
+	return repb.Compressor_IDENTITY
 }
 
 func clientAcceptsCompressor(acceptableCompressors []repb.Compressor_Value, compressor repb.Compressor_Value) bool {
@@ -401,11 +672,22 @@ func clientAcceptsCompressor(acceptableCompressors []repb.Compressor_Value, comp
 	return false
 }
 
-func zstdDecompress(data []byte, decompressedLength int64) ([]byte, error) {
-	buf := make([]byte, decompressedLength)
-	out, err := compression.DecompressZstd(buf, data)
-	if err != nil {
-		return nil, status.InternalErrorf("Failed to decompress zstd-compressed blob: %s", err)
+func decompress(compressor repb.Compressor_Value, data []byte, decompressedLength int64) ([]byte, error) {
+	if compressor == repb.Compressor_ZSTD {
+		buf := make([]byte, decompressedLength)
+		out, err := compression.DecompressZstd(buf, data)
+		if err != nil {
+			return nil, status.InternalErrorf("Failed to decompress zstd-compressed blob: %s", err)
+		}
+		return out, nil
+	}
+	// Read at most one byte past the digest size so that a small payload
+	// can't expand into an arbitrarily large buffer.
+	out, err := compression.DecompressBytesWithLimit(compressor, data, decompressedLength)
+	if status.IsInvalidArgumentError(err) {
+		return nil, status.InvalidArgumentErrorf("%s-compressed blob is larger than its digest size %d", strings.ToLower(compressor.String()), decompressedLength)
+	} else if err != nil {
+		return nil, status.InternalErrorf("Failed to decompress %s-compressed blob: %s", strings.ToLower(compressor.String()), err)
 	}
 	return out, nil
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"slices"
 	"testing"
 	"time"
 
@@ -17,6 +18,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/hit_tracker"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/cas"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testcompression"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
@@ -209,6 +211,105 @@ func TestBatchUpdateAndReadCompressedBlobs(t *testing.T) {
 	require.Equal(t, [][]byte{blob}, blobs)
 }
 
+func TestBatchUpdateAndReadOtherCompressors(t *testing.T) {
+	for _, compressor := range []repb.Compressor_Value{repb.Compressor_DEFLATE, repb.Compressor_BROTLI} {
+		t.Run(compressor.String(), func(t *testing.T) {
+			ctx := context.Background()
+			te := testenv.GetTestEnv(t)
+			clientConn := runCASServer(ctx, t, te)
+			casClient := repb.NewContentAddressableStorageClient(clientConn)
+
+			blob := []byte("AAAAAAAAAAAAAAAAAAAAAAAAA")
+			compressedBlob, err := compression.CompressBytes(compressor, blob)
+			require.NoError(t, err)
+			d, err := digest.Compute(bytes.NewReader(blob), repb.DigestFunction_SHA256)
+			require.NoError(t, err)
+
+			batchUpdateResp, err := casClient.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+				Requests: []*repb.BatchUpdateBlobsRequest_Request{
+					{Digest: d, Data: compressedBlob, Compressor: compressor},
+				},
+			})
+			require.NoError(t, err)
+			for i, resp := range batchUpdateResp.Responses {
+				require.Equal(t, int32(gcodes.OK), resp.Status.Code, "BatchUpdateResponse[%d].Status != OK", i)
+			}
+
+			// ZSTD is not acceptable, so the other compressor is used.
+			readResp, err := casClient.BatchReadBlobs(ctx, &repb.BatchReadBlobsRequest{
+				Digests:               []*repb.Digest{d},
+				AcceptableCompressors: []repb.Compressor_Value{repb.Compressor_IDENTITY, compressor},
+			})
+			require.NoError(t, err)
+			require.Len(t, readResp.Responses, 1)
+			resp := readResp.Responses[0]
+			require.Equal(t, int32(gcodes.OK), resp.Status.Code)
+			require.Equal(t, compressor, resp.GetCompressor())
+			decompressed, err := compression.DecompressBytes(compressor, resp.GetData())
+			require.NoError(t, err)
+			require.Equal(t, blob, decompressed)
+
+			// ZSTD is preferred when the client accepts it.
+			readResp, err = casClient.BatchReadBlobs(ctx, &repb.BatchReadBlobsRequest{
+				Digests:               []*repb.Digest{d},
+				AcceptableCompressors: []repb.Compressor_Value{compressor, repb.Compressor_ZSTD},
+			})
+			require.NoError(t, err)
+			require.Len(t, readResp.Responses, 1)
+			require.Equal(t, repb.Compressor_ZSTD, readResp.Responses[0].GetCompressor())
+			require.Equal(t, blob, zstdDecompress(t, readResp.Responses[0].GetData()))
+		})
+	}
+}
+
+func TestBatchUpdateRejectsCorruptDeflateBlobs(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	clientConn := runCASServer(ctx, t, te)
+	casClient := repb.NewContentAddressableStorageClient(clientConn)
+
+	blob := []byte("AAAAAAAAAAAAAAAAAAAAAAAAA")
+	d, err := digest.Compute(bytes.NewReader(blob), repb.DigestFunction_SHA256)
+	require.NoError(t, err)
+	compressedBlob := compression.CompressFlate(blob)
+
+	batchUpdateResp, err := casClient.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+		Requests: []*repb.BatchUpdateBlobsRequest_Request{
+			{Digest: d, Data: compressedBlob[:len(compressedBlob)-1], Compressor: repb.Compressor_DEFLATE},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, batchUpdateResp.Responses, 1)
+	require.NotEqual(t, int32(gcodes.OK), batchUpdateResp.Responses[0].Status.Code)
+}
+
+func TestBatchUpdateRejectsOversizedCompressedBlobs(t *testing.T) {
+	for _, compressor := range []repb.Compressor_Value{repb.Compressor_DEFLATE, repb.Compressor_BROTLI} {
+		t.Run(compressor.String(), func(t *testing.T) {
+			ctx := context.Background()
+			te := testenv.GetTestEnv(t)
+			clientConn := runCASServer(ctx, t, te)
+			casClient := repb.NewContentAddressableStorageClient(clientConn)
+
+			// The payload decompresses to far more than the digest size.
+			blob := []byte("AAAAAAAAAAAAAAAAAAAAAAAAA")
+			d, err := digest.Compute(bytes.NewReader(blob), repb.DigestFunction_SHA256)
+			require.NoError(t, err)
+			compressedBlob, err := compression.CompressBytes(compressor, bytes.Repeat(blob, 100_000))
+			require.NoError(t, err)
+
+			batchUpdateResp, err := casClient.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+				Requests: []*repb.BatchUpdateBlobsRequest_Request{
+					{Digest: d, Data: compressedBlob, Compressor: compressor},
+				},
+			})
+			require.NoError(t, err)
+			require.Len(t, batchUpdateResp.Responses, 1)
+			require.Equal(t, int32(gcodes.InvalidArgument), batchUpdateResp.Responses[0].Status.Code)
+		})
+	}
+}
+
 func TestBatchUpdateRejectsCompressedBlobsIfCompressionDisabled(t *testing.T) {
 	ctx := context.Background()
 	te := testenv.GetTestEnv(t)
@@ -832,3 +933,167 @@ func TestGetTreeMissingRoot(t *testing.T) {
 	require.Error(t, err)
 	require.True(t, hasMissingDigestError(err))
 }
+
+func uploadBlob(ctx context.Context, t *testing.T, casClient repb.ContentAddressableStorageClient, buf []byte) *repb.Digest {
+	d, err := digest.Compute(bytes.NewReader(buf), repb.DigestFunction_SHA256)
+	require.NoError(t, err)
+	rsp, err := casClient.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+		Requests: []*repb.BatchUpdateBlobsRequest_Request{{Digest: d, Data: buf}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(gcodes.OK), rsp.GetResponses()[0].GetStatus().GetCode())
+	return d
+}
+
+func readBlobs(ctx context.Context, t *testing.T, casClient repb.ContentAddressableStorageClient, digests []*repb.Digest) [][]byte {
+	rsp, err := casClient.BatchReadBlobs(ctx, &repb.BatchReadBlobsRequest{Digests: digests})
+	require.NoError(t, err)
+	blobs := make([][]byte, 0, len(digests))
+	for _, r := range rsp.GetResponses() {
+		require.Equal(t, int32(gcodes.OK), r.GetStatus().GetCode(), "read %s", digest.String(r.GetDigest()))
+		blobs = append(blobs, r.GetData())
+	}
+	return blobs
+}
+
+func TestSplitBlob(t *testing.T) {
+	flags.Set(t, "cache.split_blob_average_chunk_size_bytes", 16*1024)
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te.GetAuthenticator())
+	require.NoError(t, err)
+	clientConn := runCASServer(ctx, t, te)
+	casClient := repb.NewContentAddressableStorageClient(clientConn)
+
+	_, buf := testdigest.RandomCASResourceBuf(t, 1024*1024)
+	d := uploadBlob(ctx, t, casClient, buf)
+
+	rsp, err := casClient.SplitBlob(ctx, &repb.SplitBlobRequest{BlobDigest: d})
+	require.NoError(t, err)
+	require.Equal(t, repb.DigestFunction_SHA256, rsp.GetDigestFunction())
+	require.Greater(t, len(rsp.GetChunkDigests()), 1)
+	chunks := readBlobs(ctx, t, casClient, rsp.GetChunkDigests())
+	assert.Equal(t, buf, bytes.Join(chunks, nil))
+
+	// Changing a single byte in the middle of the blob should leave most of
+	// the chunks unchanged.
+	modified := slices.Clone(buf)
+	modified[len(modified)/2] ^= 0xFF
+	modifiedDigest := uploadBlob(ctx, t, casClient, modified)
+	modifiedRsp, err := casClient.SplitBlob(ctx, &repb.SplitBlobRequest{BlobDigest: modifiedDigest})
+	require.NoError(t, err)
+	original := make(map[string]bool)
+	for _, c := range rsp.GetChunkDigests() {
+		original[c.GetHash()] = true
+	}
+	changed := 0
+	for _, c := range modifiedRsp.GetChunkDigests() {
+		if !original[c.GetHash()] {
+			changed++
+		}
+	}
+	assert.LessOrEqual(t, changed, 2)
+
+	// Splitting the empty blob returns no chunks.
+	rsp, err = casClient.SplitBlob(ctx, &repb.SplitBlobRequest{BlobDigest: &repb.Digest{Hash: digest.EmptySha256}})
+	require.NoError(t, err)
+	assert.Empty(t, rsp.GetChunkDigests())
+
+	missing, _ := testdigest.RandomCASResourceBuf(t, 100)
+	_, err = casClient.SplitBlob(ctx, &repb.SplitBlobRequest{BlobDigest: missing.GetDigest()})
+	assert.Equal(t, gcodes.NotFound, gstatus.Code(err), "expected NotFound, got %v", err)
+}
+
+func TestSplitBlob_ReadOnly(t *testing.T) {
+	flags.Set(t, "cache.split_blob_average_chunk_size_bytes", 16*1024)
+	te := testenv.GetTestEnv(t)
+	users := testauth.TestUsers("US1", "GR1", "RO1", "GR1")
+	readOnly := users["RO1"].(*testauth.TestUser)
+	readOnly.Capabilities = nil
+	readOnly.GroupMemberships[0].Capabilities = nil
+	te.SetAuthenticator(testauth.NewTestAuthenticator(users))
+	clientConn := runCASServer(context.Background(), t, te)
+	casClient := repb.NewContentAddressableStorageClient(clientConn)
+
+	writeCtx := te.GetAuthenticator().AuthContextFromAPIKey(context.Background(), "US1")
+	_, buf := testdigest.RandomCASResourceBuf(t, 256*1024)
+	d := uploadBlob(writeCtx, t, casClient, buf)
+
+	readOnlyCtx := te.GetAuthenticator().AuthContextFromAPIKey(context.Background(), "RO1")
+	_, err := casClient.SplitBlob(readOnlyCtx, &repb.SplitBlobRequest{BlobDigest: d})
+	assert.Equal(t, gcodes.PermissionDenied, gstatus.Code(err), "expected PermissionDenied, got %v", err)
+
+	rsp, err := casClient.SplitBlob(writeCtx, &repb.SplitBlobRequest{BlobDigest: d})
+	require.NoError(t, err)
+	assert.NotEmpty(t, rsp.GetChunkDigests())
+}
+
+func TestSpliceBlob(t *testing.T) {
+	flags.Set(t, "cache.split_blob_average_chunk_size_bytes", 16*1024)
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te.GetAuthenticator())
+	require.NoError(t, err)
+	clientConn := runCASServer(ctx, t, te)
+	casClient := repb.NewContentAddressableStorageClient(clientConn)
+
+	_, a := testdigest.RandomCASResourceBuf(t, 1000)
+	_, b := testdigest.RandomCASResourceBuf(t, 2000)
+	aDigest := uploadBlob(ctx, t, casClient, a)
+	bDigest := uploadBlob(ctx, t, casClient, b)
+	blob := append(slices.Clone(a), b...)
+	blobDigest, err := digest.Compute(bytes.NewReader(blob), repb.DigestFunction_SHA256)
+	require.NoError(t, err)
+
+	// Chunks in the wrong order don't match the expected digest.
+	_, err = casClient.SpliceBlob(ctx, &repb.SpliceBlobRequest{
+		BlobDigest:   blobDigest,
+		ChunkDigests: []*repb.Digest{bDigest, aDigest},
+	})
+	assert.Equal(t, gcodes.InvalidArgument, gstatus.Code(err), "expected InvalidArgument, got %v", err)
+
+	// Chunks that don't add up to the blob size are rejected.
+	_, err = casClient.SpliceBlob(ctx, &repb.SpliceBlobRequest{
+		BlobDigest:   blobDigest,
+		ChunkDigests: []*repb.Digest{aDigest},
+	})
+	assert.Equal(t, gcodes.InvalidArgument, gstatus.Code(err), "expected InvalidArgument, got %v", err)
+
+	// Missing chunks are reported as NotFound.
+	missing, _ := testdigest.RandomCASResourceBuf(t, 2000)
+	_, err = casClient.SpliceBlob(ctx, &repb.SpliceBlobRequest{
+		BlobDigest:   blobDigest,
+		ChunkDigests: []*repb.Digest{aDigest, missing.GetDigest()},
+	})
+	assert.Equal(t, gcodes.NotFound, gstatus.Code(err), "expected NotFound, got %v", err)
+
+	rsp, err := casClient.SpliceBlob(ctx, &repb.SpliceBlobRequest{
+		BlobDigest:   blobDigest,
+		ChunkDigests: []*repb.Digest{aDigest, bDigest},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, blobDigest.GetHash(), rsp.GetBlobDigest().GetHash())
+	assert.Equal(t, [][]byte{blob}, readBlobs(ctx, t, casClient, []*repb.Digest{blobDigest}))
+}
+
+func TestSplitBlobAverageChunkSizeOutOfRange(t *testing.T) {
+	for _, size := range []int{-1, 255, 256*1024*1024 + 1} {
+		flags.Set(t, "cache.split_blob_average_chunk_size_bytes", size)
+		te := testenv.GetTestEnv(t)
+		_, err := content_addressable_storage_server.NewContentAddressableStorageServer(te)
+		require.Equal(t, gcodes.InvalidArgument, gstatus.Code(err), "size %d: %v", size, err)
+	}
+}
+
+func TestSplitSpliceDisabled(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te.GetAuthenticator())
+	require.NoError(t, err)
+	clientConn := runCASServer(ctx, t, te)
+	casClient := repb.NewContentAddressableStorageClient(clientConn)
+
+	rn, buf := testdigest.RandomCASResourceBuf(t, 100)
+	d := uploadBlob(ctx, t, casClient, buf)
+	_, err = casClient.SplitBlob(ctx, &repb.SplitBlobRequest{BlobDigest: d})
+	assert.Equal(t, gcodes.Unimplemented, gstatus.Code(err))
+	_, err = casClient.SpliceBlob(ctx, &repb.SpliceBlobRequest{BlobDigest: rn.GetDigest(), ChunkDigests: []*repb.Digest{d}})
+	assert.Equal(t, gcodes.Unimplemented, gstatus.Code(err))
+}
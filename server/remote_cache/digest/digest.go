@@ -525,12 +525,14 @@ func parseResourceName(resourceName string, cacheType rspb.CacheType, resourceTy
 		}
 	}
 
-	// The next piece must be "blobs" or "zstd"
+	// The next piece must be "blobs" or a compressor name such as "zstd"
 	compressor := repb.Compressor_IDENTITY
-	if piece == "zstd" {
-		compressor = repb.Compressor_ZSTD
-	} else if piece != "blobs" {
-		return nil, status.InvalidArgumentErrorf("Unparseable resource name, invalid compressed blob type: %s", resourceName)
+	if piece != "blobs" {
+		c, ok := compressorFromSegment(piece)
+		if !ok {
+			return nil, status.InvalidArgumentErrorf("Unparseable resource name, invalid compressed blob type: %s", resourceName)
+		}
+		compressor = c
 	}
 
 	// If this is a compressed blob, the next piece must be "compressed-blobs"
@@ -604,12 +606,26 @@ func ParseActionCacheResourceName(resourceName string) (*ACResourceName, error)
 }
 
 func blobTypeSegment(compressor repb.Compressor_Value) string {
-	if compressor == repb.Compressor_ZSTD {
-		return "compressed-blobs/zstd"
+	if compressor != repb.Compressor_IDENTITY {
+		return "compressed-blobs/" + strings.ToLower(compressor.String())
 	}
 	return "blobs"
 }
 
+// compressorFromSegment returns the compressor named by the given
+// "compressed-blobs/{compressor}" resource name segment. The segment is the
+// lowercase name of a compressor other than IDENTITY.
+func compressorFromSegment(segment string) (repb.Compressor_Value, bool) {
+	if segment == "" || strings.ToLower(segment) != segment {
+		return repb.Compressor_IDENTITY, false
+	}
+	v, ok := repb.Compressor_Value_value[strings.ToUpper(segment)]
+	if !ok || repb.Compressor_Value(v) == repb.Compressor_IDENTITY {
+		return repb.Compressor_IDENTITY, false
+	}
+	return repb.Compressor_Value(v), true
+}
+
 func IsCacheDebuggingEnabled(ctx context.Context) bool {
 	if hdrs := gmetadata.ValueFromIncomingContext(ctx, "debug-cache-hits"); len(hdrs) > 0 {
 		if strings.ToLower(strings.TrimSpace(hdrs[0])) == "true" {
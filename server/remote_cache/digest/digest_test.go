@@ -115,6 +115,22 @@ func TestParseDownloadResourceName(t *testing.T) {
 			resourceName: "compressed-blobs/zstd/blake3/072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d/1234",
 			wantDRN:      newCompressedCASRN(&repb.Digest{Hash: "072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d", SizeBytes: 1234}, "", repb.DigestFunction_BLAKE3),
 		},
+		{ // DEFLATE compression
+			resourceName: "my_instance_name/compressed-blobs/deflate/072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d/1234",
+			wantDRN:      newCASRNWithCompressor(&repb.Digest{Hash: "072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d", SizeBytes: 1234}, "my_instance_name", repb.DigestFunction_SHA256, repb.Compressor_DEFLATE),
+		},
+		{ // BROTLI compression
+			resourceName: "compressed-blobs/brotli/blake3/072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d/1234",
+			wantDRN:      newCASRNWithCompressor(&repb.Digest{Hash: "072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d", SizeBytes: 1234}, "", repb.DigestFunction_BLAKE3, repb.Compressor_BROTLI),
+		},
+		{ // IDENTITY is not a valid compressed blob type
+			resourceName: "compressed-blobs/identity/072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d/1234",
+			wantError:    status.InvalidArgumentError(""),
+		},
+		{ // Compressor names must be lowercase
+			resourceName: "compressed-blobs/DEFLATE/072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d/1234",
+			wantError:    status.InvalidArgumentError(""),
+		},
 	}
 	for _, tc := range cases {
 		drn, err := digest.ParseDownloadResourceName(tc.resourceName)
@@ -260,8 +276,12 @@ func casrnsEqual(first *digest.CASResourceName, second *digest.CASResourceName)
 }
 
 func newCompressedCASRN(d *repb.Digest, instanceName string, digestFunction repb.DigestFunction_Value) *digest.CASResourceName {
+	return newCASRNWithCompressor(d, instanceName, digestFunction, repb.Compressor_ZSTD)
+}
+
+func newCASRNWithCompressor(d *repb.Digest, instanceName string, digestFunction repb.DigestFunction_Value, compressor repb.Compressor_Value) *digest.CASResourceName {
 	rn := digest.NewCASResourceName(d, instanceName, digestFunction)
-	rn.SetCompressor(repb.Compressor_ZSTD)
+	rn.SetCompressor(compressor)
 	return rn
 }
 
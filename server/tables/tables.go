@@ -845,6 +845,55 @@ func (*IPRule) TableName() string {
 	return "IPRules"
 }
 
+// EventSink is an HTTP endpoint that a group's build events are streamed to
+// while invocations are in progress.
+type EventSink struct {
+	Model
+	EventSinkID string `gorm:"primaryKey"`
+	GroupID     string `gorm:"index:event_sink_group_id_idx"`
+
+	// The URL that batches of events are POSTed to.
+	URL string `gorm:"not null"`
+
+	// The secret used to sign requests with HMAC-SHA256, encrypted with the
+	// KMS master key using the EventSinkID as associated data. If empty,
+	// requests are not signed.
+	EncryptedSecret []byte
+
+	// Comma-separated list of build event payload types to forward, using the
+	// names of the BuildEvent payload fields (e.g. "test_result,aborted").
+	// If empty, all events are forwarded.
+	EventTypes string `gorm:"not null;default:''"`
+
+	// The encoding of the request body: either "json" or "proto".
+	Format string `gorm:"not null;default:'json'"`
+}
+
+func (*EventSink) TableName() string {
+	return "EventSinks"
+}
+
+// EventSinkDeadLetter is a batch of build events that could not be delivered
+// to an event sink after exhausting all retries.
+type EventSinkDeadLetter struct {
+	Model
+	DeadLetterID string `gorm:"primaryKey"`
+	EventSinkID  string `gorm:"index:event_sink_dead_letter_event_sink_id_idx"`
+	GroupID      string `gorm:"index:event_sink_dead_letter_group_id_idx"`
+	InvocationID string
+
+	// The request body and content type of the undelivered batch.
+	ContentType string
+	Payload     []byte `gorm:"size:max"`
+
+	Attempts  int64
+	LastError string `gorm:"type:text"`
+}
+
+func (*EventSinkDeadLetter) TableName() string {
+	return "EventSinkDeadLetters"
+}
+
 type PostAutoMigrateLogic func() error
 
 // Manual migration called before auto-migration.
@@ -1332,7 +1381,9 @@ func RegisterTables() {
 	registerTable("AK", &APIKey{})
 	registerTable("CA", &CacheEntry{})
 	registerTable("CL", &CacheLog{})
+	registerTable("ED", &EventSinkDeadLetter{})
 	registerTable("EK", &EncryptionKey{})
+	registerTable("ES", &EventSink{})
 	registerTable("EV", &EncryptionKeyVersion{})
 	registerTable("EX", &Execution{})
 	registerTable("GH", &GitHubAppInstallation{})
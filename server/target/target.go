@@ -46,6 +46,9 @@ const (
 	// The number of distinct commits returned in GetTargetHistoryResponse.
 	targetHistoryPageSize = 40
 
+	// The maximum number of targets returned per page of target stats.
+	targetStatsMaxPageSize = 500
+
 	// The max number of targets returned in each TargetGroup page.
 	// TODO(bduffany): let the client set this. We want this to be 100 when on
 	// the Targets tab but 10 when on the overview tab.
@@ -625,6 +628,7 @@ func readPaginatedTargetsFromOLAPDB(ctx context.Context, env environment.Env, re
 		return nil, status.InvalidArgumentError("expected non empty repo_url")
 	}
 	branch := strings.TrimSpace(req.GetQuery().GetBranchName())
+	label := strings.TrimSpace(req.GetQuery().GetLabel())
 
 	groupID := req.GetRequestContext().GetGroupId()
 	if groupID == "" {
@@ -659,6 +663,9 @@ func readPaginatedTargetsFromOLAPDB(ctx context.Context, env environment.Env, re
 	if branch != "" {
 		innerCommitQuery.AddWhereClause("branch_name = ?", branch)
 	}
+	if label != "" {
+		innerCommitQuery.AddWhereClause("label = ?", label)
+	}
 	innerCommitQuery.SetGroupBy("commit_sha")
 	innerCommitQuery.SetOrderBy("latest_created_at_usec DESC, commit_sha", true /*=ascending*/)
 
@@ -685,6 +692,9 @@ func readPaginatedTargetsFromOLAPDB(ctx context.Context, env environment.Env, re
 	if branch != "" {
 		q.AddWhereClause("branch_name = ?", branch)
 	}
+	if label != "" {
+		q.AddWhereClause("label = ?", label)
+	}
 	q.SetOrderBy("label ASC, start_time_usec", false /*=ascending*/)
 	return fetchTargetsFromOLAPDB(ctx, env, q, repo, groupID)
 }
@@ -710,6 +720,18 @@ func readPaginatedTargetsFromPrimaryDB(ctx context.Context, env environment.Env,
 	commitQuery.AddWhereClause("role = ?", ciRole)
 	commitQuery.AddWhereClause("(command = ? OR command = ?)", testCommand, coverageCommand)
 	commitQuery.AddWhereClause("commit_sha != ''")
+	branch := strings.TrimSpace(req.GetQuery().GetBranchName())
+	if branch != "" {
+		commitQuery.AddWhereClause("branch_name = ?", branch)
+	}
+	label := strings.TrimSpace(req.GetQuery().GetLabel())
+	if label != "" {
+		// Only page over commits that ran the target.
+		commitQuery.AddWhereClause(`invocation_uuid IN (
+			SELECT ts.invocation_uuid FROM "TargetStatuses" AS ts
+			JOIN "Targets" AS t ON ts.target_id = t.target_id
+			WHERE t.group_id = ? AND t.label = ?)`, req.GetRequestContext().GetGroupId(), label)
+	}
 	paginationToken, err := NewTokenFromRequest(req)
 	if err != nil {
 		return nil, err
@@ -733,6 +755,9 @@ func readPaginatedTargetsFromPrimaryDB(ctx context.Context, env environment.Env,
 	if repo != "" {
 		joinQuery.AddWhereClause("inv.repo_url = ?", repo)
 	}
+	if branch != "" {
+		joinQuery.AddWhereClause("inv.branch_name = ?", branch)
+	}
 	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, env, joinQuery, "inv"); err != nil {
 		return nil, err
 	}
@@ -746,6 +771,9 @@ func readPaginatedTargetsFromPrimaryDB(ctx context.Context, env environment.Env,
 		FROM "Targets" as t
 		JOIN "TargetStatuses" as ts ON ts.target_id = t.target_id`)
 	q.AddJoinClause(joinQuery, "i", "ts.invocation_uuid = i.invocation_uuid")
+	if label != "" {
+		q.AddWhereClause("t.label = ?", label)
+	}
 	return fetchTargetsFromPrimaryDB(ctx, env, q, repo)
 }
 
@@ -869,6 +897,15 @@ func GetTargetStats(ctx context.Context, env environment.Env, req *trpb.GetTarge
 		return nil, status.UnimplementedError("Target stats requires an OLAP DB.")
 	}
 
+	pg, err := paging.DecodeOffsetLimit(req.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+	pg.Offset = max(pg.Offset, int64(0))
+	if pg.Limit <= 0 || pg.Limit > targetStatsMaxPageSize {
+		pg.Limit = targetStatsMaxPageSize
+	}
+
 	innerWhereClause := "group_id = ? AND cached = 0"
 	qArgs := []interface{}{u.GetGroupID()}
 
@@ -891,6 +928,7 @@ func GetTargetStats(ctx context.Context, env environment.Env, req *trpb.GetTarge
 	}
 
 	qArgs = append(qArgs, qArgs...)
+	qArgs = append(qArgs, pg.GetLimit()+1, pg.GetOffset())
 	qStr := `SELECT stats.label AS label, total_runs, successful_runs, flaky_runs,
 	    failed_runs, likely_flaky_runs, (flaky_duration_usec + likely_flaky_duration_usec) AS total_flake_runtime_usec, flaky_runs + likely_flaky_runs as total_flakes
 	FROM (
@@ -916,21 +954,27 @@ func GetTargetStats(ctx context.Context, env environment.Env, req *trpb.GetTarge
 				ORDER BY invocation_start_time_usec ASC
 				ROWS BETWEEN 1 PRECEDING AND 1 FOLLOWING))
 		WHERE (first_status BETWEEN 1 AND 2) AND (last_status BETWEEN 1 AND 2) AND status IN (3, 4) GROUP BY label) lf
-	ON lf.label=stats.label ORDER BY total_flakes DESC LIMIT 500`
+	ON lf.label=stats.label
+	WHERE total_flakes > 0
+	ORDER BY total_flakes DESC, label ASC LIMIT ? OFFSET ?`
 
 	rq := env.GetOLAPDBHandle().NewQuery(ctx, "get_target_stats").Raw(qStr, qArgs...)
 	type qRow struct {
 		Label                 string
 		FlakyRuns             int64
 		TotalRuns             int64
+		SuccessfulRuns        int64
 		FailedRuns            int64
 		LikelyFlakyRuns       int64
 		TotalFlakeRuntimeUsec int64
 	}
 
+	count := int64(0)
 	rsp := &trpb.GetTargetStatsResponse{}
 	db.ScanEach(rq, func(ctx context.Context, row *qRow) error {
-		if row.FlakyRuns+row.LikelyFlakyRuns == 0 {
+		// We fetch limit+1 rows just to see if there's going to be another page of results.
+		count++
+		if count > pg.GetLimit() {
 			return nil
 		}
 		out := &trpb.AggregateTargetStats{
@@ -938,6 +982,7 @@ func GetTargetStats(ctx context.Context, env environment.Env, req *trpb.GetTarge
 			Data: &trpb.TargetStatsData{
 				FlakyRuns:             row.FlakyRuns,
 				TotalRuns:             row.TotalRuns,
+				SuccessfulRuns:        row.SuccessfulRuns,
 				FailedRuns:            row.FailedRuns,
 				LikelyFlakyRuns:       row.LikelyFlakyRuns,
 				TotalFlakeRuntimeUsec: row.TotalFlakeRuntimeUsec,
@@ -946,6 +991,11 @@ func GetTargetStats(ctx context.Context, env environment.Env, req *trpb.GetTarge
 		rsp.Stats = append(rsp.Stats, out)
 		return nil
 	})
+	if count > pg.GetLimit() {
+		if rsp.NextPageToken, err = paging.EncodeOffsetLimit(&pgpb.OffsetLimit{Offset: pg.GetOffset() + pg.GetLimit(), Limit: pg.GetLimit()}); err != nil {
+			return nil, err
+		}
+	}
 	return rsp, nil
 }
 
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,7 +30,7 @@ func New(clock clockwork.Clock) *mockGCS {
 }
 
 // N.B. This implementation only mocks out the bits of GCS needed
-// to implement the pebble.PebbleGCSStorage interface.
+// to implement the filestore.PebbleGCSStorage interface.
 type mockGCS struct {
 	clock     clockwork.Clock
 	ageInDays int64
@@ -93,6 +95,33 @@ func (m *mockGCS) ConditionalWriter(ctx context.Context, blobName string, overwr
 	return cwc, nil
 }
 
+func (m *mockGCS) BlobExists(ctx context.Context, blobName string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.items[blobName]
+	return ok && !m.expired(blobName), nil
+}
+
+func (m *mockGCS) ListBlobs(ctx context.Context, prefix string, fn func(blobName string, lastModified time.Time) error) error {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.items))
+	lastModified := make(map[string]time.Time, len(m.items))
+	for name, blob := range m.items {
+		if strings.HasPrefix(name, prefix) && !m.expired(name) {
+			names = append(names, name)
+			lastModified[name] = blob.customTime
+		}
+	}
+	m.mu.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		if err := fn(name, lastModified[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *mockGCS) DeleteBlob(ctx context.Context, blobName string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
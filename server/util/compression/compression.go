@@ -1,15 +1,28 @@
 package compression
 
 import (
+	"bytes"
 	"errors"
 	"io"
+	"math"
 	"runtime"
 	"sync"
 
+	"github.com/andybalholm/brotli"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/klauspost/compress/flate"
 	"github.com/klauspost/compress/zstd"
 	"github.com/prometheus/client_golang/prometheus"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// maxConvertBufSizeBytes caps the size of the buffers used when
+	// compressing a stored blob on the fly.
+	maxConvertBufSizeBytes = 4e6 // 4 MB
 )
 
 var (
@@ -24,8 +37,12 @@ var (
 	zstdDecoderPool = NewZstdDecoderPool()
 
 	// These are used a bunch and the labels are constant so just do it once.
-	zstdCompressedBytesMetric   = metrics.BytesCompressed.With(prometheus.Labels{metrics.CompressionType: "zstd"})
-	zstdDecompressedBytesMetric = metrics.BytesDecompressed.With(prometheus.Labels{metrics.CompressionType: "zstd"})
+	zstdCompressedBytesMetric     = metrics.BytesCompressed.With(prometheus.Labels{metrics.CompressionType: "zstd"})
+	zstdDecompressedBytesMetric   = metrics.BytesDecompressed.With(prometheus.Labels{metrics.CompressionType: "zstd"})
+	flateCompressedBytesMetric    = metrics.BytesCompressed.With(prometheus.Labels{metrics.CompressionType: "deflate"})
+	flateDecompressedBytesMetric  = metrics.BytesDecompressed.With(prometheus.Labels{metrics.CompressionType: "deflate"})
+	brotliCompressedBytesMetric   = metrics.BytesCompressed.With(prometheus.Labels{metrics.CompressionType: "brotli"})
+	brotliDecompressedBytesMetric = metrics.BytesDecompressed.With(prometheus.Labels{metrics.CompressionType: "brotli"})
 )
 
 func mustGetZstdEncoder() *zstd.Encoder {
@@ -61,7 +78,7 @@ func DecompressZstd(dst []byte, src []byte) ([]byte, error) {
 	return buf, err
 }
 
-type zstdDecompressor struct {
+type pipeDecompressor struct {
 	pw   *io.PipeWriter
 	done chan error
 }
@@ -78,7 +95,7 @@ func NewZstdDecompressor(writer io.Writer) (io.WriteCloser, error) {
 	if err != nil {
 		return nil, err
 	}
-	d := &zstdDecompressor{
+	d := &pipeDecompressor{
 		pw:   pw,
 		done: make(chan error, 1),
 	}
@@ -97,11 +114,11 @@ func NewZstdDecompressor(writer io.Writer) (io.WriteCloser, error) {
 	return d, nil
 }
 
-func (d *zstdDecompressor) Write(p []byte) (int, error) {
+func (d *pipeDecompressor) Write(p []byte) (int, error) {
 	return d.pw.Write(p)
 }
 
-func (d *zstdDecompressor) Close() error {
+func (d *pipeDecompressor) Close() error {
 	var lastErr error
 	if err := d.pw.Close(); err != nil {
 		lastErr = err
@@ -288,3 +305,319 @@ func (p *ZstdDecoderPool) Put(ref *DecoderRef) error {
 	p.pool.Put(ref)
 	return nil
 }
+
+// ConvertBytes converts data that is stored with the given compressor into the
+// requested compressor. If the two compressors match, the data is returned
+// unmodified.
+func ConvertBytes(data []byte, stored, requested repb.Compressor_Value) ([]byte, error) {
+	if stored == requested {
+		return data, nil
+	}
+	decompressed, err := DecompressBytes(stored, data)
+	if err != nil {
+		return nil, err
+	}
+	return CompressBytes(requested, decompressed)
+}
+
+// readCloser combines a reader with the closer of the stream it wraps.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// NewConvertingReader wraps a reader over a stored blob and returns a reader
+// that serves the blob using the requested compressor, without transcoding
+// when the two compressors match.
+//
+// The offset and limit are in terms of the uncompressed blob. If the blob is
+// stored uncompressed, callers that can seek should apply the offset and limit
+// at the source and pass zero here. Passthrough of compressed data does not
+// support an offset or limit, matching the behavior of the other caches.
+//
+// sizeBytes is the uncompressed size of the blob, if known, and is used to
+// size the compression buffers.
+func NewConvertingReader(reader io.ReadCloser, stored, requested repb.Compressor_Value, offset, limit, sizeBytes int64) (io.ReadCloser, error) {
+	if stored == requested && stored != repb.Compressor_IDENTITY {
+		if offset != 0 || limit != 0 {
+			reader.Close()
+			return nil, status.FailedPreconditionError("passthrough compression does not support offset/limit")
+		}
+		return reader, nil
+	}
+	if stored != repb.Compressor_IDENTITY {
+		dr, err := NewDecompressingReader(stored, reader)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+		reader = dr
+	}
+	if offset != 0 {
+		if _, err := io.CopyN(io.Discard, reader, offset); err != nil {
+			reader.Close()
+			return nil, err
+		}
+	}
+	if limit != 0 {
+		reader = &readCloser{io.LimitReader(reader, limit), reader}
+	}
+	if requested == repb.Compressor_IDENTITY {
+		return reader, nil
+	}
+	bufSize := int64(maxConvertBufSizeBytes)
+	if sizeBytes > 0 && sizeBytes < bufSize {
+		bufSize = sizeBytes
+	}
+	cr, err := NewCompressingReader(requested, reader, bufSize)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return cr, nil
+}
+
+// CompressFlate compresses a chunk of data using raw DEFLATE (RFC 1951) at
+// the default level.
+func CompressFlate(src []byte) []byte {
+	flateCompressedBytesMetric.Add(float64(len(src)))
+	var buf bytes.Buffer
+	// NewWriter only fails for invalid compression levels.
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(src)
+	w.Close()
+	return buf.Bytes()
+}
+
+// DecompressFlate decompresses a full chunk of raw DEFLATE data. It returns an
+// InvalidArgument error if the data decompresses to more than maxSizeBytes.
+func DecompressFlate(src []byte, maxSizeBytes int64) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	buf, err := readAllLimited(r, maxSizeBytes)
+	flateDecompressedBytesMetric.Add(float64(len(buf)))
+	return buf, err
+}
+
+// CompressBrotli compresses a chunk of data using brotli (RFC 7932) at the
+// default level.
+func CompressBrotli(src []byte) []byte {
+	brotliCompressedBytesMetric.Add(float64(len(src)))
+	var buf bytes.Buffer
+	w := brotli.NewWriter(&buf)
+	w.Write(src)
+	w.Close()
+	return buf.Bytes()
+}
+
+// DecompressBrotli decompresses a full chunk of brotli data. It returns an
+// InvalidArgument error if the data decompresses to more than maxSizeBytes.
+func DecompressBrotli(src []byte, maxSizeBytes int64) ([]byte, error) {
+	buf, err := readAllLimited(brotli.NewReader(bytes.NewReader(src)), maxSizeBytes)
+	brotliDecompressedBytesMetric.Add(float64(len(buf)))
+	return buf, err
+}
+
+// readAllLimited reads r to completion, reading at most one byte past
+// maxSizeBytes so that oversized data is detected without buffering it.
+func readAllLimited(r io.Reader, maxSizeBytes int64) ([]byte, error) {
+	if maxSizeBytes < math.MaxInt64 {
+		r = io.LimitReader(r, maxSizeBytes+1)
+	}
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return buf, err
+	}
+	if int64(len(buf)) > maxSizeBytes {
+		return buf, status.InvalidArgumentErrorf("decompressed data exceeds %d bytes", maxSizeBytes)
+	}
+	return buf, nil
+}
+
+// CompressBytes compresses a chunk of data using the given compressor.
+// IDENTITY returns the data unmodified.
+func CompressBytes(compressor repb.Compressor_Value, src []byte) ([]byte, error) {
+	switch compressor {
+	case repb.Compressor_IDENTITY:
+		return src, nil
+	case repb.Compressor_ZSTD:
+		return CompressZstd(nil, src), nil
+	case repb.Compressor_DEFLATE:
+		return CompressFlate(src), nil
+	case repb.Compressor_BROTLI:
+		return CompressBrotli(src), nil
+	default:
+		return nil, status.UnimplementedErrorf("unsupported compressor %s", compressor)
+	}
+}
+
+// DecompressBytes decompresses a full chunk of data that was compressed with
+// the given compressor. IDENTITY returns the data unmodified.
+func DecompressBytes(compressor repb.Compressor_Value, src []byte) ([]byte, error) {
+	return DecompressBytesWithLimit(compressor, src, math.MaxInt64)
+}
+
+// DecompressBytesWithLimit is like DecompressBytes, but returns an
+// InvalidArgument error if the data decompresses to more than maxSizeBytes.
+func DecompressBytesWithLimit(compressor repb.Compressor_Value, src []byte, maxSizeBytes int64) ([]byte, error) {
+	switch compressor {
+	case repb.Compressor_IDENTITY:
+		return src, nil
+	case repb.Compressor_ZSTD:
+		buf, err := DecompressZstd(nil, src)
+		if err == nil && int64(len(buf)) > maxSizeBytes {
+			return nil, status.InvalidArgumentErrorf("decompressed data exceeds %d bytes", maxSizeBytes)
+		}
+		return buf, err
+	case repb.Compressor_DEFLATE:
+		return DecompressFlate(src, maxSizeBytes)
+	case repb.Compressor_BROTLI:
+		return DecompressBrotli(src, maxSizeBytes)
+	default:
+		return nil, status.UnimplementedErrorf("unsupported compressor %s", compressor)
+	}
+}
+
+// newStreamDecoder returns a reader that decodes the given stream, along with
+// the metric that tracks decompressed bytes.
+func newStreamDecoder(compressor repb.Compressor_Value, reader io.Reader) (io.Reader, prometheus.Counter, error) {
+	switch compressor {
+	case repb.Compressor_DEFLATE:
+		return flate.NewReader(reader), flateDecompressedBytesMetric, nil
+	case repb.Compressor_BROTLI:
+		return brotli.NewReader(reader), brotliDecompressedBytesMetric, nil
+	default:
+		return nil, nil, status.UnimplementedErrorf("unsupported compressor %s", compressor)
+	}
+}
+
+// newStreamEncoder returns a writer that encodes into the given writer, along
+// with the metric that tracks compressed bytes.
+func newStreamEncoder(compressor repb.Compressor_Value, writer io.Writer) (io.WriteCloser, prometheus.Counter, error) {
+	switch compressor {
+	case repb.Compressor_DEFLATE:
+		w, err := flate.NewWriter(writer, flate.DefaultCompression)
+		return w, flateCompressedBytesMetric, err
+	case repb.Compressor_BROTLI:
+		return brotli.NewWriter(writer), brotliCompressedBytesMetric, nil
+	default:
+		return nil, nil, status.UnimplementedErrorf("unsupported compressor %s", compressor)
+	}
+}
+
+// NewDecompressor returns a WriteCloser that accepts bytes compressed with the
+// given compressor, and streams the decompressed bytes to the given writer.
+//
+// As with NewZstdDecompressor, writes are not matched one-to-one with writes
+// to the underlying writer.
+func NewDecompressor(compressor repb.Compressor_Value, writer io.Writer) (io.WriteCloser, error) {
+	if compressor == repb.Compressor_ZSTD {
+		return NewZstdDecompressor(writer)
+	}
+	pr, pw := io.Pipe()
+	decoder, metric, err := newStreamDecoder(compressor, pr)
+	if err != nil {
+		return nil, err
+	}
+	d := &pipeDecompressor{
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+	go func() {
+		n, err := io.Copy(writer, decoder)
+		metric.Add(float64(n))
+		// Unblock any pending writes if decoding stopped early.
+		pr.CloseWithError(err)
+		d.done <- err
+		close(d.done)
+	}()
+	return d, nil
+}
+
+// NewDecompressingReader reads data compressed with the given compressor from
+// the input reader and makes the decompressed data available on the output
+// reader. Closing the output reader closes the input reader.
+func NewDecompressingReader(compressor repb.Compressor_Value, reader io.ReadCloser) (io.ReadCloser, error) {
+	if compressor == repb.Compressor_ZSTD {
+		return NewZstdDecompressingReader(reader)
+	}
+	decoder, metric, err := newStreamDecoder(compressor, reader)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloser{&countingReader{decoder, metric}, reader}, nil
+}
+
+type countingReader struct {
+	io.Reader
+	metric prometheus.Counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.metric.Add(float64(n))
+	return n, err
+}
+
+// NewCompressingReader returns a reader that makes the contents of the given
+// reader available compressed with the given compressor. bufSize is the size
+// of the buffers used to read from the input reader, and should be large
+// enough to get a good compression ratio.
+func NewCompressingReader(compressor repb.Compressor_Value, reader io.ReadCloser, bufSize int64) (io.ReadCloser, error) {
+	if bufSize <= 0 {
+		return nil, io.ErrShortBuffer
+	}
+	if compressor == repb.Compressor_ZSTD {
+		return NewZstdCompressingReader(reader, make([]byte, bufSize), make([]byte, bufSize))
+	}
+	r := &streamCompressingReader{
+		inputReader: reader,
+		readBuf:     make([]byte, bufSize),
+	}
+	encoder, metric, err := newStreamEncoder(compressor, &r.compressed)
+	if err != nil {
+		return nil, err
+	}
+	r.encoder = encoder
+	r.metric = metric
+	return r, nil
+}
+
+// streamCompressingReader compresses the input reader using a streaming
+// encoder, buffering compressed output until it is read.
+type streamCompressingReader struct {
+	inputReader io.ReadCloser
+	encoder     io.WriteCloser
+	metric      prometheus.Counter
+	readBuf     []byte
+	compressed  bytes.Buffer
+	eof         bool
+}
+
+func (r *streamCompressingReader) Read(p []byte) (int, error) {
+	for r.compressed.Len() == 0 && !r.eof {
+		n, err := r.inputReader.Read(r.readBuf)
+		if n > 0 {
+			r.metric.Add(float64(n))
+			if _, err := r.encoder.Write(r.readBuf[:n]); err != nil {
+				return 0, err
+			}
+		}
+		if err == io.EOF {
+			if err := r.encoder.Close(); err != nil {
+				return 0, err
+			}
+			r.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if r.compressed.Len() == 0 {
+		return 0, io.EOF
+	}
+	return r.compressed.Read(p)
+}
+
+func (r *streamCompressingReader) Close() error {
+	return r.inputReader.Close()
+}
@@ -10,8 +10,11 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
 	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 )
 
 func TestLossless(t *testing.T) {
@@ -221,3 +224,181 @@ func TestCompressingReader_HoldErrors(t *testing.T) {
 	require.Error(t, err)
 	require.ErrorIs(t, err, errorToReturn)
 }
+
+func TestConvertBytes(t *testing.T) {
+	_, r := testdigest.NewReader(t, 1000)
+	src, err := io.ReadAll(r)
+	require.NoError(t, err)
+	compressed := compression.CompressZstd(nil, src)
+
+	for _, tc := range []struct {
+		stored    repb.Compressor_Value
+		requested repb.Compressor_Value
+		data      []byte
+	}{
+		{repb.Compressor_IDENTITY, repb.Compressor_IDENTITY, src},
+		{repb.Compressor_IDENTITY, repb.Compressor_ZSTD, src},
+		{repb.Compressor_ZSTD, repb.Compressor_IDENTITY, compressed},
+		{repb.Compressor_ZSTD, repb.Compressor_ZSTD, compressed},
+	} {
+		t.Run(fmt.Sprintf("%s_to_%s", tc.stored, tc.requested), func(t *testing.T) {
+			out, err := compression.ConvertBytes(tc.data, tc.stored, tc.requested)
+			require.NoError(t, err)
+			if tc.requested == repb.Compressor_ZSTD {
+				out, err = compression.DecompressZstd(nil, out)
+				require.NoError(t, err)
+			}
+			require.Empty(t, cmp.Diff(src, out))
+		})
+	}
+}
+
+func TestConvertingReader(t *testing.T) {
+	_, r := testdigest.NewReader(t, 1000)
+	src, err := io.ReadAll(r)
+	require.NoError(t, err)
+	compressed := compression.CompressZstd(nil, src)
+
+	for _, tc := range []struct {
+		stored    repb.Compressor_Value
+		requested repb.Compressor_Value
+		offset    int64
+		limit     int64
+	}{
+		{repb.Compressor_IDENTITY, repb.Compressor_IDENTITY, 0, 0},
+		{repb.Compressor_IDENTITY, repb.Compressor_ZSTD, 0, 0},
+		{repb.Compressor_ZSTD, repb.Compressor_IDENTITY, 0, 0},
+		{repb.Compressor_ZSTD, repb.Compressor_ZSTD, 0, 0},
+		{repb.Compressor_ZSTD, repb.Compressor_IDENTITY, 100, 0},
+		{repb.Compressor_ZSTD, repb.Compressor_IDENTITY, 100, 50},
+		{repb.Compressor_IDENTITY, repb.Compressor_ZSTD, 100, 50},
+	} {
+		name := fmt.Sprintf("%s_to_%s_offset_%d_limit_%d", tc.stored, tc.requested, tc.offset, tc.limit)
+		t.Run(name, func(t *testing.T) {
+			stored := src
+			if tc.stored == repb.Compressor_ZSTD {
+				stored = compressed
+			}
+			rc, err := compression.NewConvertingReader(io.NopCloser(bytes.NewReader(stored)), tc.stored, tc.requested, tc.offset, tc.limit, int64(len(src)))
+			require.NoError(t, err)
+			out, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+			if tc.requested == repb.Compressor_ZSTD {
+				out, err = compression.DecompressZstd(nil, out)
+				require.NoError(t, err)
+			}
+			expected := src[tc.offset:]
+			if tc.limit != 0 {
+				expected = expected[:tc.limit]
+			}
+			require.Empty(t, cmp.Diff(expected, out))
+		})
+	}
+}
+
+func TestConvertingReader_PassthroughOffset(t *testing.T) {
+	compressed := compression.CompressZstd(nil, []byte("hello world"))
+	_, err := compression.NewConvertingReader(io.NopCloser(bytes.NewReader(compressed)), repb.Compressor_ZSTD, repb.Compressor_ZSTD, 1, 0, 11)
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+}
+
+func TestStreamingCompressors(t *testing.T) {
+	for _, compressor := range []repb.Compressor_Value{repb.Compressor_ZSTD, repb.Compressor_DEFLATE, repb.Compressor_BROTLI} {
+		for _, size := range []int64{1, 1000, 1e5} {
+			t.Run(fmt.Sprintf("%s/%d", compressor, size), func(t *testing.T) {
+				_, r := testdigest.NewReader(t, size)
+				src, err := io.ReadAll(r)
+				require.NoError(t, err)
+
+				compressed, err := compression.CompressBytes(compressor, src)
+				require.NoError(t, err)
+				out, err := compression.DecompressBytes(compressor, compressed)
+				require.NoError(t, err)
+				require.Empty(t, cmp.Diff(src, out))
+
+				// Compress with a small buffer so that the input is read in
+				// several chunks.
+				cr, err := compression.NewCompressingReader(compressor, io.NopCloser(bytes.NewReader(src)), 1024)
+				require.NoError(t, err)
+				streamCompressed, err := io.ReadAll(cr)
+				require.NoError(t, err)
+				require.NoError(t, cr.Close())
+
+				dr, err := compression.NewDecompressingReader(compressor, io.NopCloser(bytes.NewReader(streamCompressed)))
+				require.NoError(t, err)
+				out, err = io.ReadAll(dr)
+				require.NoError(t, err)
+				require.NoError(t, dr.Close())
+				require.Empty(t, cmp.Diff(src, out))
+
+				var buf bytes.Buffer
+				d, err := compression.NewDecompressor(compressor, &buf)
+				require.NoError(t, err)
+				for chunk := compressed; len(chunk) > 0; {
+					n := min(len(chunk), 100)
+					_, err := d.Write(chunk[:n])
+					require.NoError(t, err)
+					chunk = chunk[n:]
+				}
+				require.NoError(t, d.Close())
+				require.Empty(t, cmp.Diff(src, buf.Bytes()))
+			})
+		}
+	}
+}
+
+func TestDecompressBytesWithLimit(t *testing.T) {
+	for _, compressor := range []repb.Compressor_Value{repb.Compressor_ZSTD, repb.Compressor_DEFLATE, repb.Compressor_BROTLI} {
+		t.Run(compressor.String(), func(t *testing.T) {
+			src := bytes.Repeat([]byte("a"), 10_000)
+			compressed, err := compression.CompressBytes(compressor, src)
+			require.NoError(t, err)
+
+			out, err := compression.DecompressBytesWithLimit(compressor, compressed, int64(len(src)))
+			require.NoError(t, err)
+			require.Empty(t, cmp.Diff(src, out))
+
+			_, err = compression.DecompressBytesWithLimit(compressor, compressed, int64(len(src)-1))
+			require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+		})
+	}
+}
+
+func TestDecompressor_CorruptData(t *testing.T) {
+	for _, compressor := range []repb.Compressor_Value{repb.Compressor_DEFLATE, repb.Compressor_BROTLI} {
+		t.Run(compressor.String(), func(t *testing.T) {
+			compressed, err := compression.CompressBytes(compressor, []byte("hello world, hello world"))
+			require.NoError(t, err)
+			truncated := compressed[:len(compressed)/2]
+
+			_, err = compression.DecompressBytes(compressor, truncated)
+			require.Error(t, err)
+
+			d, err := compression.NewDecompressor(compressor, io.Discard)
+			require.NoError(t, err)
+			_, _ = d.Write(truncated)
+			require.Error(t, d.Close())
+		})
+	}
+}
+
+func TestConvertBytes_AcrossCompressors(t *testing.T) {
+	src := []byte("hello world, hello world, hello world")
+	deflated := compression.CompressFlate(src)
+
+	brotli, err := compression.ConvertBytes(deflated, repb.Compressor_DEFLATE, repb.Compressor_BROTLI)
+	require.NoError(t, err)
+	out, err := compression.DecompressBrotli(brotli, int64(len(src)))
+	require.NoError(t, err)
+	require.Empty(t, cmp.Diff(src, out))
+
+	rc, err := compression.NewConvertingReader(io.NopCloser(bytes.NewReader(deflated)), repb.Compressor_DEFLATE, repb.Compressor_ZSTD, 6, 5, int64(len(src)))
+	require.NoError(t, err)
+	zstd, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	out, err = compression.DecompressZstd(nil, zstd)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(out))
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/pprof"
 	"runtime"
+	"sync"
 
 	"github.com/VictoriaMetrics/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
@@ -33,17 +34,46 @@ const (
 	acceptEncodingKey = "Accept-Encoding"
 )
 
+var (
+	authenticatedHandlersMu sync.Mutex
+	authenticatedHandlers   = map[string]http.Handler{}
+)
+
+// RegisterAuthenticatedHandler registers a handler to be served on the
+// monitoring port(s). Since these handlers may change server state, requests
+// are rejected unless basic auth is configured for the monitoring port. It
+// must be called before the monitoring handlers are registered.
+func RegisterAuthenticatedHandler(pattern string, handler http.Handler) {
+	authenticatedHandlersMu.Lock()
+	defer authenticatedHandlersMu.Unlock()
+	authenticatedHandlers[pattern] = handler
+}
+
+func forbiddenHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "monitoring.basic_auth must be configured to use this endpoint", http.StatusForbidden)
+}
+
 // Registers monitoring handlers on the provided mux. Note that using
 // StartMonitoringHandler on a monitoring-only port is preferred.
 func RegisterMonitoringHandlers(env environment.Env, mux *http.ServeMux) {
 	handle := mux.Handle
-	if *basicAuthUser != "" || *basicAuthPass != "" {
+	authEnabled := *basicAuthUser != "" || *basicAuthPass != ""
+	if authEnabled {
 		auth := basicauth.Middleware(basicauth.DefaultRealm, map[string]string{*basicAuthUser: *basicAuthPass})
 		handle = func(pattern string, handler http.Handler) {
 			mux.Handle(pattern, auth(handler))
 		}
 	}
 
+	authenticatedHandlersMu.Lock()
+	for pattern, handler := range authenticatedHandlers {
+		if !authEnabled {
+			handler = http.HandlerFunc(forbiddenHandler)
+		}
+		handle(pattern, handler)
+	}
+	authenticatedHandlersMu.Unlock()
+
 	// Prometheus metrics
 	handle("/metrics", metricsHandler())
 
@@ -24,6 +24,18 @@ import (
 	gstatus "google.golang.org/grpc/status"
 )
 
+// ErrPreempted is the cause with which the context of a running task is
+// canceled when the task is preempted to make room for a higher-priority task.
+// Preempted tasks are re-enqueued without counting as a failed attempt.
+var ErrPreempted = status.AbortedError("task was preempted by a higher-priority task")
+
+const (
+	// Suffixes appended to execution IDs to form the resource names of
+	// their output streams.
+	stdoutStreamSuffix = "stdout"
+	stderrStreamSuffix = "stderr"
+)
+
 // MakeEnv assembles a list of EnvironmentVariable protos from a list of
 // NAME=VALUE pairs. If the same name is specified more than once, the last one
 // wins. The entries are sorted by name, so that the environment variables are
@@ -395,6 +407,32 @@ func AuxiliaryMetadata(md *repb.ExecutedActionMetadata, pb proto.Message) (ok bo
 	return false, nil
 }
 
+// OutputStreamNames returns the ByteStream resource names that can be used to
+// read the stdout and stderr of an execution while it is running. These are
+// advertised in the ExecuteOperationMetadata of executions whose output is
+// being streamed.
+func OutputStreamNames(executionID string) (stdout, stderr string) {
+	return executionID + "/" + stdoutStreamSuffix, executionID + "/" + stderrStreamSuffix
+}
+
+// ParseOutputStreamName parses a resource name returned by OutputStreamNames.
+// It returns the execution ID and whether the name refers to stderr rather
+// than stdout, or ok=false if the name is not an output stream name.
+func ParseOutputStreamName(name string) (executionID string, stderr bool, ok bool) {
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return "", false, false
+	}
+	executionID, suffix := name[:i], name[i+1:]
+	if suffix != stdoutStreamSuffix && suffix != stderrStreamSuffix {
+		return "", false, false
+	}
+	if _, err := digest.ParseUploadResourceName(executionID); err != nil {
+		return "", false, false
+	}
+	return executionID, suffix == stderrStreamSuffix, true
+}
+
 // Retryable returns false if the error is a configuration error
 // that will persist, even despite retries.
 func Retryable(err error) bool {
@@ -403,3 +441,16 @@ func Retryable(err error) bool {
 		status.IsUnauthenticatedError(err)
 	return !taskMisconfigured
 }
+
+// Preempted returns whether the context of a running task was canceled because
+// the task was preempted.
+func Preempted(ctx context.Context) bool {
+	return IsPreemptedError(context.Cause(ctx))
+}
+
+// IsPreemptedError returns whether the error is ErrPreempted.
+func IsPreemptedError(err error) bool {
+	// Compare by identity rather than using errors.Is, which would match any
+	// status error with the same code and message.
+	return err == ErrPreempted
+}
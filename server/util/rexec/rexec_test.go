@@ -1,11 +1,13 @@
 package rexec_test
 
 import (
+	"context"
 	"testing"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/rexec"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/testing/protocmp"
@@ -110,3 +112,46 @@ func TestNormalizeCommand(t *testing.T) {
 		})
 	}
 }
+
+func TestOutputStreamNames(t *testing.T) {
+	executionID := "instance/uploads/d6b8ea5d-3a3b-4d70-a3f4-30d4bb1e2c1f/blobs/blake3/4f5a3e1c0d7c7a8bb8a2b61f8d1f3f4e3b6f8e1e4f6b7d3c2a1b0f9e8d7c6b5a/142"
+	stdout, stderr := rexec.OutputStreamNames(executionID)
+	require.Equal(t, executionID+"/stdout", stdout)
+	require.Equal(t, executionID+"/stderr", stderr)
+
+	id, isStderr, ok := rexec.ParseOutputStreamName(stdout)
+	require.True(t, ok)
+	require.Equal(t, executionID, id)
+	require.False(t, isStderr)
+
+	id, isStderr, ok = rexec.ParseOutputStreamName(stderr)
+	require.True(t, ok)
+	require.Equal(t, executionID, id)
+	require.True(t, isStderr)
+
+	for _, name := range []string{
+		"",
+		"stdout",
+		executionID,
+		executionID + "/stdin",
+		"instance/blobs/4f5a3e1c0d7c7a8bb8a2b61f8d1f3f4e3b6f8e1e4f6b7d3c2a1b0f9e8d7c6b5a/142/stdout",
+	} {
+		_, _, ok := rexec.ParseOutputStreamName(name)
+		require.False(t, ok, "ParseOutputStreamName(%q)", name)
+	}
+}
+
+func TestPreempted(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	require.False(t, rexec.Preempted(ctx))
+	cancel(rexec.ErrPreempted)
+	childCtx, childCancel := context.WithCancel(ctx)
+	defer childCancel()
+	require.True(t, rexec.Preempted(ctx))
+	require.True(t, rexec.Preempted(childCtx))
+
+	ctx, cancel = context.WithCancelCause(context.Background())
+	cancel(nil)
+	require.False(t, rexec.Preempted(ctx))
+	require.False(t, rexec.IsPreemptedError(status.AbortedError("context canceled")))
+}